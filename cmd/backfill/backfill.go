@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"github.com/mcncl/buildkite-pubsub/pkg/transform"
+)
+
+// defaultAPIURL is the Buildkite REST API base URL
+const defaultAPIURL = "https://api.buildkite.com/v2"
+
+// defaultRateLimitWait is how long to wait after a 429 without RateLimit-Reset
+const defaultRateLimitWait = 10 * time.Second
+
+// maxRateLimitRetries bounds consecutive 429 responses for one page
+const maxRateLimitRetries = 5
+
+// nextLinkPattern extracts the rel="next" URL from a Link header
+var nextLinkPattern = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// query selects the builds to backfill
+type query struct {
+	Org      string
+	Pipeline string // empty selects every pipeline in the organization
+	From     time.Time
+	To       time.Time
+	PerPage  int
+}
+
+// apiBuild is a build as returned by the REST API, which nests the pipeline
+// inside the build rather than alongside it as webhook payloads do
+type apiBuild struct {
+	transform.Build
+	Pipeline transform.Pipeline `json:"pipeline"`
+}
+
+// payload converts the build to the webhook payload Buildkite would have
+// sent for its current state
+func (b apiBuild) payload() transform.Payload {
+	return transform.Payload{
+		Event:    eventForState(b.State),
+		Build:    b.Build,
+		Pipeline: b.Pipeline,
+		Sender:   b.Creator,
+	}
+}
+
+// eventForState maps a build state to the webhook event announcing it
+func eventForState(state string) string {
+	switch state {
+	case "passed", "failed", "canceled", "skipped", "not_run", "blocked":
+		return "build.finished"
+	case "running", "failing", "canceling":
+		return "build.running"
+	default:
+		return "build.scheduled"
+	}
+}
+
+// apiClient pages through builds in the Buildkite REST API
+type apiClient struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+	logger     *slog.Logger
+	// sleep waits between rate-limited requests; replaced in tests
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// buildsURL returns the first page URL for the query
+func (c *apiClient) buildsURL(q query) string {
+	path := fmt.Sprintf("%s/organizations/%s/builds", c.baseURL, url.PathEscape(q.Org))
+	if q.Pipeline != "" {
+		path = fmt.Sprintf("%s/organizations/%s/pipelines/%s/builds", c.baseURL, url.PathEscape(q.Org), url.PathEscape(q.Pipeline))
+	}
+
+	params := url.Values{}
+	if !q.From.IsZero() {
+		params.Set("created_from", q.From.UTC().Format(time.RFC3339))
+	}
+	if !q.To.IsZero() {
+		params.Set("created_to", q.To.UTC().Format(time.RFC3339))
+	}
+	if q.PerPage > 0 {
+		params.Set("per_page", strconv.Itoa(q.PerPage))
+	}
+	if len(params) == 0 {
+		return path
+	}
+	return path + "?" + params.Encode()
+}
+
+// fetch returns one page of builds and the URL of the next page, if any
+func (c *apiClient) fetch(ctx context.Context, pageURL string) ([]apiBuild, string, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to build request: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+c.token)
+		req.Header.Set("Accept", "application/json")
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return nil, "", fmt.Errorf("builds request failed: %w", err)
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < maxRateLimitRetries {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+
+			wait := defaultRateLimitWait
+			if secs, err := strconv.Atoi(resp.Header.Get("RateLimit-Reset")); err == nil && secs > 0 {
+				wait = time.Duration(secs) * time.Second
+			}
+			c.logger.Warn("Buildkite API rate limit reached, waiting", "wait", wait)
+			if err := c.sleep(ctx, wait); err != nil {
+				return nil, "", err
+			}
+			continue
+		}
+
+		builds, err := decodeBuilds(resp)
+		if err != nil {
+			return nil, "", err
+		}
+
+		var next string
+		if m := nextLinkPattern.FindStringSubmatch(resp.Header.Get("Link")); m != nil {
+			next = m[1]
+		}
+		return builds, next, nil
+	}
+}
+
+// decodeBuilds reads a builds response, closing its body
+func decodeBuilds(resp *http.Response) ([]apiBuild, error) {
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("buildkite API returned status %d: %s", resp.StatusCode, body)
+	}
+
+	var builds []apiBuild
+	if err := json.NewDecoder(resp.Body).Decode(&builds); err != nil {
+		return nil, fmt.Errorf("failed to decode builds: %w", err)
+	}
+	return builds, nil
+}
+
+// sleepContext waits for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// backfiller transforms historical builds and publishes them like webhooks
+type backfiller struct {
+	client *apiClient
+	pub    publisher.Publisher
+	logger *slog.Logger
+	// schemaVersion is passed to transform.WithSchemaVersion when set
+	schemaVersion string
+	// legacyPipeline publishes the pipeline's display name as the pipeline
+	// attribute, like a webhook with LegacyPipelineAttribute
+	legacyPipeline bool
+}
+
+// result counts what a backfill did
+type result struct {
+	Published int
+	Failed    int
+}
+
+// run publishes every build matching the query, continuing past builds that
+// fail so one bad build does not stop the import
+func (b *backfiller) run(ctx context.Context, q query) (result, error) {
+	var res result
+	for pageURL := b.client.buildsURL(q); pageURL != ""; {
+		builds, next, err := b.client.fetch(ctx, pageURL)
+		if err != nil {
+			return res, err
+		}
+
+		for _, build := range builds {
+			logger := b.logger.With("build_id", build.ID, "pipeline", build.Pipeline.Slug, "number", build.Number)
+			msgID, err := b.publish(ctx, build)
+			if err != nil {
+				res.Failed++
+				logger.Error("Failed to backfill build", "error", err)
+				continue
+			}
+			res.Published++
+			logger.Debug("Backfilled build", "message_id", msgID)
+		}
+
+		b.logger.Info("Backfilled page", "builds", len(builds), "published", res.Published, "failed", res.Failed)
+		pageURL = next
+	}
+	return res, nil
+}
+
+// publish transforms a build and publishes it with the attributes the
+// webhook would set, plus backfill=true and delivery_mode=backfilled
+func (b *backfiller) publish(ctx context.Context, build apiBuild) (string, error) {
+	var opts []transform.Option
+	if b.schemaVersion != "" {
+		opts = append(opts, transform.WithSchemaVersion(b.schemaVersion))
+	}
+	transformed, err := transform.Transform(build.payload(), opts...)
+	if err != nil {
+		return "", fmt.Errorf("failed to transform build: %w", err)
+	}
+
+	pipeline := transformed.Build.Pipeline
+	if pipeline == "" {
+		pipeline = transformed.Pipeline.Name
+	}
+	pipeline = subscriber.Slug(pipeline)
+	if b.legacyPipeline {
+		pipeline = transformed.Pipeline.Name
+	}
+	attributes := map[string]string{
+		"origin":      "buildkite-webhook",
+		"event_type":  transformed.EventType,
+		"pipeline":    pipeline,
+		"build_state": transformed.Build.State,
+		"branch":      transformed.Build.Branch,
+		"backfill":    "true",
+	}
+	if transformed.Build.Organization != "" {
+		attributes[subscriber.OrganizationAttribute] = subscriber.Slug(transformed.Build.Organization)
+	}
+	if transformed.Build.ClusterID != "" {
+		attributes["cluster_id"] = transformed.Build.ClusterID
+	}
+	if transformed.Build.NormalizedState != "" {
+		attributes["normalized_state"] = transformed.Build.NormalizedState
+		attributes["is_terminal"] = strconv.FormatBool(transformed.Build.IsTerminal)
+		attributes["is_retry"] = strconv.FormatBool(transformed.Build.IsRetry)
+		attributes["is_blocked"] = strconv.FormatBool(transformed.Build.IsBlocked)
+	}
+	attributes[subscriber.DeliveryModeAttribute] = subscriber.DeliveryModeBackfilled
+	attributes[subscriber.PublishedAtAttribute] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	return b.pub.Publish(ctx, transformed, attributes)
+}
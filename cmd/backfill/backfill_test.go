@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"github.com/mcncl/buildkite-pubsub/pkg/transform"
+)
+
+func TestEventForState(t *testing.T) {
+	tests := map[string]string{
+		"passed":    "build.finished",
+		"failed":    "build.finished",
+		"canceled":  "build.finished",
+		"running":   "build.running",
+		"failing":   "build.running",
+		"scheduled": "build.scheduled",
+		"":          "build.scheduled",
+	}
+	for state, want := range tests {
+		if got := eventForState(state); got != want {
+			t.Errorf("eventForState(%q) = %q, want %q", state, got, want)
+		}
+	}
+}
+
+func TestBuildsURL(t *testing.T) {
+	c := &apiClient{baseURL: "https://api.example.com/v2"}
+	q := query{
+		Org:      "acme",
+		Pipeline: "deploy",
+		From:     time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		PerPage:  50,
+	}
+
+	want := "https://api.example.com/v2/organizations/acme/pipelines/deploy/builds?created_from=2024-01-01T00%3A00%3A00Z&per_page=50"
+	if got := c.buildsURL(q); got != want {
+		t.Errorf("buildsURL() = %q, want %q", got, want)
+	}
+
+	if got := c.buildsURL(query{Org: "acme"}); got != "https://api.example.com/v2/organizations/acme/builds" {
+		t.Errorf("buildsURL() without pipeline = %q", got)
+	}
+}
+
+func TestBackfillRun(t *testing.T) {
+	const build = `{
+		"id": "%s",
+		"number": %d,
+		"state": "%s",
+		"branch": "main",
+		"created_at": "2024-01-02T03:04:05Z",
+		"creator": {"id": "u1", "name": "Test User"},
+		"pipeline": {"slug": "deploy", "name": "Deploy", "url": "https://api.buildkite.com/v2/organizations/acme/pipelines/deploy"}
+	}`
+
+	var requests int
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if got := r.Header.Get("Authorization"); got != "Bearer api-token" {
+			t.Errorf("Authorization = %q, want bearer token", got)
+		}
+
+		switch r.URL.Query().Get("page") {
+		case "":
+			if requests == 1 {
+				// Exercise rate limit handling on the first request
+				w.Header().Set("RateLimit-Reset", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.Header().Set("Link", fmt.Sprintf(`<%s/organizations/acme/pipelines/deploy/builds?page=2>; rel="next"`, srv.URL))
+			_, _ = fmt.Fprintf(w, "[%s]", fmt.Sprintf(build, "b2", 2, "passed"))
+		case "2":
+			_, _ = fmt.Fprintf(w, "[%s]", fmt.Sprintf(build, "b1", 1, "running"))
+		default:
+			t.Errorf("unexpected page %q", r.URL.Query().Get("page"))
+		}
+	}))
+	defer srv.Close()
+
+	var waited time.Duration
+	pub := publisher.NewMockPublisher().(*publisher.MockPublisher)
+	b := &backfiller{
+		client: &apiClient{
+			baseURL:    srv.URL,
+			token:      "api-token",
+			httpClient: srv.Client(),
+			logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+			sleep: func(ctx context.Context, d time.Duration) error {
+				waited += d
+				return nil
+			},
+		},
+		pub:    pub,
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	res, err := b.run(context.Background(), query{Org: "acme", Pipeline: "deploy"})
+	if err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if res.Published != 2 || res.Failed != 0 {
+		t.Errorf("run() = %+v, want 2 published", res)
+	}
+	if waited != time.Second {
+		t.Errorf("waited %v after rate limit, want 1s", waited)
+	}
+
+	published := pub.GetPublished()
+	if len(published) != 2 {
+		t.Fatalf("published %d messages, want 2", len(published))
+	}
+
+	first := published[0]
+	if first.Attributes["backfill"] != "true" || first.Attributes[subscriber.DeliveryModeAttribute] != subscriber.DeliveryModeBackfilled {
+		t.Errorf("backfill attributes = %q, %q, want true, backfilled", first.Attributes["backfill"], first.Attributes[subscriber.DeliveryModeAttribute])
+	}
+	if first.Attributes["pipeline"] != "deploy" || first.Attributes[subscriber.OrganizationAttribute] != "acme" {
+		t.Errorf("pipeline, organization = %q, %q, want deploy, acme", first.Attributes["pipeline"], first.Attributes[subscriber.OrganizationAttribute])
+	}
+	if first.Attributes["event_type"] != "build.finished" {
+		t.Errorf("event_type = %q, want build.finished", first.Attributes["event_type"])
+	}
+	transformed, ok := first.Data.(transform.TransformedPayload)
+	if !ok {
+		t.Fatalf("published data is %T, want transform.TransformedPayload", first.Data)
+	}
+	if transformed.Build.Organization != "acme" || transformed.Build.Pipeline != "deploy" {
+		t.Errorf("build = %+v, want organization acme and pipeline deploy", transformed.Build)
+	}
+	if published[1].Attributes["event_type"] != "build.running" {
+		t.Errorf("second event_type = %q, want build.running", published[1].Attributes["event_type"])
+	}
+}
+
+func TestBackfillRunAPIError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message":"Forbidden"}`, http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	b := &backfiller{
+		client: &apiClient{baseURL: srv.URL, httpClient: srv.Client(), logger: slog.New(slog.NewTextHandler(io.Discard, nil))},
+		pub:    publisher.NewMockPublisher(),
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	if _, err := b.run(context.Background(), query{Org: "acme"}); err == nil {
+		t.Error("run() expected error for forbidden response")
+	}
+}
@@ -0,0 +1,105 @@
+// Command backfill imports historical builds from the Buildkite REST API. It
+// pages through an organization's or pipeline's builds within a date range,
+// transforms each one exactly as the webhook does and publishes it to the
+// topic with a backfill=true attribute, so new consumers can bootstrap
+// historical data.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/logging"
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+)
+
+func main() {
+	projectID := flag.String("project", os.Getenv("PROJECT_ID"), "Google Cloud project ID (defaults to $PROJECT_ID)")
+	topicID := flag.String("topic", os.Getenv("TOPIC_ID"), "Pub/Sub topic ID (defaults to $TOPIC_ID)")
+	apiToken := flag.String("api-token", os.Getenv("BUILDKITE_API_TOKEN"), "Buildkite API token with read_builds scope (defaults to $BUILDKITE_API_TOKEN)")
+	apiURL := flag.String("api-url", defaultAPIURL, "Buildkite REST API base URL")
+	org := flag.String("org", "", "Buildkite organization slug")
+	pipeline := flag.String("pipeline", "", "Pipeline slug (empty imports every pipeline in the organization)")
+	from := flag.String("from", "", "Import builds created at or after this date (YYYY-MM-DD or RFC3339)")
+	to := flag.String("to", "", "Import builds created before this date (YYYY-MM-DD or RFC3339)")
+	perPage := flag.Int("per-page", 100, "Builds requested per API page (max 100)")
+	schemaVersion := flag.String("schema-version", os.Getenv("SCHEMA_VERSION"), "Message schema version, matching the webhook's (defaults to $SCHEMA_VERSION)")
+	legacyPipeline := flag.Bool("legacy-pipeline-attribute", os.Getenv("LEGACY_PIPELINE_ATTRIBUTE") == "true", "Publish the pipeline's display name as the pipeline attribute, matching the webhook's (defaults to $LEGACY_PIPELINE_ATTRIBUTE)")
+	logLevel := flag.String("log-level", "info", "Log level (debug, info, warn, error)")
+	logFormat := flag.String("log-format", "text", "Log format (json, text, dev)")
+	flag.Parse()
+
+	logger := logging.NewLogger(*logLevel, *logFormat)
+
+	if *projectID == "" || *topicID == "" || *apiToken == "" || *org == "" {
+		fmt.Fprintln(os.Stderr, "-project, -topic, -api-token and -org are required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	q := query{Org: *org, Pipeline: *pipeline, PerPage: *perPage}
+	var err error
+	if q.From, err = parseDate(*from); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -from: %v\n", err)
+		os.Exit(2)
+	}
+	if q.To, err = parseDate(*to); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -to: %v\n", err)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	pubsubPub, err := publisher.NewPubSubPublisher(ctx, *projectID, *topicID)
+	if err != nil {
+		logger.Error("Failed to create publisher", "error", err)
+		os.Exit(1)
+	}
+	pub := publisher.NewAttributeGuardPublisher(pubsubPub, nil)
+	defer func() { _ = pub.Close() }()
+
+	b := &backfiller{
+		client: &apiClient{
+			baseURL:    *apiURL,
+			token:      *apiToken,
+			httpClient: &http.Client{Timeout: 30 * time.Second},
+			logger:     logger,
+			sleep:      sleepContext,
+		},
+		pub:            pub,
+		logger:         logger,
+		schemaVersion:  *schemaVersion,
+		legacyPipeline: *legacyPipeline,
+	}
+
+	logger.Info("Starting backfill", "org", q.Org, "pipeline", q.Pipeline, "from", *from, "to", *to, "topic", *topicID)
+
+	res, err := b.run(ctx, q)
+	if err != nil {
+		logger.Error("Backfill failed", "error", err, "published", res.Published, "failed", res.Failed)
+		os.Exit(1)
+	}
+
+	logger.Info("Backfill complete", "published", res.Published, "failed", res.Failed)
+	if res.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// parseDate accepts a date or an RFC3339 timestamp; empty means unbounded
+func parseDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
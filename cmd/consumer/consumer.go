@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// message is the subset of a Pub/Sub message the consumer acts on
+type message struct {
+	ID              string
+	Data            []byte
+	Attributes      map[string]string
+	PublishTime     time.Time
+	DeliveryAttempt int
+}
+
+// outcome tells the receive loop what to do with a message
+type outcome int
+
+const (
+	outcomeAck outcome = iota
+	outcomeNack
+	outcomeSkipped
+	// outcomeExpired is a message past its expires_at, acknowledged
+	// without being handled
+	outcomeExpired
+)
+
+// attributeFilter matches messages whose attributes equal every key/value pair.
+// It mirrors what a Pub/Sub subscription filter would do server-side.
+type attributeFilter map[string]string
+
+// String implements flag.Value
+func (f attributeFilter) String() string {
+	pairs := make([]string, 0, len(f))
+	for k, v := range f {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Set implements flag.Value, accepting repeated key=value arguments
+func (f attributeFilter) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return fmt.Errorf("filter %q must be in key=value form", value)
+	}
+	f[key] = strings.TrimSpace(val)
+	return nil
+}
+
+// Matches reports whether the attributes satisfy the filter
+func (f attributeFilter) Matches(attributes map[string]string) bool {
+	for k, v := range f {
+		if attributes[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// newExpiredCounter registers the counter of expired messages the consumer
+// dropped, by event type, with reg
+func newExpiredCounter(reg prometheus.Registerer) *prometheus.CounterVec {
+	expired := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_consumer_expired_messages_total",
+			Help: "Messages past their expires_at acknowledged without being handled",
+		},
+		[]string{"event_type"},
+	)
+	reg.MustRegister(expired)
+	return expired
+}
+
+// consumer prints or forwards Buildkite events received from Pub/Sub
+type consumer struct {
+	filter     attributeFilter
+	forwardURL string
+	httpClient *http.Client
+	out        io.Writer
+	logger     *slog.Logger
+	// confirm publishes a delivery confirmation with the given attributes;
+	// nil leaves messages unconfirmed
+	confirm func(ctx context.Context, attributes map[string]string) error
+	// expired counts dropped expired messages by event type; nil counts
+	// none
+	expired *prometheus.CounterVec
+}
+
+// handle processes a single message. Messages that fail to forward are
+// nacked so Pub/Sub redelivers them and, once the subscription's
+// max delivery attempts is reached, moves them to its dead-letter topic.
+func (c *consumer) handle(ctx context.Context, msg message) outcome {
+	if !c.filter.Matches(msg.Attributes) {
+		c.logger.Debug("Skipping message not matching filter", "message_id", msg.ID)
+		return outcomeSkipped
+	}
+
+	logger := c.logger.With(
+		"message_id", msg.ID,
+		"event_type", msg.Attributes["event_type"],
+		"delivery_attempt", msg.DeliveryAttempt,
+	)
+
+	// Stale events, such as those replayed from the DLQ hours later, would
+	// only be noise downstream
+	if subscriber.Expired(msg.Attributes, time.Now()) {
+		logger.Info("Dropping expired message", "expires_at", msg.Attributes[subscriber.ExpiresAtAttribute])
+		if c.expired != nil {
+			c.expired.WithLabelValues(msg.Attributes["event_type"]).Inc()
+		}
+		return outcomeExpired
+	}
+	if lag, ok := subscriber.Lag(msg.Attributes, time.Now()); ok {
+		logger = logger.With("lag", lag)
+	}
+
+	// Messages read from the webhook's DLQ topic carry the failure reason
+	if reason, ok := msg.Attributes["dlq_reason"]; ok {
+		logger.Warn("Received dead-lettered event",
+			"dlq_reason", reason,
+			"dlq_error_message", msg.Attributes["dlq_error_message"],
+			"dlq_original_timestamp", msg.Attributes["dlq_original_timestamp"],
+		)
+	}
+
+	if c.forwardURL == "" {
+		if err := c.print(msg); err != nil {
+			logger.Error("Failed to print message", "error", err)
+			return outcomeNack
+		}
+	} else {
+		if err := c.forward(ctx, msg); err != nil {
+			logger.Error("Failed to forward message, nacking for redelivery", "error", err)
+			return outcomeNack
+		}
+		logger.Info("Forwarded message", "url", c.forwardURL)
+	}
+
+	// The message was handled, so a failed confirmation is only logged;
+	// the webhook counts it as unconfirmed
+	if attributes, ok := subscriber.ConfirmationAttributes(msg.Attributes, msg.ID); ok && c.confirm != nil {
+		if err := c.confirm(ctx, attributes); err != nil {
+			logger.Warn("Failed to confirm message", "error", err)
+		}
+	}
+	return outcomeAck
+}
+
+// print writes the message attributes and indented payload to the output
+func (c *consumer) print(msg message) error {
+	var body interface{}
+	if err := json.Unmarshal(msg.Data, &body); err != nil {
+		body = string(msg.Data)
+	}
+
+	record := map[string]interface{}{
+		"message_id":   msg.ID,
+		"publish_time": msg.PublishTime.UTC().Format(time.RFC3339Nano),
+		"attributes":   msg.Attributes,
+		"data":         body,
+	}
+
+	enc := json.NewEncoder(c.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(record)
+}
+
+// forward POSTs the message payload to the forward URL, passing attributes
+// as X-Pubsub-Attribute-* headers
+func (c *consumer) forward(ctx context.Context, msg message) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.forwardURL, bytes.NewReader(msg.Data))
+	if err != nil {
+		return fmt.Errorf("failed to build forward request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Pubsub-Message-Id", msg.ID)
+	for k, v := range msg.Attributes {
+		req.Header.Set("X-Pubsub-Attribute-"+k, v)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("forward request failed: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("forward target returned status %d", resp.StatusCode)
+	}
+	return nil
+}
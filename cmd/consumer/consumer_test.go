@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAttributeFilter(t *testing.T) {
+	filter := attributeFilter{}
+	if err := filter.Set("event_type=build.finished"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if err := filter.Set("branch = main"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if err := filter.Set("missing-separator"); err == nil {
+		t.Error("Set() expected error for value without '='")
+	}
+
+	tests := []struct {
+		name       string
+		attributes map[string]string
+		want       bool
+	}{
+		{
+			name:       "all attributes match",
+			attributes: map[string]string{"event_type": "build.finished", "branch": "main", "pipeline": "p"},
+			want:       true,
+		},
+		{
+			name:       "one attribute differs",
+			attributes: map[string]string{"event_type": "build.finished", "branch": "dev"},
+			want:       false,
+		},
+		{
+			name:       "attribute missing",
+			attributes: map[string]string{"event_type": "build.finished"},
+			want:       false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := filter.Matches(tt.attributes); got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConsumerHandle(t *testing.T) {
+	msg := message{
+		ID:          "msg-1",
+		Data:        []byte(`{"event_type":"build.finished","build":{"id":"123"}}`),
+		Attributes:  map[string]string{"event_type": "build.finished", "pipeline": "test"},
+		PublishTime: time.Date(2024, 1, 9, 10, 0, 0, 0, time.UTC),
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	t.Run("prints matching message", func(t *testing.T) {
+		var out bytes.Buffer
+		c := &consumer{filter: attributeFilter{}, out: &out, logger: logger}
+
+		if got := c.handle(context.Background(), msg); got != outcomeAck {
+			t.Fatalf("handle() = %v, want ack", got)
+		}
+
+		var record map[string]interface{}
+		if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+			t.Fatalf("printed output is not JSON: %v", err)
+		}
+		if record["message_id"] != "msg-1" {
+			t.Errorf("message_id = %v, want msg-1", record["message_id"])
+		}
+	})
+
+	t.Run("skips non-matching message", func(t *testing.T) {
+		var out bytes.Buffer
+		c := &consumer{filter: attributeFilter{"pipeline": "other"}, out: &out, logger: logger}
+
+		if got := c.handle(context.Background(), msg); got != outcomeSkipped {
+			t.Errorf("handle() = %v, want skipped", got)
+		}
+		if out.Len() != 0 {
+			t.Errorf("expected no output for skipped message, got %q", out.String())
+		}
+	})
+
+	t.Run("forwards message with attribute headers", func(t *testing.T) {
+		var gotBody []byte
+		var gotHeader string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotBody, _ = io.ReadAll(r.Body)
+			gotHeader = r.Header.Get("X-Pubsub-Attribute-Event_type")
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer srv.Close()
+
+		c := &consumer{filter: attributeFilter{}, forwardURL: srv.URL, httpClient: srv.Client(), logger: logger}
+
+		if got := c.handle(context.Background(), msg); got != outcomeAck {
+			t.Fatalf("handle() = %v, want ack", got)
+		}
+		if !bytes.Equal(gotBody, msg.Data) {
+			t.Errorf("forwarded body = %s, want %s", gotBody, msg.Data)
+		}
+		if gotHeader != "build.finished" {
+			t.Errorf("forwarded event_type header = %q, want build.finished", gotHeader)
+		}
+	})
+
+	t.Run("drops expired message", func(t *testing.T) {
+		var out bytes.Buffer
+		c := &consumer{filter: attributeFilter{}, out: &out, logger: logger, expired: newExpiredCounter(prometheus.NewRegistry())}
+
+		expired := msg
+		expired.Attributes = map[string]string{
+			"event_type":                  "build.started",
+			subscriber.ExpiresAtAttribute: time.Now().Add(-time.Minute).UTC().Format(time.RFC3339Nano),
+		}
+		if got := c.handle(context.Background(), expired); got != outcomeExpired {
+			t.Errorf("handle() = %v, want expired", got)
+		}
+		if out.Len() != 0 {
+			t.Errorf("expected no output for expired message, got %q", out.String())
+		}
+
+		expired.Attributes[subscriber.ExpiresAtAttribute] = time.Now().Add(time.Hour).UTC().Format(time.RFC3339Nano)
+		if got := c.handle(context.Background(), expired); got != outcomeAck {
+			t.Errorf("handle() = %v for a message that has not expired, want ack", got)
+		}
+		if got := testutil.ToFloat64(c.expired.WithLabelValues("build.started")); got != 1 {
+			t.Errorf("expired messages = %v, want 1", got)
+		}
+	})
+
+	t.Run("confirms message that asks for it", func(t *testing.T) {
+		var confirmed map[string]string
+		c := &consumer{filter: attributeFilter{}, out: io.Discard, logger: logger}
+		c.confirm = func(_ context.Context, attributes map[string]string) error {
+			confirmed = attributes
+			return nil
+		}
+
+		c.handle(context.Background(), msg)
+		if confirmed != nil {
+			t.Errorf("confirmed %v for a message that does not ask for it", confirmed)
+		}
+
+		critical := msg
+		critical.Attributes = map[string]string{"event_type": "build.finished", subscriber.ConfirmAttribute: "replica-1"}
+		if got := c.handle(context.Background(), critical); got != outcomeAck {
+			t.Fatalf("handle() = %v, want ack", got)
+		}
+		if confirmed[subscriber.ConfirmAttribute] != "replica-1" || confirmed[subscriber.ConfirmsMessageIDAttribute] != "msg-1" {
+			t.Errorf("confirmation attributes = %v, want replica-1 confirming msg-1", confirmed)
+		}
+	})
+
+	t.Run("nacks when forward target fails", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer srv.Close()
+
+		c := &consumer{filter: attributeFilter{}, forwardURL: srv.URL, httpClient: srv.Client(), logger: logger}
+
+		if got := c.handle(context.Background(), msg); got != outcomeNack {
+			t.Errorf("handle() = %v, want nack", got)
+		}
+	})
+}
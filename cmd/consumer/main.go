@@ -0,0 +1,146 @@
+// Command consumer is a reference Pub/Sub consumer for events published by the
+// webhook. It pretty-prints or forwards events, filters on message attributes,
+// and can run as a smoke test that exits once a number of events arrive.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/pubsub/v2"
+	"github.com/mcncl/buildkite-pubsub/internal/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func main() {
+	filter := attributeFilter{}
+
+	projectID := flag.String("project", os.Getenv("PROJECT_ID"), "Google Cloud project ID (defaults to $PROJECT_ID)")
+	subscriptionID := flag.String("subscription", os.Getenv("SUBSCRIPTION_ID"), "Pub/Sub subscription ID (defaults to $SUBSCRIPTION_ID)")
+	forwardURL := flag.String("forward-url", "", "POST each event to this URL instead of printing it")
+	count := flag.Int("count", 0, "Exit successfully after this many matching events (0 runs until interrupted)")
+	timeout := flag.Duration("timeout", 0, "Exit with an error if -count events have not arrived within this duration")
+	confirmTopic := flag.String("confirm-topic", "", "Publish a delivery confirmation to this topic for each handled message that asks for one")
+	metricsAddr := flag.String("metrics-addr", "", "Serve Prometheus metrics at /metrics on this address, e.g. :9090")
+	logLevel := flag.String("log-level", "info", "Log level (debug, info, warn, error)")
+	logFormat := flag.String("log-format", "text", "Log format (json, text, dev)")
+	flag.Var(filter, "filter", "Only handle events whose attribute matches key=value (repeatable)")
+	flag.Parse()
+
+	logger := logging.NewLogger(*logLevel, *logFormat)
+
+	if *projectID == "" || *subscriptionID == "" {
+		fmt.Fprintln(os.Stderr, "both -project and -subscription are required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	client, err := pubsub.NewClient(ctx, *projectID)
+	if err != nil {
+		logger.Error("Failed to create Pub/Sub client", "error", err)
+		os.Exit(1)
+	}
+	defer func() { _ = client.Close() }()
+
+	reg := prometheus.NewRegistry()
+	c := &consumer{
+		filter:     filter,
+		forwardURL: *forwardURL,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		out:        os.Stdout,
+		logger:     logger,
+		expired:    newExpiredCounter(reg),
+	}
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+		srv := &http.Server{Addr: *metricsAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+				logger.Error("Metrics server failed", "error", err)
+			}
+		}()
+		defer func() { _ = srv.Close() }()
+	}
+	if *confirmTopic != "" {
+		confirmations := client.Publisher(*confirmTopic)
+		defer confirmations.Stop()
+		c.confirm = func(ctx context.Context, attributes map[string]string) error {
+			_, err := confirmations.Publish(ctx, &pubsub.Message{Data: []byte("{}"), Attributes: attributes}).Get(ctx)
+			return err
+		}
+	}
+
+	// Receive runs the callback concurrently; serialise output and stop once
+	// the requested number of events has been handled
+	receiveCtx, cancelReceive := context.WithCancel(ctx)
+	defer cancelReceive()
+
+	var mu sync.Mutex
+	var handled, expired atomic.Int64
+
+	logger.Info("Consuming events", "project_id", *projectID, "subscription", *subscriptionID, "filter", filter.String())
+
+	err = client.Subscriber(*subscriptionID).Receive(receiveCtx, func(ctx context.Context, m *pubsub.Message) {
+		msg := message{
+			ID:          m.ID,
+			Data:        m.Data,
+			Attributes:  m.Attributes,
+			PublishTime: m.PublishTime,
+		}
+		if m.DeliveryAttempt != nil {
+			msg.DeliveryAttempt = *m.DeliveryAttempt
+		}
+
+		mu.Lock()
+		result := c.handle(ctx, msg)
+		mu.Unlock()
+
+		switch result {
+		case outcomeNack:
+			m.Nack()
+			return
+		case outcomeSkipped:
+			m.Ack()
+			return
+		case outcomeExpired:
+			expired.Add(1)
+			m.Ack()
+			return
+		}
+		m.Ack()
+
+		if n := handled.Add(1); *count > 0 && n >= int64(*count) {
+			cancelReceive()
+		}
+	})
+	if err != nil {
+		logger.Error("Receive failed", "error", err)
+		os.Exit(1)
+	}
+
+	if *count > 0 && handled.Load() < int64(*count) {
+		logger.Error("Did not receive expected events", "want", *count, "got", handled.Load())
+		os.Exit(1)
+	}
+
+	logger.Info("Consumer stopped", "handled", handled.Load(), "expired", expired.Load())
+}
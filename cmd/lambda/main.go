@@ -0,0 +1,110 @@
+// Command lambda runs the webhook on AWS Lambda behind API Gateway or an
+// Application Load Balancer, publishing to Amazon SNS instead of Pub/Sub.
+// It is configured from the same environment variables as the server, with
+// SNS topic ARNs in place of Pub/Sub topic IDs:
+//
+//	TOPIC_ID=arn:aws:sns:us-east-1:123456789012:buildkite-events
+//
+// PROJECT_ID is not needed and defaults to AWS_REGION. CONFIG_FILE may name
+// a configuration file deployed with the function.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/mcncl/buildkite-pubsub/internal/app"
+	"github.com/mcncl/buildkite-pubsub/internal/config"
+	"github.com/mcncl/buildkite-pubsub/internal/logging"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+	"github.com/mcncl/buildkite-pubsub/internal/version"
+	"github.com/mcncl/buildkite-pubsub/pkg/awslambda"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	handlerMu sync.Mutex
+	handler   http.Handler
+	logger    = logging.NewLogger(os.Getenv("LOG_LEVEL"), "json")
+
+	// loadAWSConfig loads credentials and the region once, on the first
+	// publish rather than during the cold start
+	loadAWSConfig = sync.OnceValues(func() (aws.Config, error) {
+		return awsconfig.LoadDefaultConfig(context.Background())
+	})
+)
+
+func main() {
+	lambda.Start(awslambda.New(http.HandlerFunc(serveWebhook)))
+}
+
+// serveWebhook handles Buildkite webhook deliveries on any path. The service
+// starts on the first invocation; if it cannot, the request fails with 503
+// and the next invocation tries again.
+func serveWebhook(w http.ResponseWriter, r *http.Request) {
+	h, err := webhookHandler(r.Context())
+	if err != nil {
+		logger.Error("Service initialization error", "error", err)
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+// webhookHandler builds the service once it starts successfully
+func webhookHandler(ctx context.Context) (http.Handler, error) {
+	handlerMu.Lock()
+	defer handlerMu.Unlock()
+	if handler != nil {
+		return handler, nil
+	}
+
+	// Topic ARNs name the account and region, so the project ID is unused
+	var override *config.Config
+	if os.Getenv("PROJECT_ID") == "" {
+		override = &config.Config{GCP: config.GCPConfig{ProjectID: os.Getenv("AWS_REGION")}}
+	}
+	cfg, err := config.Load(os.Getenv("CONFIG_FILE"), override)
+	if err != nil {
+		return nil, err
+	}
+	config.WarnDeprecations(logger, cfg.Deprecated)
+
+	// Metrics feed the handler's decisions but are not scraped here
+	if err := metrics.InitMetrics(prometheus.NewRegistry(), app.MetricsOptions(cfg.Metrics)...); err != nil {
+		return nil, err
+	}
+
+	// Publishers must outlive the invocation that starts the service
+	svc, err := app.New(context.WithoutCancel(ctx), cfg, app.Options{
+		Logger:       logger,
+		NewPublisher: newSNSPublisher,
+	})
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Function started", "function", os.Getenv("AWS_LAMBDA_FUNCTION_NAME"), "version", version.Version)
+
+	handler = svc.Webhook
+	return handler, nil
+}
+
+// newSNSPublisher returns a publisher for an SNS topic ARN that creates its
+// client on first use, so pings and rejected requests never wait for it
+func newSNSPublisher(_ context.Context, _, topicARN string) (publisher.Publisher, error) {
+	return publisher.NewLazyPublisher(topicARN, func(context.Context) (publisher.Publisher, error) {
+		awsCfg, err := loadAWSConfig()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load AWS configuration: %w", err)
+		}
+		return publisher.NewSNSPublisher(sns.NewFromConfig(awsCfg), topicARN), nil
+	}), nil
+}
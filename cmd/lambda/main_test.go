@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/mcncl/buildkite-pubsub/pkg/awslambda"
+)
+
+func TestServeWebhook(t *testing.T) {
+	invoke := func(token, body string) events.APIGatewayV2HTTPResponse {
+		t.Helper()
+		event := events.APIGatewayV2HTTPRequest{
+			Version: "2.0",
+			RawPath: "/",
+			Headers: map[string]string{"x-buildkite-token": token},
+			Body:    body,
+		}
+		event.RequestContext.HTTP.Method = http.MethodPost
+		payload, _ := json.Marshal(event)
+		out, err := awslambda.New(http.HandlerFunc(serveWebhook)).Invoke(context.Background(), payload)
+		if err != nil {
+			t.Fatalf("Invoke() error = %v", err)
+		}
+		var response events.APIGatewayV2HTTPResponse
+		if err := json.Unmarshal(out, &response); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		return response
+	}
+
+	t.Setenv("PROJECT_ID", "")
+	t.Setenv("TOPIC_ID", "")
+	t.Setenv("BUILDKITE_WEBHOOK_TOKEN", "")
+	if response := invoke("token", `{"event":"ping"}`); response.StatusCode != http.StatusServiceUnavailable || handler != nil {
+		t.Errorf("status before configuration = %d, want %d", response.StatusCode, http.StatusServiceUnavailable)
+	}
+
+	// Without PROJECT_ID the service starts, and answers pings without
+	// creating an SNS client
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("TOPIC_ID", "arn:aws:sns:us-east-1:123456789012:buildkite-events")
+	t.Setenv("BUILDKITE_WEBHOOK_TOKEN", "token")
+	loadAWSConfig = func() (aws.Config, error) {
+		t.Fatal("AWS configuration loaded before the first publish")
+		return aws.Config{}, nil
+	}
+	response := invoke("token", `{"event":"ping"}`)
+	if response.StatusCode != http.StatusOK || !strings.Contains(response.Body, "Pong") {
+		t.Errorf("ping = %d %s", response.StatusCode, response.Body)
+	}
+	if response := invoke("wrong-token", `{"event":"ping"}`); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status with a wrong token = %d, want %d", response.StatusCode, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// drainer takes the instance out of load balancing before shutdown: it fails
+// readiness, then waits a settle period for load balancers and Kubernetes
+// endpoints to stop routing to it while it keeps serving
+type drainer struct {
+	setReady func(bool)
+	settle   time.Duration
+	logger   *slog.Logger
+	sleep    func(time.Duration)
+
+	once sync.Once
+	// requests receives the trigger of a shutdown requested other than by
+	// signal, such as a preStop hook
+	requests chan string
+}
+
+// newDrainer creates a drainer that waits settle after failing readiness
+func newDrainer(setReady func(bool), settle time.Duration, logger *slog.Logger) *drainer {
+	return &drainer{
+		setReady: setReady,
+		settle:   settle,
+		logger:   logger,
+		sleep:    time.Sleep,
+		requests: make(chan string, 1),
+	}
+}
+
+// drain fails readiness and waits out the settle period. Only the first
+// call does so; concurrent calls wait for it and later ones return at once.
+func (d *drainer) drain(trigger string) {
+	d.once.Do(func() {
+		d.setReady(false)
+		if d.settle > 0 {
+			d.logger.Info("Readiness failed; waiting for load balancers to deregister", "trigger", trigger, "settle", d.settle.String())
+			d.sleep(d.settle)
+		}
+	})
+}
+
+// preStop drains, then asks for a graceful shutdown without waiting for
+// SIGTERM
+func (d *drainer) preStop(trigger string) {
+	d.drain(trigger)
+	select {
+	case d.requests <- trigger:
+	default:
+		// A shutdown has already been requested
+	}
+}
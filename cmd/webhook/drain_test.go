@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDrainer(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+
+	d := newDrainer(func(ready bool) {
+		if ready {
+			t.Error("drain marked the instance ready")
+		}
+		record("unready")
+	}, 10*time.Second, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	d.sleep = func(settle time.Duration) {
+		if settle != 10*time.Second {
+			t.Errorf("settled for %v, want 10s", settle)
+		}
+		record("settled")
+	}
+
+	d.preStop("prestop")
+	// SIGTERM follows the preStop hook; it must not settle again
+	d.drain("terminated")
+	d.preStop("user defined signal 1")
+
+	if got := len(events); got != 2 || events[0] != "unready" || events[1] != "settled" {
+		t.Errorf("events = %v, want [unready settled]", events)
+	}
+	select {
+	case trigger := <-d.requests:
+		if trigger != "prestop" {
+			t.Errorf("shutdown requested by %q, want prestop", trigger)
+		}
+	default:
+		t.Fatal("preStop did not request a shutdown")
+	}
+}
@@ -5,46 +5,98 @@ import (
 	"flag"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"syscall"
+	"strconv"
 	"time"
 
-	"cloud.google.com/go/pubsub/v2"
+	"github.com/mcncl/buildkite-pubsub/internal/admin"
+	"github.com/mcncl/buildkite-pubsub/internal/app"
+	"github.com/mcncl/buildkite-pubsub/internal/clockcheck"
+	"github.com/mcncl/buildkite-pubsub/internal/cloudrun"
 	"github.com/mcncl/buildkite-pubsub/internal/config"
 	"github.com/mcncl/buildkite-pubsub/internal/errors"
+	"github.com/mcncl/buildkite-pubsub/internal/jsoncodec"
 	"github.com/mcncl/buildkite-pubsub/internal/logging"
 	"github.com/mcncl/buildkite-pubsub/internal/metrics"
-	loggingMiddleware "github.com/mcncl/buildkite-pubsub/internal/middleware/logging"
-	"github.com/mcncl/buildkite-pubsub/internal/middleware/request"
-	"github.com/mcncl/buildkite-pubsub/internal/middleware/security"
-	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+	"github.com/mcncl/buildkite-pubsub/internal/middleware"
+	"github.com/mcncl/buildkite-pubsub/internal/middleware/compress"
+	"github.com/mcncl/buildkite-pubsub/internal/middleware/instrument"
+	"github.com/mcncl/buildkite-pubsub/internal/server"
 	"github.com/mcncl/buildkite-pubsub/internal/telemetry"
+	"github.com/mcncl/buildkite-pubsub/internal/version"
+	"github.com/mcncl/buildkite-pubsub/pkg/buildkiteauth"
 	"github.com/mcncl/buildkite-pubsub/pkg/webhook"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 )
 
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "setup-gcp":
+			os.Exit(runSetupGCP(os.Args[2:], os.Stdout))
+		case "selftest":
+			os.Exit(runSelftest(os.Args[2:], os.Stdout))
+		case "subscription-filter":
+			os.Exit(runSubscriptionFilter(os.Args[2:], os.Stdout))
+		case "reprocess":
+			os.Exit(runReprocess(os.Args[2:], os.Stdout))
+		}
+	}
+
 	// Parse command line flags
 	configFile := flag.String("config", "", "Path to configuration file (JSON or YAML)")
 	logLevel := flag.String("log-level", "info", "Log level (debug, info, warn, error)")
-	logFormat := flag.String("log-format", "json", "Log format (json, text, dev)")
+	logFormat := flag.String("log-format", "json", "Log format (json, text, dev, gcp)")
+	profile := flag.String("profile", "", "Configuration profile (development, staging, production); defaults to $CONFIG_PROFILE")
+	validateConfig := flag.Bool("validate-config", false, "Load and validate the configuration, list deprecated settings and exit")
+	showVersion := flag.Bool("version", false, "Print the build version and exit")
 	flag.Parse()
 
+	build := version.Get()
+	if *showVersion {
+		fmt.Println(build)
+		return
+	}
+
+	// On Cloud Run, log in the format Cloud Logging parses unless the flag
+	// or configuration chooses another
+	onCloudRun := cloudrun.Detect()
+	format := *logFormat
+	if onCloudRun && !flagSet("log-format") {
+		format = "gcp"
+	}
+
 	// Initialize structured logger
-	logger := initLogger(*logLevel, *logFormat)
+	logger := initLogger(*logLevel, format)
 
 	// Load configuration
-	cfg, err := config.Load(*configFile, nil)
+	var override *config.Config
+	if *profile != "" {
+		override = &config.Config{Profile: *profile}
+	}
+	cfg, err := config.Load(*configFile, override)
+	if *validateConfig {
+		os.Exit(printConfigValidation(os.Stdout, cfg, err))
+	}
 	if err != nil {
-		logger.Error("Failed to load configuration", "error", err)
-		os.Exit(1)
+		fatal(logger, shutdownConfigError, errors.Wrap(err, "failed to load configuration"))
+	}
+	if cfg.Server.LogFormat != "" && cfg.Server.LogFormat != format && !flagSet("log-format") {
+		logger = initLogger(*logLevel, cfg.Server.LogFormat)
 	}
 
 	// Log the configuration (with sensitive values masked)
 	logger.Info("Configuration loaded", "config", cfg.String())
+	config.WarnDeprecations(logger, cfg.Deprecated)
+	if onCloudRun {
+		service, revision := cloudrun.Service()
+		logger.Info("Running on Cloud Run", "service", service, "revision", revision)
+	}
 
 	ctx := context.Background()
 
@@ -58,6 +110,14 @@ func main() {
 		if telemetryConfig.ServiceName == "" {
 			telemetryConfig.ServiceName = "buildkite-webhook"
 		}
+		if telemetryConfig.ServiceVersion == "" {
+			telemetryConfig.ServiceVersion = build.Version
+		}
+		if telemetryConfig.Environment == "" {
+			telemetryConfig.Environment = cfg.Profile
+		}
+		telemetryConfig.SampleRatio = cfg.Tracing.SampleRatio
+		telemetryConfig.Insecure = cfg.Tracing.OTLPInsecure
 
 		telemetryProvider, err = telemetry.NewProvider(telemetryConfig)
 		if err != nil {
@@ -74,114 +134,159 @@ func main() {
 		}
 	}
 
-	// Add metrics initialization
+	// Add metrics initialization, named and labelled per deployment
 	reg := prometheus.NewRegistry()
-	if err := metrics.InitMetrics(reg); err != nil {
-		logger.Error("Failed to initialize metrics", "error", err)
-		os.Exit(1)
-	}
-
-	// Create publisher with optimized settings from config
-	pubSettings := &pubsub.PublishSettings{
-		CountThreshold: cfg.GCP.PubSubBatchSize,
-		ByteThreshold:  1e6,  // 1MB
-		DelayThreshold: 10e6, // 10ms
-		NumGoroutines:  4,
-		FlowControlSettings: pubsub.FlowControlSettings{
-			MaxOutstandingMessages: 1000,
-			MaxOutstandingBytes:    1e9,
-			LimitExceededBehavior:  pubsub.FlowControlBlock,
-		},
-		EnableCompression:         true,
-		CompressionBytesThreshold: 1000,
-	}
-
-	pub, err := publisher.NewPubSubPublisherWithSettings(ctx, cfg.GCP.ProjectID, cfg.GCP.TopicID, pubSettings)
-	if err != nil {
-		// Wrap the error with additional context
-		if errors.IsConnectionError(err) {
-			err = errors.Wrap(err, "failed to connect to Google Cloud Pub/Sub")
-		} else {
-			err = errors.Wrap(err, "failed to create publisher")
-		}
-
-		logger.Error("Publisher initialization error", "error", err, "project_id", cfg.GCP.ProjectID, "topic_id", cfg.GCP.TopicID)
-		os.Exit(1)
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	if err := metrics.InitMetrics(reg, app.MetricsOptions(cfg.Metrics)...); err != nil {
+		fatal(logger, shutdownConfigError, errors.Wrap(err, "failed to initialize metrics"))
 	}
-	defer func() {
-		if err := pub.Close(); err != nil {
-			logger.Error("Failed to close publisher", "error", err)
-		}
-	}()
-
-	// Create webhook handler
-	webhookHandler := webhook.NewHandler(webhook.Config{
-		BuildkiteToken: cfg.Webhook.Token,
-		HMACSecret:     cfg.Webhook.HMACSecret,
-		Publisher:      pub,
-	})
-
-	// Create router
-	mux := http.NewServeMux()
-
-	// Add metrics endpoint
-	mux.Handle("/metrics", promhttp.Handler())
 
-	// Add health check routes
-	mux.HandleFunc("/health", healthCheck.HealthHandler)
-	mux.HandleFunc("/ready", healthCheck.ReadyHandler)
-
-	// Add webhook route with middleware
-	var middlewares []func(http.Handler) http.Handler
+	// Check the clock in the background so a slow NTP server never delays startup
+	if cfg.Webhook.ClockCheckServer != "" {
+		go checkClock(cfg.Webhook, logger)
+	}
 
+	// Trust Cloud Run's front end for client addresses and HTTPS, and add
+	// tracing when configured; cfg.Webhook.Middleware places them
+	middlewares := make(map[string]func(http.Handler) http.Handler)
+	if onCloudRun {
+		middlewares[middleware.ProxyHeaders] = cloudrun.WithProxyHeaders
+	}
 	if telemetryProvider != nil {
-		middlewares = append(middlewares, telemetryProvider.TracingMiddleware)
+		middlewares[middleware.Tracing] = telemetryProvider.TracingMiddleware
 	}
 
-	middlewares = append(middlewares,
-		request.WithRequestID,
-		loggingMiddleware.WithStructuredLogging(logger),
-		security.WithRateLimit(cfg.Security.RateLimit),
-		request.WithTimeout(cfg.Server.RequestTimeout),
-	)
-
-	mux.Handle(cfg.Webhook.Path, chainMiddleware(webhookHandler, middlewares...))
+	// Build the publishers, webhook handlers and routes
+	start := func() (*app.App, error) {
+		return app.New(ctx, cfg, app.Options{
+			Logger:     logger,
+			Registry:   reg,
+			Health:     healthCheck,
+			Middleware: middlewares,
+		})
+	}
+	handler := &startupHandler{health: healthCheck}
+	svc, err := start()
+	if err != nil {
+		logStartupError(logger, err)
+		if cfg.Server.StartupRetryTimeout <= 0 || errors.IsValidationError(err) {
+			fatal(logger, startupFailure(err), err)
+		}
+	} else {
+		handler.setHandler(svc.Handler)
+	}
 
 	// Configure server
-	srv := &http.Server{
-		Addr:         fmt.Sprintf(":%d", cfg.Server.Port),
-		Handler:      mux,
-		ReadTimeout:  cfg.Server.ReadTimeout,
-		WriteTimeout: cfg.Server.WriteTimeout,
-		IdleTimeout:  cfg.Server.IdleTimeout,
+	srv := server.New(cfg.Server, handler)
+	ln, err := server.Listen(cfg.Server)
+	if err != nil {
+		fatal(logger, shutdownListenerError, errors.Wrap(err, "failed to start listener"))
 	}
 
 	// Start server in goroutine
 	go func() {
-		logger.Info("Server starting", "port", cfg.Server.Port)
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-			logger.Error("HTTP server error", "error", err)
-			os.Exit(1)
+		logger.Info("Server starting", "addr", ln.Addr().String(), "version", build.Version, "commit", build.Commit, "json_codec", jsoncodec.Name,
+			"h2c", cfg.Server.EnableH2C, "keep_alives", !cfg.Server.DisableKeepAlives, "max_connections", cfg.Server.MaxConnections)
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			fatal(logger, shutdownServerError, errors.Wrap(err, "HTTP server error"))
 		}
 	}()
 
+	// Keep retrying a failed startup, serving 503s meanwhile
+	if svc == nil {
+		logger.Warn("Starting degraded; retrying startup", "timeout", cfg.Server.StartupRetryTimeout.String())
+		svc, err = retryStartup(logger, cfg.Server.StartupRetryTimeout, err, start)
+		if err != nil {
+			fatal(logger, startupFailure(err), errors.Wrap(err, "giving up on startup"))
+		}
+		handler.setHandler(svc.Handler)
+		logger.Info("Service started after retrying")
+	}
+	defer svc.Close()
+
+	// Cloud Run stops routing to an instance before SIGTERM and kills it soon
+	// after, so a settle period only costs shutdown time there
+	settle := cfg.Server.ShutdownSettle
+	if onCloudRun && settle > 0 {
+		logger.Warn("Ignoring shutdown settle period on Cloud Run", "settle", settle.String())
+		settle = 0
+	}
+	drain := newDrainer(healthCheck.SetReady, settle, logger)
+
+	// Start the optional admin listener
+	var adminSrv *http.Server
+	if cfg.Admin.Port != 0 {
+		adminMux := http.NewServeMux()
+		if cfg.Admin.EnableDebug {
+			admin.RegisterDebug(adminMux)
+		}
+		admin.Handle(adminMux, "/pause", admin.PauseHandler(svc.Pause))
+		admin.Handle(adminMux, "/prestop", admin.PreStopHandler(func() { drain.preStop("prestop") }))
+		admin.Handle(adminMux, "/transform-preview", admin.TransformPreviewHandler(svc.Preview))
+		// Listings can be large, so they are gzipped for clients that accept it
+		if svc.Recorder != nil {
+			admin.Handle(adminMux, "/requests", compress.Gzip(admin.RequestsHandler(svc.Recorder)))
+		}
+		if svc.Failover != nil {
+			admin.Handle(adminMux, "/failover", admin.FailoverHandler(svc.Failover))
+		}
+		if svc.Audit != nil {
+			admin.Handle(adminMux, "/events", compress.Gzip(admin.EventsHandler(svc.Audit)))
+		}
+		if svc.AuthBan != nil {
+			admin.Handle(adminMux, "/bans", compress.Gzip(admin.BansHandler(svc.AuthBan)))
+		}
+
+		adminSrv = &http.Server{
+			Addr:              net.JoinHostPort(cfg.Admin.BindAddress, strconv.Itoa(cfg.Admin.Port)),
+			Handler:           instrument.Middleware(admin.WithAuthorizer(adminAuthorizer(cfg.Admin), logger)(admin.WithAudit(logger)(adminMux))),
+			ReadHeaderTimeout: cfg.Server.ReadTimeout,
+			IdleTimeout:       cfg.Server.IdleTimeout,
+			// No WriteTimeout: CPU profiles and traces stream for their full duration
+		}
+
+		go func() {
+			logger.Info("Admin server starting", "addr", adminSrv.Addr, "debug_endpoints", cfg.Admin.EnableDebug)
+			if err := adminSrv.ListenAndServe(); err != http.ErrServerClosed {
+				fatal(logger, shutdownServerError, errors.Wrap(err, "admin server error"))
+			}
+		}()
+	}
+
 	// Mark as ready to receive traffic
 	healthCheck.SetReady(true)
 
-	// Wait for interrupt signal
+	// Wait for a signal or a preStop hook
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	sig := <-sigChan
-	logger.Info("Shutting down server", "signal", sig.String())
+	signal.Notify(sigChan, shutdownSignals...)
+	var trigger string
+	select {
+	case sig := <-sigChan:
+		trigger = sig.String()
+	case trigger = <-drain.requests:
+	}
+	logger.Info("Shutting down server", "trigger", trigger)
+
+	// Stop being routed new webhooks before the listener closes
+	drain.drain(trigger)
 
 	// Graceful shutdown
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.RequestTimeout)
+	// Cloud Run kills the instance soon after SIGTERM, so finish within its deadline
+	shutdownTimeout := cfg.Server.RequestTimeout
+	if onCloudRun && shutdownTimeout > cloudrun.ShutdownTimeout {
+		shutdownTimeout = cloudrun.ShutdownTimeout
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer cancel()
 
-	healthCheck.SetReady(false)
 	if err := srv.Shutdown(shutdownCtx); err != nil {
 		logger.Error("HTTP server shutdown error", "error", err)
 	}
+	if adminSrv != nil {
+		if err := adminSrv.Shutdown(shutdownCtx); err != nil {
+			logger.Error("Admin server shutdown error", "error", err)
+		}
+	}
 
 	// Shutdown telemetry
 	if telemetryProvider != nil {
@@ -191,6 +296,51 @@ func main() {
 	}
 
 	logger.Info("Server shutdown complete")
+	reportShutdown(logger, shutdownSignal, nil)
+}
+
+// checkClock warns when the local clock is far enough from NTP time that
+// signed deliveries may be rejected as expired or from the future
+func checkClock(cfg config.WebhookConfig, logger *slog.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	offset, err := clockcheck.Offset(ctx, cfg.ClockCheckServer)
+	if err != nil {
+		logger.Warn("Failed to check clock", "server", cfg.ClockCheckServer, "error", err)
+		return
+	}
+	metrics.ClockOffset.Set(offset.Seconds())
+
+	tolerance := cfg.SignatureTolerance
+	if tolerance <= 0 {
+		tolerance = buildkiteauth.DefaultTolerance
+	}
+	if cfg.SignatureFutureTolerance > 0 {
+		tolerance = min(tolerance, cfg.SignatureFutureTolerance)
+	}
+	if offset.Abs() > tolerance/2 {
+		logger.Warn("Local clock is skewed; signed webhooks may be rejected",
+			"server", cfg.ClockCheckServer, "offset", offset.String(), "tolerance", tolerance.String())
+		return
+	}
+	logger.Info("Clock checked", "server", cfg.ClockCheckServer, "offset", offset.String())
+}
+
+// adminAuthorizer accepts the admin token and OIDC tokens as configured.
+// Without either, only loopback clients are allowed.
+func adminAuthorizer(cfg config.AdminConfig) admin.Authorizer {
+	var authorizers []admin.Authorizer
+	if cfg.Token != "" || cfg.OIDCIssuer == "" {
+		authorizers = append(authorizers, admin.NewTokenAuthorizer(cfg.Token))
+	}
+	if cfg.OIDCIssuer != "" {
+		authorizers = append(authorizers, admin.NewOIDCAuthorizer(admin.OIDCConfig{
+			Issuer:   cfg.OIDCIssuer,
+			Audience: cfg.OIDCAudience,
+			Subjects: cfg.OIDCSubjects,
+		}))
+	}
+	return admin.AnyOf(authorizers...)
 }
 
 // initLogger creates and configures the structured logger
@@ -198,18 +348,20 @@ func initLogger(level, format string) *slog.Logger {
 	return logging.NewLogger(level, format)
 }
 
+// flagSet reports whether the named flag was passed on the command line
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 func getPort() string {
 	if port := os.Getenv("PORT"); port != "" {
 		return port
 	}
 	return "8080"
 }
-
-// Middleware chain helper - applies middleware in reverse order
-// so they execute in the order they're passed
-func chainMiddleware(handler http.Handler, middlewares ...func(http.Handler) http.Handler) http.Handler {
-	for i := len(middlewares) - 1; i >= 0; i-- {
-		handler = middlewares[i](handler)
-	}
-	return handler
-}
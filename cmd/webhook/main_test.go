@@ -1,10 +1,7 @@
 package main
 
 import (
-	"net/http"
-	"net/http/httptest"
 	"os"
-	"reflect"
 	"testing"
 )
 
@@ -46,46 +43,3 @@ func TestGetPort(t *testing.T) {
 		})
 	}
 }
-
-func TestMiddlewareChaining(t *testing.T) {
-	executionOrder := []string{}
-
-	middleware1 := func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			executionOrder = append(executionOrder, "middleware1_before")
-			next.ServeHTTP(w, r)
-			executionOrder = append(executionOrder, "middleware1_after")
-		})
-	}
-
-	middleware2 := func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			executionOrder = append(executionOrder, "middleware2_before")
-			next.ServeHTTP(w, r)
-			executionOrder = append(executionOrder, "middleware2_after")
-		})
-	}
-
-	finalHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		executionOrder = append(executionOrder, "handler")
-	})
-
-	handler := chainMiddleware(finalHandler, middleware1, middleware2)
-
-	req := httptest.NewRequest(http.MethodGet, "/test", nil)
-	w := httptest.NewRecorder()
-	handler.ServeHTTP(w, req)
-
-	// Check execution order
-	expected := []string{
-		"middleware1_before",
-		"middleware2_before",
-		"handler",
-		"middleware2_after",
-		"middleware1_after",
-	}
-
-	if !reflect.DeepEqual(executionOrder, expected) {
-		t.Errorf("middleware execution order = %v, want %v", executionOrder, expected)
-	}
-}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/buildkite"
+	"github.com/mcncl/buildkite-pubsub/internal/quarantine"
+	"github.com/mcncl/buildkite-pubsub/pkg/buildkiteauth"
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook"
+)
+
+// reprocessOptions describes a reprocess run
+type reprocessOptions struct {
+	// Dir is the quarantine directory
+	Dir string
+	// URL is the webhook URL quarantined payloads are sent to again
+	URL        string
+	Token      string
+	HMACSecret string
+	// Keep leaves reprocessed payloads in the quarantine
+	Keep bool
+}
+
+// runReprocess implements the reprocess subcommand, which sends quarantined
+// payloads to the webhook again once the transform is fixed, and returns
+// the exit code
+func runReprocess(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("reprocess", flag.ContinueOnError)
+	opts := reprocessOptions{}
+	fs.StringVar(&opts.Dir, "dir", os.Getenv("QUARANTINE_DIR"), "Quarantine directory (defaults to $QUARANTINE_DIR)")
+	fs.StringVar(&opts.URL, "url", "", "Webhook URL to send quarantined payloads to")
+	fs.StringVar(&opts.Token, "token", os.Getenv("BUILDKITE_WEBHOOK_TOKEN"), "Webhook token (defaults to $BUILDKITE_WEBHOOK_TOKEN)")
+	fs.StringVar(&opts.HMACSecret, "hmac-secret", os.Getenv("BUILDKITE_WEBHOOK_HMAC_SECRET"), "Webhook HMAC secret (defaults to $BUILDKITE_WEBHOOK_HMAC_SECRET)")
+	fs.BoolVar(&opts.Keep, "keep", false, "Keep reprocessed payloads in the quarantine")
+	fs.SetOutput(out)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if opts.Dir == "" || opts.URL == "" || (opts.Token == "" && opts.HMACSecret == "") {
+		_, _ = fmt.Fprintln(out, "reprocess: -dir, -url and -token or -hmac-secret are required")
+		return 2
+	}
+
+	dir, err := quarantine.NewDir(opts.Dir)
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "reprocess: %v\n", err)
+		return 1
+	}
+	failed, err := reprocess(context.Background(), dir, &http.Client{Timeout: 30 * time.Second}, opts, out)
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "reprocess: %v\n", err)
+		return 1
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// reprocess sends each quarantined payload to the webhook, removing those
+// it publishes unless opts.Keep is set, and returns the number that failed.
+// A payload the webhook quarantines again is reported as failed.
+func reprocess(ctx context.Context, dir *quarantine.Dir, httpClient *http.Client, opts reprocessOptions, out io.Writer) (int, error) {
+	entries, err := dir.List()
+	if err != nil {
+		return 0, err
+	}
+
+	var reprocessed, failed int
+	for _, entry := range entries {
+		status, err := resend(ctx, httpClient, opts, entry)
+		switch {
+		case err != nil:
+			_, _ = fmt.Fprintf(out, "FAIL %s %s: %v\n", entry.ID, entry.EventType, err)
+		case status == http.StatusAccepted:
+			_, _ = fmt.Fprintf(out, "FAIL %s %s: quarantined again\n", entry.ID, entry.EventType)
+		case status != http.StatusOK:
+			_, _ = fmt.Fprintf(out, "FAIL %s %s: HTTP %d\n", entry.ID, entry.EventType, status)
+		default:
+			reprocessed++
+			_, _ = fmt.Fprintf(out, "OK   %s %s\n", entry.ID, entry.EventType)
+			if !opts.Keep {
+				if err := dir.Remove(entry.ID); err != nil {
+					return failed, err
+				}
+			}
+			continue
+		}
+		failed++
+	}
+	_, _ = fmt.Fprintf(out, "%d reprocessed, %d failed\n", reprocessed, failed)
+	return failed, nil
+}
+
+// resend posts a quarantined payload to the webhook as Buildkite would, with
+// its original delivery ID, and returns the response status
+func resend(ctx context.Context, httpClient *http.Client, opts reprocessOptions, entry quarantine.Entry) (int, error) {
+	body := []byte(entry.Body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(buildkite.EventHeader, entry.EventType)
+	req.Header.Set(webhook.DeliveryModeHeader, subscriber.DeliveryModeReplayed)
+	if entry.DeliveryID != "" {
+		req.Header.Set(buildkite.DeliveryIDHeader, entry.DeliveryID)
+	}
+	if opts.HMACSecret != "" {
+		ts := time.Now().Unix()
+		req.Header.Set(buildkiteauth.SignatureHeader, fmt.Sprintf("timestamp=%d,signature=%s", ts, buildkiteauth.Sign(opts.HMACSecret, ts, body)))
+	} else {
+		req.Header.Set(buildkiteauth.TokenHeader, opts.Token)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/internal/buildkite"
+	"github.com/mcncl/buildkite-pubsub/internal/quarantine"
+	"github.com/mcncl/buildkite-pubsub/pkg/buildkiteauth"
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook"
+)
+
+func TestRunReprocess(t *testing.T) {
+	// The fixed webhook publishes build events, but still fails job events
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(buildkiteauth.TokenHeader) != "test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get(webhook.DeliveryModeHeader) != subscriber.DeliveryModeReplayed {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, r.Header.Get(buildkite.DeliveryIDHeader)+" "+string(body))
+		if r.Header.Get(buildkite.EventHeader) == "job.finished" {
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "quarantine")
+	dir, err := quarantine.NewDir(path)
+	if err != nil {
+		t.Fatalf("NewDir() error = %v", err)
+	}
+	build := `{"event":"build.finished"}`
+	if _, err := dir.Put([]byte(build), "build.finished", "d1", errors.New("bad build")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dir.Put([]byte(`{"event":"job.finished"}`), "job.finished", "d2", errors.New("bad job")); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if code := runReprocess([]string{"-dir", path, "-url", server.URL, "-token", "test-token"}, &out); code != 1 {
+		t.Fatalf("runReprocess() = %d, want 1 as one payload still fails: %s", code, out.String())
+	}
+	if !strings.Contains(out.String(), "1 reprocessed, 1 failed") {
+		t.Errorf("output = %q, want a summary of 1 reprocessed and 1 failed", out.String())
+	}
+	if len(received) != 2 || received[0] != "d1 "+build {
+		t.Errorf("received %q, want the build payload as quarantined with its delivery ID first", received)
+	}
+	entries, _ := dir.List()
+	if len(entries) != 1 || entries[0].EventType != "job.finished" {
+		t.Errorf("quarantine after reprocess = %+v, want only the job payload", entries)
+	}
+
+	if code := runReprocess([]string{"-dir", path}, &out); code != 2 {
+		t.Errorf("runReprocess() without -url = %d, want 2", code)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub/v2"
+	"cloud.google.com/go/pubsub/v2/apiv1/pubsubpb"
+	"github.com/mcncl/buildkite-pubsub/pkg/buildkiteauth"
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// defaultBuildkiteAPIURL is the Buildkite REST API base URL
+const defaultBuildkiteAPIURL = "https://api.buildkite.com/v2"
+
+// Self-test check results
+const (
+	selftestPass = "PASS"
+	selftestFail = "FAIL"
+	selftestSkip = "SKIP"
+)
+
+// selftestOptions describes the environment checked by selftest
+type selftestOptions struct {
+	// URL is the public webhook URL Buildkite delivers to
+	URL        string
+	Token      string
+	HMACSecret string
+	// ProjectID and TopicID name the topic the webhook publishes to; empty
+	// skips the delivery check
+	ProjectID string
+	TopicID   string
+	// APIToken and Org enable the Buildkite API check
+	APIURL   string
+	APIToken string
+	Org      string
+	// Timeout bounds the wait for the event to arrive on Pub/Sub
+	Timeout time.Duration
+}
+
+// selftestCheck records the result of one check
+type selftestCheck struct {
+	Name   string
+	Result string
+	Detail string
+}
+
+// runSelftest implements the selftest subcommand and returns the exit code
+func runSelftest(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	opts := selftestOptions{}
+	fs.StringVar(&opts.URL, "url", "", "Public webhook URL, as configured in Buildkite")
+	fs.StringVar(&opts.Token, "token", os.Getenv("BUILDKITE_WEBHOOK_TOKEN"), "Webhook token (defaults to $BUILDKITE_WEBHOOK_TOKEN)")
+	fs.StringVar(&opts.HMACSecret, "hmac-secret", os.Getenv("BUILDKITE_WEBHOOK_HMAC_SECRET"), "Webhook HMAC secret (defaults to $BUILDKITE_WEBHOOK_HMAC_SECRET)")
+	fs.StringVar(&opts.ProjectID, "project", os.Getenv("PROJECT_ID"), "Google Cloud project ID (defaults to $PROJECT_ID)")
+	fs.StringVar(&opts.TopicID, "topic", os.Getenv("TOPIC_ID"), "Topic ID the webhook publishes to (defaults to $TOPIC_ID)")
+	fs.StringVar(&opts.APIURL, "api-url", defaultBuildkiteAPIURL, "Buildkite REST API base URL")
+	fs.StringVar(&opts.APIToken, "api-token", os.Getenv("BUILDKITE_API_TOKEN"), "Buildkite API token with read_organizations scope (defaults to $BUILDKITE_API_TOKEN)")
+	fs.StringVar(&opts.Org, "org", "", "Buildkite organization slug")
+	fs.DurationVar(&opts.Timeout, "timeout", time.Minute, "How long to wait for the event to arrive on Pub/Sub")
+	fs.SetOutput(out)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if opts.URL == "" || (opts.Token == "" && opts.HMACSecret == "") {
+		_, _ = fmt.Fprintln(out, "selftest: -url and -token or -hmac-secret are required")
+		return 2
+	}
+	if (opts.ProjectID == "") != (opts.TopicID == "") {
+		_, _ = fmt.Fprintln(out, "selftest: -project and -topic must be set together")
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout+time.Minute)
+	defer cancel()
+
+	var client *pubsub.Client
+	if opts.ProjectID != "" {
+		var err error
+		client, err = pubsub.NewClient(ctx, opts.ProjectID)
+		if err != nil {
+			_, _ = fmt.Fprintf(out, "selftest: failed to create Pub/Sub client: %v\n", err)
+			return 1
+		}
+		defer func() { _ = client.Close() }()
+	}
+
+	checks := selftest(ctx, client, &http.Client{Timeout: 30 * time.Second}, opts)
+	printSelftestReport(out, checks)
+	for _, c := range checks {
+		if c.Result == selftestFail {
+			return 1
+		}
+	}
+	return 0
+}
+
+// selftest checks the Buildkite API, sends an authenticated ping to the
+// public URL and, when a client is given, waits for the webhook to publish
+// it to the topic. A check that cannot run because an earlier one failed is
+// skipped.
+func selftest(ctx context.Context, client *pubsub.Client, httpClient *http.Client, opts selftestOptions) []selftestCheck {
+	checks := []selftestCheck{
+		checkBuildkiteAPI(ctx, httpClient, opts),
+		// Buildkite's API has no endpoint for notification services, so the
+		// webhook can be neither registered nor inspected through it
+		{Name: "Buildkite webhook", Result: selftestSkip, Detail: "not available through the Buildkite API; check Settings > Notification Services"},
+	}
+
+	id := selftestID()
+	var subID string
+	if client == nil {
+		checks = append(checks, selftestCheck{Name: "Pub/Sub subscription", Result: selftestSkip, Detail: "no -project and -topic"})
+	} else {
+		// Only messages published after the subscription exists are
+		// delivered, so create it before the ping
+		check, created := createSelftestSubscription(ctx, client, opts, id)
+		checks = append(checks, check)
+		if created != "" {
+			subID = created
+			defer func() {
+				// Use a fresh context so a timed out run still cleans up
+				cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+				defer cancel()
+				_ = client.SubscriptionAdminClient.DeleteSubscription(cleanupCtx, &pubsubpb.DeleteSubscriptionRequest{
+					Subscription: fmt.Sprintf("projects/%s/subscriptions/%s", opts.ProjectID, subID),
+				})
+			}()
+		}
+	}
+
+	ping, published := pingWebhook(ctx, httpClient, opts, id, subID != "")
+	checks = append(checks, ping)
+
+	switch {
+	case client == nil:
+		checks = append(checks, selftestCheck{Name: "Pub/Sub delivery", Result: selftestSkip, Detail: "no -project and -topic"})
+	case subID == "" || ping.Result != selftestPass:
+		checks = append(checks, selftestCheck{Name: "Pub/Sub delivery", Result: selftestSkip, Detail: "an earlier check failed"})
+	case !published:
+		checks = append(checks, selftestCheck{Name: "Pub/Sub delivery", Result: selftestFail,
+			Detail: "the webhook did not publish the ping; it may predate self-test support"})
+	default:
+		checks = append(checks, awaitSelftestEvent(ctx, client, subID, id, opts.Timeout))
+	}
+	return checks
+}
+
+// checkBuildkiteAPI confirms the API token can read the organization
+func checkBuildkiteAPI(ctx context.Context, httpClient *http.Client, opts selftestOptions) selftestCheck {
+	check := selftestCheck{Name: "Buildkite API"}
+	if opts.APIToken == "" || opts.Org == "" {
+		check.Result, check.Detail = selftestSkip, "no -api-token and -org"
+		return check
+	}
+
+	endpoint := strings.TrimSuffix(opts.APIURL, "/") + "/organizations/" + url.PathEscape(opts.Org)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		check.Result, check.Detail = selftestFail, err.Error()
+		return check
+	}
+	req.Header.Set("Authorization", "Bearer "+opts.APIToken)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		check.Result, check.Detail = selftestFail, err.Error()
+		return check
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		check.Result, check.Detail = selftestFail, "API token rejected"
+		return check
+	case http.StatusForbidden, http.StatusNotFound:
+		check.Result, check.Detail = selftestFail, fmt.Sprintf("organization %s not found or not readable with this token (HTTP %d)", opts.Org, resp.StatusCode)
+		return check
+	default:
+		check.Result, check.Detail = selftestFail, fmt.Sprintf("unexpected HTTP %d", resp.StatusCode)
+		return check
+	}
+
+	var org struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&org); err != nil {
+		check.Result, check.Detail = selftestFail, fmt.Sprintf("failed to decode organization: %v", err)
+		return check
+	}
+	check.Result, check.Detail = selftestPass, "organization "+org.Name
+	return check
+}
+
+// createSelftestSubscription creates a temporary subscription receiving only
+// this run's event and returns its ID, or "" if it could not be created
+func createSelftestSubscription(ctx context.Context, client *pubsub.Client, opts selftestOptions, id string) (selftestCheck, string) {
+	check := selftestCheck{Name: "Pub/Sub subscription"}
+	subID := opts.TopicID + "-selftest-" + id
+	_, err := client.SubscriptionAdminClient.CreateSubscription(ctx, &pubsubpb.Subscription{
+		Name:   fmt.Sprintf("projects/%s/subscriptions/%s", opts.ProjectID, subID),
+		Topic:  fmt.Sprintf("projects/%s/topics/%s", opts.ProjectID, opts.TopicID),
+		Filter: fmt.Sprintf("attributes.%s = %q", subscriber.SelftestIDAttribute, id),
+		// Pub/Sub removes the subscription if the run dies before deleting it
+		ExpirationPolicy: &pubsubpb.ExpirationPolicy{Ttl: durationpb.New(24 * time.Hour)},
+	})
+	if err != nil {
+		check.Result, check.Detail = selftestFail, fmt.Sprintf("failed to create temporary subscription %s: %v", subID, err)
+		return check, ""
+	}
+	check.Result, check.Detail = selftestPass, "created temporary subscription "+subID
+	return check, subID
+}
+
+// pingWebhook sends an authenticated ping to the public URL, asking the
+// webhook to publish it when publish is set, and reports whether it did
+func pingWebhook(ctx context.Context, httpClient *http.Client, opts selftestOptions, id string, publish bool) (selftestCheck, bool) {
+	check := selftestCheck{Name: "Webhook ping"}
+	body := []byte(`{"event":"ping"}`)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, opts.URL, bytes.NewReader(body))
+	if err != nil {
+		check.Result, check.Detail = selftestFail, err.Error()
+		return check, false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Buildkite-Event", "ping")
+	if opts.HMACSecret != "" {
+		ts := time.Now().Unix()
+		req.Header.Set(buildkiteauth.SignatureHeader, fmt.Sprintf("timestamp=%d,signature=%s", ts, buildkiteauth.Sign(opts.HMACSecret, ts, body)))
+	} else {
+		req.Header.Set(buildkiteauth.TokenHeader, opts.Token)
+	}
+	if publish {
+		req.Header.Set(webhook.SelftestHeader, id)
+	}
+
+	start := time.Now()
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		check.Result, check.Detail = selftestFail, err.Error()
+		return check, false
+	}
+	defer func() { _ = resp.Body.Close() }()
+	elapsed := time.Since(start).Round(time.Millisecond)
+
+	var response map[string]string
+	_ = json.NewDecoder(resp.Body).Decode(&response)
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		check.Result, check.Detail = selftestFail, "webhook rejected the token or signature (HTTP 401)"
+	case resp.StatusCode != http.StatusOK:
+		check.Result, check.Detail = selftestFail, fmt.Sprintf("HTTP %d: %s", resp.StatusCode, response["message"])
+	case response["service"] != "buildkite-pubsub":
+		check.Result, check.Detail = selftestFail, "HTTP 200 from something other than buildkite-pubsub"
+	default:
+		check.Result, check.Detail = selftestPass, fmt.Sprintf("HTTP 200 in %s from version %s", elapsed, response["version"])
+	}
+	return check, check.Result == selftestPass && response["message_id"] != ""
+}
+
+// awaitSelftestEvent waits up to timeout for this run's event to arrive on
+// the temporary subscription
+func awaitSelftestEvent(ctx context.Context, client *pubsub.Client, subID, id string, timeout time.Duration) selftestCheck {
+	check := selftestCheck{Name: "Pub/Sub delivery"}
+	receiveCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	received := make(chan time.Duration, 1)
+	err := client.Subscriber(subID).Receive(receiveCtx, func(_ context.Context, m *pubsub.Message) {
+		m.Ack()
+		if m.Attributes[subscriber.SelftestIDAttribute] != id {
+			return
+		}
+		select {
+		case received <- time.Since(start).Round(time.Millisecond):
+		default:
+		}
+		cancel()
+	})
+
+	select {
+	case elapsed := <-received:
+		check.Result, check.Detail = selftestPass, fmt.Sprintf("event received after %s", elapsed)
+	default:
+		check.Result = selftestFail
+		check.Detail = fmt.Sprintf("event not received within %s", timeout)
+		if err != nil {
+			check.Detail = fmt.Sprintf("failed to receive: %v", err)
+		}
+	}
+	return check
+}
+
+// selftestID returns a random ID for one run, valid in a subscription name
+func selftestID() string {
+	b := make([]byte, 6)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// printSelftestReport writes one line per check and the overall result
+func printSelftestReport(out io.Writer, checks []selftestCheck) {
+	result := selftestPass
+	_, _ = fmt.Fprintln(out, "Self-test report:")
+	for _, c := range checks {
+		_, _ = fmt.Fprintf(out, "  %-4s  %-20s %s\n", c.Result, c.Name, c.Detail)
+		if c.Result == selftestFail {
+			result = selftestFail
+		}
+	}
+	_, _ = fmt.Fprintf(out, "Result: %s\n", result)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub/pstest"
+	"cloud.google.com/go/pubsub/v2"
+	"cloud.google.com/go/pubsub/v2/apiv1/pubsubpb"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSelftest(t *testing.T) {
+	ctx := context.Background()
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	srv := pstest.NewServer()
+	defer func() { _ = srv.Close() }()
+	t.Setenv("PUBSUB_EMULATOR_HOST", srv.Addr)
+
+	client, err := pubsub.NewClient(ctx, "test-project")
+	if err != nil {
+		t.Fatalf("pubsub.NewClient: %v", err)
+	}
+	defer func() { _ = client.Close() }()
+	if _, err := client.TopicAdminClient.CreateTopic(ctx, &pubsubpb.Topic{Name: "projects/test-project/topics/events"}); err != nil {
+		t.Fatalf("CreateTopic: %v", err)
+	}
+
+	pub, err := publisher.NewPubSubPublisher(ctx, "test-project", "events")
+	if err != nil {
+		t.Fatalf("NewPubSubPublisher: %v", err)
+	}
+	defer func() { _ = pub.Close() }()
+	webhookSrv := httptest.NewServer(webhook.NewHandler(webhook.Config{BuildkiteToken: "test-token", Publisher: pub, Version: "v1.2.3"}))
+	defer webhookSrv.Close()
+
+	apiSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer api-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/organizations/my-org" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`{"slug":"my-org","name":"My Org"}`))
+	}))
+	defer apiSrv.Close()
+
+	opts := selftestOptions{
+		URL:       webhookSrv.URL,
+		Token:     "test-token",
+		ProjectID: "test-project",
+		TopicID:   "events",
+		APIURL:    apiSrv.URL,
+		APIToken:  "api-token",
+		Org:       "my-org",
+		Timeout:   10 * time.Second,
+	}
+	results := func(checks []selftestCheck) map[string]string {
+		m := make(map[string]string)
+		for _, c := range checks {
+			m[c.Name] = c.Result
+		}
+		return m
+	}
+
+	checks := selftest(ctx, client, http.DefaultClient, opts)
+	want := map[string]string{
+		"Buildkite API":        selftestPass,
+		"Buildkite webhook":    selftestSkip,
+		"Pub/Sub subscription": selftestPass,
+		"Webhook ping":         selftestPass,
+		"Pub/Sub delivery":     selftestPass,
+	}
+	for name, result := range want {
+		if got := results(checks)[name]; got != result {
+			t.Errorf("%s = %s, want %s: %+v", name, got, result, checks)
+		}
+	}
+
+	// The temporary subscription is removed
+	subs := client.SubscriptionAdminClient.ListSubscriptions(ctx, &pubsubpb.ListSubscriptionsRequest{Project: "projects/test-project"})
+	if sub, err := subs.Next(); err == nil {
+		t.Errorf("subscription %s left behind", sub.GetName())
+	}
+
+	var out bytes.Buffer
+	printSelftestReport(&out, checks)
+	if !strings.Contains(out.String(), "Result: PASS") {
+		t.Errorf("report = %q, want an overall pass", out.String())
+	}
+
+	// A wrong token fails the ping and skips the delivery check
+	opts.Token = "wrong-token"
+	opts.APIToken = "wrong-token"
+	checks = selftest(ctx, client, http.DefaultClient, opts)
+	want = map[string]string{
+		"Buildkite API":    selftestFail,
+		"Webhook ping":     selftestFail,
+		"Pub/Sub delivery": selftestSkip,
+	}
+	for name, result := range want {
+		if got := results(checks)[name]; got != result {
+			t.Errorf("with a wrong token %s = %s, want %s: %+v", name, got, result, checks)
+		}
+	}
+
+	// Without Pub/Sub only the ping is checked
+	opts.Token = "test-token"
+	checks = selftest(ctx, nil, http.DefaultClient, opts)
+	if got := results(checks); got["Webhook ping"] != selftestPass || got["Pub/Sub delivery"] != selftestSkip {
+		t.Errorf("without Pub/Sub checks = %+v", checks)
+	}
+}
+
+func TestRunSelftestFlags(t *testing.T) {
+	for name, args := range map[string][]string{
+		"no url":         {"-token", "t"},
+		"no credentials": {"-url", "https://example.com/webhook", "-token", "", "-hmac-secret", ""},
+		"project only":   {"-url", "https://example.com/webhook", "-token", "t", "-project", "p", "-topic", ""},
+	} {
+		var out bytes.Buffer
+		if code := runSelftest(args, &out); code != 2 {
+			t.Errorf("runSelftest() with %s = %d, want 2: %s", name, code, out.String())
+		}
+	}
+}
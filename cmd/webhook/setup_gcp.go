@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	"cloud.google.com/go/iam/apiv1/iampb"
+	"cloud.google.com/go/pubsub/v2"
+	"cloud.google.com/go/pubsub/v2/apiv1/pubsubpb"
+	"github.com/googleapis/gax-go/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// setupOptions describes the Pub/Sub resources created by setup-gcp
+type setupOptions struct {
+	ProjectID           string
+	TopicID             string
+	DLQTopicID          string
+	SubscriptionID      string
+	MaxDeliveryAttempts int32
+	// ServiceAccount is the runtime service account email granted publish access
+	ServiceAccount string
+	// ProjectNumber enables bindings for the Pub/Sub service agent, which
+	// dead lettering needs to move messages to the DLQ topic
+	ProjectNumber string
+}
+
+// setupStep records what setup-gcp did to one resource
+type setupStep struct {
+	Resource string
+	Action   string
+}
+
+// iamPolicyClient is implemented by both the topic and subscription admin clients
+type iamPolicyClient interface {
+	GetIamPolicy(ctx context.Context, req *iampb.GetIamPolicyRequest, opts ...gax.CallOption) (*iampb.Policy, error)
+	SetIamPolicy(ctx context.Context, req *iampb.SetIamPolicyRequest, opts ...gax.CallOption) (*iampb.Policy, error)
+}
+
+// runSetupGCP implements the setup-gcp subcommand and returns the exit code
+func runSetupGCP(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("setup-gcp", flag.ContinueOnError)
+	opts := setupOptions{}
+	fs.StringVar(&opts.ProjectID, "project", os.Getenv("PROJECT_ID"), "Google Cloud project ID (defaults to $PROJECT_ID)")
+	fs.StringVar(&opts.TopicID, "topic", os.Getenv("TOPIC_ID"), "Topic ID (defaults to $TOPIC_ID)")
+	fs.StringVar(&opts.DLQTopicID, "dlq-topic", os.Getenv("DLQ_TOPIC_ID"), "Dead letter topic ID (defaults to $DLQ_TOPIC_ID or <topic>-dlq)")
+	fs.StringVar(&opts.SubscriptionID, "subscription", "", "Subscription ID (defaults to <topic>-sub)")
+	maxAttempts := fs.Int("max-delivery-attempts", 5, "Delivery attempts before a message is dead-lettered (5-100)")
+	fs.StringVar(&opts.ServiceAccount, "service-account", "", "Runtime service account email to grant publish access")
+	fs.StringVar(&opts.ProjectNumber, "project-number", "", "Project number, to grant the Pub/Sub service agent dead-letter permissions")
+	fs.SetOutput(out)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if opts.ProjectID == "" || opts.TopicID == "" {
+		_, _ = fmt.Fprintln(out, "setup-gcp: -project and -topic are required")
+		return 2
+	}
+	if opts.DLQTopicID == "" {
+		opts.DLQTopicID = opts.TopicID + "-dlq"
+	}
+	if opts.SubscriptionID == "" {
+		opts.SubscriptionID = opts.TopicID + "-sub"
+	}
+	if *maxAttempts < 5 || *maxAttempts > 100 {
+		_, _ = fmt.Fprintln(out, "setup-gcp: -max-delivery-attempts must be between 5 and 100")
+		return 2
+	}
+	opts.MaxDeliveryAttempts = int32(*maxAttempts) // #nosec G115 -- range checked above
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	client, err := pubsub.NewClient(ctx, opts.ProjectID)
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "setup-gcp: failed to create Pub/Sub client: %v\n", err)
+		return 1
+	}
+	defer func() { _ = client.Close() }()
+
+	steps, err := setupGCP(ctx, client, opts)
+	printSetupSummary(out, steps)
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "setup-gcp: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// setupGCP idempotently creates the topic, DLQ topic, subscription with
+// dead-letter policy and IAM bindings. Steps completed before an error are
+// still returned so the summary shows partial progress.
+func setupGCP(ctx context.Context, client *pubsub.Client, opts setupOptions) ([]setupStep, error) {
+	var steps []setupStep
+	topicPath := fmt.Sprintf("projects/%s/topics/%s", opts.ProjectID, opts.TopicID)
+	dlqTopicPath := fmt.Sprintf("projects/%s/topics/%s", opts.ProjectID, opts.DLQTopicID)
+	subPath := fmt.Sprintf("projects/%s/subscriptions/%s", opts.ProjectID, opts.SubscriptionID)
+
+	for _, path := range []string{topicPath, dlqTopicPath} {
+		action, err := ensureTopic(ctx, client, path)
+		if err != nil {
+			return steps, err
+		}
+		steps = append(steps, setupStep{Resource: path, Action: action})
+	}
+
+	action, err := ensureSubscription(ctx, client, subPath, topicPath, dlqTopicPath, opts.MaxDeliveryAttempts)
+	if err != nil {
+		return steps, err
+	}
+	steps = append(steps, setupStep{Resource: subPath, Action: action})
+
+	type binding struct {
+		client   iamPolicyClient
+		resource string
+		role     string
+		member   string
+	}
+	var bindings []binding
+
+	if opts.ServiceAccount != "" {
+		member := "serviceAccount:" + opts.ServiceAccount
+		bindings = append(bindings,
+			binding{client.TopicAdminClient, topicPath, "roles/pubsub.publisher", member},
+			binding{client.TopicAdminClient, dlqTopicPath, "roles/pubsub.publisher", member},
+			binding{client.TopicAdminClient, topicPath, "roles/pubsub.viewer", member},
+		)
+	} else {
+		steps = append(steps, setupStep{Resource: "runtime service account bindings", Action: "skipped (no -service-account)"})
+	}
+
+	if opts.ProjectNumber != "" {
+		agent := fmt.Sprintf("serviceAccount:service-%s@gcp-sa-pubsub.iam.gserviceaccount.com", opts.ProjectNumber)
+		bindings = append(bindings,
+			binding{client.TopicAdminClient, dlqTopicPath, "roles/pubsub.publisher", agent},
+			binding{client.SubscriptionAdminClient, subPath, "roles/pubsub.subscriber", agent},
+		)
+	} else {
+		steps = append(steps, setupStep{Resource: "Pub/Sub service agent bindings", Action: "skipped (no -project-number)"})
+	}
+
+	for _, b := range bindings {
+		action, err := ensureIAMBinding(ctx, b.client, b.resource, b.role, b.member)
+		if err != nil {
+			return steps, err
+		}
+		steps = append(steps, setupStep{
+			Resource: fmt.Sprintf("%s %s on %s", b.member, b.role, b.resource),
+			Action:   action,
+		})
+	}
+
+	return steps, nil
+}
+
+// ensureTopic creates the topic if it does not already exist
+func ensureTopic(ctx context.Context, client *pubsub.Client, topicPath string) (string, error) {
+	_, err := client.TopicAdminClient.CreateTopic(ctx, &pubsubpb.Topic{Name: topicPath})
+	switch status.Code(err) {
+	case codes.OK:
+		return "created", nil
+	case codes.AlreadyExists:
+		return "exists", nil
+	default:
+		return "", fmt.Errorf("failed to create topic %s: %w", topicPath, err)
+	}
+}
+
+// ensureSubscription creates the subscription, or updates its dead-letter
+// policy when it exists with different settings
+func ensureSubscription(ctx context.Context, client *pubsub.Client, subPath, topicPath, dlqTopicPath string, maxAttempts int32) (string, error) {
+	policy := &pubsubpb.DeadLetterPolicy{
+		DeadLetterTopic:     dlqTopicPath,
+		MaxDeliveryAttempts: maxAttempts,
+	}
+
+	_, err := client.SubscriptionAdminClient.CreateSubscription(ctx, &pubsubpb.Subscription{
+		Name:               subPath,
+		Topic:              topicPath,
+		AckDeadlineSeconds: 60,
+		DeadLetterPolicy:   policy,
+	})
+	switch status.Code(err) {
+	case codes.OK:
+		return "created", nil
+	case codes.AlreadyExists:
+		// Reconcile the dead-letter policy below
+	default:
+		return "", fmt.Errorf("failed to create subscription %s: %w", subPath, err)
+	}
+
+	existing, err := client.SubscriptionAdminClient.GetSubscription(ctx, &pubsubpb.GetSubscriptionRequest{Subscription: subPath})
+	if err != nil {
+		return "", fmt.Errorf("failed to get subscription %s: %w", subPath, err)
+	}
+	if existing.GetTopic() != topicPath {
+		return "", fmt.Errorf("subscription %s exists but is attached to %s", subPath, existing.GetTopic())
+	}
+
+	current := existing.GetDeadLetterPolicy()
+	if current.GetDeadLetterTopic() == dlqTopicPath && current.GetMaxDeliveryAttempts() == maxAttempts {
+		return "exists", nil
+	}
+
+	existing.DeadLetterPolicy = policy
+	_, err = client.SubscriptionAdminClient.UpdateSubscription(ctx, &pubsubpb.UpdateSubscriptionRequest{
+		Subscription: existing,
+		UpdateMask:   &fieldmaskpb.FieldMask{Paths: []string{"dead_letter_policy"}},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to update dead-letter policy on %s: %w", subPath, err)
+	}
+	return "updated dead-letter policy", nil
+}
+
+// ensureIAMBinding adds member to role on resource unless already present
+func ensureIAMBinding(ctx context.Context, client iamPolicyClient, resource, role, member string) (string, error) {
+	policy, err := client.GetIamPolicy(ctx, &iampb.GetIamPolicyRequest{Resource: resource})
+	if err != nil {
+		return "", fmt.Errorf("failed to get IAM policy for %s: %w", resource, err)
+	}
+
+	for _, b := range policy.GetBindings() {
+		if b.GetRole() == role && b.GetCondition() == nil && slices.Contains(b.GetMembers(), member) {
+			return "already granted", nil
+		}
+	}
+
+	granted := false
+	for _, b := range policy.Bindings {
+		if b.GetRole() == role && b.GetCondition() == nil {
+			b.Members = append(b.Members, member)
+			granted = true
+			break
+		}
+	}
+	if !granted {
+		policy.Bindings = append(policy.Bindings, &iampb.Binding{Role: role, Members: []string{member}})
+	}
+
+	// The policy etag guards against concurrent modification
+	if _, err := client.SetIamPolicy(ctx, &iampb.SetIamPolicyRequest{Resource: resource, Policy: policy}); err != nil {
+		return "", fmt.Errorf("failed to set IAM policy for %s: %w", resource, err)
+	}
+	return "granted", nil
+}
+
+// printSetupSummary writes one line per step
+func printSetupSummary(out io.Writer, steps []setupStep) {
+	_, _ = fmt.Fprintln(out, "GCP setup summary:")
+	for _, s := range steps {
+		_, _ = fmt.Fprintf(out, "  %-28s %s\n", s.Action, s.Resource)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/pubsub/pstest"
+	"cloud.google.com/go/pubsub/v2"
+	"cloud.google.com/go/pubsub/v2/apiv1/pubsubpb"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestSetupGCP(t *testing.T) {
+	ctx := context.Background()
+
+	srv := pstest.NewServer()
+	defer func() { _ = srv.Close() }()
+
+	conn, err := grpc.NewClient(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("grpc.NewClient: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	client, err := pubsub.NewClient(ctx, "test-project", option.WithGRPCConn(conn), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("pubsub.NewClient: %v", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	opts := setupOptions{
+		ProjectID:           "test-project",
+		TopicID:             "events",
+		DLQTopicID:          "events-dlq",
+		SubscriptionID:      "events-sub",
+		MaxDeliveryAttempts: 5,
+	}
+
+	actions := func(steps []setupStep) map[string]string {
+		m := make(map[string]string)
+		for _, s := range steps {
+			m[s.Resource] = s.Action
+		}
+		return m
+	}
+
+	// First run creates everything
+	steps, err := setupGCP(ctx, client, opts)
+	if err != nil {
+		t.Fatalf("setupGCP() first run error = %v", err)
+	}
+	got := actions(steps)
+	for _, resource := range []string{
+		"projects/test-project/topics/events",
+		"projects/test-project/topics/events-dlq",
+		"projects/test-project/subscriptions/events-sub",
+	} {
+		if got[resource] != "created" {
+			t.Errorf("first run %s = %q, want created", resource, got[resource])
+		}
+	}
+
+	sub, err := client.SubscriptionAdminClient.GetSubscription(ctx, &pubsubpb.GetSubscriptionRequest{
+		Subscription: "projects/test-project/subscriptions/events-sub",
+	})
+	if err != nil {
+		t.Fatalf("GetSubscription: %v", err)
+	}
+	if got := sub.GetDeadLetterPolicy().GetDeadLetterTopic(); got != "projects/test-project/topics/events-dlq" {
+		t.Errorf("dead letter topic = %q, want events-dlq", got)
+	}
+
+	// Second run is a no-op
+	steps, err = setupGCP(ctx, client, opts)
+	if err != nil {
+		t.Fatalf("setupGCP() second run error = %v", err)
+	}
+	got = actions(steps)
+	if got["projects/test-project/topics/events"] != "exists" {
+		t.Errorf("second run topic = %q, want exists", got["projects/test-project/topics/events"])
+	}
+	if got["projects/test-project/subscriptions/events-sub"] != "exists" {
+		t.Errorf("second run subscription = %q, want exists", got["projects/test-project/subscriptions/events-sub"])
+	}
+
+	// Changing max delivery attempts reconciles the policy
+	opts.MaxDeliveryAttempts = 10
+	steps, err = setupGCP(ctx, client, opts)
+	if err != nil {
+		t.Fatalf("setupGCP() third run error = %v", err)
+	}
+	if got := actions(steps)["projects/test-project/subscriptions/events-sub"]; got != "updated dead-letter policy" {
+		t.Errorf("third run subscription = %q, want updated dead-letter policy", got)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+
+	"github.com/mcncl/buildkite-pubsub/internal/errors"
+)
+
+// shutdownReason says why the process exited
+type shutdownReason string
+
+const (
+	// shutdownSignal is a graceful shutdown on a signal or preStop hook
+	shutdownSignal shutdownReason = "signal"
+	// shutdownConfigError is invalid configuration; restarting will not help
+	shutdownConfigError shutdownReason = "config_error"
+	// shutdownStartupError is a failure to reach or use Pub/Sub at startup,
+	// such as a missing topic or permission
+	shutdownStartupError shutdownReason = "startup_error"
+	// shutdownListenerError is a failure to listen on the configured port
+	shutdownListenerError shutdownReason = "listener_error"
+	// shutdownServerError is the HTTP or admin server failing while running
+	shutdownServerError shutdownReason = "server_error"
+)
+
+// exitCodes lets orchestration tell configuration errors from crashes. 2
+// matches the flag package's exit code for invalid flags.
+var exitCodes = map[shutdownReason]int{
+	shutdownSignal:        0,
+	shutdownServerError:   1,
+	shutdownConfigError:   2,
+	shutdownStartupError:  3,
+	shutdownListenerError: 4,
+}
+
+// startupFailure returns the shutdown reason for a failed startup: invalid
+// configuration is told apart from Pub/Sub being unavailable
+func startupFailure(err error) shutdownReason {
+	if errors.IsValidationError(err) {
+		return shutdownConfigError
+	}
+	return shutdownStartupError
+}
+
+// reportShutdown logs the process's final record, returning the exit code
+// for reason. A metric would rarely be scraped before the process exits, so
+// the log record and exit code are the record of the shutdown.
+func reportShutdown(logger *slog.Logger, reason shutdownReason, err error) int {
+	code := exitCodes[reason]
+	attrs := []any{"reason", string(reason), "exit_code", code}
+	if err != nil {
+		logger.Error("Exiting", append(attrs, "error", err)...)
+	} else {
+		logger.Info("Exiting", attrs...)
+	}
+	return code
+}
+
+// fatal exits after reporting the shutdown. Deferred calls do not run.
+func fatal(logger *slog.Logger, reason shutdownReason, err error) {
+	os.Exit(reportShutdown(logger, reason, err))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/internal/errors"
+)
+
+func TestReportShutdown(t *testing.T) {
+	tests := []struct {
+		reason   shutdownReason
+		err      error
+		wantCode int
+		wantLvl  string
+	}{
+		{shutdownSignal, nil, 0, "INFO"},
+		{shutdownServerError, fmt.Errorf("accept: too many open files"), 1, "ERROR"},
+		{shutdownConfigError, errors.NewValidationError("GCP.ProjectID is required"), 2, "ERROR"},
+		{shutdownStartupError, fmt.Errorf("topic does not exist"), 3, "ERROR"},
+		{shutdownListenerError, fmt.Errorf("address already in use"), 4, "ERROR"},
+	}
+	for _, tt := range tests {
+		var logs bytes.Buffer
+		if code := reportShutdown(slog.New(slog.NewJSONHandler(&logs, nil)), tt.reason, tt.err); code != tt.wantCode {
+			t.Errorf("reportShutdown(%s) = %d, want %d", tt.reason, code, tt.wantCode)
+		}
+		var record map[string]any
+		if err := json.Unmarshal(logs.Bytes(), &record); err != nil {
+			t.Fatalf("log record %q: %v", logs.String(), err)
+		}
+		if record["level"] != tt.wantLvl || record["reason"] != string(tt.reason) || record["exit_code"] != float64(tt.wantCode) {
+			t.Errorf("log record = %v", record)
+		}
+	}
+}
+
+func TestStartupFailure(t *testing.T) {
+	if got := startupFailure(errors.NewValidationError("bad credentials mode")); got != shutdownConfigError {
+		t.Errorf("startupFailure(validation error) = %s, want %s", got, shutdownConfigError)
+	}
+	if got := startupFailure(errors.NewNotFoundError("topic missing")); got != shutdownStartupError {
+		t.Errorf("startupFailure(not found error) = %s, want %s", got, shutdownStartupError)
+	}
+}
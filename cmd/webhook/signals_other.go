@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// shutdownSignals start a graceful shutdown
+var shutdownSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
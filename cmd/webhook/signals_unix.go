@@ -0,0 +1,12 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// shutdownSignals start a graceful shutdown. SIGUSR1 lets an exec preStop
+// hook start draining before Kubernetes sends SIGTERM.
+var shutdownSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1}
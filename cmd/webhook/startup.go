@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/app"
+	"github.com/mcncl/buildkite-pubsub/internal/errors"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook"
+)
+
+// Backoff between startup attempts, doubling up to the maximum
+var (
+	startupRetryInitial = time.Second
+	startupRetryMax     = 30 * time.Second
+)
+
+// startupHandler serves the service once it has started. Until then it
+// answers liveness checks, fails readiness and rejects other requests with
+// 503, so Buildkite retries deliveries that arrive while startup is retried.
+type startupHandler struct {
+	health  *webhook.HealthCheck
+	handler atomic.Pointer[http.Handler]
+}
+
+func (s *startupHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h := s.handler.Load(); h != nil {
+		(*h).ServeHTTP(w, r)
+		return
+	}
+	switch r.URL.Path {
+	case "/health":
+		s.health.HealthHandler(w, r)
+	case "/ready":
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "starting"})
+	default:
+		w.Header().Set("Retry-After", strconv.Itoa(int(startupRetryMax.Seconds())))
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+	}
+}
+
+// setHandler starts serving h
+func (s *startupHandler) setHandler(h http.Handler) {
+	s.handler.Store(&h)
+}
+
+// logStartupError logs why the service failed to start, with a hint on
+// fixing it when there is one
+func logStartupError(logger *slog.Logger, err error) {
+	attrs := []any{"error", err}
+	if hint := errors.Hint(err); hint != "" {
+		attrs = append(attrs, "hint", hint)
+	}
+	logger.Error("Service initialization error", attrs...)
+}
+
+// retryStartup retries a startup that failed with err, with exponential
+// backoff, until it succeeds or timeout passes. It returns the last error;
+// invalid configuration is never retried.
+func retryStartup(logger *slog.Logger, timeout time.Duration, err error, start func() (*app.App, error)) (*app.App, error) {
+	deadline := time.Now().Add(timeout)
+	for delay := startupRetryInitial; ; delay = min(delay*2, startupRetryMax) {
+		if errors.IsValidationError(err) || time.Now().Add(delay).After(deadline) {
+			return nil, err
+		}
+		logger.Warn("Retrying startup", "delay", delay.String(), "remaining", time.Until(deadline).Round(time.Second).String())
+		time.Sleep(delay)
+
+		svc, startErr := start()
+		if startErr == nil {
+			return svc, nil
+		}
+		err = startErr
+		logStartupError(logger, err)
+	}
+}
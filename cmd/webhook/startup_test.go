@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/app"
+	"github.com/mcncl/buildkite-pubsub/internal/errors"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook"
+)
+
+func TestStartupHandler(t *testing.T) {
+	h := &startupHandler{health: webhook.NewHealthCheck()}
+	serve := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, nil))
+		return rec
+	}
+
+	if rec := serve("/health"); rec.Code != http.StatusOK {
+		t.Errorf("/health while starting = %d, want 200", rec.Code)
+	}
+	if rec := serve("/ready"); rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "starting") {
+		t.Errorf("/ready while starting = %d %s, want 503 starting", rec.Code, rec.Body)
+	}
+	if rec := serve("/webhook"); rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("/webhook while starting = %d, Retry-After %q, want 503 with Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	h.setHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	for _, path := range []string{"/health", "/ready", "/webhook"} {
+		if rec := serve(path); rec.Code != http.StatusTeapot {
+			t.Errorf("%s once started = %d, want the service's response", path, rec.Code)
+		}
+	}
+}
+
+func TestRetryStartup(t *testing.T) {
+	initial, maxDelay := startupRetryInitial, startupRetryMax
+	t.Cleanup(func() { startupRetryInitial, startupRetryMax = initial, maxDelay })
+	startupRetryInitial, startupRetryMax = time.Millisecond, 4*time.Millisecond
+
+	notFound := errors.WithHint(fmt.Errorf("%w: topic missing", errors.ErrNotFound), "create it")
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+
+	// Succeeds once the topic appears
+	attempts := 0
+	svc, err := retryStartup(logger, time.Minute, notFound, func() (*app.App, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, notFound
+		}
+		return &app.App{}, nil
+	})
+	if err != nil || svc == nil || attempts != 3 {
+		t.Errorf("retryStartup() = %v, %v after %d attempts, want success on the third", svc, err, attempts)
+	}
+	if !strings.Contains(logs.String(), `"hint":"create it"`) {
+		t.Errorf("logs = %s, want failures logged with their hint", logs.String())
+	}
+
+	// Gives up when the timeout passes
+	svc, err = retryStartup(slog.New(slog.NewTextHandler(io.Discard, nil)), 20*time.Millisecond, notFound, func() (*app.App, error) {
+		return nil, notFound
+	})
+	if svc != nil || !errors.IsNotFoundError(err) {
+		t.Errorf("retryStartup() = %v, %v, want the last error after the timeout", svc, err)
+	}
+
+	// Never retries invalid configuration
+	attempts = 0
+	_, err = retryStartup(logger, time.Minute, errors.NewValidationError("bad route"), func() (*app.App, error) {
+		attempts++
+		return nil, nil
+	})
+	if !errors.IsValidationError(err) || attempts != 0 {
+		t.Errorf("retryStartup() = %v after %d attempts, want the validation error without retrying", err, attempts)
+	}
+}
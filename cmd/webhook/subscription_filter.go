@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+)
+
+// runSubscriptionFilter implements the subscription-filter subcommand, which
+// prints the Pub/Sub subscription filter for its terms, and returns the exit
+// code
+func runSubscriptionFilter(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("subscription-filter", flag.ContinueOnError)
+	custom := fs.String("attributes", "", "Comma-separated custom attributes published by attribute rules")
+	fs.SetOutput(out)
+	fs.Usage = func() {
+		_, _ = fmt.Fprintln(out, "Usage: webhook subscription-filter [-attributes a,b] term...")
+		_, _ = fmt.Fprintln(out, "Terms are attribute=v1,v2, attribute!=value, attribute^=prefix, attribute or !attribute, e.g.")
+		_, _ = fmt.Fprintln(out, "  webhook subscription-filter event_type=build.finished branch=main")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	terms := make([]subscriber.FilterTerm, fs.NArg())
+	for i, arg := range fs.Args() {
+		term, err := subscriber.ParseFilterTerm(arg)
+		if err != nil {
+			_, _ = fmt.Fprintf(out, "subscription-filter: %v\n", err)
+			return 2
+		}
+		terms[i] = term
+	}
+	filter, err := subscriber.SubscriptionFilter(terms, splitAttributes(*custom)...)
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "subscription-filter: %v\n", err)
+		return 1
+	}
+	_, _ = fmt.Fprintln(out, filter)
+	return 0
+}
+
+// splitAttributes splits a comma-separated list of attribute names
+func splitAttributes(list string) []string {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
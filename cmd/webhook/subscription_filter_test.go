@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRunSubscriptionFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		wantCode int
+		wantOut  string
+	}{
+		{
+			name:    "filter",
+			args:    []string{"event_type=build.finished", "branch=main"},
+			wantOut: `attributes.event_type = "build.finished" AND attributes.branch = "main"` + "\n",
+		},
+		{
+			name:    "custom attributes",
+			args:    []string{"-attributes", "severity, tier", "tier=1"},
+			wantOut: `attributes.tier = "1"` + "\n",
+		},
+		{name: "no terms", wantCode: 2},
+		{name: "malformed term", args: []string{"branch="}, wantCode: 2},
+		{name: "unknown attribute", args: []string{"severity=high"}, wantCode: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if code := runSubscriptionFilter(tt.args, &out); code != tt.wantCode {
+				t.Fatalf("runSubscriptionFilter() = %d, want %d: %s", code, tt.wantCode, out.String())
+			}
+			if tt.wantOut != "" && out.String() != tt.wantOut {
+				t.Errorf("output = %q, want %q", out.String(), tt.wantOut)
+			}
+			if tt.wantCode != 0 && !strings.Contains(out.String(), "subscription-filter") {
+				t.Errorf("output %q does not explain the failure", out.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/mcncl/buildkite-pubsub/internal/config"
+)
+
+// printConfigValidation reports the result of loading the configuration and
+// lists every deprecation, marking those it uses. It returns the exit code.
+func printConfigValidation(out io.Writer, cfg *config.Config, err error) int {
+	code := 0
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "Configuration is invalid: %v\n", err)
+		code = 1
+	} else {
+		_, _ = fmt.Fprintln(out, "Configuration is valid")
+	}
+
+	inUse := make(map[config.Deprecation]bool)
+	if cfg != nil {
+		for _, d := range cfg.Deprecated {
+			inUse[d] = true
+		}
+	}
+	_, _ = fmt.Fprintln(out, "Deprecations:")
+	for _, d := range config.Deprecations {
+		status := ""
+		if inUse[d] {
+			status = "IN USE"
+		}
+		_, _ = fmt.Fprintf(out, "  %-6s  %-4s  %-28s use %s, removed in %s\n", status, d.Source, d.Key, d.Replacement, d.RemovedIn)
+	}
+	return code
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/internal/config"
+)
+
+func TestPrintConfigValidation(t *testing.T) {
+	var out bytes.Buffer
+	cfg := &config.Config{Deprecated: []config.Deprecation{config.Deprecations[0]}}
+	if code := printConfigValidation(&out, cfg, nil); code != 0 {
+		t.Errorf("exit code = %d, want 0", code)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if lines[0] != "Configuration is valid" || len(lines) != len(config.Deprecations)+2 {
+		t.Fatalf("output = %q, want the result and every deprecation", out.String())
+	}
+	if !strings.Contains(lines[2], "IN USE") || !strings.Contains(lines[2], config.Deprecations[0].Key) {
+		t.Errorf("line %q doesn't mark %s in use", lines[2], config.Deprecations[0].Key)
+	}
+	if strings.Contains(lines[3], "IN USE") {
+		t.Errorf("line %q is marked in use", lines[3])
+	}
+
+	out.Reset()
+	if code := printConfigValidation(&out, nil, errors.New("GCP.TopicID cannot be empty")); code != 1 {
+		t.Errorf("exit code = %d, want 1", code)
+	}
+	if !strings.HasPrefix(out.String(), "Configuration is invalid: GCP.TopicID cannot be empty\n") {
+		t.Errorf("output = %q, want the error", out.String())
+	}
+}
@@ -0,0 +1,255 @@
+// Package contracts publishes the JSON Schema of the messages the webhook
+// publishes, with a corpus of recorded Buildkite payloads. Its tests check
+// that every message transformed from the corpus matches the schema, so
+// `go test ./contracts/...` fails on a release that would break consumers.
+// Consumers can range over Cases to check their own parsers against the
+// messages of the version they depend on. The package also embeds the
+// OpenAPI description of the webhook's HTTP endpoints, generated from the
+// handlers' response types by go generate.
+package contracts
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mcncl/buildkite-pubsub/internal/jsoncodec"
+	"github.com/mcncl/buildkite-pubsub/pkg/transform"
+)
+
+//go:generate go run ./internal/genopenapi -o schemas/openapi.json
+
+//go:embed schemas/*.json corpus/*.json
+var files embed.FS
+
+// Case is a recorded webhook payload and a message transformed from it
+type Case struct {
+	// Name identifies the case, such as build.finished or
+	// build.finished@v2 for the message with schema version 2
+	Name      string
+	EventType string
+	// SchemaVersion is the message's schema_version, empty for the
+	// original format
+	SchemaVersion string
+	// Payload is the webhook body as Buildkite sent it
+	Payload []byte
+	// Message is the message data as the webhook publishes it
+	Message []byte
+}
+
+// SchemaVersions are the message formats cases are produced for: the
+// original format, then every version WithSchemaVersion accepts
+func SchemaVersions() []string {
+	latest, _ := strconv.Atoi(transform.LatestSchemaVersion)
+	versions := []string{""}
+	for v := 1; v <= latest; v++ {
+		versions = append(versions, strconv.Itoa(v))
+	}
+	return versions
+}
+
+// Schema returns the message JSON Schema, covering every schema version
+func Schema() []byte {
+	data, _ := files.ReadFile("schemas/message.schema.json")
+	return data
+}
+
+// OpenAPIPath is the path the webhook serves its OpenAPI description at
+const OpenAPIPath = "/schemas/openapi.json"
+
+// OpenAPI returns the OpenAPI 3.1 description of the webhook's HTTP
+// endpoints, generated from the handlers' response types
+func OpenAPI() []byte {
+	data, _ := files.ReadFile("schemas/openapi.json")
+	return data
+}
+
+// OriginalSchemaName names the original format, without schema_version, in
+// schema paths
+const OriginalSchemaName = "original"
+
+// SchemaPath is the path the webhook serves the schema of a version at,
+// such as /schemas/2.json, or /schemas/original.json for the original
+// format
+func SchemaPath(version string) string {
+	if version == "" {
+		version = OriginalSchemaName
+	}
+	return "/schemas/" + version + ".json"
+}
+
+// epochMillisFields are the build fields schema version 2 added
+var epochMillisFields = []string{"created_at_ms", "started_at_ms", "finished_at_ms"}
+
+// SchemaFor returns the JSON Schema of messages with one schema version,
+// empty for the original format: schema_version must be that version, and
+// fields later versions add are not allowed
+func SchemaFor(version string) ([]byte, error) {
+	known := false
+	for _, v := range SchemaVersions() {
+		known = known || v == version
+	}
+	if !known {
+		return nil, fmt.Errorf("unknown schema version %q", version)
+	}
+
+	var root map[string]interface{}
+	if err := json.Unmarshal(Schema(), &root); err != nil {
+		return nil, err
+	}
+	properties := root["properties"].(map[string]interface{})
+	if version == "" {
+		root["title"] = root["title"].(string) + ", original format"
+		delete(properties, "schema_version")
+	} else {
+		root["title"] = root["title"].(string) + ", schema version " + version
+		properties["schema_version"] = map[string]interface{}{"const": version}
+		root["required"] = append(root["required"].([]interface{}), "schema_version")
+	}
+	if n, _ := strconv.Atoi(version); n < 2 {
+		build := root["$defs"].(map[string]interface{})["build"].(map[string]interface{})
+		for _, field := range epochMillisFields {
+			delete(build["properties"].(map[string]interface{}), field)
+		}
+	}
+	return json.MarshalIndent(root, "", "  ")
+}
+
+// Handler serves the schema of every version at its SchemaPath, so the
+// schema_url attribute of a message resolves to the schema it matches, and
+// the OpenAPI description at OpenAPIPath
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.URL.Path == OpenAPIPath {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+			_, _ = w.Write(OpenAPI())
+			return
+		}
+		for _, version := range SchemaVersions() {
+			if r.URL.Path != SchemaPath(version) {
+				continue
+			}
+			data, err := SchemaFor(version)
+			if err != nil {
+				http.Error(w, "failed to build schema", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/schema+json")
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+			_, _ = w.Write(data)
+			return
+		}
+		http.NotFound(w, r)
+	})
+}
+
+var (
+	compileOnce sync.Once
+	compiled    *schema
+	compileErr  error
+)
+
+// Validate checks message data against the message schema, returning a
+// *ValidationError listing every problem when it does not match
+func Validate(message []byte) error {
+	compileOnce.Do(func() {
+		compiled, compileErr = compileSchema(Schema())
+	})
+	if compileErr != nil {
+		return compileErr
+	}
+	var value interface{}
+	if err := json.Unmarshal(message, &value); err != nil {
+		return fmt.Errorf("message is not JSON: %w", err)
+	}
+	return compiled.validate(value)
+}
+
+// Cases transforms every payload of the corpus in every schema version,
+// along with the build.job messages of builds carrying jobs
+func Cases() ([]Case, error) {
+	names, err := files.ReadDir("corpus")
+	if err != nil {
+		return nil, err
+	}
+	var cases []Case
+	for _, entry := range names {
+		body, err := files.ReadFile(path.Join("corpus", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(entry.Name(), ".json")
+		for _, version := range SchemaVersions() {
+			versionCases, err := transformCases(name, body, version)
+			if err != nil {
+				return nil, fmt.Errorf("corpus %s: %w", entry.Name(), err)
+			}
+			cases = append(cases, versionCases...)
+		}
+	}
+	sort.Slice(cases, func(i, j int) bool { return cases[i].Name < cases[j].Name })
+	return cases, nil
+}
+
+// transformCases returns the messages the webhook publishes for body with
+// schema version
+func transformCases(name string, body []byte, version string) ([]Case, error) {
+	var payload transform.Payload
+	if err := jsoncodec.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	var opts []transform.Option
+	if version != "" {
+		name += "@v" + version
+		opts = append(opts, transform.WithSchemaVersion(version))
+	}
+	transformed, err := transform.Transform(payload, opts...)
+	if err != nil {
+		return nil, err
+	}
+	messages := []transform.TransformedPayload{transformed}
+
+	jobs, err := transform.BuildJobs(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(jobs) > 0 {
+		jobMessages, err := transform.JobMessages(transformed, jobs)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, jobMessages...)
+	}
+
+	cases := make([]Case, 0, len(messages))
+	for _, message := range messages {
+		data, err := jsoncodec.Marshal(message)
+		if err != nil {
+			return nil, err
+		}
+		c := Case{
+			Name:          name,
+			EventType:     message.EventType,
+			SchemaVersion: version,
+			Payload:       body,
+			Message:       data,
+		}
+		if message.JobSeries != nil {
+			c.Name += "/job/" + strconv.Itoa(message.JobSeries.Index)
+		}
+		cases = append(cases, c)
+	}
+	return cases, nil
+}
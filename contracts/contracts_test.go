@@ -0,0 +1,307 @@
+package contracts
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/contracts/internal/jsonschema"
+	"github.com/mcncl/buildkite-pubsub/pkg/transform"
+)
+
+func TestCasesMatchSchema(t *testing.T) {
+	cases, err := Cases()
+	if err != nil {
+		t.Fatalf("Cases() error = %v", err)
+	}
+
+	eventTypes := make(map[string]bool)
+	for _, c := range cases {
+		eventTypes[c.EventType] = true
+		t.Run(c.Name, func(t *testing.T) {
+			if err := Validate(c.Message); err != nil {
+				t.Fatalf("Validate() error = %v\nmessage: %s", err, c.Message)
+			}
+
+			var message struct {
+				EventType     string                 `json:"event_type"`
+				SchemaVersion string                 `json:"schema_version"`
+				Build         map[string]interface{} `json:"build"`
+			}
+			if err := json.Unmarshal(c.Message, &message); err != nil {
+				t.Fatalf("failed to decode message: %v", err)
+			}
+			if message.EventType != c.EventType || message.SchemaVersion != c.SchemaVersion {
+				t.Errorf("message event_type = %q, schema_version = %q, want %q, %q", message.EventType, message.SchemaVersion, c.EventType, c.SchemaVersion)
+			}
+			// Fields belong to the version that introduced them
+			if c.SchemaVersion == "" || c.SchemaVersion == "1" {
+				for _, field := range []string{"created_at_ms", "started_at_ms", "finished_at_ms"} {
+					if _, ok := message.Build[field]; ok {
+						t.Errorf("build.%s is set before schema version 2", field)
+					}
+				}
+			}
+		})
+	}
+
+	for _, eventType := range []string{"build.scheduled", "build.finished", "build.job", "job.finished", "agent.connected"} {
+		if !eventTypes[eventType] {
+			t.Errorf("corpus has no %s case", eventType)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases, err := Cases()
+	if err != nil {
+		t.Fatalf("Cases() error = %v", err)
+	}
+	var valid map[string]interface{}
+	for _, c := range cases {
+		if c.Name == "build.finished@v2" {
+			if err := json.Unmarshal(c.Message, &valid); err != nil {
+				t.Fatalf("failed to decode message: %v", err)
+			}
+		}
+	}
+	if valid == nil {
+		t.Fatal("no build.finished@v2 case")
+	}
+
+	tests := []struct {
+		name   string
+		change func(message map[string]interface{})
+		want   string
+	}{
+		{
+			name:   "missing field",
+			change: func(m map[string]interface{}) { delete(m, "pipeline") },
+			want:   "/: missing required field pipeline",
+		},
+		{
+			name:   "wrong type",
+			change: func(m map[string]interface{}) { m["build"].(map[string]interface{})["number"] = "697" },
+			want:   "/build/number: want integer, got string",
+		},
+		{
+			name:   "fractional integer",
+			change: func(m map[string]interface{}) { m["build"].(map[string]interface{})["number"] = 1.5 },
+			want:   "/build/number: want integer, got number",
+		},
+		{
+			name:   "unexpected field",
+			change: func(m map[string]interface{}) { m["sender"].(map[string]interface{})["login"] = "test" },
+			want:   "/sender: unexpected field login",
+		},
+		{
+			name:   "bad timestamp",
+			change: func(m map[string]interface{}) { m["build"].(map[string]interface{})["created_at"] = "yesterday" },
+			want:   `/build/created_at: "yesterday" is not an RFC 3339 timestamp`,
+		},
+		{
+			name:   "unknown enum value",
+			change: func(m map[string]interface{}) { m["schema_version"] = "3" },
+			want:   "/schema_version: 3 is not one of [1 2]",
+		},
+		{
+			name:   "pattern",
+			change: func(m map[string]interface{}) { m["event_type"] = "ping" },
+			want:   `/event_type: "ping" does not match`,
+		},
+		{
+			name:   "below minimum",
+			change: func(m map[string]interface{}) { m["build"].(map[string]interface{})["created_at_ms"] = 0 },
+			want:   "/build/created_at_ms: 0 is less than 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Copy the message through JSON so each test changes its own
+			data, _ := json.Marshal(valid)
+			var message map[string]interface{}
+			_ = json.Unmarshal(data, &message)
+			tt.change(message)
+			data, _ = json.Marshal(message)
+
+			err := Validate(data)
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) {
+				t.Fatalf("Validate() error = %v, want a *ValidationError", err)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Validate() error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+
+	if err := Validate([]byte("not json")); err == nil {
+		t.Error("Validate() of invalid JSON error = nil, want error")
+	}
+}
+
+// TestSchemaMatchesGoTypes checks the message schema describes the fields
+// transform.TransformedPayload marshals, so a field added to the Go types
+// cannot be left out of the published schema
+func TestSchemaMatchesGoTypes(t *testing.T) {
+	var root map[string]interface{}
+	if err := json.Unmarshal(Schema(), &root); err != nil {
+		t.Fatalf("failed to parse schema: %v", err)
+	}
+	defs, _ := root["$defs"].(map[string]interface{})
+	resolve := func(node map[string]interface{}) map[string]interface{} {
+		if ref, ok := node["$ref"].(string); ok {
+			def, _ := defs[strings.TrimPrefix(ref, "#/$defs/")].(map[string]interface{})
+			return def
+		}
+		return node
+	}
+
+	var compare func(generated, published map[string]interface{}, at string)
+	compare = func(generated, published map[string]interface{}, at string) {
+		published = resolve(published)
+		if want, ok := generated["type"].(string); ok && published["type"] != nil {
+			types, isList := published["type"].([]interface{})
+			if !isList {
+				types = []interface{}{published["type"]}
+			}
+			if !slices.Contains(types, interface{}(want)) {
+				t.Errorf("%s: schema type %v, Go type marshals %s", at, published["type"], want)
+			}
+		}
+		if items, ok := generated["items"].(map[string]interface{}); ok {
+			if publishedItems, ok := published["items"].(map[string]interface{}); ok {
+				compare(items, publishedItems, at+"/items")
+			}
+		}
+
+		generatedProperties, _ := generated["properties"].(map[string]interface{})
+		publishedProperties, _ := published["properties"].(map[string]interface{})
+		if generatedProperties == nil || publishedProperties == nil {
+			return
+		}
+		for name, property := range generatedProperties {
+			publishedProperty, ok := publishedProperties[name].(map[string]interface{})
+			if !ok {
+				t.Errorf("%s: schema has no %s field", at, name)
+				continue
+			}
+			compare(property.(map[string]interface{}), publishedProperty, at+"/"+name)
+		}
+		for name := range publishedProperties {
+			if _, ok := generatedProperties[name]; !ok {
+				t.Errorf("%s: schema has %s, which the Go type does not marshal", at, name)
+			}
+		}
+
+		var wantRequired, gotRequired []string
+		wantRequired = append(wantRequired, generated["required"].([]string)...)
+		for _, name := range published["required"].([]interface{}) {
+			gotRequired = append(gotRequired, name.(string))
+		}
+		sort.Strings(wantRequired)
+		sort.Strings(gotRequired)
+		if !slices.Equal(wantRequired, gotRequired) {
+			t.Errorf("%s: schema requires %v, Go type always marshals %v", at, gotRequired, wantRequired)
+		}
+	}
+	compare(jsonschema.FromType(reflect.TypeOf(transform.TransformedPayload{})), root, "")
+}
+
+func TestSchemaFor(t *testing.T) {
+	cases, err := Cases()
+	if err != nil {
+		t.Fatalf("Cases() error = %v", err)
+	}
+	schemas := make(map[string]*schema)
+	for _, version := range SchemaVersions() {
+		data, err := SchemaFor(version)
+		if err != nil {
+			t.Fatalf("SchemaFor(%q) error = %v", version, err)
+		}
+		if schemas[version], err = compileSchema(data); err != nil {
+			t.Fatalf("SchemaFor(%q) does not compile: %v", version, err)
+		}
+	}
+
+	for _, c := range cases {
+		var message interface{}
+		if err := json.Unmarshal(c.Message, &message); err != nil {
+			t.Fatalf("failed to decode %s: %v", c.Name, err)
+		}
+		for version, s := range schemas {
+			err := s.validate(message)
+			if version == c.SchemaVersion && err != nil {
+				t.Errorf("%s does not match the schema of its version: %v", c.Name, err)
+			}
+			if version != c.SchemaVersion && err == nil {
+				t.Errorf("%s matches the schema of version %q", c.Name, version)
+			}
+		}
+	}
+
+	if _, err := SchemaFor("99"); err == nil {
+		t.Error("SchemaFor(99) error = nil, want error")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		method     string
+		path       string
+		wantStatus int
+		wantTitle  string
+	}{
+		{http.MethodGet, "/schemas/original.json", http.StatusOK, "Buildkite Pub/Sub message, original format"},
+		{http.MethodGet, "/schemas/2.json", http.StatusOK, "Buildkite Pub/Sub message, schema version 2"},
+		{http.MethodGet, "/schemas/openapi.json", http.StatusOK, ""},
+		{http.MethodGet, "/schemas/99.json", http.StatusNotFound, ""},
+		{http.MethodGet, "/schemas/", http.StatusNotFound, ""},
+		{http.MethodPost, "/schemas/1.json", http.StatusMethodNotAllowed, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			Handler().ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantTitle == "" {
+				return
+			}
+			if got := rec.Header().Get("Content-Type"); got != "application/schema+json" {
+				t.Errorf("Content-Type = %q, want application/schema+json", got)
+			}
+			var body struct {
+				Title string `json:"title"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("response is not JSON: %v", err)
+			}
+			if body.Title != tt.wantTitle {
+				t.Errorf("title = %q, want %q", body.Title, tt.wantTitle)
+			}
+		})
+	}
+}
+
+func TestCompileSchemaRejectsUnsupportedKeywords(t *testing.T) {
+	for _, schema := range []string{
+		`{"type":"object","oneOf":[]}`,
+		`{"properties":{"id":{"format":"uuid"}}}`,
+		`{"properties":{"id":{"$ref":"#/$defs/missing"}}}`,
+		`{"pattern":"["}`,
+	} {
+		if _, err := compileSchema([]byte(schema)); err == nil {
+			t.Errorf("compileSchema(%s) error = nil, want error", schema)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+// Command genopenapi writes the OpenAPI description of the webhook's HTTP
+// endpoints, deriving the response schemas from the Go types the handlers
+// answer with. Run it with go generate ./contracts after changing an
+// endpoint or response type; the contracts tests fail while the committed
+// spec is out of date.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+
+	"github.com/mcncl/buildkite-pubsub/contracts"
+	"github.com/mcncl/buildkite-pubsub/contracts/internal/jsonschema"
+	"github.com/mcncl/buildkite-pubsub/internal/stats"
+	"github.com/mcncl/buildkite-pubsub/internal/version"
+	"github.com/mcncl/buildkite-pubsub/pkg/buildkiteauth"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook"
+)
+
+func main() {
+	output := flag.String("o", "schemas/openapi.json", "file to write the spec to")
+	flag.Parse()
+
+	spec, err := generate()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "genopenapi: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(*output, spec, 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "genopenapi: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+type object = map[string]interface{}
+
+// generate returns the OpenAPI 3.1 document, indented and ending in a
+// newline
+func generate() ([]byte, error) {
+	spec := object{
+		"openapi": "3.1.0",
+		"info": object{
+			"title":       "Buildkite Pub/Sub webhook",
+			"description": "Receives Buildkite webhooks and publishes them to Google Cloud Pub/Sub. The webhook and batch paths are configurable; the defaults are shown.",
+			"version":     "1",
+		},
+		"paths": object{
+			"/webhook":             webhookPath(),
+			"/webhook/batch":       batchPath(),
+			"/health":              getJSON("Liveness check", "#/components/schemas/Status", nil),
+			"/ready":               readyPath(),
+			"/version":             getJSON("Build of the running binary", "#/components/schemas/VersionInfo", nil),
+			"/stats":               getJSON("Rolling request and publish rates", "#/components/schemas/Stats", nil),
+			"/metrics":             metricsPath(),
+			"/schemas/{name}.json": schemasPath(),
+			contracts.OpenAPIPath:  openAPIPath(),
+		},
+		"components": object{
+			"schemas": object{
+				"ErrorResponse":   schemaOf(webhook.ErrorResponse{}),
+				"BatchResponse":   schemaOf(webhook.BatchResponse{}),
+				"VersionInfo":     schemaOf(version.Info{}),
+				"Stats":           schemaOf(stats.Snapshot{}),
+				"PublishResponse": publishResponse(),
+				"Status": object{
+					"type":     "object",
+					"required": []string{"status"},
+					"properties": object{
+						"status": object{"type": "string"},
+					},
+				},
+			},
+			"securitySchemes": object{
+				"token": object{
+					"type":        "apiKey",
+					"in":          "header",
+					"name":        buildkiteauth.TokenHeader,
+					"description": "The webhook's token, as Buildkite sends it",
+				},
+				"signature": object{
+					"type":        "apiKey",
+					"in":          "header",
+					"name":        buildkiteauth.SignatureHeader,
+					"description": "HMAC-SHA256 signature of the timestamp and body, as Buildkite sends it",
+				},
+			},
+		},
+	}
+
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// schemaOf returns the JSON Schema of the type of v
+func schemaOf(v interface{}) map[string]interface{} {
+	return jsonschema.FromType(reflect.TypeOf(v))
+}
+
+func ref(to string) object {
+	return object{"$ref": to}
+}
+
+func jsonContent(schemaRef string) object {
+	return object{"application/json": object{"schema": ref(schemaRef)}}
+}
+
+// errorResponses answers each status with an ErrorResponse
+func errorResponses(responses object, descriptions map[string]string) object {
+	for status, description := range descriptions {
+		responses[status] = object{
+			"description": description,
+			"content":     jsonContent("#/components/schemas/ErrorResponse"),
+		}
+	}
+	return responses
+}
+
+func getJSON(summary, schemaRef string, extra object) object {
+	responses := object{
+		"200": object{"description": "OK", "content": jsonContent(schemaRef)},
+	}
+	for status, response := range extra {
+		responses[status] = response
+	}
+	return object{"get": object{"summary": summary, "responses": responses}}
+}
+
+var webhookErrors = map[string]string{
+	"400": "The body or a header is malformed",
+	"401": "Authentication failed",
+	"413": "The body is too large",
+	"429": "Rate limited; retry after retry_after seconds",
+	"500": "Publishing failed",
+	"503": "The publish queue is full or the webhook is paused",
+}
+
+func webhookPath() object {
+	responses := errorResponses(object{
+		"200": object{"description": "The event was published, filtered or dropped", "content": jsonContent("#/components/schemas/PublishResponse")},
+	}, webhookErrors)
+	responses["422"] = object{"description": "The event type is not supported and unsupported events are rejected", "content": jsonContent("#/components/schemas/ErrorResponse")}
+	return object{
+		"post": object{
+			"summary":     "Publish a Buildkite webhook event",
+			"description": "Served at webhook.path, and at each of webhook.paths",
+			"security":    []object{{"token": []string{}}, {"signature": []string{}}},
+			"requestBody": object{
+				"required": true,
+				"content":  object{"application/json": object{"schema": object{"type": "object", "description": "A Buildkite webhook payload"}}},
+			},
+			"responses": responses,
+		},
+	}
+}
+
+func batchPath() object {
+	responses := errorResponses(object{
+		"200": object{"description": "Every event was accepted", "content": jsonContent("#/components/schemas/BatchResponse")},
+		"207": object{"description": "Some events failed; items has each outcome", "content": jsonContent("#/components/schemas/BatchResponse")},
+	}, webhookErrors)
+	return object{
+		"post": object{
+			"summary":     "Publish an array of Buildkite webhook events",
+			"description": "Served at webhook.batch_path when set",
+			"security":    []object{{"token": []string{}}, {"signature": []string{}}},
+			"requestBody": object{
+				"required": true,
+				"content": object{"application/json": object{"schema": object{
+					"type":  "array",
+					"items": object{"type": "object", "description": "A Buildkite webhook payload"},
+				}}},
+			},
+			"responses": responses,
+		},
+	}
+}
+
+func readyPath() object {
+	return getJSON("Readiness check", "#/components/schemas/Status", object{
+		"503": object{
+			"description": "Starting, paused or saturated",
+			"content":     jsonContent("#/components/schemas/Status"),
+		},
+	})
+}
+
+func metricsPath() object {
+	return object{
+		"get": object{
+			"summary": "Prometheus metrics",
+			"responses": object{
+				"200": object{
+					"description": "Metrics in the Prometheus text format",
+					"content":     object{"text/plain": object{"schema": object{"type": "string"}}},
+				},
+			},
+		},
+	}
+}
+
+func schemasPath() object {
+	names := []string{}
+	for _, v := range contracts.SchemaVersions() {
+		if v == "" {
+			v = contracts.OriginalSchemaName
+		}
+		names = append(names, v)
+	}
+	return object{
+		"get": object{
+			"summary":     "JSON Schema of the messages of a schema version",
+			"description": "The schema_url attribute of a message points here",
+			"parameters": []object{{
+				"name":     "name",
+				"in":       "path",
+				"required": true,
+				"schema":   object{"enum": names},
+			}},
+			"responses": object{
+				"200": object{
+					"description": "The JSON Schema",
+					"content":     object{"application/schema+json": object{"schema": object{"type": "object"}}},
+				},
+				"404": object{"description": "Unknown schema version"},
+			},
+		},
+	}
+}
+
+func openAPIPath() object {
+	return object{
+		"get": object{
+			"summary": "This OpenAPI description",
+			"responses": object{
+				"200": object{
+					"description": "The OpenAPI description",
+					"content":     object{"application/json": object{"schema": object{"type": "object"}}},
+				},
+			},
+		},
+	}
+}
+
+// publishResponse describes the body of a webhook answered with 200. The
+// handler builds it as a map, so there is no type to derive it from.
+func publishResponse() object {
+	return object{
+		"type":     "object",
+		"required": []string{"status", "message"},
+		"properties": object{
+			"status":             object{"const": "success"},
+			"message":            object{"type": "string"},
+			"event_type":         object{"type": "string"},
+			"message_id":         object{"type": "string", "description": "Set when the event was published"},
+			"topic":              object{"type": "string"},
+			"publish_time":       object{"type": "string", "format": "date-time"},
+			"publish_attempts":   object{"type": "integer"},
+			"retry_latency_ms":   object{"type": "integer"},
+			"transform_warnings": object{"type": "array", "items": object{"type": "string"}},
+			"service":            object{"type": "string", "description": "Set for ping events"},
+			"version":            object{"type": "string", "description": "Set for ping events"},
+			"publish_ms":         object{"type": "string", "description": "Set for ping events published by the ping check"},
+		},
+	}
+}
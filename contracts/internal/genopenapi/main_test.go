@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/contracts"
+)
+
+func TestSpecIsUpToDate(t *testing.T) {
+	spec, err := generate()
+	if err != nil {
+		t.Fatalf("generate() error = %v", err)
+	}
+	if !bytes.Equal(spec, contracts.OpenAPI()) {
+		t.Fatal("contracts/schemas/openapi.json is out of date; run go generate ./contracts")
+	}
+
+	var doc struct {
+		OpenAPI string                     `json:"openapi"`
+		Paths   map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		t.Fatalf("spec is not JSON: %v", err)
+	}
+	for _, path := range []string{"/webhook", "/health", "/ready", "/version", "/stats", "/metrics", contracts.OpenAPIPath} {
+		if _, ok := doc.Paths[path]; !ok {
+			t.Errorf("spec has no %s path", path)
+		}
+	}
+}
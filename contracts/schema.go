@@ -0,0 +1,257 @@
+package contracts
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ValidationError lists every way a message breaks the schema
+type ValidationError struct {
+	// Problems are JSON pointers to the invalid values with what is wrong
+	// with them, such as "/build/number: want integer, got string"
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "message does not match the schema: " + strings.Join(e.Problems, "; ")
+}
+
+// annotations are keywords that do not affect validation
+var annotations = map[string]bool{
+	"$schema":     true,
+	"$defs":       true,
+	"title":       true,
+	"description": true,
+}
+
+// schema is a compiled JSON Schema supporting the subset of draft 2020-12
+// the message schema uses. Unsupported keywords fail compilation so the
+// schema cannot silently stop being checked.
+type schema struct {
+	root     map[string]interface{}
+	patterns map[string]*regexp.Regexp
+}
+
+// compileSchema parses a schema and checks every keyword it uses is supported
+func compileSchema(data []byte) (*schema, error) {
+	var root map[string]interface{}
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("failed to parse schema: %w", err)
+	}
+	s := &schema{root: root, patterns: make(map[string]*regexp.Regexp)}
+	if err := s.compile(root, "#"); err != nil {
+		return nil, err
+	}
+	if defs, ok := root["$defs"].(map[string]interface{}); ok {
+		for name, def := range defs {
+			if err := s.compile(def, "#/$defs/"+name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+func (s *schema) compile(node interface{}, at string) error {
+	obj, ok := node.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("schema %s is not an object", at)
+	}
+	for keyword, value := range obj {
+		switch keyword {
+		case "type", "enum", "const", "minimum", "required":
+		case "$ref":
+			if _, err := s.resolve(value); err != nil {
+				return fmt.Errorf("schema %s: %w", at, err)
+			}
+		case "format":
+			if value != "date-time" {
+				return fmt.Errorf("schema %s: unsupported format %v", at, value)
+			}
+		case "pattern":
+			pattern, _ := value.(string)
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("schema %s: %w", at, err)
+			}
+			s.patterns[pattern] = re
+		case "properties":
+			properties, _ := value.(map[string]interface{})
+			for name, property := range properties {
+				if err := s.compile(property, at+"/properties/"+name); err != nil {
+					return err
+				}
+			}
+		case "items":
+			if err := s.compile(value, at+"/items"); err != nil {
+				return err
+			}
+		case "additionalProperties":
+			if _, ok := value.(bool); !ok {
+				if err := s.compile(value, at+"/additionalProperties"); err != nil {
+					return err
+				}
+			}
+		default:
+			if !annotations[keyword] {
+				return fmt.Errorf("schema %s: unsupported keyword %s", at, keyword)
+			}
+		}
+	}
+	return nil
+}
+
+// resolve returns the schema a local "#/$defs/name" reference points to
+func (s *schema) resolve(ref interface{}) (map[string]interface{}, error) {
+	name, ok := strings.CutPrefix(fmt.Sprint(ref), "#/$defs/")
+	if !ok {
+		return nil, fmt.Errorf("unsupported $ref %v", ref)
+	}
+	defs, _ := s.root["$defs"].(map[string]interface{})
+	def, ok := defs[name].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("$ref %v is not defined", ref)
+	}
+	return def, nil
+}
+
+// validate checks a decoded JSON document against the schema
+func (s *schema) validate(value interface{}) error {
+	var problems []string
+	s.check(s.root, value, "", &problems)
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func (s *schema) check(node map[string]interface{}, value interface{}, at string, problems *[]string) {
+	fail := func(format string, args ...interface{}) {
+		where := at
+		if where == "" {
+			where = "/"
+		}
+		*problems = append(*problems, where+": "+fmt.Sprintf(format, args...))
+	}
+
+	if ref, ok := node["$ref"]; ok {
+		def, _ := s.resolve(ref)
+		s.check(def, value, at, problems)
+	}
+	if types, ok := node["type"]; ok && !matchesType(types, value) {
+		fail("want %v, got %s", types, typeOf(value))
+		return
+	}
+	if enum, ok := node["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if allowed == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("%v is not one of %v", value, enum)
+		}
+	}
+	if want, ok := node["const"]; ok && want != value {
+		fail("%v is not %v", value, want)
+	}
+	if minimum, ok := node["minimum"].(float64); ok {
+		if n, isNumber := value.(float64); isNumber && n < minimum {
+			fail("%v is less than %v", n, minimum)
+		}
+	}
+	if str, ok := value.(string); ok {
+		if pattern, ok := node["pattern"].(string); ok && !s.patterns[pattern].MatchString(str) {
+			fail("%q does not match %s", str, pattern)
+		}
+		if node["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, str); err != nil {
+				fail("%q is not an RFC 3339 timestamp", str)
+			}
+		}
+	}
+	if items, ok := node["items"].(map[string]interface{}); ok {
+		if array, isArray := value.([]interface{}); isArray {
+			for i, item := range array {
+				s.check(items, item, fmt.Sprintf("%s/%d", at, i), problems)
+			}
+		}
+	}
+
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		return
+	}
+	if required, ok := node["required"].([]interface{}); ok {
+		for _, name := range required {
+			if _, present := obj[name.(string)]; !present {
+				fail("missing required field %s", name)
+			}
+		}
+	}
+	properties, _ := node["properties"].(map[string]interface{})
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	// Sort so problems are reported in a stable order
+	sort.Strings(names)
+	for _, name := range names {
+		path := at + "/" + name
+		if property, ok := properties[name].(map[string]interface{}); ok {
+			s.check(property, obj[name], path, problems)
+			continue
+		}
+		switch additional := node["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				fail("unexpected field %s", name)
+			}
+		case map[string]interface{}:
+			s.check(additional, obj[name], path, problems)
+		}
+	}
+}
+
+// matchesType reports whether value is of the schema type, or one of the
+// types when given a list
+func matchesType(types interface{}, value interface{}) bool {
+	if list, ok := types.([]interface{}); ok {
+		for _, t := range list {
+			if matchesType(t, value) {
+				return true
+			}
+		}
+		return false
+	}
+	actual := typeOf(value)
+	return actual == types || (types == "number" && actual == "integer")
+}
+
+// typeOf returns the JSON Schema type of a value decoded by encoding/json
+func typeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
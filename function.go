@@ -0,0 +1,84 @@
+// Package buildkitepubsub exports the webhook as a Cloud Functions (2nd gen)
+// HTTP function, so the service can be deployed without a container:
+//
+//	gcloud functions deploy buildkite-webhook --gen2 --runtime=go125 \
+//	  --entry-point=Webhook --trigger-http --allow-unauthenticated \
+//	  --set-env-vars=PROJECT_ID=...,TOPIC_ID=...,BUILDKITE_WEBHOOK_TOKEN=...
+//
+// The function is configured from the same environment variables as the
+// server, and CONFIG_FILE may name a configuration file deployed with it.
+package buildkitepubsub
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/mcncl/buildkite-pubsub/internal/app"
+	"github.com/mcncl/buildkite-pubsub/internal/cloudrun"
+	"github.com/mcncl/buildkite-pubsub/internal/config"
+	"github.com/mcncl/buildkite-pubsub/internal/errors"
+	"github.com/mcncl/buildkite-pubsub/internal/logging"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/internal/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	functionMu      sync.Mutex
+	functionHandler http.Handler
+	functionLogger  = logging.NewLogger(os.Getenv("LOG_LEVEL"), "gcp")
+)
+
+// Webhook handles Buildkite webhook deliveries on any path, with the same
+// authentication, rate limits and publishing as the server's webhook path.
+// The service starts on the first request; if it cannot, the request fails
+// with 503 and the next request tries again.
+func Webhook(w http.ResponseWriter, r *http.Request) {
+	handler, err := webhookHandler(r.Context())
+	if err != nil {
+		attrs := []any{"error", err}
+		if hint := errors.Hint(err); hint != "" {
+			attrs = append(attrs, "hint", hint)
+		}
+		functionLogger.Error("Service initialization error", attrs...)
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// webhookHandler builds the service once it starts successfully
+func webhookHandler(ctx context.Context) (http.Handler, error) {
+	functionMu.Lock()
+	defer functionMu.Unlock()
+	if functionHandler != nil {
+		return functionHandler, nil
+	}
+
+	cfg, err := config.Load(os.Getenv("CONFIG_FILE"), nil)
+	if err != nil {
+		return nil, err
+	}
+	config.WarnDeprecations(functionLogger, cfg.Deprecated)
+
+	// Metrics feed the handler's decisions but are not scraped here
+	if err := metrics.InitMetrics(prometheus.NewRegistry(), app.MetricsOptions(cfg.Metrics)...); err != nil {
+		return nil, err
+	}
+
+	// Publishers must outlive the request that starts the service
+	svc, err := app.New(context.WithoutCancel(ctx), cfg, app.Options{
+		Logger:     functionLogger,
+		Middleware: map[string]func(http.Handler) http.Handler{middleware.ProxyHeaders: cloudrun.WithProxyHeaders},
+	})
+	if err != nil {
+		return nil, err
+	}
+	service, revision := cloudrun.Service()
+	functionLogger.Info("Function started", "service", service, "revision", revision)
+
+	functionHandler = svc.Webhook
+	return functionHandler, nil
+}
@@ -0,0 +1,25 @@
+package buildkitepubsub
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook/webhooktest"
+)
+
+func TestWebhookUnavailableUntilConfigured(t *testing.T) {
+	t.Setenv("PROJECT_ID", "")
+	t.Setenv("TOPIC_ID", "")
+	t.Setenv("BUILDKITE_WEBHOOK_TOKEN", "")
+
+	body := webhooktest.Payload("build.finished")
+	for i := 0; i < 2; i++ {
+		rr := webhooktest.Serve(http.HandlerFunc(Webhook), webhooktest.NewTokenRequest("/", "token", body))
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("request %d status = %d, want %d", i+1, rr.Code, http.StatusServiceUnavailable)
+		}
+	}
+	if functionHandler != nil {
+		t.Error("handler was kept after failing to start")
+	}
+}
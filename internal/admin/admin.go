@@ -0,0 +1,60 @@
+// Package admin provides the operational endpoints served on the optional
+// admin listener, along with the middleware that protects them.
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// APIPrefix is the versioned path admin endpoints are served under
+const APIPrefix = "/admin/v1"
+
+// legacyPrefix is where admin endpoints were served before versioning
+const legacyPrefix = "/admin"
+
+// Handle serves an admin endpoint at APIPrefix+path, and at its unversioned
+// /admin path for existing callers such as preStop hooks. Unversioned
+// responses link to the versioned path.
+func Handle(mux *http.ServeMux, path string, handler http.Handler) {
+	mux.Handle(APIPrefix+path, handler)
+	successor := fmt.Sprintf(`<%s%s>; rel="successor-version"`, APIPrefix, path)
+	mux.Handle(legacyPrefix+path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", successor)
+		handler.ServeHTTP(w, r)
+	}))
+}
+
+// WithAuth protects admin endpoints with a static token. When token is set,
+// requests must send "Authorization: Bearer <token>". When token is empty,
+// only loopback clients are allowed. See WithAuthorizer for other schemes.
+func WithAuth(token string) func(http.Handler) http.Handler {
+	return WithAuthorizer(NewTokenAuthorizer(token), nil)
+}
+
+// isLoopback reports whether the remote address is a loopback address
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// writeJSON writes data as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, statusCode int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+// writeError writes a JSON error response
+func writeError(w http.ResponseWriter, statusCode int, message string) {
+	writeJSON(w, statusCode, map[string]string{
+		"status":  "error",
+		"message": message,
+	})
+}
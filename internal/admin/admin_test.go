@@ -0,0 +1,211 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithAuth(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      string
+		remoteAddr string
+		authHeader string
+		wantStatus int
+	}{
+		{
+			name:       "no token allows loopback",
+			remoteAddr: "127.0.0.1:54321",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "no token allows IPv6 loopback",
+			remoteAddr: "[::1]:54321",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "no token rejects remote client",
+			remoteAddr: "10.0.0.5:54321",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "valid bearer token",
+			token:      "secret",
+			remoteAddr: "10.0.0.5:54321",
+			authHeader: "Bearer secret",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "wrong bearer token",
+			token:      "secret",
+			remoteAddr: "127.0.0.1:54321",
+			authHeader: "Bearer nope",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "missing bearer token",
+			token:      "secret",
+			remoteAddr: "127.0.0.1:54321",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "non-bearer scheme",
+			token:      "secret",
+			remoteAddr: "127.0.0.1:54321",
+			authHeader: "Basic secret",
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := WithAuth(tt.token)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/debug/vars", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.authHeader != "" {
+				req.Header.Set("Authorization", tt.authHeader)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRegisterDebug(t *testing.T) {
+	mux := http.NewServeMux()
+	RegisterDebug(mux)
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/goroutine?debug=1", "/debug/vars"} {
+		t.Run(path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Errorf("GET %s returned %d, want %d", path, w.Code, http.StatusOK)
+			}
+		})
+	}
+}
+
+// staticAuthorizer accepts requests as identity, or refuses with err
+type staticAuthorizer struct {
+	identity string
+	err      error
+}
+
+func (a staticAuthorizer) Authorize(r *http.Request) (string, error) {
+	return a.identity, a.err
+}
+
+func TestWithAuthorizer(t *testing.T) {
+	forbidden := staticAuthorizer{err: fmt.Errorf("%w: local-only", ErrForbidden)}
+	unauthenticated := staticAuthorizer{err: fmt.Errorf("%w: bad token", ErrUnauthenticated)}
+	tests := []struct {
+		name         string
+		authz        Authorizer
+		wantStatus   int
+		wantIdentity string
+	}{
+		{name: "accepted", authz: staticAuthorizer{identity: "ops"}, wantStatus: http.StatusOK, wantIdentity: "ops"},
+		{name: "first accepting authorizer wins", authz: AnyOf(unauthenticated, staticAuthorizer{identity: "ops"}), wantStatus: http.StatusOK, wantIdentity: "ops"},
+		{name: "forbidden", authz: forbidden, wantStatus: http.StatusForbidden},
+		{name: "unauthenticated", authz: unauthenticated, wantStatus: http.StatusUnauthorized},
+		// Credentials might satisfy one of them, so ask for them
+		{name: "forbidden and unauthenticated", authz: AnyOf(forbidden, unauthenticated), wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var identity string
+			handler := WithAuthorizer(tt.authz, slog.New(slog.DiscardHandler))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				identity = Identity(r.Context())
+			}))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/v1/pause", nil))
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if identity != tt.wantIdentity {
+				t.Errorf("identity = %q, want %q", identity, tt.wantIdentity)
+			}
+			if challenge := w.Header().Get("WWW-Authenticate"); (challenge != "") != (tt.wantStatus == http.StatusUnauthorized) {
+				t.Errorf("WWW-Authenticate = %q with status %d", challenge, w.Code)
+			}
+		})
+	}
+}
+
+func TestWithAudit(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	handler := WithAuthorizer(staticAuthorizer{identity: "ops@example.com"}, logger)(WithAudit(logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})))
+
+	// Reads aren't actions
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/admin/v1/pause", nil))
+	if buf.Len() != 0 {
+		t.Fatalf("GET was audited: %s", buf.String())
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/admin/v1/pause?x=1", nil))
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("invalid audit record %q: %v", buf.String(), err)
+	}
+	want := map[string]interface{}{
+		"msg":      "Admin action",
+		"identity": "ops@example.com",
+		"method":   http.MethodPost,
+		"path":     "/admin/v1/pause",
+		"query":    "x=1",
+		"status":   float64(http.StatusAccepted),
+	}
+	for key, value := range want {
+		if record[key] != value {
+			t.Errorf("%s = %v, want %v", key, record[key], value)
+		}
+	}
+}
+
+func TestHandle(t *testing.T) {
+	mux := http.NewServeMux()
+	Handle(mux, "/pause", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		path     string
+		wantLink string
+	}{
+		{path: "/admin/v1/pause"},
+		{path: "/admin/pause", wantLink: `</admin/v1/pause>; rel="successor-version"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != http.StatusOK {
+				t.Errorf("GET %s returned %d, want %d", tt.path, w.Code, http.StatusOK)
+			}
+			if got := w.Header().Get("Link"); got != tt.wantLink {
+				t.Errorf("Link = %q, want %q", got, tt.wantLink)
+			}
+		})
+	}
+}
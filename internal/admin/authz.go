@@ -0,0 +1,164 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/jwtauth"
+)
+
+// Errors an Authorizer wraps to choose the response: ErrForbidden answers
+// 403, and anything else 401 with a WWW-Authenticate challenge
+var (
+	ErrUnauthenticated = errors.New("unauthenticated")
+	ErrForbidden       = errors.New("forbidden")
+)
+
+// Authorizer decides whether an admin request may proceed
+type Authorizer interface {
+	// Authorize returns the caller's identity for the audit log, or why
+	// the request is refused
+	Authorize(r *http.Request) (identity string, err error)
+}
+
+// TokenAuthorizer accepts requests sending "Authorization: Bearer <token>".
+// With no token, it accepts only loopback clients, so an accidentally
+// exposed listener never serves anyone else.
+type TokenAuthorizer struct {
+	token string
+}
+
+// NewTokenAuthorizer creates an authorizer for the static token
+func NewTokenAuthorizer(token string) *TokenAuthorizer {
+	return &TokenAuthorizer{token: token}
+}
+
+// Authorize implements Authorizer
+func (a *TokenAuthorizer) Authorize(r *http.Request) (string, error) {
+	if a.token == "" {
+		if !isLoopback(r.RemoteAddr) {
+			return "", fmt.Errorf("%w: admin endpoints are local-only when no admin token is configured", ErrForbidden)
+		}
+		return "loopback", nil
+	}
+	provided, ok := jwtauth.BearerToken(r)
+	if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(a.token)) != 1 {
+		return "", fmt.Errorf("%w: invalid or missing admin token", ErrUnauthenticated)
+	}
+	return "token", nil
+}
+
+// anyOf accepts requests any of its authorizers accepts
+type anyOf []Authorizer
+
+// AnyOf returns an authorizer accepting requests any of authorizers
+// accepts, such as a break-glass static token alongside OIDC
+func AnyOf(authorizers ...Authorizer) Authorizer {
+	if len(authorizers) == 1 {
+		return authorizers[0]
+	}
+	return anyOf(authorizers)
+}
+
+// Authorize implements Authorizer, refusing with every authorizer's reason
+func (a anyOf) Authorize(r *http.Request) (string, error) {
+	var errs []error
+	for _, authorizer := range a {
+		identity, err := authorizer.Authorize(r)
+		if err == nil {
+			return identity, nil
+		}
+		errs = append(errs, err)
+	}
+	return "", errors.Join(errs...)
+}
+
+type identityKey struct{}
+
+// Identity returns the caller identity an Authorizer accepted the request
+// with
+func Identity(ctx context.Context) string {
+	identity, _ := ctx.Value(identityKey{}).(string)
+	return identity
+}
+
+// WithAuthorizer protects admin endpoints with authz, logging refused
+// requests to logger
+func WithAuthorizer(authz Authorizer, logger *slog.Logger) func(http.Handler) http.Handler {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity, err := authz.Authorize(r)
+			if err != nil {
+				logger.Warn("Admin request refused", "method", r.Method, "path", r.URL.Path,
+					"remote_addr", r.RemoteAddr, "reason", err.Error())
+				// Only a refusal from every authorizer for the caller's
+				// origin rather than their credentials is forbidden
+				if errors.Is(err, ErrForbidden) && !errors.Is(err, ErrUnauthenticated) {
+					writeError(w, http.StatusForbidden, strings.TrimPrefix(err.Error(), ErrForbidden.Error()+": "))
+					return
+				}
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				writeError(w, http.StatusUnauthorized, "invalid or missing admin credentials")
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, identity)))
+		})
+	}
+}
+
+// WithAudit logs every admin action, meaning any request that isn't a GET,
+// HEAD or OPTIONS, with the identity that made it and its outcome
+func WithAudit(logger *slog.Logger) func(http.Handler) http.Handler {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				next.ServeHTTP(w, r)
+				return
+			}
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(sw, r)
+			logger.Info("Admin action",
+				"identity", Identity(r.Context()),
+				"method", r.Method,
+				"path", r.URL.Path,
+				"query", r.URL.RawQuery,
+				"status", sw.status,
+				"remote_addr", r.RemoteAddr,
+				"duration_ms", time.Since(start).Milliseconds(),
+			)
+		})
+	}
+}
+
+// statusWriter records the response status
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,53 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/netip"
+
+	"github.com/mcncl/buildkite-pubsub/internal/middleware/security"
+)
+
+// BanController is the subset of security.AuthBan the admin API drives
+type BanController interface {
+	Bans() []security.Ban
+	Unban(ip string) bool
+}
+
+// BansHandler lists the client IPs banned after repeated auth failures on
+// GET and lifts a ban on POST with a body of {"action": "unban", "ip": "..."}.
+// Unbanning an IP that is not banned is not an error; "unbanned" in the
+// response reports whether it was.
+func BansHandler(ctrl BanController) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := map[string]interface{}{}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var req struct {
+				Action string `json:"action"`
+				IP     string `json:"ip"`
+			}
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "request body must be JSON with action and ip fields")
+				return
+			}
+			if req.Action != "unban" {
+				writeError(w, http.StatusBadRequest, "action must be: unban")
+				return
+			}
+			if _, err := netip.ParseAddr(req.IP); err != nil {
+				writeError(w, http.StatusBadRequest, "ip must be an IP address")
+				return
+			}
+			response["unbanned"] = ctrl.Unban(req.IP)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		response["bans"] = ctrl.Bans()
+		writeJSON(w, http.StatusOK, response)
+	})
+}
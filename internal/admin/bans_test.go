@@ -0,0 +1,107 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/middleware/security"
+)
+
+type fakeBans struct {
+	bans []security.Ban
+}
+
+func (f *fakeBans) Bans() []security.Ban { return f.bans }
+func (f *fakeBans) Unban(ip string) bool {
+	for i, ban := range f.bans {
+		if ban.IP == ip {
+			f.bans = append(f.bans[:i], f.bans[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func TestBansHandler(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		body         string
+		wantStatus   int
+		wantBans     int
+		wantUnbanned interface{}
+	}{
+		{
+			name:       "get lists bans",
+			method:     http.MethodGet,
+			wantStatus: http.StatusOK,
+			wantBans:   1,
+		},
+		{
+			name:         "post unbans",
+			method:       http.MethodPost,
+			body:         `{"action":"unban","ip":"192.0.2.1"}`,
+			wantStatus:   http.StatusOK,
+			wantUnbanned: true,
+		},
+		{
+			name:         "post unbanning an IP that is not banned",
+			method:       http.MethodPost,
+			body:         `{"action":"unban","ip":"192.0.2.2"}`,
+			wantStatus:   http.StatusOK,
+			wantBans:     1,
+			wantUnbanned: false,
+		},
+		{
+			name:       "post rejects an invalid IP",
+			method:     http.MethodPost,
+			body:       `{"action":"unban","ip":"example.com"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "post rejects unknown action",
+			method:     http.MethodPost,
+			body:       `{"action":"ban","ip":"192.0.2.1"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "delete not allowed",
+			method:     http.MethodDelete,
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			ctrl := &fakeBans{bans: []security.Ban{{IP: "192.0.2.1", Since: now, Until: now.Add(time.Hour), Failures: 5}}}
+			req := httptest.NewRequest(tt.method, "/admin/bans", strings.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+			BansHandler(ctrl).ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+			var body struct {
+				Bans     []security.Ban `json:"bans"`
+				Unbanned interface{}    `json:"unbanned"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if len(body.Bans) != tt.wantBans {
+				t.Errorf("bans = %+v, want %d", body.Bans, tt.wantBans)
+			}
+			if body.Unbanned != tt.wantUnbanned {
+				t.Errorf("unbanned = %v, want %v", body.Unbanned, tt.wantUnbanned)
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+package admin
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof" // #nosec G108 -- handlers are registered explicitly on the admin mux only
+)
+
+// RegisterDebug registers net/http/pprof and expvar handlers under /debug/
+func RegisterDebug(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+}
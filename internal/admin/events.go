@@ -0,0 +1,54 @@
+package admin
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/audit"
+)
+
+// EventsHandler answers GET queries against the publish audit index, e.g.
+// /admin/events?build_id=... to check whether a build's events were
+// published. Supported parameters are event_id, build_id, since (RFC3339)
+// and limit.
+func EventsHandler(store audit.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		params := r.URL.Query()
+		query := audit.Query{
+			EventID: params.Get("event_id"),
+			BuildID: params.Get("build_id"),
+		}
+		if since := params.Get("since"); since != "" {
+			t, err := time.Parse(time.RFC3339, since)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "since must be an RFC3339 timestamp")
+				return
+			}
+			query.Since = t
+		}
+		if limit := params.Get("limit"); limit != "" {
+			n, err := strconv.Atoi(limit)
+			if err != nil || n < 1 {
+				writeError(w, http.StatusBadRequest, "limit must be a positive integer")
+				return
+			}
+			query.Limit = n
+		}
+
+		records, err := store.Query(r.Context(), query)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"events": records,
+		})
+	})
+}
@@ -0,0 +1,80 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/audit"
+)
+
+type fakeAuditStore struct {
+	query audit.Query
+}
+
+func (f *fakeAuditStore) Record(ctx context.Context, record audit.Record) error { return nil }
+
+func (f *fakeAuditStore) Query(ctx context.Context, query audit.Query) ([]audit.Record, error) {
+	f.query = query
+	return []audit.Record{{EventID: "evt-1", MessageID: "msg-1", Outcome: audit.OutcomePublished}}, nil
+}
+
+func TestEventsHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		wantStatus int
+		wantQuery  audit.Query
+	}{
+		{
+			name:       "queries by build",
+			method:     http.MethodGet,
+			target:     "/admin/events?build_id=b1&since=2024-01-02T03:04:05Z&limit=5",
+			wantStatus: http.StatusOK,
+			wantQuery:  audit.Query{BuildID: "b1", Since: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), Limit: 5},
+		},
+		{
+			name:       "queries by event",
+			method:     http.MethodGet,
+			target:     "/admin/events?event_id=evt-1",
+			wantStatus: http.StatusOK,
+			wantQuery:  audit.Query{EventID: "evt-1"},
+		},
+		{name: "rejects invalid since", method: http.MethodGet, target: "/admin/events?since=yesterday", wantStatus: http.StatusBadRequest},
+		{name: "rejects invalid limit", method: http.MethodGet, target: "/admin/events?limit=0", wantStatus: http.StatusBadRequest},
+		{name: "other methods not allowed", method: http.MethodPost, target: "/admin/events", wantStatus: http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeAuditStore{}
+			w := httptest.NewRecorder()
+			EventsHandler(store).ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if !store.query.Since.Equal(tt.wantQuery.Since) || store.query.BuildID != tt.wantQuery.BuildID ||
+				store.query.EventID != tt.wantQuery.EventID || store.query.Limit != tt.wantQuery.Limit {
+				t.Errorf("query = %+v, want %+v", store.query, tt.wantQuery)
+			}
+
+			var resp struct {
+				Events []audit.Record `json:"events"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if len(resp.Events) != 1 || resp.Events[0].MessageID != "msg-1" {
+				t.Errorf("events = %+v, want the stored record", resp.Events)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+)
+
+// FailoverController is the subset of publisher.FailoverPublisher the admin API drives
+type FailoverController interface {
+	Mode() publisher.FailoverMode
+	SetMode(mode publisher.FailoverMode)
+	Active() string
+	CircuitState() publisher.CircuitState
+}
+
+// FailoverHandler reports failover state on GET and switches the mode on
+// POST with a body of {"mode": "auto" | "primary" | "secondary"}
+func FailoverHandler(ctrl FailoverController) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var req struct {
+				Mode string `json:"mode"`
+			}
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "request body must be JSON with a mode field")
+				return
+			}
+			mode, err := publisher.ParseFailoverMode(req.Mode)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			ctrl.SetMode(mode)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]string{
+			"mode":          string(ctrl.Mode()),
+			"active":        ctrl.Active(),
+			"circuit_state": ctrl.CircuitState().String(),
+		})
+	})
+}
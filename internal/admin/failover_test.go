@@ -0,0 +1,91 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+)
+
+type fakeFailover struct {
+	mode publisher.FailoverMode
+}
+
+func (f *fakeFailover) Mode() publisher.FailoverMode         { return f.mode }
+func (f *fakeFailover) SetMode(mode publisher.FailoverMode)  { f.mode = mode }
+func (f *fakeFailover) Active() string                       { return "primary" }
+func (f *fakeFailover) CircuitState() publisher.CircuitState { return publisher.CircuitClosed }
+
+func TestFailoverHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		wantStatus int
+		wantMode   publisher.FailoverMode
+	}{
+		{
+			name:       "get reports state",
+			method:     http.MethodGet,
+			wantStatus: http.StatusOK,
+			wantMode:   publisher.FailoverAuto,
+		},
+		{
+			name:       "post switches mode",
+			method:     http.MethodPost,
+			body:       `{"mode":"secondary"}`,
+			wantStatus: http.StatusOK,
+			wantMode:   publisher.FailoverSecondary,
+		},
+		{
+			name:       "post rejects unknown mode",
+			method:     http.MethodPost,
+			body:       `{"mode":"sideways"}`,
+			wantStatus: http.StatusBadRequest,
+			wantMode:   publisher.FailoverAuto,
+		},
+		{
+			name:       "post rejects invalid json",
+			method:     http.MethodPost,
+			body:       `not json`,
+			wantStatus: http.StatusBadRequest,
+			wantMode:   publisher.FailoverAuto,
+		},
+		{
+			name:       "other methods not allowed",
+			method:     http.MethodDelete,
+			wantStatus: http.StatusMethodNotAllowed,
+			wantMode:   publisher.FailoverAuto,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := &fakeFailover{mode: publisher.FailoverAuto}
+			req := httptest.NewRequest(tt.method, "/admin/failover", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			FailoverHandler(ctrl).ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if ctrl.mode != tt.wantMode {
+				t.Errorf("mode = %s, want %s", ctrl.mode, tt.wantMode)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var resp map[string]string
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("response is not JSON: %v", err)
+			}
+			if resp["mode"] != string(tt.wantMode) || resp["active"] != "primary" || resp["circuit_state"] != "closed" {
+				t.Errorf("unexpected response %v", resp)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/mcncl/buildkite-pubsub/internal/clock"
+	"github.com/mcncl/buildkite-pubsub/internal/jwtauth"
+)
+
+// OIDCConfig holds the settings for an OIDCAuthorizer
+type OIDCConfig struct {
+	// Issuer is the OpenID Connect issuer URL, such as
+	// https://accounts.google.com; its signing keys are found through
+	// discovery
+	Issuer string
+	// Audience is the aud claim tokens must carry
+	Audience string
+	// Subjects are the sub or verified email claims allowed in. Anyone the
+	// issuer will mint a token for can choose the audience, so the allowed
+	// callers must be listed.
+	Subjects []string
+	// Client fetches discovery documents and keys; nil uses a client with
+	// a 10s timeout
+	Client *http.Client
+	// Clock checks token expiry; nil uses the system clock
+	Clock clock.Clock
+}
+
+// OIDCAuthorizer accepts admin requests bearing an ID token, signed with
+// RS256 or ES256, from an OpenID Connect issuer such as Google for GCP
+// service accounts or a Kubernetes cluster for projected service account
+// tokens
+type OIDCAuthorizer struct {
+	verifier *jwtauth.Verifier
+	// open is set when no subjects are configured, which admin refuses
+	// rather than letting in anyone the issuer vouches for
+	open bool
+}
+
+// NewOIDCAuthorizer creates an authorizer; the issuer is not contacted
+// until the first token arrives
+func NewOIDCAuthorizer(cfg OIDCConfig) *OIDCAuthorizer {
+	return &OIDCAuthorizer{
+		verifier: jwtauth.New(jwtauth.Config{
+			Issuer:   cfg.Issuer,
+			Audience: cfg.Audience,
+			Subjects: cfg.Subjects,
+			Client:   cfg.Client,
+			Clock:    cfg.Clock,
+		}),
+		open: len(cfg.Subjects) == 0,
+	}
+}
+
+// Authorize implements Authorizer, identifying the caller by the allowed
+// subject or email their token carries
+func (o *OIDCAuthorizer) Authorize(r *http.Request) (string, error) {
+	token, ok := jwtauth.BearerToken(r)
+	if o.open {
+		return "", fmt.Errorf("%w: no OIDC subjects are allowed", ErrUnauthenticated)
+	}
+	if !ok {
+		return "", fmt.Errorf("%w: missing bearer token", ErrUnauthenticated)
+	}
+	identity, _, err := o.verifier.Verify(r.Context(), token)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+	return identity, nil
+}
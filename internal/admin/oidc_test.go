@@ -0,0 +1,84 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/clock"
+	"github.com/mcncl/buildkite-pubsub/internal/jwtauth/jwtauthtest"
+)
+
+func TestOIDCAuthorizer(t *testing.T) {
+	issuer := jwtauthtest.NewIssuer(t)
+	key := issuer.AddKey(t, "rsa-1", false)
+	clk := clock.NewFake(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	token := func(sub string) string {
+		return jwtauthtest.Sign(t, key, "rsa-1", map[string]interface{}{
+			"iss": issuer.URL,
+			"sub": sub,
+			"aud": "buildkite-pubsub-admin",
+			"exp": clk.Now().Add(time.Hour).Unix(),
+		})
+	}
+
+	tests := []struct {
+		name         string
+		subjects     []string
+		header       string
+		wantIdentity string
+	}{
+		{
+			name:         "allowed subject",
+			subjects:     []string{"1234567890"},
+			header:       "Bearer " + token("1234567890"),
+			wantIdentity: "1234567890",
+		},
+		{
+			name:     "subject not allowed",
+			subjects: []string{"1234567890"},
+			header:   "Bearer " + token("999"),
+		},
+		{
+			name:   "no subjects allows no one",
+			header: "Bearer " + token("1234567890"),
+		},
+		{
+			name:     "missing bearer token",
+			subjects: []string{"1234567890"},
+		},
+		{
+			name:     "invalid token",
+			subjects: []string{"1234567890"},
+			header:   "Bearer not-a-jwt",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authz := NewOIDCAuthorizer(OIDCConfig{
+				Issuer:   issuer.URL,
+				Audience: "buildkite-pubsub-admin",
+				Subjects: tt.subjects,
+				Client:   issuer.Client(),
+				Clock:    clk,
+			})
+			req := httptest.NewRequest(http.MethodPost, "/admin/v1/pause", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			identity, err := authz.Authorize(req)
+			if tt.wantIdentity == "" {
+				if !errors.Is(err, ErrUnauthenticated) {
+					t.Errorf("Authorize() = %q, %v, want ErrUnauthenticated", identity, err)
+				}
+				return
+			}
+			if err != nil || identity != tt.wantIdentity {
+				t.Errorf("Authorize() = %q, %v, want %q", identity, err, tt.wantIdentity)
+			}
+		})
+	}
+}
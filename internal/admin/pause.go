@@ -0,0 +1,89 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/pause"
+)
+
+// defaultDrainTimeout bounds how long a drain request waits for in-flight webhooks
+const defaultDrainTimeout = 30 * time.Second
+
+// PauseController is the subset of pause.Switch the admin API drives
+type PauseController interface {
+	Pause(reason string) error
+	Resume() error
+	Drain(ctx context.Context, reason string) error
+	State() pause.State
+}
+
+// PauseHandler reports intake state on GET and changes it on POST with a
+// body of {"action": "pause" | "drain" | "resume", "reason": "..."}. A drain
+// pauses intake and waits for in-flight webhooks, for up to "timeout" (a Go
+// duration, 30s by default); "drained" in the response reports whether they
+// finished.
+func PauseHandler(ctrl PauseController) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := map[string]interface{}{}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var req struct {
+				Action  string `json:"action"`
+				Reason  string `json:"reason"`
+				Timeout string `json:"timeout"`
+			}
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "request body must be JSON with an action field")
+				return
+			}
+
+			var err error
+			switch req.Action {
+			case "pause":
+				err = ctrl.Pause(req.Reason)
+			case "resume":
+				err = ctrl.Resume()
+			case "drain":
+				timeout := defaultDrainTimeout
+				if req.Timeout != "" {
+					if timeout, err = time.ParseDuration(req.Timeout); err != nil || timeout <= 0 {
+						writeError(w, http.StatusBadRequest, "timeout must be a positive duration such as 30s")
+						return
+					}
+				}
+				ctx, cancel := context.WithTimeout(r.Context(), timeout)
+				err = ctrl.Drain(ctx, req.Reason)
+				cancel()
+				response["drained"] = err == nil
+				if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+					err = nil
+				}
+			default:
+				writeError(w, http.StatusBadRequest, "action must be one of: pause, drain, resume")
+				return
+			}
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		state := ctrl.State()
+		response["paused"] = state.Paused
+		response["in_flight"] = state.InFlight
+		if state.Paused {
+			response["since"] = state.Since
+			response["reason"] = state.Reason
+		}
+		writeJSON(w, http.StatusOK, response)
+	})
+}
@@ -0,0 +1,118 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/internal/pause"
+)
+
+type fakePause struct {
+	state pause.State
+	// drainErr is returned by Drain, e.g. when webhooks are still in flight
+	drainErr error
+}
+
+func (f *fakePause) Pause(reason string) error {
+	f.state = pause.State{Paused: true, Reason: reason}
+	return nil
+}
+func (f *fakePause) Resume() error { f.state = pause.State{}; return nil }
+func (f *fakePause) Drain(ctx context.Context, reason string) error {
+	_ = f.Pause(reason)
+	return f.drainErr
+}
+func (f *fakePause) State() pause.State { return f.state }
+
+func TestPauseHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		body        string
+		drainErr    error
+		wantStatus  int
+		wantPaused  bool
+		wantDrained interface{}
+	}{
+		{
+			name:       "get reports state",
+			method:     http.MethodGet,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "post pauses",
+			method:     http.MethodPost,
+			body:       `{"action":"pause","reason":"pubsub maintenance"}`,
+			wantStatus: http.StatusOK,
+			wantPaused: true,
+		},
+		{
+			name:        "post drains",
+			method:      http.MethodPost,
+			body:        `{"action":"drain","timeout":"5s"}`,
+			wantStatus:  http.StatusOK,
+			wantPaused:  true,
+			wantDrained: true,
+		},
+		{
+			name:        "drain reports webhooks still in flight",
+			method:      http.MethodPost,
+			body:        `{"action":"drain"}`,
+			drainErr:    context.DeadlineExceeded,
+			wantStatus:  http.StatusOK,
+			wantPaused:  true,
+			wantDrained: false,
+		},
+		{
+			name:       "post resumes",
+			method:     http.MethodPost,
+			body:       `{"action":"resume"}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "post rejects unknown action",
+			method:     http.MethodPost,
+			body:       `{"action":"stop"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "post rejects invalid timeout",
+			method:     http.MethodPost,
+			body:       `{"action":"drain","timeout":"soon"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "other methods not allowed",
+			method:     http.MethodDelete,
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := &fakePause{drainErr: tt.drainErr}
+			req := httptest.NewRequest(tt.method, "/admin/pause", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			PauseHandler(ctrl).ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var resp map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("response is not JSON: %v", err)
+			}
+			if resp["paused"] != tt.wantPaused || resp["drained"] != tt.wantDrained {
+				t.Errorf("unexpected response %v", resp)
+			}
+		})
+	}
+}
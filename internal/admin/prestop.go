@@ -0,0 +1,19 @@
+package admin
+
+import "net/http"
+
+// PreStopHandler runs preStop, which takes the instance out of load
+// balancing and begins a graceful shutdown, and responds once it returns. It
+// answers GET as well as POST so a Kubernetes httpGet preStop hook can call
+// it; the hook blocks pod termination until the response.
+func PreStopHandler(preStop func()) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			w.Header().Set("Allow", "GET, POST")
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		preStop()
+		writeJSON(w, http.StatusOK, map[string]string{"status": "shutting_down"})
+	})
+}
@@ -0,0 +1,32 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPreStopHandler(t *testing.T) {
+	tests := []struct {
+		method     string
+		wantStatus int
+		wantCalls  int
+	}{
+		{http.MethodGet, http.StatusOK, 1},
+		{http.MethodPost, http.StatusOK, 1},
+		{http.MethodDelete, http.StatusMethodNotAllowed, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			calls := 0
+			rr := httptest.NewRecorder()
+			PreStopHandler(func() { calls++ }).ServeHTTP(rr, httptest.NewRequest(tt.method, "/admin/prestop", nil))
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("preStop called %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
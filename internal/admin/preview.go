@@ -0,0 +1,49 @@
+package admin
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/mcncl/buildkite-pubsub/internal/errors"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook"
+)
+
+// maxPreviewBytes bounds preview payloads; Buildkite's largest payloads are
+// a few megabytes
+const maxPreviewBytes = 10 << 20
+
+// TransformPreviewer is the subset of webhook.Handler the admin API uses to
+// preview messages
+type TransformPreviewer interface {
+	Preview(body []byte) (webhook.Preview, error)
+}
+
+// TransformPreviewHandler answers a POST of a raw Buildkite payload with the
+// message and attributes the webhook would publish for it, without
+// publishing, so consumers can design subscription filters against them
+func TransformPreviewHandler(previewer TransformPreviewer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPreviewBytes))
+		if err != nil {
+			// Reading only fails on a payload over the limit or a dropped client
+			writeError(w, http.StatusRequestEntityTooLarge, "payload is too large to preview")
+			return
+		}
+		preview, err := previewer.Preview(body)
+		switch {
+		case errors.IsValidationError(err):
+			writeError(w, http.StatusBadRequest, errors.Format(err))
+			return
+		case err != nil:
+			writeError(w, http.StatusUnprocessableEntity, errors.Format(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, preview)
+	})
+}
@@ -0,0 +1,98 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/internal/errors"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook"
+)
+
+type fakePreviewer struct {
+	body []byte
+	err  error
+}
+
+func (f *fakePreviewer) Preview(body []byte) (webhook.Preview, error) {
+	f.body = body
+	if f.err != nil {
+		return webhook.Preview{}, f.err
+	}
+	return webhook.Preview{
+		EventType:  "build.finished",
+		Data:       json.RawMessage(`{"event_type":"build.finished"}`),
+		Attributes: map[string]string{"event_type": "build.finished"},
+	}, nil
+}
+
+func TestTransformPreviewHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		err        error
+		wantStatus int
+	}{
+		{
+			name:       "post previews payload",
+			method:     http.MethodPost,
+			body:       `{"event":"build.finished"}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "invalid payload",
+			method:     http.MethodPost,
+			body:       "not json",
+			err:        errors.NewValidationError("failed to decode payload"),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "transform failure",
+			method:     http.MethodPost,
+			body:       `{"event":"build.finished"}`,
+			err:        errors.Wrap(fmt.Errorf("boom"), "failed to transform payload"),
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "payload too large",
+			method:     http.MethodPost,
+			body:       strings.Repeat("x", maxPreviewBytes+1),
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "get not allowed",
+			method:     http.MethodGet,
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previewer := &fakePreviewer{err: tt.err}
+			req := httptest.NewRequest(tt.method, "/admin/transform-preview", strings.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+			TransformPreviewHandler(previewer).ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if string(previewer.body) != tt.body {
+				t.Errorf("previewed body = %q, want %q", previewer.body, tt.body)
+			}
+			var preview webhook.Preview
+			if err := json.Unmarshal(rr.Body.Bytes(), &preview); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if preview.EventType != "build.finished" || preview.Attributes["event_type"] != "build.finished" {
+				t.Errorf("response = %s, want the preview", rr.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package admin
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/mcncl/buildkite-pubsub/internal/recorder"
+)
+
+// RequestRecorder is the subset of recorder.Recorder the admin API reads
+type RequestRecorder interface {
+	Recent(filter recorder.Filter) []recorder.Exchange
+	Reset()
+}
+
+// RequestsHandler returns recorded webhook requests and responses, newest
+// first, on GET and discards them on DELETE. Supported parameters are
+// request_id, delivery_id and limit.
+func RequestsHandler(rec RequestRecorder) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodDelete:
+			rec.Reset()
+			w.WriteHeader(http.StatusNoContent)
+			return
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		params := r.URL.Query()
+		filter := recorder.Filter{
+			RequestID:  params.Get("request_id"),
+			DeliveryID: params.Get("delivery_id"),
+		}
+		if limit := params.Get("limit"); limit != "" {
+			n, err := strconv.Atoi(limit)
+			if err != nil || n < 1 {
+				writeError(w, http.StatusBadRequest, "limit must be a positive integer")
+				return
+			}
+			filter.Limit = n
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"requests": rec.Recent(filter),
+		})
+	})
+}
@@ -0,0 +1,82 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/internal/recorder"
+)
+
+type fakeRecorder struct {
+	exchanges []recorder.Exchange
+	filter    recorder.Filter
+}
+
+func (f *fakeRecorder) Recent(filter recorder.Filter) []recorder.Exchange {
+	f.filter = filter
+	return f.exchanges
+}
+func (f *fakeRecorder) Reset() { f.exchanges = nil }
+
+func TestRequestsHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		wantStatus int
+		wantFilter recorder.Filter
+		wantCount  int
+	}{
+		{
+			name:       "lists recorded requests",
+			method:     http.MethodGet,
+			target:     "/admin/requests",
+			wantStatus: http.StatusOK,
+			wantCount:  1,
+		},
+		{
+			name:       "filters by delivery",
+			method:     http.MethodGet,
+			target:     "/admin/requests?delivery_id=d1&request_id=r1&limit=5",
+			wantStatus: http.StatusOK,
+			wantFilter: recorder.Filter{DeliveryID: "d1", RequestID: "r1", Limit: 5},
+			wantCount:  1,
+		},
+		{name: "rejects invalid limit", method: http.MethodGet, target: "/admin/requests?limit=-1", wantStatus: http.StatusBadRequest},
+		{name: "delete clears", method: http.MethodDelete, target: "/admin/requests", wantStatus: http.StatusNoContent},
+		{name: "other methods not allowed", method: http.MethodPost, target: "/admin/requests", wantStatus: http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &fakeRecorder{exchanges: []recorder.Exchange{{Method: http.MethodPost, Path: "/webhook", Status: http.StatusOK}}}
+			w := httptest.NewRecorder()
+			RequestsHandler(rec).ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.method == http.MethodDelete && rec.exchanges != nil {
+				t.Error("DELETE did not reset the recorder")
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			if rec.filter != tt.wantFilter {
+				t.Errorf("filter = %+v, want %+v", rec.filter, tt.wantFilter)
+			}
+			var resp struct {
+				Requests []recorder.Exchange `json:"requests"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("response is not JSON: %v", err)
+			}
+			if len(resp.Requests) != tt.wantCount {
+				t.Errorf("got %d requests, want %d", len(resp.Requests), tt.wantCount)
+			}
+		})
+	}
+}
@@ -0,0 +1,875 @@
+// Package app assembles the webhook service from its configuration: the
+// publisher chain, webhook handlers and their middleware. cmd/webhook serves
+// it on its own listener; the Cloud Functions entry point serves its webhook
+// handler directly.
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/pubsub/v2"
+	"github.com/mcncl/buildkite-pubsub/contracts"
+	"github.com/mcncl/buildkite-pubsub/internal/audit"
+	"github.com/mcncl/buildkite-pubsub/internal/buildkite"
+	"github.com/mcncl/buildkite-pubsub/internal/config"
+	"github.com/mcncl/buildkite-pubsub/internal/confirmation"
+	"github.com/mcncl/buildkite-pubsub/internal/errors"
+	"github.com/mcncl/buildkite-pubsub/internal/expression"
+	"github.com/mcncl/buildkite-pubsub/internal/gcpauth"
+	"github.com/mcncl/buildkite-pubsub/internal/heartbeat"
+	"github.com/mcncl/buildkite-pubsub/internal/jwtauth"
+	"github.com/mcncl/buildkite-pubsub/internal/lag"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/internal/middleware"
+	"github.com/mcncl/buildkite-pubsub/internal/middleware/compress"
+	"github.com/mcncl/buildkite-pubsub/internal/middleware/instrument"
+	loggingMiddleware "github.com/mcncl/buildkite-pubsub/internal/middleware/logging"
+	"github.com/mcncl/buildkite-pubsub/internal/middleware/request"
+	"github.com/mcncl/buildkite-pubsub/internal/middleware/security"
+	"github.com/mcncl/buildkite-pubsub/internal/ownership"
+	"github.com/mcncl/buildkite-pubsub/internal/pause"
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+	"github.com/mcncl/buildkite-pubsub/internal/quarantine"
+	"github.com/mcncl/buildkite-pubsub/internal/recorder"
+	"github.com/mcncl/buildkite-pubsub/internal/rejections"
+	"github.com/mcncl/buildkite-pubsub/internal/stats"
+	"github.com/mcncl/buildkite-pubsub/internal/version"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/api/option"
+)
+
+// Options holds what the service needs beyond its configuration
+type Options struct {
+	Logger *slog.Logger
+	// Registry is served on /metrics; metrics must already be initialized
+	// with it. Nil leaves /metrics out.
+	Registry *prometheus.Registry
+	// Health is served on /health and /ready and reports publish
+	// back-pressure; nil creates one
+	Health *webhook.HealthCheck
+	// Middleware adds optional webhook middleware by name, such as
+	// middleware.Tracing or middleware.ProxyHeaders, placed in the chain by
+	// cfg.Webhook.Middleware
+	Middleware map[string]func(http.Handler) http.Handler
+	// AttributeHooks derive additional message attributes, after
+	// cfg.GCP.AttributeRules
+	AttributeHooks []webhook.AttributeHook
+	// Version is reported in pings, heartbeats and the producer_version
+	// attribute; empty uses the build's version.Version
+	Version string
+	// NewPublisher creates the publisher for a topic; nil publishes to
+	// Google Cloud Pub/Sub
+	NewPublisher func(ctx context.Context, projectID, topicID string) (publisher.Publisher, error)
+	// NewLagSource creates the source of subscription backlogs; nil reads
+	// them from Cloud Monitoring
+	NewLagSource func(ctx context.Context, projectID string) (lag.Source, error)
+	// NewConfirmationSource creates the source of delivery confirmations
+	// addressed to id; nil subscribes to the feedback topic on Pub/Sub
+	NewConfirmationSource func(ctx context.Context, projectID, topicID, id string) (confirmation.Source, error)
+}
+
+// App is the assembled webhook service
+type App struct {
+	// Handler serves the webhook paths, /health, /ready, /version, /stats,
+	// /schemas/ and /metrics
+	Handler http.Handler
+	// Webhook serves the primary webhook with its middleware on any path
+	Webhook http.Handler
+	// Preview previews the primary webhook's messages for the admin
+	// listener
+	Preview *webhook.Handler
+	Health  *webhook.HealthCheck
+	// Failover and Audit are nil unless configured; the admin listener
+	// exposes them
+	Failover *publisher.FailoverPublisher
+	Audit    *audit.SQLiteStore
+	// Pause rejects webhooks while paused through the admin listener
+	Pause *pause.Switch
+	// Recorder keeps recent webhook exchanges for the admin listener; nil
+	// unless configured
+	Recorder *recorder.Recorder
+	// Stats keeps the rolling rates served at /stats
+	Stats *stats.Aggregator
+	// AuthBan rejects client IPs after repeated auth failures; nil unless
+	// configured
+	AuthBan *security.AuthBan
+
+	logger  *slog.Logger
+	closers []closer
+}
+
+// maxBlockedBuilds bounds how many blocked builds are remembered for unblock
+// events; blocked builds are rare, so it is not configurable
+const maxBlockedBuilds = 10000
+
+type closer struct {
+	name  string
+	close func() error
+}
+
+// New builds the service described by cfg. Close the App to flush and
+// close its publishers and stores.
+func New(ctx context.Context, cfg *config.Config, opts Options) (_ *App, err error) {
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	health := opts.Health
+	if health == nil {
+		health = webhook.NewHealthCheck()
+	}
+	if opts.Version == "" {
+		opts.Version = version.Version
+	}
+	a := &App{Health: health, Stats: stats.New(cfg.Server.StatsWindow), logger: logger}
+	defer func() {
+		if err != nil {
+			a.Close()
+		}
+	}()
+
+	newPublisher := opts.NewPublisher
+	if newPublisher == nil {
+		clientOpts, err := gcpauth.ClientOptions(ctx, cfg.GCP.Credentials)
+		if err != nil {
+			return nil, fmt.Errorf("credentials: %w", err)
+		}
+		newPublisher = pubSubPublisher(PublishSettings(cfg.GCP), clientOpts)
+	}
+
+	pub, err := newPublisher(ctx, cfg.GCP.ProjectID, cfg.GCP.TopicID)
+	if err != nil {
+		return nil, fmt.Errorf("publisher for project %s topic %s: %w", cfg.GCP.ProjectID, cfg.GCP.TopicID, err)
+	}
+
+	// Guard the primary topic with a circuit breaker, failing over to the
+	// secondary topic while it is open when one is configured
+	breakerCfg := publisher.CircuitBreakerConfig{
+		FailureThreshold: cfg.GCP.CircuitBreakerThreshold,
+		OpenTimeout:      cfg.GCP.CircuitBreakerTimeout,
+		StoreTTL:         cfg.GCP.CircuitBreakerStateTTL,
+		OnStateChange: func(from, to publisher.CircuitState) {
+			metrics.CircuitBreakerState.WithLabelValues("pubsub").Set(float64(to))
+			logger.Warn("Circuit breaker state changed", "from", from.String(), "to", to.String())
+		},
+		// Saving is best effort; the breaker works in memory without it
+		OnStoreError: func(err error) {
+			logger.Warn("Failed to load or save circuit breaker state", "error", err)
+		},
+	}
+	if cfg.GCP.CircuitBreakerState != "" {
+		store, err := publisher.NewCircuitStateStore(cfg.GCP.CircuitBreakerState, "pubsub:"+cfg.GCP.ProjectID+":"+cfg.GCP.TopicID)
+		if err != nil {
+			_ = pub.Close()
+			return nil, fmt.Errorf("circuit breaker state store: %w", err)
+		}
+		if closer, ok := store.(io.Closer); ok {
+			a.onClose("circuit breaker state store", closer.Close)
+		}
+		breakerCfg.Store = store
+	}
+	breaker := publisher.NewCircuitBreaker(breakerCfg)
+
+	var webhookPub publisher.Publisher = publisher.NewCircuitBreakerPublisher(pub, breaker)
+	if cfg.GCP.SecondaryTopicID != "" {
+		secondaryProjectID := cfg.GCP.SecondaryProjectID
+		if secondaryProjectID == "" {
+			secondaryProjectID = cfg.GCP.ProjectID
+		}
+
+		secondary, err := newPublisher(ctx, secondaryProjectID, cfg.GCP.SecondaryTopicID)
+		if err != nil {
+			_ = pub.Close()
+			return nil, fmt.Errorf("secondary publisher for project %s topic %s: %w", secondaryProjectID, cfg.GCP.SecondaryTopicID, err)
+		}
+
+		a.Failover = publisher.NewFailoverPublisher(pub, secondary, breaker)
+		webhookPub = a.Failover
+		logger.Info("Failover publishing enabled", "secondary_project_id", secondaryProjectID, "secondary_topic_id", cfg.GCP.SecondaryTopicID)
+	}
+
+	// Route matching events to their own topics; unmatched events use the
+	// primary topic with its circuit breaker and failover
+	if len(cfg.GCP.Routes) > 0 {
+		routes := make([]publisher.Route, 0, len(cfg.GCP.Routes))
+		for _, route := range cfg.GCP.Routes {
+			projectID := route.ProjectID
+			if projectID == "" {
+				projectID = cfg.GCP.ProjectID
+			}
+
+			condition, err := compileCondition("routes["+route.Name+"]", route.Expression)
+			if err != nil {
+				_ = publisher.NewRoutingPublisher(webhookPub, routes).Close()
+				return nil, fmt.Errorf("route %s: %w", route.Name, err)
+			}
+			routePub, err := newPublisher(ctx, projectID, route.TopicID)
+			if err != nil {
+				_ = publisher.NewRoutingPublisher(webhookPub, routes).Close()
+				return nil, fmt.Errorf("publisher for route %s project %s topic %s: %w", route.Name, projectID, route.TopicID, err)
+			}
+
+			routes = append(routes, publisher.Route{
+				RouteRule: publisher.RouteRule{
+					Name:       route.Name,
+					EventType:  route.EventType,
+					Pipeline:   route.Pipeline,
+					Branch:     route.Branch,
+					BuildState: route.BuildState,
+					Expression: condition,
+				},
+				Publisher: routePub,
+			})
+		}
+		webhookPub = publisher.NewRoutingPublisher(webhookPub, routes)
+		logger.Info("Topic routing enabled", "routes", len(routes))
+	}
+
+	// Publish each event UUID at most once when a dedupe store is configured
+	var dedupeStore publisher.DedupeStore
+	switch cfg.Dedupe.Backend {
+	case "memory":
+		dedupeStore = publisher.NewMemoryDedupeStore()
+		logger.Info("Publish deduplication enabled", "backend", "memory", "ttl", cfg.Dedupe.TTL)
+	case "redis":
+		store, err := publisher.NewRedisDedupeStore(cfg.Dedupe.RedisURL)
+		if err != nil {
+			_ = webhookPub.Close()
+			return nil, fmt.Errorf("dedupe store: %w", err)
+		}
+		a.onClose("dedupe store", store.Close)
+
+		// Store errors fail open, so an unreachable Redis is not fatal
+		pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		if err := store.Ping(pingCtx); err != nil {
+			logger.Warn("Dedupe store unreachable, publishing without deduplication until it recovers", "error", err)
+		}
+		cancel()
+
+		dedupeStore = store
+		logger.Info("Publish deduplication enabled", "backend", "redis", "ttl", cfg.Dedupe.TTL)
+	}
+	// A replica that dies mid-publish leaves its dedupe key pending; hold it
+	// only as long as a publish can run so the redelivery can take over
+	newDedupe := func(pub publisher.Publisher) publisher.Publisher {
+		dedupe := publisher.NewDedupePublisher(pub, dedupeStore, cfg.Dedupe.TTL)
+		dedupe.SetPendingTTL(2 * cfg.Server.RequestTimeout)
+		return dedupe
+	}
+	if dedupeStore != nil {
+		webhookPub = newDedupe(webhookPub)
+	}
+
+	// Bound pending publishes, failing the ready check as the queue fills
+	if cfg.GCP.MaxPendingPublishes > 0 {
+		// Shed only low-priority events; high-priority ones wait their turn
+		var classifier *publisher.PriorityClassifier
+		if len(cfg.GCP.HighPriorityEvents) > 0 {
+			classifier = publisher.NewPriorityClassifier(cfg.GCP.HighPriorityEvents)
+		}
+		backpressure := publisher.NewPriorityBackpressurePublisher(webhookPub, cfg.GCP.MaxPendingPublishes, classifier)
+		health.SetSaturationCheck(backpressure.Saturated)
+		a.Stats.SetQueue(backpressure.Depth, cfg.GCP.MaxPendingPublishes)
+		webhookPub = backpressure
+		logger.Info("Publish back-pressure enabled", "max_pending_publishes", cfg.GCP.MaxPendingPublishes,
+			"high_priority_events", cfg.GCP.HighPriorityEvents)
+	}
+
+	// Keep attributes within Pub/Sub limits rather than failing publishes
+	webhookPub = publisher.NewAttributeGuardPublisher(webhookPub, cfg.GCP.AttributeAllowList)
+	a.onClose("publisher", webhookPub.Close)
+
+	// Publish heartbeats through the same chain as events, so consumers can
+	// tell a quiet period from a broken pipeline; like the ownership
+	// watcher, they outlive ctx
+	if cfg.Heartbeat.Interval > 0 {
+		heartbeats := heartbeat.New(heartbeat.Config{
+			Publisher: webhookPub,
+			Interval:  cfg.Heartbeat.Interval,
+			Instance:  cfg.Heartbeat.InstanceID,
+			Timeout:   cfg.Server.RequestTimeout,
+			Version:   opts.Version,
+			Logger:    logger,
+		})
+		heartbeatCtx, stopHeartbeats := context.WithCancel(context.Background())
+		go heartbeats.Run(heartbeatCtx)
+		a.onClose("heartbeats", func() error {
+			stopHeartbeats()
+			return nil
+		})
+		logger.Info("Heartbeats enabled", "interval", cfg.Heartbeat.Interval, "instance", heartbeats.Instance())
+	}
+
+	// Watch the backlog of the topic's subscriptions, serving it in
+	// /stats and as metrics
+	if len(cfg.SubscriptionLag.Subscriptions) > 0 {
+		newLagSource := opts.NewLagSource
+		if newLagSource == nil {
+			newLagSource = monitoringLagSource(cfg.GCP.Credentials)
+		}
+		source, err := newLagSource(ctx, cfg.GCP.ProjectID)
+		if err != nil {
+			return nil, fmt.Errorf("subscription lag source: %w", err)
+		}
+		interval := cfg.SubscriptionLag.Interval
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		monitor := lag.New(lag.Config{
+			Source:        source,
+			Subscriptions: cfg.SubscriptionLag.Subscriptions,
+			Interval:      interval,
+			MaxAge:        cfg.SubscriptionLag.MaxAge,
+			Logger:        logger,
+		})
+		a.Stats.SetSubscriptions(monitor.Samples)
+		lagCtx, stopLag := context.WithCancel(context.Background())
+		go monitor.Run(lagCtx)
+		a.onClose("subscription lag monitor", func() error {
+			stopLag()
+			return nil
+		})
+		logger.Info("Subscription lag monitoring enabled", "subscriptions", cfg.SubscriptionLag.Subscriptions, "interval", interval)
+	}
+
+	// Create the DLQ publisher when any event type can be dead-lettered
+	var dlqPub, dlqFallback publisher.Publisher
+	if cfg.GCP.DLQFallbackDir != "" {
+		fallback, err := publisher.NewFilePublisher(cfg.GCP.DLQFallbackDir)
+		if err != nil {
+			return nil, fmt.Errorf("DLQ fallback at %s: %w", cfg.GCP.DLQFallbackDir, err)
+		}
+		dlqFallback = fallback
+		logger.Info("DLQ fallback enabled", "dir", cfg.GCP.DLQFallbackDir)
+	}
+	if cfg.GCP.DLQRequired() {
+		dlqPub, err = newPublisher(ctx, cfg.GCP.ProjectID, cfg.GCP.DLQTopicID)
+		if err != nil {
+			return nil, fmt.Errorf("DLQ publisher for project %s topic %s: %w", cfg.GCP.ProjectID, cfg.GCP.DLQTopicID, err)
+		}
+		// DLQ messages carry their own attributes, so only the size guard applies
+		dlqPub = publisher.NewAttributeGuardPublisher(dlqPub, nil)
+		a.onClose("DLQ publisher", dlqPub.Close)
+	}
+
+	// Sample rejected requests into a diagnostics topic, or the log when
+	// none is set
+	var rejectionSampler *rejections.Sampler
+	if cfg.Rejections.SampleRate > 0 {
+		var rejectionPub publisher.Publisher
+		if cfg.Rejections.TopicID != "" {
+			rejectionPub, err = newPublisher(ctx, cfg.GCP.ProjectID, cfg.Rejections.TopicID)
+			if err != nil {
+				return nil, fmt.Errorf("rejection publisher for project %s topic %s: %w", cfg.GCP.ProjectID, cfg.Rejections.TopicID, err)
+			}
+			rejectionPub = publisher.NewAttributeGuardPublisher(rejectionPub, nil)
+			a.onClose("rejection publisher", rejectionPub.Close)
+		}
+		rejectionSampler = rejections.New(rejections.Config{
+			Publisher:  rejectionPub,
+			SampleRate: cfg.Rejections.SampleRate,
+			Logger:     logger,
+		})
+		logger.Info("Rejection sampling enabled", "sample_rate", cfg.Rejections.SampleRate, "topic", cfg.Rejections.TopicID)
+	}
+
+	var schemaDrift *buildkite.SchemaDriftDetector
+	if cfg.Webhook.DetectSchemaDrift {
+		schemaDrift = buildkite.NewSchemaDriftDetector(logger, 0)
+	}
+
+	// Index publish outcomes so operators can check whether an event was published
+	if cfg.Audit.Path != "" {
+		a.Audit, err = audit.NewSQLiteStore(cfg.Audit.Path, time.Duration(cfg.Audit.RetentionDays)*24*time.Hour)
+		if err != nil {
+			return nil, fmt.Errorf("audit index at %s: %w", cfg.Audit.Path, err)
+		}
+		a.onClose("audit index", a.Audit.Close)
+		logger.Info("Audit index enabled", "path", cfg.Audit.Path, "retention_days", cfg.Audit.RetentionDays)
+	}
+
+	// Create webhook handler
+	handlerCfg := webhook.Config{
+		BuildkiteToken:    cfg.Webhook.Token,
+		HMACSecret:        cfg.Webhook.HMACSecret,
+		Publisher:         a.Stats.Publisher(webhookPub),
+		DLQPublisher:      dlqPub,
+		DLQFallback:       dlqFallback,
+		EnableDLQ:         cfg.GCP.EnableDLQ,
+		RetryMaxAttempts:  cfg.GCP.PubSubRetryMaxAttempts,
+		EventPolicies:     cfg.GCP.EventPolicies,
+		SchemaDrift:       schemaDrift,
+		ChecksumRaw:       cfg.Webhook.ChecksumPayload == config.ChecksumPayloadRaw,
+		Rejections:        rejectionSampler,
+		UnsupportedEvents: cfg.Webhook.UnsupportedEvents,
+		Version:           opts.Version,
+		StrictMethods:     cfg.Webhook.StrictMethods,
+		ServerTiming:      cfg.Webhook.ServerTiming,
+		PartialPayloads:   cfg.Webhook.PartialPayloads,
+		SchemaVersion:     cfg.Webhook.SchemaVersion,
+		SchemaBaseURL:     cfg.Webhook.SchemaBaseURL,
+
+		DeliveryAttemptHeader:    cfg.Webhook.DeliveryAttemptHeader,
+		SignatureTolerance:       cfg.Webhook.SignatureTolerance,
+		SignatureFutureTolerance: cfg.Webhook.SignatureFutureTolerance,
+		MaxDecompressedSize:      cfg.Webhook.MaxDecompressedSize,
+		BatchMaxItems:            cfg.Webhook.BatchMaxItems,
+		DLQRetryMaxAttempts:      cfg.GCP.DLQRetryMaxAttempts,
+		LegacyPipelineAttribute:  cfg.Webhook.LegacyPipelineAttribute,
+	}
+	switch cfg.Webhook.ChecksumAlgorithm {
+	case "":
+		handlerCfg.ChecksumAlgorithm = config.ChecksumSHA256
+	case config.ChecksumNone:
+	default:
+		handlerCfg.ChecksumAlgorithm = cfg.Webhook.ChecksumAlgorithm
+	}
+	// Publish each terminal build state once, per replica
+	if cfg.Dedupe.TransitionTTL > 0 {
+		handlerCfg.Transitions = webhook.NewTransitionTracker(cfg.Dedupe.TransitionTTL, cfg.Dedupe.TransitionMaxBuilds)
+		logger.Info("Terminal state deduplication enabled", "ttl", cfg.Dedupe.TransitionTTL, "max_builds", cfg.Dedupe.TransitionMaxBuilds)
+	}
+	// Derive build.unblocked from blocked builds that run again, per replica
+	if cfg.Webhook.UnblockEventTTL > 0 {
+		handlerCfg.Blocks = webhook.NewBlockTracker(cfg.Webhook.UnblockEventTTL, maxBlockedBuilds)
+		logger.Info("Unblock events enabled", "ttl", cfg.Webhook.UnblockEventTTL)
+	}
+	if len(cfg.Webhook.JobMessagePipelines) > 0 {
+		handlerCfg.JobMessagePipelines = cfg.Webhook.JobMessagePipelines
+		logger.Info("Job messages enabled", "pipelines", cfg.Webhook.JobMessagePipelines)
+	}
+	if cfg.Quarantine.Dir != "" {
+		dir, err := quarantine.NewDir(cfg.Quarantine.Dir)
+		if err != nil {
+			return nil, err
+		}
+		handlerCfg.Quarantine = dir
+		handlerCfg.QuarantineAcknowledge = cfg.Quarantine.Acknowledge
+		logger.Info("Transform failure quarantine enabled", "dir", cfg.Quarantine.Dir, "acknowledge", cfg.Quarantine.Acknowledge)
+	}
+	// Publish pings so Buildkite's "Test webhook" checks the topic is reachable
+	if cfg.Webhook.PingCheck {
+		handlerCfg.PingPublisher = handlerCfg.Publisher
+		pingTopic := cfg.GCP.TopicID
+		if cfg.Webhook.PingTopicID != "" {
+			pingPub, err := newPublisher(ctx, cfg.GCP.ProjectID, cfg.Webhook.PingTopicID)
+			if err != nil {
+				return nil, fmt.Errorf("ping publisher for project %s topic %s: %w", cfg.GCP.ProjectID, cfg.Webhook.PingTopicID, err)
+			}
+			pingPub = publisher.NewAttributeGuardPublisher(pingPub, nil)
+			a.onClose("ping publisher", pingPub.Close)
+			handlerCfg.PingPublisher, pingTopic = pingPub, cfg.Webhook.PingTopicID
+		}
+		logger.Info("Ping check enabled", "topic", pingTopic)
+	}
+	// Try a new schema version on live traffic before switching to it
+	if cfg.Webhook.ShadowTopicID != "" {
+		shadowPub, err := newPublisher(ctx, cfg.GCP.ProjectID, cfg.Webhook.ShadowTopicID)
+		if err != nil {
+			return nil, fmt.Errorf("shadow publisher for project %s topic %s: %w", cfg.GCP.ProjectID, cfg.Webhook.ShadowTopicID, err)
+		}
+		shadowPub = publisher.NewAttributeGuardPublisher(shadowPub, cfg.GCP.AttributeAllowList)
+		a.onClose("shadow publisher", shadowPub.Close)
+		handlerCfg.ShadowPublisher = shadowPub
+		handlerCfg.ShadowSchemaVersion = cfg.Webhook.ShadowSchemaVersion
+		logger.Info("Shadow publishing enabled", "topic", cfg.Webhook.ShadowTopicID, "schema_version", cfg.Webhook.ShadowSchemaVersion)
+	}
+	// Wait for the consumer to confirm the messages of critical pipelines
+	if len(cfg.Confirmation.Pipelines) > 0 {
+		newSource := opts.NewConfirmationSource
+		if newSource == nil {
+			newSource = pubSubConfirmationSource(cfg.GCP.Credentials)
+		}
+		id := confirmationID()
+		source, err := newSource(ctx, cfg.GCP.ProjectID, cfg.Confirmation.TopicID, id)
+		if err != nil {
+			return nil, fmt.Errorf("confirmation source for project %s topic %s: %w", cfg.GCP.ProjectID, cfg.Confirmation.TopicID, err)
+		}
+		tracker := confirmation.New(confirmation.Config{Source: source, Timeout: cfg.Confirmation.Timeout, Logger: logger})
+		confirmCtx, stopConfirm := context.WithCancel(context.Background())
+		go tracker.Run(confirmCtx)
+		a.onClose("delivery confirmations", func() error {
+			stopConfirm()
+			if closer, ok := source.(io.Closer); ok {
+				return closer.Close()
+			}
+			return nil
+		})
+		handlerCfg.Confirmations = tracker
+		handlerCfg.ConfirmationID = id
+		handlerCfg.ConfirmationPipelines = cfg.Confirmation.Pipelines
+		logger.Info("Delivery confirmations enabled", "pipelines", cfg.Confirmation.Pipelines, "topic", cfg.Confirmation.TopicID, "id", id)
+	}
+	if len(cfg.GCP.AttributeRules) > 0 {
+		rules := make([]webhook.AttributeRule, 0, len(cfg.GCP.AttributeRules))
+		for i, rule := range cfg.GCP.AttributeRules {
+			name := fmt.Sprintf("attribute_rules[%d]", i)
+			condition, err := compileCondition(name, rule.Expression)
+			if err != nil {
+				return nil, fmt.Errorf("attribute rule %d: %w", i, err)
+			}
+			var value *expression.Program
+			if rule.ValueExpression != "" {
+				if value, err = expression.CompileValue(name+".value", rule.ValueExpression); err != nil {
+					return nil, fmt.Errorf("attribute rule %d: %w", i, err)
+				}
+			}
+			rules = append(rules, webhook.AttributeRule{
+				Attribute:       rule.Attribute,
+				Value:           rule.Value,
+				ValueExpression: value,
+				Match: publisher.RouteRule{
+					EventType:  rule.EventType,
+					Pipeline:   rule.Pipeline,
+					Branch:     rule.Branch,
+					BuildState: rule.BuildState,
+					Expression: condition,
+				},
+			})
+		}
+		handlerCfg.AttributeHooks = append(handlerCfg.AttributeHooks, webhook.AttributeRules(rules))
+	}
+	handlerCfg.AttributeHooks = append(handlerCfg.AttributeHooks, opts.AttributeHooks...)
+	if len(cfg.GCP.HashedAttributes) > 0 {
+		handlerCfg.AttributeHasher = webhook.NewAttributeHasher([]byte(cfg.GCP.AttributeHashKey), cfg.GCP.HashedAttributes)
+	}
+
+	// Attach owning teams, picking up edits to the mapping while running;
+	// the watcher outlives ctx, which may only cover startup
+	if cfg.Ownership.File != "" {
+		teams, err := ownership.NewWatcher(cfg.Ownership.File, logger)
+		if err != nil {
+			return nil, err
+		}
+		watchCtx, stopWatching := context.WithCancel(context.Background())
+		go teams.Run(watchCtx, cfg.Ownership.ReloadInterval)
+		a.onClose("ownership watcher", func() error {
+			stopWatching()
+			return nil
+		})
+		handlerCfg.Teams = teams
+		logger.Info("Pipeline ownership enabled", "file", cfg.Ownership.File)
+	}
+	if a.Audit != nil {
+		// Keep audit writes off the request path; the writer is closed,
+		// flushing its queue, before the index it writes to
+		writer := audit.NewWriter(a.Audit, audit.DefaultQueueSize)
+		a.onClose("audit writer", writer.Close)
+		handlerCfg.Audit = writer
+	}
+
+	// Restore a pause from before a restart, taking this instance out of
+	// rotation while paused
+	a.Pause, err = pause.New(cfg.Admin.PauseStateFile, cfg.Admin.PauseRetryAfter)
+	if err != nil {
+		return nil, err
+	}
+	health.SetPauseCheck(a.Pause.Paused)
+	if a.Pause.Paused() {
+		state := a.Pause.State()
+		logger.Warn("Webhook intake is paused", "since", state.Since, "reason", state.Reason)
+	}
+
+	// Create router
+	mux := http.NewServeMux()
+
+	// Add metrics endpoint; promhttp negotiates gzip or zstd itself, which
+	// the gzip middleware leaves alone
+	if opts.Registry != nil {
+		mux.Handle("/metrics", compress.Gzip(promhttp.HandlerFor(opts.Registry, promhttp.HandlerOpts{Registry: opts.Registry})))
+	}
+
+	// Add health check routes
+	mux.HandleFunc("/health", health.HealthHandler)
+	mux.HandleFunc("/ready", health.ReadyHandler)
+	mux.HandleFunc("/version", version.Handler)
+	mux.Handle("/stats", compress.Gzip(http.HandlerFunc(a.Stats.Handler)))
+	// Serve the message schemas the schema_url attribute points at
+	mux.Handle("/schemas/", compress.Gzip(contracts.Handler()))
+
+	// Add webhook route with middleware, in the configured order
+	builder := middleware.NewBuilder()
+	for name, mw := range opts.Middleware {
+		builder.Register(name, mw)
+	}
+
+	rateLimits := security.RateLimitConfig{
+		Global: security.LimitConfig{
+			Requests: cfg.Security.RateLimit,
+			Burst:    cfg.Security.RateLimitBurst,
+			Window:   cfg.Security.RateLimitWindow,
+		},
+		IP: security.LimitConfig{
+			Requests: cfg.Security.IPRateLimit,
+			Burst:    cfg.Security.IPRateLimitBurst,
+			Window:   cfg.Security.RateLimitWindow,
+		},
+		Token: security.LimitConfig{
+			Requests: cfg.Security.TokenRateLimit,
+			Burst:    cfg.Security.TokenRateLimitBurst,
+			Window:   cfg.Security.RateLimitWindow,
+		},
+	}
+	if cfg.Security.TokenRateLimitHeader != "" {
+		trusted, err := security.ParseCIDRs(cfg.Security.TokenRateLimitHeaderCIDRs)
+		if err != nil {
+			return nil, fmt.Errorf("token rate limit header: %w", err)
+		}
+		rateLimits.TokenKey = security.HeaderKey(cfg.Security.TokenRateLimitHeader, trusted)
+	}
+	rateLimits.BypassPaths = cfg.Security.RateLimitBypassPaths
+	if rateLimits.BypassCIDRs, err = security.ParseCIDRs(cfg.Security.RateLimitBypassCIDRs); err != nil {
+		return nil, fmt.Errorf("rate limit bypass: %w", err)
+	}
+
+	builder.Register(middleware.RequestID, request.WithRequestID)
+	builder.Register(middleware.Logging, loggingMiddleware.WithStructuredLogging(logger))
+	if len(cfg.Security.CORSAllowedOrigins) > 0 {
+		builder.Register(middleware.CORS, security.WithCORS(security.CORSConfig{AllowedOrigins: cfg.Security.CORSAllowedOrigins}))
+	}
+	if cfg.Admin.RecordRequests > 0 {
+		a.Recorder = recorder.New(cfg.Admin.RecordRequests, cfg.Admin.RecordRedactFields)
+		builder.Register(middleware.Recorder, a.Recorder.Middleware)
+		logger.Info("Request recording enabled", "size", cfg.Admin.RecordRequests)
+	}
+	builder.Register(middleware.Pause, a.Pause.Middleware)
+	if cfg.Security.AuthBanMaxFailures > 0 {
+		exempt, err := security.ParseCIDRs(cfg.Security.AuthBanExemptCIDRs)
+		if err != nil {
+			return nil, fmt.Errorf("auth ban exemption: %w", err)
+		}
+		a.AuthBan = security.NewAuthBan(security.AuthBanConfig{
+			MaxFailures: cfg.Security.AuthBanMaxFailures,
+			Window:      cfg.Security.AuthBanWindow,
+			Cooldown:    cfg.Security.AuthBanCooldown,
+			ExemptCIDRs: exempt,
+		})
+		builder.Register(middleware.AuthBan, a.AuthBan.Middleware)
+		logger.Info("Auth failure banning enabled",
+			"max_failures", cfg.Security.AuthBanMaxFailures,
+			"window", cfg.Security.AuthBanWindow,
+			"cooldown", cfg.Security.AuthBanCooldown)
+	}
+	builder.Register(middleware.RateLimit, security.WithRateLimits(rateLimits))
+	timeouts := request.TimeoutConfig{Timeout: cfg.Server.RequestTimeout}
+	if timeouts.HeaderCIDRs, err = security.ParseCIDRs(cfg.Server.TimeoutHeaderCIDRs); err != nil {
+		return nil, fmt.Errorf("timeout header: %w", err)
+	}
+	builder.Register(middleware.Timeout, request.WithTimeouts(timeouts))
+	middlewares, err := builder.Build(cfg.Webhook.Middleware)
+	if err != nil {
+		return nil, err
+	}
+
+	// Count every request, including those the middleware rejects
+	a.Preview = webhook.NewHandler(handlerCfg)
+	a.Webhook = a.Stats.Middleware(Chain(a.Preview, middlewares...))
+	mux.Handle(cfg.Webhook.Path, a.Webhook)
+
+	// Accept batches of payloads with the primary webhook's credentials,
+	// publishing each as if delivered on its own
+	if cfg.Webhook.BatchPath != "" {
+		mux.Handle(cfg.Webhook.BatchPath, a.Stats.Middleware(Chain(http.HandlerFunc(a.Preview.ServeBatch), middlewares...)))
+		logger.Info("Webhook batch endpoint enabled", "path", cfg.Webhook.BatchPath)
+	}
+
+	// Serve additional webhook paths, each with its own credentials, event
+	// filter and topic; they share the middleware and its rate limiters
+	for _, webhookPath := range cfg.Webhook.Paths {
+		pathCfg := handlerCfg
+		if webhookPath.Token != "" || webhookPath.HMACSecret != "" {
+			pathCfg.BuildkiteToken = webhookPath.Token
+			pathCfg.HMACSecret = webhookPath.HMACSecret
+		}
+		condition, err := compileCondition("paths["+webhookPath.Path+"]", webhookPath.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("webhook path %s: %w", webhookPath.Path, err)
+		}
+		pathCfg.Filter = publisher.RouteRule{
+			Name:       webhookPath.Path,
+			EventType:  webhookPath.EventType,
+			Pipeline:   webhookPath.Pipeline,
+			Branch:     webhookPath.Branch,
+			BuildState: webhookPath.BuildState,
+			Expression: condition,
+		}
+		if webhookPath.JWT != nil {
+			pathCfg.JWT = jwtauth.New(jwtauth.Config{
+				Issuer:   webhookPath.JWT.Issuer,
+				Audience: webhookPath.JWT.Audience,
+				JWKSURL:  webhookPath.JWT.JWKSURL,
+				Subjects: webhookPath.JWT.Subjects,
+				Leeway:   time.Duration(webhookPath.JWT.ClockSkewSeconds) * time.Second,
+			})
+		}
+
+		if webhookPath.TopicID != "" {
+			projectID := webhookPath.ProjectID
+			if projectID == "" {
+				projectID = cfg.GCP.ProjectID
+			}
+
+			pathPub, err := newPublisher(ctx, projectID, webhookPath.TopicID)
+			if err != nil {
+				return nil, fmt.Errorf("publisher for webhook path %s project %s topic %s: %w", webhookPath.Path, projectID, webhookPath.TopicID, err)
+			}
+			if dedupeStore != nil {
+				pathPub = newDedupe(pathPub)
+			}
+			pathPub = publisher.NewAttributeGuardPublisher(pathPub, cfg.GCP.AttributeAllowList)
+			a.onClose("webhook path publisher", pathPub.Close)
+			pathCfg.Publisher = a.Stats.Publisher(pathPub)
+			// The shadow topic mirrors the events topic only, and only its
+			// consumer confirms messages
+			pathCfg.ShadowPublisher = nil
+			pathCfg.Confirmations = nil
+			// Pings check the path's own topic unless they have a dedicated one
+			if cfg.Webhook.PingCheck && cfg.Webhook.PingTopicID == "" {
+				pathCfg.PingPublisher = pathCfg.Publisher
+			}
+		}
+
+		mux.Handle(webhookPath.Path, a.Stats.Middleware(Chain(webhook.NewHandler(pathCfg), middlewares...)))
+		logger.Info("Webhook path enabled", "path", webhookPath.Path, "topic_id", webhookPath.TopicID, "jwt_auth", pathCfg.JWT != nil)
+	}
+
+	// Record the same HTTP metrics for every route
+	a.Handler = instrument.Middleware(mux)
+	return a, nil
+}
+
+// Close closes publishers and stores in the reverse order they were opened,
+// logging any that fail
+func (a *App) Close() {
+	for i := len(a.closers) - 1; i >= 0; i-- {
+		if err := a.closers[i].close(); err != nil {
+			a.logger.Error("Failed to close "+a.closers[i].name, "error", err)
+		}
+	}
+	a.closers = nil
+}
+
+func (a *App) onClose(name string, close func() error) {
+	a.closers = append(a.closers, closer{name: name, close: close})
+}
+
+// compileCondition compiles an optional CEL condition; rule labels its
+// evaluation metrics
+func compileCondition(rule, source string) (*expression.Program, error) {
+	if source == "" {
+		return nil, nil
+	}
+	return expression.CompileCondition(rule, source)
+}
+
+// pubSubPublisher returns a constructor for Pub/Sub publishers with the
+// given batching and flow control settings, authenticating with opts
+func pubSubPublisher(settings *pubsub.PublishSettings, opts []option.ClientOption) func(ctx context.Context, projectID, topicID string) (publisher.Publisher, error) {
+	return func(ctx context.Context, projectID, topicID string) (publisher.Publisher, error) {
+		pub, err := publisher.NewPubSubPublisherWithSettings(ctx, projectID, topicID, settings, opts...)
+		if err != nil {
+			// Wrap the error with additional context
+			if errors.IsConnectionError(err) {
+				return nil, errors.Wrap(err, "failed to connect to Google Cloud Pub/Sub")
+			}
+			return nil, errors.Wrap(err, "failed to create publisher")
+		}
+		return pub, nil
+	}
+}
+
+// monitoringLagSource reads subscription backlogs from Cloud Monitoring with
+// the configured credentials
+func monitoringLagSource(creds config.CredentialsConfig) func(ctx context.Context, projectID string) (lag.Source, error) {
+	return func(ctx context.Context, projectID string) (lag.Source, error) {
+		clientOpts, err := gcpauth.ClientOptions(ctx, creds)
+		if err != nil {
+			return nil, fmt.Errorf("credentials: %w", err)
+		}
+		return lag.NewMonitoringSource(ctx, projectID, clientOpts...)
+	}
+}
+
+// pubSubConfirmationSource subscribes to the feedback topic with the
+// configured credentials
+func pubSubConfirmationSource(creds config.CredentialsConfig) func(ctx context.Context, projectID, topicID, id string) (confirmation.Source, error) {
+	return func(ctx context.Context, projectID, topicID, id string) (confirmation.Source, error) {
+		clientOpts, err := gcpauth.ClientOptions(ctx, creds)
+		if err != nil {
+			return nil, fmt.Errorf("credentials: %w", err)
+		}
+		return confirmation.NewPubSubSource(ctx, projectID, topicID, id, clientOpts...)
+	}
+}
+
+// confirmationID returns a random ID addressing confirmations to this
+// replica, valid in a subscription name
+func confirmationID() string {
+	b := make([]byte, 6)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// PublishSettings returns the Pub/Sub batching and flow control settings cfg
+// describes. Unset values keep the client's defaults, except that publishes
+// beyond the outstanding limits wait rather than fail.
+func PublishSettings(cfg config.GCPConfig) *pubsub.PublishSettings {
+	settings := pubsub.DefaultPublishSettings
+	settings.FlowControlSettings.LimitExceededBehavior = pubsub.FlowControlBlock
+	settings.NumGoroutines = 4
+	if cfg.PubSubBatchSize > 0 {
+		settings.CountThreshold = cfg.PubSubBatchSize
+	}
+	if cfg.PubSubByteThreshold > 0 {
+		settings.ByteThreshold = cfg.PubSubByteThreshold
+	}
+	if cfg.PubSubDelayThreshold > 0 {
+		settings.DelayThreshold = cfg.PubSubDelayThreshold
+	}
+	if cfg.PubSubMaxOutstandingMessages > 0 {
+		settings.FlowControlSettings.MaxOutstandingMessages = cfg.PubSubMaxOutstandingMessages
+	}
+	if cfg.PubSubMaxOutstandingBytes > 0 {
+		settings.FlowControlSettings.MaxOutstandingBytes = cfg.PubSubMaxOutstandingBytes
+	}
+	if cfg.PubSubCompression != nil {
+		settings.EnableCompression = *cfg.PubSubCompression
+	}
+	if cfg.PubSubCompressionThreshold > 0 {
+		settings.CompressionBytesThreshold = cfg.PubSubCompressionThreshold
+	}
+	return &settings
+}
+
+// MetricsOptions names and labels metrics as cfg describes
+func MetricsOptions(cfg config.MetricsConfig) []metrics.Option {
+	rules := make([]metrics.RelabelRule, len(cfg.RelabelRules))
+	for i, rule := range cfg.RelabelRules {
+		rules[i] = metrics.RelabelRule{Label: rule.Label, Match: rule.Match, Replacement: rule.Replacement}
+	}
+	return []metrics.Option{
+		metrics.WithNamespace(cfg.Namespace),
+		metrics.WithSubsystem(cfg.Subsystem),
+		metrics.WithConstLabels(cfg.ConstLabels),
+		metrics.WithDroppedLabels(cfg.DropLabels),
+		metrics.WithRelabelRules(rules),
+	}
+}
+
+// Chain applies middleware in reverse order so they execute in the order
+// they're passed
+func Chain(handler http.Handler, middlewares ...func(http.Handler) http.Handler) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
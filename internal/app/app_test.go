@@ -0,0 +1,589 @@
+package app_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub/v2"
+	"github.com/mcncl/buildkite-pubsub/internal/app"
+	"github.com/mcncl/buildkite-pubsub/internal/config"
+	"github.com/mcncl/buildkite-pubsub/internal/confirmation"
+	"github.com/mcncl/buildkite-pubsub/internal/lag"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"github.com/mcncl/buildkite-pubsub/pkg/transform"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook/webhooktest"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// topics hands out one mock publisher per topic
+type topics struct {
+	mu     sync.Mutex
+	pubs   map[string]*publisher.MockPublisher
+	failOn string
+}
+
+func (tp *topics) newPublisher(_ context.Context, _, topicID string) (publisher.Publisher, error) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if topicID == tp.failOn {
+		return nil, errors.New("topic not found")
+	}
+	if tp.pubs == nil {
+		tp.pubs = make(map[string]*publisher.MockPublisher)
+	}
+	pub := webhooktest.NewPublisher()
+	tp.pubs[topicID] = pub
+	return pub, nil
+}
+
+func (tp *topics) get(topicID string) *publisher.MockPublisher {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	return tp.pubs[topicID]
+}
+
+func testConfig() *config.Config {
+	cfg := config.DefaultConfig()
+	cfg.GCP.ProjectID = "test-project"
+	cfg.GCP.TopicID = "builds"
+	cfg.Webhook.Token = "test-token"
+	return cfg
+}
+
+func TestNew(t *testing.T) {
+	reg := webhooktest.NewRegistry(t)
+	tp := &topics{}
+	svc, err := app.New(context.Background(), testConfig(), app.Options{
+		Registry:     reg,
+		NewPublisher: tp.newPublisher,
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer svc.Close()
+
+	for _, path := range []string{"/health", "/ready", "/metrics", "/version", "/stats", "/schemas/original.json", "/schemas/openapi.json"} {
+		rr := httptest.NewRecorder()
+		svc.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if rr.Code != http.StatusOK && !(path == "/ready" && rr.Code == http.StatusServiceUnavailable) {
+			t.Errorf("GET %s status = %d", path, rr.Code)
+		}
+	}
+
+	// The metrics payload is large enough to be worth compressing
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	svc.Handler.ServeHTTP(rr, req)
+	if got := rr.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("GET /metrics Content-Encoding = %q, want gzip", got)
+	}
+
+	body := webhooktest.Payload("build.finished")
+	rr = webhooktest.Serve(svc.Handler, webhooktest.NewTokenRequest("/webhook", "test-token", body))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("POST /webhook status = %d: %s", rr.Code, rr.Body)
+	}
+	webhooktest.AssertPublished(t, tp.get("builds"), "build.finished")
+
+	// Webhook serves the webhook on any path, for platforms that route
+	// every request to one handler
+	rr = webhooktest.Serve(svc.Webhook, webhooktest.NewTokenRequest("/", "test-token", body))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("POST / status = %d: %s", rr.Code, rr.Body)
+	}
+	webhooktest.AssertPublishedCount(t, tp.get("builds"), 2)
+	if rr.Header().Get("X-Request-ID") == "" {
+		t.Error("webhook response has no X-Request-ID; middleware not applied")
+	}
+	if snapshot := svc.Stats.Snapshot(); snapshot.RequestsPerSecond == 0 || snapshot.PublishesPerSecond == 0 {
+		t.Errorf("stats = %+v, want requests and publishes counted", snapshot)
+	}
+}
+
+func TestNewWebhookPaths(t *testing.T) {
+	webhooktest.NewRegistry(t)
+	cfg := testConfig()
+	cfg.Webhook.Paths = []config.WebhookPathConfig{
+		{Path: "/webhook/agents", Token: "agent-token", TopicID: "agents"},
+	}
+	tp := &topics{}
+	svc, err := app.New(context.Background(), cfg, app.Options{NewPublisher: tp.newPublisher})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer svc.Close()
+
+	body := webhooktest.Payload("agent.connected")
+	rr := webhooktest.Serve(svc.Handler, webhooktest.NewTokenRequest("/webhook/agents", "agent-token", body))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("POST /webhook/agents status = %d: %s", rr.Code, rr.Body)
+	}
+	webhooktest.AssertPublished(t, tp.get("agents"), "agent.connected")
+	webhooktest.AssertPublishedCount(t, tp.get("builds"), 0)
+}
+
+func TestNewBatchPath(t *testing.T) {
+	webhooktest.NewRegistry(t)
+	cfg := testConfig()
+	cfg.Webhook.BatchPath = "/webhook/batch"
+	tp := &topics{}
+	svc, err := app.New(context.Background(), cfg, app.Options{NewPublisher: tp.newPublisher})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer svc.Close()
+
+	body := []byte("[" + string(webhooktest.Payload("build.finished")) + "," + string(webhooktest.Payload("build.started")) + "]")
+	rr := webhooktest.Serve(svc.Handler, webhooktest.NewTokenRequest("/webhook/batch", "test-token", body))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("POST /webhook/batch status = %d: %s", rr.Code, rr.Body)
+	}
+	webhooktest.AssertPublishedCount(t, tp.get("builds"), 2)
+}
+
+func TestNewPublisherError(t *testing.T) {
+	webhooktest.NewRegistry(t)
+	cfg := testConfig()
+	cfg.GCP.EnableDLQ = true
+	cfg.GCP.DLQTopicID = "dead-letters"
+
+	tp := &topics{failOn: "dead-letters"}
+	_, err := app.New(context.Background(), cfg, app.Options{NewPublisher: tp.newPublisher})
+	if err == nil || !strings.Contains(err.Error(), "dead-letters") {
+		t.Errorf("New() error = %v, want DLQ publisher error", err)
+	}
+}
+
+func TestNewMiddlewareOrder(t *testing.T) {
+	webhooktest.NewRegistry(t)
+	cfg := testConfig()
+	cfg.Webhook.Middleware = []string{"logging", "timeout"}
+	tp := &topics{}
+	svc, err := app.New(context.Background(), cfg, app.Options{NewPublisher: tp.newPublisher})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer svc.Close()
+
+	rr := webhooktest.Serve(svc.Handler, webhooktest.NewTokenRequest("/webhook", "test-token", webhooktest.Payload("build.finished")))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("POST /webhook status = %d: %s", rr.Code, rr.Body)
+	}
+	if id := rr.Header().Get("X-Request-ID"); id != "" {
+		t.Errorf("X-Request-ID = %q, want none with request_id disabled", id)
+	}
+
+	cfg.Webhook.Middleware = []string{"logging", "request_id"}
+	if _, err := app.New(context.Background(), cfg, app.Options{NewPublisher: tp.newPublisher}); err == nil {
+		t.Error("New() with request_id after logging error = nil, want error")
+	}
+}
+
+func TestNewAttributeHooks(t *testing.T) {
+	webhooktest.NewRegistry(t)
+	cfg := testConfig()
+	cfg.GCP.AttributeRules = []config.AttributeRuleConfig{
+		{Attribute: "team", Value: "payments", Pipeline: "payments-*"},
+	}
+	tp := &topics{}
+	svc, err := app.New(context.Background(), cfg, app.Options{
+		NewPublisher: tp.newPublisher,
+		AttributeHooks: []webhook.AttributeHook{
+			func(payload transform.TransformedPayload) map[string]string {
+				return map[string]string{"team": "platform", "severity": payload.Build.State}
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer svc.Close()
+
+	body := webhooktest.Payload("build.finished", webhooktest.WithPipeline("payments-api"), webhooktest.WithBuildState("failed"))
+	if rr := webhooktest.Serve(svc.Handler, webhooktest.NewTokenRequest("/webhook", "test-token", body)); rr.Code != http.StatusOK {
+		t.Fatalf("POST /webhook status = %d: %s", rr.Code, rr.Body)
+	}
+	// Configured rules run before hooks, so they win on conflicts
+	webhooktest.AssertAttributes(t, tp.get("builds"), map[string]string{"team": "payments", "severity": "failed"})
+}
+
+func TestNewExpressions(t *testing.T) {
+	reg := webhooktest.NewRegistry(t)
+	cfg := testConfig()
+	cfg.GCP.Routes = []config.RouteConfig{
+		{Name: "failures", TopicID: "failures", Expression: "build.state == 'failed' && build.branch == 'main'"},
+	}
+	cfg.GCP.AttributeRules = []config.AttributeRuleConfig{
+		{Attribute: "team", ValueExpression: "build.pipeline.split('-')[0]"},
+	}
+	cfg.Webhook.Paths = []config.WebhookPathConfig{
+		{Path: "/webhook/lost", TopicID: "lost", Expression: "event_type == 'agent.lost'"},
+	}
+	tp := &topics{}
+	svc, err := app.New(context.Background(), cfg, app.Options{NewPublisher: tp.newPublisher})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer svc.Close()
+
+	for _, branch := range []string{"main", "feature"} {
+		body := webhooktest.Payload("build.finished", webhooktest.WithPipeline("payments-api"), webhooktest.WithBuildState("failed"), webhooktest.WithBranch(branch))
+		if rr := webhooktest.Serve(svc.Handler, webhooktest.NewTokenRequest("/webhook", "test-token", body)); rr.Code != http.StatusOK {
+			t.Fatalf("POST /webhook status = %d: %s", rr.Code, rr.Body)
+		}
+	}
+	webhooktest.AssertPublishedCount(t, tp.get("failures"), 1)
+	webhooktest.AssertPublishedCount(t, tp.get("builds"), 1)
+	webhooktest.AssertAttributes(t, tp.get("builds"), map[string]string{"team": "payments"})
+	webhooktest.AssertCounter(t, reg, "buildkite_expression_evaluations_total", map[string]string{"rule": "routes[failures]", "result": "matched"}, 1)
+
+	for _, event := range []string{"agent.connected", "agent.lost"} {
+		if rr := webhooktest.Serve(svc.Handler, webhooktest.NewTokenRequest("/webhook/lost", "test-token", webhooktest.Payload(event))); rr.Code != http.StatusOK {
+			t.Fatalf("POST /webhook/lost status = %d: %s", rr.Code, rr.Body)
+		}
+	}
+	webhooktest.AssertPublished(t, tp.get("lost"), "agent.lost")
+	webhooktest.AssertPublishedCount(t, tp.get("lost"), 1)
+
+	cfg.GCP.Routes[0].Expression = "build.state =="
+	if _, err := app.New(context.Background(), cfg, app.Options{NewPublisher: tp.newPublisher}); err == nil {
+		t.Error("New() with an invalid route expression error = nil, want error")
+	}
+}
+
+func TestNewHeartbeats(t *testing.T) {
+	webhooktest.NewRegistry(t)
+	cfg := testConfig()
+	cfg.Heartbeat.Interval = time.Hour
+	cfg.Heartbeat.InstanceID = "webhook-1"
+	tp := &topics{}
+	svc, err := app.New(context.Background(), cfg, app.Options{NewPublisher: tp.newPublisher})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer svc.Close()
+
+	// The first heartbeat is sent straight away
+	deadline := time.Now().Add(2 * time.Second)
+	for len(tp.get("builds").GetPublished()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no heartbeat published")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	webhooktest.AssertAttributes(t, tp.get("builds"), map[string]string{
+		"event_type": subscriber.HeartbeatEventType,
+		"instance":   "webhook-1",
+		"sequence":   "1",
+	})
+}
+
+// lagSource reports a fixed backlog for every subscription
+type lagSource struct{}
+
+func (lagSource) Backlogs(_ context.Context, subscriptions []string) (map[string]lag.Backlog, error) {
+	backlogs := make(map[string]lag.Backlog, len(subscriptions))
+	for _, sub := range subscriptions {
+		backlogs[sub] = lag.Backlog{Undelivered: 5, OldestUnackedAge: time.Minute}
+	}
+	return backlogs, nil
+}
+
+func TestNewSubscriptionLag(t *testing.T) {
+	webhooktest.NewRegistry(t)
+	cfg := testConfig()
+	cfg.SubscriptionLag.Subscriptions = []string{"builds-consumer"}
+	tp := &topics{}
+	svc, err := app.New(context.Background(), cfg, app.Options{
+		NewPublisher: tp.newPublisher,
+		NewLagSource: func(context.Context, string) (lag.Source, error) { return lagSource{}, nil },
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer svc.Close()
+
+	// The first check runs straight away and is served in /stats
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		samples := svc.Stats.Snapshot().Subscriptions
+		if len(samples) == 1 && samples[0].Undelivered == 5 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("/stats subscriptions = %+v, want the builds-consumer backlog", samples)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// confirmSource confirms the mock publisher's message ID until it is
+// closed
+type confirmSource struct {
+	id     string
+	closed atomic.Bool
+}
+
+func (s *confirmSource) Receive(ctx context.Context, confirm func(string)) error {
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			confirm("mock-message-id")
+		}
+	}
+}
+
+func (s *confirmSource) Close() error {
+	s.closed.Store(true)
+	return nil
+}
+
+func TestNewConfirmation(t *testing.T) {
+	webhooktest.NewRegistry(t)
+	cfg := testConfig()
+	cfg.Confirmation.Pipelines = []string{"deploy-*"}
+	cfg.Confirmation.TopicID = "feedback"
+	cfg.Confirmation.Timeout = time.Second
+	tp := &topics{}
+	source := &confirmSource{}
+	svc, err := app.New(context.Background(), cfg, app.Options{
+		NewPublisher: tp.newPublisher,
+		NewConfirmationSource: func(_ context.Context, _, topicID, id string) (confirmation.Source, error) {
+			if topicID != "feedback" {
+				t.Errorf("confirmation topic = %q, want feedback", topicID)
+			}
+			source.id = id
+			return source, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	body := webhooktest.Payload("build.finished", webhooktest.WithPipeline("deploy-production"))
+	rr := webhooktest.Serve(svc.Handler, webhooktest.NewTokenRequest("/webhook", "test-token", body))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"confirmed":true`) {
+		t.Fatalf("POST /webhook = %d: %s, want a confirmed message", rr.Code, rr.Body)
+	}
+	webhooktest.AssertAttributes(t, tp.get("builds"), map[string]string{subscriber.ConfirmAttribute: source.id})
+
+	svc.Close()
+	if !source.closed.Load() {
+		t.Error("confirmation source not closed")
+	}
+}
+
+func TestNewChecksum(t *testing.T) {
+	for algorithm, want := range map[string]string{"": "sha256:", config.ChecksumSHA512: "sha512:", config.ChecksumNone: ""} {
+		webhooktest.NewRegistry(t)
+		cfg := testConfig()
+		cfg.Webhook.ChecksumAlgorithm = algorithm
+		tp := &topics{}
+		svc, err := app.New(context.Background(), cfg, app.Options{NewPublisher: tp.newPublisher})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+
+		body := webhooktest.Payload("build.finished")
+		if rr := webhooktest.Serve(svc.Handler, webhooktest.NewTokenRequest("/webhook", "test-token", body)); rr.Code != http.StatusOK {
+			t.Fatalf("POST /webhook status = %d: %s", rr.Code, rr.Body)
+		}
+		got := tp.get("builds").LastPublished().Attributes[subscriber.ChecksumAttribute]
+		if !strings.HasPrefix(got, want) || (want == "") != (got == "") {
+			t.Errorf("checksum with algorithm %q = %q, want prefix %q", algorithm, got, want)
+		}
+		svc.Close()
+	}
+}
+
+func TestNewRejections(t *testing.T) {
+	reg := webhooktest.NewRegistry(t)
+	cfg := testConfig()
+	cfg.Rejections.SampleRate = 1
+	cfg.Rejections.TopicID = "rejections"
+	tp := &topics{}
+	svc, err := app.New(context.Background(), cfg, app.Options{NewPublisher: tp.newPublisher})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer svc.Close()
+
+	body := webhooktest.Payload("build.finished")
+	if rr := webhooktest.Serve(svc.Handler, webhooktest.NewTokenRequest("/webhook", "wrong-token", body)); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("POST /webhook with a wrong token status = %d, want %d", rr.Code, http.StatusUnauthorized)
+	}
+	webhooktest.AssertAttributes(t, tp.get("rejections"), map[string]string{
+		"event_type": "rejection",
+		"reason":     "auth_failure",
+		"status":     "401",
+	})
+	webhooktest.AssertCounter(t, reg, "buildkite_rejection_samples_total", map[string]string{"reason": "auth_failure", "status": "success"}, 1)
+	if got := len(tp.get("builds").GetPublished()); got != 0 {
+		t.Errorf("published %d events for a rejected request, want 0", got)
+	}
+}
+
+func TestNewOwnership(t *testing.T) {
+	reg := webhooktest.NewRegistry(t)
+	cfg := testConfig()
+	cfg.Ownership.File = filepath.Join(t.TempDir(), "owners.yaml")
+	tp := &topics{}
+	if _, err := app.New(context.Background(), cfg, app.Options{NewPublisher: tp.newPublisher}); err == nil {
+		t.Error("New() with a missing ownership file error = nil, want error")
+	}
+
+	if err := os.WriteFile(cfg.Ownership.File, []byte("- team: payments\n  pipelines: [\"payments-*\"]\n"), 0o600); err != nil {
+		t.Fatalf("failed to write ownership file: %v", err)
+	}
+	svc, err := app.New(context.Background(), cfg, app.Options{NewPublisher: tp.newPublisher})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer svc.Close()
+
+	body := webhooktest.Payload("build.finished", webhooktest.WithPipeline("payments-api"))
+	if rr := webhooktest.Serve(svc.Handler, webhooktest.NewTokenRequest("/webhook", "test-token", body)); rr.Code != http.StatusOK {
+		t.Fatalf("POST /webhook status = %d: %s", rr.Code, rr.Body)
+	}
+	webhooktest.AssertAttributes(t, tp.get("builds"), map[string]string{"team": "payments"})
+	webhooktest.AssertCounter(t, reg, "buildkite_builds_total", map[string]string{"team": "payments"}, 1)
+}
+
+func TestNewCORS(t *testing.T) {
+	webhooktest.NewRegistry(t)
+	cfg := testConfig()
+	cfg.Security.CORSAllowedOrigins = []string{"https://console.example.com"}
+	tp := &topics{}
+	svc, err := app.New(context.Background(), cfg, app.Options{NewPublisher: tp.newPublisher})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer svc.Close()
+
+	req := httptest.NewRequest(http.MethodOptions, "/webhook", nil)
+	req.Header.Set("Origin", "https://console.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	rr := webhooktest.Serve(svc.Handler, req)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("preflight status = %d, want %d", rr.Code, http.StatusNoContent)
+	}
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "https://console.example.com" {
+		t.Errorf("Access-Control-Allow-Origin = %q", got)
+	}
+
+	rr = webhooktest.Serve(svc.Handler, httptest.NewRequest(http.MethodHead, "/webhook", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("HEAD status = %d, want %d", rr.Code, http.StatusOK)
+	}
+}
+
+func TestMetricsOptions(t *testing.T) {
+	cfg := testConfig()
+	cfg.Metrics.DropLabels = []string{"pipeline"}
+	cfg.Metrics.RelabelRules = []config.RelabelRule{{Label: "branch", Match: "feature/*", Replacement: "feature"}}
+	reg := prometheus.NewRegistry()
+	if err := metrics.InitMetrics(reg, app.MetricsOptions(cfg.Metrics)...); err != nil {
+		t.Fatalf("InitMetrics() error = %v", err)
+	}
+
+	svc, err := app.New(context.Background(), cfg, app.Options{NewPublisher: (&topics{}).newPublisher})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer svc.Close()
+
+	for _, branch := range []string{"feature/login", "feature/signup"} {
+		body := webhooktest.Payload("build.finished", webhooktest.WithBranch(branch), webhooktest.WithBuildState("passed"))
+		if rr := webhooktest.Serve(svc.Handler, webhooktest.NewTokenRequest("/webhook", "test-token", body)); rr.Code != http.StatusOK {
+			t.Fatalf("POST /webhook status = %d: %s", rr.Code, rr.Body)
+		}
+	}
+	webhooktest.AssertCounter(t, reg, "buildkite_builds_total", map[string]string{"state": "passed", "branch": "feature"}, 2)
+}
+
+func TestPublishSettings(t *testing.T) {
+	cfg := config.DefaultConfig()
+	settings := app.PublishSettings(cfg.GCP)
+	if settings.CountThreshold != 100 || settings.DelayThreshold != 10*time.Millisecond || !settings.EnableCompression ||
+		settings.FlowControlSettings.MaxOutstandingBytes != 100e6 || settings.FlowControlSettings.LimitExceededBehavior != pubsub.FlowControlBlock {
+		t.Errorf("default settings = %+v", settings)
+	}
+
+	disabled := false
+	cfg.GCP.PubSubBatchSize = 500
+	cfg.GCP.PubSubDelayThreshold = 50 * time.Millisecond
+	cfg.GCP.PubSubMaxOutstandingMessages = 5000
+	cfg.GCP.PubSubCompression = &disabled
+	settings = app.PublishSettings(cfg.GCP)
+	if settings.CountThreshold != 500 || settings.DelayThreshold != 50*time.Millisecond ||
+		settings.FlowControlSettings.MaxOutstandingMessages != 5000 || settings.EnableCompression {
+		t.Errorf("settings = %+v, want the configured values", settings)
+	}
+
+	// Unset values keep the client's defaults
+	settings = app.PublishSettings(config.GCPConfig{})
+	if settings.ByteThreshold != pubsub.DefaultPublishSettings.ByteThreshold || settings.EnableCompression {
+		t.Errorf("settings = %+v, want the client defaults", settings)
+	}
+}
+
+func TestChain(t *testing.T) {
+	executionOrder := []string{}
+
+	middleware1 := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			executionOrder = append(executionOrder, "middleware1_before")
+			next.ServeHTTP(w, r)
+			executionOrder = append(executionOrder, "middleware1_after")
+		})
+	}
+
+	middleware2 := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			executionOrder = append(executionOrder, "middleware2_before")
+			next.ServeHTTP(w, r)
+			executionOrder = append(executionOrder, "middleware2_after")
+		})
+	}
+
+	finalHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		executionOrder = append(executionOrder, "handler")
+	})
+
+	handler := app.Chain(finalHandler, middleware1, middleware2)
+
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	// Check execution order
+	expected := []string{
+		"middleware1_before",
+		"middleware2_before",
+		"handler",
+		"middleware2_after",
+		"middleware1_after",
+	}
+
+	if !reflect.DeepEqual(executionOrder, expected) {
+		t.Errorf("middleware execution order = %v, want %v", executionOrder, expected)
+	}
+}
@@ -0,0 +1,208 @@
+// Package audit keeps a local index of publish outcomes so operators can
+// check whether an event or build was published without searching logs or
+// the topic
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite" // registers the pure Go "sqlite" driver
+)
+
+// Publish outcomes
+const (
+	OutcomePublished    = "published"
+	OutcomeFailed       = "failed"
+	OutcomeDeadLettered = "dead_lettered"
+)
+
+const (
+	// defaultQueryLimit caps results when a query sets no limit
+	defaultQueryLimit = 100
+	// maxQueryLimit caps results for any query
+	maxQueryLimit = 1000
+	// pruneInterval is how often records older than the retention are deleted
+	pruneInterval = time.Hour
+)
+
+// Record is the outcome of publishing one webhook event
+type Record struct {
+	// EventID is the Buildkite delivery UUID, or a hash of the payload when
+	// Buildkite did not send one
+	EventID     string    `json:"event_id"`
+	MessageID   string    `json:"message_id,omitempty"`
+	EventType   string    `json:"event_type"`
+	BuildID     string    `json:"build_id,omitempty"`
+	Pipeline    string    `json:"pipeline,omitempty"`
+	Outcome     string    `json:"outcome"`
+	Error       string    `json:"error,omitempty"`
+	PublishedAt time.Time `json:"published_at"`
+}
+
+// Query selects records; empty fields match every record. Results are
+// newest first.
+type Query struct {
+	EventID string
+	BuildID string
+	Since   time.Time
+	// Limit defaults to 100 and is capped at 1000
+	Limit int
+}
+
+// Store records publish outcomes and answers queries about them
+type Store interface {
+	Record(ctx context.Context, record Record) error
+	Query(ctx context.Context, query Query) ([]Record, error)
+}
+
+const schema = `
+CREATE TABLE IF NOT EXISTS events (
+	id           INTEGER PRIMARY KEY AUTOINCREMENT,
+	event_id     TEXT NOT NULL,
+	message_id   TEXT NOT NULL DEFAULT '',
+	event_type   TEXT NOT NULL DEFAULT '',
+	build_id     TEXT NOT NULL DEFAULT '',
+	pipeline     TEXT NOT NULL DEFAULT '',
+	outcome      TEXT NOT NULL,
+	error        TEXT NOT NULL DEFAULT '',
+	published_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS events_event_id ON events (event_id);
+CREATE INDEX IF NOT EXISTS events_build_id ON events (build_id);
+CREATE INDEX IF NOT EXISTS events_published_at ON events (published_at);
+`
+
+// SQLiteStore is a Store in an embedded SQLite database that keeps records
+// for the retention period
+type SQLiteStore struct {
+	db        *sql.DB
+	retention time.Duration
+
+	mu        sync.Mutex
+	lastPrune time.Time
+}
+
+// NewSQLiteStore opens or creates the database at path, deleting records
+// older than retention
+func NewSQLiteStore(path string, retention time.Duration) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit database: %w", err)
+	}
+	// SQLite allows a single writer; serialise access rather than retry on SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(schema); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to create audit schema: %w", err)
+	}
+
+	s := &SQLiteStore{db: db, retention: retention}
+	if err := s.prune(context.Background(), time.Now()); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Record implements Store, pruning expired records at most once an hour
+func (s *SQLiteStore) Record(ctx context.Context, record Record) error {
+	if record.PublishedAt.IsZero() {
+		record.PublishedAt = time.Now()
+	}
+
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO events (event_id, message_id, event_type, build_id, pipeline, outcome, error, published_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		record.EventID, record.MessageID, record.EventType, record.BuildID, record.Pipeline,
+		record.Outcome, record.Error, record.PublishedAt.UnixNano(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to write audit record: %w", err)
+	}
+
+	s.mu.Lock()
+	due := time.Since(s.lastPrune) > pruneInterval
+	s.mu.Unlock()
+	if due {
+		return s.prune(ctx, time.Now())
+	}
+	return nil
+}
+
+// Query implements Store
+func (s *SQLiteStore) Query(ctx context.Context, query Query) ([]Record, error) {
+	var where []string
+	var args []interface{}
+	if query.EventID != "" {
+		where = append(where, "event_id = ?")
+		args = append(args, query.EventID)
+	}
+	if query.BuildID != "" {
+		where = append(where, "build_id = ?")
+		args = append(args, query.BuildID)
+	}
+	if !query.Since.IsZero() {
+		where = append(where, "published_at >= ?")
+		args = append(args, query.Since.UnixNano())
+	}
+
+	limit := query.Limit
+	if limit <= 0 {
+		limit = defaultQueryLimit
+	}
+	if limit > maxQueryLimit {
+		limit = maxQueryLimit
+	}
+
+	stmt := "SELECT event_id, message_id, event_type, build_id, pipeline, outcome, error, published_at FROM events"
+	if len(where) > 0 {
+		stmt += " WHERE " + strings.Join(where, " AND ")
+	}
+	stmt += " ORDER BY published_at DESC, id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := s.db.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit records: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	records := []Record{}
+	for rows.Next() {
+		var r Record
+		var publishedAt int64
+		if err := rows.Scan(&r.EventID, &r.MessageID, &r.EventType, &r.BuildID, &r.Pipeline, &r.Outcome, &r.Error, &publishedAt); err != nil {
+			return nil, fmt.Errorf("failed to read audit record: %w", err)
+		}
+		r.PublishedAt = time.Unix(0, publishedAt).UTC()
+		records = append(records, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit records: %w", err)
+	}
+	return records, nil
+}
+
+// prune deletes records older than the retention period
+func (s *SQLiteStore) prune(ctx context.Context, now time.Time) error {
+	s.mu.Lock()
+	s.lastPrune = now
+	s.mu.Unlock()
+
+	cutoff := now.Add(-s.retention).UnixNano()
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM events WHERE published_at < ?", cutoff); err != nil {
+		return fmt.Errorf("failed to prune audit records: %w", err)
+	}
+	return nil
+}
+
+// Close closes the database
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
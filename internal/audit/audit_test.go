@@ -0,0 +1,101 @@
+package audit
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T, path string, retention time.Duration) *SQLiteStore {
+	t.Helper()
+	store, err := NewSQLiteStore(path, retention)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore() error = %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	return store
+}
+
+func TestSQLiteStoreRecordAndQuery(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t, filepath.Join(t.TempDir(), "audit.db"), 24*time.Hour)
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	records := []Record{
+		{EventID: "evt-1", EventType: "build.started", BuildID: "build-1", Outcome: OutcomeFailed, Error: "timeout", PublishedAt: now.Add(-2 * time.Minute)},
+		{EventID: "evt-1", MessageID: "msg-1", EventType: "build.started", BuildID: "build-1", Outcome: OutcomePublished, PublishedAt: now.Add(-time.Minute)},
+		{EventID: "evt-2", MessageID: "msg-2", EventType: "build.finished", BuildID: "build-1", Pipeline: "deploy", Outcome: OutcomePublished, PublishedAt: now},
+		{EventID: "evt-3", MessageID: "msg-3", EventType: "build.finished", BuildID: "build-2", Outcome: OutcomePublished, PublishedAt: now},
+	}
+	for _, r := range records {
+		if err := store.Record(ctx, r); err != nil {
+			t.Fatalf("Record() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query Query
+		want  []string // message IDs, newest first
+	}{
+		{name: "by event", query: Query{EventID: "evt-1"}, want: []string{"msg-1", ""}},
+		{name: "by build", query: Query{BuildID: "build-1"}, want: []string{"msg-2", "msg-1", ""}},
+		{name: "since", query: Query{BuildID: "build-1", Since: now.Add(-90 * time.Second)}, want: []string{"msg-2", "msg-1"}},
+		{name: "limit", query: Query{Limit: 1, BuildID: "build-2"}, want: []string{"msg-3"}},
+		{name: "no match", query: Query{EventID: "missing"}, want: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := store.Query(ctx, tt.query)
+			if err != nil {
+				t.Fatalf("Query() error = %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Query() returned %d records, want %d: %+v", len(got), len(tt.want), got)
+			}
+			for i, r := range got {
+				if r.MessageID != tt.want[i] {
+					t.Errorf("record %d message_id = %q, want %q", i, r.MessageID, tt.want[i])
+				}
+			}
+		})
+	}
+
+	got, err := store.Query(ctx, Query{EventID: "evt-2"})
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	if want := records[2]; got[0] != want {
+		t.Errorf("Query() = %+v, want %+v", got[0], want)
+	}
+}
+
+func TestSQLiteStorePrunesExpiredRecords(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.db")
+
+	store, err := NewSQLiteStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore() error = %v", err)
+	}
+	old := Record{EventID: "old", Outcome: OutcomePublished, PublishedAt: time.Now().Add(-2 * time.Hour)}
+	recent := Record{EventID: "recent", Outcome: OutcomePublished, PublishedAt: time.Now()}
+	for _, r := range []Record{old, recent} {
+		if err := store.Record(ctx, r); err != nil {
+			t.Fatalf("Record() error = %v", err)
+		}
+	}
+	_ = store.Close()
+
+	// Reopening prunes records older than the retention
+	store = newTestStore(t, path, time.Hour)
+	got, err := store.Query(ctx, Query{})
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	if len(got) != 1 || got[0].EventID != "recent" {
+		t.Errorf("Query() after reopen = %+v, want only the recent record", got)
+	}
+}
@@ -0,0 +1,103 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+)
+
+const (
+	// DefaultQueueSize is how many records a Writer holds before dropping
+	// new ones
+	DefaultQueueSize = 1024
+	// writeTimeout bounds each background write
+	writeTimeout = time.Second
+)
+
+var (
+	// ErrQueueFull is returned by Writer.Record when the record was dropped
+	// because the queue is full
+	ErrQueueFull = errors.New("audit queue is full")
+	// ErrWriterClosed is returned by Writer.Record after Close
+	ErrWriterClosed = errors.New("audit writer is closed")
+)
+
+// Writer is a Store that writes records to another Store in the
+// background, keeping slow writes off the request path. Records arriving
+// while its queue is full are dropped and counted rather than waited for.
+// Queries go straight to the underlying Store.
+type Writer struct {
+	store   Store
+	records chan Record
+	done    chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewWriter starts writing records to store, queueing up to size of them
+func NewWriter(store Store, size int) *Writer {
+	w := &Writer{
+		store:   store,
+		records: make(chan Record, max(size, 1)),
+		done:    make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Record implements Store, queueing the record without waiting for it to
+// be written
+func (w *Writer) Record(ctx context.Context, record Record) error {
+	if record.PublishedAt.IsZero() {
+		record.PublishedAt = time.Now()
+	}
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return ErrWriterClosed
+	}
+	select {
+	case w.records <- record:
+		metrics.AuditQueueDepth.Set(float64(len(w.records)))
+		return nil
+	default:
+		metrics.AuditRecordsDroppedTotal.Inc()
+		return ErrQueueFull
+	}
+}
+
+// Query implements Store
+func (w *Writer) Query(ctx context.Context, query Query) ([]Record, error) {
+	return w.store.Query(ctx, query)
+}
+
+// Close stops accepting records and waits for the queued ones to be
+// written. It must be called before closing the underlying Store.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.records)
+	}
+	w.mu.Unlock()
+	<-w.done
+	return nil
+}
+
+// run writes queued records until the queue is closed and drained
+func (w *Writer) run() {
+	defer close(w.done)
+	for record := range w.records {
+		metrics.AuditQueueDepth.Set(float64(len(w.records)))
+		ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+		if err := w.store.Record(ctx, record); err != nil {
+			metrics.ErrorsTotal.WithLabelValues("audit_write_error").Inc()
+		}
+		cancel()
+	}
+}
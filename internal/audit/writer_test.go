@@ -0,0 +1,73 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// blockingStore holds each write until it is released
+type blockingStore struct {
+	Store
+	release chan struct{}
+}
+
+func (b *blockingStore) Record(ctx context.Context, record Record) error {
+	<-b.release
+	return b.Store.Record(ctx, record)
+}
+
+func TestWriter(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+	ctx := context.Background()
+	store := &blockingStore{
+		Store:   newTestStore(t, filepath.Join(t.TempDir(), "audit.db"), 24*time.Hour),
+		release: make(chan struct{}),
+	}
+	writer := NewWriter(store, 2)
+
+	// The first record is taken off the queue and blocks in the store, the
+	// next two fill the queue and the last is dropped
+	if err := writer.Record(ctx, Record{EventID: "evt-1", Outcome: OutcomePublished}); err != nil {
+		t.Fatalf("Record() error = %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(writer.records) != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	for _, id := range []string{"evt-2", "evt-3"} {
+		if err := writer.Record(ctx, Record{EventID: id, Outcome: OutcomePublished}); err != nil {
+			t.Fatalf("Record(%s) error = %v", id, err)
+		}
+	}
+	if err := writer.Record(ctx, Record{EventID: "evt-4", Outcome: OutcomePublished}); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("Record() on a full queue error = %v, want ErrQueueFull", err)
+	}
+	if got := testutil.ToFloat64(metrics.AuditRecordsDroppedTotal); got != 1 {
+		t.Errorf("dropped records = %v, want 1", got)
+	}
+
+	// Close writes the queued records
+	close(store.release)
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	records, err := writer.Query(ctx, Query{})
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	if len(records) != 3 {
+		t.Errorf("Query() returned %d records, want 3: %+v", len(records), records)
+	}
+	if err := writer.Record(ctx, Record{EventID: "evt-5", Outcome: OutcomePublished}); !errors.Is(err, ErrWriterClosed) {
+		t.Errorf("Record() after Close error = %v, want ErrWriterClosed", err)
+	}
+}
@@ -0,0 +1,16 @@
+package buildkite
+
+import "github.com/mcncl/buildkite-pubsub/pkg/buildkiteauth"
+
+// Headers sent by Buildkite on webhook deliveries
+const (
+	// EventHeader carries the event type, e.g. "build.finished"
+	EventHeader = "X-Buildkite-Event"
+	// TokenHeader carries the webhook token when token auth is configured
+	TokenHeader = buildkiteauth.TokenHeader
+	// SignatureHeader carries "timestamp=...,signature=..." when HMAC signing is configured
+	SignatureHeader = buildkiteauth.SignatureHeader
+	// DeliveryIDHeader carries the UUID Buildkite assigns to a webhook delivery.
+	// It stays the same when Buildkite retries the delivery.
+	DeliveryIDHeader = "X-Buildkite-Delivery-Id"
+)
@@ -0,0 +1,287 @@
+package buildkite
+
+import (
+	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/jsoncodec"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+)
+
+// Schema drift kinds
+const (
+	DriftUnknownField = "unknown"
+	DriftMissingField = "missing"
+)
+
+// DriftOtherField is the field label of drifts beyond maxDriftSeries
+const DriftOtherField = "other"
+
+// defaultDriftLogInterval limits how often the same drift is logged
+const defaultDriftLogInterval = time.Hour
+
+// maxDriftSeries caps the distinct drifts counted and logged by their own
+// field, since unknown fields come from whatever keys a payload has. Later
+// drifts are counted and rate limited as DriftOtherField.
+const maxDriftSeries = 500
+
+// requiredFields lists fields that must be present, keyed by event type
+// prefix. Fields not listed here may legitimately be absent.
+var requiredFields = map[string][]string{
+	"":       {"event"},
+	"build.": {"build.id", "build.number", "build.state", "pipeline.slug"},
+	"agent.": {"agent.id", "agent.connection_state"},
+}
+
+// documentedFields are fields Buildkite documents for webhook payloads that
+// Payload does not decode. They are known, so they are not reported.
+var documentedFields = []string{
+	"build.author",
+	"build.cancel_reason",
+	"build.env",
+	"build.jobs",
+	"build.pipeline",
+	"build.pull_request",
+	"job.agent",
+	"job.agent_query_rules",
+	"job.artifact_paths",
+	"job.artifacts_url",
+	"job.build_url",
+	"job.cluster_id",
+	"job.cluster_queue_id",
+	"job.cluster_queue_url",
+	"job.cluster_url",
+	"job.command",
+	"job.created_at",
+	"job.env",
+	"job.expired_at",
+	"job.log_url",
+	"job.matrix",
+	"job.parallel_group_index",
+	"job.parallel_group_total",
+	"job.priority",
+	"job.raw_log_url",
+	"job.retried",
+	"job.retried_in_job_id",
+	"job.retries_count",
+	"job.retry_source",
+	"job.retry_type",
+	"job.runnable_at",
+	"job.scheduled_at",
+	"job.signature",
+	"job.soft_failed",
+	"job.triggered_build",
+	"pipeline.allow_rebuilds",
+	"pipeline.archived_at",
+	"pipeline.badge_url",
+	"pipeline.branch_configuration",
+	"pipeline.builds_url",
+	"pipeline.cancel_running_branch_builds",
+	"pipeline.cancel_running_branch_builds_filter",
+	"pipeline.cluster_id",
+	"pipeline.color",
+	"pipeline.configuration",
+	"pipeline.created_by",
+	"pipeline.default_branch",
+	"pipeline.emoji",
+	"pipeline.env",
+	"pipeline.running_builds_count",
+	"pipeline.running_jobs_count",
+	"pipeline.scheduled_builds_count",
+	"pipeline.scheduled_jobs_count",
+	"pipeline.skip_queued_branch_builds",
+	"pipeline.skip_queued_branch_builds_filter",
+	"pipeline.steps",
+	"pipeline.tags",
+	"pipeline.visibility",
+	"pipeline.waiting_jobs_count",
+}
+
+// knownFields holds the dotted paths of every field Payload decodes plus the
+// documented fields. Paths to nested structs map to true so the detector
+// descends into them.
+var knownFields = func() map[string]bool {
+	fields := make(map[string]bool)
+	collectFields(reflect.TypeOf(Payload{}), "", fields)
+	for _, field := range documentedFields {
+		fields[field] = false
+	}
+	return fields
+}()
+
+// collectFields records the JSON field paths of t under prefix
+func collectFields(t reflect.Type, prefix string, fields map[string]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		path := prefix + name
+
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		// Free-form maps and time values are leaves
+		nested := ft.Kind() == reflect.Struct && ft != reflect.TypeOf(time.Time{})
+		fields[path] = nested
+		if nested {
+			collectFields(ft, path+".", fields)
+		}
+	}
+}
+
+// SchemaDrift describes one difference between a payload and the known schema
+type SchemaDrift struct {
+	Kind  string
+	Field string
+}
+
+// SchemaDriftDetector compares incoming payloads with the fields Payload
+// knows about, so Buildkite API changes are noticed before consumers break
+type SchemaDriftDetector struct {
+	logger   *slog.Logger
+	interval time.Duration
+
+	mu sync.Mutex
+	// lastLogged is keyed by event type, kind and field label, so it holds
+	// at most maxDriftSeries keys plus one other key per event type and kind
+	lastLogged map[string]time.Time
+}
+
+// NewSchemaDriftDetector creates a detector that logs each drift at most once
+// per interval per event type; zero uses one hour
+func NewSchemaDriftDetector(logger *slog.Logger, interval time.Duration) *SchemaDriftDetector {
+	if interval <= 0 {
+		interval = defaultDriftLogInterval
+	}
+	return &SchemaDriftDetector{
+		logger:     logger,
+		interval:   interval,
+		lastLogged: make(map[string]time.Time),
+	}
+}
+
+// Check reports unknown and missing fields in body, counts every drift in
+// metrics and logs drift not already logged within the interval
+func (d *SchemaDriftDetector) Check(eventType string, body []byte) []SchemaDrift {
+	var raw map[string]interface{}
+	if err := jsoncodec.Unmarshal(body, &raw); err != nil {
+		return nil
+	}
+
+	drifts := DetectSchemaDrift(eventType, raw)
+	if len(drifts) == 0 {
+		return nil
+	}
+
+	// Metric labels must be valid UTF-8; replace invalid bytes as the JSON
+	// decoder does for the event type in a payload
+	eventType = strings.ToValidUTF8(eventType, "\uFFFD")
+
+	fields, due := d.track(eventType, drifts)
+	for i, drift := range drifts {
+		metrics.SchemaDriftTotal.WithLabelValues(eventType, drift.Kind, fields[i]).Inc()
+	}
+
+	if len(due) > 0 {
+		var unknown, missing []string
+		for _, drift := range due {
+			if drift.Kind == DriftUnknownField {
+				unknown = append(unknown, drift.Field)
+			} else {
+				missing = append(missing, drift.Field)
+			}
+		}
+		d.logger.Warn("Payload schema drift detected",
+			"event_type", eventType,
+			"unknown_fields", unknown,
+			"missing_fields", missing,
+		)
+	}
+
+	return drifts
+}
+
+// track returns the field label of each drift, and the drifts not logged
+// within the interval, marking them logged
+func (d *SchemaDriftDetector) track(eventType string, drifts []SchemaDrift) (fields []string, due []SchemaDrift) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	fields = make([]string, len(drifts))
+	for i, drift := range drifts {
+		key := eventType + "|" + drift.Kind + "|" + drift.Field
+		fields[i] = drift.Field
+		if _, ok := d.lastLogged[key]; !ok && len(d.lastLogged) >= maxDriftSeries {
+			key = eventType + "|" + drift.Kind + "|" + DriftOtherField
+			fields[i] = DriftOtherField
+		}
+		if last, ok := d.lastLogged[key]; ok && now.Sub(last) < d.interval {
+			continue
+		}
+		d.lastLogged[key] = now
+		due = append(due, drift)
+	}
+	return fields, due
+}
+
+// DetectSchemaDrift compares a decoded payload with the known schema and the
+// fields required for its event type. Results are sorted by field.
+func DetectSchemaDrift(eventType string, raw map[string]interface{}) []SchemaDrift {
+	var drifts []SchemaDrift
+	findUnknownFields(raw, "", &drifts)
+
+	for prefix, fields := range requiredFields {
+		if !strings.HasPrefix(eventType, prefix) {
+			continue
+		}
+		for _, field := range fields {
+			if lookupField(raw, field) == nil {
+				drifts = append(drifts, SchemaDrift{Kind: DriftMissingField, Field: field})
+			}
+		}
+	}
+
+	sort.Slice(drifts, func(i, j int) bool {
+		if drifts[i].Field != drifts[j].Field {
+			return drifts[i].Field < drifts[j].Field
+		}
+		return drifts[i].Kind < drifts[j].Kind
+	})
+	return drifts
+}
+
+// findUnknownFields walks obj and records keys missing from knownFields
+func findUnknownFields(obj map[string]interface{}, prefix string, drifts *[]SchemaDrift) {
+	for key, value := range obj {
+		path := prefix + key
+		nested, known := knownFields[path]
+		if !known {
+			*drifts = append(*drifts, SchemaDrift{Kind: DriftUnknownField, Field: path})
+			continue
+		}
+		if child, ok := value.(map[string]interface{}); ok && nested {
+			findUnknownFields(child, path+".", drifts)
+		}
+	}
+}
+
+// lookupField returns the value at a dotted path, or nil when absent or null
+func lookupField(obj map[string]interface{}, path string) interface{} {
+	var current interface{} = obj
+	for _, part := range strings.Split(path, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current = m[part]
+	}
+	return current
+}
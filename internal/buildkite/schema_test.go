@@ -0,0 +1,194 @@
+package buildkite
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDetectSchemaDrift(t *testing.T) {
+	tests := []struct {
+		name      string
+		eventType string
+		payload   map[string]interface{}
+		want      []SchemaDrift
+	}{
+		{
+			name:      "known fields only",
+			eventType: "build.finished",
+			payload: map[string]interface{}{
+				"event": "build.finished",
+				"build": map[string]interface{}{
+					"id": "1", "number": 1.0, "state": "passed",
+					"meta_data":    map[string]interface{}{"anything": "goes"},
+					"author":       map[string]interface{}{"name": "documented"},
+					"creator":      map[string]interface{}{"id": "u1"},
+					"scheduled_at": nil,
+				},
+				"pipeline": map[string]interface{}{
+					"slug":     "p",
+					"provider": map[string]interface{}{"id": "github", "settings": map[string]interface{}{"x": 1.0}},
+				},
+			},
+		},
+		{
+			name:      "unknown nested and top-level fields",
+			eventType: "build.finished",
+			payload: map[string]interface{}{
+				"event":   "build.finished",
+				"webhook": map[string]interface{}{"id": "w"},
+				"build": map[string]interface{}{
+					"id": "1", "number": 1.0, "state": "passed",
+					"creator":     map[string]interface{}{"id": "u1", "pronouns": "they/them"},
+					"new_setting": true,
+				},
+				"pipeline": map[string]interface{}{"slug": "p"},
+			},
+			want: []SchemaDrift{
+				{Kind: DriftUnknownField, Field: "build.creator.pronouns"},
+				{Kind: DriftUnknownField, Field: "build.new_setting"},
+				{Kind: DriftUnknownField, Field: "webhook"},
+			},
+		},
+		{
+			name:      "missing required build fields",
+			eventType: "build.started",
+			payload: map[string]interface{}{
+				"event": "build.started",
+				"build": map[string]interface{}{"id": "1", "number": 1.0, "state": nil},
+			},
+			want: []SchemaDrift{
+				{Kind: DriftMissingField, Field: "build.state"},
+				{Kind: DriftMissingField, Field: "pipeline.slug"},
+			},
+		},
+		{
+			name:      "job and block step fields",
+			eventType: "job.activated",
+			payload: map[string]interface{}{
+				"event": "job.activated",
+				"job": map[string]interface{}{
+					"id": "j1", "type": "manual", "label": "Deploy?", "state": "unblocked",
+					"unblocked_by":      map[string]interface{}{"id": "u1", "name": "Test User"},
+					"unblockable":       true,
+					"agent_query_rules": []interface{}{},
+				},
+				"build": map[string]interface{}{
+					"id": "1", "number": 1.0, "state": "running", "blocked": false, "blocked_state": "",
+				},
+				"pipeline": map[string]interface{}{"slug": "p"},
+			},
+		},
+		{
+			name:      "build fields not required for other events",
+			eventType: "agent.connected",
+			payload: map[string]interface{}{
+				"event": "agent.connected",
+				"agent": map[string]interface{}{"id": "a1", "connection_state": "connected", "meta_data": []interface{}{"queue=linux"}},
+			},
+		},
+		{
+			name:      "missing required agent fields",
+			eventType: "agent.stopped",
+			payload: map[string]interface{}{
+				"event": "agent.stopped",
+				"agent": map[string]interface{}{"id": "a1"},
+			},
+			want: []SchemaDrift{
+				{Kind: DriftMissingField, Field: "agent.connection_state"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := DetectSchemaDrift(tt.eventType, tt.payload)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DetectSchemaDrift() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSchemaDriftDetectorRateLimitsLogs(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	var logs bytes.Buffer
+	detector := NewSchemaDriftDetector(slog.New(slog.NewTextHandler(&logs, nil)), time.Hour)
+	body := []byte(`{"event":"build.finished","build":{"id":"1","number":1,"state":"passed","surprise":1},"pipeline":{"slug":"p"}}`)
+
+	for i := 0; i < 3; i++ {
+		if drifts := detector.Check("build.finished", body); len(drifts) != 1 {
+			t.Fatalf("Check() returned %d drifts, want 1", len(drifts))
+		}
+	}
+
+	if got := strings.Count(logs.String(), "Payload schema drift detected"); got != 1 {
+		t.Errorf("logged drift %d times, want 1", got)
+	}
+
+	// A different event type with the same drift is logged separately
+	detector.Check("build.started", bytes.Replace(body, []byte("build.finished"), []byte("build.started"), 1))
+	if got := strings.Count(logs.String(), "Payload schema drift detected"); got != 2 {
+		t.Errorf("logged drift %d times, want 2", got)
+	}
+}
+
+func TestSchemaDriftDetectorBoundsFields(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+	detector := NewSchemaDriftDetector(slog.New(slog.NewTextHandler(io.Discard, nil)), time.Hour)
+
+	// A payload with arbitrary keys cannot create a series for each of them
+	fields := make([]string, 0, maxDriftSeries+100)
+	for i := 0; i < maxDriftSeries+100; i++ {
+		fields = append(fields, fmt.Sprintf("%q:1", fmt.Sprintf("noise_%d", i)))
+	}
+	body := []byte(`{"event":"build.finished","build":{"id":"1","number":1,"state":"passed"},"pipeline":{"slug":"p"},` + strings.Join(fields, ",") + `}`)
+	if drifts := detector.Check("build.finished", body); len(drifts) != maxDriftSeries+100 {
+		t.Fatalf("Check() returned %d drifts, want %d", len(drifts), maxDriftSeries+100)
+	}
+
+	if got := testutil.CollectAndCount(metrics.SchemaDriftTotal); got != maxDriftSeries+1 {
+		t.Errorf("drift series = %d, want %d plus one for other fields", got, maxDriftSeries)
+	}
+	if got := testutil.ToFloat64(metrics.SchemaDriftTotal.WithLabelValues("build.finished", DriftUnknownField, DriftOtherField)); got != 100 {
+		t.Errorf("other field drifts = %v, want 100", got)
+	}
+	if got := len(detector.lastLogged); got != maxDriftSeries+1 {
+		t.Errorf("lastLogged holds %d keys, want %d", got, maxDriftSeries+1)
+	}
+}
+
+func FuzzSchemaDriftDetector(f *testing.F) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		f.Fatalf("failed to initialize metrics: %v", err)
+	}
+	detector := NewSchemaDriftDetector(slog.New(slog.NewTextHandler(io.Discard, nil)), time.Hour)
+
+	f.Add("build.finished", []byte(`{"event":"build.finished","build":{"id":"1","number":1,"state":"passed"},"pipeline":{"slug":"p"}}`))
+	f.Add("agent.lost", []byte(`{"event":"agent.lost","agent":{"id":"a","meta_data":[{"nested":true}]}}`))
+	f.Add("build.running", []byte(`{"build":"not an object","pipeline":[1,2],"sender":null}`))
+	f.Add("", []byte(`[]`))
+
+	f.Fuzz(func(t *testing.T, eventType string, body []byte) {
+		drifts := detector.Check(eventType, body)
+		for i := 1; i < len(drifts); i++ {
+			if drifts[i-1].Field > drifts[i].Field {
+				t.Fatalf("drifts not sorted by field: %+v", drifts)
+			}
+		}
+	})
+}
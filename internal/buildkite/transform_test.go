@@ -70,6 +70,9 @@ func TestTransform(t *testing.T) {
 			FinishedAt:   finishedAt,
 			Pipeline:     "basic-pipeline",
 			Organization: "testkite",
+
+			NormalizedState: "failure",
+			IsTerminal:      true,
 		},
 		Pipeline: PipelineInfo{
 			ID:          "0189b873-e493-4675-b964-a085ddc4b927",
@@ -113,3 +116,67 @@ func TestTransform(t *testing.T) {
 		t.Errorf("Transform() Raw field mismatch:\ngot  = %v\nwant = %v", rawField, expectedRaw)
 	}
 }
+
+func TestTransformAgentEvent(t *testing.T) {
+	body := []byte(`{
+		"event": "agent.stopped",
+		"agent": {
+			"id": "0188a3b8-4e1a-4c8f-9b0e-3f4e5d6c7b8a",
+			"name": "ci-agent-1",
+			"connection_state": "stopped",
+			"hostname": "ip-10-0-0-1",
+			"version": "3.80.0",
+			"cluster_id": "c0ffee00-0000-4000-8000-000000000001",
+			"meta_data": ["queue=linux-large", "os=linux"]
+		},
+		"sender": {"id": "u1", "name": "Test User"}
+	}`)
+
+	var payload Payload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatalf("failed to decode payload: %v", err)
+	}
+
+	got, err := Transform(payload)
+	if err != nil {
+		t.Fatalf("Transform() error = %v", err)
+	}
+	if got.Agent == nil {
+		t.Fatal("Transform() Agent = nil, want agent info")
+	}
+
+	want := AgentInfo{
+		ID:              "0188a3b8-4e1a-4c8f-9b0e-3f4e5d6c7b8a",
+		Name:            "ci-agent-1",
+		Hostname:        "ip-10-0-0-1",
+		ConnectionState: "stopped",
+		Version:         "3.80.0",
+		ClusterID:       "c0ffee00-0000-4000-8000-000000000001",
+		QueueName:       "linux-large",
+		Tags:            []string{"queue=linux-large", "os=linux"},
+	}
+	if !reflect.DeepEqual(*got.Agent, want) {
+		t.Errorf("Transform() Agent = %+v, want %+v", *got.Agent, want)
+	}
+	if _, ok := got.Raw["agent"]; !ok {
+		t.Error("raw payload missing agent")
+	}
+}
+
+func TestAgentQueue(t *testing.T) {
+	tests := []struct {
+		tags []string
+		want string
+	}{
+		{tags: []string{"os=linux", "queue=deploy"}, want: "deploy"},
+		{tags: []string{"os=linux"}, want: "default"},
+		{tags: []string{"queue="}, want: "default"},
+		{tags: nil, want: "default"},
+	}
+
+	for _, tt := range tests {
+		if got := AgentQueue(tt.tags); got != tt.want {
+			t.Errorf("AgentQueue(%v) = %q, want %q", tt.tags, got, tt.want)
+		}
+	}
+}
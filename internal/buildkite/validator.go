@@ -1,23 +1,19 @@
 package buildkite
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
-	"crypto/subtle"
-	"encoding/hex"
-	"fmt"
-	"io"
+	"errors"
 	"log"
 	"net/http"
-	"strconv"
-	"strings"
-	"time"
+
+	"github.com/mcncl/buildkite-pubsub/pkg/buildkiteauth"
 )
 
-// Validator handles webhook token and HMAC signature validation
+// Validator handles webhook token and HMAC signature validation. The checks
+// themselves live in pkg/buildkiteauth so other services can reuse them.
 type Validator struct {
 	token      string
 	hmacSecret string
+	opts       buildkiteauth.VerifyOptions
 }
 
 // NewValidator creates a new validator with the given token and optional HMAC secret
@@ -27,97 +23,61 @@ func NewValidator(token string) *Validator {
 
 // NewValidatorWithHMAC creates a new validator with HMAC signature support
 func NewValidatorWithHMAC(token, hmacSecret string) *Validator {
+	return NewValidatorWithOptions(token, hmacSecret, buildkiteauth.VerifyOptions{})
+}
+
+// NewValidatorWithOptions creates a validator that checks signature
+// timestamps against the tolerances in opts
+func NewValidatorWithOptions(token, hmacSecret string, opts buildkiteauth.VerifyOptions) *Validator {
 	return &Validator{
 		token:      token,
 		hmacSecret: hmacSecret,
+		opts:       opts,
 	}
 }
 
-// ValidateToken checks if the provided token matches the expected token or validates HMAC signature
-func (v *Validator) ValidateToken(r *http.Request) bool {
-	// First, check if HMAC signature is present
-	signature := r.Header.Get("X-Buildkite-Signature")
-	if signature != "" && v.hmacSecret != "" {
-		return v.validateHMACSignature(r, signature)
-	}
+// Signature failure reasons, used as metric labels
+const (
+	SignatureMalformed = "malformed"
+	SignatureInvalid   = "invalid_signature"
+	SignatureExpired   = "expired_timestamp"
+	SignatureFuture    = "future_timestamp"
+)
 
-	// Fall back to token validation
-	providedToken := r.Header.Get("X-Buildkite-Token")
-	providedToken = strings.TrimSpace(providedToken)
-	if providedToken == "" {
-		log.Printf("Debug - No token provided")
-		return false
+// SignatureFailureReason classifies a validation error from a signed
+// request, returning "" for errors that are not signature failures. An
+// expired or future timestamp usually means clock skew; an invalid
+// signature usually means the wrong secret.
+func SignatureFailureReason(err error) string {
+	switch {
+	case errors.Is(err, buildkiteauth.ErrSignatureFuture):
+		return SignatureFuture
+	case errors.Is(err, buildkiteauth.ErrSignatureExpired):
+		return SignatureExpired
+	case errors.Is(err, buildkiteauth.ErrInvalidSignature):
+		return SignatureInvalid
+	case errors.Is(err, buildkiteauth.ErrMalformedSignature):
+		return SignatureMalformed
 	}
-
-	result := subtle.ConstantTimeCompare([]byte(providedToken), []byte(v.token)) == 1
-	log.Printf("Debug - Token is valid: %v", result)
-
-	return result
+	return ""
 }
 
-// validateHMACSignature validates the HMAC-SHA256 signature from Buildkite
-func (v *Validator) validateHMACSignature(r *http.Request, headerValue string) bool {
-	// Parse the header value (format: "timestamp=1619071700,signature=...")
-	parts := strings.Split(headerValue, ",")
-	var timestamp, signature string
-
-	for _, part := range parts {
-		kv := strings.SplitN(part, "=", 2)
-		if len(kv) != 2 {
-			continue
-		}
-		key := strings.TrimSpace(kv[0])
-		value := strings.TrimSpace(kv[1])
-
-		switch key {
-		case "timestamp":
-			timestamp = value
-		case "signature":
-			signature = value
-		}
-	}
-
-	if timestamp == "" || signature == "" {
-		log.Printf("Debug - Invalid signature format: missing timestamp or signature")
-		return false
-	}
-
-	// Validate timestamp to prevent replay attacks (within 5 minutes)
-	ts, err := strconv.ParseInt(timestamp, 10, 64)
-	if err != nil {
-		log.Printf("Debug - Invalid timestamp format: %v", err)
-		return false
-	}
-
-	// Check if timestamp is within acceptable window (5 minutes)
-	now := time.Now().Unix()
-	timeDiff := now - ts
-	if timeDiff < 0 {
-		timeDiff = -timeDiff
-	}
-	if timeDiff > 300 { // 5 minutes
-		log.Printf("Debug - Timestamp too old or in future: %d seconds difference", timeDiff)
-		return false
-	}
+// ValidateToken checks if the provided token matches the expected token or validates HMAC signature
+func (v *Validator) ValidateToken(r *http.Request) bool {
+	return v.Validate(r) == nil
+}
 
-	// Read the request body
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("Debug - Failed to read request body: %v", err)
-		return false
+// Validate checks the request's token or HMAC signature, returning one of
+// the buildkiteauth errors when it is not valid
+func (v *Validator) Validate(r *http.Request) error {
+	err := buildkiteauth.VerifyRequest(r, v.token, v.hmacSecret, v.opts)
+	switch {
+	case err == nil:
+		log.Printf("Debug - Webhook request is valid")
+	case errors.Is(err, buildkiteauth.ErrMissingToken):
+		log.Printf("Debug - No token provided")
+	default:
+		log.Printf("Debug - Webhook request is invalid: %v", err)
 	}
-	// Restore the body for later use
-	r.Body = io.NopCloser(strings.NewReader(string(body)))
-
-	// Compute expected signature: HMAC-SHA256(secret, "timestamp.body")
-	message := fmt.Sprintf("%s.%s", timestamp, string(body))
-	mac := hmac.New(sha256.New, []byte(v.hmacSecret))
-	mac.Write([]byte(message))
-	expectedSignature := hex.EncodeToString(mac.Sum(nil))
-
-	// Compare signatures using constant-time comparison
-	result := subtle.ConstantTimeCompare([]byte(signature), []byte(expectedSignature)) == 1
-	log.Printf("Debug - HMAC signature is valid: %v", result)
-
-	return result
+	return err
 }
@@ -0,0 +1,81 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewFake(start)
+
+	short, long := c.After(time.Second), c.After(time.Minute)
+	if c.Waiters() != 2 {
+		t.Fatalf("Waiters() = %d, want 2", c.Waiters())
+	}
+	select {
+	case <-short:
+		t.Fatal("After fired before the clock moved")
+	default:
+	}
+
+	c.Advance(30 * time.Second)
+	select {
+	case got := <-short:
+		if !got.Equal(start.Add(30 * time.Second)) {
+			t.Errorf("After sent %v, want the advanced time", got)
+		}
+	default:
+		t.Fatal("After did not fire once its deadline passed")
+	}
+	if c.Since(start) != 30*time.Second {
+		t.Errorf("Since() = %v, want 30s", c.Since(start))
+	}
+
+	// Setting the clock back fires nothing
+	c.Set(start)
+	select {
+	case <-long:
+		t.Fatal("After fired when the clock was set back")
+	default:
+	}
+	c.Set(start.Add(time.Hour))
+	<-long
+	if c.Waiters() != 0 {
+		t.Errorf("Waiters() = %d after every wait fired, want 0", c.Waiters())
+	}
+
+	// A wait of zero fires at once
+	select {
+	case <-c.After(0):
+	default:
+		t.Error("After(0) did not fire at once")
+	}
+}
+
+func TestFakeBlockUntil(t *testing.T) {
+	c := NewFake(time.Unix(0, 0))
+	done := make(chan struct{})
+	go func() {
+		<-c.After(time.Second)
+		close(done)
+	}()
+
+	c.BlockUntil(1)
+	c.Advance(time.Second)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting goroutine did not wake after Advance")
+	}
+}
+
+func TestOrReal(t *testing.T) {
+	if OrReal(nil) != Real {
+		t.Error("OrReal(nil) is not the real clock")
+	}
+	fake := NewFake(time.Unix(0, 0))
+	if OrReal(fake) != fake {
+		t.Error("OrReal(fake) did not return the fake")
+	}
+}
@@ -0,0 +1,105 @@
+// Package clockcheck measures the local clock's offset from an NTP server.
+// HMAC signatures carry a timestamp, so a skewed clock rejects every signed
+// delivery just as a wrong secret does; checking the clock at startup tells
+// the two apart.
+package clockcheck
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// packetSize is the size of an NTP packet without extensions
+	packetSize = 48
+	// ntpEpochOffset is the number of seconds from 1900, the NTP epoch, to 1970
+	ntpEpochOffset = 2208988800
+	// defaultTimeout bounds the query when ctx has no deadline
+	defaultTimeout = 5 * time.Second
+)
+
+// Offset queries server, a host or host:port, with SNTP and returns how far
+// the server's clock is ahead of the local clock. A negative offset means
+// the local clock is fast.
+func Offset(ctx context.Context, server string) (time.Duration, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultTimeout)
+		defer cancel()
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return 0, fmt.Errorf("failed to reach NTP server %s: %w", server, err)
+	}
+	defer func() { _ = conn.Close() }()
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return 0, err
+	}
+
+	// Version 4, client mode, with the send time as the transmit timestamp
+	// so the reply can be matched to this request
+	request := make([]byte, packetSize)
+	request[0] = 4<<3 | 3
+	sent := time.Now()
+	putTimestamp(request[40:], sent)
+	if _, err := conn.Write(request); err != nil {
+		return 0, fmt.Errorf("failed to query NTP server %s: %w", server, err)
+	}
+
+	reply := make([]byte, packetSize)
+	n, err := conn.Read(reply)
+	received := time.Now()
+	if err != nil {
+		return 0, fmt.Errorf("failed to query NTP server %s: %w", server, err)
+	}
+	if err := validate(request, reply[:n]); err != nil {
+		return 0, fmt.Errorf("NTP server %s: %w", server, err)
+	}
+
+	// Standard SNTP offset: the mean of the request and reply clock deltas
+	serverReceived := timestamp(reply[32:])
+	serverSent := timestamp(reply[40:])
+	return (serverReceived.Sub(sent) + serverSent.Sub(received)) / 2, nil
+}
+
+// validate checks that reply is a usable server reply to request
+func validate(request, reply []byte) error {
+	if len(reply) < packetSize {
+		return errors.New("reply too short")
+	}
+	if mode := reply[0] & 0x7; mode != 4 {
+		return fmt.Errorf("reply has mode %d, want server mode 4", mode)
+	}
+	if reply[0]>>6 == 3 || reply[1] == 0 {
+		return errors.New("server is unsynchronized")
+	}
+	if binary.BigEndian.Uint64(reply[24:]) != binary.BigEndian.Uint64(request[40:]) {
+		return errors.New("reply does not match request")
+	}
+	return nil
+}
+
+// putTimestamp writes t as a 64-bit NTP timestamp
+func putTimestamp(b []byte, t time.Time) {
+	seconds := uint64(t.Unix() + ntpEpochOffset)
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	binary.BigEndian.PutUint64(b, seconds<<32|fraction)
+}
+
+// timestamp reads a 64-bit NTP timestamp
+func timestamp(b []byte) time.Time {
+	v := binary.BigEndian.Uint64(b)
+	seconds := int64(v>>32) - ntpEpochOffset
+	nanos := int64((v & 0xffffffff) * uint64(time.Second) >> 32)
+	return time.Unix(seconds, nanos)
+}
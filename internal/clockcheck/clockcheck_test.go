@@ -0,0 +1,90 @@
+package clockcheck
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeServer answers SNTP requests with a clock offset from the local one.
+// mangle, when set, can corrupt the reply.
+func fakeServer(t *testing.T, offset time.Duration, mangle func([]byte)) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buf := make([]byte, packetSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < packetSize {
+				continue
+			}
+			reply := make([]byte, packetSize)
+			reply[0] = 4<<3 | 4
+			reply[1] = 2
+			copy(reply[24:32], buf[40:48])
+			putTimestamp(reply[32:], time.Now().Add(offset))
+			putTimestamp(reply[40:], time.Now().Add(offset))
+			if mangle != nil {
+				mangle(reply)
+			}
+			_, _ = conn.WriteTo(reply, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestOffset(t *testing.T) {
+	for _, offset := range []time.Duration{0, 90 * time.Second, -10 * time.Minute} {
+		got, err := Offset(context.Background(), fakeServer(t, offset, nil))
+		if err != nil {
+			t.Fatalf("Offset() error = %v", err)
+		}
+		if diff := got - offset; diff < -time.Second || diff > time.Second {
+			t.Errorf("Offset() = %v, want about %v", got, offset)
+		}
+	}
+}
+
+func TestOffsetRejectsBadReplies(t *testing.T) {
+	tests := map[string]func([]byte){
+		"client mode":     func(b []byte) { b[0] = 4<<3 | 3 },
+		"unsynchronized":  func(b []byte) { b[1] = 0 },
+		"mismatched echo": func(b []byte) { b[24]++ },
+	}
+	for name, mangle := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Offset(context.Background(), fakeServer(t, 0, mangle)); err == nil {
+				t.Error("Offset() error = nil, want error")
+			}
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer func() { _ = silent.Close() }()
+	if _, err := Offset(ctx, silent.LocalAddr().String()); err == nil {
+		t.Error("Offset() from a silent server error = nil, want timeout")
+	}
+}
+
+func TestTimestampRoundTrip(t *testing.T) {
+	want := time.Date(2024, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	b := make([]byte, 8)
+	putTimestamp(b, want)
+	if got := timestamp(b); got.Sub(want).Abs() > time.Microsecond {
+		t.Errorf("timestamp() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,69 @@
+// Package cloudrun adapts the service to Cloud Run and Cloud Functions (2nd
+// gen), which terminate HTTPS in Google's front end and forward requests to
+// the container over HTTP.
+package cloudrun
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ShutdownTimeout is how long to drain requests after SIGTERM, within the
+// 10 seconds Cloud Run allows before it kills the instance
+const ShutdownTimeout = 8 * time.Second
+
+// Detect reports whether the process runs on Cloud Run or Cloud Functions,
+// which both set K_SERVICE
+func Detect() bool {
+	return os.Getenv("K_SERVICE") != ""
+}
+
+// Service returns the Cloud Run service and revision names
+func Service() (service, revision string) {
+	return os.Getenv("K_SERVICE"), os.Getenv("K_REVISION")
+}
+
+// WithProxyHeaders trusts the headers Google's front end adds when it
+// forwards a request. The front end appends the address it received the
+// request from to X-Forwarded-For, so the last entry becomes the request's
+// remote address and per-IP rate limits and logs see the client rather than
+// the front end; earlier entries are set by the client and ignored. A
+// request received over HTTPS gets the https URL scheme.
+func WithProxyHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := lastForwardedFor(r.Header.Values("X-Forwarded-For"))
+		https := r.Header.Get("X-Forwarded-Proto") == "https"
+		if ip == "" && !https {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r = r.WithContext(r.Context())
+		if ip != "" {
+			r.RemoteAddr = net.JoinHostPort(ip, "0")
+		}
+		if https {
+			u := *r.URL
+			u.Scheme = "https"
+			r.URL = &u
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// lastForwardedFor returns the last address in X-Forwarded-For headers, or
+// "" if it is not an IP address
+func lastForwardedFor(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	entries := strings.Split(values[len(values)-1], ",")
+	ip := strings.TrimSpace(entries[len(entries)-1])
+	if net.ParseIP(ip) == nil {
+		return ""
+	}
+	return ip
+}
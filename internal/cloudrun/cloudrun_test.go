@@ -0,0 +1,94 @@
+package cloudrun
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDetect(t *testing.T) {
+	t.Setenv("K_SERVICE", "")
+	if Detect() {
+		t.Error("Detect() = true without K_SERVICE")
+	}
+
+	t.Setenv("K_SERVICE", "buildkite-webhook")
+	t.Setenv("K_REVISION", "buildkite-webhook-00042-abc")
+	if !Detect() {
+		t.Error("Detect() = false with K_SERVICE set")
+	}
+	if service, revision := Service(); service != "buildkite-webhook" || revision != "buildkite-webhook-00042-abc" {
+		t.Errorf("Service() = %q, %q", service, revision)
+	}
+}
+
+func TestWithProxyHeaders(t *testing.T) {
+	tests := []struct {
+		name       string
+		forwarded  []string
+		proto      string
+		wantAddr   string
+		wantScheme string
+	}{
+		{
+			name:     "no proxy headers",
+			wantAddr: "192.0.2.1:1234",
+		},
+		{
+			name:       "client address and https",
+			forwarded:  []string{"203.0.113.7"},
+			proto:      "https",
+			wantAddr:   "203.0.113.7:0",
+			wantScheme: "https",
+		},
+		{
+			name:      "spoofed entries are ignored",
+			forwarded: []string{"10.0.0.1, 198.51.100.2", "203.0.113.7"},
+			wantAddr:  "203.0.113.7:0",
+		},
+		{
+			name:      "last entry within a header",
+			forwarded: []string{"10.0.0.1, 2001:db8::1"},
+			wantAddr:  "[2001:db8::1]:0",
+		},
+		{
+			name:      "invalid address keeps the remote address",
+			forwarded: []string{"203.0.113.7, unknown"},
+			wantAddr:  "192.0.2.1:1234",
+		},
+		{
+			name:     "http is left alone",
+			proto:    "http",
+			wantAddr: "192.0.2.1:1234",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotAddr, gotScheme string
+			handler := WithProxyHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotAddr, gotScheme = r.RemoteAddr, r.URL.Scheme
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			for _, v := range tt.forwarded {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.proto != "" {
+				req.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if gotAddr != tt.wantAddr {
+				t.Errorf("RemoteAddr = %q, want %q", gotAddr, tt.wantAddr)
+			}
+			if gotScheme != tt.wantScheme {
+				t.Errorf("URL.Scheme = %q, want %q", gotScheme, tt.wantScheme)
+			}
+			if req.RemoteAddr != "192.0.2.1:1234" {
+				t.Error("original request was modified")
+			}
+		})
+	}
+}
@@ -5,33 +5,238 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"net/netip"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/mcncl/buildkite-pubsub/internal/errors"
+	"github.com/mcncl/buildkite-pubsub/internal/expression"
+	"github.com/mcncl/buildkite-pubsub/internal/middleware"
+	"github.com/mcncl/buildkite-pubsub/internal/middleware/security"
+	"github.com/mcncl/buildkite-pubsub/pkg/transform"
 	"gopkg.in/yaml.v3"
 )
 
 // Config holds all application configuration
 type Config struct {
-	GCP      GCPConfig      `json:"gcp" yaml:"gcp"`
-	Webhook  WebhookConfig  `json:"webhook" yaml:"webhook"`
-	Server   ServerConfig   `json:"server" yaml:"server"`
-	Security SecurityConfig `json:"security" yaml:"security"`
+	// Profile is the named profile whose defaults the configuration was
+	// loaded with, chosen by the -profile flag or CONFIG_PROFILE
+	Profile   string          `json:"profile,omitempty" yaml:"-"`
+	GCP       GCPConfig       `json:"gcp" yaml:"gcp"`
+	Webhook   WebhookConfig   `json:"webhook" yaml:"webhook"`
+	Server    ServerConfig    `json:"server" yaml:"server"`
+	Security  SecurityConfig  `json:"security" yaml:"security"`
+	Admin     AdminConfig     `json:"admin" yaml:"admin"`
+	Dedupe    DedupeConfig    `json:"dedupe" yaml:"dedupe"`
+	Audit     AuditConfig     `json:"audit" yaml:"audit"`
+	Metrics   MetricsConfig   `json:"metrics" yaml:"metrics"`
+	Ownership OwnershipConfig `json:"ownership" yaml:"ownership"`
+	Heartbeat HeartbeatConfig `json:"heartbeat" yaml:"heartbeat"`
+	// SubscriptionLag monitors the backlog of the topic's subscriptions
+	SubscriptionLag SubscriptionLagConfig `json:"subscription_lag" yaml:"subscription_lag"`
+	// Confirmation waits for the primary consumer to confirm the messages
+	// of critical pipelines
+	Confirmation ConfirmationConfig `json:"confirmation" yaml:"confirmation"`
+	// Rejections samples requests rejected for failing authentication or
+	// validation
+	Rejections RejectionsConfig `json:"rejections" yaml:"rejections"`
+	// Quarantine keeps payloads that fail to transform
+	Quarantine QuarantineConfig `json:"quarantine" yaml:"quarantine"`
+	Tracing    TracingConfig    `json:"tracing" yaml:"tracing"`
+	// Deprecated lists the deprecated environment variables and file keys
+	// the configuration was loaded from
+	Deprecated []Deprecation `json:"-" yaml:"-"`
 }
 
 // GCPConfig holds Google Cloud Platform related configuration
 type GCPConfig struct {
-	ProjectID              string `json:"project_id" yaml:"project_id"`
-	TopicID                string `json:"topic_id" yaml:"topic_id"`
-	CredentialsFile        string `json:"credentials_file" yaml:"credentials_file"`
-	PubSubBatchSize        int    `json:"pubsub_batch_size" yaml:"pubsub_batch_size"`
+	ProjectID string `json:"project_id" yaml:"project_id"`
+	TopicID   string `json:"topic_id" yaml:"topic_id"`
+	// CredentialsFile is GOOGLE_APPLICATION_CREDENTIALS, which Application
+	// Default Credentials read; Credentials chooses how to authenticate
+	CredentialsFile string            `json:"credentials_file" yaml:"credentials_file"`
+	Credentials     CredentialsConfig `json:"credentials" yaml:"credentials"`
+	// PubSubBatchSize is the number of messages that triggers sending a batch
+	PubSubBatchSize int `json:"pubsub_batch_size" yaml:"pubsub_batch_size"`
+	// PubSubByteThreshold is the batch size in bytes that triggers sending it
+	PubSubByteThreshold int `json:"pubsub_byte_threshold" yaml:"pubsub_byte_threshold"`
+	// PubSubDelayThreshold is the longest a message waits for its batch to fill
+	PubSubDelayThreshold time.Duration `json:"pubsub_delay_threshold" yaml:"pubsub_delay_threshold,omitempty"`
+	// PubSubMaxOutstandingMessages and PubSubMaxOutstandingBytes bound the
+	// messages waiting to be published; publishes beyond either wait
+	PubSubMaxOutstandingMessages int `json:"pubsub_max_outstanding_messages" yaml:"pubsub_max_outstanding_messages"`
+	PubSubMaxOutstandingBytes    int `json:"pubsub_max_outstanding_bytes" yaml:"pubsub_max_outstanding_bytes"`
+	// PubSubCompression gzips batches of at least PubSubCompressionThreshold
+	// bytes
+	PubSubCompression          *bool `json:"pubsub_compression,omitempty" yaml:"pubsub_compression,omitempty"`
+	PubSubCompressionThreshold int   `json:"pubsub_compression_threshold" yaml:"pubsub_compression_threshold"`
+	// PubSubRetryMaxAttempts is how many times a publish is tried
 	PubSubRetryMaxAttempts int    `json:"pubsub_retry_max_attempts" yaml:"pubsub_retry_max_attempts"`
 	EnableDLQ              bool   `json:"enable_dlq" yaml:"enable_dlq"`
 	DLQTopicID             string `json:"dlq_topic_id" yaml:"dlq_topic_id"`
+	// DLQRetryMaxAttempts is how many times a DLQ publish is tried
+	DLQRetryMaxAttempts int `json:"dlq_retry_max_attempts" yaml:"dlq_retry_max_attempts"`
+	// DLQFallbackDir keeps DLQ messages that could not be published as
+	// files; empty drops them
+	DLQFallbackDir string `json:"dlq_fallback_dir,omitempty" yaml:"dlq_fallback_dir,omitempty"`
+	// Secondary topic used when the primary's circuit breaker opens
+	SecondaryProjectID string `json:"secondary_project_id" yaml:"secondary_project_id"`
+	SecondaryTopicID   string `json:"secondary_topic_id" yaml:"secondary_topic_id"`
+	// Consecutive publish failures that open the circuit breaker
+	CircuitBreakerThreshold int `json:"circuit_breaker_threshold" yaml:"circuit_breaker_threshold"`
+	// How long the circuit stays open before probing the primary again
+	CircuitBreakerTimeout time.Duration `json:"circuit_breaker_timeout" yaml:"circuit_breaker_timeout,omitempty"`
+	// CircuitBreakerState is a file path or a redis:// or rediss:// URL where
+	// the circuit state is saved, so a restart during an outage resumes an
+	// open circuit; empty keeps it in memory only
+	CircuitBreakerState string `json:"circuit_breaker_state,omitempty" yaml:"circuit_breaker_state,omitempty"`
+	// CircuitBreakerStateTTL is how long a saved circuit state applies;
+	// zero uses ten times CircuitBreakerTimeout
+	CircuitBreakerStateTTL time.Duration `json:"circuit_breaker_state_ttl,omitempty" yaml:"circuit_breaker_state_ttl,omitempty"`
+	// MaxPendingPublishes bounds concurrent publishes; further webhooks get a
+	// 429 with a Retry-After estimated from the drain rate. 0 disables it.
+	MaxPendingPublishes int `json:"max_pending_publishes" yaml:"max_pending_publishes"`
+	// HighPriorityEvents are event type patterns, such as "build.*", that
+	// wait for a slot when the publish queue is full; only other events are
+	// rejected. Empty treats every event alike.
+	HighPriorityEvents []string `json:"high_priority_events,omitempty" yaml:"high_priority_events,omitempty"`
+	// AttributeAllowList limits published message attributes to these keys;
+	// empty publishes all attributes
+	AttributeAllowList []string `json:"attribute_allow_list,omitempty" yaml:"attribute_allow_list,omitempty"`
+	// AttributeRules derive additional message attributes from events
+	AttributeRules []AttributeRuleConfig `json:"attribute_rules,omitempty" yaml:"attribute_rules,omitempty"`
+	// HashedAttributes are message attributes whose values, such as a
+	// creator email set by an attribute rule, are replaced with an
+	// HMAC-SHA256 keyed by AttributeHashKey, so events still correlate
+	// without the raw value being stored. The pipeline, branch and team
+	// metric labels are hashed too when listed.
+	HashedAttributes []string `json:"hashed_attributes,omitempty" yaml:"hashed_attributes,omitempty"`
+	// AttributeHashKey keys the hash of HashedAttributes; consumers holding
+	// it can hash a known value to look it up
+	AttributeHashKey string `json:"attribute_hash_key,omitempty" yaml:"attribute_hash_key,omitempty"`
+	// Per-event-type overrides of the retry budget and DLQ enablement
+	EventPolicies map[string]EventPolicy `json:"event_policies,omitempty" yaml:"event_policies,omitempty"`
+	// Routes send matching events to other topics; unmatched events use TopicID
+	Routes []RouteConfig `json:"routes,omitempty" yaml:"routes,omitempty"`
+}
+
+// Credential modes
+const (
+	// CredentialsADC uses Application Default Credentials, or File when set
+	// whatever its type
+	CredentialsADC = "adc"
+	// CredentialsKeyFile uses the service account key in File
+	CredentialsKeyFile = "key_file"
+	// CredentialsWorkloadIdentityFederation uses the external account
+	// configuration in File, such as one for GKE or AWS workload identity
+	CredentialsWorkloadIdentityFederation = "workload_identity_federation"
+	// CredentialsImpersonation impersonates TargetPrincipal using File, or
+	// Application Default Credentials when File is empty
+	CredentialsImpersonation = "impersonation"
+)
+
+// CredentialsConfig chooses how the service authenticates to Google Cloud
+type CredentialsConfig struct {
+	// Mode is one of the credential modes; empty means CredentialsADC
+	Mode string `json:"mode,omitempty" yaml:"mode,omitempty"`
+	// File is the service account key or external account configuration
+	File string `json:"file,omitempty" yaml:"file,omitempty"`
+	// TargetPrincipal is the email of the service account to impersonate
+	TargetPrincipal string `json:"target_principal,omitempty" yaml:"target_principal,omitempty"`
+	// Delegates are the service accounts in a delegation chain from the
+	// base credentials to TargetPrincipal
+	Delegates []string `json:"delegates,omitempty" yaml:"delegates,omitempty"`
+}
+
+// RouteConfig sends events matching all of its patterns to a topic. Patterns
+// use path.Match syntax and empty patterns match anything.
+type RouteConfig struct {
+	Name string `json:"name" yaml:"name"`
+	// ProjectID defaults to GCP.ProjectID
+	ProjectID  string `json:"project_id,omitempty" yaml:"project_id,omitempty"`
+	TopicID    string `json:"topic_id" yaml:"topic_id"`
+	EventType  string `json:"event_type,omitempty" yaml:"event_type,omitempty"`
+	Pipeline   string `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
+	Branch     string `json:"branch,omitempty" yaml:"branch,omitempty"`
+	BuildState string `json:"build_state,omitempty" yaml:"build_state,omitempty"`
+	// Expression is a CEL condition events must also satisfy
+	Expression string `json:"expression,omitempty" yaml:"expression,omitempty"`
+}
+
+// AttributeRuleConfig sets an attribute on events matching all of its
+// patterns, such as team=payments for pipelines matching "payments-*". For
+// each attribute the first matching rule wins. Patterns use path.Match
+// syntax and empty patterns match anything.
+type AttributeRuleConfig struct {
+	Attribute string `json:"attribute" yaml:"attribute"`
+	Value     string `json:"value,omitempty" yaml:"value,omitempty"`
+	// ValueExpression is a CEL expression computing the value instead of
+	// Value; a rule whose expression fails to evaluate does not match
+	ValueExpression string `json:"value_expression,omitempty" yaml:"value_expression,omitempty"`
+	EventType       string `json:"event_type,omitempty" yaml:"event_type,omitempty"`
+	Pipeline        string `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
+	Branch          string `json:"branch,omitempty" yaml:"branch,omitempty"`
+	BuildState      string `json:"build_state,omitempty" yaml:"build_state,omitempty"`
+	// Expression is a CEL condition events must also satisfy
+	Expression string `json:"expression,omitempty" yaml:"expression,omitempty"`
+}
+
+// EventPolicy overrides publish behaviour for a single Buildkite event type
+type EventPolicy struct {
+	// RetryMaxAttempts replaces GCP.PubSubRetryMaxAttempts; 1 disables retries
+	// and 0 inherits the global value
+	RetryMaxAttempts int `json:"retry_max_attempts,omitempty" yaml:"retry_max_attempts,omitempty"`
+	// EnableDLQ replaces GCP.EnableDLQ when set
+	EnableDLQ *bool `json:"enable_dlq,omitempty" yaml:"enable_dlq,omitempty"`
+	// TTLSeconds stamps messages with an expires_at attribute this long
+	// after the webhook received them; 0 leaves them without one
+	TTLSeconds int `json:"ttl_seconds,omitempty" yaml:"ttl_seconds,omitempty"`
+}
+
+// validate checks that the fields the mode needs are set and the others
+// are not
+func (c CredentialsConfig) validate() error {
+	switch c.Mode {
+	case "", CredentialsADC:
+		if c.TargetPrincipal != "" || len(c.Delegates) > 0 {
+			return errors.NewValidationError("GCP.Credentials.TargetPrincipal requires mode " + CredentialsImpersonation)
+		}
+	case CredentialsKeyFile, CredentialsWorkloadIdentityFederation:
+		if c.File == "" {
+			return errors.NewValidationError("GCP.Credentials.File is required for mode " + c.Mode)
+		}
+		if c.TargetPrincipal != "" || len(c.Delegates) > 0 {
+			return errors.NewValidationError("GCP.Credentials.TargetPrincipal requires mode " + CredentialsImpersonation)
+		}
+	case CredentialsImpersonation:
+		if c.TargetPrincipal == "" {
+			return errors.NewValidationError("GCP.Credentials.TargetPrincipal is required for mode " + CredentialsImpersonation)
+		}
+	default:
+		return errors.NewValidationError(fmt.Sprintf("GCP.Credentials.Mode %q must be one of %s, %s, %s or %s",
+			c.Mode, CredentialsADC, CredentialsKeyFile, CredentialsWorkloadIdentityFederation, CredentialsImpersonation))
+	}
+	return nil
+}
+
+// DLQRequired reports whether any event type can be sent to the DLQ
+func (c GCPConfig) DLQRequired() bool {
+	if c.EnableDLQ {
+		return true
+	}
+	for _, policy := range c.EventPolicies {
+		if policy.EnableDLQ != nil && *policy.EnableDLQ {
+			return true
+		}
+	}
+	return false
 }
 
 // WebhookConfig holds Buildkite webhook related configuration
@@ -39,34 +244,461 @@ type WebhookConfig struct {
 	Token      string `json:"token" yaml:"token"`
 	HMACSecret string `json:"hmac_secret" yaml:"hmac_secret"`
 	Path       string `json:"path" yaml:"path"`
+	// DetectSchemaDrift logs and counts payload fields that are unknown or
+	// missing compared to the known Buildkite schema
+	DetectSchemaDrift bool `json:"detect_schema_drift" yaml:"detect_schema_drift"`
+	// UnsupportedEvents is what happens to event types the service does not
+	// transform: "publish" the raw payload, "drop" with a 200, or "reject"
+	// with a 422. Defaults to "publish".
+	UnsupportedEvents string `json:"unsupported_events" yaml:"unsupported_events"`
+	// Paths serve additional webhook endpoints alongside Path, each with its
+	// own credentials, event filter and topic
+	Paths []WebhookPathConfig `json:"paths,omitempty" yaml:"paths,omitempty"`
+	// Middleware lists the webhook middleware to run, outermost first; empty
+	// runs every middleware in the default order
+	Middleware []string `json:"middleware,omitempty" yaml:"middleware,omitempty"`
+	// StrictMethods rejects every method but POST with 405; otherwise HEAD
+	// answers uptime checks and OPTIONS lists the allowed methods
+	StrictMethods bool `json:"strict_methods" yaml:"strict_methods"`
+	// ServerTiming adds a Server-Timing header with the duration of each
+	// phase of the request to webhook responses, for debugging latency
+	ServerTiming bool `json:"server_timing,omitempty" yaml:"server_timing,omitempty"`
+	// SignatureTolerance is the maximum age of an HMAC signature timestamp;
+	// zero uses five minutes
+	SignatureTolerance time.Duration `json:"signature_tolerance" yaml:"signature_tolerance,omitempty"`
+	// SignatureFutureTolerance is how far ahead of the local clock an HMAC
+	// signature timestamp may be; zero uses SignatureTolerance
+	SignatureFutureTolerance time.Duration `json:"signature_future_tolerance" yaml:"signature_future_tolerance,omitempty"`
+	// ClockCheckServer is an NTP server queried at startup to warn when the
+	// local clock is too skewed for signature timestamps; empty disables it
+	ClockCheckServer string `json:"clock_check_server" yaml:"clock_check_server"`
+	// DeliveryAttemptHeader names a request header carrying the delivery
+	// attempt number, published as the delivery_attempt attribute; empty
+	// ignores attempts
+	DeliveryAttemptHeader string `json:"delivery_attempt_header" yaml:"delivery_attempt_header,omitempty"`
+	// ChecksumAlgorithm is the hash of the checksum attribute: "sha256",
+	// "sha512" or "none" to publish no checksum. Defaults to "sha256".
+	ChecksumAlgorithm string `json:"checksum_algorithm" yaml:"checksum_algorithm"`
+	// ChecksumPayload is what the checksum covers: the published message
+	// "data" or the "raw" webhook body. Defaults to "data".
+	ChecksumPayload string `json:"checksum_payload" yaml:"checksum_payload"`
+	// SchemaVersion stamps messages with schema_version and adds the fields
+	// of that version, up to transform.LatestSchemaVersion. Empty publishes
+	// the original format without schema_version.
+	SchemaVersion string `json:"schema_version,omitempty" yaml:"schema_version,omitempty"`
+	// ShadowSchemaVersion, with ShadowTopicID, also publishes each supported
+	// event transformed with this schema version to the shadow topic,
+	// counting the fields where it diverges from the published message, so
+	// a new version can be tried on live traffic before switching to it
+	ShadowSchemaVersion string `json:"shadow_schema_version,omitempty" yaml:"shadow_schema_version,omitempty"`
+	// ShadowTopicID is the topic, in GCP.ProjectID, of shadow messages
+	ShadowTopicID string `json:"shadow_topic_id,omitempty" yaml:"shadow_topic_id,omitempty"`
+	// SchemaBaseURL is the external URL the webhook is reached at, such as
+	// https://webhook.example.com. When set, messages of supported events
+	// carry a schema_url attribute pointing at the JSON Schema of their
+	// version, served under /schemas/.
+	SchemaBaseURL string `json:"schema_base_url,omitempty" yaml:"schema_base_url,omitempty"`
+	// UnblockEventTTL is how long a blocked build is remembered so a
+	// build.unblocked event is published when it runs again; zero disables
+	// unblock events
+	UnblockEventTTL time.Duration `json:"unblock_event_ttl,omitempty" yaml:"unblock_event_ttl,omitempty"`
+	// JobMessagePipelines are path.Match patterns of the pipeline slugs
+	// whose build.finished events are followed by a build.job message per
+	// job of the build
+	JobMessagePipelines []string `json:"job_message_pipelines,omitempty" yaml:"job_message_pipelines,omitempty"`
+	// PingCheck publishes a ping message for each ping event and answers
+	// with the result, so Buildkite's "Test webhook" exercises publishing
+	PingCheck bool `json:"ping_check,omitempty" yaml:"ping_check,omitempty"`
+	// PingTopicID is a dedicated topic for ping messages; empty publishes
+	// them to the events topic
+	PingTopicID string `json:"ping_topic_id,omitempty" yaml:"ping_topic_id,omitempty"`
+	// PartialPayloads publishes events whose optional sections, such as
+	// sender or job, are malformed without those sections, listing them
+	// in a transform_warnings attribute, instead of rejecting the event
+	PartialPayloads bool `json:"partial_payloads,omitempty" yaml:"partial_payloads,omitempty"`
+	// LegacyPipelineAttribute publishes the pipeline's display name as the
+	// pipeline attribute, as before it became the normalized slug, for
+	// consumers whose subscription filters still match the name
+	LegacyPipelineAttribute bool `json:"legacy_pipeline_attribute,omitempty" yaml:"legacy_pipeline_attribute,omitempty"`
+	// MaxDecompressedSize caps the size in bytes of a gzip-encoded body
+	// once decompressed, so a small decompression bomb cannot exhaust
+	// memory; zero uses webhook.DefaultMaxDecompressedSize
+	MaxDecompressedSize int `json:"max_decompressed_size,omitempty" yaml:"max_decompressed_size,omitempty"`
+	// BatchPath serves an endpoint accepting a JSON array of payloads per
+	// request, such as /webhook/batch; empty disables it
+	BatchPath string `json:"batch_path,omitempty" yaml:"batch_path,omitempty"`
+	// BatchMaxItems caps the payloads in one batch; zero uses
+	// webhook.DefaultBatchMaxItems
+	BatchMaxItems int `json:"batch_max_items,omitempty" yaml:"batch_max_items,omitempty"`
+}
+
+// WebhookPathConfig configures an additional webhook endpoint. Empty
+// credentials and topic fall back to the main webhook's. Events not matching
+// every non-empty filter pattern are acknowledged without being published.
+type WebhookPathConfig struct {
+	Path       string `json:"path" yaml:"path"`
+	Token      string `json:"token,omitempty" yaml:"token,omitempty"`
+	HMACSecret string `json:"hmac_secret,omitempty" yaml:"hmac_secret,omitempty"`
+	// ProjectID defaults to GCP.ProjectID
+	ProjectID  string `json:"project_id,omitempty" yaml:"project_id,omitempty"`
+	TopicID    string `json:"topic_id,omitempty" yaml:"topic_id,omitempty"`
+	EventType  string `json:"event_type,omitempty" yaml:"event_type,omitempty"`
+	Pipeline   string `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
+	Branch     string `json:"branch,omitempty" yaml:"branch,omitempty"`
+	BuildState string `json:"build_state,omitempty" yaml:"build_state,omitempty"`
+	// Expression is a CEL condition events must also satisfy
+	Expression string `json:"expression,omitempty" yaml:"expression,omitempty"`
+	// JWT optionally accepts JWT bearer tokens on the path as an
+	// alternative to the Buildkite token
+	JWT *JWTAuthConfig `json:"jwt,omitempty" yaml:"jwt,omitempty"`
+}
+
+// JWTAuthConfig lets internal services forwarding events to a webhook path
+// authenticate with JWTs from their own issuer instead of sharing the
+// Buildkite token
+type JWTAuthConfig struct {
+	// Issuer is the iss claim tokens must carry
+	Issuer string `json:"issuer" yaml:"issuer"`
+	// Audience is the aud claim tokens must carry
+	Audience string `json:"audience" yaml:"audience"`
+	// JWKSURL serves the issuer's signing keys; empty finds them through
+	// OpenID Connect discovery on Issuer
+	JWKSURL string `json:"jwks_url,omitempty" yaml:"jwks_url,omitempty"`
+	// Subjects optionally limits tokens to these sub or verified email
+	// claims. Shared issuers such as Google mint tokens for any audience,
+	// so list the callers when using one.
+	Subjects []string `json:"subjects,omitempty" yaml:"subjects,omitempty"`
+	// ClockSkewSeconds is the skew allowed when checking token expiry;
+	// zero allows a minute
+	ClockSkewSeconds int `json:"clock_skew_seconds,omitempty" yaml:"clock_skew_seconds,omitempty"`
 }
 
+// validate checks the issuer, audience and clock skew, returning errors
+// naming the field for the caller to prefix with the path
+func (c JWTAuthConfig) validate() error {
+	switch {
+	case !strings.HasPrefix(c.Issuer, "https://"):
+		return fmt.Errorf("Issuer must be an https:// URL")
+	case c.Audience == "":
+		return fmt.Errorf("Audience is required")
+	case c.JWKSURL != "" && !strings.HasPrefix(c.JWKSURL, "https://"):
+		return fmt.Errorf("JWKSURL must be an https:// URL")
+	case c.ClockSkewSeconds < 0 || c.ClockSkewSeconds > 600:
+		return fmt.Errorf("ClockSkewSeconds must be between 0 and 600")
+	}
+	return nil
+}
+
+// Unsupported event actions
+const (
+	UnsupportedEventsPublish = "publish"
+	UnsupportedEventsDrop    = "drop"
+	UnsupportedEventsReject  = "reject"
+)
+
+// Checksum algorithms and payloads
+const (
+	ChecksumSHA256      = "sha256"
+	ChecksumSHA512      = "sha512"
+	ChecksumNone        = "none"
+	ChecksumPayloadData = "data"
+	ChecksumPayloadRaw  = "raw"
+)
+
+// MinAttributeHashKeyLength is the shortest GCP.AttributeHashKey accepted,
+// so hashed values cannot be reversed by guessing the key
+const MinAttributeHashKeyLength = 16
+
 // ServerConfig holds HTTP server related configuration
 type ServerConfig struct {
-	Port           int           `json:"port" yaml:"port"`
-	LogLevel       string        `json:"log_level" yaml:"log_level"`
+	Port     int    `json:"port" yaml:"port"`
+	LogLevel string `json:"log_level" yaml:"log_level"`
+	// LogFormat is json, text, dev or gcp for Cloud Logging structured
+	// entries; empty uses the -log-format flag's default
+	LogFormat      string        `json:"log_format" yaml:"log_format"`
 	MaxRequestSize int           `json:"max_request_size" yaml:"max_request_size"`
 	RequestTimeout time.Duration `json:"request_timeout" yaml:"request_timeout,omitempty"`
 	ReadTimeout    time.Duration `json:"read_timeout" yaml:"read_timeout,omitempty"`
 	WriteTimeout   time.Duration `json:"write_timeout" yaml:"write_timeout,omitempty"`
 	IdleTimeout    time.Duration `json:"idle_timeout" yaml:"idle_timeout,omitempty"`
+	// ReadHeaderTimeout bounds reading request headers; 0 uses ReadTimeout
+	ReadHeaderTimeout time.Duration `json:"read_header_timeout" yaml:"read_header_timeout,omitempty"`
+	// MaxHeaderBytes caps request header size; 0 uses net/http's 1 MB
+	MaxHeaderBytes int `json:"max_header_bytes" yaml:"max_header_bytes"`
+	// DisableKeepAlives closes each connection after one request
+	DisableKeepAlives bool `json:"disable_keep_alives" yaml:"disable_keep_alives"`
+	// EnableH2C serves HTTP/2 without TLS alongside HTTP/1.1, for proxies
+	// and load balancers that speak cleartext HTTP/2 to their backends
+	EnableH2C bool `json:"enable_h2c" yaml:"enable_h2c"`
+	// HTTP2MaxConcurrentStreams limits streams per HTTP/2 connection; 0 uses net/http's default
+	HTTP2MaxConcurrentStreams int `json:"http2_max_concurrent_streams" yaml:"http2_max_concurrent_streams"`
+	// MaxConnections caps simultaneous connections; further connections
+	// wait to be accepted. 0 is unlimited.
+	MaxConnections int `json:"max_connections" yaml:"max_connections"`
+	// UnixSocket is a socket path to listen on instead of Port, for a
+	// reverse proxy on the same host
+	UnixSocket string `json:"unix_socket" yaml:"unix_socket"`
+	// UnixSocketMode is the octal file mode of UnixSocket
+	UnixSocketMode string `json:"unix_socket_mode" yaml:"unix_socket_mode"`
+	// SystemdSocket serves on the socket passed by systemd socket
+	// activation (LISTEN_FDS) instead of opening one
+	SystemdSocket bool `json:"systemd_socket" yaml:"systemd_socket"`
+	// StartupRetryTimeout keeps retrying a failed startup, such as a topic
+	// that doesn't exist yet, for this long while serving 503s and failing
+	// readiness; zero exits at once
+	StartupRetryTimeout time.Duration `json:"startup_retry_timeout" yaml:"startup_retry_timeout,omitempty"`
+	// ShutdownSettle is how long shutdown keeps serving after failing
+	// readiness, so load balancers deregister the instance before its
+	// listener closes; ignored on Cloud Run
+	ShutdownSettle time.Duration `json:"shutdown_settle" yaml:"shutdown_settle,omitempty"`
+	// TimeoutHeaderCIDRs are the networks of trusted forwarders that may
+	// shorten RequestTimeout for a request with an X-Request-Timeout or
+	// grpc-timeout header
+	TimeoutHeaderCIDRs []string `json:"timeout_header_cidrs,omitempty" yaml:"timeout_header_cidrs,omitempty"`
+	// StatsWindow is the rolling window /stats averages rates over; zero
+	// uses a minute
+	StatsWindow time.Duration `json:"stats_window,omitempty" yaml:"stats_window,omitempty"`
 }
 
 // SecurityConfig holds security related configuration
 type SecurityConfig struct {
+	// RateLimit is the global number of requests allowed per RateLimitWindow
 	RateLimit int `json:"rate_limit" yaml:"rate_limit"`
+	// RateLimitBurst caps instantaneous global bursts; 0 uses RateLimit
+	RateLimitBurst int `json:"rate_limit_burst" yaml:"rate_limit_burst"`
+	// RateLimitWindow is the period the rate limits apply to, for example
+	// one second for requests per second; defaults to one minute
+	RateLimitWindow time.Duration `json:"rate_limit_window" yaml:"rate_limit_window,omitempty"`
+	// IPRateLimit is the number of requests allowed per client IP per
+	// window; 0 disables per-IP limiting
+	IPRateLimit      int `json:"ip_rate_limit" yaml:"ip_rate_limit"`
+	IPRateLimitBurst int `json:"ip_rate_limit_burst" yaml:"ip_rate_limit_burst"`
+	// TokenRateLimit is the number of requests allowed per webhook token
+	// per window; 0 disables per-token limiting
+	TokenRateLimit      int `json:"token_rate_limit" yaml:"token_rate_limit"`
+	TokenRateLimitBurst int `json:"token_rate_limit_burst" yaml:"token_rate_limit_burst"`
+	// TokenRateLimitHeader keys the token limiter by this header, such as a
+	// tenant ID; when empty it is keyed by a hash of X-Buildkite-Token
+	TokenRateLimitHeader string `json:"token_rate_limit_header" yaml:"token_rate_limit_header"`
+	// TokenRateLimitHeaderCIDRs are the networks of trusted proxies whose
+	// TokenRateLimitHeader is believed; other clients are keyed by token
+	TokenRateLimitHeaderCIDRs []string `json:"token_rate_limit_header_cidrs,omitempty" yaml:"token_rate_limit_header_cidrs,omitempty"`
+	// RateLimitBypassPaths are path patterns, such as health checks, that
+	// skip every rate limiter
+	RateLimitBypassPaths []string `json:"rate_limit_bypass_paths,omitempty" yaml:"rate_limit_bypass_paths,omitempty"`
+	// RateLimitBypassCIDRs are client networks, such as Buildkite's webhook
+	// IPs, that skip the per-IP rate limiter
+	RateLimitBypassCIDRs []string `json:"rate_limit_bypass_cidrs,omitempty" yaml:"rate_limit_bypass_cidrs,omitempty"`
+	// CORSAllowedOrigins are origins allowed to call the webhook endpoint
+	// from a browser; empty disables CORS
+	CORSAllowedOrigins []string `json:"cors_allowed_origins,omitempty" yaml:"cors_allowed_origins,omitempty"`
+	// AuthBanMaxFailures bans a client IP after this many authentication
+	// failures within AuthBanWindow; 0 disables banning
+	AuthBanMaxFailures int `json:"auth_ban_max_failures" yaml:"auth_ban_max_failures"`
+	// AuthBanWindow is the period auth failures are counted over
+	AuthBanWindow time.Duration `json:"auth_ban_window" yaml:"auth_ban_window,omitempty"`
+	// AuthBanCooldown is how long a banned IP's requests are rejected
+	AuthBanCooldown time.Duration `json:"auth_ban_cooldown" yaml:"auth_ban_cooldown,omitempty"`
+	// AuthBanExemptCIDRs are client networks that are never banned, such as
+	// a proxy whose address every request would otherwise share
+	AuthBanExemptCIDRs []string `json:"auth_ban_exempt_cidrs,omitempty" yaml:"auth_ban_exempt_cidrs,omitempty"`
+}
+
+// AdminConfig holds configuration for the optional admin listener
+type AdminConfig struct {
+	// Port for the admin listener; 0 disables it
+	Port int `json:"port" yaml:"port"`
+	// BindAddress defaults to loopback so admin endpoints are local-only
+	BindAddress string `json:"bind_address" yaml:"bind_address"`
+	// Token is a bearer token required for admin requests; when empty and
+	// OIDCIssuer is unset only loopback clients are allowed
+	Token string `json:"token" yaml:"token"`
+	// OIDCIssuer accepts admin requests bearing an ID token from this
+	// OpenID Connect issuer, alongside Token; empty disables OIDC
+	OIDCIssuer string `json:"oidc_issuer,omitempty" yaml:"oidc_issuer,omitempty"`
+	// OIDCAudience is the aud claim OIDC tokens must carry
+	OIDCAudience string `json:"oidc_audience,omitempty" yaml:"oidc_audience,omitempty"`
+	// OIDCSubjects are the sub or email claims of the callers allowed
+	// through OIDC
+	OIDCSubjects []string `json:"oidc_subjects,omitempty" yaml:"oidc_subjects,omitempty"`
+	// EnableDebug exposes net/http/pprof and expvar under /debug/
+	EnableDebug bool `json:"enable_debug" yaml:"enable_debug"`
+	// PauseStateFile records a pause made through /admin/pause so the
+	// service stays paused across restarts; empty keeps it in memory
+	PauseStateFile string `json:"pause_state_file" yaml:"pause_state_file"`
+	// PauseRetryAfter is sent as Retry-After with the 503 returned while paused
+	PauseRetryAfter time.Duration `json:"pause_retry_after" yaml:"pause_retry_after,omitempty"`
+	// RecordRequests keeps this many recent webhook requests and responses
+	// for /admin/requests; 0 disables recording
+	RecordRequests int `json:"record_requests" yaml:"record_requests"`
+	// RecordRedactFields are payload fields redacted from recorded bodies;
+	// empty uses recorder.DefaultRedactFields
+	RecordRedactFields []string `json:"record_redact_fields,omitempty" yaml:"record_redact_fields,omitempty"`
+}
+
+// DedupeConfig holds configuration for deduplicating publishes by event UUID
+type DedupeConfig struct {
+	// Backend is "memory" or "redis"; empty disables deduplication
+	Backend string `json:"backend" yaml:"backend"`
+	// RedisURL is a redis:// or rediss:// URL used by the redis backend
+	RedisURL string `json:"redis_url" yaml:"redis_url"`
+	// TTL is how long a published event UUID is remembered
+	TTL time.Duration `json:"ttl" yaml:"ttl,omitempty"`
+	// TransitionTTL is how long each build's last state is remembered so a
+	// repeated terminal state is published once; zero disables it
+	TransitionTTL time.Duration `json:"transition_ttl,omitempty" yaml:"transition_ttl,omitempty"`
+	// TransitionMaxBuilds bounds how many builds' states are remembered
+	TransitionMaxBuilds int `json:"transition_max_builds,omitempty" yaml:"transition_max_builds,omitempty"`
+}
+
+// AuditConfig holds configuration for the local index of publish outcomes
+type AuditConfig struct {
+	// Path of the SQLite database; empty disables the audit index
+	Path string `json:"path" yaml:"path"`
+	// RetentionDays is how many days of records are kept
+	RetentionDays int `json:"retention_days" yaml:"retention_days"`
+}
+
+// OwnershipConfig holds the mapping of pipelines to owning teams, published
+// as the team attribute and build metric label
+type OwnershipConfig struct {
+	// File is a YAML or JSON list of teams and their pipeline patterns;
+	// empty disables ownership
+	File string `json:"file" yaml:"file"`
+	// ReloadInterval is how often File is checked for changes; zero uses
+	// 30 seconds
+	ReloadInterval time.Duration `json:"reload_interval" yaml:"reload_interval,omitempty"`
+}
+
+// HeartbeatConfig holds the synthetic heartbeat events published to the
+// topic, so consumers can tell a quiet period from a broken pipeline
+type HeartbeatConfig struct {
+	// Interval between heartbeats; zero disables them
+	Interval time.Duration `json:"interval" yaml:"interval,omitempty"`
+	// InstanceID identifies this replica in its heartbeats; empty uses the
+	// hostname
+	InstanceID string `json:"instance_id" yaml:"instance_id"`
+}
+
+// SubscriptionLagConfig holds the monitoring of the backlog of the
+// subscriptions consuming the topic, so the producer hears when consumers
+// fall behind
+type SubscriptionLagConfig struct {
+	// Subscriptions are the IDs of subscriptions in GCP.ProjectID to
+	// monitor; empty disables monitoring
+	Subscriptions []string `json:"subscriptions,omitempty" yaml:"subscriptions,omitempty"`
+	// Interval between checks; zero uses a minute
+	Interval time.Duration `json:"interval" yaml:"interval,omitempty"`
+	// MaxAge reports a subscription as lagging once its oldest
+	// unacknowledged message is older; zero never does
+	MaxAge time.Duration `json:"max_age" yaml:"max_age,omitempty"`
+}
+
+// MaxConfirmationTimeout caps ConfirmationConfig.Timeout, keeping the
+// webhook's answer well within Buildkite's delivery timeout
+const MaxConfirmationTimeout = 30 * time.Second
+
+// ConfirmationConfig holds the feedback loop with the primary consumer for
+// critical pipelines: after publishing one of their events, the webhook
+// waits for the consumer to confirm it on a feedback topic before
+// answering Buildkite
+type ConfirmationConfig struct {
+	// Pipelines are path.Match patterns of the critical pipelines' slugs;
+	// empty disables confirmations
+	Pipelines []string `json:"pipelines,omitempty" yaml:"pipelines,omitempty"`
+	// TopicID is the feedback topic, in GCP.ProjectID, the consumer
+	// publishes confirmations to
+	TopicID string `json:"topic_id,omitempty" yaml:"topic_id,omitempty"`
+	// Timeout is how long to wait for a confirmation; zero uses 10s
+	Timeout time.Duration `json:"timeout" yaml:"timeout,omitempty"`
+}
+
+// RejectionsConfig holds the sampling of sanitized records of rejected
+// requests, for investigating spikes of auth and validation failures
+type RejectionsConfig struct {
+	// SampleRate is the fraction of rejections recorded, from 0 to 1; zero
+	// disables sampling
+	SampleRate float64 `json:"sample_rate" yaml:"sample_rate"`
+	// TopicID is the diagnostics topic records are published to, in
+	// GCP.ProjectID; empty logs them instead
+	TopicID string `json:"topic_id" yaml:"topic_id"`
+}
+
+// QuarantineConfig holds where payloads that fail to transform are kept
+// for reprocessing
+type QuarantineConfig struct {
+	// Dir is the directory quarantined payloads are written to, such as a
+	// mounted Cloud Storage bucket; empty disables quarantine
+	Dir string `json:"dir" yaml:"dir"`
+	// Acknowledge answers quarantined payloads with 202 so Buildkite does
+	// not retry them; otherwise they fail with 500
+	Acknowledge bool `json:"acknowledge" yaml:"acknowledge"`
+}
+
+// TracingConfig holds how traces are sampled and exported when tracing is
+// enabled with ENABLE_TRACING
+type TracingConfig struct {
+	// SampleRatio is the fraction of new traces sampled, from 0 to 1;
+	// traces continued from an inbound traceparent follow its decision.
+	// Zero samples every trace.
+	SampleRatio float64 `json:"sample_ratio" yaml:"sample_ratio"`
+	// OTLPInsecure sends spans to the collector without TLS when true and
+	// with TLS when false; unset uses TLS only for https:// endpoints and
+	// Honeycomb
+	OTLPInsecure *bool `json:"otlp_insecure,omitempty" yaml:"otlp_insecure,omitempty"`
+}
+
+// MetricsConfig holds configuration for how Prometheus metrics are named and
+// labelled, so several deployments can share one Prometheus
+type MetricsConfig struct {
+	// Namespace replaces the "buildkite" prefix of every metric name
+	Namespace string `json:"namespace" yaml:"namespace"`
+	// Subsystem is inserted after the namespace
+	Subsystem string `json:"subsystem" yaml:"subsystem"`
+	// ConstLabels are added to every metric, e.g. environment or region
+	ConstLabels map[string]string `json:"const_labels" yaml:"const_labels"`
+	// DropLabels removes high-cardinality pipeline, branch and team labels,
+	// either from every metric ("branch") or from one
+	// ("buildkite_builds_total:branch")
+	DropLabels []string `json:"drop_labels,omitempty" yaml:"drop_labels,omitempty"`
+	// RelabelRules rewrite pipeline, branch and team label values on every
+	// metric that has them; the first matching rule for a label applies
+	RelabelRules []RelabelRule `json:"relabel_rules,omitempty" yaml:"relabel_rules,omitempty"`
+}
+
+// RelabelRule replaces a label value matching a route-style glob, e.g.
+// collapsing every "feature/*" branch into one series
+type RelabelRule struct {
+	Label       string `json:"label" yaml:"label"`
+	Match       string `json:"match" yaml:"match"`
+	Replacement string `json:"replacement" yaml:"replacement"`
 }
 
+// metricNamePattern matches valid Prometheus metric name parts and label names
+var metricNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
 // DefaultConfig returns a configuration with sensible defaults
 func DefaultConfig() *Config {
 	return &Config{
 		GCP: GCPConfig{
-			CredentialsFile:        "credentials.json",
-			PubSubBatchSize:        100,
-			PubSubRetryMaxAttempts: 5,
+			CredentialsFile:      "credentials.json",
+			PubSubBatchSize:      100,
+			PubSubByteThreshold:  1e6,
+			PubSubDelayThreshold: 10 * time.Millisecond,
+			// Enough for a burst of several thousand webhooks, while a
+			// stalled topic blocks publishes well before memory runs out
+			PubSubMaxOutstandingMessages: 1000,
+			PubSubMaxOutstandingBytes:    100e6,
+			PubSubCompression:            boolPtr(true),
+			PubSubCompressionThreshold:   1000,
+			PubSubRetryMaxAttempts:       5,
+			DLQRetryMaxAttempts:          3,
+			CircuitBreakerThreshold:      5,
+			CircuitBreakerTimeout:        30 * time.Second,
 		},
 		Webhook: WebhookConfig{
-			Path: "/webhook",
+			Path:              "/webhook",
+			UnsupportedEvents: UnsupportedEventsPublish,
 		},
 		Server: ServerConfig{
 			Port:           8888,
@@ -76,9 +708,24 @@ func DefaultConfig() *Config {
 			ReadTimeout:    5 * time.Second,
 			WriteTimeout:   10 * time.Second,
 			IdleTimeout:    120 * time.Second,
+			UnixSocketMode: "0660",
 		},
 		Security: SecurityConfig{
-			RateLimit: 60,
+			RateLimit:       60,
+			RateLimitWindow: time.Minute,
+			AuthBanWindow:   5 * time.Minute,
+			AuthBanCooldown: 15 * time.Minute,
+		},
+		Admin: AdminConfig{
+			BindAddress:     "127.0.0.1",
+			PauseRetryAfter: time.Minute,
+		},
+		Dedupe: DedupeConfig{
+			TTL:                 24 * time.Hour,
+			TransitionMaxBuilds: 10000,
+		},
+		Audit: AuditConfig{
+			RetentionDays: 7,
 		},
 	}
 }
@@ -92,20 +739,261 @@ func (c *Config) Validate() error {
 	if c.GCP.TopicID == "" {
 		return errors.NewValidationError("GCP.TopicID cannot be empty")
 	}
+	if err := c.GCP.Credentials.validate(); err != nil {
+		return err
+	}
 	// Validate DLQ configuration
-	if c.GCP.EnableDLQ && c.GCP.DLQTopicID == "" {
+	if c.GCP.DLQRequired() && c.GCP.DLQTopicID == "" {
 		return errors.NewValidationError("GCP.DLQTopicID is required when DLQ is enabled")
 	}
+	// Pub/Sub rejects publish requests of more than 1000 messages or 10MB
+	if c.GCP.PubSubBatchSize < 0 || c.GCP.PubSubBatchSize > 1000 {
+		return errors.NewValidationError("GCP.PubSubBatchSize must be between 0 and 1000")
+	}
+	if c.GCP.PubSubByteThreshold < 0 || c.GCP.PubSubByteThreshold > 10e6 {
+		return errors.NewValidationError("GCP.PubSubByteThreshold must be between 0 and 10000000")
+	}
+	if c.GCP.PubSubDelayThreshold < 0 || c.GCP.PubSubMaxOutstandingMessages < 0 || c.GCP.PubSubCompressionThreshold < 0 {
+		return errors.NewValidationError("GCP publish settings cannot be negative")
+	}
+	if c.GCP.PubSubMaxOutstandingBytes < 0 || (c.GCP.PubSubMaxOutstandingBytes > 0 && c.GCP.PubSubMaxOutstandingBytes < c.GCP.PubSubByteThreshold) {
+		return errors.NewValidationError("GCP.PubSubMaxOutstandingBytes must be at least GCP.PubSubByteThreshold")
+	}
+	if c.GCP.PubSubRetryMaxAttempts < 0 {
+		return errors.NewValidationError("GCP.PubSubRetryMaxAttempts cannot be negative")
+	}
+	if c.GCP.DLQRetryMaxAttempts < 0 {
+		return errors.NewValidationError("GCP.DLQRetryMaxAttempts cannot be negative")
+	}
+	if c.GCP.DLQFallbackDir != "" && !c.GCP.DLQRequired() {
+		return errors.NewValidationError("GCP.DLQFallbackDir requires DLQ to be enabled")
+	}
+	for eventType, policy := range c.GCP.EventPolicies {
+		if policy.RetryMaxAttempts < 0 {
+			return errors.NewValidationError("GCP.EventPolicies[" + eventType + "].RetryMaxAttempts cannot be negative")
+		}
+		if policy.TTLSeconds < 0 {
+			return errors.NewValidationError("GCP.EventPolicies[" + eventType + "].TTLSeconds cannot be negative")
+		}
+	}
+	routeNames := make(map[string]bool)
+	for i, route := range c.GCP.Routes {
+		if route.Name == "" || route.TopicID == "" {
+			return errors.NewValidationError(fmt.Sprintf("GCP.Routes[%d] requires a name and topic_id", i))
+		}
+		if route.Name == "default" || routeNames[route.Name] {
+			return errors.NewValidationError("GCP.Routes name " + route.Name + " is reserved or duplicated")
+		}
+		routeNames[route.Name] = true
+		for _, pattern := range []string{route.EventType, route.Pipeline, route.Branch, route.BuildState} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.NewValidationError("GCP.Routes[" + route.Name + "] has an invalid pattern: " + pattern)
+			}
+		}
+		if route.Expression != "" {
+			if _, err := expression.CompileCondition(route.Name, route.Expression); err != nil {
+				return errors.NewValidationError("GCP.Routes[" + route.Name + "]: " + err.Error())
+			}
+		}
+	}
+	for i, rule := range c.GCP.AttributeRules {
+		if rule.Attribute == "" || (rule.Value == "") == (rule.ValueExpression == "") {
+			return errors.NewValidationError(fmt.Sprintf("GCP.AttributeRules[%d] requires an attribute and one of value or value_expression", i))
+		}
+		for _, pattern := range []string{rule.EventType, rule.Pipeline, rule.Branch, rule.BuildState} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.NewValidationError(fmt.Sprintf("GCP.AttributeRules[%d] has an invalid pattern: %s", i, pattern))
+			}
+		}
+		if rule.Expression != "" {
+			if _, err := expression.CompileCondition(rule.Attribute, rule.Expression); err != nil {
+				return errors.NewValidationError(fmt.Sprintf("GCP.AttributeRules[%d]: %v", i, err))
+			}
+		}
+		if rule.ValueExpression != "" {
+			if _, err := expression.CompileValue(rule.Attribute, rule.ValueExpression); err != nil {
+				return errors.NewValidationError(fmt.Sprintf("GCP.AttributeRules[%d]: %v", i, err))
+			}
+		}
+	}
+	if len(c.GCP.HashedAttributes) > 0 && len(c.GCP.AttributeHashKey) < MinAttributeHashKeyLength {
+		return errors.NewValidationError(fmt.Sprintf("GCP.AttributeHashKey of at least %d bytes is required when GCP.HashedAttributes is set", MinAttributeHashKeyLength))
+	}
+	// Validate failover configuration
+	if c.GCP.SecondaryProjectID != "" && c.GCP.SecondaryTopicID == "" {
+		return errors.NewValidationError("GCP.SecondaryTopicID is required when GCP.SecondaryProjectID is set")
+	}
+	if c.GCP.SecondaryTopicID != "" && c.GCP.SecondaryTopicID == c.GCP.TopicID &&
+		(c.GCP.SecondaryProjectID == "" || c.GCP.SecondaryProjectID == c.GCP.ProjectID) {
+		return errors.NewValidationError("GCP.SecondaryTopicID must differ from the primary topic")
+	}
+	if c.GCP.CircuitBreakerThreshold < 0 {
+		return errors.NewValidationError("GCP.CircuitBreakerThreshold cannot be negative")
+	}
+	if c.GCP.MaxPendingPublishes < 0 {
+		return errors.NewValidationError("GCP.MaxPendingPublishes cannot be negative")
+	}
+	for _, pattern := range c.GCP.HighPriorityEvents {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.NewValidationError("GCP.HighPriorityEvents has an invalid pattern: " + pattern)
+		}
+	}
+	if c.GCP.CircuitBreakerTimeout < 0 {
+		return errors.NewValidationError("GCP.CircuitBreakerTimeout cannot be negative")
+	}
+	if c.GCP.CircuitBreakerStateTTL < 0 {
+		return errors.NewValidationError("GCP.CircuitBreakerStateTTL cannot be negative")
+	}
 
 	// Check required Webhook fields - either Token or HMACSecret must be provided
 	if c.Webhook.Token == "" && c.Webhook.HMACSecret == "" {
 		return errors.NewValidationError("Webhook.Token or Webhook.HMACSecret must be provided")
 	}
+	paths := map[string]bool{c.Webhook.Path: true, "/metrics": true, "/health": true, "/ready": true, "/version": true, "/stats": true, "/schemas/": true}
+	if c.Webhook.BatchPath != "" {
+		if !strings.HasPrefix(c.Webhook.BatchPath, "/") {
+			return errors.NewValidationError("Webhook.BatchPath must start with /")
+		}
+		if paths[c.Webhook.BatchPath] {
+			return errors.NewValidationError("Webhook.BatchPath " + c.Webhook.BatchPath + " is reserved")
+		}
+		paths[c.Webhook.BatchPath] = true
+	}
+	if c.Webhook.BatchMaxItems < 0 {
+		return errors.NewValidationError("Webhook.BatchMaxItems cannot be negative")
+	}
+	for i, p := range c.Webhook.Paths {
+		if !strings.HasPrefix(p.Path, "/") {
+			return errors.NewValidationError(fmt.Sprintf("Webhook.Paths[%d].Path must start with /", i))
+		}
+		if paths[p.Path] {
+			return errors.NewValidationError("Webhook.Paths path " + p.Path + " is reserved or duplicated")
+		}
+		paths[p.Path] = true
+		for _, pattern := range []string{p.EventType, p.Pipeline, p.Branch, p.BuildState} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.NewValidationError("Webhook.Paths[" + p.Path + "] has an invalid pattern: " + pattern)
+			}
+		}
+		if p.Expression != "" {
+			if _, err := expression.CompileCondition(p.Path, p.Expression); err != nil {
+				return errors.NewValidationError("Webhook.Paths[" + p.Path + "]: " + err.Error())
+			}
+		}
+		if p.JWT != nil {
+			if err := p.JWT.validate(); err != nil {
+				return errors.NewValidationError("Webhook.Paths[" + p.Path + "].JWT." + err.Error())
+			}
+		}
+	}
+	if err := middleware.ValidateOrder(c.Webhook.Middleware); err != nil {
+		return errors.NewValidationError("Webhook.Middleware: " + err.Error())
+	}
+	if c.Webhook.SignatureTolerance < 0 || c.Webhook.SignatureTolerance > time.Hour {
+		return errors.NewValidationError("Webhook.SignatureTolerance must be between 0 and 1h")
+	}
+	if c.Webhook.SignatureFutureTolerance < 0 || c.Webhook.SignatureFutureTolerance > time.Hour {
+		return errors.NewValidationError("Webhook.SignatureFutureTolerance must be between 0 and 1h")
+	}
+	if c.Webhook.MaxDecompressedSize < 0 {
+		return errors.NewValidationError("Webhook.MaxDecompressedSize cannot be negative")
+	}
+	if c.Webhook.StrictMethods && len(c.Security.CORSAllowedOrigins) > 0 {
+		return errors.NewValidationError("Webhook.StrictMethods cannot be combined with Security.CORSAllowedOrigins, which answers OPTIONS preflight requests")
+	}
+	switch c.Webhook.UnsupportedEvents {
+	case "", UnsupportedEventsPublish, UnsupportedEventsDrop, UnsupportedEventsReject:
+	default:
+		return errors.NewValidationError("Webhook.UnsupportedEvents must be one of: publish, drop, reject")
+	}
+	switch c.Webhook.ChecksumAlgorithm {
+	case "", ChecksumSHA256, ChecksumSHA512, ChecksumNone:
+	default:
+		return errors.NewValidationError("Webhook.ChecksumAlgorithm must be one of: sha256, sha512, none")
+	}
+	switch c.Webhook.ChecksumPayload {
+	case "", ChecksumPayloadData, ChecksumPayloadRaw:
+	default:
+		return errors.NewValidationError("Webhook.ChecksumPayload must be one of: data, raw")
+	}
+	if c.Webhook.SchemaVersion != "" {
+		latest, _ := strconv.Atoi(transform.LatestSchemaVersion)
+		if v, err := strconv.Atoi(c.Webhook.SchemaVersion); err != nil || v < 1 || v > latest {
+			return errors.NewValidationError(fmt.Sprintf("Webhook.SchemaVersion must be a number from 1 to %s", transform.LatestSchemaVersion))
+		}
+	}
+	if (c.Webhook.ShadowSchemaVersion == "") != (c.Webhook.ShadowTopicID == "") {
+		return errors.NewValidationError("Webhook.ShadowSchemaVersion and Webhook.ShadowTopicID must be set together")
+	}
+	if c.Webhook.ShadowSchemaVersion != "" {
+		latest, _ := strconv.Atoi(transform.LatestSchemaVersion)
+		if v, err := strconv.Atoi(c.Webhook.ShadowSchemaVersion); err != nil || v < 1 || v > latest {
+			return errors.NewValidationError(fmt.Sprintf("Webhook.ShadowSchemaVersion must be a number from 1 to %s", transform.LatestSchemaVersion))
+		}
+		if c.Webhook.ShadowSchemaVersion == c.Webhook.SchemaVersion {
+			return errors.NewValidationError("Webhook.ShadowSchemaVersion must differ from Webhook.SchemaVersion")
+		}
+		if c.Webhook.ShadowTopicID == c.GCP.TopicID {
+			return errors.NewValidationError("Webhook.ShadowTopicID must differ from GCP.TopicID")
+		}
+	}
+	if c.Webhook.SchemaBaseURL != "" {
+		if !strings.HasPrefix(c.Webhook.SchemaBaseURL, "https://") && !strings.HasPrefix(c.Webhook.SchemaBaseURL, "http://") {
+			return errors.NewValidationError("Webhook.SchemaBaseURL must be an http:// or https:// URL")
+		}
+		if strings.ContainsAny(c.Webhook.SchemaBaseURL, "?#") {
+			return errors.NewValidationError("Webhook.SchemaBaseURL cannot have a query or fragment")
+		}
+	}
+	if c.Webhook.UnblockEventTTL != 0 && (c.Webhook.UnblockEventTTL < time.Minute || c.Webhook.UnblockEventTTL > 30*24*time.Hour) {
+		return errors.NewValidationError("Webhook.UnblockEventTTL must be between 1m and 720h")
+	}
+	for _, pattern := range c.Webhook.JobMessagePipelines {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.NewValidationError("Webhook.JobMessagePipelines has an invalid pattern: " + pattern)
+		}
+	}
+	if c.Webhook.PingTopicID != "" && !c.Webhook.PingCheck {
+		return errors.NewValidationError("Webhook.PingTopicID requires Webhook.PingCheck")
+	}
 
 	// Check Server fields
 	if c.Server.Port < 1024 || c.Server.Port > 65535 {
 		return errors.NewValidationError("Server.Port must be between 1024 and 65535")
 	}
+	if c.Server.MaxHeaderBytes < 0 {
+		return errors.NewValidationError("Server.MaxHeaderBytes must not be negative")
+	}
+	if c.Server.HTTP2MaxConcurrentStreams < 0 {
+		return errors.NewValidationError("Server.HTTP2MaxConcurrentStreams must not be negative")
+	}
+	if c.Server.MaxConnections < 0 {
+		return errors.NewValidationError("Server.MaxConnections must not be negative")
+	}
+	if c.Server.StartupRetryTimeout < 0 {
+		return errors.NewValidationError("Server.StartupRetryTimeout cannot be negative")
+	}
+	if c.Server.ShutdownSettle < 0 || c.Server.ShutdownSettle > 5*time.Minute {
+		return errors.NewValidationError("Server.ShutdownSettle must be between 0 and 5m")
+	}
+	if c.Server.StatsWindow != 0 && (c.Server.StatsWindow < time.Second || c.Server.StatsWindow > time.Hour) {
+		return errors.NewValidationError("Server.StatsWindow must be between 1s and 1h")
+	}
+	for _, cidr := range c.Server.TimeoutHeaderCIDRs {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			if _, err := netip.ParseAddr(cidr); err != nil {
+				return errors.NewValidationError("Server.TimeoutHeaderCIDRs has an invalid network: " + cidr)
+			}
+		}
+	}
+	if c.Server.UnixSocket != "" && c.Server.SystemdSocket {
+		return errors.NewValidationError("Server.UnixSocket and Server.SystemdSocket cannot both be set")
+	}
+	if c.Server.UnixSocketMode != "" {
+		if _, err := strconv.ParseUint(c.Server.UnixSocketMode, 8, 32); err != nil {
+			return errors.NewValidationError("Server.UnixSocketMode must be an octal file mode such as 0660")
+		}
+	}
 
 	validLogLevels := map[string]bool{
 		"debug": true,
@@ -118,18 +1006,215 @@ func (c *Config) Validate() error {
 	if _, ok := validLogLevels[strings.ToLower(c.Server.LogLevel)]; !ok {
 		return errors.NewValidationError("Server.LogLevel must be one of: debug, info, warn, error, fatal, trace")
 	}
+	switch c.Server.LogFormat {
+	case "", "json", "text", "dev", "gcp":
+	default:
+		return errors.NewValidationError("Server.LogFormat must be one of: json, text, dev, gcp")
+	}
 
 	// Check Security fields
 	if c.Security.RateLimit < 0 {
 		return errors.NewValidationError("Security.RateLimit cannot be negative")
 	}
+	if c.Security.RateLimitBurst < 0 || c.Security.IPRateLimitBurst < 0 || c.Security.TokenRateLimitBurst < 0 {
+		return errors.NewValidationError("Security rate limit bursts cannot be negative")
+	}
+	if c.Security.IPRateLimit < 0 || c.Security.TokenRateLimit < 0 {
+		return errors.NewValidationError("Security.IPRateLimit and Security.TokenRateLimit cannot be negative")
+	}
+	if c.Security.RateLimitWindow != 0 && (c.Security.RateLimitWindow < time.Second || c.Security.RateLimitWindow > time.Hour) {
+		return errors.NewValidationError("Security.RateLimitWindow must be between 1s and 1h")
+	}
+	for _, pattern := range c.Security.RateLimitBypassPaths {
+		if _, err := path.Match(pattern, ""); err != nil || !strings.HasPrefix(pattern, "/") {
+			return errors.NewValidationError("Security.RateLimitBypassPaths has an invalid pattern: " + pattern)
+		}
+	}
+	if c.Security.TokenRateLimitHeader != "" && len(c.Security.TokenRateLimitHeaderCIDRs) == 0 {
+		return errors.NewValidationError("Security.TokenRateLimitHeader requires Security.TokenRateLimitHeaderCIDRs")
+	}
+	for _, cidr := range c.Security.TokenRateLimitHeaderCIDRs {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			if _, err := netip.ParseAddr(cidr); err != nil {
+				return errors.NewValidationError("Security.TokenRateLimitHeaderCIDRs has an invalid network: " + cidr)
+			}
+		}
+	}
+	for _, cidr := range c.Security.RateLimitBypassCIDRs {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			if _, err := netip.ParseAddr(cidr); err != nil {
+				return errors.NewValidationError("Security.RateLimitBypassCIDRs has an invalid network: " + cidr)
+			}
+		}
+	}
+	for _, origin := range c.Security.CORSAllowedOrigins {
+		if err := security.ValidateOrigin(origin); err != nil {
+			return errors.NewValidationError("Security.CORSAllowedOrigins: " + err.Error())
+		}
+	}
+	if c.Security.AuthBanMaxFailures < 0 {
+		return errors.NewValidationError("Security.AuthBanMaxFailures cannot be negative")
+	}
+	if c.Security.AuthBanMaxFailures > 0 {
+		if c.Security.AuthBanWindow < time.Second || c.Security.AuthBanWindow > 24*time.Hour {
+			return errors.NewValidationError("Security.AuthBanWindow must be between 1s and 24h")
+		}
+		if c.Security.AuthBanCooldown < time.Second || c.Security.AuthBanCooldown > 7*24*time.Hour {
+			return errors.NewValidationError("Security.AuthBanCooldown must be between 1s and 168h")
+		}
+	}
+	for _, cidr := range c.Security.AuthBanExemptCIDRs {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			if _, err := netip.ParseAddr(cidr); err != nil {
+				return errors.NewValidationError("Security.AuthBanExemptCIDRs has an invalid network: " + cidr)
+			}
+		}
+	}
+
+	// Check Admin fields
+	if c.Admin.Port != 0 {
+		if c.Admin.Port < 1024 || c.Admin.Port > 65535 {
+			return errors.NewValidationError("Admin.Port must be between 1024 and 65535")
+		}
+		if c.Admin.Port == c.Server.Port {
+			return errors.NewValidationError("Admin.Port must differ from Server.Port")
+		}
+	}
+	if c.Admin.OIDCIssuer != "" {
+		// Signing keys fetched over plain HTTP could be swapped in transit
+		if !strings.HasPrefix(c.Admin.OIDCIssuer, "https://") {
+			return errors.NewValidationError("Admin.OIDCIssuer must be an https URL")
+		}
+		if c.Admin.OIDCAudience == "" {
+			return errors.NewValidationError("Admin.OIDCAudience is required when Admin.OIDCIssuer is set")
+		}
+		if len(c.Admin.OIDCSubjects) == 0 {
+			return errors.NewValidationError("Admin.OIDCSubjects is required when Admin.OIDCIssuer is set")
+		}
+	} else if c.Admin.OIDCAudience != "" || len(c.Admin.OIDCSubjects) > 0 {
+		return errors.NewValidationError("Admin.OIDCIssuer is required when Admin.OIDCAudience or Admin.OIDCSubjects is set")
+	}
+	if c.Admin.EnableDebug && c.Admin.Port == 0 {
+		return errors.NewValidationError("Admin.Port is required when Admin.EnableDebug is set")
+	}
+	if c.Admin.PauseRetryAfter < 0 || c.Admin.PauseRetryAfter > time.Hour {
+		return errors.NewValidationError("Admin.PauseRetryAfter must be between 0 and 1h")
+	}
+	if c.Admin.RecordRequests < 0 || c.Admin.RecordRequests > 10000 {
+		return errors.NewValidationError("Admin.RecordRequests must be between 0 and 10000")
+	}
+	if c.Admin.RecordRequests > 0 && c.Admin.Port == 0 {
+		return errors.NewValidationError("Admin.Port is required when Admin.RecordRequests is set")
+	}
+
+	// Check Dedupe fields
+	switch c.Dedupe.Backend {
+	case "", "memory":
+	case "redis":
+		if c.Dedupe.RedisURL == "" {
+			return errors.NewValidationError("Dedupe.RedisURL is required for the redis backend")
+		}
+	default:
+		return errors.NewValidationError("Dedupe.Backend must be one of: memory, redis")
+	}
+	if c.Dedupe.Backend != "" && c.Dedupe.TTL <= 0 {
+		return errors.NewValidationError("Dedupe.TTL must be positive")
+	}
+	if c.Dedupe.TransitionTTL < 0 {
+		return errors.NewValidationError("Dedupe.TransitionTTL must not be negative")
+	}
+	if c.Dedupe.TransitionTTL > 0 && c.Dedupe.TransitionMaxBuilds <= 0 {
+		return errors.NewValidationError("Dedupe.TransitionMaxBuilds must be positive when Dedupe.TransitionTTL is set")
+	}
+
+	// Check Audit fields
+	if c.Audit.Path != "" && c.Audit.RetentionDays < 1 {
+		return errors.NewValidationError("Audit.RetentionDays must be at least 1")
+	}
+
+	// Check Ownership fields
+	if c.Ownership.ReloadInterval < 0 {
+		return errors.NewValidationError("Ownership.ReloadInterval cannot be negative")
+	}
+
+	// Check Heartbeat fields
+	if c.Heartbeat.Interval < 0 {
+		return errors.NewValidationError("Heartbeat.Interval cannot be negative")
+	}
+
+	// Check SubscriptionLag fields
+	if c.SubscriptionLag.Interval < 0 {
+		return errors.NewValidationError("SubscriptionLag.Interval cannot be negative")
+	}
+	if c.SubscriptionLag.MaxAge < 0 {
+		return errors.NewValidationError("SubscriptionLag.MaxAge cannot be negative")
+	}
+
+	// Check Confirmation fields
+	if (len(c.Confirmation.Pipelines) == 0) != (c.Confirmation.TopicID == "") {
+		return errors.NewValidationError("Confirmation.Pipelines and Confirmation.TopicID must be set together")
+	}
+	for _, pattern := range c.Confirmation.Pipelines {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.NewValidationError("Confirmation.Pipelines has an invalid pattern: " + pattern)
+		}
+	}
+	if c.Confirmation.TopicID != "" && c.Confirmation.TopicID == c.GCP.TopicID {
+		return errors.NewValidationError("Confirmation.TopicID must differ from GCP.TopicID")
+	}
+	if c.Confirmation.Timeout < 0 || c.Confirmation.Timeout > MaxConfirmationTimeout {
+		return errors.NewValidationError(fmt.Sprintf("Confirmation.Timeout must be between 0 and %s", MaxConfirmationTimeout))
+	}
+
+	// Check Rejections fields
+	if c.Rejections.SampleRate < 0 || c.Rejections.SampleRate > 1 {
+		return errors.NewValidationError("Rejections.SampleRate must be between 0 and 1")
+	}
+	if c.Quarantine.Acknowledge && c.Quarantine.Dir == "" {
+		return errors.NewValidationError("Quarantine.Acknowledge requires Quarantine.Dir")
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		return errors.NewValidationError("Tracing.SampleRatio must be between 0 and 1")
+	}
+
+	// Check Metrics fields
+	if c.Metrics.Namespace != "" && !metricNamePattern.MatchString(c.Metrics.Namespace) {
+		return errors.NewValidationError("Metrics.Namespace must contain only letters, digits and underscores")
+	}
+	if c.Metrics.Subsystem != "" && !metricNamePattern.MatchString(c.Metrics.Subsystem) {
+		return errors.NewValidationError("Metrics.Subsystem must contain only letters, digits and underscores")
+	}
+	for name := range c.Metrics.ConstLabels {
+		if !metricNamePattern.MatchString(name) || strings.HasPrefix(name, "__") {
+			return errors.NewValidationError(fmt.Sprintf("Metrics.ConstLabels has invalid label name %q", name))
+		}
+	}
+	for _, entry := range c.Metrics.DropLabels {
+		metric, label, ok := strings.Cut(entry, ":")
+		if (ok && !metricNamePattern.MatchString(metric)) || !metricNamePattern.MatchString(label) {
+			return errors.NewValidationError(fmt.Sprintf("Metrics.DropLabels has invalid entry %q", entry))
+		}
+	}
+	for i, rule := range c.Metrics.RelabelRules {
+		if !metricNamePattern.MatchString(rule.Label) {
+			return errors.NewValidationError(fmt.Sprintf("Metrics.RelabelRules[%d] has invalid label name %q", i, rule.Label))
+		}
+		if _, err := path.Match(rule.Match, ""); err != nil || rule.Match == "" {
+			return errors.NewValidationError(fmt.Sprintf("Metrics.RelabelRules[%d] has an invalid pattern %q", i, rule.Match))
+		}
+	}
 
 	return nil
 }
 
 // LoadFromEnv loads configuration from environment variables
 func LoadFromEnv() (*Config, error) {
-	cfg := DefaultConfig()
+	return loadFromEnv(DefaultConfig())
+}
+
+// loadFromEnv sets the values of environment variables in cfg
+func loadFromEnv(cfg *Config) (*Config, error) {
+	cfg.Deprecated = deprecatedEnv()
 
 	// Load GCP config
 	if val := os.Getenv("PROJECT_ID"); val != "" {
@@ -141,11 +1226,53 @@ func LoadFromEnv() (*Config, error) {
 	if val := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); val != "" {
 		cfg.GCP.CredentialsFile = val
 	}
+	if val := os.Getenv("GCP_CREDENTIALS_MODE"); val != "" {
+		cfg.GCP.Credentials.Mode = strings.ToLower(val)
+	}
+	if val := os.Getenv("GCP_CREDENTIALS_FILE"); val != "" {
+		cfg.GCP.Credentials.File = val
+	}
+	if val := os.Getenv("GCP_IMPERSONATE_SERVICE_ACCOUNT"); val != "" {
+		cfg.GCP.Credentials.TargetPrincipal = val
+	}
+	if val := os.Getenv("GCP_IMPERSONATE_DELEGATES"); val != "" {
+		cfg.GCP.Credentials.Delegates = splitList(val)
+	}
 	if val := os.Getenv("PUBSUB_BATCH_SIZE"); val != "" {
 		if size, err := strconv.Atoi(val); err == nil && size > 0 {
 			cfg.GCP.PubSubBatchSize = size
 		}
 	}
+	if val := os.Getenv("PUBSUB_BYTE_THRESHOLD"); val != "" {
+		if bytes, err := strconv.Atoi(val); err == nil && bytes > 0 {
+			cfg.GCP.PubSubByteThreshold = bytes
+		}
+	}
+	if val := os.Getenv("PUBSUB_DELAY_THRESHOLD_MS"); val != "" {
+		if delay, err := strconv.Atoi(val); err == nil && delay > 0 {
+			cfg.GCP.PubSubDelayThreshold = time.Duration(delay) * time.Millisecond
+		}
+	}
+	if val := os.Getenv("PUBSUB_MAX_OUTSTANDING_MESSAGES"); val != "" {
+		if messages, err := strconv.Atoi(val); err == nil && messages > 0 {
+			cfg.GCP.PubSubMaxOutstandingMessages = messages
+		}
+	}
+	if val := os.Getenv("PUBSUB_MAX_OUTSTANDING_BYTES"); val != "" {
+		if bytes, err := strconv.Atoi(val); err == nil && bytes > 0 {
+			cfg.GCP.PubSubMaxOutstandingBytes = bytes
+		}
+	}
+	if val := os.Getenv("PUBSUB_COMPRESSION"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			cfg.GCP.PubSubCompression = &enabled
+		}
+	}
+	if val := os.Getenv("PUBSUB_COMPRESSION_THRESHOLD"); val != "" {
+		if bytes, err := strconv.Atoi(val); err == nil && bytes >= 0 {
+			cfg.GCP.PubSubCompressionThreshold = bytes
+		}
+	}
 	if val := os.Getenv("PUBSUB_RETRY_MAX_ATTEMPTS"); val != "" {
 		if attempts, err := strconv.Atoi(val); err == nil && attempts > 0 {
 			cfg.GCP.PubSubRetryMaxAttempts = attempts
@@ -157,6 +1284,101 @@ func LoadFromEnv() (*Config, error) {
 	if val := os.Getenv("DLQ_TOPIC_ID"); val != "" {
 		cfg.GCP.DLQTopicID = val
 	}
+	if val := os.Getenv("DLQ_RETRY_MAX_ATTEMPTS"); val != "" {
+		if attempts, err := strconv.Atoi(val); err == nil && attempts > 0 {
+			cfg.GCP.DLQRetryMaxAttempts = attempts
+		}
+	}
+	if val := os.Getenv("DLQ_FALLBACK_DIR"); val != "" {
+		cfg.GCP.DLQFallbackDir = val
+	}
+	if val := os.Getenv("SECONDARY_PROJECT_ID"); val != "" {
+		cfg.GCP.SecondaryProjectID = val
+	}
+	if val := os.Getenv("SECONDARY_TOPIC_ID"); val != "" {
+		cfg.GCP.SecondaryTopicID = val
+	}
+	if val := os.Getenv("CIRCUIT_BREAKER_THRESHOLD"); val != "" {
+		if threshold, err := strconv.Atoi(val); err == nil && threshold > 0 {
+			cfg.GCP.CircuitBreakerThreshold = threshold
+		}
+	}
+	if val := os.Getenv("CIRCUIT_BREAKER_TIMEOUT"); val != "" {
+		if timeout, err := strconv.Atoi(val); err == nil && timeout > 0 {
+			cfg.GCP.CircuitBreakerTimeout = time.Duration(timeout) * time.Second
+		}
+	}
+	if val := os.Getenv("CIRCUIT_BREAKER_STATE"); val != "" {
+		cfg.GCP.CircuitBreakerState = val
+	}
+	if val := os.Getenv("CIRCUIT_BREAKER_STATE_TTL"); val != "" {
+		if ttl, err := strconv.Atoi(val); err == nil && ttl > 0 {
+			cfg.GCP.CircuitBreakerStateTTL = time.Duration(ttl) * time.Second
+		}
+	}
+	if val := os.Getenv("MAX_PENDING_PUBLISHES"); val != "" {
+		if pending, err := strconv.Atoi(val); err == nil && pending >= 0 {
+			cfg.GCP.MaxPendingPublishes = pending
+		}
+	}
+	if val := os.Getenv("HIGH_PRIORITY_EVENTS"); val != "" {
+		cfg.GCP.HighPriorityEvents = splitList(val)
+	}
+	if val := os.Getenv("ATTRIBUTE_ALLOW_LIST"); val != "" {
+		cfg.GCP.AttributeAllowList = splitList(val)
+	}
+	if val := os.Getenv("HASHED_ATTRIBUTES"); val != "" {
+		cfg.GCP.HashedAttributes = splitList(val)
+	}
+	if val := os.Getenv("ATTRIBUTE_HASH_KEY"); val != "" {
+		cfg.GCP.AttributeHashKey = val
+	}
+	// EVENT_RETRY_MAX_ATTEMPTS, EVENT_DLQ and EVENT_TTL take comma-separated
+	// event=value pairs, e.g. "build.finished=10,agent.connected=1"
+	if val := os.Getenv("EVENT_RETRY_MAX_ATTEMPTS"); val != "" {
+		for eventType, value := range parseEventOverrides(val) {
+			if attempts, err := strconv.Atoi(value); err == nil && attempts > 0 {
+				policy := cfg.GCP.EventPolicies[eventType]
+				policy.RetryMaxAttempts = attempts
+				setEventPolicy(&cfg.GCP, eventType, policy)
+			}
+		}
+	}
+	if val := os.Getenv("EVENT_DLQ"); val != "" {
+		for eventType, value := range parseEventOverrides(val) {
+			enabled := strings.ToLower(value) == "true" || value == "1"
+			policy := cfg.GCP.EventPolicies[eventType]
+			policy.EnableDLQ = &enabled
+			setEventPolicy(&cfg.GCP, eventType, policy)
+		}
+	}
+	if val := os.Getenv("EVENT_TTL"); val != "" {
+		for eventType, value := range parseEventOverrides(val) {
+			if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+				policy := cfg.GCP.EventPolicies[eventType]
+				policy.TTLSeconds = seconds
+				setEventPolicy(&cfg.GCP, eventType, policy)
+			}
+		}
+	}
+	// ROUTES is a JSON array of routes, e.g.
+	// [{"name":"prod","topic_id":"prod-events","branch":"release/*"}]
+	if val := os.Getenv("ROUTES"); val != "" {
+		var routes []RouteConfig
+		if err := json.Unmarshal([]byte(val), &routes); err != nil {
+			return nil, errors.NewValidationError("ROUTES must be a JSON array of routes: " + err.Error())
+		}
+		cfg.GCP.Routes = routes
+	}
+	// ATTRIBUTE_RULES is a JSON array of rules, e.g.
+	// [{"attribute":"team","value":"payments","pipeline":"payments-*"}]
+	if val := os.Getenv("ATTRIBUTE_RULES"); val != "" {
+		var rules []AttributeRuleConfig
+		if err := json.Unmarshal([]byte(val), &rules); err != nil {
+			return nil, errors.NewValidationError("ATTRIBUTE_RULES must be a JSON array of rules: " + err.Error())
+		}
+		cfg.GCP.AttributeRules = rules
+	}
 
 	// Load Webhook config
 	if val := os.Getenv("BUILDKITE_WEBHOOK_TOKEN"); val != "" {
@@ -165,94 +1387,648 @@ func LoadFromEnv() (*Config, error) {
 	if val := os.Getenv("BUILDKITE_WEBHOOK_HMAC_SECRET"); val != "" {
 		cfg.Webhook.HMACSecret = val
 	}
-	if val := os.Getenv("WEBHOOK_PATH"); val != "" {
-		cfg.Webhook.Path = val
+	if val := os.Getenv("WEBHOOK_PATH"); val != "" {
+		cfg.Webhook.Path = val
+	}
+	if val := os.Getenv("ENABLE_SCHEMA_DRIFT_DETECTION"); val != "" {
+		cfg.Webhook.DetectSchemaDrift = strings.ToLower(val) == "true" || val == "1"
+	}
+	if val := os.Getenv("UNSUPPORTED_EVENTS"); val != "" {
+		cfg.Webhook.UnsupportedEvents = strings.ToLower(val)
+	}
+	if val := os.Getenv("CHECKSUM_ALGORITHM"); val != "" {
+		cfg.Webhook.ChecksumAlgorithm = strings.ToLower(val)
+	}
+	if val := os.Getenv("CHECKSUM_PAYLOAD"); val != "" {
+		cfg.Webhook.ChecksumPayload = strings.ToLower(val)
+	}
+	if val := os.Getenv("SCHEMA_VERSION"); val != "" {
+		cfg.Webhook.SchemaVersion = val
+	}
+	if val := os.Getenv("SHADOW_SCHEMA_VERSION"); val != "" {
+		cfg.Webhook.ShadowSchemaVersion = val
+	}
+	if val := os.Getenv("SHADOW_TOPIC_ID"); val != "" {
+		cfg.Webhook.ShadowTopicID = val
+	}
+	if val := os.Getenv("SCHEMA_BASE_URL"); val != "" {
+		cfg.Webhook.SchemaBaseURL = val
+	}
+	if val := os.Getenv("UNBLOCK_EVENT_TTL"); val != "" {
+		if ttl, err := strconv.Atoi(val); err == nil && ttl >= 0 {
+			cfg.Webhook.UnblockEventTTL = time.Duration(ttl) * time.Second
+		}
+	}
+	if val := os.Getenv("JOB_MESSAGE_PIPELINES"); val != "" {
+		cfg.Webhook.JobMessagePipelines = splitList(val)
+	}
+	if val := os.Getenv("PING_CHECK"); val != "" {
+		cfg.Webhook.PingCheck = strings.ToLower(val) == "true" || val == "1"
+	}
+	if val := os.Getenv("PING_TOPIC_ID"); val != "" {
+		cfg.Webhook.PingTopicID = val
+	}
+	if val := os.Getenv("PARTIAL_PAYLOADS"); val != "" {
+		cfg.Webhook.PartialPayloads = strings.ToLower(val) == "true" || val == "1"
+	}
+	if val := os.Getenv("LEGACY_PIPELINE_ATTRIBUTE"); val != "" {
+		cfg.Webhook.LegacyPipelineAttribute = strings.ToLower(val) == "true" || val == "1"
+	}
+	if val := os.Getenv("MAX_DECOMPRESSED_SIZE"); val != "" {
+		if size, err := strconv.Atoi(val); err == nil && size > 0 {
+			cfg.Webhook.MaxDecompressedSize = size
+		}
+	}
+	if val := os.Getenv("WEBHOOK_BATCH_PATH"); val != "" {
+		cfg.Webhook.BatchPath = val
+	}
+	if val := os.Getenv("WEBHOOK_BATCH_MAX_ITEMS"); val != "" {
+		if items, err := strconv.Atoi(val); err == nil && items > 0 {
+			cfg.Webhook.BatchMaxItems = items
+		}
+	}
+	// WEBHOOK_PATHS is a JSON array of paths, e.g.
+	// [{"path":"/webhook/agents","event_type":"agent.*","topic_id":"agent-events"}]
+	if val := os.Getenv("WEBHOOK_PATHS"); val != "" {
+		var webhookPaths []WebhookPathConfig
+		if err := json.Unmarshal([]byte(val), &webhookPaths); err != nil {
+			return nil, errors.NewValidationError("WEBHOOK_PATHS must be a JSON array of paths: " + err.Error())
+		}
+		cfg.Webhook.Paths = webhookPaths
+	}
+	// WEBHOOK_MIDDLEWARE is a comma-separated list, outermost first, e.g.
+	// "request_id,logging,rate_limit,timeout"
+	if val := os.Getenv("WEBHOOK_MIDDLEWARE"); val != "" {
+		cfg.Webhook.Middleware = splitList(val)
+	}
+	if val := os.Getenv("WEBHOOK_STRICT_METHODS"); val != "" {
+		cfg.Webhook.StrictMethods = strings.ToLower(val) == "true" || val == "1"
+	}
+	if val := os.Getenv("SERVER_TIMING"); val != "" {
+		cfg.Webhook.ServerTiming = strings.ToLower(val) == "true" || val == "1"
+	}
+	if val := getenv("SIGNATURE_TOLERANCE"); val != "" {
+		if seconds, err := strconv.Atoi(val); err == nil && seconds > 0 {
+			cfg.Webhook.SignatureTolerance = time.Duration(seconds) * time.Second
+		}
+	}
+	if val := getenv("SIGNATURE_FUTURE_TOLERANCE"); val != "" {
+		if seconds, err := strconv.Atoi(val); err == nil && seconds > 0 {
+			cfg.Webhook.SignatureFutureTolerance = time.Duration(seconds) * time.Second
+		}
+	}
+	if val := os.Getenv("CLOCK_CHECK_SERVER"); val != "" {
+		cfg.Webhook.ClockCheckServer = val
+	}
+	if val := os.Getenv("DELIVERY_ATTEMPT_HEADER"); val != "" {
+		cfg.Webhook.DeliveryAttemptHeader = val
+	}
+
+	// Load Server config
+	if val := os.Getenv("PORT"); val != "" {
+		if port, err := strconv.Atoi(val); err == nil {
+			cfg.Server.Port = port
+		}
+	}
+	if val := os.Getenv("LOG_LEVEL"); val != "" {
+		cfg.Server.LogLevel = val
+	}
+	if val := os.Getenv("LOG_FORMAT"); val != "" {
+		cfg.Server.LogFormat = val
+	}
+	if val := os.Getenv("MAX_REQUEST_SIZE"); val != "" {
+		if size, err := strconv.Atoi(val); err == nil && size > 0 {
+			cfg.Server.MaxRequestSize = size
+		}
+	}
+	if val := os.Getenv("REQUEST_TIMEOUT"); val != "" {
+		if timeout, err := strconv.Atoi(val); err == nil && timeout > 0 {
+			cfg.Server.RequestTimeout = time.Duration(timeout) * time.Second
+		}
+	}
+	if val := os.Getenv("READ_TIMEOUT"); val != "" {
+		if timeout, err := strconv.Atoi(val); err == nil && timeout > 0 {
+			cfg.Server.ReadTimeout = time.Duration(timeout) * time.Second
+		}
+	}
+	if val := os.Getenv("WRITE_TIMEOUT"); val != "" {
+		if timeout, err := strconv.Atoi(val); err == nil && timeout > 0 {
+			cfg.Server.WriteTimeout = time.Duration(timeout) * time.Second
+		}
+	}
+	if val := os.Getenv("IDLE_TIMEOUT"); val != "" {
+		if timeout, err := strconv.Atoi(val); err == nil && timeout > 0 {
+			cfg.Server.IdleTimeout = time.Duration(timeout) * time.Second
+		}
+	}
+	if val := os.Getenv("READ_HEADER_TIMEOUT"); val != "" {
+		if timeout, err := strconv.Atoi(val); err == nil && timeout > 0 {
+			cfg.Server.ReadHeaderTimeout = time.Duration(timeout) * time.Second
+		}
+	}
+	if val := os.Getenv("MAX_HEADER_BYTES"); val != "" {
+		if size, err := strconv.Atoi(val); err == nil && size > 0 {
+			cfg.Server.MaxHeaderBytes = size
+		}
+	}
+	if val := os.Getenv("DISABLE_KEEP_ALIVES"); val != "" {
+		cfg.Server.DisableKeepAlives = strings.ToLower(val) == "true" || val == "1"
+	}
+	if val := os.Getenv("ENABLE_H2C"); val != "" {
+		cfg.Server.EnableH2C = strings.ToLower(val) == "true" || val == "1"
+	}
+	if val := os.Getenv("HTTP2_MAX_CONCURRENT_STREAMS"); val != "" {
+		if streams, err := strconv.Atoi(val); err == nil && streams > 0 {
+			cfg.Server.HTTP2MaxConcurrentStreams = streams
+		}
+	}
+	if val := os.Getenv("MAX_CONNECTIONS"); val != "" {
+		if conns, err := strconv.Atoi(val); err == nil && conns > 0 {
+			cfg.Server.MaxConnections = conns
+		}
+	}
+	if val := os.Getenv("UNIX_SOCKET"); val != "" {
+		cfg.Server.UnixSocket = val
+	}
+	if val := os.Getenv("UNIX_SOCKET_MODE"); val != "" {
+		cfg.Server.UnixSocketMode = val
+	}
+	if val := os.Getenv("SYSTEMD_SOCKET"); val != "" {
+		cfg.Server.SystemdSocket = strings.ToLower(val) == "true" || val == "1"
+	}
+	if val := os.Getenv("STARTUP_RETRY_TIMEOUT"); val != "" {
+		if timeout, err := strconv.Atoi(val); err == nil && timeout > 0 {
+			cfg.Server.StartupRetryTimeout = time.Duration(timeout) * time.Second
+		}
+	}
+	if val := os.Getenv("SHUTDOWN_SETTLE"); val != "" {
+		if settle, err := strconv.Atoi(val); err == nil {
+			cfg.Server.ShutdownSettle = time.Duration(settle) * time.Second
+		}
+	}
+	if val := os.Getenv("REQUEST_TIMEOUT_HEADER_CIDRS"); val != "" {
+		cfg.Server.TimeoutHeaderCIDRs = splitList(val)
+	}
+	if val := os.Getenv("STATS_WINDOW"); val != "" {
+		if window, err := strconv.Atoi(val); err == nil {
+			cfg.Server.StatsWindow = time.Duration(window) * time.Second
+		}
+	}
+
+	// Load Security config
+	if val := os.Getenv("RATE_LIMIT"); val != "" {
+		if limit, err := strconv.Atoi(val); err == nil && limit >= 0 {
+			cfg.Security.RateLimit = limit
+		}
+	}
+	if val := os.Getenv("RATE_LIMIT_BURST"); val != "" {
+		if burst, err := strconv.Atoi(val); err == nil && burst >= 0 {
+			cfg.Security.RateLimitBurst = burst
+		}
+	}
+	if val := os.Getenv("RATE_LIMIT_WINDOW"); val != "" {
+		if window, err := strconv.Atoi(val); err == nil && window > 0 {
+			cfg.Security.RateLimitWindow = time.Duration(window) * time.Second
+		}
+	}
+	if val := os.Getenv("IP_RATE_LIMIT"); val != "" {
+		if limit, err := strconv.Atoi(val); err == nil && limit >= 0 {
+			cfg.Security.IPRateLimit = limit
+		}
+	}
+	if val := os.Getenv("IP_RATE_LIMIT_BURST"); val != "" {
+		if burst, err := strconv.Atoi(val); err == nil && burst >= 0 {
+			cfg.Security.IPRateLimitBurst = burst
+		}
+	}
+	if val := os.Getenv("TOKEN_RATE_LIMIT"); val != "" {
+		if limit, err := strconv.Atoi(val); err == nil && limit >= 0 {
+			cfg.Security.TokenRateLimit = limit
+		}
+	}
+	if val := os.Getenv("TOKEN_RATE_LIMIT_BURST"); val != "" {
+		if burst, err := strconv.Atoi(val); err == nil && burst >= 0 {
+			cfg.Security.TokenRateLimitBurst = burst
+		}
+	}
+	if val := os.Getenv("TOKEN_RATE_LIMIT_HEADER"); val != "" {
+		cfg.Security.TokenRateLimitHeader = val
+	}
+	if val := os.Getenv("TOKEN_RATE_LIMIT_HEADER_CIDRS"); val != "" {
+		cfg.Security.TokenRateLimitHeaderCIDRs = splitList(val)
+	}
+	if val := os.Getenv("RATE_LIMIT_BYPASS_PATHS"); val != "" {
+		cfg.Security.RateLimitBypassPaths = splitList(val)
+	}
+	if val := os.Getenv("RATE_LIMIT_BYPASS_CIDRS"); val != "" {
+		cfg.Security.RateLimitBypassCIDRs = splitList(val)
+	}
+	if val := os.Getenv("CORS_ALLOWED_ORIGINS"); val != "" {
+		cfg.Security.CORSAllowedOrigins = splitList(val)
+	}
+	if val := os.Getenv("AUTH_BAN_MAX_FAILURES"); val != "" {
+		if failures, err := strconv.Atoi(val); err == nil && failures >= 0 {
+			cfg.Security.AuthBanMaxFailures = failures
+		}
+	}
+	if val := os.Getenv("AUTH_BAN_WINDOW"); val != "" {
+		if window, err := strconv.Atoi(val); err == nil && window > 0 {
+			cfg.Security.AuthBanWindow = time.Duration(window) * time.Second
+		}
+	}
+	if val := os.Getenv("AUTH_BAN_COOLDOWN"); val != "" {
+		if cooldown, err := strconv.Atoi(val); err == nil && cooldown > 0 {
+			cfg.Security.AuthBanCooldown = time.Duration(cooldown) * time.Second
+		}
+	}
+	if val := os.Getenv("AUTH_BAN_EXEMPT_CIDRS"); val != "" {
+		cfg.Security.AuthBanExemptCIDRs = splitList(val)
+	}
+
+	// Load Admin config
+	if val := os.Getenv("ADMIN_PORT"); val != "" {
+		if port, err := strconv.Atoi(val); err == nil {
+			cfg.Admin.Port = port
+		}
+	}
+	if val := os.Getenv("ADMIN_BIND_ADDRESS"); val != "" {
+		cfg.Admin.BindAddress = val
+	}
+	if val := os.Getenv("ADMIN_TOKEN"); val != "" {
+		cfg.Admin.Token = val
+	}
+	if val := os.Getenv("ADMIN_OIDC_ISSUER"); val != "" {
+		cfg.Admin.OIDCIssuer = val
+	}
+	if val := os.Getenv("ADMIN_OIDC_AUDIENCE"); val != "" {
+		cfg.Admin.OIDCAudience = val
+	}
+	if val := os.Getenv("ADMIN_OIDC_SUBJECTS"); val != "" {
+		cfg.Admin.OIDCSubjects = splitList(val)
+	}
+	if val := os.Getenv("ENABLE_DEBUG_ENDPOINTS"); val != "" {
+		cfg.Admin.EnableDebug = strings.ToLower(val) == "true" || val == "1"
+	}
+	if val := os.Getenv("PAUSE_STATE_FILE"); val != "" {
+		cfg.Admin.PauseStateFile = val
+	}
+	if val := os.Getenv("PAUSE_RETRY_AFTER"); val != "" {
+		if seconds, err := strconv.Atoi(val); err == nil && seconds > 0 {
+			cfg.Admin.PauseRetryAfter = time.Duration(seconds) * time.Second
+		}
+	}
+	if val := os.Getenv("RECORD_REQUESTS"); val != "" {
+		if n, err := strconv.Atoi(val); err == nil {
+			cfg.Admin.RecordRequests = n
+		}
+	}
+	if val := os.Getenv("RECORD_REDACT_FIELDS"); val != "" {
+		cfg.Admin.RecordRedactFields = splitList(val)
+	}
+
+	// Load Dedupe config
+	if val := os.Getenv("DEDUPE_BACKEND"); val != "" {
+		cfg.Dedupe.Backend = strings.ToLower(val)
+	}
+	if val := os.Getenv("DEDUPE_REDIS_URL"); val != "" {
+		cfg.Dedupe.RedisURL = val
+	}
+	if val := os.Getenv("DEDUPE_TTL"); val != "" {
+		if ttl, err := strconv.Atoi(val); err == nil && ttl > 0 {
+			cfg.Dedupe.TTL = time.Duration(ttl) * time.Second
+		}
+	}
+	if val := os.Getenv("DEDUPE_TRANSITION_TTL"); val != "" {
+		if ttl, err := strconv.Atoi(val); err == nil {
+			cfg.Dedupe.TransitionTTL = time.Duration(ttl) * time.Second
+		}
+	}
+	if val := os.Getenv("DEDUPE_TRANSITION_MAX_BUILDS"); val != "" {
+		if n, err := strconv.Atoi(val); err == nil {
+			cfg.Dedupe.TransitionMaxBuilds = n
+		}
+	}
+
+	// Load Audit config
+	if val := os.Getenv("AUDIT_DB_PATH"); val != "" {
+		cfg.Audit.Path = val
+	}
+	if val := os.Getenv("AUDIT_RETENTION_DAYS"); val != "" {
+		if days, err := strconv.Atoi(val); err == nil && days > 0 {
+			cfg.Audit.RetentionDays = days
+		}
+	}
+
+	// Load Ownership config
+	if val := os.Getenv("OWNERSHIP_FILE"); val != "" {
+		cfg.Ownership.File = val
+	}
+	if val := os.Getenv("OWNERSHIP_RELOAD_INTERVAL"); val != "" {
+		if seconds, err := strconv.Atoi(val); err == nil && seconds > 0 {
+			cfg.Ownership.ReloadInterval = time.Duration(seconds) * time.Second
+		}
+	}
+
+	// Load Heartbeat config
+	if val := os.Getenv("HEARTBEAT_INTERVAL"); val != "" {
+		if seconds, err := strconv.Atoi(val); err == nil && seconds > 0 {
+			cfg.Heartbeat.Interval = time.Duration(seconds) * time.Second
+		}
+	}
+	if val := os.Getenv("HEARTBEAT_INSTANCE_ID"); val != "" {
+		cfg.Heartbeat.InstanceID = val
+	}
+
+	// Load SubscriptionLag config
+	if val := os.Getenv("SUBSCRIPTION_LAG_SUBSCRIPTIONS"); val != "" {
+		cfg.SubscriptionLag.Subscriptions = splitList(val)
+	}
+	if val := os.Getenv("SUBSCRIPTION_LAG_INTERVAL"); val != "" {
+		if seconds, err := strconv.Atoi(val); err == nil && seconds > 0 {
+			cfg.SubscriptionLag.Interval = time.Duration(seconds) * time.Second
+		}
+	}
+	if val := os.Getenv("SUBSCRIPTION_LAG_MAX_AGE"); val != "" {
+		if seconds, err := strconv.Atoi(val); err == nil && seconds > 0 {
+			cfg.SubscriptionLag.MaxAge = time.Duration(seconds) * time.Second
+		}
+	}
+
+	// Load Confirmation config
+	if val := os.Getenv("CONFIRMATION_PIPELINES"); val != "" {
+		cfg.Confirmation.Pipelines = splitList(val)
+	}
+	if val := os.Getenv("CONFIRMATION_TOPIC_ID"); val != "" {
+		cfg.Confirmation.TopicID = val
+	}
+	if val := os.Getenv("CONFIRMATION_TIMEOUT"); val != "" {
+		if seconds, err := strconv.Atoi(val); err == nil && seconds > 0 {
+			cfg.Confirmation.Timeout = time.Duration(seconds) * time.Second
+		}
 	}
 
-	// Load Server config
-	if val := os.Getenv("PORT"); val != "" {
-		if port, err := strconv.Atoi(val); err == nil {
-			cfg.Server.Port = port
+	// Load Rejections config
+	if val := os.Getenv("REJECTION_SAMPLE_RATE"); val != "" {
+		if rate, err := strconv.ParseFloat(val, 64); err == nil {
+			cfg.Rejections.SampleRate = rate
 		}
 	}
-	if val := os.Getenv("LOG_LEVEL"); val != "" {
-		cfg.Server.LogLevel = val
+	if val := os.Getenv("REJECTION_TOPIC_ID"); val != "" {
+		cfg.Rejections.TopicID = val
 	}
-	if val := os.Getenv("MAX_REQUEST_SIZE"); val != "" {
-		if size, err := strconv.Atoi(val); err == nil && size > 0 {
-			cfg.Server.MaxRequestSize = size
+
+	// Load Quarantine config
+	if val := os.Getenv("QUARANTINE_DIR"); val != "" {
+		cfg.Quarantine.Dir = val
+	}
+	if val := os.Getenv("QUARANTINE_ACKNOWLEDGE"); val != "" {
+		if acknowledge, err := strconv.ParseBool(val); err == nil {
+			cfg.Quarantine.Acknowledge = acknowledge
 		}
 	}
-	if val := os.Getenv("REQUEST_TIMEOUT"); val != "" {
-		if timeout, err := strconv.Atoi(val); err == nil && timeout > 0 {
-			cfg.Server.RequestTimeout = time.Duration(timeout) * time.Second
+
+	// Load Tracing config
+	if val := os.Getenv("TRACE_SAMPLE_RATIO"); val != "" {
+		if ratio, err := strconv.ParseFloat(val, 64); err == nil {
+			cfg.Tracing.SampleRatio = ratio
 		}
 	}
-	if val := os.Getenv("READ_TIMEOUT"); val != "" {
-		if timeout, err := strconv.Atoi(val); err == nil && timeout > 0 {
-			cfg.Server.ReadTimeout = time.Duration(timeout) * time.Second
+	if val := os.Getenv("OTEL_EXPORTER_OTLP_INSECURE"); val != "" {
+		if insecure, err := strconv.ParseBool(val); err == nil {
+			cfg.Tracing.OTLPInsecure = &insecure
 		}
 	}
-	if val := os.Getenv("WRITE_TIMEOUT"); val != "" {
-		if timeout, err := strconv.Atoi(val); err == nil && timeout > 0 {
-			cfg.Server.WriteTimeout = time.Duration(timeout) * time.Second
+
+	// Load Metrics config
+	if val := os.Getenv("METRICS_NAMESPACE"); val != "" {
+		cfg.Metrics.Namespace = val
+	}
+	if val := os.Getenv("METRICS_SUBSYSTEM"); val != "" {
+		cfg.Metrics.Subsystem = val
+	}
+	// METRICS_CONST_LABELS takes comma-separated name=value pairs, e.g.
+	// "environment=prod,region=us-east1"
+	if val := os.Getenv("METRICS_CONST_LABELS"); val != "" {
+		cfg.Metrics.ConstLabels = parseEventOverrides(val)
+	}
+	if val := os.Getenv("METRICS_DROP_LABELS"); val != "" {
+		cfg.Metrics.DropLabels = splitList(val)
+	}
+	// METRICS_RELABEL_RULES is a JSON array of rules, e.g.
+	// [{"label":"branch","match":"feature/*","replacement":"feature/*"}]
+	if val := os.Getenv("METRICS_RELABEL_RULES"); val != "" {
+		var rules []RelabelRule
+		if err := json.Unmarshal([]byte(val), &rules); err != nil {
+			return nil, errors.NewValidationError("METRICS_RELABEL_RULES must be a JSON array of rules: " + err.Error())
 		}
+		cfg.Metrics.RelabelRules = rules
 	}
-	if val := os.Getenv("IDLE_TIMEOUT"); val != "" {
-		if timeout, err := strconv.Atoi(val); err == nil && timeout > 0 {
-			cfg.Server.IdleTimeout = time.Duration(timeout) * time.Second
+
+	return cfg, nil
+}
+
+// parseEventOverrides parses comma-separated key=value pairs, such as
+// event=value overrides, skipping malformed entries
+func parseEventOverrides(val string) map[string]string {
+	overrides := make(map[string]string)
+	for _, pair := range strings.Split(val, ",") {
+		eventType, value, ok := strings.Cut(pair, "=")
+		eventType = strings.TrimSpace(eventType)
+		if !ok || eventType == "" {
+			continue
 		}
+		overrides[eventType] = strings.TrimSpace(value)
 	}
+	return overrides
+}
 
-	// Load Security config
-	if val := os.Getenv("RATE_LIMIT"); val != "" {
-		if limit, err := strconv.Atoi(val); err == nil && limit >= 0 {
-			cfg.Security.RateLimit = limit
+// splitList splits a comma-separated list, dropping empty entries
+func splitList(val string) []string {
+	var list []string
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
 		}
 	}
+	return list
+}
 
-	return cfg, nil
+// setEventPolicy stores a policy, allocating the map on first use
+func setEventPolicy(gcp *GCPConfig, eventType string, policy EventPolicy) {
+	if gcp.EventPolicies == nil {
+		gcp.EventPolicies = make(map[string]EventPolicy)
+	}
+	gcp.EventPolicies[eventType] = policy
 }
 
-// LoadFromFile loads configuration from a JSON or YAML file
+// LoadFromFile loads configuration from a JSON or YAML file. Unknown keys
+// are rejected unless CONFIG_STRICT is false.
 func LoadFromFile(path string) (*Config, error) {
+	return loadFromFile(path, DefaultConfig())
+}
+
+// loadFromFile sets the values in a config file in cfg
+func loadFromFile(path string, cfg *Config) (*Config, error) {
 	// Clean the path to prevent directory traversal attacks
 	cleanPath := filepath.Clean(path)
 	data, err := os.ReadFile(cleanPath)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to read config file")
 	}
-
-	cfg := DefaultConfig()
+	cfg.Deprecated = deprecatedKeys(data)
 
 	// Create a temporary struct for parsing that uses string types for durations
 	type tempConfig struct {
 		GCP struct {
-			ProjectID              string `json:"project_id" yaml:"project_id"`
-			TopicID                string `json:"topic_id" yaml:"topic_id"`
-			CredentialsFile        string `json:"credentials_file" yaml:"credentials_file"`
-			PubSubBatchSize        int    `json:"pubsub_batch_size" yaml:"pubsub_batch_size"`
-			PubSubRetryMaxAttempts int    `json:"pubsub_retry_max_attempts" yaml:"pubsub_retry_max_attempts"`
-			EnableDLQ              bool   `json:"enable_dlq" yaml:"enable_dlq"`
-			DLQTopicID             string `json:"dlq_topic_id" yaml:"dlq_topic_id"`
+			ProjectID                    string                 `json:"project_id" yaml:"project_id"`
+			TopicID                      string                 `json:"topic_id" yaml:"topic_id"`
+			CredentialsFile              string                 `json:"credentials_file" yaml:"credentials_file"`
+			Credentials                  CredentialsConfig      `json:"credentials" yaml:"credentials"`
+			PubSubBatchSize              int                    `json:"pubsub_batch_size" yaml:"pubsub_batch_size"`
+			PubSubByteThreshold          int                    `json:"pubsub_byte_threshold" yaml:"pubsub_byte_threshold"`
+			PubSubDelayThreshold         string                 `json:"pubsub_delay_threshold" yaml:"pubsub_delay_threshold"`
+			PubSubMaxOutstandingMessages int                    `json:"pubsub_max_outstanding_messages" yaml:"pubsub_max_outstanding_messages"`
+			PubSubMaxOutstandingBytes    int                    `json:"pubsub_max_outstanding_bytes" yaml:"pubsub_max_outstanding_bytes"`
+			PubSubCompression            *bool                  `json:"pubsub_compression" yaml:"pubsub_compression"`
+			PubSubCompressionThreshold   int                    `json:"pubsub_compression_threshold" yaml:"pubsub_compression_threshold"`
+			PubSubRetryMaxAttempts       int                    `json:"pubsub_retry_max_attempts" yaml:"pubsub_retry_max_attempts"`
+			EnableDLQ                    bool                   `json:"enable_dlq" yaml:"enable_dlq"`
+			DLQTopicID                   string                 `json:"dlq_topic_id" yaml:"dlq_topic_id"`
+			DLQRetryMaxAttempts          int                    `json:"dlq_retry_max_attempts" yaml:"dlq_retry_max_attempts"`
+			DLQFallbackDir               string                 `json:"dlq_fallback_dir" yaml:"dlq_fallback_dir"`
+			SecondaryProjectID           string                 `json:"secondary_project_id" yaml:"secondary_project_id"`
+			SecondaryTopicID             string                 `json:"secondary_topic_id" yaml:"secondary_topic_id"`
+			CircuitBreakerThreshold      int                    `json:"circuit_breaker_threshold" yaml:"circuit_breaker_threshold"`
+			CircuitBreakerTimeout        string                 `json:"circuit_breaker_timeout" yaml:"circuit_breaker_timeout"`
+			CircuitBreakerState          string                 `json:"circuit_breaker_state" yaml:"circuit_breaker_state"`
+			CircuitBreakerStateTTL       string                 `json:"circuit_breaker_state_ttl" yaml:"circuit_breaker_state_ttl"`
+			MaxPendingPublishes          int                    `json:"max_pending_publishes" yaml:"max_pending_publishes"`
+			HighPriorityEvents           []string               `json:"high_priority_events" yaml:"high_priority_events"`
+			AttributeAllowList           []string               `json:"attribute_allow_list" yaml:"attribute_allow_list"`
+			EventPolicies                map[string]EventPolicy `json:"event_policies" yaml:"event_policies"`
+			Routes                       []RouteConfig          `json:"routes" yaml:"routes"`
+			AttributeRules               []AttributeRuleConfig  `json:"attribute_rules" yaml:"attribute_rules"`
+			HashedAttributes             []string               `json:"hashed_attributes" yaml:"hashed_attributes"`
+			AttributeHashKey             string                 `json:"attribute_hash_key" yaml:"attribute_hash_key"`
 		} `json:"gcp" yaml:"gcp"`
 		Webhook struct {
-			Token      string `json:"token" yaml:"token"`
-			HMACSecret string `json:"hmac_secret" yaml:"hmac_secret"`
-			Path       string `json:"path" yaml:"path"`
+			Token             string              `json:"token" yaml:"token"`
+			HMACSecret        string              `json:"hmac_secret" yaml:"hmac_secret"`
+			Path              string              `json:"path" yaml:"path"`
+			DetectSchemaDrift bool                `json:"detect_schema_drift" yaml:"detect_schema_drift"`
+			UnsupportedEvents string              `json:"unsupported_events" yaml:"unsupported_events"`
+			Paths             []WebhookPathConfig `json:"paths" yaml:"paths"`
+			Middleware        []string            `json:"middleware" yaml:"middleware"`
+			StrictMethods     bool                `json:"strict_methods" yaml:"strict_methods"`
+			ServerTiming      bool                `json:"server_timing" yaml:"server_timing"`
+
+			SignatureTolerance       string   `json:"signature_tolerance" yaml:"signature_tolerance"`
+			SignatureFutureTolerance string   `json:"signature_future_tolerance" yaml:"signature_future_tolerance"`
+			ClockCheckServer         string   `json:"clock_check_server" yaml:"clock_check_server"`
+			DeliveryAttemptHeader    string   `json:"delivery_attempt_header" yaml:"delivery_attempt_header"`
+			ChecksumAlgorithm        string   `json:"checksum_algorithm" yaml:"checksum_algorithm"`
+			ChecksumPayload          string   `json:"checksum_payload" yaml:"checksum_payload"`
+			SchemaVersion            string   `json:"schema_version" yaml:"schema_version"`
+			ShadowSchemaVersion      string   `json:"shadow_schema_version" yaml:"shadow_schema_version"`
+			ShadowTopicID            string   `json:"shadow_topic_id" yaml:"shadow_topic_id"`
+			SchemaBaseURL            string   `json:"schema_base_url" yaml:"schema_base_url"`
+			UnblockEventTTL          string   `json:"unblock_event_ttl" yaml:"unblock_event_ttl"`
+			JobMessagePipelines      []string `json:"job_message_pipelines" yaml:"job_message_pipelines"`
+			PingCheck                bool     `json:"ping_check" yaml:"ping_check"`
+			PingTopicID              string   `json:"ping_topic_id" yaml:"ping_topic_id"`
+			PartialPayloads          bool     `json:"partial_payloads" yaml:"partial_payloads"`
+			LegacyPipelineAttribute  bool     `json:"legacy_pipeline_attribute" yaml:"legacy_pipeline_attribute"`
+			MaxDecompressedSize      int      `json:"max_decompressed_size" yaml:"max_decompressed_size"`
+			BatchPath                string   `json:"batch_path" yaml:"batch_path"`
+			BatchMaxItems            int      `json:"batch_max_items" yaml:"batch_max_items"`
 		} `json:"webhook" yaml:"webhook"`
 		Server struct {
 			Port           int    `json:"port" yaml:"port"`
 			LogLevel       string `json:"log_level" yaml:"log_level"`
+			LogFormat      string `json:"log_format" yaml:"log_format"`
 			MaxRequestSize int    `json:"max_request_size" yaml:"max_request_size"`
 			RequestTimeout string `json:"request_timeout" yaml:"request_timeout"`
 			ReadTimeout    string `json:"read_timeout" yaml:"read_timeout"`
 			WriteTimeout   string `json:"write_timeout" yaml:"write_timeout"`
 			IdleTimeout    string `json:"idle_timeout" yaml:"idle_timeout"`
+
+			ReadHeaderTimeout         string   `json:"read_header_timeout" yaml:"read_header_timeout"`
+			MaxHeaderBytes            int      `json:"max_header_bytes" yaml:"max_header_bytes"`
+			DisableKeepAlives         bool     `json:"disable_keep_alives" yaml:"disable_keep_alives"`
+			EnableH2C                 bool     `json:"enable_h2c" yaml:"enable_h2c"`
+			HTTP2MaxConcurrentStreams int      `json:"http2_max_concurrent_streams" yaml:"http2_max_concurrent_streams"`
+			MaxConnections            int      `json:"max_connections" yaml:"max_connections"`
+			UnixSocket                string   `json:"unix_socket" yaml:"unix_socket"`
+			UnixSocketMode            string   `json:"unix_socket_mode" yaml:"unix_socket_mode"`
+			SystemdSocket             bool     `json:"systemd_socket" yaml:"systemd_socket"`
+			StartupRetryTimeout       string   `json:"startup_retry_timeout" yaml:"startup_retry_timeout"`
+			ShutdownSettle            string   `json:"shutdown_settle" yaml:"shutdown_settle"`
+			TimeoutHeaderCIDRs        []string `json:"timeout_header_cidrs" yaml:"timeout_header_cidrs"`
+			StatsWindow               string   `json:"stats_window" yaml:"stats_window"`
 		} `json:"server" yaml:"server"`
 		Security struct {
-			RateLimit int `json:"rate_limit" yaml:"rate_limit"`
+			RateLimit                 int      `json:"rate_limit" yaml:"rate_limit"`
+			RateLimitBurst            int      `json:"rate_limit_burst" yaml:"rate_limit_burst"`
+			RateLimitWindow           string   `json:"rate_limit_window" yaml:"rate_limit_window"`
+			IPRateLimit               int      `json:"ip_rate_limit" yaml:"ip_rate_limit"`
+			IPRateLimitBurst          int      `json:"ip_rate_limit_burst" yaml:"ip_rate_limit_burst"`
+			TokenRateLimit            int      `json:"token_rate_limit" yaml:"token_rate_limit"`
+			TokenRateLimitBurst       int      `json:"token_rate_limit_burst" yaml:"token_rate_limit_burst"`
+			TokenRateLimitHeader      string   `json:"token_rate_limit_header" yaml:"token_rate_limit_header"`
+			TokenRateLimitHeaderCIDRs []string `json:"token_rate_limit_header_cidrs" yaml:"token_rate_limit_header_cidrs"`
+			RateLimitBypassPaths      []string `json:"rate_limit_bypass_paths" yaml:"rate_limit_bypass_paths"`
+			RateLimitBypassCIDRs      []string `json:"rate_limit_bypass_cidrs" yaml:"rate_limit_bypass_cidrs"`
+			CORSAllowedOrigins        []string `json:"cors_allowed_origins" yaml:"cors_allowed_origins"`
+			AuthBanMaxFailures        int      `json:"auth_ban_max_failures" yaml:"auth_ban_max_failures"`
+			AuthBanWindow             string   `json:"auth_ban_window" yaml:"auth_ban_window"`
+			AuthBanCooldown           string   `json:"auth_ban_cooldown" yaml:"auth_ban_cooldown"`
+			AuthBanExemptCIDRs        []string `json:"auth_ban_exempt_cidrs" yaml:"auth_ban_exempt_cidrs"`
 		} `json:"security" yaml:"security"`
+		Admin struct {
+			Port            int    `json:"port" yaml:"port"`
+			BindAddress     string `json:"bind_address" yaml:"bind_address"`
+			Token           string `json:"token" yaml:"token"`
+			OIDCIssuer      string `json:"oidc_issuer" yaml:"oidc_issuer"`
+			OIDCAudience    string `json:"oidc_audience" yaml:"oidc_audience"`
+			EnableDebug     bool   `json:"enable_debug" yaml:"enable_debug"`
+			PauseStateFile  string `json:"pause_state_file" yaml:"pause_state_file"`
+			PauseRetryAfter string `json:"pause_retry_after" yaml:"pause_retry_after"`
+
+			RecordRequests     int      `json:"record_requests" yaml:"record_requests"`
+			RecordRedactFields []string `json:"record_redact_fields" yaml:"record_redact_fields"`
+			OIDCSubjects       []string `json:"oidc_subjects" yaml:"oidc_subjects"`
+		} `json:"admin" yaml:"admin"`
+		Dedupe struct {
+			Backend  string `json:"backend" yaml:"backend"`
+			RedisURL string `json:"redis_url" yaml:"redis_url"`
+			TTL      string `json:"ttl" yaml:"ttl"`
+
+			TransitionTTL       string `json:"transition_ttl" yaml:"transition_ttl"`
+			TransitionMaxBuilds int    `json:"transition_max_builds" yaml:"transition_max_builds"`
+		} `json:"dedupe" yaml:"dedupe"`
+		Audit     AuditConfig   `json:"audit" yaml:"audit"`
+		Metrics   MetricsConfig `json:"metrics" yaml:"metrics"`
+		Ownership struct {
+			File           string `json:"file" yaml:"file"`
+			ReloadInterval string `json:"reload_interval" yaml:"reload_interval"`
+		} `json:"ownership" yaml:"ownership"`
+		Heartbeat struct {
+			Interval   string `json:"interval" yaml:"interval"`
+			InstanceID string `json:"instance_id" yaml:"instance_id"`
+		} `json:"heartbeat" yaml:"heartbeat"`
+		SubscriptionLag struct {
+			Subscriptions []string `json:"subscriptions" yaml:"subscriptions"`
+			Interval      string   `json:"interval" yaml:"interval"`
+			MaxAge        string   `json:"max_age" yaml:"max_age"`
+		} `json:"subscription_lag" yaml:"subscription_lag"`
+		Confirmation struct {
+			Pipelines []string `json:"pipelines" yaml:"pipelines"`
+			TopicID   string   `json:"topic_id" yaml:"topic_id"`
+			Timeout   string   `json:"timeout" yaml:"timeout"`
+		} `json:"confirmation" yaml:"confirmation"`
+		Rejections RejectionsConfig `json:"rejections" yaml:"rejections"`
+		Quarantine QuarantineConfig `json:"quarantine" yaml:"quarantine"`
+		Tracing    TracingConfig    `json:"tracing" yaml:"tracing"`
 	}
 
 	var tempCfg tempConfig
@@ -261,6 +2037,9 @@ func LoadFromFile(path string) (*Config, error) {
 	ext := strings.ToLower(filepath.Ext(path))
 	switch ext {
 	case ".json":
+		if err := checkKnownKeys(path, data, reflect.TypeOf(tempCfg)); err != nil {
+			return nil, err
+		}
 		// For JSON, we'll try first with the original struct
 		// and if that fails, then with the temporary struct
 		err := json.Unmarshal(data, cfg)
@@ -274,6 +2053,9 @@ func LoadFromFile(path string) (*Config, error) {
 			return cfg, nil
 		}
 	case ".yaml", ".yml":
+		if err := checkKnownKeys(path, data, reflect.TypeOf(tempCfg)); err != nil {
+			return nil, err
+		}
 		if err := yaml.Unmarshal(data, &tempCfg); err != nil {
 			return nil, errors.Wrap(err, "failed to parse YAML config file")
 		}
@@ -285,57 +2067,282 @@ func LoadFromFile(path string) (*Config, error) {
 	cfg.GCP.ProjectID = tempCfg.GCP.ProjectID
 	cfg.GCP.TopicID = tempCfg.GCP.TopicID
 	cfg.GCP.CredentialsFile = tempCfg.GCP.CredentialsFile
+	cfg.GCP.Credentials = tempCfg.GCP.Credentials
+	// credentials_file named the key to authenticate with, so it becomes the
+	// file Application Default Credentials read
+	if cfg.GCP.Credentials.File == "" && cfg.GCP.Credentials.Mode == "" {
+		cfg.GCP.Credentials.File = tempCfg.GCP.CredentialsFile
+	}
 	cfg.GCP.PubSubBatchSize = tempCfg.GCP.PubSubBatchSize
+	cfg.GCP.PubSubByteThreshold = tempCfg.GCP.PubSubByteThreshold
+	parseDuration(tempCfg.GCP.PubSubDelayThreshold, &cfg.GCP.PubSubDelayThreshold)
+	cfg.GCP.PubSubMaxOutstandingMessages = tempCfg.GCP.PubSubMaxOutstandingMessages
+	cfg.GCP.PubSubMaxOutstandingBytes = tempCfg.GCP.PubSubMaxOutstandingBytes
+	if tempCfg.GCP.PubSubCompression != nil {
+		cfg.GCP.PubSubCompression = tempCfg.GCP.PubSubCompression
+	}
+	cfg.GCP.PubSubCompressionThreshold = tempCfg.GCP.PubSubCompressionThreshold
 	cfg.GCP.PubSubRetryMaxAttempts = tempCfg.GCP.PubSubRetryMaxAttempts
 	cfg.GCP.EnableDLQ = tempCfg.GCP.EnableDLQ
 	cfg.GCP.DLQTopicID = tempCfg.GCP.DLQTopicID
+	cfg.GCP.DLQRetryMaxAttempts = tempCfg.GCP.DLQRetryMaxAttempts
+	cfg.GCP.DLQFallbackDir = tempCfg.GCP.DLQFallbackDir
+	cfg.GCP.SecondaryProjectID = tempCfg.GCP.SecondaryProjectID
+	cfg.GCP.SecondaryTopicID = tempCfg.GCP.SecondaryTopicID
+	cfg.GCP.CircuitBreakerThreshold = tempCfg.GCP.CircuitBreakerThreshold
+	parseDuration(tempCfg.GCP.CircuitBreakerTimeout, &cfg.GCP.CircuitBreakerTimeout)
+	cfg.GCP.CircuitBreakerState = tempCfg.GCP.CircuitBreakerState
+	parseDuration(tempCfg.GCP.CircuitBreakerStateTTL, &cfg.GCP.CircuitBreakerStateTTL)
+	cfg.GCP.MaxPendingPublishes = tempCfg.GCP.MaxPendingPublishes
+	cfg.GCP.HighPriorityEvents = tempCfg.GCP.HighPriorityEvents
+	cfg.GCP.AttributeAllowList = tempCfg.GCP.AttributeAllowList
+	cfg.GCP.EventPolicies = tempCfg.GCP.EventPolicies
+	cfg.GCP.Routes = tempCfg.GCP.Routes
+	cfg.GCP.AttributeRules = tempCfg.GCP.AttributeRules
+	cfg.GCP.HashedAttributes = tempCfg.GCP.HashedAttributes
+	cfg.GCP.AttributeHashKey = tempCfg.GCP.AttributeHashKey
 
 	cfg.Webhook.Token = tempCfg.Webhook.Token
 	cfg.Webhook.HMACSecret = tempCfg.Webhook.HMACSecret
 	cfg.Webhook.Path = tempCfg.Webhook.Path
+	cfg.Webhook.DetectSchemaDrift = tempCfg.Webhook.DetectSchemaDrift
+	if tempCfg.Webhook.UnsupportedEvents != "" {
+		cfg.Webhook.UnsupportedEvents = tempCfg.Webhook.UnsupportedEvents
+	}
+	cfg.Webhook.Paths = tempCfg.Webhook.Paths
+	cfg.Webhook.Middleware = tempCfg.Webhook.Middleware
+	cfg.Webhook.StrictMethods = tempCfg.Webhook.StrictMethods
+	cfg.Webhook.ServerTiming = tempCfg.Webhook.ServerTiming
+	parseDuration(tempCfg.Webhook.SignatureTolerance, &cfg.Webhook.SignatureTolerance)
+	parseDuration(tempCfg.Webhook.SignatureFutureTolerance, &cfg.Webhook.SignatureFutureTolerance)
+	cfg.Webhook.ClockCheckServer = tempCfg.Webhook.ClockCheckServer
+	cfg.Webhook.DeliveryAttemptHeader = tempCfg.Webhook.DeliveryAttemptHeader
+	if tempCfg.Webhook.ChecksumAlgorithm != "" {
+		cfg.Webhook.ChecksumAlgorithm = tempCfg.Webhook.ChecksumAlgorithm
+	}
+	if tempCfg.Webhook.ChecksumPayload != "" {
+		cfg.Webhook.ChecksumPayload = tempCfg.Webhook.ChecksumPayload
+	}
+	cfg.Webhook.SchemaVersion = tempCfg.Webhook.SchemaVersion
+	cfg.Webhook.ShadowSchemaVersion = tempCfg.Webhook.ShadowSchemaVersion
+	cfg.Webhook.ShadowTopicID = tempCfg.Webhook.ShadowTopicID
+	cfg.Webhook.SchemaBaseURL = tempCfg.Webhook.SchemaBaseURL
+	parseDuration(tempCfg.Webhook.UnblockEventTTL, &cfg.Webhook.UnblockEventTTL)
+	cfg.Webhook.JobMessagePipelines = tempCfg.Webhook.JobMessagePipelines
+	cfg.Webhook.PingCheck = tempCfg.Webhook.PingCheck
+	cfg.Webhook.PingTopicID = tempCfg.Webhook.PingTopicID
+	cfg.Webhook.PartialPayloads = tempCfg.Webhook.PartialPayloads
+	cfg.Webhook.LegacyPipelineAttribute = tempCfg.Webhook.LegacyPipelineAttribute
+	cfg.Webhook.MaxDecompressedSize = tempCfg.Webhook.MaxDecompressedSize
+	cfg.Webhook.BatchPath = tempCfg.Webhook.BatchPath
+	cfg.Webhook.BatchMaxItems = tempCfg.Webhook.BatchMaxItems
 
 	cfg.Server.Port = tempCfg.Server.Port
 	cfg.Server.LogLevel = tempCfg.Server.LogLevel
+	cfg.Server.LogFormat = tempCfg.Server.LogFormat
 	cfg.Server.MaxRequestSize = tempCfg.Server.MaxRequestSize
 
 	// Parse duration values
-	if tempCfg.Server.RequestTimeout != "" {
-		if secs, err := strconv.Atoi(tempCfg.Server.RequestTimeout); err == nil {
-			cfg.Server.RequestTimeout = time.Duration(secs) * time.Second
-		} else if d, err := time.ParseDuration(tempCfg.Server.RequestTimeout); err == nil {
-			cfg.Server.RequestTimeout = d
-		}
+	parseDuration(tempCfg.Server.RequestTimeout, &cfg.Server.RequestTimeout)
+	parseDuration(tempCfg.Server.ReadTimeout, &cfg.Server.ReadTimeout)
+	parseDuration(tempCfg.Server.WriteTimeout, &cfg.Server.WriteTimeout)
+	parseDuration(tempCfg.Server.IdleTimeout, &cfg.Server.IdleTimeout)
+	parseDuration(tempCfg.Server.ReadHeaderTimeout, &cfg.Server.ReadHeaderTimeout)
+	cfg.Server.MaxHeaderBytes = tempCfg.Server.MaxHeaderBytes
+	cfg.Server.DisableKeepAlives = tempCfg.Server.DisableKeepAlives
+	cfg.Server.EnableH2C = tempCfg.Server.EnableH2C
+	cfg.Server.HTTP2MaxConcurrentStreams = tempCfg.Server.HTTP2MaxConcurrentStreams
+	cfg.Server.MaxConnections = tempCfg.Server.MaxConnections
+	cfg.Server.UnixSocket = tempCfg.Server.UnixSocket
+	if tempCfg.Server.UnixSocketMode != "" {
+		cfg.Server.UnixSocketMode = tempCfg.Server.UnixSocketMode
 	}
+	cfg.Server.SystemdSocket = tempCfg.Server.SystemdSocket
+	parseDuration(tempCfg.Server.StartupRetryTimeout, &cfg.Server.StartupRetryTimeout)
+	parseDuration(tempCfg.Server.ShutdownSettle, &cfg.Server.ShutdownSettle)
+	cfg.Server.TimeoutHeaderCIDRs = tempCfg.Server.TimeoutHeaderCIDRs
+	parseDuration(tempCfg.Server.StatsWindow, &cfg.Server.StatsWindow)
 
-	if tempCfg.Server.ReadTimeout != "" {
-		if secs, err := strconv.Atoi(tempCfg.Server.ReadTimeout); err == nil {
-			cfg.Server.ReadTimeout = time.Duration(secs) * time.Second
-		} else if d, err := time.ParseDuration(tempCfg.Server.ReadTimeout); err == nil {
-			cfg.Server.ReadTimeout = d
-		}
+	cfg.Security.RateLimit = tempCfg.Security.RateLimit
+	cfg.Security.RateLimitBurst = tempCfg.Security.RateLimitBurst
+	parseDuration(tempCfg.Security.RateLimitWindow, &cfg.Security.RateLimitWindow)
+	cfg.Security.IPRateLimit = tempCfg.Security.IPRateLimit
+	cfg.Security.IPRateLimitBurst = tempCfg.Security.IPRateLimitBurst
+	cfg.Security.TokenRateLimit = tempCfg.Security.TokenRateLimit
+	cfg.Security.TokenRateLimitBurst = tempCfg.Security.TokenRateLimitBurst
+	cfg.Security.TokenRateLimitHeader = tempCfg.Security.TokenRateLimitHeader
+	cfg.Security.TokenRateLimitHeaderCIDRs = tempCfg.Security.TokenRateLimitHeaderCIDRs
+	cfg.Security.RateLimitBypassPaths = tempCfg.Security.RateLimitBypassPaths
+	cfg.Security.RateLimitBypassCIDRs = tempCfg.Security.RateLimitBypassCIDRs
+	cfg.Security.CORSAllowedOrigins = tempCfg.Security.CORSAllowedOrigins
+	cfg.Security.AuthBanMaxFailures = tempCfg.Security.AuthBanMaxFailures
+	parseDuration(tempCfg.Security.AuthBanWindow, &cfg.Security.AuthBanWindow)
+	parseDuration(tempCfg.Security.AuthBanCooldown, &cfg.Security.AuthBanCooldown)
+	cfg.Security.AuthBanExemptCIDRs = tempCfg.Security.AuthBanExemptCIDRs
+
+	cfg.Admin.Port = tempCfg.Admin.Port
+	if tempCfg.Admin.BindAddress != "" {
+		cfg.Admin.BindAddress = tempCfg.Admin.BindAddress
 	}
+	cfg.Admin.Token = tempCfg.Admin.Token
+	cfg.Admin.OIDCIssuer = tempCfg.Admin.OIDCIssuer
+	cfg.Admin.OIDCAudience = tempCfg.Admin.OIDCAudience
+	cfg.Admin.OIDCSubjects = tempCfg.Admin.OIDCSubjects
+	cfg.Admin.EnableDebug = tempCfg.Admin.EnableDebug
+	cfg.Admin.PauseStateFile = tempCfg.Admin.PauseStateFile
+	parseDuration(tempCfg.Admin.PauseRetryAfter, &cfg.Admin.PauseRetryAfter)
+	cfg.Admin.RecordRequests = tempCfg.Admin.RecordRequests
+	cfg.Admin.RecordRedactFields = tempCfg.Admin.RecordRedactFields
 
-	if tempCfg.Server.WriteTimeout != "" {
-		if secs, err := strconv.Atoi(tempCfg.Server.WriteTimeout); err == nil {
-			cfg.Server.WriteTimeout = time.Duration(secs) * time.Second
-		} else if d, err := time.ParseDuration(tempCfg.Server.WriteTimeout); err == nil {
-			cfg.Server.WriteTimeout = d
-		}
+	cfg.Dedupe.Backend = tempCfg.Dedupe.Backend
+	cfg.Dedupe.RedisURL = tempCfg.Dedupe.RedisURL
+	parseDuration(tempCfg.Dedupe.TTL, &cfg.Dedupe.TTL)
+	parseDuration(tempCfg.Dedupe.TransitionTTL, &cfg.Dedupe.TransitionTTL)
+	if tempCfg.Dedupe.TransitionMaxBuilds != 0 {
+		cfg.Dedupe.TransitionMaxBuilds = tempCfg.Dedupe.TransitionMaxBuilds
 	}
 
-	if tempCfg.Server.IdleTimeout != "" {
-		if secs, err := strconv.Atoi(tempCfg.Server.IdleTimeout); err == nil {
-			cfg.Server.IdleTimeout = time.Duration(secs) * time.Second
-		} else if d, err := time.ParseDuration(tempCfg.Server.IdleTimeout); err == nil {
-			cfg.Server.IdleTimeout = d
-		}
+	cfg.Audit.Path = tempCfg.Audit.Path
+	if tempCfg.Audit.RetentionDays != 0 {
+		cfg.Audit.RetentionDays = tempCfg.Audit.RetentionDays
 	}
 
-	cfg.Security.RateLimit = tempCfg.Security.RateLimit
+	cfg.Metrics = tempCfg.Metrics
+
+	cfg.Ownership.File = tempCfg.Ownership.File
+	parseDuration(tempCfg.Ownership.ReloadInterval, &cfg.Ownership.ReloadInterval)
+
+	parseDuration(tempCfg.Heartbeat.Interval, &cfg.Heartbeat.Interval)
+	cfg.Heartbeat.InstanceID = tempCfg.Heartbeat.InstanceID
+	cfg.SubscriptionLag.Subscriptions = tempCfg.SubscriptionLag.Subscriptions
+	parseDuration(tempCfg.SubscriptionLag.Interval, &cfg.SubscriptionLag.Interval)
+	parseDuration(tempCfg.SubscriptionLag.MaxAge, &cfg.SubscriptionLag.MaxAge)
+	cfg.Confirmation.Pipelines = tempCfg.Confirmation.Pipelines
+	cfg.Confirmation.TopicID = tempCfg.Confirmation.TopicID
+	parseDuration(tempCfg.Confirmation.Timeout, &cfg.Confirmation.Timeout)
+
+	cfg.Rejections = tempCfg.Rejections
+	cfg.Quarantine = tempCfg.Quarantine
+
+	if tempCfg.Tracing.SampleRatio != 0 {
+		cfg.Tracing.SampleRatio = tempCfg.Tracing.SampleRatio
+	}
+	if tempCfg.Tracing.OTLPInsecure != nil {
+		cfg.Tracing.OTLPInsecure = tempCfg.Tracing.OTLPInsecure
+	}
 
 	return cfg, nil
 }
 
+// strictFiles reports whether config files with unknown keys are rejected,
+// which CONFIG_STRICT=false turns off for files shared with newer or older
+// versions
+func strictFiles() bool {
+	strict, err := strconv.ParseBool(os.Getenv("CONFIG_STRICT"))
+	return strict || err != nil
+}
+
+// checkKnownKeys returns a validation error naming the first key in a config
+// file, such as a misspelled webhook.hmac_secert, that t has no field for.
+// Files that fail to parse are left for the parser to report.
+func checkKnownKeys(path string, data []byte, t reflect.Type) error {
+	if !strictFiles() {
+		return nil
+	}
+	// YAML is a superset of JSON, so this reads both
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil
+	}
+	if key := unknownKey(doc, t, ""); key != "" {
+		return errors.NewValidationError(fmt.Sprintf("unknown key %s in config file %s; set CONFIG_STRICT=false to ignore unknown keys", key, path))
+	}
+	return nil
+}
+
+// unknownKey returns the path of the first key in value, in sorted order,
+// with no field in t, or "" when every key is known. Values of the wrong
+// type are left for the parser to report.
+func unknownKey(value interface{}, t reflect.Type, path string) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		fields := make(map[string]reflect.Type, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			if name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ","); name != "" && name != "-" {
+				fields[name] = t.Field(i).Type
+			}
+		}
+		for _, key := range sortedKeys(m) {
+			keyPath := joinKeyPath(path, key)
+			field, ok := fields[key]
+			if !ok {
+				return keyPath
+			}
+			if unknown := unknownKey(m[key], field, keyPath); unknown != "" {
+				return unknown
+			}
+		}
+	case reflect.Map:
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		for _, key := range sortedKeys(m) {
+			if unknown := unknownKey(m[key], t.Elem(), joinKeyPath(path, key)); unknown != "" {
+				return unknown
+			}
+		}
+	case reflect.Slice:
+		items, ok := value.([]interface{})
+		if !ok {
+			return ""
+		}
+		for i, item := range items {
+			if unknown := unknownKey(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i)); unknown != "" {
+				return unknown
+			}
+		}
+	}
+	return ""
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func joinKeyPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// parseDuration sets target from a config file value given either as whole
+// seconds ("30") or a Go duration string ("30s"). Empty or invalid values
+// leave target unchanged.
+func parseDuration(value string, target *time.Duration) {
+	if value == "" {
+		return
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		*target = time.Duration(secs) * time.Second
+	} else if d, err := time.ParseDuration(value); err == nil {
+		*target = d
+	}
+}
+
 // MergeConfigs merges two configurations, with the second taking precedence
 func MergeConfigs(base, override *Config) *Config {
 	result := *base
@@ -355,9 +2362,39 @@ func MergeConfigs(base, override *Config) *Config {
 	if override.GCP.CredentialsFile != "" {
 		result.GCP.CredentialsFile = override.GCP.CredentialsFile
 	}
+	if override.GCP.Credentials.Mode != "" {
+		result.GCP.Credentials.Mode = override.GCP.Credentials.Mode
+	}
+	if override.GCP.Credentials.File != "" {
+		result.GCP.Credentials.File = override.GCP.Credentials.File
+	}
+	if override.GCP.Credentials.TargetPrincipal != "" {
+		result.GCP.Credentials.TargetPrincipal = override.GCP.Credentials.TargetPrincipal
+	}
+	if len(override.GCP.Credentials.Delegates) > 0 {
+		result.GCP.Credentials.Delegates = override.GCP.Credentials.Delegates
+	}
 	if override.GCP.PubSubBatchSize != 0 {
 		result.GCP.PubSubBatchSize = override.GCP.PubSubBatchSize
 	}
+	if override.GCP.PubSubByteThreshold != 0 {
+		result.GCP.PubSubByteThreshold = override.GCP.PubSubByteThreshold
+	}
+	if override.GCP.PubSubDelayThreshold != 0 {
+		result.GCP.PubSubDelayThreshold = override.GCP.PubSubDelayThreshold
+	}
+	if override.GCP.PubSubMaxOutstandingMessages != 0 {
+		result.GCP.PubSubMaxOutstandingMessages = override.GCP.PubSubMaxOutstandingMessages
+	}
+	if override.GCP.PubSubMaxOutstandingBytes != 0 {
+		result.GCP.PubSubMaxOutstandingBytes = override.GCP.PubSubMaxOutstandingBytes
+	}
+	if override.GCP.PubSubCompression != nil {
+		result.GCP.PubSubCompression = override.GCP.PubSubCompression
+	}
+	if override.GCP.PubSubCompressionThreshold != 0 {
+		result.GCP.PubSubCompressionThreshold = override.GCP.PubSubCompressionThreshold
+	}
 	if override.GCP.PubSubRetryMaxAttempts != 0 {
 		result.GCP.PubSubRetryMaxAttempts = override.GCP.PubSubRetryMaxAttempts
 	}
@@ -367,6 +2404,75 @@ func MergeConfigs(base, override *Config) *Config {
 	if override.GCP.DLQTopicID != "" {
 		result.GCP.DLQTopicID = override.GCP.DLQTopicID
 	}
+	if override.GCP.DLQRetryMaxAttempts != 0 {
+		result.GCP.DLQRetryMaxAttempts = override.GCP.DLQRetryMaxAttempts
+	}
+	if override.GCP.DLQFallbackDir != "" {
+		result.GCP.DLQFallbackDir = override.GCP.DLQFallbackDir
+	}
+	if override.GCP.SecondaryProjectID != "" {
+		result.GCP.SecondaryProjectID = override.GCP.SecondaryProjectID
+	}
+	if override.GCP.SecondaryTopicID != "" {
+		result.GCP.SecondaryTopicID = override.GCP.SecondaryTopicID
+	}
+	if override.GCP.CircuitBreakerThreshold != 0 {
+		result.GCP.CircuitBreakerThreshold = override.GCP.CircuitBreakerThreshold
+	}
+	if override.GCP.CircuitBreakerTimeout != 0 {
+		result.GCP.CircuitBreakerTimeout = override.GCP.CircuitBreakerTimeout
+	}
+	if override.GCP.CircuitBreakerState != "" {
+		result.GCP.CircuitBreakerState = override.GCP.CircuitBreakerState
+	}
+	if override.GCP.CircuitBreakerStateTTL != 0 {
+		result.GCP.CircuitBreakerStateTTL = override.GCP.CircuitBreakerStateTTL
+	}
+	if override.GCP.MaxPendingPublishes != 0 {
+		result.GCP.MaxPendingPublishes = override.GCP.MaxPendingPublishes
+	}
+	if len(override.GCP.HighPriorityEvents) > 0 {
+		result.GCP.HighPriorityEvents = override.GCP.HighPriorityEvents
+	}
+	if len(override.GCP.AttributeAllowList) > 0 {
+		result.GCP.AttributeAllowList = override.GCP.AttributeAllowList
+	}
+	if len(override.GCP.EventPolicies) > 0 {
+		// Merge field by field so, e.g., an env DLQ override keeps a retry
+		// budget set in the config file
+		policies := make(map[string]EventPolicy, len(base.GCP.EventPolicies)+len(override.GCP.EventPolicies))
+		for eventType, policy := range base.GCP.EventPolicies {
+			policies[eventType] = policy
+		}
+		for eventType, policy := range override.GCP.EventPolicies {
+			merged := policies[eventType]
+			if policy.RetryMaxAttempts != 0 {
+				merged.RetryMaxAttempts = policy.RetryMaxAttempts
+			}
+			if policy.EnableDLQ != nil {
+				merged.EnableDLQ = policy.EnableDLQ
+			}
+			if policy.TTLSeconds != 0 {
+				merged.TTLSeconds = policy.TTLSeconds
+			}
+			policies[eventType] = merged
+		}
+		result.GCP.EventPolicies = policies
+	}
+	if len(override.GCP.Routes) > 0 {
+		// Routes are ordered, so a later source replaces the whole list
+		result.GCP.Routes = override.GCP.Routes
+	}
+	if len(override.GCP.AttributeRules) > 0 {
+		// Rules are ordered, so a later source replaces the whole list
+		result.GCP.AttributeRules = override.GCP.AttributeRules
+	}
+	if len(override.GCP.HashedAttributes) > 0 {
+		result.GCP.HashedAttributes = override.GCP.HashedAttributes
+	}
+	if override.GCP.AttributeHashKey != "" {
+		result.GCP.AttributeHashKey = override.GCP.AttributeHashKey
+	}
 
 	// Webhook config
 	if override.Webhook.Token != "" {
@@ -378,6 +2484,81 @@ func MergeConfigs(base, override *Config) *Config {
 	if override.Webhook.Path != "" {
 		result.Webhook.Path = override.Webhook.Path
 	}
+	if override.Webhook.DetectSchemaDrift {
+		result.Webhook.DetectSchemaDrift = true
+	}
+	if override.Webhook.UnsupportedEvents != "" {
+		result.Webhook.UnsupportedEvents = override.Webhook.UnsupportedEvents
+	}
+	if len(override.Webhook.Paths) > 0 {
+		result.Webhook.Paths = override.Webhook.Paths
+	}
+	if len(override.Webhook.Middleware) > 0 {
+		result.Webhook.Middleware = override.Webhook.Middleware
+	}
+	if override.Webhook.StrictMethods {
+		result.Webhook.StrictMethods = true
+	}
+	if override.Webhook.ServerTiming {
+		result.Webhook.ServerTiming = true
+	}
+	if override.Webhook.SignatureTolerance != 0 {
+		result.Webhook.SignatureTolerance = override.Webhook.SignatureTolerance
+	}
+	if override.Webhook.SignatureFutureTolerance != 0 {
+		result.Webhook.SignatureFutureTolerance = override.Webhook.SignatureFutureTolerance
+	}
+	if override.Webhook.ClockCheckServer != "" {
+		result.Webhook.ClockCheckServer = override.Webhook.ClockCheckServer
+	}
+	if override.Webhook.DeliveryAttemptHeader != "" {
+		result.Webhook.DeliveryAttemptHeader = override.Webhook.DeliveryAttemptHeader
+	}
+	if override.Webhook.ChecksumAlgorithm != "" {
+		result.Webhook.ChecksumAlgorithm = override.Webhook.ChecksumAlgorithm
+	}
+	if override.Webhook.ChecksumPayload != "" {
+		result.Webhook.ChecksumPayload = override.Webhook.ChecksumPayload
+	}
+	if override.Webhook.SchemaVersion != "" {
+		result.Webhook.SchemaVersion = override.Webhook.SchemaVersion
+	}
+	if override.Webhook.UnblockEventTTL != 0 {
+		result.Webhook.UnblockEventTTL = override.Webhook.UnblockEventTTL
+	}
+	if len(override.Webhook.JobMessagePipelines) > 0 {
+		result.Webhook.JobMessagePipelines = override.Webhook.JobMessagePipelines
+	}
+	if override.Webhook.ShadowSchemaVersion != "" {
+		result.Webhook.ShadowSchemaVersion = override.Webhook.ShadowSchemaVersion
+	}
+	if override.Webhook.ShadowTopicID != "" {
+		result.Webhook.ShadowTopicID = override.Webhook.ShadowTopicID
+	}
+	if override.Webhook.SchemaBaseURL != "" {
+		result.Webhook.SchemaBaseURL = override.Webhook.SchemaBaseURL
+	}
+	if override.Webhook.PingCheck {
+		result.Webhook.PingCheck = true
+	}
+	if override.Webhook.PingTopicID != "" {
+		result.Webhook.PingTopicID = override.Webhook.PingTopicID
+	}
+	if override.Webhook.PartialPayloads {
+		result.Webhook.PartialPayloads = true
+	}
+	if override.Webhook.LegacyPipelineAttribute {
+		result.Webhook.LegacyPipelineAttribute = true
+	}
+	if override.Webhook.MaxDecompressedSize != 0 {
+		result.Webhook.MaxDecompressedSize = override.Webhook.MaxDecompressedSize
+	}
+	if override.Webhook.BatchPath != "" {
+		result.Webhook.BatchPath = override.Webhook.BatchPath
+	}
+	if override.Webhook.BatchMaxItems != 0 {
+		result.Webhook.BatchMaxItems = override.Webhook.BatchMaxItems
+	}
 
 	// Server config
 	if override.Server.Port != 0 {
@@ -386,6 +2567,9 @@ func MergeConfigs(base, override *Config) *Config {
 	if override.Server.LogLevel != "" {
 		result.Server.LogLevel = override.Server.LogLevel
 	}
+	if override.Server.LogFormat != "" {
+		result.Server.LogFormat = override.Server.LogFormat
+	}
 	if override.Server.MaxRequestSize != 0 {
 		result.Server.MaxRequestSize = override.Server.MaxRequestSize
 	}
@@ -401,11 +2585,235 @@ func MergeConfigs(base, override *Config) *Config {
 	if override.Server.IdleTimeout != 0 {
 		result.Server.IdleTimeout = override.Server.IdleTimeout
 	}
+	if override.Server.ReadHeaderTimeout != 0 {
+		result.Server.ReadHeaderTimeout = override.Server.ReadHeaderTimeout
+	}
+	if override.Server.MaxHeaderBytes != 0 {
+		result.Server.MaxHeaderBytes = override.Server.MaxHeaderBytes
+	}
+	if override.Server.DisableKeepAlives {
+		result.Server.DisableKeepAlives = true
+	}
+	if override.Server.EnableH2C {
+		result.Server.EnableH2C = true
+	}
+	if override.Server.HTTP2MaxConcurrentStreams != 0 {
+		result.Server.HTTP2MaxConcurrentStreams = override.Server.HTTP2MaxConcurrentStreams
+	}
+	if override.Server.MaxConnections != 0 {
+		result.Server.MaxConnections = override.Server.MaxConnections
+	}
+	if override.Server.UnixSocket != "" {
+		result.Server.UnixSocket = override.Server.UnixSocket
+	}
+	if override.Server.UnixSocketMode != "" {
+		result.Server.UnixSocketMode = override.Server.UnixSocketMode
+	}
+	if override.Server.SystemdSocket {
+		result.Server.SystemdSocket = true
+	}
+	if override.Server.StartupRetryTimeout != 0 {
+		result.Server.StartupRetryTimeout = override.Server.StartupRetryTimeout
+	}
+	if override.Server.ShutdownSettle != 0 {
+		result.Server.ShutdownSettle = override.Server.ShutdownSettle
+	}
+	if len(override.Server.TimeoutHeaderCIDRs) > 0 {
+		result.Server.TimeoutHeaderCIDRs = override.Server.TimeoutHeaderCIDRs
+	}
+	if override.Server.StatsWindow != 0 {
+		result.Server.StatsWindow = override.Server.StatsWindow
+	}
 
 	// Security config
 	if override.Security.RateLimit != 0 {
 		result.Security.RateLimit = override.Security.RateLimit
 	}
+	if override.Security.RateLimitBurst != 0 {
+		result.Security.RateLimitBurst = override.Security.RateLimitBurst
+	}
+	if override.Security.RateLimitWindow != 0 {
+		result.Security.RateLimitWindow = override.Security.RateLimitWindow
+	}
+	if override.Security.IPRateLimit != 0 {
+		result.Security.IPRateLimit = override.Security.IPRateLimit
+	}
+	if override.Security.IPRateLimitBurst != 0 {
+		result.Security.IPRateLimitBurst = override.Security.IPRateLimitBurst
+	}
+	if override.Security.TokenRateLimit != 0 {
+		result.Security.TokenRateLimit = override.Security.TokenRateLimit
+	}
+	if override.Security.TokenRateLimitBurst != 0 {
+		result.Security.TokenRateLimitBurst = override.Security.TokenRateLimitBurst
+	}
+	if override.Security.TokenRateLimitHeader != "" {
+		result.Security.TokenRateLimitHeader = override.Security.TokenRateLimitHeader
+	}
+	if len(override.Security.TokenRateLimitHeaderCIDRs) > 0 {
+		result.Security.TokenRateLimitHeaderCIDRs = override.Security.TokenRateLimitHeaderCIDRs
+	}
+	if len(override.Security.RateLimitBypassPaths) > 0 {
+		result.Security.RateLimitBypassPaths = override.Security.RateLimitBypassPaths
+	}
+	if len(override.Security.RateLimitBypassCIDRs) > 0 {
+		result.Security.RateLimitBypassCIDRs = override.Security.RateLimitBypassCIDRs
+	}
+	if len(override.Security.CORSAllowedOrigins) > 0 {
+		result.Security.CORSAllowedOrigins = override.Security.CORSAllowedOrigins
+	}
+	if override.Security.AuthBanMaxFailures != 0 {
+		result.Security.AuthBanMaxFailures = override.Security.AuthBanMaxFailures
+	}
+	if override.Security.AuthBanWindow != 0 {
+		result.Security.AuthBanWindow = override.Security.AuthBanWindow
+	}
+	if override.Security.AuthBanCooldown != 0 {
+		result.Security.AuthBanCooldown = override.Security.AuthBanCooldown
+	}
+	if len(override.Security.AuthBanExemptCIDRs) > 0 {
+		result.Security.AuthBanExemptCIDRs = override.Security.AuthBanExemptCIDRs
+	}
+
+	// Admin config
+	if override.Admin.Port != 0 {
+		result.Admin.Port = override.Admin.Port
+	}
+	if override.Admin.BindAddress != "" {
+		result.Admin.BindAddress = override.Admin.BindAddress
+	}
+	if override.Admin.Token != "" {
+		result.Admin.Token = override.Admin.Token
+	}
+	if override.Admin.OIDCIssuer != "" {
+		result.Admin.OIDCIssuer = override.Admin.OIDCIssuer
+	}
+	if override.Admin.OIDCAudience != "" {
+		result.Admin.OIDCAudience = override.Admin.OIDCAudience
+	}
+	if len(override.Admin.OIDCSubjects) > 0 {
+		result.Admin.OIDCSubjects = override.Admin.OIDCSubjects
+	}
+	if override.Admin.EnableDebug {
+		result.Admin.EnableDebug = true
+	}
+	if override.Admin.PauseStateFile != "" {
+		result.Admin.PauseStateFile = override.Admin.PauseStateFile
+	}
+	if override.Admin.PauseRetryAfter != 0 {
+		result.Admin.PauseRetryAfter = override.Admin.PauseRetryAfter
+	}
+	if override.Admin.RecordRequests != 0 {
+		result.Admin.RecordRequests = override.Admin.RecordRequests
+	}
+	if len(override.Admin.RecordRedactFields) > 0 {
+		result.Admin.RecordRedactFields = override.Admin.RecordRedactFields
+	}
+
+	// Dedupe config
+	if override.Dedupe.Backend != "" {
+		result.Dedupe.Backend = override.Dedupe.Backend
+	}
+	if override.Dedupe.RedisURL != "" {
+		result.Dedupe.RedisURL = override.Dedupe.RedisURL
+	}
+	if override.Dedupe.TTL != 0 {
+		result.Dedupe.TTL = override.Dedupe.TTL
+	}
+	if override.Dedupe.TransitionTTL != 0 {
+		result.Dedupe.TransitionTTL = override.Dedupe.TransitionTTL
+	}
+	if override.Dedupe.TransitionMaxBuilds != 0 {
+		result.Dedupe.TransitionMaxBuilds = override.Dedupe.TransitionMaxBuilds
+	}
+
+	// Audit config
+	if override.Audit.Path != "" {
+		result.Audit.Path = override.Audit.Path
+	}
+	if override.Audit.RetentionDays != 0 {
+		result.Audit.RetentionDays = override.Audit.RetentionDays
+	}
+
+	// Ownership config
+	if override.Ownership.File != "" {
+		result.Ownership.File = override.Ownership.File
+	}
+	if override.Ownership.ReloadInterval != 0 {
+		result.Ownership.ReloadInterval = override.Ownership.ReloadInterval
+	}
+
+	// Heartbeat config
+	if override.Heartbeat.Interval != 0 {
+		result.Heartbeat.Interval = override.Heartbeat.Interval
+	}
+	if override.Heartbeat.InstanceID != "" {
+		result.Heartbeat.InstanceID = override.Heartbeat.InstanceID
+	}
+
+	// SubscriptionLag config
+	if len(override.SubscriptionLag.Subscriptions) > 0 {
+		result.SubscriptionLag.Subscriptions = override.SubscriptionLag.Subscriptions
+	}
+	if override.SubscriptionLag.Interval != 0 {
+		result.SubscriptionLag.Interval = override.SubscriptionLag.Interval
+	}
+	if override.SubscriptionLag.MaxAge != 0 {
+		result.SubscriptionLag.MaxAge = override.SubscriptionLag.MaxAge
+	}
+
+	// Confirmation config
+	if len(override.Confirmation.Pipelines) > 0 {
+		result.Confirmation.Pipelines = override.Confirmation.Pipelines
+	}
+	if override.Confirmation.TopicID != "" {
+		result.Confirmation.TopicID = override.Confirmation.TopicID
+	}
+	if override.Confirmation.Timeout != 0 {
+		result.Confirmation.Timeout = override.Confirmation.Timeout
+	}
+
+	// Rejections config
+	if override.Rejections.SampleRate != 0 {
+		result.Rejections.SampleRate = override.Rejections.SampleRate
+	}
+	if override.Rejections.TopicID != "" {
+		result.Rejections.TopicID = override.Rejections.TopicID
+	}
+
+	// Quarantine config
+	if override.Quarantine.Dir != "" {
+		result.Quarantine.Dir = override.Quarantine.Dir
+	}
+	if override.Quarantine.Acknowledge {
+		result.Quarantine.Acknowledge = true
+	}
+
+	// Tracing config
+	if override.Tracing.SampleRatio != 0 {
+		result.Tracing.SampleRatio = override.Tracing.SampleRatio
+	}
+	if override.Tracing.OTLPInsecure != nil {
+		result.Tracing.OTLPInsecure = override.Tracing.OTLPInsecure
+	}
+
+	// Metrics config
+	if override.Metrics.Namespace != "" {
+		result.Metrics.Namespace = override.Metrics.Namespace
+	}
+	if override.Metrics.Subsystem != "" {
+		result.Metrics.Subsystem = override.Metrics.Subsystem
+	}
+	if len(override.Metrics.ConstLabels) > 0 {
+		result.Metrics.ConstLabels = override.Metrics.ConstLabels
+	}
+	if len(override.Metrics.DropLabels) > 0 {
+		result.Metrics.DropLabels = override.Metrics.DropLabels
+	}
+	// Relabel rules are ordered, so a later source replaces the whole list
+	if len(override.Metrics.RelabelRules) > 0 {
+		result.Metrics.RelabelRules = override.Metrics.RelabelRules
+	}
 
 	return &result
 }
@@ -414,31 +2822,46 @@ func MergeConfigs(base, override *Config) *Config {
 // 1. Override (highest precedence)
 // 2. Environment variables
 // 3. Config file
-// 4. Default values (lowest precedence)
+// 4. Default values, adjusted by the profile in override.Profile or
+// CONFIG_PROFILE (lowest precedence)
 func Load(configFile string, override *Config) (*Config, error) {
-	// Start with default configuration
-	cfg := DefaultConfig()
+	profile := os.Getenv("CONFIG_PROFILE")
+	if override != nil && override.Profile != "" {
+		profile = override.Profile
+	}
+	profile = strings.ToLower(profile)
+
+	// Start with the profile's defaults. Each source is read into an empty
+	// configuration so only the values it sets replace them.
+	cfg, err := ProfileDefaults(profile)
+	if err != nil {
+		return nil, err
+	}
 
 	// Load from file if provided
+	var deprecated []Deprecation
 	if configFile != "" {
-		fileCfg, err := LoadFromFile(configFile)
+		fileCfg, err := loadFromFile(configFile, &Config{})
 		if err != nil {
 			return nil, err
 		}
 		cfg = MergeConfigs(cfg, fileCfg)
+		deprecated = fileCfg.Deprecated
 	}
 
 	// Load from environment variables
-	envCfg, err := LoadFromEnv()
+	envCfg, err := loadFromEnv(&Config{})
 	if err != nil {
 		return nil, err
 	}
 	cfg = MergeConfigs(cfg, envCfg)
+	cfg.Deprecated = append(deprecated, envCfg.Deprecated...)
 
 	// Apply explicit overrides
 	if override != nil {
 		cfg = MergeConfigs(cfg, override)
 	}
+	cfg.Profile = profile
 
 	// Validate the final configuration
 	if err := cfg.Validate(); err != nil {
@@ -461,6 +2884,30 @@ func (c *Config) String() string {
 	if copy.Webhook.HMACSecret != "" {
 		copy.Webhook.HMACSecret = "********"
 	}
+	if len(copy.Webhook.Paths) > 0 {
+		copy.Webhook.Paths = append([]WebhookPathConfig(nil), copy.Webhook.Paths...)
+		for i := range copy.Webhook.Paths {
+			if copy.Webhook.Paths[i].Token != "" {
+				copy.Webhook.Paths[i].Token = "********"
+			}
+			if copy.Webhook.Paths[i].HMACSecret != "" {
+				copy.Webhook.Paths[i].HMACSecret = "********"
+			}
+		}
+	}
+	if copy.Admin.Token != "" {
+		copy.Admin.Token = "********"
+	}
+	if copy.GCP.AttributeHashKey != "" {
+		copy.GCP.AttributeHashKey = "********"
+	}
+	if copy.Dedupe.RedisURL != "" {
+		// The URL may embed a password
+		copy.Dedupe.RedisURL = "********"
+	}
+	if strings.HasPrefix(copy.GCP.CircuitBreakerState, "redis") {
+		copy.GCP.CircuitBreakerState = "********"
+	}
 
 	// Convert to JSON
 	bytes, err := json.MarshalIndent(copy, "", "  ")
@@ -3,6 +3,8 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -19,6 +21,10 @@ func TestLoadFromEnv(t *testing.T) {
 		"MAX_REQUEST_SIZE",
 		"REQUEST_TIMEOUT",
 		"RATE_LIMIT",
+		"RATE_LIMIT_BURST",
+		"RATE_LIMIT_WINDOW",
+		"IP_RATE_LIMIT",
+		"IP_RATE_LIMIT_BURST",
 	} {
 		if val, exists := os.LookupEnv(key); exists {
 			envBackup[key] = val
@@ -47,7 +53,11 @@ func TestLoadFromEnv(t *testing.T) {
 	_ = os.Setenv("LOG_LEVEL", "debug")
 	_ = os.Setenv("MAX_REQUEST_SIZE", "5242880") // 5 MB
 	_ = os.Setenv("REQUEST_TIMEOUT", "45")       // 45 seconds
-	_ = os.Setenv("RATE_LIMIT", "120")           // 120 requests per minute
+	_ = os.Setenv("RATE_LIMIT", "120")           // 120 requests per window
+	_ = os.Setenv("RATE_LIMIT_BURST", "20")
+	_ = os.Setenv("RATE_LIMIT_WINDOW", "1") // per second
+	_ = os.Setenv("IP_RATE_LIMIT", "10")
+	_ = os.Setenv("IP_RATE_LIMIT_BURST", "5")
 
 	// Load configuration from environment
 	cfg, err := LoadFromEnv()
@@ -80,6 +90,15 @@ func TestLoadFromEnv(t *testing.T) {
 	if cfg.Security.RateLimit != 120 {
 		t.Errorf("RateLimit = %d, want %d", cfg.Security.RateLimit, 120)
 	}
+	if cfg.Security.RateLimitBurst != 20 {
+		t.Errorf("RateLimitBurst = %d, want %d", cfg.Security.RateLimitBurst, 20)
+	}
+	if cfg.Security.RateLimitWindow != time.Second {
+		t.Errorf("RateLimitWindow = %v, want %v", cfg.Security.RateLimitWindow, time.Second)
+	}
+	if cfg.Security.IPRateLimit != 10 || cfg.Security.IPRateLimitBurst != 5 {
+		t.Errorf("IPRateLimit = %d/%d, want 10/5", cfg.Security.IPRateLimit, cfg.Security.IPRateLimitBurst)
+	}
 }
 
 func TestLoadFromFile(t *testing.T) {
@@ -385,6 +404,160 @@ func TestValidateConfig(t *testing.T) {
 			},
 			wantError: true,
 		},
+		{
+			name: "negative rate limit burst",
+			config: Config{
+				GCP: GCPConfig{
+					ProjectID: "valid-project",
+					TopicID:   "valid-topic",
+				},
+				Webhook: WebhookConfig{
+					Token: "valid-token",
+				},
+				Security: SecurityConfig{
+					RateLimit:        60,
+					IPRateLimitBurst: -1,
+				},
+			},
+			wantError: true,
+		},
+		{
+			name: "rate limit window below one second",
+			config: Config{
+				GCP: GCPConfig{
+					ProjectID: "valid-project",
+					TopicID:   "valid-topic",
+				},
+				Webhook: WebhookConfig{
+					Token: "valid-token",
+				},
+				Security: SecurityConfig{
+					RateLimit:       60,
+					RateLimitWindow: 500 * time.Millisecond,
+				},
+			},
+			wantError: true,
+		},
+		{
+			name: "secondary topic same as primary",
+			config: Config{
+				GCP: GCPConfig{
+					ProjectID:        "valid-project",
+					TopicID:          "valid-topic",
+					SecondaryTopicID: "valid-topic",
+				},
+				Webhook: WebhookConfig{
+					Token: "valid-token",
+				},
+				Server: ServerConfig{
+					Port:     8080,
+					LogLevel: "info",
+				},
+			},
+			wantError: true,
+		},
+		{
+			name: "admin port same as server port",
+			config: Config{
+				GCP: GCPConfig{
+					ProjectID: "valid-project",
+					TopicID:   "valid-topic",
+				},
+				Webhook: WebhookConfig{
+					Token: "valid-token",
+				},
+				Server: ServerConfig{
+					Port:     8080,
+					LogLevel: "info",
+				},
+				Admin: AdminConfig{
+					Port: 8080,
+				},
+			},
+			wantError: true,
+		},
+		{
+			name: "debug endpoints without admin port",
+			config: Config{
+				GCP: GCPConfig{
+					ProjectID: "valid-project",
+					TopicID:   "valid-topic",
+				},
+				Webhook: WebhookConfig{
+					Token: "valid-token",
+				},
+				Server: ServerConfig{
+					Port:     8080,
+					LogLevel: "info",
+				},
+				Admin: AdminConfig{
+					EnableDebug: true,
+				},
+			},
+			wantError: true,
+		},
+		{
+			name: "debug endpoints on admin port",
+			config: Config{
+				GCP: GCPConfig{
+					ProjectID: "valid-project",
+					TopicID:   "valid-topic",
+				},
+				Webhook: WebhookConfig{
+					Token: "valid-token",
+				},
+				Server: ServerConfig{
+					Port:     8080,
+					LogLevel: "info",
+				},
+				Admin: AdminConfig{
+					Port:        9090,
+					EnableDebug: true,
+				},
+			},
+			wantError: false,
+		},
+		{
+			name: "audit index without retention",
+			config: Config{
+				GCP: GCPConfig{
+					ProjectID: "valid-project",
+					TopicID:   "valid-topic",
+				},
+				Webhook: WebhookConfig{
+					Token: "valid-token",
+				},
+				Server: ServerConfig{
+					Port:     8080,
+					LogLevel: "info",
+				},
+				Audit: AuditConfig{
+					Path: "/var/lib/webhook/audit.db",
+				},
+			},
+			wantError: true,
+		},
+		{
+			name: "invalid metrics const label",
+			config: Config{
+				GCP: GCPConfig{
+					ProjectID: "valid-project",
+					TopicID:   "valid-topic",
+				},
+				Webhook: WebhookConfig{
+					Token: "valid-token",
+				},
+				Server: ServerConfig{
+					Port:     8080,
+					LogLevel: "info",
+				},
+				Metrics: MetricsConfig{
+					Namespace:   "mycorp",
+					ConstLabels: map[string]string{"deploy-env": "prod"},
+				},
+			},
+			wantError: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -520,3 +693,1708 @@ func TestLoadWithPrecedence(t *testing.T) {
 		t.Errorf("LogLevel = %q, want %q", cfg4.Server.LogLevel, "debug")
 	}
 }
+
+func TestEventPolicies(t *testing.T) {
+	t.Setenv("EVENT_RETRY_MAX_ATTEMPTS", "build.finished=10, agent.connected=1,malformed")
+	t.Setenv("EVENT_DLQ", "agent.connected=false")
+	t.Setenv("EVENT_TTL", "build.started=3600")
+
+	envCfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+
+	finished := envCfg.GCP.EventPolicies["build.finished"]
+	if finished.RetryMaxAttempts != 10 || finished.EnableDLQ != nil {
+		t.Errorf("build.finished policy = %+v, want 10 attempts and inherited DLQ", finished)
+	}
+	connected := envCfg.GCP.EventPolicies["agent.connected"]
+	if connected.RetryMaxAttempts != 1 || connected.EnableDLQ == nil || *connected.EnableDLQ {
+		t.Errorf("agent.connected policy = %+v, want 1 attempt and DLQ disabled", connected)
+	}
+	if _, ok := envCfg.GCP.EventPolicies["malformed"]; ok {
+		t.Error("malformed entry should be skipped")
+	}
+	if started := envCfg.GCP.EventPolicies["build.started"]; started.TTLSeconds != 3600 {
+		t.Errorf("build.started policy = %+v, want a TTL of 3600 seconds", started)
+	}
+
+	// Env overrides merge field by field with file policies
+	enabled := true
+	fileCfg := DefaultConfig()
+	fileCfg.GCP.EventPolicies = map[string]EventPolicy{
+		"build.finished": {EnableDLQ: &enabled},
+		"job.started":    {RetryMaxAttempts: 3},
+	}
+
+	merged := MergeConfigs(fileCfg, envCfg)
+	finished = merged.GCP.EventPolicies["build.finished"]
+	if finished.RetryMaxAttempts != 10 || finished.EnableDLQ == nil || !*finished.EnableDLQ {
+		t.Errorf("merged build.finished policy = %+v, want 10 attempts and DLQ enabled", finished)
+	}
+	if merged.GCP.EventPolicies["job.started"].RetryMaxAttempts != 3 {
+		t.Error("merged policies lost job.started from base")
+	}
+	if merged.GCP.EventPolicies["build.started"].TTLSeconds != 3600 {
+		t.Error("merged policies lost the build.started TTL")
+	}
+	if len(fileCfg.GCP.EventPolicies) != 2 {
+		t.Error("MergeConfigs modified the base policies")
+	}
+
+	// A per-event DLQ requires a DLQ topic
+	merged.GCP.ProjectID = "project"
+	merged.GCP.TopicID = "topic"
+	merged.Webhook.Token = "token"
+	if err := merged.Validate(); err == nil {
+		t.Error("Validate() expected error for per-event DLQ without DLQ topic")
+	}
+	merged.GCP.DLQTopicID = "topic-dlq"
+	if err := merged.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+	merged.GCP.EventPolicies["build.started"] = EventPolicy{TTLSeconds: -1}
+	if err := merged.Validate(); err == nil {
+		t.Error("Validate() expected error for a negative TTL")
+	}
+}
+
+func TestRoutesValidation(t *testing.T) {
+	base := func(routes ...RouteConfig) Config {
+		cfg := *DefaultConfig()
+		cfg.GCP.ProjectID = "project"
+		cfg.GCP.TopicID = "topic"
+		cfg.Webhook.Token = "token"
+		cfg.GCP.Routes = routes
+		return cfg
+	}
+
+	tests := []struct {
+		name      string
+		config    Config
+		wantError bool
+	}{
+		{
+			name:   "valid routes",
+			config: base(RouteConfig{Name: "prod", TopicID: "prod-events", Branch: "release/*"}, RouteConfig{Name: "dev", TopicID: "dev-events"}),
+		},
+		{
+			name:      "missing topic",
+			config:    base(RouteConfig{Name: "prod"}),
+			wantError: true,
+		},
+		{
+			name:      "reserved name",
+			config:    base(RouteConfig{Name: "default", TopicID: "events"}),
+			wantError: true,
+		},
+		{
+			name:      "duplicate name",
+			config:    base(RouteConfig{Name: "prod", TopicID: "a"}, RouteConfig{Name: "prod", TopicID: "b"}),
+			wantError: true,
+		},
+		{
+			name:      "malformed pattern",
+			config:    base(RouteConfig{Name: "prod", TopicID: "a", Branch: "release/["}),
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if (err != nil) != tt.wantError {
+				t.Errorf("Validate() error = %v, wantError %v", err, tt.wantError)
+			}
+		})
+	}
+
+	t.Setenv("ROUTES", `[{"name":"prod","topic_id":"prod-events","branch":"release/*"}]`)
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	if len(cfg.GCP.Routes) != 1 || cfg.GCP.Routes[0].Branch != "release/*" {
+		t.Errorf("Routes = %+v, want one prod route", cfg.GCP.Routes)
+	}
+
+	t.Setenv("ROUTES", "not json")
+	if _, err := LoadFromEnv(); err == nil {
+		t.Error("LoadFromEnv() expected error for invalid ROUTES")
+	}
+}
+
+func TestWebhookPathsValidation(t *testing.T) {
+	base := func(paths ...WebhookPathConfig) Config {
+		cfg := *DefaultConfig()
+		cfg.GCP.ProjectID = "project"
+		cfg.GCP.TopicID = "topic"
+		cfg.Webhook.Token = "token"
+		cfg.Webhook.Paths = paths
+		return cfg
+	}
+
+	tests := []struct {
+		name      string
+		config    Config
+		wantError bool
+	}{
+		{
+			name: "valid paths",
+			config: base(
+				WebhookPathConfig{Path: "/webhook/builds", EventType: "build.*"},
+				WebhookPathConfig{Path: "/webhook/agents", EventType: "agent.*", TopicID: "agent-events", Token: "agent-token"},
+			),
+		},
+		{
+			name:      "relative path",
+			config:    base(WebhookPathConfig{Path: "webhook/builds"}),
+			wantError: true,
+		},
+		{
+			name:      "same as main webhook path",
+			config:    base(WebhookPathConfig{Path: "/webhook"}),
+			wantError: true,
+		},
+		{
+			name:      "reserved path",
+			config:    base(WebhookPathConfig{Path: "/metrics"}),
+			wantError: true,
+		},
+		{
+			name:      "duplicate path",
+			config:    base(WebhookPathConfig{Path: "/webhook/builds"}, WebhookPathConfig{Path: "/webhook/builds"}),
+			wantError: true,
+		},
+		{
+			name:      "malformed pattern",
+			config:    base(WebhookPathConfig{Path: "/webhook/builds", EventType: "build.["}),
+			wantError: true,
+		},
+		{
+			name: "JWT auth",
+			config: base(WebhookPathConfig{Path: "/webhook/internal", JWT: &JWTAuthConfig{
+				Issuer:           "https://accounts.google.com",
+				Audience:         "buildkite-pubsub",
+				Subjects:         []string{"forwarder@example.iam.gserviceaccount.com"},
+				ClockSkewSeconds: 30,
+			}}),
+		},
+		{
+			name:      "JWT issuer not https",
+			config:    base(WebhookPathConfig{Path: "/webhook/internal", JWT: &JWTAuthConfig{Issuer: "http://issuer.internal", Audience: "webhook"}}),
+			wantError: true,
+		},
+		{
+			name:      "JWT without audience",
+			config:    base(WebhookPathConfig{Path: "/webhook/internal", JWT: &JWTAuthConfig{Issuer: "https://issuer.internal"}}),
+			wantError: true,
+		},
+		{
+			name:      "JWKS URL not https",
+			config:    base(WebhookPathConfig{Path: "/webhook/internal", JWT: &JWTAuthConfig{Issuer: "https://issuer.internal", Audience: "webhook", JWKSURL: "http://issuer.internal/keys"}}),
+			wantError: true,
+		},
+		{
+			name:      "negative JWT clock skew",
+			config:    base(WebhookPathConfig{Path: "/webhook/internal", JWT: &JWTAuthConfig{Issuer: "https://issuer.internal", Audience: "webhook", ClockSkewSeconds: -1}}),
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if (err != nil) != tt.wantError {
+				t.Errorf("Validate() error = %v, wantError %v", err, tt.wantError)
+			}
+		})
+	}
+
+	t.Setenv("WEBHOOK_PATHS", `[{"path":"/webhook/agents","event_type":"agent.*","token":"agent-token"}]`)
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	if len(cfg.Webhook.Paths) != 1 || cfg.Webhook.Paths[0].EventType != "agent.*" {
+		t.Errorf("Paths = %+v, want one agents path", cfg.Webhook.Paths)
+	}
+	if strings.Contains(cfg.String(), "agent-token") {
+		t.Error("String() exposes a webhook path token")
+	}
+
+	t.Setenv("WEBHOOK_PATHS", `[{"path":"/webhook/internal","jwt":{"issuer":"https://issuer.internal","audience":"webhook","jwks_url":"https://issuer.internal/keys","clock_skew_seconds":90}}]`)
+	if cfg, err = LoadFromEnv(); err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	if jwt := cfg.Webhook.Paths[0].JWT; jwt == nil || jwt.JWKSURL != "https://issuer.internal/keys" || jwt.ClockSkewSeconds != 90 {
+		t.Errorf("Paths[0].JWT = %+v, want the issuer's JWKS URL and 90s skew", jwt)
+	}
+
+	t.Setenv("WEBHOOK_PATHS", "not json")
+	if _, err := LoadFromEnv(); err == nil {
+		t.Error("LoadFromEnv() expected error for invalid WEBHOOK_PATHS")
+	}
+}
+
+func TestAuditConfigFromEnv(t *testing.T) {
+	t.Setenv("AUDIT_DB_PATH", "/var/lib/webhook/audit.db")
+	t.Setenv("AUDIT_RETENTION_DAYS", "30")
+
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	if cfg.Audit.Path != "/var/lib/webhook/audit.db" || cfg.Audit.RetentionDays != 30 {
+		t.Errorf("Audit = %+v, want path and 30 days", cfg.Audit)
+	}
+}
+
+func TestMetricsConfigFromEnv(t *testing.T) {
+	t.Setenv("METRICS_NAMESPACE", "mycorp")
+	t.Setenv("METRICS_SUBSYSTEM", "ci")
+	t.Setenv("METRICS_CONST_LABELS", "environment=prod, region=us-east1")
+
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	want := MetricsConfig{
+		Namespace:   "mycorp",
+		Subsystem:   "ci",
+		ConstLabels: map[string]string{"environment": "prod", "region": "us-east1"},
+	}
+	if !reflect.DeepEqual(cfg.Metrics, want) {
+		t.Errorf("Metrics = %+v, want %+v", cfg.Metrics, want)
+	}
+}
+
+func TestMetricsLabelPolicyConfig(t *testing.T) {
+	t.Setenv("METRICS_DROP_LABELS", "pipeline, buildkite_builds_total:branch")
+	t.Setenv("METRICS_RELABEL_RULES", `[{"label":"branch","match":"feature/*","replacement":"feature/*"}]`)
+
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	wantDrop := []string{"pipeline", "buildkite_builds_total:branch"}
+	wantRules := []RelabelRule{{Label: "branch", Match: "feature/*", Replacement: "feature/*"}}
+	if !reflect.DeepEqual(cfg.Metrics.DropLabels, wantDrop) || !reflect.DeepEqual(cfg.Metrics.RelabelRules, wantRules) {
+		t.Errorf("Metrics = %+v, want dropped labels and relabel rules from environment", cfg.Metrics)
+	}
+
+	t.Setenv("METRICS_RELABEL_RULES", "feature/*=feature")
+	if _, err := LoadFromEnv(); err == nil {
+		t.Error("LoadFromEnv() with non-JSON METRICS_RELABEL_RULES error = nil, want error")
+	}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	yamlConfig := `metrics:
+  drop_labels: [branch]
+  relabel_rules:
+    - label: pipeline
+      match: "preview-*"
+      replacement: preview
+`
+	if err := os.WriteFile(path, []byte(yamlConfig), 0o644); err != nil {
+		t.Fatalf("Failed to write test YAML file: %v", err)
+	}
+	fileCfg, err := LoadFromFile(path)
+	if err != nil {
+		t.Fatalf("LoadFromFile() error = %v", err)
+	}
+	if !reflect.DeepEqual(fileCfg.Metrics.DropLabels, []string{"branch"}) ||
+		!reflect.DeepEqual(fileCfg.Metrics.RelabelRules, []RelabelRule{{Label: "pipeline", Match: "preview-*", Replacement: "preview"}}) {
+		t.Errorf("Metrics = %+v, want dropped labels and relabel rules from file", fileCfg.Metrics)
+	}
+
+	for _, metrics := range []MetricsConfig{
+		{DropLabels: []string{"build-branch"}},
+		{DropLabels: []string{"buildkite-builds:branch"}},
+		{RelabelRules: []RelabelRule{{Label: "branch", Match: "feature/[", Replacement: "feature"}}},
+		{RelabelRules: []RelabelRule{{Label: "branch", Replacement: "feature"}}},
+	} {
+		cfg := DefaultConfig()
+		cfg.GCP.ProjectID, cfg.GCP.TopicID, cfg.Webhook.Token = "project", "topic", "token"
+		cfg.Metrics = metrics
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Validate() with Metrics %+v error = nil, want error", metrics)
+		}
+	}
+}
+
+func TestServerTuningConfig(t *testing.T) {
+	t.Setenv("READ_HEADER_TIMEOUT", "2")
+	t.Setenv("MAX_HEADER_BYTES", "65536")
+	t.Setenv("DISABLE_KEEP_ALIVES", "true")
+	t.Setenv("ENABLE_H2C", "1")
+	t.Setenv("HTTP2_MAX_CONCURRENT_STREAMS", "500")
+	t.Setenv("MAX_CONNECTIONS", "2000")
+
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	if cfg.Server.ReadHeaderTimeout != 2*time.Second || cfg.Server.MaxHeaderBytes != 65536 ||
+		!cfg.Server.DisableKeepAlives || !cfg.Server.EnableH2C ||
+		cfg.Server.HTTP2MaxConcurrentStreams != 500 || cfg.Server.MaxConnections != 2000 {
+		t.Errorf("Server = %+v, want tuning from environment", cfg.Server)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	yamlConfig := `server:
+  port: 8888
+  read_header_timeout: "3s"
+  max_header_bytes: 32768
+  enable_h2c: true
+  http2_max_concurrent_streams: 250
+  max_connections: 1000
+`
+	if err := os.WriteFile(path, []byte(yamlConfig), 0o644); err != nil {
+		t.Fatalf("Failed to write test YAML file: %v", err)
+	}
+	fileCfg, err := LoadFromFile(path)
+	if err != nil {
+		t.Fatalf("LoadFromFile() error = %v", err)
+	}
+	if fileCfg.Server.ReadHeaderTimeout != 3*time.Second || fileCfg.Server.MaxHeaderBytes != 32768 ||
+		!fileCfg.Server.EnableH2C || fileCfg.Server.HTTP2MaxConcurrentStreams != 250 || fileCfg.Server.MaxConnections != 1000 {
+		t.Errorf("Server = %+v, want tuning from file", fileCfg.Server)
+	}
+
+	merged := MergeConfigs(DefaultConfig(), fileCfg)
+	if merged.Server.MaxConnections != 1000 || !merged.Server.EnableH2C {
+		t.Errorf("MergeConfigs() Server = %+v, want file tuning", merged.Server)
+	}
+
+	for name, mutate := range map[string]func(*ServerConfig){
+		"negative max header bytes": func(s *ServerConfig) { s.MaxHeaderBytes = -1 },
+		"negative max streams":      func(s *ServerConfig) { s.HTTP2MaxConcurrentStreams = -1 },
+		"negative max connections":  func(s *ServerConfig) { s.MaxConnections = -1 },
+	} {
+		t.Run(name, func(t *testing.T) {
+			invalid := DefaultConfig()
+			invalid.GCP.ProjectID = "project"
+			invalid.GCP.TopicID = "topic"
+			invalid.Webhook.Token = "token"
+			mutate(&invalid.Server)
+			if err := invalid.Validate(); err == nil {
+				t.Error("Validate() expected error")
+			}
+		})
+	}
+}
+
+func TestServerListenerConfig(t *testing.T) {
+	t.Setenv("UNIX_SOCKET", "/run/buildkite-webhook/webhook.sock")
+	t.Setenv("UNIX_SOCKET_MODE", "0600")
+
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	if cfg.Server.UnixSocket != "/run/buildkite-webhook/webhook.sock" || cfg.Server.UnixSocketMode != "0600" {
+		t.Errorf("Server = %+v, want unix socket from environment", cfg.Server)
+	}
+	if DefaultConfig().Server.UnixSocketMode != "0660" {
+		t.Errorf("default UnixSocketMode = %q, want 0660", DefaultConfig().Server.UnixSocketMode)
+	}
+
+	tests := []struct {
+		name    string
+		server  func(*ServerConfig)
+		wantErr bool
+	}{
+		{name: "unix socket", server: func(s *ServerConfig) { s.UnixSocket = "/tmp/webhook.sock" }},
+		{name: "systemd socket", server: func(s *ServerConfig) { s.SystemdSocket = true }},
+		{name: "both", server: func(s *ServerConfig) { s.UnixSocket = "/tmp/webhook.sock"; s.SystemdSocket = true }, wantErr: true},
+		{name: "invalid mode", server: func(s *ServerConfig) { s.UnixSocketMode = "rw-rw----" }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.GCP.ProjectID = "project"
+			c.GCP.TopicID = "topic"
+			c.Webhook.Token = "token"
+			tt.server(&c.Server)
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLogFormatConfig(t *testing.T) {
+	t.Setenv("LOG_FORMAT", "gcp")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	if cfg.Server.LogFormat != "gcp" {
+		t.Errorf("LogFormat = %q, want gcp", cfg.Server.LogFormat)
+	}
+
+	for format, wantErr := range map[string]bool{"": false, "json": false, "gcp": false, "stackdriver": true} {
+		c := DefaultConfig()
+		c.GCP.ProjectID = "project"
+		c.GCP.TopicID = "topic"
+		c.Webhook.Token = "token"
+		c.Server.LogFormat = format
+		if err := c.Validate(); (err != nil) != wantErr {
+			t.Errorf("Validate() with LogFormat %q error = %v, wantErr %v", format, err, wantErr)
+		}
+	}
+}
+
+func TestRateLimitBypassConfig(t *testing.T) {
+	t.Setenv("RATE_LIMIT_BYPASS_PATHS", "/health, /ready")
+	t.Setenv("RATE_LIMIT_BYPASS_CIDRS", "100.24.182.0/24,2600:1f18::1")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	if !reflect.DeepEqual(cfg.Security.RateLimitBypassPaths, []string{"/health", "/ready"}) ||
+		!reflect.DeepEqual(cfg.Security.RateLimitBypassCIDRs, []string{"100.24.182.0/24", "2600:1f18::1"}) {
+		t.Errorf("Security = %+v, want bypass paths and CIDRs from environment", cfg.Security)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	yamlConfig := `security:
+  rate_limit_bypass_paths: ["/health"]
+  rate_limit_bypass_cidrs: ["10.0.0.0/8"]
+`
+	if err := os.WriteFile(path, []byte(yamlConfig), 0o644); err != nil {
+		t.Fatalf("Failed to write test YAML file: %v", err)
+	}
+	fileCfg, err := LoadFromFile(path)
+	if err != nil {
+		t.Fatalf("LoadFromFile() error = %v", err)
+	}
+	if !reflect.DeepEqual(fileCfg.Security.RateLimitBypassPaths, []string{"/health"}) ||
+		!reflect.DeepEqual(fileCfg.Security.RateLimitBypassCIDRs, []string{"10.0.0.0/8"}) {
+		t.Errorf("Security = %+v, want bypass paths and CIDRs from file", fileCfg.Security)
+	}
+
+	for _, security := range []SecurityConfig{
+		{RateLimitBypassPaths: []string{"health"}},
+		{RateLimitBypassPaths: []string{"/health/["}},
+		{RateLimitBypassCIDRs: []string{"10.0.0.0/33"}},
+		{RateLimitBypassCIDRs: []string{"buildkite"}},
+	} {
+		c := DefaultConfig()
+		c.GCP.ProjectID = "project"
+		c.GCP.TopicID = "topic"
+		c.Webhook.Token = "token"
+		c.Security.RateLimitBypassPaths = security.RateLimitBypassPaths
+		c.Security.RateLimitBypassCIDRs = security.RateLimitBypassCIDRs
+		if err := c.Validate(); err == nil {
+			t.Errorf("Validate() with Security %+v error = nil, want error", security)
+		}
+	}
+}
+
+func TestPauseConfig(t *testing.T) {
+	if cfg := DefaultConfig(); cfg.Admin.PauseRetryAfter != time.Minute {
+		t.Errorf("default PauseRetryAfter = %v, want 1m", cfg.Admin.PauseRetryAfter)
+	}
+
+	t.Setenv("PAUSE_STATE_FILE", "/var/lib/webhook/pause.json")
+	t.Setenv("PAUSE_RETRY_AFTER", "300")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	if cfg.Admin.PauseStateFile != "/var/lib/webhook/pause.json" || cfg.Admin.PauseRetryAfter != 5*time.Minute {
+		t.Errorf("Admin = %+v, want pause state file and retry after from environment", cfg.Admin)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	yamlConfig := `admin:
+  port: 9090
+  pause_state_file: /data/pause.json
+  pause_retry_after: "2m"
+`
+	if err := os.WriteFile(path, []byte(yamlConfig), 0o644); err != nil {
+		t.Fatalf("Failed to write test YAML file: %v", err)
+	}
+	fileCfg, err := LoadFromFile(path)
+	if err != nil {
+		t.Fatalf("LoadFromFile() error = %v", err)
+	}
+	if fileCfg.Admin.Port != 9090 || fileCfg.Admin.BindAddress != "127.0.0.1" ||
+		fileCfg.Admin.PauseStateFile != "/data/pause.json" || fileCfg.Admin.PauseRetryAfter != 2*time.Minute {
+		t.Errorf("Admin = %+v, want pause settings from file", fileCfg.Admin)
+	}
+}
+
+func TestHighPriorityEventsConfig(t *testing.T) {
+	t.Setenv("HIGH_PRIORITY_EVENTS", "build.*, job.finished")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	if !reflect.DeepEqual(cfg.GCP.HighPriorityEvents, []string{"build.*", "job.finished"}) {
+		t.Errorf("HighPriorityEvents = %v, want build.* and job.finished", cfg.GCP.HighPriorityEvents)
+	}
+
+	c := DefaultConfig()
+	c.GCP.ProjectID = "project"
+	c.GCP.TopicID = "topic"
+	c.Webhook.Token = "token"
+	c.GCP.HighPriorityEvents = []string{"build.["}
+	if err := c.Validate(); err == nil {
+		t.Error("Validate() with an invalid pattern error = nil, want error")
+	}
+}
+
+func TestWebhookMiddlewareConfig(t *testing.T) {
+	t.Setenv("WEBHOOK_MIDDLEWARE", "request_id, logging, timeout")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	if !reflect.DeepEqual(cfg.Webhook.Middleware, []string{"request_id", "logging", "timeout"}) {
+		t.Errorf("Middleware = %v, want request_id, logging, timeout", cfg.Webhook.Middleware)
+	}
+
+	for order, wantErr := range map[string]bool{
+		"":                      false,
+		"request_id,logging":    false,
+		"logging,request_id":    true,
+		"request_id,csrf":       true,
+		"rate_limit,rate_limit": true,
+	} {
+		c := DefaultConfig()
+		c.GCP.ProjectID = "project"
+		c.GCP.TopicID = "topic"
+		c.Webhook.Token = "token"
+		c.Webhook.Middleware = splitList(order)
+		if err := c.Validate(); (err != nil) != wantErr {
+			t.Errorf("Validate() with Middleware %q error = %v, wantErr %v", order, err, wantErr)
+		}
+	}
+}
+
+func TestWebhookMethodsConfig(t *testing.T) {
+	t.Setenv("WEBHOOK_STRICT_METHODS", "true")
+	t.Setenv("SERVER_TIMING", "1")
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://console.example.com, http://localhost:3000")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	if !cfg.Webhook.StrictMethods {
+		t.Error("StrictMethods = false, want true")
+	}
+	if merged := MergeConfigs(DefaultConfig(), cfg); !merged.Webhook.ServerTiming {
+		t.Error("merged ServerTiming = false, want true")
+	}
+	if !reflect.DeepEqual(cfg.Security.CORSAllowedOrigins, []string{"https://console.example.com", "http://localhost:3000"}) {
+		t.Errorf("CORSAllowedOrigins = %v", cfg.Security.CORSAllowedOrigins)
+	}
+
+	tests := []struct {
+		name    string
+		strict  bool
+		origins []string
+		wantErr bool
+	}{
+		{name: "defaults"},
+		{name: "strict", strict: true},
+		{name: "origins", origins: []string{"https://console.example.com", "*"}},
+		{name: "invalid origin", origins: []string{"console.example.com"}, wantErr: true},
+		{name: "strict with origins", strict: true, origins: []string{"*"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.GCP.ProjectID = "project"
+			c.GCP.TopicID = "topic"
+			c.Webhook.Token = "token"
+			c.Webhook.StrictMethods = tt.strict
+			c.Security.CORSAllowedOrigins = tt.origins
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRecordRequestsConfig(t *testing.T) {
+	t.Setenv("RECORD_REQUESTS", "50")
+	t.Setenv("RECORD_REDACT_FIELDS", "build.env, sender")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	if cfg.Admin.RecordRequests != 50 {
+		t.Errorf("RecordRequests = %d, want 50", cfg.Admin.RecordRequests)
+	}
+	if !reflect.DeepEqual(cfg.Admin.RecordRedactFields, []string{"build.env", "sender"}) {
+		t.Errorf("RecordRedactFields = %v", cfg.Admin.RecordRedactFields)
+	}
+
+	tests := []struct {
+		name    string
+		records int
+		port    int
+		wantErr bool
+	}{
+		{name: "disabled"},
+		{name: "enabled", records: 100, port: 9090},
+		{name: "without admin listener", records: 100, wantErr: true},
+		{name: "negative", records: -1, port: 9090, wantErr: true},
+		{name: "too many", records: 10001, port: 9090, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.GCP.ProjectID = "project"
+			c.GCP.TopicID = "topic"
+			c.Webhook.Token = "token"
+			c.Admin.Port = tt.port
+			c.Admin.RecordRequests = tt.records
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSignatureToleranceConfig(t *testing.T) {
+	t.Setenv("HMAC_TIMESTAMP_TOLERANCE", "600")
+	t.Setenv("HMAC_FUTURE_TOLERANCE", "30")
+	t.Setenv("CLOCK_CHECK_SERVER", "time.google.com")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	if cfg.Webhook.SignatureTolerance != 10*time.Minute || cfg.Webhook.SignatureFutureTolerance != 30*time.Second {
+		t.Errorf("tolerances = %v, %v, want 10m, 30s", cfg.Webhook.SignatureTolerance, cfg.Webhook.SignatureFutureTolerance)
+	}
+	if cfg.Webhook.ClockCheckServer != "time.google.com" {
+		t.Errorf("ClockCheckServer = %q", cfg.Webhook.ClockCheckServer)
+	}
+
+	c := DefaultConfig()
+	c.GCP.ProjectID = "project"
+	c.GCP.TopicID = "topic"
+	c.Webhook.Token = "token"
+	c.Webhook.SignatureTolerance = 2 * time.Hour
+	if err := c.Validate(); err == nil {
+		t.Error("Validate() with a 2h SignatureTolerance error = nil, want error")
+	}
+	c.Webhook.SignatureTolerance = 0
+	c.Webhook.SignatureFutureTolerance = -time.Second
+	if err := c.Validate(); err == nil {
+		t.Error("Validate() with a negative SignatureFutureTolerance error = nil, want error")
+	}
+}
+
+func TestDeliveryAttemptHeaderConfig(t *testing.T) {
+	t.Setenv("DELIVERY_ATTEMPT_HEADER", "X-Delivery-Attempt")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	if cfg.Webhook.DeliveryAttemptHeader != "X-Delivery-Attempt" {
+		t.Errorf("DeliveryAttemptHeader = %q, want X-Delivery-Attempt", cfg.Webhook.DeliveryAttemptHeader)
+	}
+
+	merged := MergeConfigs(DefaultConfig(), cfg)
+	if merged.Webhook.DeliveryAttemptHeader != "X-Delivery-Attempt" {
+		t.Errorf("merged DeliveryAttemptHeader = %q, want X-Delivery-Attempt", merged.Webhook.DeliveryAttemptHeader)
+	}
+}
+
+func TestSchemaVersionConfig(t *testing.T) {
+	t.Setenv("SCHEMA_VERSION", "2")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	merged := MergeConfigs(DefaultConfig(), cfg)
+	if merged.Webhook.SchemaVersion != "2" {
+		t.Errorf("merged SchemaVersion = %q, want 2", merged.Webhook.SchemaVersion)
+	}
+
+	c := DefaultConfig()
+	c.GCP.ProjectID = "project"
+	c.GCP.TopicID = "topic"
+	c.Webhook.Token = "token"
+	for version, valid := range map[string]bool{"": true, "1": true, "2": true, "0": false, "3": false, "v2": false} {
+		c.Webhook.SchemaVersion = version
+		if err := c.Validate(); (err == nil) != valid {
+			t.Errorf("Validate() with SchemaVersion %q error = %v, want valid %v", version, err, valid)
+		}
+	}
+}
+
+func TestShadowPublishConfig(t *testing.T) {
+	t.Setenv("SHADOW_SCHEMA_VERSION", "2")
+	t.Setenv("SHADOW_TOPIC_ID", "events-shadow")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	merged := MergeConfigs(DefaultConfig(), cfg)
+	if merged.Webhook.ShadowSchemaVersion != "2" || merged.Webhook.ShadowTopicID != "events-shadow" {
+		t.Errorf("merged shadow = %q to %q, want 2 to events-shadow", merged.Webhook.ShadowSchemaVersion, merged.Webhook.ShadowTopicID)
+	}
+
+	tests := []struct {
+		name          string
+		schemaVersion string
+		shadowVersion string
+		shadowTopic   string
+		wantErr       bool
+	}{
+		{name: "disabled"},
+		{name: "valid", shadowVersion: "2", shadowTopic: "events-shadow"},
+		{name: "from version 1", schemaVersion: "1", shadowVersion: "2", shadowTopic: "events-shadow"},
+		{name: "missing topic", shadowVersion: "2", wantErr: true},
+		{name: "missing version", shadowTopic: "events-shadow", wantErr: true},
+		{name: "unknown version", shadowVersion: "3", shadowTopic: "events-shadow", wantErr: true},
+		{name: "same version", schemaVersion: "2", shadowVersion: "2", shadowTopic: "events-shadow", wantErr: true},
+		{name: "events topic", shadowVersion: "2", shadowTopic: "topic", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.GCP.ProjectID = "project"
+			c.GCP.TopicID = "topic"
+			c.Webhook.Token = "token"
+			c.Webhook.SchemaVersion = tt.schemaVersion
+			c.Webhook.ShadowSchemaVersion = tt.shadowVersion
+			c.Webhook.ShadowTopicID = tt.shadowTopic
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSchemaBaseURLConfig(t *testing.T) {
+	t.Setenv("SCHEMA_BASE_URL", "https://webhook.example.com")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	merged := MergeConfigs(DefaultConfig(), cfg)
+	if merged.Webhook.SchemaBaseURL != "https://webhook.example.com" {
+		t.Errorf("merged SchemaBaseURL = %q, want https://webhook.example.com", merged.Webhook.SchemaBaseURL)
+	}
+
+	tests := []struct {
+		name    string
+		baseURL string
+		wantErr bool
+	}{
+		{name: "disabled"},
+		{name: "https", baseURL: "https://webhook.example.com"},
+		{name: "with a path", baseURL: "http://proxy.internal/buildkite/"},
+		{name: "no scheme", baseURL: "webhook.example.com", wantErr: true},
+		{name: "query", baseURL: "https://webhook.example.com?v=1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.GCP.ProjectID = "project"
+			c.GCP.TopicID = "topic"
+			c.Webhook.Token = "token"
+			c.Webhook.SchemaBaseURL = tt.baseURL
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTransitionDedupeConfig(t *testing.T) {
+	t.Setenv("DEDUPE_TRANSITION_TTL", "3600")
+	t.Setenv("DEDUPE_TRANSITION_MAX_BUILDS", "500")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	merged := MergeConfigs(DefaultConfig(), cfg)
+	if merged.Dedupe.TransitionTTL != time.Hour || merged.Dedupe.TransitionMaxBuilds != 500 {
+		t.Errorf("transition dedupe = %v, %d, want 1h, 500", merged.Dedupe.TransitionTTL, merged.Dedupe.TransitionMaxBuilds)
+	}
+
+	c := DefaultConfig()
+	c.GCP.ProjectID = "project"
+	c.GCP.TopicID = "topic"
+	c.Webhook.Token = "token"
+	c.Dedupe.TransitionTTL = time.Hour
+	if err := c.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+	c.Dedupe.TransitionMaxBuilds = 0
+	if err := c.Validate(); err == nil {
+		t.Error("Validate() without TransitionMaxBuilds error = nil, want error")
+	}
+}
+
+func TestStatsWindowConfig(t *testing.T) {
+	t.Setenv("STATS_WINDOW", "30")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	if merged := MergeConfigs(DefaultConfig(), cfg); merged.Server.StatsWindow != 30*time.Second {
+		t.Errorf("merged StatsWindow = %v, want 30s", merged.Server.StatsWindow)
+	}
+
+	c := DefaultConfig()
+	c.GCP.ProjectID = "project"
+	c.GCP.TopicID = "topic"
+	c.Webhook.Token = "token"
+	c.Server.StatsWindow = 2 * time.Hour
+	if err := c.Validate(); err == nil {
+		t.Error("Validate() with a 2h StatsWindow error = nil, want error")
+	}
+}
+
+func TestUnblockEventTTLConfig(t *testing.T) {
+	t.Setenv("UNBLOCK_EVENT_TTL", "86400")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	merged := MergeConfigs(DefaultConfig(), cfg)
+	if merged.Webhook.UnblockEventTTL != 24*time.Hour {
+		t.Errorf("merged UnblockEventTTL = %v, want 24h", merged.Webhook.UnblockEventTTL)
+	}
+
+	merged.GCP.ProjectID = "project"
+	merged.GCP.TopicID = "topic"
+	merged.Webhook.Token = "token"
+	if err := merged.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+	merged.Webhook.UnblockEventTTL = time.Second
+	if err := merged.Validate(); err == nil {
+		t.Error("Validate() with a 1s UnblockEventTTL error = nil, want error")
+	}
+}
+
+func TestJobMessagePipelinesConfig(t *testing.T) {
+	t.Setenv("JOB_MESSAGE_PIPELINES", "monorepo, test-*")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	merged := MergeConfigs(DefaultConfig(), cfg)
+	if want := []string{"monorepo", "test-*"}; !reflect.DeepEqual(merged.Webhook.JobMessagePipelines, want) {
+		t.Errorf("JobMessagePipelines = %v, want %v", merged.Webhook.JobMessagePipelines, want)
+	}
+
+	merged.GCP.ProjectID = "project"
+	merged.GCP.TopicID = "topic"
+	merged.Webhook.Token = "token"
+	if err := merged.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+	merged.Webhook.JobMessagePipelines = []string{"["}
+	if err := merged.Validate(); err == nil {
+		t.Error("Validate() with an invalid pattern error = nil, want error")
+	}
+}
+
+func TestAuthBanConfig(t *testing.T) {
+	t.Setenv("AUTH_BAN_MAX_FAILURES", "5")
+	t.Setenv("AUTH_BAN_WINDOW", "60")
+	t.Setenv("AUTH_BAN_EXEMPT_CIDRS", "10.0.0.0/8, 192.0.2.1")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	merged := MergeConfigs(DefaultConfig(), cfg)
+	if merged.Security.AuthBanMaxFailures != 5 || merged.Security.AuthBanWindow != time.Minute || merged.Security.AuthBanCooldown != 15*time.Minute {
+		t.Errorf("auth ban = %d failures in %v for %v, want 5 in 1m0s for the default 15m0s",
+			merged.Security.AuthBanMaxFailures, merged.Security.AuthBanWindow, merged.Security.AuthBanCooldown)
+	}
+	if want := []string{"10.0.0.0/8", "192.0.2.1"}; !reflect.DeepEqual(merged.Security.AuthBanExemptCIDRs, want) {
+		t.Errorf("AuthBanExemptCIDRs = %v, want %v", merged.Security.AuthBanExemptCIDRs, want)
+	}
+
+	merged.GCP.ProjectID = "project"
+	merged.GCP.TopicID = "topic"
+	merged.Webhook.Token = "token"
+	if err := merged.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+	merged.Security.AuthBanCooldown = 0
+	if err := merged.Validate(); err == nil {
+		t.Error("Validate() with no cooldown error = nil, want error")
+	}
+	merged.Security.AuthBanCooldown = time.Hour
+	merged.Security.AuthBanExemptCIDRs = []string{"10.0.0.0/33"}
+	if err := merged.Validate(); err == nil {
+		t.Error("Validate() with an invalid exempt network error = nil, want error")
+	}
+}
+
+func TestAttributeRulesConfig(t *testing.T) {
+	t.Setenv("ATTRIBUTE_RULES", `[{"attribute":"team","value":"payments","pipeline":"payments-*"}]`)
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	want := []AttributeRuleConfig{{Attribute: "team", Value: "payments", Pipeline: "payments-*"}}
+	if !reflect.DeepEqual(cfg.GCP.AttributeRules, want) {
+		t.Errorf("AttributeRules = %+v, want %+v", cfg.GCP.AttributeRules, want)
+	}
+
+	t.Setenv("ATTRIBUTE_RULES", "team=payments")
+	if _, err := LoadFromEnv(); err == nil {
+		t.Error("LoadFromEnv() with malformed ATTRIBUTE_RULES error = nil, want error")
+	}
+
+	tests := []struct {
+		name    string
+		rule    AttributeRuleConfig
+		wantErr bool
+	}{
+		{name: "valid", rule: AttributeRuleConfig{Attribute: "severity", Value: "high", BuildState: "failed"}},
+		{name: "missing value", rule: AttributeRuleConfig{Attribute: "severity"}, wantErr: true},
+		{name: "invalid pattern", rule: AttributeRuleConfig{Attribute: "team", Value: "x", Pipeline: "[payments"}, wantErr: true},
+		{name: "value expression", rule: AttributeRuleConfig{Attribute: "team", ValueExpression: "build.pipeline.split('-')[0]", Expression: "has(build.pipeline)"}},
+		{name: "value and value expression", rule: AttributeRuleConfig{Attribute: "team", Value: "x", ValueExpression: "build.pipeline"}, wantErr: true},
+		{name: "invalid value expression", rule: AttributeRuleConfig{Attribute: "team", ValueExpression: "build.pipeline =="}, wantErr: true},
+		{name: "invalid expression", rule: AttributeRuleConfig{Attribute: "team", Value: "x", Expression: "'not a condition'"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.GCP.ProjectID = "project"
+			c.GCP.TopicID = "topic"
+			c.Webhook.Token = "token"
+			c.GCP.AttributeRules = []AttributeRuleConfig{tt.rule}
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHashedAttributesConfig(t *testing.T) {
+	t.Setenv("HASHED_ATTRIBUTES", "creator_email, branch")
+	t.Setenv("ATTRIBUTE_HASH_KEY", "0123456789abcdef")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	merged := MergeConfigs(DefaultConfig(), cfg)
+	if want := []string{"creator_email", "branch"}; !reflect.DeepEqual(merged.GCP.HashedAttributes, want) {
+		t.Errorf("HashedAttributes = %v, want %v", merged.GCP.HashedAttributes, want)
+	}
+	if merged.GCP.AttributeHashKey != "0123456789abcdef" {
+		t.Errorf("AttributeHashKey = %q, want the env value", merged.GCP.AttributeHashKey)
+	}
+	if strings.Contains(merged.String(), "0123456789abcdef") {
+		t.Error("String() exposes the attribute hash key")
+	}
+
+	tests := []struct {
+		name    string
+		key     string
+		wantErr bool
+	}{
+		{name: "key", key: "0123456789abcdef"},
+		{name: "missing key", wantErr: true},
+		{name: "short key", key: "secret", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.GCP.ProjectID = "project"
+			c.GCP.TopicID = "topic"
+			c.Webhook.Token = "token"
+			c.GCP.HashedAttributes = []string{"creator_email"}
+			c.GCP.AttributeHashKey = tt.key
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExpressionsConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		route   string
+		path    string
+		wantErr bool
+	}{
+		{name: "valid", route: "build.state == 'failed' && build.branch == 'main'", path: "event_type.startsWith('agent.')"},
+		{name: "invalid route", route: "build.state = 'failed'", wantErr: true},
+		{name: "route returns string", route: "'failed'", wantErr: true},
+		{name: "invalid path", path: "job.state == 'failed'", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.GCP.ProjectID = "project"
+			c.GCP.TopicID = "topic"
+			c.Webhook.Token = "token"
+			c.GCP.Routes = []RouteConfig{{Name: "failures", TopicID: "failures", Expression: tt.route}}
+			c.Webhook.Paths = []WebhookPathConfig{{Path: "/webhook/agents", Expression: tt.path}}
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOwnershipConfig(t *testing.T) {
+	t.Setenv("OWNERSHIP_FILE", "/etc/buildkite-pubsub/owners.yaml")
+	t.Setenv("OWNERSHIP_RELOAD_INTERVAL", "60")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	if cfg.Ownership.File != "/etc/buildkite-pubsub/owners.yaml" || cfg.Ownership.ReloadInterval != time.Minute {
+		t.Errorf("Ownership = %+v, want the file with a 1m reload interval", cfg.Ownership)
+	}
+
+	c := DefaultConfig()
+	c.GCP.ProjectID = "project"
+	c.GCP.TopicID = "topic"
+	c.Webhook.Token = "token"
+	c.Ownership.ReloadInterval = -time.Second
+	if err := c.Validate(); err == nil {
+		t.Error("Validate() with a negative Ownership.ReloadInterval error = nil, want error")
+	}
+}
+
+func TestHeartbeatConfig(t *testing.T) {
+	t.Setenv("HEARTBEAT_INTERVAL", "60")
+	t.Setenv("HEARTBEAT_INSTANCE_ID", "webhook-1")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	if cfg.Heartbeat.Interval != time.Minute || cfg.Heartbeat.InstanceID != "webhook-1" {
+		t.Errorf("Heartbeat = %+v, want a 1m interval for webhook-1", cfg.Heartbeat)
+	}
+
+	c := DefaultConfig()
+	c.GCP.ProjectID = "project"
+	c.GCP.TopicID = "topic"
+	c.Webhook.Token = "token"
+	c.Heartbeat.Interval = -time.Second
+	if err := c.Validate(); err == nil {
+		t.Error("Validate() with a negative Heartbeat.Interval error = nil, want error")
+	}
+}
+
+func TestRejectionsConfig(t *testing.T) {
+	t.Setenv("REJECTION_SAMPLE_RATE", "0.25")
+	t.Setenv("REJECTION_TOPIC_ID", "webhook-rejections")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	if cfg.Rejections.SampleRate != 0.25 || cfg.Rejections.TopicID != "webhook-rejections" {
+		t.Errorf("Rejections = %+v, want a 0.25 sample into webhook-rejections", cfg.Rejections)
+	}
+
+	for _, rate := range []float64{-0.1, 1.5} {
+		c := DefaultConfig()
+		c.GCP.ProjectID = "project"
+		c.GCP.TopicID = "topic"
+		c.Webhook.Token = "token"
+		c.Rejections.SampleRate = rate
+		if err := c.Validate(); err == nil {
+			t.Errorf("Validate() with Rejections.SampleRate %v error = nil, want error", rate)
+		}
+	}
+}
+
+func TestQuarantineConfig(t *testing.T) {
+	t.Setenv("QUARANTINE_DIR", "/var/lib/quarantine")
+	t.Setenv("QUARANTINE_ACKNOWLEDGE", "true")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	merged := MergeConfigs(DefaultConfig(), cfg)
+	if merged.Quarantine.Dir != "/var/lib/quarantine" || !merged.Quarantine.Acknowledge {
+		t.Errorf("Quarantine = %+v, want /var/lib/quarantine, acknowledged", merged.Quarantine)
+	}
+
+	merged.GCP.ProjectID = "project"
+	merged.GCP.TopicID = "topic"
+	merged.Webhook.Token = "token"
+	if err := merged.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+	merged.Quarantine.Dir = ""
+	if err := merged.Validate(); err == nil {
+		t.Error("Validate() with Quarantine.Acknowledge and no Dir error = nil, want error")
+	}
+}
+
+func TestChecksumConfig(t *testing.T) {
+	t.Setenv("CHECKSUM_ALGORITHM", "SHA512")
+	t.Setenv("CHECKSUM_PAYLOAD", "raw")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	if cfg.Webhook.ChecksumAlgorithm != ChecksumSHA512 || cfg.Webhook.ChecksumPayload != ChecksumPayloadRaw {
+		t.Errorf("checksum = %q of %q, want sha512 of raw", cfg.Webhook.ChecksumAlgorithm, cfg.Webhook.ChecksumPayload)
+	}
+
+	for name, set := range map[string]func(*Config){
+		"algorithm": func(c *Config) { c.Webhook.ChecksumAlgorithm = "md5" },
+		"payload":   func(c *Config) { c.Webhook.ChecksumPayload = "body" },
+	} {
+		c := DefaultConfig()
+		c.GCP.ProjectID = "project"
+		c.GCP.TopicID = "topic"
+		c.Webhook.Token = "token"
+		set(c)
+		if err := c.Validate(); err == nil {
+			t.Errorf("Validate() with an unknown checksum %s error = nil, want error", name)
+		}
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	// Earlier tests may leave these set
+	for _, key := range []string{"LOG_LEVEL", "LOG_FORMAT", "RATE_LIMIT", "RATE_LIMIT_BURST", "TRACE_SAMPLE_RATIO", "REJECTION_SAMPLE_RATE"} {
+		t.Setenv(key, "")
+	}
+	t.Setenv("PROJECT_ID", "project")
+	t.Setenv("TOPIC_ID", "topic")
+	t.Setenv("BUILDKITE_WEBHOOK_TOKEN", "token")
+
+	t.Setenv("CONFIG_PROFILE", "Development")
+	cfg, err := Load("", nil)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Profile != ProfileDevelopment || cfg.Server.LogFormat != "dev" || cfg.Server.LogLevel != "debug" {
+		t.Errorf("profile %q logs %s at %s, want development dev logs at debug", cfg.Profile, cfg.Server.LogFormat, cfg.Server.LogLevel)
+	}
+	if cfg.Tracing.OTLPInsecure == nil || !*cfg.Tracing.OTLPInsecure || cfg.Tracing.SampleRatio != 1 || cfg.Rejections.SampleRate != 1 {
+		t.Errorf("Tracing = %+v, Rejections = %+v, want everything sampled over insecure OTLP", cfg.Tracing, cfg.Rejections)
+	}
+
+	// The override's profile wins over CONFIG_PROFILE, and the file and
+	// environment win over the profile
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(configPath, []byte("security:\n  rate_limit: 100\ntracing:\n  sample_ratio: 0.5\n"), 0o644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	t.Setenv("REJECTION_SAMPLE_RATE", "0.2")
+	cfg, err = Load(configPath, &Config{Profile: ProfileProduction})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Profile != ProfileProduction || cfg.Server.LogFormat != "" || cfg.Security.RateLimitBurst != 200 {
+		t.Errorf("profile %q logs %q with burst %d, want production defaults", cfg.Profile, cfg.Server.LogFormat, cfg.Security.RateLimitBurst)
+	}
+	if cfg.Security.RateLimit != 100 || cfg.Tracing.SampleRatio != 0.5 || cfg.Rejections.SampleRate != 0.2 {
+		t.Errorf("rate limit %d, trace ratio %v, rejection rate %v, want the file and environment values",
+			cfg.Security.RateLimit, cfg.Tracing.SampleRatio, cfg.Rejections.SampleRate)
+	}
+	if cfg.Tracing.OTLPInsecure == nil || *cfg.Tracing.OTLPInsecure {
+		t.Errorf("OTLPInsecure = %v, want false", cfg.Tracing.OTLPInsecure)
+	}
+
+	t.Setenv("CONFIG_PROFILE", "qa")
+	if _, err := Load("", nil); err == nil || !strings.Contains(err.Error(), `"qa"`) {
+		t.Errorf("Load() with an unknown profile error = %v, want it named", err)
+	}
+}
+
+func TestTracingConfig(t *testing.T) {
+	t.Setenv("TRACE_SAMPLE_RATIO", "0.05")
+	t.Setenv("OTEL_EXPORTER_OTLP_INSECURE", "true")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	if cfg.Tracing.SampleRatio != 0.05 || cfg.Tracing.OTLPInsecure == nil || !*cfg.Tracing.OTLPInsecure {
+		t.Errorf("Tracing = %+v, want a 0.05 ratio over insecure OTLP", cfg.Tracing)
+	}
+
+	c := DefaultConfig()
+	c.GCP.ProjectID = "project"
+	c.GCP.TopicID = "topic"
+	c.Webhook.Token = "token"
+	c.Tracing.SampleRatio = 2
+	if err := c.Validate(); err == nil {
+		t.Error("Validate() with Tracing.SampleRatio 2 error = nil, want error")
+	}
+}
+
+func TestCredentialsConfig(t *testing.T) {
+	t.Setenv("GCP_CREDENTIALS_MODE", "Impersonation")
+	t.Setenv("GCP_CREDENTIALS_FILE", "/var/run/secrets/federation.json")
+	t.Setenv("GCP_IMPERSONATE_SERVICE_ACCOUNT", "publisher@project.iam.gserviceaccount.com")
+	t.Setenv("GCP_IMPERSONATE_DELEGATES", "a@project.iam.gserviceaccount.com, b@project.iam.gserviceaccount.com")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	want := CredentialsConfig{
+		Mode:            CredentialsImpersonation,
+		File:            "/var/run/secrets/federation.json",
+		TargetPrincipal: "publisher@project.iam.gserviceaccount.com",
+		Delegates:       []string{"a@project.iam.gserviceaccount.com", "b@project.iam.gserviceaccount.com"},
+	}
+	if !reflect.DeepEqual(cfg.GCP.Credentials, want) {
+		t.Errorf("Credentials = %+v, want %+v", cfg.GCP.Credentials, want)
+	}
+
+	tests := []struct {
+		creds   CredentialsConfig
+		wantErr bool
+	}{
+		{CredentialsConfig{}, false},
+		{CredentialsConfig{Mode: CredentialsADC, File: "creds.json"}, false},
+		{CredentialsConfig{Mode: CredentialsKeyFile, File: "key.json"}, false},
+		{CredentialsConfig{Mode: CredentialsKeyFile}, true},
+		{CredentialsConfig{Mode: CredentialsWorkloadIdentityFederation}, true},
+		{CredentialsConfig{Mode: CredentialsImpersonation, TargetPrincipal: "sa@p.iam.gserviceaccount.com"}, false},
+		{CredentialsConfig{Mode: CredentialsImpersonation}, true},
+		{CredentialsConfig{Mode: CredentialsKeyFile, File: "key.json", TargetPrincipal: "sa@p.iam.gserviceaccount.com"}, true},
+		{CredentialsConfig{Delegates: []string{"sa@p.iam.gserviceaccount.com"}}, true},
+		{CredentialsConfig{Mode: "oidc"}, true},
+	}
+	for _, tt := range tests {
+		c := DefaultConfig()
+		c.GCP.ProjectID = "project"
+		c.GCP.TopicID = "topic"
+		c.Webhook.Token = "token"
+		c.GCP.Credentials = tt.creds
+		if err := c.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("Validate() with %+v error = %v, wantErr %v", tt.creds, err, tt.wantErr)
+		}
+	}
+}
+
+func TestPublishSettingsConfig(t *testing.T) {
+	t.Setenv("PUBSUB_DELAY_THRESHOLD_MS", "50")
+	t.Setenv("PUBSUB_MAX_OUTSTANDING_MESSAGES", "5000")
+	t.Setenv("PUBSUB_MAX_OUTSTANDING_BYTES", "200000000")
+	t.Setenv("PUBSUB_COMPRESSION", "false")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	if cfg.GCP.PubSubDelayThreshold != 50*time.Millisecond || cfg.GCP.PubSubMaxOutstandingMessages != 5000 ||
+		cfg.GCP.PubSubMaxOutstandingBytes != 200e6 || cfg.GCP.PubSubCompression == nil || *cfg.GCP.PubSubCompression {
+		t.Errorf("GCP = %+v, want the publish settings from the environment", cfg.GCP)
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr bool
+	}{
+		{"defaults", func(c *Config) {}, false},
+		{"batch too large", func(c *Config) { c.GCP.PubSubBatchSize = 1001 }, true},
+		{"bytes too large", func(c *Config) { c.GCP.PubSubByteThreshold = 11e6 }, true},
+		{"negative delay", func(c *Config) { c.GCP.PubSubDelayThreshold = -time.Millisecond }, true},
+		{"outstanding below batch", func(c *Config) { c.GCP.PubSubMaxOutstandingBytes = 1000 }, true},
+	}
+	for _, tt := range tests {
+		c := DefaultConfig()
+		c.GCP.ProjectID = "project"
+		c.GCP.TopicID = "topic"
+		c.Webhook.Token = "token"
+		tt.modify(c)
+		if err := c.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: Validate() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestLoadFromFileUnknownKeys(t *testing.T) {
+	dir := t.TempDir()
+	tests := map[string]struct {
+		content string
+		key     string
+	}{
+		"config.yaml":       {"gcp:\n  project_id: p\nwebhook:\n  token: t\n  hmac_secert: s\n", "webhook.hmac_secert"},
+		"top.yaml":          {"gcp:\n  project_id: p\nprofile: production\n", "profile"},
+		"route.yml":         {"gcp:\n  routes:\n    - name: r\n      topik: t\n", "gcp.routes[0].topik"},
+		"policy.yaml":       {"gcp:\n  event_policies:\n    build.finished:\n      retries: 3\n", "gcp.event_policies.build.finished.retries"},
+		"config.json":       {`{"server": {"port": 8080, "log_levle": "debug"}}`, "server.log_levle"},
+		"durations.json":    {`{"server": {"read_timeout": "5s"}, "security": {"rate_limit_windw": "1m"}}`, "security.rate_limit_windw"},
+		"relabel_rule.json": {`{"metrics": {"relabel_rules": [{"label": "branch", "match": "*", "replace": "x"}]}}`, "metrics.relabel_rules[0].replace"},
+	}
+	for name, tt := range tests {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+		_, err := LoadFromFile(path)
+		if err == nil || !strings.Contains(err.Error(), "unknown key "+tt.key+" ") {
+			t.Errorf("LoadFromFile(%s) error = %v, want unknown key %s", name, err, tt.key)
+		}
+	}
+
+	// Known keys at every level, including free-form map keys, are accepted
+	path := filepath.Join(dir, "valid.yaml")
+	content := "gcp:\n  project_id: p\n  event_policies:\n    build.finished:\n      retry_max_attempts: 3\nmetrics:\n  const_labels:\n    region: us\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	if _, err := LoadFromFile(path); err != nil {
+		t.Errorf("LoadFromFile() error = %v", err)
+	}
+
+	// CONFIG_STRICT=false ignores unknown keys
+	t.Setenv("CONFIG_STRICT", "false")
+	cfg, err := LoadFromFile(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatalf("LoadFromFile() with CONFIG_STRICT=false error = %v", err)
+	}
+	if cfg.Webhook.Token != "t" {
+		t.Errorf("Webhook.Token = %q, want the known keys loaded", cfg.Webhook.Token)
+	}
+}
+
+func TestTimeoutHeaderCIDRsConfig(t *testing.T) {
+	t.Setenv("REQUEST_TIMEOUT_HEADER_CIDRS", "10.0.0.0/8, 192.0.2.1")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	if want := []string{"10.0.0.0/8", "192.0.2.1"}; !reflect.DeepEqual(cfg.Server.TimeoutHeaderCIDRs, want) {
+		t.Errorf("TimeoutHeaderCIDRs = %v, want %v", cfg.Server.TimeoutHeaderCIDRs, want)
+	}
+
+	cfg.GCP.ProjectID = "project"
+	cfg.GCP.TopicID = "topic"
+	cfg.Webhook.Token = "token"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+	cfg.Server.TimeoutHeaderCIDRs = []string{"10.0.0.0/33"}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Validate() with an invalid network error = nil, want error")
+	}
+}
+
+func TestTokenRateLimitHeaderCIDRsConfig(t *testing.T) {
+	t.Setenv("TOKEN_RATE_LIMIT_HEADER", "X-Tenant-ID")
+	t.Setenv("TOKEN_RATE_LIMIT_HEADER_CIDRS", "10.0.0.0/8, 192.0.2.1")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	if want := []string{"10.0.0.0/8", "192.0.2.1"}; !reflect.DeepEqual(cfg.Security.TokenRateLimitHeaderCIDRs, want) {
+		t.Errorf("TokenRateLimitHeaderCIDRs = %v, want %v", cfg.Security.TokenRateLimitHeaderCIDRs, want)
+	}
+
+	cfg.GCP.ProjectID = "project"
+	cfg.GCP.TopicID = "topic"
+	cfg.Webhook.Token = "token"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+	cfg.Security.TokenRateLimitHeaderCIDRs = []string{"10.0.0.0/33"}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Validate() with an invalid network error = nil, want error")
+	}
+	cfg.Security.TokenRateLimitHeaderCIDRs = nil
+	if err := cfg.Validate(); err == nil {
+		t.Error("Validate() with a header and no trusted networks error = nil, want error")
+	}
+}
+
+func TestShutdownSettleConfig(t *testing.T) {
+	t.Setenv("SHUTDOWN_SETTLE", "10")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	merged := MergeConfigs(DefaultConfig(), cfg)
+	if merged.Server.ShutdownSettle != 10*time.Second {
+		t.Errorf("ShutdownSettle = %v, want 10s", merged.Server.ShutdownSettle)
+	}
+
+	merged.GCP.ProjectID = "project"
+	merged.GCP.TopicID = "topic"
+	merged.Webhook.Token = "token"
+	if err := merged.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+	merged.Server.ShutdownSettle = -time.Second
+	if err := merged.Validate(); err == nil {
+		t.Error("Validate() with a negative ShutdownSettle error = nil, want error")
+	}
+}
+
+func TestPingCheckConfig(t *testing.T) {
+	t.Setenv("PING_CHECK", "true")
+	t.Setenv("PING_TOPIC_ID", "buildkite-pings")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	merged := MergeConfigs(DefaultConfig(), cfg)
+	if !merged.Webhook.PingCheck || merged.Webhook.PingTopicID != "buildkite-pings" {
+		t.Errorf("ping check = %v to %q, want enabled to buildkite-pings", merged.Webhook.PingCheck, merged.Webhook.PingTopicID)
+	}
+
+	merged.GCP.ProjectID = "project"
+	merged.GCP.TopicID = "topic"
+	merged.Webhook.Token = "token"
+	if err := merged.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+	merged.Webhook.PingCheck = false
+	if err := merged.Validate(); err == nil {
+		t.Error("Validate() with PingTopicID and no PingCheck error = nil, want error")
+	}
+}
+
+func TestPartialPayloadsConfig(t *testing.T) {
+	t.Setenv("PARTIAL_PAYLOADS", "true")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	if merged := MergeConfigs(DefaultConfig(), cfg); !merged.Webhook.PartialPayloads {
+		t.Error("Webhook.PartialPayloads = false, want true")
+	}
+}
+
+func TestLegacyPipelineAttributeConfig(t *testing.T) {
+	t.Setenv("LEGACY_PIPELINE_ATTRIBUTE", "true")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	if merged := MergeConfigs(DefaultConfig(), cfg); !merged.Webhook.LegacyPipelineAttribute {
+		t.Error("Webhook.LegacyPipelineAttribute = false, want true")
+	}
+}
+
+func TestMaxDecompressedSizeConfig(t *testing.T) {
+	t.Setenv("MAX_DECOMPRESSED_SIZE", "2097152")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	merged := MergeConfigs(DefaultConfig(), cfg)
+	if merged.Webhook.MaxDecompressedSize != 2<<20 {
+		t.Errorf("Webhook.MaxDecompressedSize = %d, want %d", merged.Webhook.MaxDecompressedSize, 2<<20)
+	}
+
+	merged.GCP.ProjectID = "project"
+	merged.GCP.TopicID = "topic"
+	merged.Webhook.Token = "token"
+	merged.Webhook.MaxDecompressedSize = -1
+	if err := merged.Validate(); err == nil {
+		t.Error("Validate() with a negative MaxDecompressedSize error = nil, want error")
+	}
+}
+
+func TestWebhookBatchConfig(t *testing.T) {
+	t.Setenv("WEBHOOK_BATCH_PATH", "/webhook/batch")
+	t.Setenv("WEBHOOK_BATCH_MAX_ITEMS", "250")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	merged := MergeConfigs(DefaultConfig(), cfg)
+	if merged.Webhook.BatchPath != "/webhook/batch" || merged.Webhook.BatchMaxItems != 250 {
+		t.Errorf("batch path, max items = %q, %d, want /webhook/batch, 250", merged.Webhook.BatchPath, merged.Webhook.BatchMaxItems)
+	}
+	merged.GCP.ProjectID = "project"
+	merged.GCP.TopicID = "topic"
+	merged.Webhook.Token = "token"
+	if err := merged.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+
+	for _, batchPath := range []string{"webhook/batch", "/webhook", "/metrics"} {
+		merged.Webhook.BatchPath = batchPath
+		if err := merged.Validate(); err == nil {
+			t.Errorf("Validate() with BatchPath %q error = nil, want error", batchPath)
+		}
+	}
+	merged.Webhook.BatchPath = "/webhook/batch"
+	merged.Webhook.Paths = []WebhookPathConfig{{Path: "/webhook/batch"}}
+	if err := merged.Validate(); err == nil {
+		t.Error("Validate() with a path duplicating BatchPath error = nil, want error")
+	}
+}
+
+func TestCircuitBreakerStateConfig(t *testing.T) {
+	t.Setenv("CIRCUIT_BREAKER_STATE", "redis://:hunter2@redis:6379/0")
+	t.Setenv("CIRCUIT_BREAKER_STATE_TTL", "600")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	merged := MergeConfigs(DefaultConfig(), cfg)
+	if merged.GCP.CircuitBreakerState != "redis://:hunter2@redis:6379/0" || merged.GCP.CircuitBreakerStateTTL != 10*time.Minute {
+		t.Errorf("circuit breaker state = %q with TTL %v, want the Redis URL with 10m", merged.GCP.CircuitBreakerState, merged.GCP.CircuitBreakerStateTTL)
+	}
+	if strings.Contains(merged.String(), "hunter2") {
+		t.Error("String() includes the circuit breaker state Redis password")
+	}
+
+	merged.GCP.ProjectID = "project"
+	merged.GCP.TopicID = "topic"
+	merged.Webhook.Token = "token"
+	merged.GCP.CircuitBreakerStateTTL = -time.Second
+	if err := merged.Validate(); err == nil {
+		t.Error("Validate() with a negative CircuitBreakerStateTTL error = nil, want error")
+	}
+}
+
+func TestSubscriptionLagConfig(t *testing.T) {
+	t.Setenv("SUBSCRIPTION_LAG_SUBSCRIPTIONS", "builds-consumer, metrics-consumer")
+	t.Setenv("SUBSCRIPTION_LAG_INTERVAL", "30")
+	t.Setenv("SUBSCRIPTION_LAG_MAX_AGE", "600")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	merged := MergeConfigs(DefaultConfig(), cfg)
+	want := SubscriptionLagConfig{
+		Subscriptions: []string{"builds-consumer", "metrics-consumer"},
+		Interval:      30 * time.Second,
+		MaxAge:        10 * time.Minute,
+	}
+	if !reflect.DeepEqual(merged.SubscriptionLag, want) {
+		t.Errorf("SubscriptionLag = %+v, want %+v", merged.SubscriptionLag, want)
+	}
+}
+
+func TestConfirmationConfig(t *testing.T) {
+	t.Setenv("CONFIRMATION_PIPELINES", "deploy-*, release")
+	t.Setenv("CONFIRMATION_TOPIC_ID", "buildkite-confirmations")
+	t.Setenv("CONFIRMATION_TIMEOUT", "5")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	merged := MergeConfigs(DefaultConfig(), cfg)
+	want := ConfirmationConfig{
+		Pipelines: []string{"deploy-*", "release"},
+		TopicID:   "buildkite-confirmations",
+		Timeout:   5 * time.Second,
+	}
+	if !reflect.DeepEqual(merged.Confirmation, want) {
+		t.Errorf("Confirmation = %+v, want %+v", merged.Confirmation, want)
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(*ConfirmationConfig)
+		wantErr bool
+	}{
+		{name: "valid", modify: func(*ConfirmationConfig) {}},
+		{name: "disabled", modify: func(c *ConfirmationConfig) { *c = ConfirmationConfig{} }},
+		{name: "no topic", modify: func(c *ConfirmationConfig) { c.TopicID = "" }, wantErr: true},
+		{name: "no pipelines", modify: func(c *ConfirmationConfig) { c.Pipelines = nil }, wantErr: true},
+		{name: "invalid pattern", modify: func(c *ConfirmationConfig) { c.Pipelines = []string{"deploy-["} }, wantErr: true},
+		{name: "events topic", modify: func(c *ConfirmationConfig) { c.TopicID = "topic" }, wantErr: true},
+		{name: "timeout too long", modify: func(c *ConfirmationConfig) { c.Timeout = time.Minute }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := *merged
+			c.GCP.ProjectID = "project"
+			c.GCP.TopicID = "topic"
+			c.Webhook.Token = "token"
+			tt.modify(&c.Confirmation)
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDLQResilienceConfig(t *testing.T) {
+	if got := DefaultConfig().GCP.DLQRetryMaxAttempts; got != 3 {
+		t.Errorf("default DLQRetryMaxAttempts = %d, want 3", got)
+	}
+	t.Setenv("DLQ_RETRY_MAX_ATTEMPTS", "5")
+	t.Setenv("DLQ_FALLBACK_DIR", "/var/lib/buildkite-pubsub/dlq")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	merged := MergeConfigs(DefaultConfig(), cfg)
+	if merged.GCP.DLQRetryMaxAttempts != 5 || merged.GCP.DLQFallbackDir != "/var/lib/buildkite-pubsub/dlq" {
+		t.Errorf("DLQ retry attempts = %d, fallback = %q", merged.GCP.DLQRetryMaxAttempts, merged.GCP.DLQFallbackDir)
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(*GCPConfig)
+		wantErr bool
+	}{
+		{name: "valid", modify: func(*GCPConfig) {}},
+		{name: "negative attempts", modify: func(c *GCPConfig) { c.DLQRetryMaxAttempts = -1 }, wantErr: true},
+		{name: "fallback without DLQ", modify: func(c *GCPConfig) { c.EnableDLQ = false }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := *merged
+			c.GCP.ProjectID = "project"
+			c.GCP.TopicID = "topic"
+			c.GCP.EnableDLQ = true
+			c.GCP.DLQTopicID = "dlq"
+			c.Webhook.Token = "token"
+			tt.modify(&c.GCP)
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAdminOIDCConfig(t *testing.T) {
+	t.Setenv("ADMIN_OIDC_ISSUER", "https://accounts.google.com")
+	t.Setenv("ADMIN_OIDC_AUDIENCE", "buildkite-pubsub-admin")
+	t.Setenv("ADMIN_OIDC_SUBJECTS", "ops@example.iam.gserviceaccount.com, 1234567890")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	merged := MergeConfigs(DefaultConfig(), cfg)
+	if merged.Admin.OIDCIssuer != "https://accounts.google.com" || merged.Admin.OIDCAudience != "buildkite-pubsub-admin" ||
+		!reflect.DeepEqual(merged.Admin.OIDCSubjects, []string{"ops@example.iam.gserviceaccount.com", "1234567890"}) {
+		t.Errorf("Admin OIDC = %q %q %v", merged.Admin.OIDCIssuer, merged.Admin.OIDCAudience, merged.Admin.OIDCSubjects)
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(*AdminConfig)
+		wantErr bool
+	}{
+		{name: "valid", modify: func(*AdminConfig) {}},
+		{name: "plain HTTP issuer", modify: func(a *AdminConfig) { a.OIDCIssuer = "http://issuer.example.com" }, wantErr: true},
+		{name: "no audience", modify: func(a *AdminConfig) { a.OIDCAudience = "" }, wantErr: true},
+		{name: "no subjects", modify: func(a *AdminConfig) { a.OIDCSubjects = nil }, wantErr: true},
+		{name: "subjects without issuer", modify: func(a *AdminConfig) { a.OIDCIssuer = "" }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := *merged
+			c.GCP.ProjectID = "project"
+			c.GCP.TopicID = "topic"
+			c.Webhook.Token = "token"
+			tt.modify(&c.Admin)
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Deprecation sources
+const (
+	DeprecatedEnv  = "env"
+	DeprecatedFile = "file"
+)
+
+// Deprecation describes an environment variable or config file key that
+// still works but has been replaced
+type Deprecation struct {
+	// Source is DeprecatedEnv or DeprecatedFile
+	Source string `json:"source"`
+	// Key is the environment variable, or the dotted path of the file key
+	// such as "webhook.path"
+	Key string `json:"key"`
+	// Replacement is the variable or key to use instead
+	Replacement string `json:"replacement"`
+	// RemovedIn is the release that stops accepting Key
+	RemovedIn string `json:"removed_in"`
+}
+
+// Deprecations lists every deprecated environment variable and config file
+// key. The loaders read a deprecated variable or key when its replacement
+// is unset.
+var Deprecations = []Deprecation{
+	{Source: DeprecatedEnv, Key: "HMAC_TIMESTAMP_TOLERANCE", Replacement: "SIGNATURE_TOLERANCE", RemovedIn: "2.0"},
+	{Source: DeprecatedEnv, Key: "HMAC_FUTURE_TOLERANCE", Replacement: "SIGNATURE_FUTURE_TOLERANCE", RemovedIn: "2.0"},
+	{Source: DeprecatedFile, Key: "gcp.credentials_file", Replacement: "gcp.credentials.file", RemovedIn: "2.0"},
+}
+
+// getenv returns the environment variable name, or the value of the
+// deprecated variable it replaces when name is unset
+func getenv(name string) string {
+	if val := os.Getenv(name); val != "" {
+		return val
+	}
+	for _, d := range Deprecations {
+		if d.Source == DeprecatedEnv && d.Replacement == name {
+			if val := os.Getenv(d.Key); val != "" {
+				return val
+			}
+		}
+	}
+	return ""
+}
+
+// deprecatedEnv returns the deprecations of the environment variables set
+func deprecatedEnv() []Deprecation {
+	var used []Deprecation
+	for _, d := range Deprecations {
+		if d.Source == DeprecatedEnv && os.Getenv(d.Key) != "" {
+			used = append(used, d)
+		}
+	}
+	return used
+}
+
+// deprecatedKeys returns the deprecations of the keys in a config file.
+// Files that fail to parse are left for the parser to report.
+func deprecatedKeys(data []byte) []Deprecation {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil
+	}
+	var used []Deprecation
+	for _, d := range Deprecations {
+		if d.Source == DeprecatedFile && hasKeyPath(doc, d.Key) {
+			used = append(used, d)
+		}
+	}
+	return used
+}
+
+// hasKeyPath reports whether the dotted key path is set in a parsed file
+func hasKeyPath(doc interface{}, keyPath string) bool {
+	for _, key := range strings.Split(keyPath, ".") {
+		m, ok := doc.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		if doc, ok = m[key]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// warnedDeprecations holds the keys already warned about, so a service
+// that loads its configuration again warns only once
+var warnedDeprecations sync.Map
+
+// WarnDeprecations logs a warning for each deprecation in use that hasn't
+// been warned about already
+func WarnDeprecations(logger *slog.Logger, deprecations []Deprecation) {
+	for _, d := range deprecations {
+		if _, warned := warnedDeprecations.LoadOrStore(d.Source+":"+d.Key, true); warned {
+			continue
+		}
+		logger.Warn("Deprecated configuration in use",
+			"source", d.Source, "key", d.Key, "replacement", d.Replacement, "removed_in", d.RemovedIn)
+	}
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeprecatedEnv(t *testing.T) {
+	t.Setenv("SIGNATURE_TOLERANCE", "")
+	t.Setenv("HMAC_TIMESTAMP_TOLERANCE", "600")
+	cfg, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	if cfg.Webhook.SignatureTolerance != 10*time.Minute {
+		t.Errorf("SignatureTolerance = %v, want the deprecated variable's 10m", cfg.Webhook.SignatureTolerance)
+	}
+	if len(cfg.Deprecated) != 1 || cfg.Deprecated[0].Key != "HMAC_TIMESTAMP_TOLERANCE" || cfg.Deprecated[0].Replacement != "SIGNATURE_TOLERANCE" {
+		t.Errorf("Deprecated = %+v, want HMAC_TIMESTAMP_TOLERANCE", cfg.Deprecated)
+	}
+
+	// The replacement wins when both are set
+	t.Setenv("SIGNATURE_TOLERANCE", "120")
+	cfg, err = LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv() error = %v", err)
+	}
+	if cfg.Webhook.SignatureTolerance != 2*time.Minute {
+		t.Errorf("SignatureTolerance = %v, want the replacement's 2m", cfg.Webhook.SignatureTolerance)
+	}
+}
+
+func TestDeprecatedFileKeys(t *testing.T) {
+	t.Setenv("PROJECT_ID", "project")
+	t.Setenv("TOPIC_ID", "topic")
+	t.Setenv("BUILDKITE_WEBHOOK_TOKEN", "token")
+	t.Setenv("HMAC_FUTURE_TOLERANCE", "30")
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("gcp:\n  credentials_file: /secrets/key.json\n"), 0o644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	cfg, err := Load(path, nil)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	var keys []string
+	for _, d := range cfg.Deprecated {
+		keys = append(keys, d.Source+":"+d.Key)
+	}
+	if got := strings.Join(keys, ","); got != "file:gcp.credentials_file,env:HMAC_FUTURE_TOLERANCE" {
+		t.Errorf("Deprecated = %s, want the file key then the environment variable", got)
+	}
+	if cfg.GCP.Credentials.File != "/secrets/key.json" {
+		t.Errorf("Credentials.File = %q, want the deprecated key's value", cfg.GCP.Credentials.File)
+	}
+}
+
+func TestWarnDeprecations(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	d := Deprecation{Source: DeprecatedEnv, Key: "WARN_TEST_OLD", Replacement: "WARN_TEST_NEW", RemovedIn: "2.0"}
+	WarnDeprecations(logger, []Deprecation{d})
+	WarnDeprecations(logger, []Deprecation{d})
+
+	if n := strings.Count(buf.String(), "\n"); n != 1 {
+		t.Fatalf("logged %d warnings, want 1:\n%s", n, buf.String())
+	}
+	for _, want := range []string{`"level":"WARN"`, `"key":"WARN_TEST_OLD"`, `"replacement":"WARN_TEST_NEW"`, `"removed_in":"2.0"`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("warning %s is missing %s", buf.String(), want)
+		}
+	}
+}
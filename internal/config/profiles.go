@@ -0,0 +1,61 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mcncl/buildkite-pubsub/internal/errors"
+)
+
+// Configuration profiles, which adjust the defaults for an environment
+const (
+	ProfileDevelopment = "development"
+	ProfileStaging     = "staging"
+	ProfileProduction  = "production"
+)
+
+// profiles adjust DefaultConfig for each profile. Staging and production
+// leave the log format unset so Cloud Run's is still chosen automatically.
+var profiles = map[string]func(*Config){
+	ProfileDevelopment: func(c *Config) {
+		c.Server.LogLevel = "debug"
+		c.Server.LogFormat = "dev"
+		c.Security.RateLimit = 600
+		c.Rejections.SampleRate = 1
+		c.Tracing.SampleRatio = 1
+		c.Tracing.OTLPInsecure = boolPtr(true)
+	},
+	ProfileStaging: func(c *Config) {
+		c.Security.RateLimit = 300
+		c.Rejections.SampleRate = 0.25
+		c.Tracing.SampleRatio = 0.5
+		c.Tracing.OTLPInsecure = boolPtr(false)
+	},
+	ProfileProduction: func(c *Config) {
+		c.Security.RateLimit = 1200
+		c.Security.RateLimitBurst = 200
+		c.Rejections.SampleRate = 0.01
+		c.Tracing.SampleRatio = 0.1
+		c.Tracing.OTLPInsecure = boolPtr(false)
+	},
+}
+
+// ProfileDefaults returns DefaultConfig adjusted by the named profile; an
+// empty name returns DefaultConfig unchanged
+func ProfileDefaults(name string) (*Config, error) {
+	cfg := DefaultConfig()
+	if name == "" {
+		return cfg, nil
+	}
+	adjust, ok := profiles[strings.ToLower(name)]
+	if !ok {
+		return nil, errors.NewValidationError(fmt.Sprintf("unknown config profile %q; use %s, %s or %s",
+			name, ProfileDevelopment, ProfileStaging, ProfileProduction))
+	}
+	adjust(cfg)
+	return cfg, nil
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
@@ -0,0 +1,149 @@
+// Package confirmation closes the loop with the primary consumer for
+// critical pipelines. The webhook asks the consumer to confirm each of
+// their messages on a feedback topic, and waits a bounded time for the
+// confirmation before answering Buildkite, so a consumer that stops
+// processing them is noticed within seconds rather than hours later.
+package confirmation
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is how long Wait waits when Config.Timeout is zero
+const DefaultTimeout = 10 * time.Second
+
+// retainEarly is how long a confirmation that arrives before Wait is
+// called is kept, in case the consumer beats the webhook's own bookkeeping
+const retainEarly = time.Minute
+
+// retryDelay is the pause before receiving again after Receive fails
+const retryDelay = 5 * time.Second
+
+// Source receives the confirmations the consumer publishes
+type Source interface {
+	// Receive calls confirm with the ID of each message confirmed, until
+	// ctx is done or receiving fails
+	Receive(ctx context.Context, confirm func(messageID string)) error
+}
+
+// Config holds the settings for a Tracker
+type Config struct {
+	Source Source
+	// Timeout bounds Wait; zero uses DefaultTimeout
+	Timeout time.Duration
+	Logger  *slog.Logger
+}
+
+// Tracker matches confirmations to the messages waiting for them. It is
+// safe for concurrent use.
+type Tracker struct {
+	source  Source
+	timeout time.Duration
+	logger  *slog.Logger
+	now     func() time.Time
+
+	mu      sync.Mutex
+	waiting map[string]chan struct{}
+	// early are confirmations received before their Wait, by when they
+	// arrived
+	early map[string]time.Time
+}
+
+// New creates a Tracker; call Run to start receiving confirmations
+func New(cfg Config) *Tracker {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Tracker{
+		source:  cfg.Source,
+		timeout: timeout,
+		logger:  logger,
+		now:     time.Now,
+		waiting: make(map[string]chan struct{}),
+		early:   make(map[string]time.Time),
+	}
+}
+
+// Run receives confirmations until ctx is done, receiving again after a
+// failure
+func (t *Tracker) Run(ctx context.Context) {
+	for {
+		err := t.source.Receive(ctx, t.Confirm)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			t.logger.Warn("Failed to receive delivery confirmations", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+// Confirm records that the consumer processed the message, releasing its
+// Wait
+func (t *Tracker) Confirm(messageID string) {
+	if messageID == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if done, ok := t.waiting[messageID]; ok {
+		close(done)
+		delete(t.waiting, messageID)
+		return
+	}
+	now := t.now()
+	for id, at := range t.early {
+		if now.Sub(at) > retainEarly {
+			delete(t.early, id)
+		}
+	}
+	t.early[messageID] = now
+}
+
+// Wait blocks until the message is confirmed, returning how long that
+// took, or until the timeout passes or ctx is done, returning false
+func (t *Tracker) Wait(ctx context.Context, messageID string) (time.Duration, bool) {
+	start := t.now()
+	t.mu.Lock()
+	if _, ok := t.early[messageID]; ok {
+		delete(t.early, messageID)
+		t.mu.Unlock()
+		return 0, true
+	}
+	done := make(chan struct{})
+	t.waiting[messageID] = done
+	t.mu.Unlock()
+
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return t.now().Sub(start), true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// The confirmation may have arrived as the wait ended
+	select {
+	case <-done:
+		return t.now().Sub(start), true
+	default:
+	}
+	delete(t.waiting, messageID)
+	return t.now().Sub(start), false
+}
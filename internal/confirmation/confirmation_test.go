@@ -0,0 +1,156 @@
+package confirmation
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub/pstest"
+	"cloud.google.com/go/pubsub/v2"
+	"cloud.google.com/go/pubsub/v2/apiv1/pubsubpb"
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestTrackerWait(t *testing.T) {
+	tracker := New(Config{Timeout: 50 * time.Millisecond})
+
+	// Confirmed while waiting
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		tracker.Confirm("msg-1")
+	}()
+	if _, ok := tracker.Wait(context.Background(), "msg-1"); !ok {
+		t.Error("Wait() = false, want the confirmation received while waiting")
+	}
+
+	// Confirmed before the wait started
+	tracker.Confirm("msg-2")
+	if elapsed, ok := tracker.Wait(context.Background(), "msg-2"); !ok || elapsed != 0 {
+		t.Errorf("Wait() = %s, %v, want the early confirmation", elapsed, ok)
+	}
+
+	// Never confirmed
+	start := time.Now()
+	if _, ok := tracker.Wait(context.Background(), "msg-3"); ok {
+		t.Error("Wait() = true for an unconfirmed message")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Wait() returned after %s, want the timeout", elapsed)
+	}
+	if len(tracker.waiting) != 0 {
+		t.Errorf("%d waits left behind", len(tracker.waiting))
+	}
+
+	// The request ends first
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, ok := tracker.Wait(ctx, "msg-4"); ok {
+		t.Error("Wait() = true with a canceled context")
+	}
+}
+
+func TestTrackerForgetsEarlyConfirmations(t *testing.T) {
+	tracker := New(Config{})
+	now := time.Now()
+	tracker.now = func() time.Time { return now }
+
+	tracker.Confirm("msg-1")
+	now = now.Add(2 * retainEarly)
+	tracker.Confirm("msg-2")
+	if _, ok := tracker.early["msg-1"]; ok {
+		t.Error("early confirmation kept past retainEarly")
+	}
+	if _, ok := tracker.early["msg-2"]; !ok {
+		t.Error("recent early confirmation dropped")
+	}
+}
+
+type failingSource struct {
+	calls atomic.Int32
+}
+
+func (s *failingSource) Receive(ctx context.Context, confirm func(string)) error {
+	if s.calls.Add(1) == 1 {
+		return errors.New("subscription not found")
+	}
+	confirm("msg-1")
+	<-ctx.Done()
+	return nil
+}
+
+func TestTrackerRunStopsWithContext(t *testing.T) {
+	source := &failingSource{}
+	tracker := New(Config{Source: source})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		tracker.Run(ctx)
+		close(done)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run() did not return after the context was canceled")
+	}
+}
+
+func TestPubSubSource(t *testing.T) {
+	ctx := context.Background()
+	srv := pstest.NewServer()
+	defer func() { _ = srv.Close() }()
+	conn, err := grpc.NewClient(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("grpc.NewClient: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	opts := []option.ClientOption{option.WithGRPCConn(conn), option.WithoutAuthentication()}
+
+	client, err := pubsub.NewClient(ctx, "project", opts...)
+	if err != nil {
+		t.Fatalf("pubsub.NewClient: %v", err)
+	}
+	if _, err := client.TopicAdminClient.CreateTopic(ctx, &pubsubpb.Topic{Name: "projects/project/topics/feedback"}); err != nil {
+		t.Fatalf("CreateTopic: %v", err)
+	}
+
+	source, err := NewPubSubSource(ctx, "project", "feedback", "replica-1", opts...)
+	if err != nil {
+		t.Fatalf("NewPubSubSource() error = %v", err)
+	}
+
+	// A confirmation addressed to another replica is filtered out
+	for _, to := range []string{"replica-2", "replica-1"} {
+		attributes, _ := subscriber.ConfirmationAttributes(map[string]string{subscriber.ConfirmAttribute: to}, "msg-"+to)
+		if _, err := client.Publisher("feedback").Publish(ctx, &pubsub.Message{Data: []byte("{}"), Attributes: attributes}).Get(ctx); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+	}
+
+	receiveCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	var confirmed []string
+	_ = source.Receive(receiveCtx, func(messageID string) {
+		confirmed = append(confirmed, messageID)
+		cancel()
+	})
+	if len(confirmed) != 1 || confirmed[0] != "msg-replica-1" {
+		t.Errorf("confirmed = %v, want [msg-replica-1]", confirmed)
+	}
+
+	if err := source.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if _, err := client.SubscriptionAdminClient.GetSubscription(ctx, &pubsubpb.GetSubscriptionRequest{
+		Subscription: "projects/project/subscriptions/feedback-confirm-replica-1",
+	}); err == nil {
+		t.Error("subscription still exists after Close")
+	}
+	_ = client.Close()
+}
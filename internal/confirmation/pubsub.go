@@ -0,0 +1,69 @@
+package confirmation
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/pubsub/v2"
+	"cloud.google.com/go/pubsub/v2/apiv1/pubsubpb"
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"google.golang.org/api/option"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// PubSubSource receives confirmations from the feedback topic on a
+// subscription of its own, filtered to the confirmations addressed to it,
+// so each webhook replica hears only about the messages it published. The
+// credentials need roles/pubsub.editor on the project to create and delete
+// the subscription.
+type PubSubSource struct {
+	client       *pubsub.Client
+	subscription string
+}
+
+// NewPubSubSource subscribes to topicID in projectID for the confirmations
+// of messages published with a ConfirmAttribute of id
+func NewPubSubSource(ctx context.Context, projectID, topicID, id string, opts ...option.ClientOption) (*PubSubSource, error) {
+	client, err := pubsub.NewClient(ctx, projectID, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Pub/Sub client: %w", err)
+	}
+	subscription := fmt.Sprintf("projects/%s/subscriptions/%s-confirm-%s", projectID, topicID, id)
+	_, err = client.SubscriptionAdminClient.CreateSubscription(ctx, &pubsubpb.Subscription{
+		Name:   subscription,
+		Topic:  fmt.Sprintf("projects/%s/topics/%s", projectID, topicID),
+		Filter: fmt.Sprintf("attributes.%s = %q", subscriber.ConfirmAttribute, id),
+		// Confirmations are only useful while someone is waiting for them
+		MessageRetentionDuration: durationpb.New(10 * time.Minute),
+		// Pub/Sub removes the subscription if the replica dies before
+		// deleting it
+		ExpirationPolicy: &pubsubpb.ExpirationPolicy{Ttl: durationpb.New(24 * time.Hour)},
+	})
+	if err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("failed to create subscription %s: %w", subscription, err)
+	}
+	return &PubSubSource{client: client, subscription: subscription}, nil
+}
+
+// Receive implements Source, acknowledging every confirmation
+func (s *PubSubSource) Receive(ctx context.Context, confirm func(messageID string)) error {
+	return s.client.Subscriber(s.subscription).Receive(ctx, func(_ context.Context, m *pubsub.Message) {
+		m.Ack()
+		confirm(m.Attributes[subscriber.ConfirmsMessageIDAttribute])
+	})
+}
+
+// Close deletes the subscription and closes the client
+func (s *PubSubSource) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := s.client.SubscriptionAdminClient.DeleteSubscription(ctx, &pubsubpb.DeleteSubscriptionRequest{
+		Subscription: s.subscription,
+	})
+	if closeErr := s.client.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
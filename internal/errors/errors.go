@@ -3,6 +3,7 @@ package errors
 import (
 	"errors"
 	"fmt"
+	"time"
 )
 
 // Sentinel errors
@@ -83,6 +84,68 @@ func IsRetryable(err error) bool {
 	return errors.Is(err, ErrConnection) || errors.Is(err, ErrPublish) || errors.Is(err, ErrRateLimit)
 }
 
+// Is reports whether any error in err's chain matches target
+func Is(err, target error) bool {
+	return errors.Is(err, target)
+}
+
+// As finds the first error in err's chain that matches target
+func As(err error, target any) bool {
+	return errors.As(err, target)
+}
+
+// retryAfterError carries a suggested delay before retrying
+type retryAfterError struct {
+	err   error
+	delay time.Duration
+}
+
+func (e *retryAfterError) Error() string { return e.err.Error() }
+func (e *retryAfterError) Unwrap() error { return e.err }
+
+// WithRetryAfter attaches a suggested retry delay to err
+func WithRetryAfter(err error, delay time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	return &retryAfterError{err: err, delay: delay}
+}
+
+// RetryAfter returns the retry delay attached with WithRetryAfter
+func RetryAfter(err error) (time.Duration, bool) {
+	var e *retryAfterError
+	if errors.As(err, &e) {
+		return e.delay, true
+	}
+	return 0, false
+}
+
+// hintError carries a remediation hint for the operator
+type hintError struct {
+	err  error
+	hint string
+}
+
+func (e *hintError) Error() string { return e.err.Error() }
+func (e *hintError) Unwrap() error { return e.err }
+
+// WithHint attaches a hint telling the operator how to fix err
+func WithHint(err error, hint string) error {
+	if err == nil {
+		return nil
+	}
+	return &hintError{err: err, hint: hint}
+}
+
+// Hint returns the hint attached with WithHint, or "" when there is none
+func Hint(err error) string {
+	var e *hintError
+	if errors.As(err, &e) {
+		return e.hint
+	}
+	return ""
+}
+
 // Wrap wraps an error with additional context
 func Wrap(err error, msg string) error {
 	if err == nil {
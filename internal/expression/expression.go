@@ -0,0 +1,157 @@
+// Package expression compiles CEL expressions over the transformed payload,
+// such as build.state == 'failed' && build.branch == 'main', for filters,
+// routes and derived attributes. Expressions are compiled when the service
+// starts, so a typo fails startup rather than every webhook.
+package expression
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+	"github.com/mcncl/buildkite-pubsub/internal/jsoncodec"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/pkg/transform"
+)
+
+// Evaluation results, used as metric labels
+const (
+	ResultMatched   = "matched"
+	ResultUnmatched = "unmatched"
+	ResultValue     = "value"
+	ResultError     = "error"
+)
+
+// objects are the payload's top-level JSON objects; they are empty rather
+// than missing when the payload omits them, so has(agent.queue_name) works
+// for build events too
+var objects = []string{"build", "pipeline", "sender", "agent", "raw_payload"}
+
+// env declares the payload variables shared by every expression
+var env = sync.OnceValues(func() (*cel.Env, error) {
+	opts := []cel.EnvOption{
+		cel.Variable("event_type", cel.StringType),
+		ext.Strings(),
+	}
+	for _, name := range objects {
+		opts = append(opts, cel.Variable(name, cel.MapType(cel.StringType, cel.DynType)))
+	}
+	return cel.NewEnv(opts...)
+})
+
+// Program is a compiled expression
+type Program struct {
+	rule    string
+	source  string
+	program cel.Program
+}
+
+// CompileCondition compiles source, which must evaluate to a bool. rule
+// labels the evaluation metrics.
+func CompileCondition(rule, source string) (*Program, error) {
+	return compile(rule, source, cel.BoolType)
+}
+
+// CompileValue compiles source, which must evaluate to a string. rule
+// labels the evaluation metrics.
+func CompileValue(rule, source string) (*Program, error) {
+	return compile(rule, source, cel.StringType)
+}
+
+func compile(rule, source string, want *cel.Type) (*Program, error) {
+	e, err := env()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create expression environment: %w", err)
+	}
+	ast, issues := e.Compile(source)
+	if issues.Err() != nil {
+		return nil, fmt.Errorf("invalid expression %q: %w", source, issues.Err())
+	}
+	// Fields of the payload objects are dynamic, so only a mismatch known at
+	// compile time is rejected here
+	if out := ast.OutputType(); !out.IsExactType(want) && !out.IsExactType(cel.DynType) {
+		return nil, fmt.Errorf("expression %q returns %s, want %s", source, out, want)
+	}
+	program, err := e.Program(ast, cel.EvalOptions(cel.OptOptimize))
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %w", source, err)
+	}
+	return &Program{rule: rule, source: source, program: program}, nil
+}
+
+// String returns the expression's source
+func (p *Program) String() string {
+	return p.source
+}
+
+// Matches reports whether payload satisfies the condition. Evaluation
+// errors, such as reading a field the payload lacks, count as no match.
+func (p *Program) Matches(payload transform.TransformedPayload) bool {
+	out, err := p.eval(payload)
+	matched, ok := out.(bool)
+	switch {
+	case err != nil || !ok:
+		p.record(ResultError)
+		return false
+	case matched:
+		p.record(ResultMatched)
+	default:
+		p.record(ResultUnmatched)
+	}
+	return matched
+}
+
+// Value returns the string the expression computes for payload; ok is
+// false when evaluation fails
+func (p *Program) Value(payload transform.TransformedPayload) (value string, ok bool) {
+	out, err := p.eval(payload)
+	value, ok = out.(string)
+	if err != nil || !ok {
+		p.record(ResultError)
+		return "", false
+	}
+	p.record(ResultValue)
+	return value, true
+}
+
+func (p *Program) eval(payload transform.TransformedPayload) (interface{}, error) {
+	start := time.Now()
+	defer func() {
+		metrics.ExpressionEvaluationDuration.WithLabelValues(p.rule).Observe(time.Since(start).Seconds())
+	}()
+
+	vars, err := variables(payload)
+	if err != nil {
+		return nil, err
+	}
+	out, _, err := p.program.Eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	return out.Value(), nil
+}
+
+func (p *Program) record(result string) {
+	metrics.ExpressionEvaluationsTotal.WithLabelValues(p.rule, result).Inc()
+}
+
+// variables returns payload as expression variables, named after the JSON
+// fields consumers see in published messages
+func variables(payload transform.TransformedPayload) (map[string]interface{}, error) {
+	data, err := jsoncodec.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	var vars map[string]interface{}
+	if err := jsoncodec.Unmarshal(data, &vars); err != nil {
+		return nil, err
+	}
+	for _, name := range objects {
+		if _, ok := vars[name].(map[string]interface{}); !ok {
+			vars[name] = map[string]interface{}{}
+		}
+	}
+	return vars, nil
+}
@@ -0,0 +1,106 @@
+package expression
+
+import (
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/pkg/transform"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func testPayload() transform.TransformedPayload {
+	var payload transform.TransformedPayload
+	payload.EventType = "build.finished"
+	payload.Build.State = "failed"
+	payload.Build.Branch = "main"
+	payload.Build.Number = 42
+	payload.Build.Pipeline = "payments-api"
+	return payload
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		name      string
+		source    string
+		condition bool
+		wantErr   bool
+	}{
+		{name: "condition", source: "build.state == 'failed' && build.branch == 'main'", condition: true},
+		{name: "dynamic condition", source: "build.state", condition: true},
+		{name: "value", source: "build.pipeline.split('-')[0]"},
+		{name: "syntax error", source: "build.state ==", condition: true, wantErr: true},
+		{name: "unknown variable", source: "job.state == 'failed'", condition: true, wantErr: true},
+		{name: "condition returns string", source: "'failed'", condition: true, wantErr: true},
+		{name: "value returns bool", source: "event_type == 'build.finished'", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compile := CompileValue
+			if tt.condition {
+				compile = CompileCondition
+			}
+			if _, err := compile("test", tt.source); (err != nil) != tt.wantErr {
+				t.Errorf("compile(%q) error = %v, wantErr %v", tt.source, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMatches(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	tests := []struct {
+		source     string
+		want       bool
+		wantResult string
+	}{
+		{source: "build.state == 'failed' && build.branch == 'main'", want: true, wantResult: ResultMatched},
+		{source: "event_type.startsWith('agent.')", want: false, wantResult: ResultUnmatched},
+		{source: "build.number > 40", want: true, wantResult: ResultMatched},
+		{source: "has(agent.queue_name)", want: false, wantResult: ResultUnmatched},
+		{source: "build.missing == 'x'", want: false, wantResult: ResultError},
+		{source: "build.state", want: false, wantResult: ResultError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			program, err := CompileCondition(tt.source, tt.source)
+			if err != nil {
+				t.Fatalf("CompileCondition() error = %v", err)
+			}
+			if got := program.Matches(testPayload()); got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+			if got := testutil.ToFloat64(metrics.ExpressionEvaluationsTotal.WithLabelValues(tt.source, tt.wantResult)); got != 1 {
+				t.Errorf("%s evaluations = %v, want 1", tt.wantResult, got)
+			}
+		})
+	}
+}
+
+func TestValue(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	program, err := CompileValue("team", "build.pipeline.split('-')[0]")
+	if err != nil {
+		t.Fatalf("CompileValue() error = %v", err)
+	}
+	if got, ok := program.Value(testPayload()); !ok || got != "payments" {
+		t.Errorf("Value() = %q, %v, want payments, true", got, ok)
+	}
+
+	program, err = CompileValue("number", "build.number")
+	if err != nil {
+		t.Fatalf("CompileValue() error = %v", err)
+	}
+	if got, ok := program.Value(testPayload()); ok {
+		t.Errorf("Value() of a number = %q, want failure", got)
+	}
+	if got := testutil.ToFloat64(metrics.ExpressionEvaluationsTotal.WithLabelValues("number", ResultError)); got != 1 {
+		t.Errorf("error evaluations = %v, want 1", got)
+	}
+}
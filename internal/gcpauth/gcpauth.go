@@ -0,0 +1,126 @@
+// Package gcpauth builds the Google Cloud credentials the service publishes
+// with from its credential mode: Application Default Credentials, a service
+// account key, a workload identity federation configuration or service
+// account impersonation. Credentials are checked when they are built, so a
+// misconfigured mode fails startup with an error naming what to fix rather
+// than failing the first publish.
+package gcpauth
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"cloud.google.com/go/auth"
+	"cloud.google.com/go/auth/credentials"
+	"cloud.google.com/go/auth/credentials/impersonate"
+	"github.com/mcncl/buildkite-pubsub/internal/config"
+	"github.com/mcncl/buildkite-pubsub/internal/errors"
+	"google.golang.org/api/option"
+)
+
+// Scope is the OAuth scope requested for the credentials
+const Scope = "https://www.googleapis.com/auth/pubsub"
+
+// tokenTimeout bounds fetching the first token when ctx has no deadline
+const tokenTimeout = 10 * time.Second
+
+// ClientOptions returns the client options authenticating Google Cloud
+// clients as cfg describes. Application Default Credentials without a file
+// need none, leaving the client to find them as it always has.
+func ClientOptions(ctx context.Context, cfg config.CredentialsConfig) ([]option.ClientOption, error) {
+	creds, err := Credentials(ctx, cfg)
+	if err != nil || creds == nil {
+		return nil, err
+	}
+	return []option.ClientOption{option.WithAuthCredentials(creds)}, nil
+}
+
+// Credentials builds the credentials for cfg and fetches a token to check
+// that they work. It returns nil for Application Default Credentials without
+// a file, and when the Pub/Sub emulator is in use after checking the file.
+func Credentials(ctx context.Context, cfg config.CredentialsConfig) (*auth.Credentials, error) {
+	opts := &credentials.DetectOptions{Scopes: []string{Scope}}
+
+	var creds *auth.Credentials
+	var err error
+	var hint string
+	switch cfg.Mode {
+	case "", config.CredentialsADC:
+		if cfg.File == "" {
+			return nil, nil
+		}
+		opts.CredentialsFile = cfg.File
+		creds, err = credentials.DetectDefault(opts)
+		if err != nil {
+			return nil, fileError(cfg, err, "check that the file is a credentials file readable by the service")
+		}
+		hint = "check that the credentials in the file are still valid"
+	case config.CredentialsKeyFile:
+		creds, err = credentials.NewCredentialsFromFile(credentials.ServiceAccount, cfg.File, opts)
+		if err != nil {
+			return nil, fileError(cfg, err, "create a key with `gcloud iam service-accounts keys create`; use mode "+
+				config.CredentialsWorkloadIdentityFederation+" for external_account configurations")
+		}
+		hint = "check that the key has not been deleted or disabled"
+	case config.CredentialsWorkloadIdentityFederation:
+		creds, err = credentials.NewCredentialsFromFile(credentials.ExternalAccount, cfg.File, opts)
+		if err != nil {
+			return nil, fileError(cfg, err, "generate the configuration with `gcloud iam workload-identity-pools create-cred-config`")
+		}
+		hint = "check the workload identity pool provider, the attribute mapping and that the external identity " +
+			"has roles/iam.workloadIdentityUser on the service account"
+	case config.CredentialsImpersonation:
+		if cfg.File != "" {
+			opts.CredentialsFile = cfg.File
+		}
+		opts.Scopes = []string{"https://www.googleapis.com/auth/cloud-platform"}
+		base, err := credentials.DetectDefault(opts)
+		if err != nil {
+			return nil, errors.WithHint(fmt.Errorf("%w: failed to load base credentials to impersonate %s: %w",
+				errors.ErrAuth, cfg.TargetPrincipal, err),
+				"set GCP_CREDENTIALS_FILE, or run `gcloud auth application-default login` when running locally")
+		}
+		creds, err = impersonate.NewCredentials(&impersonate.CredentialsOptions{
+			TargetPrincipal: cfg.TargetPrincipal,
+			Delegates:       cfg.Delegates,
+			Scopes:          []string{Scope},
+			Credentials:     base,
+		})
+		if err != nil {
+			return nil, errors.NewValidationError(fmt.Sprintf("invalid impersonation of %s: %v", cfg.TargetPrincipal, err))
+		}
+		hint = "grant the base credentials roles/iam.serviceAccountTokenCreator on " + cfg.TargetPrincipal
+	default:
+		return nil, errors.NewValidationError(fmt.Sprintf("unknown GCP credentials mode %q", cfg.Mode))
+	}
+
+	// Clients of the emulator don't authenticate, and local development
+	// with it shouldn't need working credentials
+	if os.Getenv("PUBSUB_EMULATOR_HOST") != "" {
+		return nil, nil
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, tokenTimeout)
+		defer cancel()
+	}
+	if _, err := creds.Token(ctx); err != nil {
+		return nil, errors.WithHint(fmt.Errorf("%w: %s credentials failed to get a token: %w", errors.ErrAuth, mode(cfg), err), hint)
+	}
+	return creds, nil
+}
+
+// fileError reports a credentials file that is missing or of the wrong type
+func fileError(cfg config.CredentialsConfig, err error, hint string) error {
+	return errors.WithHint(errors.NewValidationError(fmt.Sprintf("%s credentials file %s: %v", mode(cfg), cfg.File, err)), hint)
+}
+
+// mode returns cfg's mode, naming the default
+func mode(cfg config.CredentialsConfig) string {
+	if cfg.Mode == "" {
+		return config.CredentialsADC
+	}
+	return cfg.Mode
+}
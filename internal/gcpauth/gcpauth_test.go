@@ -0,0 +1,115 @@
+package gcpauth
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/internal/config"
+	"github.com/mcncl/buildkite-pubsub/internal/errors"
+)
+
+const (
+	serviceAccountKey = `{
+  "type": "service_account",
+  "project_id": "project",
+  "private_key_id": "key",
+  "private_key": "not a key",
+  "client_email": "webhook@project.iam.gserviceaccount.com",
+  "token_uri": "https://oauth2.googleapis.com/token"
+}`
+	externalAccount = `{
+  "type": "external_account",
+  "audience": "//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/pool/providers/aws",
+  "subject_token_type": "urn:ietf:params:aws:token-type:aws4_request",
+  "token_url": "https://sts.googleapis.com/v1/token",
+  "credential_source": {
+    "environment_id": "aws1",
+    "regional_cred_verification_url": "https://sts.{region}.amazonaws.com?Action=GetCallerIdentity&Version=2011-06-15"
+  }
+}`
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+func TestCredentials(t *testing.T) {
+	t.Setenv("PUBSUB_EMULATOR_HOST", "localhost:8085")
+	key := writeFile(t, "key.json", serviceAccountKey)
+	federation := writeFile(t, "federation.json", externalAccount)
+
+	tests := []struct {
+		name    string
+		cfg     config.CredentialsConfig
+		wantErr string
+	}{
+		{name: "adc", cfg: config.CredentialsConfig{}},
+		{name: "adc with a file", cfg: config.CredentialsConfig{File: federation}},
+		{name: "key file", cfg: config.CredentialsConfig{Mode: config.CredentialsKeyFile, File: key}},
+		{name: "federation", cfg: config.CredentialsConfig{Mode: config.CredentialsWorkloadIdentityFederation, File: federation}},
+		{name: "impersonation", cfg: config.CredentialsConfig{
+			Mode:            config.CredentialsImpersonation,
+			File:            key,
+			TargetPrincipal: "publisher@project.iam.gserviceaccount.com",
+		}},
+		{
+			name:    "missing key file",
+			cfg:     config.CredentialsConfig{Mode: config.CredentialsKeyFile, File: filepath.Join(t.TempDir(), "missing.json")},
+			wantErr: "key_file credentials file",
+		},
+		{
+			name:    "federation config as key file",
+			cfg:     config.CredentialsConfig{Mode: config.CredentialsKeyFile, File: federation},
+			wantErr: `found "external_account"`,
+		},
+		{
+			name:    "key as federation config",
+			cfg:     config.CredentialsConfig{Mode: config.CredentialsWorkloadIdentityFederation, File: key},
+			wantErr: `found "service_account"`,
+		},
+		{
+			name:    "unknown mode",
+			cfg:     config.CredentialsConfig{Mode: "oidc"},
+			wantErr: "unknown GCP credentials mode",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := ClientOptions(context.Background(), tt.cfg)
+			if tt.wantErr == "" {
+				if err != nil || opts != nil {
+					t.Errorf("ClientOptions() = %v, %v, want no options with the emulator", opts, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("ClientOptions() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+			if !errors.IsValidationError(err) {
+				t.Errorf("error = %v, want a validation error", err)
+			}
+			if tt.cfg.File != "" && errors.Hint(err) == "" {
+				t.Errorf("error = %v, want a hint for the file", err)
+			}
+		})
+	}
+}
+
+func TestCredentialsToken(t *testing.T) {
+	t.Setenv("PUBSUB_EMULATOR_HOST", "")
+	key := writeFile(t, "key.json", serviceAccountKey)
+
+	// The key can't sign a token request, which fails before any request
+	_, err := Credentials(context.Background(), config.CredentialsConfig{Mode: config.CredentialsKeyFile, File: key})
+	if !errors.IsAuthError(err) || !strings.Contains(errors.Hint(err), "key") {
+		t.Errorf("Credentials() error = %v (hint %q), want an auth error with a hint", err, errors.Hint(err))
+	}
+}
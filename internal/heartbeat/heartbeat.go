@@ -0,0 +1,124 @@
+// Package heartbeat publishes synthetic heartbeat events to the topic on an
+// interval. Consumers that stop seeing them know events are not getting
+// through, whether the topic is broken or the webhook is down, rather than
+// guessing from a quiet period without builds.
+package heartbeat
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+)
+
+// Config holds the settings for a Sender
+type Config struct {
+	Publisher publisher.Publisher
+	// Interval between heartbeats
+	Interval time.Duration
+	// Instance identifies this replica; empty uses the hostname
+	Instance string
+	// Timeout bounds each publish; zero uses Interval
+	Timeout time.Duration
+	Version string
+	Logger  *slog.Logger
+}
+
+// Sender publishes heartbeats for one instance
+type Sender struct {
+	publisher publisher.Publisher
+	interval  time.Duration
+	instance  string
+	timeout   time.Duration
+	version   string
+	logger    *slog.Logger
+	started   time.Time
+	sequence  atomic.Uint64
+}
+
+// New creates a Sender; call Run to start sending
+func New(cfg Config) *Sender {
+	instance := cfg.Instance
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = cfg.Interval
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &Sender{
+		publisher: cfg.Publisher,
+		interval:  cfg.Interval,
+		instance:  instance,
+		timeout:   timeout,
+		version:   cfg.Version,
+		logger:    logger,
+		started:   time.Now().UTC(),
+	}
+}
+
+// Instance returns the identity the Sender puts in its heartbeats
+func (s *Sender) Instance() string {
+	return s.instance
+}
+
+// Send publishes the next heartbeat. Every call takes a sequence number,
+// so consumers see a gap where a heartbeat failed to publish.
+func (s *Sender) Send(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	now := time.Now().UTC()
+	beat := subscriber.Heartbeat{
+		EventType:       subscriber.HeartbeatEventType,
+		Instance:        s.instance,
+		Sequence:        s.sequence.Add(1),
+		StartedAt:       s.started,
+		SentAt:          now,
+		IntervalSeconds: s.interval.Seconds(),
+		Version:         s.version,
+	}
+	attributes := map[string]string{
+		"origin":                         "buildkite-webhook",
+		"event_type":                     subscriber.HeartbeatEventType,
+		"instance":                       beat.Instance,
+		"sequence":                       strconv.FormatUint(beat.Sequence, 10),
+		subscriber.DeliveryModeAttribute: subscriber.DeliveryModeSynthetic,
+		subscriber.PublishedAtAttribute:  now.Format(time.RFC3339Nano),
+	}
+
+	if _, err := s.publisher.Publish(ctx, beat, attributes); err != nil {
+		metrics.HeartbeatsTotal.WithLabelValues("error").Inc()
+		return err
+	}
+	metrics.HeartbeatsTotal.WithLabelValues("success").Inc()
+	metrics.HeartbeatLastPublished.Set(float64(now.Unix()))
+	return nil
+}
+
+// Run sends a heartbeat straight away and then every interval until ctx is
+// done, logging heartbeats that fail to publish
+func (s *Sender) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Send(ctx); err != nil && ctx.Err() == nil {
+			s.logger.Warn("Failed to publish heartbeat", "instance", s.instance, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
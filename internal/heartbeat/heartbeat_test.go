@@ -0,0 +1,106 @@
+package heartbeat
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSend(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	mock := publisher.NewTypedMockPublisher[subscriber.Heartbeat]()
+	s := New(Config{Publisher: mock, Interval: time.Minute, Instance: "webhook-1", Version: "v1.2.3"})
+
+	for range 2 {
+		if err := s.Send(context.Background()); err != nil {
+			t.Fatalf("Send() error = %v", err)
+		}
+	}
+	mock.SetError(errors.New("topic not found"))
+	if err := s.Send(context.Background()); err == nil {
+		t.Error("Send() with a failing publisher error = nil, want error")
+	}
+
+	published := mock.Published()
+	if len(published) != 2 {
+		t.Fatalf("published %d heartbeats, want 2", len(published))
+	}
+	beat, attributes := published[1].Value, published[1].Attributes
+	if beat.EventType != subscriber.HeartbeatEventType || beat.Instance != "webhook-1" || beat.Sequence != 2 ||
+		beat.IntervalSeconds != 60 || beat.Version != "v1.2.3" {
+		t.Errorf("heartbeat = %+v", beat)
+	}
+	if beat.StartedAt != published[0].Value.StartedAt || beat.SentAt.Before(beat.StartedAt) {
+		t.Errorf("started_at = %v, sent_at = %v, want a fixed start before each send", beat.StartedAt, beat.SentAt)
+	}
+	if !subscriber.IsHeartbeat(attributes) || attributes["instance"] != "webhook-1" || attributes["sequence"] != "2" {
+		t.Errorf("attributes = %v", attributes)
+	}
+	if _, ok := subscriber.PublishedAt(attributes); !ok {
+		t.Errorf("attributes = %v, want published_at", attributes)
+	}
+
+	// The failed heartbeat still took its sequence number, leaving a gap
+	mock.SetError(nil)
+	if err := s.Send(context.Background()); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	last, _ := mock.Last()
+	if last.Value.Sequence != 4 {
+		t.Errorf("sequence after a failure = %d, want 4", last.Value.Sequence)
+	}
+
+	if got := testutil.ToFloat64(metrics.HeartbeatsTotal.WithLabelValues("success")); got != 3 {
+		t.Errorf("successful heartbeats = %v, want 3", got)
+	}
+	if got := testutil.ToFloat64(metrics.HeartbeatsTotal.WithLabelValues("error")); got != 1 {
+		t.Errorf("failed heartbeats = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(metrics.HeartbeatLastPublished); got != float64(last.Value.SentAt.Unix()) {
+		t.Errorf("last published = %v, want the last heartbeat's send time", got)
+	}
+}
+
+func TestRun(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	mock := publisher.NewTypedMockPublisher[subscriber.Heartbeat]()
+	s := New(Config{Publisher: mock, Interval: 10 * time.Millisecond})
+	if s.Instance() == "" {
+		t.Error("Instance() = \"\", want the hostname")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(mock.Published()) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Run() published %d heartbeats, want at least 3", len(mock.Published()))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run() did not stop when ctx was cancelled")
+	}
+}
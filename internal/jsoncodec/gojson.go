@@ -0,0 +1,18 @@
+//go:build gojson && !sonic
+
+package jsoncodec
+
+import json "github.com/goccy/go-json"
+
+// Name identifies the JSON implementation compiled in
+const Name = "go-json"
+
+// Marshal returns the JSON encoding of v
+func Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal parses JSON data into v
+func Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,5 @@
+// Package jsoncodec encodes and decodes JSON on the webhook hot path. It uses
+// encoding/json by default; build with -tags gojson or -tags sonic to use
+// github.com/goccy/go-json or github.com/bytedance/sonic instead. Every
+// implementation produces the same output as encoding/json.
+package jsoncodec
@@ -0,0 +1,159 @@
+package jsoncodec_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/internal/jsoncodec"
+	"github.com/mcncl/buildkite-pubsub/pkg/transform"
+)
+
+// payloads returns the recorded Buildkite payloads used by the transform golden tests
+func payloads(tb testing.TB) map[string][]byte {
+	tb.Helper()
+	files, err := filepath.Glob(filepath.Join("..", "..", "pkg", "transform", "testdata", "*.json"))
+	if err != nil || len(files) == 0 {
+		tb.Fatalf("failed to find payloads: %v", err)
+	}
+	bodies := make(map[string][]byte)
+	for _, file := range files {
+		body, err := os.ReadFile(file)
+		if err != nil {
+			tb.Fatalf("failed to read %s: %v", file, err)
+		}
+		bodies[filepath.Base(file)] = body
+	}
+	return bodies
+}
+
+func TestMatchesEncodingJSON(t *testing.T) {
+	for name, body := range payloads(t) {
+		t.Run(name, func(t *testing.T) {
+			var got, want transform.Payload
+			if err := jsoncodec.Unmarshal(body, &got); err != nil {
+				t.Fatalf("%s Unmarshal() error = %v", jsoncodec.Name, err)
+			}
+			if err := json.Unmarshal(body, &want); err != nil {
+				t.Fatalf("encoding/json Unmarshal() error = %v", err)
+			}
+
+			transformed, err := transform.Transform(want, transform.WithMetaData())
+			if err != nil {
+				t.Fatalf("Transform() error = %v", err)
+			}
+			gotJSON, err := jsoncodec.Marshal(transformed)
+			if err != nil {
+				t.Fatalf("%s Marshal() error = %v", jsoncodec.Name, err)
+			}
+			wantJSON, err := json.Marshal(transformed)
+			if err != nil {
+				t.Fatalf("encoding/json Marshal() error = %v", err)
+			}
+			if !bytes.Equal(gotJSON, wantJSON) {
+				t.Errorf("%s output differs from encoding/json:\n got %s\nwant %s", jsoncodec.Name, gotJSON, wantJSON)
+			}
+
+			decoded, err := jsoncodec.Marshal(got)
+			if err != nil {
+				t.Fatalf("%s Marshal() error = %v", jsoncodec.Name, err)
+			}
+			if reencoded, _ := json.Marshal(want); !bytes.Equal(decoded, reencoded) {
+				t.Errorf("%s decoded a different payload than encoding/json", jsoncodec.Name)
+			}
+		})
+	}
+}
+
+type codec struct {
+	name      string
+	marshal   func(interface{}) ([]byte, error)
+	unmarshal func([]byte, interface{}) error
+}
+
+// codecs compares the compiled-in implementation with encoding/json; run
+// with -tags gojson or -tags sonic to see the difference
+var codecs = func() []codec {
+	codecs := []codec{{name: "encoding/json", marshal: json.Marshal, unmarshal: json.Unmarshal}}
+	if jsoncodec.Name != "encoding/json" {
+		codecs = append(codecs, codec{name: jsoncodec.Name, marshal: jsoncodec.Marshal, unmarshal: jsoncodec.Unmarshal})
+	}
+	return codecs
+}()
+
+func BenchmarkUnmarshalPayload(b *testing.B) {
+	body := payloads(b)["build.finished.json"]
+	for _, codec := range codecs {
+		b.Run(codec.name, func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			for b.Loop() {
+				var payload transform.Payload
+				if err := codec.unmarshal(body, &payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkUnmarshalMap(b *testing.B) {
+	body := payloads(b)["build.finished.json"]
+	for _, codec := range codecs {
+		b.Run(codec.name, func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			for b.Loop() {
+				var raw map[string]interface{}
+				if err := codec.unmarshal(body, &raw); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMarshalTransformed(b *testing.B) {
+	var payload transform.Payload
+	if err := json.Unmarshal(payloads(b)["build.finished.json"], &payload); err != nil {
+		b.Fatal(err)
+	}
+	transformed, err := transform.Transform(payload)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, codec := range codecs {
+		b.Run(codec.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := codec.marshal(transformed); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkTransform measures the hot path end to end: decode the delivery,
+// transform it and encode the message, using whichever codec is compiled in
+func BenchmarkTransform(b *testing.B) {
+	body := payloads(b)["build.finished.json"]
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	for b.Loop() {
+		var payload transform.Payload
+		if err := jsoncodec.Unmarshal(body, &payload); err != nil {
+			b.Fatal(err)
+		}
+		transformed, err := transform.Transform(payload)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := jsoncodec.Marshal(transformed); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+//go:build sonic
+
+package jsoncodec
+
+import "github.com/bytedance/sonic"
+
+// Name identifies the JSON implementation compiled in
+const Name = "sonic"
+
+// api matches encoding/json: sorted map keys, HTML escaping and UTF-8
+// validation, so published messages do not change with the build tag
+var api = sonic.ConfigStd
+
+// Marshal returns the JSON encoding of v
+func Marshal(v interface{}) ([]byte, error) {
+	return api.Marshal(v)
+}
+
+// Unmarshal parses JSON data into v
+func Unmarshal(data []byte, v interface{}) error {
+	return api.Unmarshal(data, v)
+}
@@ -0,0 +1,406 @@
+// Package jwtauth verifies JWT bearer tokens, such as OpenID Connect ID
+// tokens, signed with RS256 or ES256 by an issuer publishing its keys as a
+// JWKS. It lets internal callers authenticate as themselves instead of
+// sharing the Buildkite webhook secret.
+package jwtauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/clock"
+	"golang.org/x/sync/singleflight"
+)
+
+// DefaultLeeway is the clock skew allowed between the issuer and us unless
+// configured
+const DefaultLeeway = time.Minute
+
+// Signing keys are refetched at most this often when a token names an
+// unknown key, and at least this often otherwise
+const (
+	MinKeyRefresh = time.Minute
+	MaxKeyAge     = time.Hour
+)
+
+// keyFetchTimeout bounds a key fetch, which runs on after the request that
+// started it gives up so that other requests can share it
+const keyFetchTimeout = 10 * time.Second
+
+// ErrInvalidToken is wrapped by every verification failure
+var ErrInvalidToken = errors.New("invalid token")
+
+// Config holds the settings for a Verifier
+type Config struct {
+	// Issuer is the iss claim tokens must carry
+	Issuer string
+	// Audience is the aud claim tokens must carry
+	Audience string
+	// JWKSURL serves the issuer's signing keys; empty finds them through
+	// OpenID Connect discovery on Issuer
+	JWKSURL string
+	// Subjects optionally limits tokens to these sub or verified email
+	// claims
+	Subjects []string
+	// Leeway is the clock skew allowed when checking exp and nbf; zero
+	// uses DefaultLeeway
+	Leeway time.Duration
+	// Client fetches discovery documents and keys; nil uses a client with
+	// a 10s timeout
+	Client *http.Client
+	// Clock checks token expiry; nil uses the system clock
+	Clock clock.Clock
+}
+
+// Claims are the token claims checked
+type Claims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      Audience `json:"aud"`
+	Expiry        int64    `json:"exp"`
+	NotBefore     int64    `json:"nbf"`
+	Email         string   `json:"email"`
+	EmailVerified *bool    `json:"email_verified"`
+}
+
+// Audience is an aud claim, which is a string or a list of strings
+type Audience []string
+
+// UnmarshalJSON accepts a string or a list of strings
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("aud must be a string or list of strings")
+	}
+	*a = list
+	return nil
+}
+
+// Verifier checks tokens from one issuer for one audience. It fetches the
+// issuer's keys on first use and is safe for concurrent use.
+type Verifier struct {
+	issuer   string
+	audience string
+	jwksURL  string
+	subjects []string
+	leeway   time.Duration
+	client   *http.Client
+	clock    clock.Clock
+
+	// fetches shares one in-flight key fetch between requests
+	fetches singleflight.Group
+
+	mu   sync.Mutex
+	keys map[string]crypto.PublicKey
+	// fetchedAt is when keys were fetched and attemptedAt when a fetch was
+	// last tried
+	fetchedAt, attemptedAt time.Time
+}
+
+// New creates a Verifier; the issuer is not contacted until the first
+// token arrives
+func New(cfg Config) *Verifier {
+	client := cfg.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	leeway := cfg.Leeway
+	if leeway <= 0 {
+		leeway = DefaultLeeway
+	}
+	return &Verifier{
+		issuer:   strings.TrimSuffix(cfg.Issuer, "/"),
+		audience: cfg.Audience,
+		jwksURL:  cfg.JWKSURL,
+		subjects: cfg.Subjects,
+		leeway:   leeway,
+		client:   client,
+		clock:    clock.OrReal(cfg.Clock),
+	}
+}
+
+// BearerToken returns the request's Authorization bearer token
+func BearerToken(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// Verify checks token's signature and claims, returning the caller's
+// identity: the allowed subject or email, or the subject when any is
+// allowed
+func (v *Verifier) Verify(ctx context.Context, token string) (string, Claims, error) {
+	claims, err := v.verify(ctx, token)
+	if err != nil {
+		return "", Claims{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if len(v.subjects) == 0 || slices.Contains(v.subjects, claims.Subject) {
+		return claims.Subject, claims, nil
+	}
+	if claims.Email != "" && (claims.EmailVerified == nil || *claims.EmailVerified) && slices.Contains(v.subjects, claims.Email) {
+		return claims.Email, claims, nil
+	}
+	return "", Claims{}, fmt.Errorf("%w: subject %q is not allowed", ErrInvalidToken, claims.Subject)
+}
+
+// verify checks a token's signature and registered claims
+func (v *Verifier) verify(ctx context.Context, token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Claims{}, fmt.Errorf("malformed token header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, fmt.Errorf("malformed token signature")
+	}
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return Claims{}, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return Claims{}, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Claims{}, fmt.Errorf("malformed token claims: %w", err)
+	}
+	now := v.clock.Now()
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != v.issuer:
+		return Claims{}, fmt.Errorf("token issuer %q is not %q", claims.Issuer, v.issuer)
+	case !slices.Contains(claims.Audience, v.audience):
+		return Claims{}, fmt.Errorf("token audience %v does not include %q", []string(claims.Audience), v.audience)
+	case claims.Expiry == 0 || now.After(time.Unix(claims.Expiry, 0).Add(v.leeway)):
+		return Claims{}, fmt.Errorf("token has expired")
+	case claims.NotBefore != 0 && now.Before(time.Unix(claims.NotBefore, 0).Add(-v.leeway)):
+		return Claims{}, fmt.Errorf("token is not valid yet")
+	}
+	return claims, nil
+}
+
+// decodeSegment decodes a base64url JSON token segment into v
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifySignature checks signature over signed with key for alg
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("token key is not an RSA key")
+		}
+		if err := rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature); err != nil {
+			return fmt.Errorf("invalid token signature")
+		}
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return fmt.Errorf("invalid token signature")
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, digest[:], r, s) {
+			return fmt.Errorf("invalid token signature")
+		}
+	default:
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+	return nil
+}
+
+// key returns the issuer's signing key kid, refetching the keys when it is
+// unknown or they are stale
+func (v *Verifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	now := v.clock.Now()
+	key, ok := v.keys[kid]
+	fresh := ok && now.Sub(v.fetchedAt) <= MaxKeyAge
+	// Don't let tokens naming made-up keys hammer the issuer
+	throttled := !v.attemptedAt.IsZero() && now.Sub(v.attemptedAt) < MinKeyRefresh
+	v.mu.Unlock()
+	if fresh || (ok && throttled) {
+		return key, nil
+	}
+	if throttled {
+		return nil, fmt.Errorf("unknown token key %q", kid)
+	}
+
+	var keys map[string]crypto.PublicKey
+	var err error
+	select {
+	case res := <-v.fetches.DoChan("keys", v.refreshKeys):
+		keys, err = res.Val.(map[string]crypto.PublicKey), res.Err
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		// Keep serving known keys through an issuer outage
+		if ok {
+			return key, nil
+		}
+		return nil, err
+	}
+	if key, ok = keys[kid]; !ok {
+		return nil, fmt.Errorf("unknown token key %q", kid)
+	}
+	return key, nil
+}
+
+// refreshKeys fetches the issuer's keys unless a fetch was tried within
+// MinKeyRefresh, returning the keys now held. The fetch is detached from
+// any request so that a cancelled request doesn't fail it for the others
+// waiting on it. attemptedAt is only set once the fetch finishes, so
+// requests arriving meanwhile join it rather than being throttled.
+func (v *Verifier) refreshKeys() (interface{}, error) {
+	v.mu.Lock()
+	now := v.clock.Now()
+	if !v.attemptedAt.IsZero() && now.Sub(v.attemptedAt) < MinKeyRefresh {
+		keys := v.keys
+		v.mu.Unlock()
+		return keys, nil
+	}
+	v.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), keyFetchTimeout)
+	defer cancel()
+	keys, err := v.fetchKeys(ctx)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.attemptedAt = now
+	if err != nil {
+		return map[string]crypto.PublicKey(nil), err
+	}
+	v.keys, v.fetchedAt = keys, now
+	return keys, nil
+}
+
+// fetchKeys reads the issuer's signing keys, finding them through discovery
+// unless the JWKS URL is configured
+func (v *Verifier) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	jwksURL := v.jwksURL
+	if jwksURL == "" {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := v.getJSON(ctx, v.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, fmt.Errorf("failed to discover OIDC issuer: %w", err)
+		}
+		if strings.TrimSuffix(discovery.Issuer, "/") != v.issuer || discovery.JWKSURI == "" {
+			return nil, fmt.Errorf("OIDC discovery for %q returned issuer %q", v.issuer, discovery.Issuer)
+		}
+		jwksURL = discovery.JWKSURI
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := v.getJSON(ctx, jwksURL, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to fetch signing keys: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		// Skip keys of other types or uses rather than failing on them
+		if key, err := jwk.publicKey(); err == nil && (jwk.Use == "" || jwk.Use == "sig") {
+			keys[jwk.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// getJSON fetches url and decodes its JSON body into v
+func (v *Verifier) getJSON(ctx context.Context, url string, dst interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(http.MaxBytesReader(nil, resp.Body, 1<<20)).Decode(dst)
+}
+
+// jsonWebKey is an RSA or EC P-256 public key in a JWKS document
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey decodes the key
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) > 4 {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != 32 {
+			return nil, fmt.Errorf("invalid EC key")
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil || len(y) != 32 {
+			return nil, fmt.Errorf("invalid EC key")
+		}
+		// Parsing checks the point is on the curve
+		return ecdsa.ParseUncompressedPublicKey(elliptic.P256(), append(append([]byte{4}, x...), y...))
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
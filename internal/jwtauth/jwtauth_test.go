@@ -0,0 +1,309 @@
+package jwtauth_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/clock"
+	"github.com/mcncl/buildkite-pubsub/internal/jwtauth"
+	"github.com/mcncl/buildkite-pubsub/internal/jwtauth/jwtauthtest"
+)
+
+func TestVerify(t *testing.T) {
+	issuer := jwtauthtest.NewIssuer(t)
+	rsaKey := issuer.AddKey(t, "rsa-1", false)
+	ecKey := issuer.AddKey(t, "ec-1", true)
+	clk := clock.NewFake(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	verifier := jwtauth.New(jwtauth.Config{
+		Issuer:   issuer.URL,
+		Audience: "buildkite-pubsub",
+		Subjects: []string{"1234567890", "ops@example.com"},
+		Client:   issuer.Client(),
+		Clock:    clk,
+	})
+
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss": issuer.URL,
+			"sub": "1234567890",
+			"aud": "buildkite-pubsub",
+			"iat": clk.Now().Unix(),
+			"exp": clk.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	tests := []struct {
+		name         string
+		token        string
+		wantIdentity string
+	}{
+		{
+			name:         "RS256 token for an allowed subject",
+			token:        jwtauthtest.Sign(t, rsaKey, "rsa-1", claims(nil)),
+			wantIdentity: "1234567890",
+		},
+		{
+			name:         "ES256 token",
+			token:        jwtauthtest.Sign(t, ecKey, "ec-1", claims(nil)),
+			wantIdentity: "1234567890",
+		},
+		{
+			name:         "allowed verified email",
+			token:        jwtauthtest.Sign(t, rsaKey, "rsa-1", claims(map[string]interface{}{"sub": "999", "email": "ops@example.com", "email_verified": true})),
+			wantIdentity: "ops@example.com",
+		},
+		{
+			name:         "audience list",
+			token:        jwtauthtest.Sign(t, rsaKey, "rsa-1", claims(map[string]interface{}{"aud": []string{"other", "buildkite-pubsub"}})),
+			wantIdentity: "1234567890",
+		},
+		{
+			name:         "expired within leeway",
+			token:        jwtauthtest.Sign(t, rsaKey, "rsa-1", claims(map[string]interface{}{"exp": clk.Now().Add(-30 * time.Second).Unix()})),
+			wantIdentity: "1234567890",
+		},
+		{
+			name:  "unverified email",
+			token: jwtauthtest.Sign(t, rsaKey, "rsa-1", claims(map[string]interface{}{"sub": "999", "email": "ops@example.com", "email_verified": false})),
+		},
+		{
+			name:  "subject not allowed",
+			token: jwtauthtest.Sign(t, rsaKey, "rsa-1", claims(map[string]interface{}{"sub": "999"})),
+		},
+		{
+			name:  "wrong audience",
+			token: jwtauthtest.Sign(t, rsaKey, "rsa-1", claims(map[string]interface{}{"aud": "someone-else"})),
+		},
+		{
+			name:  "wrong issuer",
+			token: jwtauthtest.Sign(t, rsaKey, "rsa-1", claims(map[string]interface{}{"iss": "https://accounts.example.com"})),
+		},
+		{
+			name:  "expired",
+			token: jwtauthtest.Sign(t, rsaKey, "rsa-1", claims(map[string]interface{}{"exp": clk.Now().Add(-2 * time.Minute).Unix()})),
+		},
+		{
+			name:  "no expiry",
+			token: jwtauthtest.Sign(t, rsaKey, "rsa-1", claims(map[string]interface{}{"exp": nil})),
+		},
+		{
+			name:  "not valid yet",
+			token: jwtauthtest.Sign(t, rsaKey, "rsa-1", claims(map[string]interface{}{"nbf": clk.Now().Add(5 * time.Minute).Unix()})),
+		},
+		{
+			name:  "signed by another key",
+			token: jwtauthtest.Sign(t, otherKey, "rsa-1", claims(nil)),
+		},
+		{
+			name:  "algorithm none",
+			token: jwtauthtest.B64([]byte(`{"alg":"none","kid":"rsa-1"}`)) + "." + jwtauthtest.B64([]byte(`{"sub":"1234567890"}`)) + ".",
+		},
+		{
+			name:  "malformed",
+			token: "not-a-jwt",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, _, err := verifier.Verify(context.Background(), tt.token)
+			if tt.wantIdentity == "" {
+				if !errors.Is(err, jwtauth.ErrInvalidToken) {
+					t.Errorf("Verify() = %q, %v, want ErrInvalidToken", identity, err)
+				}
+				return
+			}
+			if err != nil || identity != tt.wantIdentity {
+				t.Errorf("Verify() = %q, %v, want %q", identity, err, tt.wantIdentity)
+			}
+		})
+	}
+	if got := issuer.FetchCount(); got != 1 {
+		t.Errorf("key fetches = %d, want 1", got)
+	}
+}
+
+func TestVerifyOptions(t *testing.T) {
+	issuer := jwtauthtest.NewIssuer(t)
+	key := issuer.AddKey(t, "k", true)
+	clk := clock.NewFake(time.Now())
+	token := jwtauthtest.Sign(t, key, "k", map[string]interface{}{
+		"iss": issuer.URL, "sub": "forwarder", "aud": "webhook",
+		"exp": clk.Now().Add(-3 * time.Minute).Unix(),
+	})
+
+	tests := []struct {
+		name    string
+		cfg     jwtauth.Config
+		wantErr bool
+	}{
+		{
+			name:    "default leeway",
+			cfg:     jwtauth.Config{},
+			wantErr: true,
+		},
+		{
+			name: "clock skew covers the expiry",
+			cfg:  jwtauth.Config{Leeway: 5 * time.Minute},
+		},
+		{
+			name:    "subject outside the allow-list",
+			cfg:     jwtauth.Config{Leeway: 5 * time.Minute, Subjects: []string{"someone-else"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.Issuer, cfg.Audience, cfg.Client, cfg.Clock = issuer.URL+"/", "webhook", issuer.Client(), clk
+			identity, claims, err := jwtauth.New(cfg).Verify(context.Background(), token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (identity != "forwarder" || claims.Subject != "forwarder") {
+				t.Errorf("Verify() = %q, %+v, want forwarder", identity, claims)
+			}
+		})
+	}
+}
+
+func TestVerifyJWKSURLSkipsDiscovery(t *testing.T) {
+	issuer := jwtauthtest.NewIssuer(t)
+	key := issuer.AddKey(t, "k", false)
+	// The issuer name has no discovery document, so only the configured
+	// JWKS URL can supply the key
+	verifier := jwtauth.New(jwtauth.Config{
+		Issuer:   "https://forwarders.internal.invalid",
+		Audience: "webhook",
+		JWKSURL:  issuer.URL + "/keys",
+		Client:   issuer.Client(),
+	})
+	token := jwtauthtest.Sign(t, key, "k", map[string]interface{}{
+		"iss": "https://forwarders.internal.invalid", "sub": "forwarder", "aud": "webhook",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	if _, _, err := verifier.Verify(context.Background(), token); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+}
+
+func TestVerifySharesKeyFetch(t *testing.T) {
+	issuer := jwtauthtest.NewIssuer(t)
+	key := issuer.AddKey(t, "k", false)
+	verifier := jwtauth.New(jwtauth.Config{
+		Issuer:   issuer.URL,
+		Audience: "webhook",
+		Client:   issuer.Client(),
+	})
+	token := jwtauthtest.Sign(t, key, "k", map[string]interface{}{
+		"iss": issuer.URL, "sub": "forwarder", "aud": "webhook", "exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	// A request that gives up doesn't fail the fetch it started for the
+	// requests behind it
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, _ = verifier.Verify(cancelled, token)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := verifier.Verify(context.Background(), token)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Verify() error = %v", err)
+		}
+	}
+	if got := issuer.FetchCount(); got != 1 {
+		t.Errorf("key fetches = %d, want 1", got)
+	}
+}
+
+func TestVerifyKeyRotation(t *testing.T) {
+	issuer := jwtauthtest.NewIssuer(t)
+	oldKey := issuer.AddKey(t, "old", false)
+	clk := clock.NewFake(time.Now())
+	verifier := jwtauth.New(jwtauth.Config{
+		Issuer:   issuer.URL,
+		Audience: "webhook",
+		Client:   issuer.Client(),
+		Clock:    clk,
+	})
+	verify := func(key crypto.Signer, kid string) error {
+		_, _, err := verifier.Verify(context.Background(), jwtauthtest.Sign(t, key, kid, map[string]interface{}{
+			"iss": issuer.URL, "sub": "forwarder", "aud": "webhook", "exp": clk.Now().Add(time.Hour).Unix(),
+		}))
+		return err
+	}
+
+	if err := verify(oldKey, "old"); err != nil {
+		t.Fatalf("Verify() with the current key error = %v", err)
+	}
+
+	// A token naming an unknown key refetches the keys at most once a minute
+	newKey := issuer.AddKey(t, "new", true)
+	if err := verify(newKey, "new"); err == nil {
+		t.Fatal("Verify() accepted a key within a minute of the last fetch")
+	}
+	clk.Advance(jwtauth.MinKeyRefresh)
+	if err := verify(newKey, "new"); err != nil {
+		t.Fatalf("Verify() with a rotated key error = %v", err)
+	}
+	if got := issuer.FetchCount(); got != 2 {
+		t.Errorf("key fetches = %d, want 2", got)
+	}
+
+	// Known keys keep working while the issuer is down
+	issuer.Close()
+	clk.Advance(2 * jwtauth.MaxKeyAge)
+	if err := verify(oldKey, "old"); err != nil {
+		t.Errorf("Verify() during an issuer outage error = %v", err)
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+		wantOK bool
+	}{
+		{header: "Bearer abc", want: "abc", wantOK: true},
+		{header: "Bearer  abc ", want: "abc", wantOK: true},
+		{header: "Bearer ", wantOK: false},
+		{header: "Basic abc", wantOK: false},
+		{header: "", wantOK: false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.Header.Set("Authorization", tt.header)
+		got, ok := jwtauth.BearerToken(req)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("BearerToken(%q) = %q, %v, want %q, %v", tt.header, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Package jwtauthtest provides a JWT issuer for tests of token
+// authentication.
+package jwtauthtest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// Issuer serves OpenID Connect discovery and a JWKS of its signing keys
+// over TLS; pass its Client to the verifier under test
+type Issuer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	keys    map[string]crypto.Signer
+	fetches int
+}
+
+// NewIssuer starts an issuer with no keys, closed when the test ends. Its
+// keys are served at URL + "/keys".
+func NewIssuer(t testing.TB) *Issuer {
+	t.Helper()
+	issuer := &Issuer{keys: make(map[string]crypto.Signer)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   issuer.URL,
+			"jwks_uri": issuer.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		issuer.mu.Lock()
+		defer issuer.mu.Unlock()
+		issuer.fetches++
+		var keys []map[string]string
+		for kid, key := range issuer.keys {
+			switch pub := key.Public().(type) {
+			case *rsa.PublicKey:
+				keys = append(keys, map[string]string{
+					"kty": "RSA", "kid": kid, "use": "sig",
+					"n": B64(pub.N.Bytes()), "e": B64(big.NewInt(int64(pub.E)).Bytes()),
+				})
+			case *ecdsa.PublicKey:
+				point, _ := pub.Bytes()
+				keys = append(keys, map[string]string{
+					"kty": "EC", "kid": kid, "crv": "P-256",
+					"x": B64(point[1:33]), "y": B64(point[33:]),
+				})
+			}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	})
+	issuer.Server = httptest.NewTLSServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+// B64 encodes data as an unpadded base64url token segment
+func B64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// AddKey adds a signing key named kid, RSA unless ec is set
+func (i *Issuer) AddKey(t testing.TB, kid string, ec bool) crypto.Signer {
+	t.Helper()
+	var key crypto.Signer
+	var err error
+	if ec {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	} else {
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.keys[kid] = key
+	return key
+}
+
+// FetchCount returns how many times the keys have been fetched
+func (i *Issuer) FetchCount() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.fetches
+}
+
+// Sign signs claims with key, naming it kid, using RS256 for RSA keys and
+// ES256 for EC keys
+func Sign(t testing.TB, key crypto.Signer, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := B64(header) + "." + B64(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatalf("failed to sign token: %v", err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatalf("failed to sign token: %v", err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + B64(signature)
+}
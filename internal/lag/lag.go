@@ -0,0 +1,166 @@
+// Package lag watches the backlog of the subscriptions consuming the topic,
+// so the producer side hears that consumers are falling behind before the
+// backlog grows into an outage of its own.
+package lag
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+)
+
+// Backlog is how far a subscription's consumers are behind
+type Backlog struct {
+	// Undelivered is the number of messages not yet acknowledged
+	Undelivered int64
+	// OldestUnackedAge is the age of the oldest message not yet
+	// acknowledged
+	OldestUnackedAge time.Duration
+}
+
+// Source reports the backlog of subscriptions
+type Source interface {
+	// Backlogs returns the backlog of each subscription it has data for,
+	// keyed by subscription ID
+	Backlogs(ctx context.Context, subscriptions []string) (map[string]Backlog, error)
+}
+
+// Sample is the last known backlog of a subscription, served in /stats
+type Sample struct {
+	Subscription string `json:"subscription"`
+	// Undelivered and OldestUnackedAgeSeconds are unset until the first
+	// successful check
+	Undelivered             int64   `json:"undelivered_messages"`
+	OldestUnackedAgeSeconds float64 `json:"oldest_unacked_age_seconds"`
+	// Lagging is true when the oldest unacknowledged message is older than
+	// the configured maximum age
+	Lagging   bool      `json:"lagging"`
+	CheckedAt time.Time `json:"checked_at,omitzero"`
+	// Error is why the last check has no backlog for the subscription
+	Error string `json:"error,omitempty"`
+}
+
+// Config holds the settings for a Monitor
+type Config struct {
+	Source        Source
+	Subscriptions []string
+	// Interval between checks
+	Interval time.Duration
+	// MaxAge marks subscriptions whose oldest unacknowledged message is
+	// older as lagging; zero never does
+	MaxAge time.Duration
+	Logger *slog.Logger
+}
+
+// Monitor checks the backlog of subscriptions on an interval, exporting it
+// as metrics and keeping the latest sample of each
+type Monitor struct {
+	source        Source
+	subscriptions []string
+	interval      time.Duration
+	maxAge        time.Duration
+	logger        *slog.Logger
+	now           func() time.Time
+
+	mu      sync.Mutex
+	samples map[string]Sample
+}
+
+// New creates a Monitor; call Run to start checking
+func New(cfg Config) *Monitor {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	samples := make(map[string]Sample, len(cfg.Subscriptions))
+	for _, sub := range cfg.Subscriptions {
+		samples[sub] = Sample{Subscription: sub, Error: "not checked yet"}
+	}
+	return &Monitor{
+		source:        cfg.Source,
+		subscriptions: cfg.Subscriptions,
+		interval:      cfg.Interval,
+		maxAge:        cfg.MaxAge,
+		logger:        logger,
+		now:           time.Now,
+		samples:       samples,
+	}
+}
+
+// Check fetches the backlog of every subscription once. A failed check
+// keeps the previous samples, noting the error.
+func (m *Monitor) Check(ctx context.Context) error {
+	backlogs, err := m.source.Backlogs(ctx, m.subscriptions)
+	now := m.now().UTC()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		metrics.SubscriptionLagChecksTotal.WithLabelValues("error").Inc()
+		for sub, sample := range m.samples {
+			sample.Error = err.Error()
+			m.samples[sub] = sample
+		}
+		return err
+	}
+	metrics.SubscriptionLagChecksTotal.WithLabelValues("success").Inc()
+
+	for _, sub := range m.subscriptions {
+		backlog, ok := backlogs[sub]
+		if !ok {
+			sample := m.samples[sub]
+			sample.Error = "no backlog reported for the subscription"
+			m.samples[sub] = sample
+			continue
+		}
+		lagging := m.maxAge > 0 && backlog.OldestUnackedAge > m.maxAge
+		if lagging && !m.samples[sub].Lagging {
+			m.logger.Warn("Subscription is falling behind", "subscription", sub,
+				"oldest_unacked_age", backlog.OldestUnackedAge.String(), "undelivered_messages", backlog.Undelivered)
+		}
+		m.samples[sub] = Sample{
+			Subscription:            sub,
+			Undelivered:             backlog.Undelivered,
+			OldestUnackedAgeSeconds: backlog.OldestUnackedAge.Seconds(),
+			Lagging:                 lagging,
+			CheckedAt:               now,
+		}
+		metrics.SubscriptionUndeliveredMessages.WithLabelValues(sub).Set(float64(backlog.Undelivered))
+		metrics.SubscriptionOldestUnackedAge.WithLabelValues(sub).Set(backlog.OldestUnackedAge.Seconds())
+	}
+	return nil
+}
+
+// Samples returns the latest sample of each subscription, in the
+// configured order
+func (m *Monitor) Samples() []Sample {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	samples := make([]Sample, 0, len(m.subscriptions))
+	for _, sub := range m.subscriptions {
+		samples = append(samples, m.samples[sub])
+	}
+	return samples
+}
+
+// Run checks straight away and then every interval until ctx is done,
+// logging checks that fail
+func (m *Monitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, m.interval)
+		if err := m.Check(checkCtx); err != nil && ctx.Err() == nil {
+			m.logger.Warn("Failed to check subscription backlog", "error", err)
+		}
+		cancel()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
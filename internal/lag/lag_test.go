@@ -0,0 +1,121 @@
+package lag
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/api/option"
+)
+
+// fakeSource returns fixed backlogs or an error
+type fakeSource struct {
+	backlogs map[string]Backlog
+	err      error
+}
+
+func (f *fakeSource) Backlogs(ctx context.Context, subscriptions []string) (map[string]Backlog, error) {
+	return f.backlogs, f.err
+}
+
+func TestMonitorCheck(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	source := &fakeSource{backlogs: map[string]Backlog{
+		"fast": {Undelivered: 3, OldestUnackedAge: 5 * time.Second},
+		"slow": {Undelivered: 1200, OldestUnackedAge: 15 * time.Minute},
+	}}
+	m := New(Config{
+		Source:        source,
+		Subscriptions: []string{"fast", "slow", "gone"},
+		Interval:      time.Minute,
+		MaxAge:        10 * time.Minute,
+	})
+	if err := m.Check(context.Background()); err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+
+	samples := m.Samples()
+	if len(samples) != 3 {
+		t.Fatalf("Samples() = %v, want one per subscription", samples)
+	}
+	if s := samples[0]; s.Subscription != "fast" || s.Undelivered != 3 || s.OldestUnackedAgeSeconds != 5 || s.Lagging || s.Error != "" {
+		t.Errorf("fast sample = %+v", s)
+	}
+	if s := samples[1]; s.Subscription != "slow" || !s.Lagging {
+		t.Errorf("slow sample = %+v, want lagging", s)
+	}
+	if s := samples[2]; s.Subscription != "gone" || s.Error == "" {
+		t.Errorf("gone sample = %+v, want an error", s)
+	}
+	if got := testutil.ToFloat64(metrics.SubscriptionOldestUnackedAge.WithLabelValues("slow")); got != 900 {
+		t.Errorf("oldest unacked age{slow} = %v, want 900", got)
+	}
+	if got := testutil.ToFloat64(metrics.SubscriptionUndeliveredMessages.WithLabelValues("slow")); got != 1200 {
+		t.Errorf("undelivered{slow} = %v, want 1200", got)
+	}
+
+	// A failed check keeps the last backlog, noting the error
+	source.err = errors.New("permission denied")
+	if err := m.Check(context.Background()); err == nil {
+		t.Fatal("Check() error = nil, want the source's error")
+	}
+	if s := m.Samples()[1]; s.Undelivered != 1200 || s.Error != "permission denied" {
+		t.Errorf("slow sample after failed check = %+v", s)
+	}
+	if got := testutil.ToFloat64(metrics.SubscriptionLagChecksTotal.WithLabelValues("error")); got != 1 {
+		t.Errorf("failed checks = %v, want 1", got)
+	}
+}
+
+func TestMonitoringSource(t *testing.T) {
+	var filters []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v3/projects/my-project/timeSeries" {
+			t.Errorf("request path = %s", r.URL.Path)
+		}
+		filter := r.URL.Query().Get("filter")
+		filters = append(filters, filter)
+		value := `{"int64Value": "42"}`
+		if strings.Contains(filter, oldestAgeMetric) {
+			value = `{"int64Value": "90"}`
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"timeSeries": []interface{}{
+				map[string]interface{}{
+					"resource": map[string]interface{}{"labels": map[string]string{"subscription_id": "consumer"}},
+					"points": []interface{}{
+						map[string]interface{}{"value": json.RawMessage(value)},
+						map[string]interface{}{"value": json.RawMessage(`{"int64Value": "1"}`)},
+					},
+				},
+			},
+		})
+	}))
+	defer srv.Close()
+
+	source, err := NewMonitoringSource(context.Background(), "my-project", option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("NewMonitoringSource() error = %v", err)
+	}
+	backlogs, err := source.Backlogs(context.Background(), []string{"consumer", "other"})
+	if err != nil {
+		t.Fatalf("Backlogs() error = %v", err)
+	}
+	if got, want := backlogs["consumer"], (Backlog{Undelivered: 42, OldestUnackedAge: 90 * time.Second}); got != want || len(backlogs) != 1 {
+		t.Errorf("Backlogs() = %v, want consumer %+v", backlogs, want)
+	}
+	if len(filters) != 2 || !strings.Contains(filters[0], `one_of("consumer","other")`) {
+		t.Errorf("filters = %q, want one query per metric for both subscriptions", filters)
+	}
+}
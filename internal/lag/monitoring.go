@@ -0,0 +1,102 @@
+package lag
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	monitoring "google.golang.org/api/monitoring/v3"
+	"google.golang.org/api/option"
+)
+
+// Cloud Monitoring metrics for a subscription's backlog. The Pub/Sub admin
+// API does not report backlog, so it is read from the metrics Pub/Sub
+// exports.
+const (
+	undeliveredMetric = "pubsub.googleapis.com/subscription/num_undelivered_messages"
+	oldestAgeMetric   = "pubsub.googleapis.com/subscription/oldest_unacked_message_age"
+)
+
+// lookback is how far back to read points; Pub/Sub samples its metrics
+// every minute and they can take a few minutes to appear
+const lookback = 10 * time.Minute
+
+// MonitoringSource reads subscription backlogs from Cloud Monitoring. The
+// credentials need roles/monitoring.viewer on the project.
+type MonitoringSource struct {
+	service   *monitoring.Service
+	projectID string
+	now       func() time.Time
+}
+
+// NewMonitoringSource creates a source for subscriptions in projectID
+func NewMonitoringSource(ctx context.Context, projectID string, opts ...option.ClientOption) (*MonitoringSource, error) {
+	service, err := monitoring.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create monitoring client: %w", err)
+	}
+	return &MonitoringSource{service: service, projectID: projectID, now: time.Now}, nil
+}
+
+// Backlogs implements Source with one query per metric for all the
+// subscriptions
+func (s *MonitoringSource) Backlogs(ctx context.Context, subscriptions []string) (map[string]Backlog, error) {
+	undelivered, err := s.latest(ctx, undeliveredMetric, subscriptions)
+	if err != nil {
+		return nil, err
+	}
+	oldestAge, err := s.latest(ctx, oldestAgeMetric, subscriptions)
+	if err != nil {
+		return nil, err
+	}
+
+	backlogs := make(map[string]Backlog, len(undelivered))
+	for sub, n := range undelivered {
+		age, ok := oldestAge[sub]
+		if !ok {
+			continue
+		}
+		backlogs[sub] = Backlog{Undelivered: n, OldestUnackedAge: time.Duration(age) * time.Second}
+	}
+	return backlogs, nil
+}
+
+// latest returns the newest point of metric for each subscription
+func (s *MonitoringSource) latest(ctx context.Context, metric string, subscriptions []string) (map[string]int64, error) {
+	quoted := make([]string, len(subscriptions))
+	for i, sub := range subscriptions {
+		quoted[i] = strconv.Quote(sub)
+	}
+	filter := fmt.Sprintf(`metric.type = %q AND resource.type = "pubsub_subscription" AND resource.labels.subscription_id = one_of(%s)`,
+		metric, strings.Join(quoted, ","))
+	end := s.now().UTC()
+
+	values := make(map[string]int64, len(subscriptions))
+	err := s.service.Projects.TimeSeries.List("projects/"+s.projectID).
+		Filter(filter).
+		IntervalStartTime(end.Add(-lookback).Format(time.RFC3339)).
+		IntervalEndTime(end.Format(time.RFC3339)).
+		Pages(ctx, func(resp *monitoring.ListTimeSeriesResponse) error {
+			for _, series := range resp.TimeSeries {
+				// Points are newest first
+				if series.Resource == nil || len(series.Points) == 0 || series.Points[0].Value == nil {
+					continue
+				}
+				value := series.Points[0].Value
+				sub := series.Resource.Labels["subscription_id"]
+				switch {
+				case value.Int64Value != nil:
+					values[sub] = *value.Int64Value
+				case value.DoubleValue != nil:
+					values[sub] = int64(*value.DoubleValue)
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", metric, err)
+	}
+	return values, nil
+}
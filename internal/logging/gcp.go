@@ -0,0 +1,170 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Fields Cloud Logging reads an entry's trace and span from
+const (
+	TraceKey        = "logging.googleapis.com/trace"
+	SpanIDKey       = "logging.googleapis.com/spanId"
+	TraceSampledKey = "logging.googleapis.com/trace_sampled"
+)
+
+// HTTPRequestKey is the attribute key for an HTTPRequest
+const HTTPRequestKey = "httpRequest"
+
+// HTTPRequest describes a completed request in Cloud Logging's httpRequest
+// format, which the Logs Explorer shows as a request line. Only the gcp
+// format writes it; other formats omit it because the request's fields are
+// logged individually.
+type HTTPRequest struct {
+	RequestMethod string `json:"requestMethod,omitempty"`
+	RequestURL    string `json:"requestUrl,omitempty"`
+	RequestSize   string `json:"requestSize,omitempty"`
+	Status        int    `json:"status,omitempty"`
+	ResponseSize  string `json:"responseSize,omitempty"`
+	UserAgent     string `json:"userAgent,omitempty"`
+	RemoteIP      string `json:"remoteIp,omitempty"`
+	Latency       string `json:"latency,omitempty"`
+	Protocol      string `json:"protocol,omitempty"`
+}
+
+// NewHTTPRequest describes a request that took latency and wrote a response
+// of size bytes with status
+func NewHTTPRequest(r *http.Request, status, size int, latency time.Duration) HTTPRequest {
+	req := HTTPRequest{
+		RequestMethod: r.Method,
+		RequestURL:    requestURL(r),
+		Status:        status,
+		ResponseSize:  strconv.Itoa(size),
+		UserAgent:     r.UserAgent(),
+		RemoteIP:      r.RemoteAddr,
+		Latency:       fmt.Sprintf("%.9fs", latency.Seconds()),
+		Protocol:      r.Proto,
+	}
+	if r.ContentLength > 0 {
+		req.RequestSize = strconv.FormatInt(r.ContentLength, 10)
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		req.RemoteIP = host
+	}
+	return req
+}
+
+// requestURL returns the absolute URL the client requested
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.URL.Scheme == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.RequestURI()
+}
+
+// LogValue is an empty group, which handlers other than the gcp format's omit
+func (HTTPRequest) LogValue() slog.Value {
+	return slog.GroupValue()
+}
+
+// httpRequestEntry is an HTTPRequest without LogValue, so the JSON handler
+// encodes its fields
+type httpRequestEntry HTTPRequest
+
+// gcpHandler writes HTTPRequest attributes as Cloud Logging's httpRequest
+// block before handing records to the JSON handler
+type gcpHandler struct {
+	slog.Handler
+}
+
+func (h gcpHandler) Handle(ctx context.Context, r slog.Record) error {
+	found := false
+	r.Attrs(func(a slog.Attr) bool {
+		_, found = a.Value.Any().(HTTPRequest)
+		return !found
+	})
+	if !found {
+		return h.Handler.Handle(ctx, r)
+	}
+
+	entry := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		if req, ok := a.Value.Any().(HTTPRequest); ok {
+			a = slog.Any(a.Key, httpRequestEntry(req))
+		}
+		entry.AddAttrs(a)
+		return true
+	})
+	return h.Handler.Handle(ctx, entry)
+}
+
+func (h gcpHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return gcpHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h gcpHandler) WithGroup(name string) slog.Handler {
+	return gcpHandler{h.Handler.WithGroup(name)}
+}
+
+// NewGCPHandler returns a JSON handler that writes Cloud Logging structured
+// entries: the level as severity, the message as message, HTTPRequest
+// attributes as httpRequest, and trace_id, span_id and trace_sampled as the
+// entry's trace so Cloud Logging links it to Cloud Trace. The trace's
+// resource name needs projectID; without one trace_id is written as is.
+func NewGCPHandler(w io.Writer, level slog.Leveler, projectID string) slog.Handler {
+	return gcpHandler{slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) > 0 {
+				return a
+			}
+			switch a.Key {
+			case slog.LevelKey:
+				if lvl, ok := a.Value.Any().(slog.Level); ok {
+					return slog.String("severity", severity(lvl))
+				}
+			case slog.MessageKey:
+				a.Key = "message"
+			case "trace_id":
+				if projectID != "" {
+					return slog.String(TraceKey, "projects/"+projectID+"/traces/"+a.Value.String())
+				}
+			case "span_id":
+				a.Key = SpanIDKey
+			case "trace_sampled":
+				a.Key = TraceSampledKey
+			}
+			return a
+		},
+	})}
+}
+
+// severity maps a slog level to a Cloud Logging severity
+func severity(level slog.Level) string {
+	switch {
+	case level < slog.LevelInfo:
+		return "DEBUG"
+	case level < slog.LevelWarn:
+		return "INFO"
+	case level < slog.LevelError:
+		return "WARNING"
+	default:
+		return "ERROR"
+	}
+}
+
+// gcpProjectID returns the project traces are recorded in: the runtime's
+// GOOGLE_CLOUD_PROJECT, or the Pub/Sub PROJECT_ID
+func gcpProjectID() string {
+	if project := os.Getenv("GOOGLE_CLOUD_PROJECT"); project != "" {
+		return project
+	}
+	return os.Getenv("PROJECT_ID")
+}
@@ -0,0 +1,135 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGCPHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		projectID string
+		log       func(*slog.Logger)
+		want      map[string]interface{}
+		absent    []string
+	}{
+		{
+			name: "severity and message",
+			log:  func(l *slog.Logger) { l.Warn("Circuit breaker state changed", "to", "open") },
+			want: map[string]interface{}{"severity": "WARNING", "message": "Circuit breaker state changed", "to": "open"},
+			absent: []string{
+				slog.LevelKey, slog.MessageKey,
+			},
+		},
+		{
+			name:      "trace",
+			projectID: "my-project",
+			log: func(l *slog.Logger) {
+				l.With("trace_id", "4bf92f3577b34da6a3ce929d0e0e4736").Info("Request started")
+			},
+			want:   map[string]interface{}{"severity": "INFO", TraceKey: "projects/my-project/traces/4bf92f3577b34da6a3ce929d0e0e4736"},
+			absent: []string{"trace_id"},
+		},
+		{
+			name:      "span and sampling",
+			projectID: "my-project",
+			log: func(l *slog.Logger) {
+				l.Info("Request started", "trace_id", "4bf92f3577b34da6a3ce929d0e0e4736", "span_id", "00f067aa0ba902b7", "trace_sampled", true)
+			},
+			want:   map[string]interface{}{SpanIDKey: "00f067aa0ba902b7", TraceSampledKey: true},
+			absent: []string{"span_id", "trace_sampled"},
+		},
+		{
+			name: "http request",
+			log: func(l *slog.Logger) {
+				l.Info("Request completed", HTTPRequestKey, HTTPRequest{RequestMethod: "POST", Status: 200, Latency: "0.250000000s"})
+			},
+			want: map[string]interface{}{HTTPRequestKey: map[string]interface{}{"requestMethod": "POST", "status": 200, "latency": "0.250000000s"}},
+		},
+		{
+			name: "trace without a project",
+			log: func(l *slog.Logger) {
+				l.Error("Publish failed", "trace_id", "4bf92f3577b34da6a3ce929d0e0e4736")
+			},
+			want:   map[string]interface{}{"severity": "ERROR", "trace_id": "4bf92f3577b34da6a3ce929d0e0e4736"},
+			absent: []string{TraceKey},
+		},
+		{
+			name: "grouped attributes are left alone",
+			log: func(l *slog.Logger) {
+				l.Debug("Detail", slog.Group("req", "trace_id", "abc"))
+			},
+			want: map[string]interface{}{"severity": "DEBUG", "req": map[string]interface{}{"trace_id": "abc"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tt.log(slog.New(NewGCPHandler(&buf, slog.LevelDebug, tt.projectID)))
+
+			var entry map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+				t.Fatalf("invalid JSON %q: %v", buf.String(), err)
+			}
+			for key, want := range tt.want {
+				got, _ := json.Marshal(entry[key])
+				wantJSON, _ := json.Marshal(want)
+				if !bytes.Equal(got, wantJSON) {
+					t.Errorf("%s = %s, want %s", key, got, wantJSON)
+				}
+			}
+			for _, key := range tt.absent {
+				if _, ok := entry[key]; ok {
+					t.Errorf("%s present in %s", key, buf.String())
+				}
+			}
+		})
+	}
+}
+
+func TestHTTPRequestOnlyInGCPFormat(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/webhook?source=test", strings.NewReader(`{"event":"ping"}`))
+	req.RemoteAddr = "203.0.113.7:4321"
+	req.Header.Set("User-Agent", "Buildkite-Request")
+	httpReq := NewHTTPRequest(req, http.StatusAccepted, 42, 1500*time.Millisecond)
+
+	want := HTTPRequest{
+		RequestMethod: "POST",
+		RequestURL:    "http://example.com/webhook?source=test",
+		RequestSize:   "16",
+		Status:        http.StatusAccepted,
+		ResponseSize:  "42",
+		UserAgent:     "Buildkite-Request",
+		RemoteIP:      "203.0.113.7",
+		Latency:       "1.500000000s",
+		Protocol:      "HTTP/1.1",
+	}
+	if httpReq != want {
+		t.Errorf("NewHTTPRequest() = %+v, want %+v", httpReq, want)
+	}
+
+	var buf bytes.Buffer
+	slog.New(slog.NewJSONHandler(&buf, nil)).Info("Request completed", "status", 202, HTTPRequestKey, httpReq)
+	if strings.Contains(buf.String(), HTTPRequestKey) {
+		t.Errorf("JSON format wrote %s: %s", HTTPRequestKey, buf.String())
+	}
+
+	buf.Reset()
+	slog.New(NewGCPHandler(&buf, slog.LevelInfo, "")).Info("Request completed", "status", 202, HTTPRequestKey, httpReq)
+	var entry struct {
+		HTTPRequest HTTPRequest `json:"httpRequest"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("invalid JSON %q: %v", buf.String(), err)
+	}
+	if entry.HTTPRequest != want {
+		t.Errorf("httpRequest = %+v, want %+v", entry.HTTPRequest, want)
+	}
+}
@@ -7,6 +7,8 @@ import (
 )
 
 // NewLogger creates a new slog.Logger with the specified level and format.
+// The "gcp" format writes Cloud Logging structured entries to stdout; the
+// others write to stderr.
 func NewLogger(level, format string) *slog.Logger {
 	var lvl slog.Level
 	switch level {
@@ -23,9 +25,12 @@ func NewLogger(level, format string) *slog.Logger {
 	opts := &slog.HandlerOptions{Level: lvl}
 
 	var handler slog.Handler
-	if format == "text" || format == "dev" {
+	switch format {
+	case "text", "dev":
 		handler = slog.NewTextHandler(os.Stderr, opts)
-	} else {
+	case "gcp":
+		handler = NewGCPHandler(os.Stdout, lvl, gcpProjectID())
+	default:
 		handler = slog.NewJSONHandler(os.Stderr, opts)
 	}
 
@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// tenantLabels identify a pipeline, branch or owning team. Their values are
+// unbounded, so operators can drop them or collapse values with relabel
+// rules.
+var tenantLabels = []string{"pipeline", "branch", "team"}
+
+// RelabelRule replaces the value of Label with Replacement when it matches
+// Match, a path.Match pattern as used by topic routes, so "feature/*"
+// collapses feature/login and feature/signup into one series
+type RelabelRule struct {
+	Label       string
+	Match       string
+	Replacement string
+}
+
+// WithDroppedLabels removes tenant labels from metrics. Each entry is a
+// label, such as "branch", to drop from every metric, or metric:label, such
+// as "buildkite_builds_total:branch", to drop it from one metric. Metrics
+// are named as declared, before any prefix, namespace or subsystem.
+func WithDroppedLabels(labels []string) Option {
+	return func(o *options) {
+		o.dropLabels = labels
+	}
+}
+
+// WithRelabelRules rewrites tenant label values on every metric that has
+// them; the first matching rule for a label applies
+func WithRelabelRules(rules []RelabelRule) Option {
+	return func(o *options) {
+		o.relabelRules = rules
+	}
+}
+
+// labelPolicy drops and relabels tenant labels
+type labelPolicy struct {
+	// dropped holds labels dropped from every metric under "" and from
+	// single metrics under their declared name
+	dropped map[string][]string
+	rules   []RelabelRule
+}
+
+// newLabelPolicy validates dropped labels and relabel rules
+func newLabelPolicy(dropLabels []string, rules []RelabelRule) (*labelPolicy, error) {
+	p := &labelPolicy{dropped: make(map[string][]string), rules: rules}
+	for _, entry := range dropLabels {
+		metric, label, ok := strings.Cut(entry, ":")
+		if !ok {
+			metric, label = "", entry
+		}
+		if !slices.Contains(tenantLabels, label) {
+			return nil, fmt.Errorf("cannot drop label %q: only %s can be dropped", label, strings.Join(tenantLabels, ", "))
+		}
+		p.dropped[metric] = append(p.dropped[metric], label)
+	}
+	for _, rule := range rules {
+		if !slices.Contains(tenantLabels, rule.Label) {
+			return nil, fmt.Errorf("cannot relabel %q: only %s can be relabeled", rule.Label, strings.Join(tenantLabels, ", "))
+		}
+		if _, err := path.Match(rule.Match, ""); err != nil {
+			return nil, fmt.Errorf("invalid relabel pattern %q: %w", rule.Match, err)
+		}
+	}
+	return p, nil
+}
+
+// isDropped reports whether label is dropped from the metric declared as name
+func (p *labelPolicy) isDropped(name, label string) bool {
+	return slices.Contains(p.dropped[""], label) || slices.Contains(p.dropped[name], label)
+}
+
+// labelNames returns the labels the metric declared as name is exported with
+func (p *labelPolicy) labelNames(name string, labelNames []string) []string {
+	kept := make([]string, 0, len(labelNames))
+	for _, label := range labelNames {
+		if !p.isDropped(name, label) {
+			kept = append(kept, label)
+		}
+	}
+	return kept
+}
+
+// labels returns the exported labels for an observation of the metric
+// declared as name, dropping and relabeling tenant labels
+func (p *labelPolicy) labels(name string, labels prometheus.Labels) prometheus.Labels {
+	for label, value := range labels {
+		if p.isDropped(name, label) {
+			delete(labels, label)
+			continue
+		}
+		for _, rule := range p.rules {
+			if rule.Label != label {
+				continue
+			}
+			if ok, _ := path.Match(rule.Match, value); ok {
+				labels[label] = rule.Replacement
+				break
+			}
+		}
+	}
+	return labels
+}
@@ -0,0 +1,177 @@
+package metrics
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gatherLabels returns the labels of every series of every gathered family
+// that has label, keyed by family name
+func gatherLabels(t *testing.T, reg *prometheus.Registry, label string) map[string][]map[string]string {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+	series := make(map[string][]map[string]string)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, pair := range metric.GetLabel() {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			if _, ok := labels[label]; ok {
+				series[family.GetName()] = append(series[family.GetName()], labels)
+			}
+		}
+	}
+	return series
+}
+
+// recordBuilds records a build event and queue time for every pipeline and
+// branch, and a delivery confirmation for every pipeline
+func recordBuilds(pipelines, branches []string) {
+	for _, pipeline := range pipelines {
+		RecordDeliveryConfirmation(pipeline, "confirmed")
+		RecordDeliveryConfirmationTime(pipeline, 0.25)
+		for _, branch := range branches {
+			RecordBuildStatus("passed", pipeline, branch, "")
+			RecordQueueTime(pipeline, branch, "", "webhook", 12)
+		}
+	}
+}
+
+func TestRelabelRulesApplyToEveryMetric(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	err := InitMetrics(reg, WithRelabelRules([]RelabelRule{
+		{Label: "branch", Match: "feature/*", Replacement: "feature/*"},
+		{Label: "branch", Match: "*", Replacement: "other"},
+		{Label: "pipeline", Match: "preview-*", Replacement: "preview"},
+	}))
+	if err != nil {
+		t.Fatalf("InitMetrics() error = %v", err)
+	}
+
+	recordBuilds([]string{"deploy", "preview-123", "preview-456"}, []string{"main", "feature/login", "feature/signup"})
+
+	series := gatherLabels(t, reg, "branch")
+	for _, name := range []string{"buildkite_builds_total", "buildkite_build_queue_seconds"} {
+		if len(series[name]) == 0 {
+			t.Errorf("%s not gathered with a branch label", name)
+		}
+	}
+	for name, all := range series {
+		seen := make(map[[2]string]bool)
+		for _, labels := range all {
+			if branch := labels["branch"]; branch != "feature/*" && branch != "other" {
+				t.Errorf("%s has branch %q, want feature/* or other", name, branch)
+			}
+			if pipeline := labels["pipeline"]; pipeline != "deploy" && pipeline != "preview" {
+				t.Errorf("%s has pipeline %q, want deploy or preview", name, pipeline)
+			}
+			seen[[2]string{labels["pipeline"], labels["branch"]}] = true
+		}
+		if len(seen) != 4 {
+			t.Errorf("%s has %d pipeline and branch pairs, want 4", name, len(seen))
+		}
+	}
+}
+
+func TestDroppedLabels(t *testing.T) {
+	tests := []struct {
+		name string
+		drop []string
+		// want lists the labels each metric keeps
+		want map[string][]string
+	}{
+		{
+			name: "label dropped from every metric",
+			drop: []string{"branch"},
+			want: map[string][]string{
+				"buildkite_builds_total":        {"state", "pipeline", "team"},
+				"buildkite_build_queue_seconds": {"pipeline", "team", "source"},
+			},
+		},
+		{
+			name: "label dropped from one metric",
+			drop: []string{"buildkite_builds_total:pipeline"},
+			want: map[string][]string{
+				"buildkite_builds_total":        {"state", "branch", "team"},
+				"buildkite_build_queue_seconds": {"pipeline", "branch", "team", "source"},
+			},
+		},
+		{
+			name: "all tenant labels dropped",
+			drop: []string{"pipeline", "branch", "team"},
+			want: map[string][]string{
+				"buildkite_builds_total":                          {"state"},
+				"buildkite_build_queue_seconds":                   {"source"},
+				"buildkite_webhook_delivery_confirmations_total":  {"outcome"},
+				"buildkite_webhook_delivery_confirmation_seconds": {},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			if err := InitMetrics(reg, WithDroppedLabels(tt.drop)); err != nil {
+				t.Fatalf("InitMetrics() error = %v", err)
+			}
+			recordBuilds([]string{"deploy", "test"}, []string{"main", "feature/login"})
+
+			families, err := reg.Gather()
+			if err != nil {
+				t.Fatalf("Gather() error = %v", err)
+			}
+			found := 0
+			for _, family := range families {
+				want, ok := tt.want[family.GetName()]
+				if !ok {
+					continue
+				}
+				found++
+				for _, metric := range family.GetMetric() {
+					var got []string
+					for _, pair := range metric.GetLabel() {
+						got = append(got, pair.GetName())
+					}
+					if len(got) != len(want) {
+						t.Errorf("%s labels = %v, want %v", family.GetName(), got, want)
+						break
+					}
+					for _, label := range want {
+						if !slices.Contains(got, label) {
+							t.Errorf("%s labels = %v, want %v", family.GetName(), got, want)
+						}
+					}
+				}
+			}
+			if found != len(tt.want) {
+				t.Errorf("gathered %d build metrics, want %d", found, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestInvalidLabelPolicy(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{name: "drop non-tenant label", opts: []Option{WithDroppedLabels([]string{"state"})}},
+		{name: "drop unknown label from metric", opts: []Option{WithDroppedLabels([]string{"buildkite_builds_total:event_type"})}},
+		{name: "relabel non-tenant label", opts: []Option{WithRelabelRules([]RelabelRule{{Label: "state", Match: "*", Replacement: "x"}})}},
+		{name: "malformed pattern", opts: []Option{WithRelabelRules([]RelabelRule{{Label: "branch", Match: "feature/[", Replacement: "x"}})}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := InitMetrics(prometheus.NewRegistry(), tt.opts...); err == nil {
+				t.Error("InitMetrics() error = nil, want error")
+			}
+		})
+	}
+}
@@ -2,36 +2,144 @@ package metrics
 
 import (
 	"fmt"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 var (
 	// Webhook request metrics
 	WebhookRequestsTotal   *prometheus.CounterVec
 	WebhookRequestDuration *prometheus.HistogramVec
+	WebhookPhaseDuration   *prometheus.HistogramVec
 	AuthFailures           prometheus.Counter
+	SignatureFailuresTotal *prometheus.CounterVec
+	RedeliveriesTotal      *prometheus.CounterVec
+	RequestEncodingsTotal  *prometheus.CounterVec
+	DecompressionRejected  *prometheus.CounterVec
+	WebhookBatchSize       prometheus.Histogram
 	RateLimitExceeded      *prometheus.CounterVec
+	RateLimitRequestsTotal *prometheus.CounterVec
+	RateLimitTokens        *prometheus.GaugeVec
+	AuthBansTotal          prometheus.Counter
+	AuthBanRejections      *prometheus.CounterVec
+	AuthBannedIPs          prometheus.Gauge
 	ErrorsTotal            *prometheus.CounterVec
 
 	// Payload processing metrics
 	PayloadProcessingDuration *prometheus.HistogramVec
 
 	// Pub/Sub metrics
-	PubsubPublishRequestsTotal *prometheus.CounterVec
-	PubsubPublishDuration      prometheus.Histogram
+	PubsubPublishRequestsTotal     *prometheus.CounterVec
+	PubsubPublishDuration          prometheus.Histogram
+	PubsubPublishRetriesTotal      *prometheus.CounterVec
+	PubsubPublishAttempts          *prometheus.HistogramVec
+	PubsubPublishOutcomesTotal     *prometheus.CounterVec
+	PubsubRetryBackoffDuration     *prometheus.HistogramVec
+	PubsubRetriesAvoidedTotal      *prometheus.CounterVec
+	PubsubAttributesSanitizedTotal *prometheus.CounterVec
+	ReceiveToPublishDuration       *prometheus.HistogramVec
+	PublishTimeSkew                *prometheus.HistogramVec
+
+	// Back-pressure metrics
+	PublishQueueDepth           prometheus.Gauge
+	PublishQueueRejectionsTotal prometheus.Counter
+	PublishQueueWaiting         prometheus.Gauge
 
 	// Dead Letter Queue metrics
-	DLQMessagesTotal *prometheus.CounterVec
+	DLQMessagesTotal        *prometheus.CounterVec
+	DLQPublishOutcomesTotal *prometheus.CounterVec
+
+	// Resilience metrics
+	CircuitBreakerState      *prometheus.GaugeVec
+	FailoverActivationsTotal *prometheus.CounterVec
+	FailoverActive           prometheus.Gauge
+
+	// Deduplication metrics
+	DedupeChecksTotal *prometheus.CounterVec
+
+	// Payload schema metrics
+	SchemaDriftTotal         *prometheus.CounterVec
+	UnsupportedEventsTotal   *prometheus.CounterVec
+	FilteredEventsTotal      *prometheus.CounterVec
+	DuplicateTransitions     *prometheus.CounterVec
+	UnblockEventsTotal       *prometheus.CounterVec
+	JobMessagesTotal         *prometheus.CounterVec
+	QuarantinedPayloadsTotal *prometheus.CounterVec
+	TransformWarningsTotal   *prometheus.CounterVec
+
+	// Shadow publish metrics
+	ShadowPublishesTotal   *prometheus.CounterVec
+	ShadowComparisonsTotal *prometheus.CounterVec
+	ShadowDivergencesTotal *prometheus.CounterVec
+
+	// Delivery confirmation metrics
+	DeliveryConfirmationsTotal   *prometheus.CounterVec
+	DeliveryConfirmationDuration *prometheus.HistogramVec
+
+	// Routing metrics
+	RoutedMessagesTotal *prometheus.CounterVec
+
+	// Expression metrics
+	ExpressionEvaluationsTotal   *prometheus.CounterVec
+	ExpressionEvaluationDuration *prometheus.HistogramVec
+
+	// Intake pause metrics
+	WebhookPaused         prometheus.Gauge
+	PausedRejectionsTotal prometheus.Counter
+
+	// Clock metrics
+	ClockOffset prometheus.Gauge
+
+	// Ownership mapping metrics
+	OwnershipReloadsTotal *prometheus.CounterVec
+	OwnershipRules        prometheus.Gauge
+
+	// Heartbeat metrics
+	HeartbeatsTotal        *prometheus.CounterVec
+	HeartbeatLastPublished prometheus.Gauge
+
+	// Subscription backlog metrics
+	SubscriptionLagChecksTotal      *prometheus.CounterVec
+	SubscriptionUndeliveredMessages *prometheus.GaugeVec
+	SubscriptionOldestUnackedAge    *prometheus.GaugeVec
+
+	// Rejected request sampling metrics
+	RejectionSamplesTotal *prometheus.CounterVec
+
+	// Audit index metrics
+	AuditQueueDepth          prometheus.Gauge
+	AuditRecordsDroppedTotal prometheus.Counter
+
+	// Build metrics, labeled by pipeline, branch and team unless dropped
+	BuildsTotal        *prometheus.CounterVec
+	BuildQueueDuration *prometheus.HistogramVec
+	// BuildQueueOutliersTotal counts queue times left out of BuildQueueDuration
+	BuildQueueOutliersTotal *prometheus.CounterVec
+
+	// HTTP server connection metrics
+	HTTPConnections      *prometheus.GaugeVec
+	HTTPConnectionsTotal prometheus.Counter
+
+	// HTTP request metrics, for every route
+	HTTPRequestsInFlight prometheus.Gauge
+	HTTPRequestsTotal    *prometheus.CounterVec
+	HTTPRequestDuration  *prometheus.HistogramVec
+	HTTPRequestSize      *prometheus.HistogramVec
+	HTTPResponseSize     *prometheus.HistogramVec
+
+	// tenantPolicy drops and relabels pipeline, branch and team labels
+	tenantPolicy = &labelPolicy{}
 
 	// Mutex to protect metric initialization
 	initMutex sync.Mutex
 )
 
-// InitMetrics initializes metrics with a specific registry
-func InitMetrics(reg prometheus.Registerer) error {
+// InitMetrics initializes metrics with a specific registry. Calling it again
+// with the same registry reuses the metrics already registered there.
+func InitMetrics(reg prometheus.Registerer, opts ...Option) error {
 	initMutex.Lock()
 	defer initMutex.Unlock()
 
@@ -39,14 +147,14 @@ func InitMetrics(reg prometheus.Registerer) error {
 		return fmt.Errorf("registry cannot be nil")
 	}
 
-	factory := promauto.With(reg)
+	factory := newCollectorFactory(reg, opts...)
 
 	WebhookRequestsTotal = factory.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "buildkite_webhook_requests_total",
 			Help: "Total number of webhook requests received",
 		},
-		[]string{"status", "event_type"},
+		[]string{"status", "event_type", "delivery_mode"},
 	)
 
 	WebhookRequestDuration = factory.NewHistogramVec(
@@ -58,6 +166,16 @@ func InitMetrics(reg prometheus.Registerer) error {
 		[]string{"event_type"},
 	)
 
+	// 100µs to 3.2s in doublings, fine enough for per-phase heatmaps
+	WebhookPhaseDuration = factory.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "buildkite_webhook_phase_duration_seconds",
+			Help:    "Duration of each phase of webhook requests in seconds (auth, read, parse, transform, publish, confirm, respond)",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+		},
+		[]string{"phase"},
+	)
+
 	AuthFailures = factory.NewCounter(
 		prometheus.CounterOpts{
 			Name: "buildkite_webhook_auth_failures_total",
@@ -65,14 +183,92 @@ func InitMetrics(reg prometheus.Registerer) error {
 		},
 	)
 
+	SignatureFailuresTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_webhook_signature_failures_total",
+			Help: "Total number of HMAC signature failures by reason",
+		},
+		[]string{"reason"},
+	)
+
+	RequestEncodingsTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_webhook_request_encodings_total",
+			Help: "Total number of webhook requests by body Content-Encoding: gzip or identity",
+		},
+		[]string{"encoding"},
+	)
+
+	DecompressionRejected = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_webhook_decompression_rejections_total",
+			Help: "Total number of compressed webhook bodies rejected by reason: too_large, malformed or unsupported",
+		},
+		[]string{"reason"},
+	)
+
+	WebhookBatchSize = factory.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "buildkite_webhook_batch_size",
+			Help:    "Number of events in each batch request",
+			Buckets: []float64{1, 2, 5, 10, 20, 50, 100, 200, 500},
+		},
+	)
+
+	RedeliveriesTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_webhook_redeliveries_total",
+			Help: "Total number of webhooks Buildkite delivered more than once",
+		},
+		[]string{"event_type"},
+	)
+
 	RateLimitExceeded = factory.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "buildkite_rate_limit_exceeded_total",
 			Help: "Total number of requests that exceeded rate limits",
 		},
+		[]string{"type", "endpoint"},
+	)
+
+	RateLimitRequestsTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_rate_limit_requests_total",
+			Help: "Total number of rate limit decisions by limiter type and result (allowed, denied, bypassed)",
+		},
+		[]string{"type", "result"},
+	)
+
+	RateLimitTokens = factory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "buildkite_rate_limit_tokens_available",
+			Help: "Tokens available in the rate limiter after the most recent request",
+		},
 		[]string{"type"},
 	)
 
+	AuthBansTotal = factory.NewCounter(
+		prometheus.CounterOpts{
+			Name: "buildkite_auth_bans_total",
+			Help: "Total number of client IPs banned after repeated authentication failures",
+		},
+	)
+
+	AuthBanRejections = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_auth_ban_rejections_total",
+			Help: "Total number of requests rejected because their client IP is banned",
+		},
+		[]string{"endpoint"},
+	)
+
+	AuthBannedIPs = factory.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "buildkite_auth_banned_ips",
+			Help: "Number of client IPs currently banned after repeated authentication failures",
+		},
+	)
+
 	ErrorsTotal = factory.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "buildkite_errors_total",
@@ -106,6 +302,86 @@ func InitMetrics(reg prometheus.Registerer) error {
 		},
 	)
 
+	ReceiveToPublishDuration = factory.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "buildkite_webhook_receive_to_publish_seconds",
+			Help:    "Time from receiving a webhook to publishing it to Pub/Sub in seconds",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"event_type"},
+	)
+
+	PublishQueueDepth = factory.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "buildkite_pubsub_publish_queue_depth",
+			Help: "Number of publishes currently pending",
+		},
+	)
+
+	PublishQueueRejectionsTotal = factory.NewCounter(
+		prometheus.CounterOpts{
+			Name: "buildkite_pubsub_publish_queue_rejections_total",
+			Help: "Total number of publishes rejected because the publish queue was full",
+		},
+	)
+
+	PublishQueueWaiting = factory.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "buildkite_pubsub_publish_queue_waiting",
+			Help: "Number of high-priority publishes waiting for a slot in the full publish queue",
+		},
+	)
+
+	PubsubAttributesSanitizedTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_pubsub_attributes_sanitized_total",
+			Help: "Total number of message attributes truncated, renamed or dropped to fit Pub/Sub limits",
+		},
+		[]string{"attribute", "action"},
+	)
+
+	PubsubPublishRetriesTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_pubsub_publish_retries_total",
+			Help: "Total number of Pub/Sub publish retries",
+		},
+		[]string{"event_type"},
+	)
+
+	PubsubPublishAttempts = factory.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "buildkite_pubsub_publish_attempts",
+			Help:    "Number of attempts each event took to publish or give up",
+			Buckets: prometheus.LinearBuckets(1, 1, 10),
+		},
+		[]string{"event_type"},
+	)
+
+	PubsubPublishOutcomesTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_pubsub_publish_outcomes_total",
+			Help: "Total number of events by the final outcome of publishing them, after any retries",
+		},
+		[]string{"event_type", "outcome"},
+	)
+
+	PubsubRetryBackoffDuration = factory.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "buildkite_pubsub_retry_backoff_seconds",
+			Help:    "Time each retried event spent waiting between publish attempts in seconds",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"event_type"},
+	)
+
+	PubsubRetriesAvoidedTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_pubsub_publish_retries_avoided_total",
+			Help: "Total number of Pub/Sub publish retries skipped because the failure opened the circuit breaker",
+		},
+		[]string{"event_type"},
+	)
+
 	DLQMessagesTotal = factory.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "buildkite_dlq_messages_total",
@@ -114,12 +390,366 @@ func InitMetrics(reg prometheus.Registerer) error {
 		[]string{"event_type", "failure_reason"},
 	)
 
-	return nil
+	DLQPublishOutcomesTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_dlq_publish_outcomes_total",
+			Help: "Total number of failed events by the outcome of sending them to the Dead Letter Queue",
+		},
+		[]string{"event_type", "outcome"},
+	)
+
+	CircuitBreakerState = factory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "buildkite_circuit_breaker_state",
+			Help: "Circuit breaker state (0=closed, 1=open, 2=half-open)",
+		},
+		[]string{"name"},
+	)
+
+	FailoverActivationsTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_pubsub_failover_activations_total",
+			Help: "Total number of switches from the primary to the secondary topic",
+		},
+		[]string{"reason"},
+	)
+
+	FailoverActive = factory.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "buildkite_pubsub_failover_active",
+			Help: "Whether publishing currently goes to the secondary topic (1) or the primary (0)",
+		},
+	)
+
+	DedupeChecksTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_pubsub_dedupe_checks_total",
+			Help: "Total number of publish deduplication checks by result (hit, miss, in_flight, error)",
+		},
+		[]string{"result"},
+	)
+
+	SchemaDriftTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_payload_schema_drift_total",
+			Help: "Total number of payload fields that are unknown or missing compared to the known schema",
+		},
+		[]string{"event_type", "kind", "field"},
+	)
+
+	UnsupportedEventsTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_unsupported_events_total",
+			Help: "Total number of webhook events with an event type the service does not transform",
+		},
+		[]string{"event_type"},
+	)
+
+	FilteredEventsTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_webhook_filtered_events_total",
+			Help: "Total number of webhook events acknowledged without publishing because they did not match the endpoint's filter",
+		},
+		[]string{"event_type"},
+	)
+
+	DuplicateTransitions = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_webhook_duplicate_transitions_total",
+			Help: "Total number of build events acknowledged without publishing because they repeated the build's terminal state",
+		},
+		[]string{"event_type", "state"},
+	)
+
+	UnblockEventsTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_webhook_unblock_events_total",
+			Help: "Total number of build.unblocked events derived when a blocked build ran again, by outcome (published, failed)",
+		},
+		[]string{"outcome"},
+	)
+
+	JobMessagesTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_webhook_job_messages_total",
+			Help: "Total number of build.job messages published for the jobs of finished builds, by outcome (published, failed)",
+		},
+		[]string{"outcome"},
+	)
+
+	QuarantinedPayloadsTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_webhook_quarantined_payloads_total",
+			Help: "Total number of payloads that failed to transform and were quarantined, by event type",
+		},
+		[]string{"event_type"},
+	)
+
+	TransformWarningsTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_transform_warnings_total",
+			Help: "Total number of malformed optional payload sections left out of published events, by section",
+		},
+		[]string{"section"},
+	)
+
+	ShadowPublishesTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_webhook_shadow_publishes_total",
+			Help: "Total number of messages shadow-published with the shadow schema version, by outcome (published, failed, transform_error)",
+		},
+		[]string{"outcome"},
+	)
+
+	ShadowComparisonsTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_webhook_shadow_comparisons_total",
+			Help: "Total number of shadow messages compared with the published message, by event type and result (identical, diverged)",
+		},
+		[]string{"event_type", "result"},
+	)
+
+	ShadowDivergencesTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_webhook_shadow_divergences_total",
+			Help: "Total number of fields differing between shadow and published messages, by field and kind (added, removed, changed)",
+		},
+		[]string{"field", "kind"},
+	)
+
+	DeliveryConfirmationsTotal = factory.NewTenantCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_webhook_delivery_confirmations_total",
+			Help: "Total number of messages of critical pipelines waited on for the consumer's confirmation, by pipeline and outcome (confirmed, timeout, duplicate)",
+		},
+		[]string{"pipeline", "outcome"},
+	)
+
+	DeliveryConfirmationDuration = factory.NewTenantHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "buildkite_webhook_delivery_confirmation_seconds",
+			Help:    "Time from publishing a message of a critical pipeline until the consumer confirmed it, in seconds",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+		},
+		[]string{"pipeline"},
+	)
+
+	RoutedMessagesTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_pubsub_routed_messages_total",
+			Help: "Total number of messages published per route",
+		},
+		[]string{"route", "status"},
+	)
+
+	ExpressionEvaluationsTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_expression_evaluations_total",
+			Help: "Total number of CEL expression evaluations by rule and result",
+		},
+		[]string{"rule", "result"},
+	)
+
+	ExpressionEvaluationDuration = factory.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "buildkite_expression_evaluation_duration_seconds",
+			Help:    "Time spent evaluating CEL expressions in seconds",
+			Buckets: prometheus.ExponentialBuckets(0.000001, 4, 10),
+		},
+		[]string{"rule"},
+	)
+
+	WebhookPaused = factory.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "buildkite_webhook_paused",
+			Help: "Whether webhook intake is paused (1) or accepting (0)",
+		},
+	)
+
+	PausedRejectionsTotal = factory.NewCounter(
+		prometheus.CounterOpts{
+			Name: "buildkite_webhook_paused_rejections_total",
+			Help: "Total number of webhooks rejected with 503 because intake was paused",
+		},
+	)
+
+	ClockOffset = factory.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "buildkite_clock_offset_seconds",
+			Help: "Offset of the local clock from the configured NTP server at startup",
+		},
+	)
+
+	OwnershipReloadsTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_ownership_reloads_total",
+			Help: "Total number of ownership mapping loads by result",
+		},
+		[]string{"result"},
+	)
+
+	OwnershipRules = factory.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "buildkite_ownership_rules",
+			Help: "Number of rules in the loaded ownership mapping",
+		},
+	)
+
+	HeartbeatsTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_heartbeats_total",
+			Help: "Total number of heartbeat events published by status",
+		},
+		[]string{"status"},
+	)
+
+	HeartbeatLastPublished = factory.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "buildkite_heartbeat_last_published_timestamp_seconds",
+			Help: "Unix time of the last heartbeat event published",
+		},
+	)
+
+	SubscriptionLagChecksTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_subscription_lag_checks_total",
+			Help: "Total number of subscription backlog checks by result",
+		},
+		[]string{"result"},
+	)
+
+	SubscriptionUndeliveredMessages = factory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "buildkite_subscription_undelivered_messages",
+			Help: "Messages not yet acknowledged by a monitored subscription's consumers",
+		},
+		[]string{"subscription"},
+	)
+
+	SubscriptionOldestUnackedAge = factory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "buildkite_subscription_oldest_unacked_age_seconds",
+			Help: "Age of the oldest message not yet acknowledged by a monitored subscription's consumers",
+		},
+		[]string{"subscription"},
+	)
+
+	RejectionSamplesTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_rejection_samples_total",
+			Help: "Total number of rejected requests sampled into diagnostics by reason and status",
+		},
+		[]string{"reason", "status"},
+	)
+
+	AuditQueueDepth = factory.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "buildkite_audit_queue_depth",
+			Help: "Number of audit records waiting to be written to the audit index",
+		},
+	)
+
+	AuditRecordsDroppedTotal = factory.NewCounter(
+		prometheus.CounterOpts{
+			Name: "buildkite_audit_records_dropped_total",
+			Help: "Total number of audit records dropped because the audit queue was full",
+		},
+	)
+
+	BuildsTotal = factory.NewTenantCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_builds_total",
+			Help: "Total number of build events by state, pipeline, branch and owning team",
+		},
+		[]string{"state", "pipeline", "branch", "team"},
+	)
+
+	BuildQueueDuration = factory.NewTenantHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "buildkite_build_queue_seconds",
+			Help:    "Time builds waited between being scheduled and starting in seconds, by what triggered them",
+			Buckets: []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600},
+		},
+		[]string{"pipeline", "branch", "team", "source"},
+	)
+
+	BuildQueueOutliersTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_build_queue_outliers_total",
+			Help: "Total number of implausible build queue times left out of the queue time histogram",
+		},
+		[]string{"reason", "source"},
+	)
+
+	HTTPConnections = factory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "buildkite_http_connections",
+			Help: "Number of open HTTP connections by state (new, active, idle)",
+		},
+		[]string{"state"},
+	)
+
+	HTTPConnectionsTotal = factory.NewCounter(
+		prometheus.CounterOpts{
+			Name: "buildkite_http_connections_total",
+			Help: "Total number of HTTP connections accepted",
+		},
+	)
+
+	HTTPRequestsInFlight = factory.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "buildkite_http_requests_in_flight",
+			Help: "Number of HTTP requests being served",
+		},
+	)
+
+	HTTPRequestsTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "buildkite_http_requests_total",
+			Help: "Total number of HTTP requests by route and status class (2xx, 3xx, 4xx, 5xx)",
+		},
+		[]string{"route", "status_class"},
+	)
+
+	HTTPRequestDuration = factory.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "buildkite_http_request_duration_seconds",
+			Help:    "Duration of HTTP requests in seconds by route",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"route"},
+	)
+
+	// 256B to 4MB, covering pings to the largest build payloads
+	sizeBuckets := prometheus.ExponentialBuckets(256, 4, 9)
+	HTTPRequestSize = factory.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "buildkite_http_request_size_bytes",
+			Help:    "Size of HTTP request bodies in bytes by route",
+			Buckets: sizeBuckets,
+		},
+		[]string{"route"},
+	)
+
+	HTTPResponseSize = factory.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "buildkite_http_response_size_bytes",
+			Help:    "Size of HTTP response bodies in bytes by route",
+			Buckets: sizeBuckets,
+		},
+		[]string{"route"},
+	)
+
+	tenantPolicy = factory.policy
+	return factory.err
 }
 
-// RecordMessageSize records the size of a message (kept for handler.go compatibility)
-func RecordMessageSize(eventType string, sizeBytes int) {
-	// No-op: metric removed but function kept for compatibility
+// RecordHTTPRequest records a served HTTP request
+func RecordHTTPRequest(route string, status int, requestSize, responseSize int64, duration time.Duration) {
+	HTTPRequestsTotal.WithLabelValues(route, strconv.Itoa(status/100)+"xx").Inc()
+	HTTPRequestDuration.WithLabelValues(route).Observe(duration.Seconds())
+	HTTPRequestSize.WithLabelValues(route).Observe(float64(requestSize))
+	HTTPResponseSize.WithLabelValues(route).Observe(float64(responseSize))
 }
 
 // RecordPubsubMessageSize records the size of a published Pub/Sub message
@@ -132,11 +762,80 @@ func RecordDLQMessage(eventType, failureReason string) {
 	DLQMessagesTotal.WithLabelValues(eventType, failureReason).Inc()
 }
 
-// RecordBuildStatus is a no-op (metric removed)
-func RecordBuildStatus(status, pipeline string) {}
+// RecordRateLimit records a request rejected by a rate limiter
+func RecordRateLimit(limiterType, endpoint string) {
+	RateLimitExceeded.WithLabelValues(limiterType, endpoint).Inc()
+}
+
+// RecordAuthBan records a client IP banned after repeated auth failures
+func RecordAuthBan() {
+	AuthBansTotal.Inc()
+}
+
+// RecordAuthBanRejection records a request rejected because its client IP
+// is banned
+func RecordAuthBanRejection(endpoint string) {
+	AuthBanRejections.WithLabelValues(endpoint).Inc()
+}
+
+// RecordRateLimitDecision records whether a rate limiter allowed a request
+// and the tokens it has left
+func RecordRateLimitDecision(limiterType string, allowed bool, tokens float64) {
+	result := "allowed"
+	if !allowed {
+		result = "denied"
+	}
+	RateLimitRequestsTotal.WithLabelValues(limiterType, result).Inc()
+	RateLimitTokens.WithLabelValues(limiterType).Set(tokens)
+}
+
+// RecordRateLimitBypass records a request that skipped a rate limiter
+// because its client is on the bypass list
+func RecordRateLimitBypass(limiterType string) {
+	RateLimitRequestsTotal.WithLabelValues(limiterType, "bypassed").Inc()
+}
+
+// RecordBuildStatus records a build event in state
+func RecordBuildStatus(state, pipeline, branch, team string) {
+	BuildsTotal.With(tenantPolicy.labels("buildkite_builds_total", prometheus.Labels{
+		"state":    state,
+		"pipeline": pipeline,
+		"branch":   branch,
+		"team":     team,
+	})).Inc()
+}
+
+// RecordDeliveryConfirmation records the outcome of waiting for the
+// consumer to confirm a message of a critical pipeline
+func RecordDeliveryConfirmation(pipeline, outcome string) {
+	DeliveryConfirmationsTotal.With(tenantPolicy.labels("buildkite_webhook_delivery_confirmations_total", prometheus.Labels{
+		"pipeline": pipeline,
+		"outcome":  outcome,
+	})).Inc()
+}
+
+// RecordDeliveryConfirmationTime records how long the consumer took to
+// confirm a message of a critical pipeline
+func RecordDeliveryConfirmationTime(pipeline string, seconds float64) {
+	DeliveryConfirmationDuration.With(tenantPolicy.labels("buildkite_webhook_delivery_confirmation_seconds", prometheus.Labels{
+		"pipeline": pipeline,
+	})).Observe(seconds)
+}
 
 // RecordPipelineBuild is a no-op (metric removed)
 func RecordPipelineBuild(pipeline, organization string) {}
 
-// RecordQueueTime is a no-op (metric removed)
-func RecordQueueTime(pipeline string, queueSeconds float64) {}
+// RecordQueueTime records how long a build triggered by source waited to start
+func RecordQueueTime(pipeline, branch, team, source string, queueSeconds float64) {
+	BuildQueueDuration.With(tenantPolicy.labels("buildkite_build_queue_seconds", prometheus.Labels{
+		"pipeline": pipeline,
+		"branch":   branch,
+		"team":     team,
+		"source":   source,
+	})).Observe(queueSeconds)
+}
+
+// RecordQueueTimeOutlier records a queue time too implausible to record
+func RecordQueueTimeOutlier(reason, source string) {
+	BuildQueueOutliersTotal.WithLabelValues(reason, source).Inc()
+}
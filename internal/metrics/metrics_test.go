@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -49,6 +50,87 @@ func TestRecordDLQMessage(t *testing.T) {
 	}
 }
 
+func TestInitMetricsIsIdempotent(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	if err := InitMetrics(reg); err != nil {
+		t.Fatalf("first InitMetrics() error = %v", err)
+	}
+	AuthFailures.Inc()
+
+	if err := InitMetrics(reg); err != nil {
+		t.Fatalf("second InitMetrics() error = %v", err)
+	}
+	if got := getCounterValue(t, AuthFailures); got != 1 {
+		t.Errorf("AuthFailures after re-init = %v, want 1 (existing metric reused)", got)
+	}
+
+	// Unregistering starts the metrics from zero on the next init
+	Unregister(reg)
+	if err := InitMetrics(reg); err != nil {
+		t.Fatalf("InitMetrics() after Unregister error = %v", err)
+	}
+	if got := getCounterValue(t, AuthFailures); got != 0 {
+		t.Errorf("AuthFailures after Unregister = %v, want 0", got)
+	}
+}
+
+func TestInitMetricsWithPrefix(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	if err := InitMetrics(reg, WithPrefix("mycorp")); err != nil {
+		t.Fatalf("InitMetrics() error = %v", err)
+	}
+	AuthFailures.Inc()
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+	var found bool
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), "mycorp_buildkite_") {
+			t.Errorf("metric %q is missing the prefix", family.GetName())
+		}
+		if family.GetName() == "mycorp_buildkite_webhook_auth_failures_total" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("mycorp_buildkite_webhook_auth_failures_total not gathered")
+	}
+}
+
+func TestInitMetricsNamespaceAndConstLabels(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	err := InitMetrics(reg,
+		WithNamespace("ci"),
+		WithSubsystem("staging"),
+		WithConstLabels(map[string]string{"environment": "staging", "region": "us-east1"}),
+	)
+	if err != nil {
+		t.Fatalf("InitMetrics() error = %v", err)
+	}
+	AuthFailures.Inc()
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "ci_staging_webhook_auth_failures_total" {
+			continue
+		}
+		labels := map[string]string{}
+		for _, pair := range family.GetMetric()[0].GetLabel() {
+			labels[pair.GetName()] = pair.GetValue()
+		}
+		if labels["environment"] != "staging" || labels["region"] != "us-east1" {
+			t.Errorf("labels = %v, want environment and region", labels)
+		}
+		return
+	}
+	t.Error("ci_staging_webhook_auth_failures_total not gathered")
+}
+
 func getCounterValue(t *testing.T, c prometheus.Counter) float64 {
 	t.Helper()
 	var metric dto.Metric
@@ -0,0 +1,188 @@
+package metrics
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// registered tracks the collectors InitMetrics registered with each registry
+// so Unregister can remove them
+var registered = make(map[prometheus.Registerer][]prometheus.Collector)
+
+// defaultNamespace is the namespace every metric is declared with
+const defaultNamespace = "buildkite"
+
+// Option customizes InitMetrics
+type Option func(*options)
+
+type options struct {
+	prefix       string
+	namespace    string
+	subsystem    string
+	constLabels  prometheus.Labels
+	dropLabels   []string
+	relabelRules []RelabelRule
+}
+
+// WithPrefix prepends prefix and an underscore to every metric name, e.g.
+// "mycorp" exports mycorp_buildkite_webhook_requests_total, so embedders
+// can keep these metrics apart from their own
+func WithPrefix(prefix string) Option {
+	return func(o *options) {
+		o.prefix = prefix
+	}
+}
+
+// WithNamespace replaces the "buildkite" namespace, so "ci" exports
+// ci_webhook_requests_total; empty keeps the default
+func WithNamespace(namespace string) Option {
+	return func(o *options) {
+		o.namespace = namespace
+	}
+}
+
+// WithSubsystem inserts a subsystem after the namespace, so "staging"
+// exports buildkite_staging_webhook_requests_total
+func WithSubsystem(subsystem string) Option {
+	return func(o *options) {
+		o.subsystem = subsystem
+	}
+}
+
+// WithConstLabels adds labels with fixed values, such as environment or
+// region, to every metric
+func WithConstLabels(labels map[string]string) Option {
+	return func(o *options) {
+		if len(labels) > 0 {
+			o.constLabels = prometheus.Labels(labels)
+		}
+	}
+}
+
+// collectorFactory creates collectors and registers them with a registry.
+// Unlike promauto, a collector already registered with the registry is
+// reused rather than causing a panic, so InitMetrics is idempotent.
+type collectorFactory struct {
+	reg    prometheus.Registerer
+	opts   options
+	policy *labelPolicy
+	// err is the first registration error
+	err error
+}
+
+func newCollectorFactory(reg prometheus.Registerer, opts ...Option) *collectorFactory {
+	f := &collectorFactory{reg: reg}
+	for _, opt := range opts {
+		opt(&f.opts)
+	}
+	f.policy, f.err = newLabelPolicy(f.opts.dropLabels, f.opts.relabelRules)
+	if f.err != nil {
+		f.policy = &labelPolicy{}
+	}
+	return f
+}
+
+// name builds the exported name from a metric declared in the default
+// namespace, applying the prefix, namespace and subsystem
+func (f *collectorFactory) name(name string) string {
+	namespace := f.opts.namespace
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+
+	var parts []string
+	for _, part := range []string{f.opts.prefix, namespace, f.opts.subsystem, strings.TrimPrefix(name, defaultNamespace+"_")} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "_")
+}
+
+// register registers c, returning the existing collector when an identical
+// one is already registered
+func register[T prometheus.Collector](f *collectorFactory, c T) T {
+	if err := f.reg.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			if existing, ok := are.ExistingCollector.(T); ok {
+				return existing
+			}
+		}
+		if f.err == nil {
+			f.err = err
+		}
+		return c
+	}
+	registered[f.reg] = append(registered[f.reg], c)
+	return c
+}
+
+// NewCounter creates and registers a counter
+func (f *collectorFactory) NewCounter(opts prometheus.CounterOpts) prometheus.Counter {
+	opts.Name = f.name(opts.Name)
+	opts.ConstLabels = f.opts.constLabels
+	return register(f, prometheus.NewCounter(opts))
+}
+
+// NewCounterVec creates and registers a counter vector
+func (f *collectorFactory) NewCounterVec(opts prometheus.CounterOpts, labelNames []string) *prometheus.CounterVec {
+	opts.Name = f.name(opts.Name)
+	opts.ConstLabels = f.opts.constLabels
+	return register(f, prometheus.NewCounterVec(opts, labelNames))
+}
+
+// NewTenantCounterVec creates and registers a counter vector whose tenant
+// labels follow the label policy; record to it with tenantPolicy.labels
+func (f *collectorFactory) NewTenantCounterVec(opts prometheus.CounterOpts, labelNames []string) *prometheus.CounterVec {
+	return f.NewCounterVec(opts, f.policy.labelNames(opts.Name, labelNames))
+}
+
+// NewGauge creates and registers a gauge
+func (f *collectorFactory) NewGauge(opts prometheus.GaugeOpts) prometheus.Gauge {
+	opts.Name = f.name(opts.Name)
+	opts.ConstLabels = f.opts.constLabels
+	return register(f, prometheus.NewGauge(opts))
+}
+
+// NewGaugeVec creates and registers a gauge vector
+func (f *collectorFactory) NewGaugeVec(opts prometheus.GaugeOpts, labelNames []string) *prometheus.GaugeVec {
+	opts.Name = f.name(opts.Name)
+	opts.ConstLabels = f.opts.constLabels
+	return register(f, prometheus.NewGaugeVec(opts, labelNames))
+}
+
+// NewHistogram creates and registers a histogram
+func (f *collectorFactory) NewHistogram(opts prometheus.HistogramOpts) prometheus.Histogram {
+	opts.Name = f.name(opts.Name)
+	opts.ConstLabels = f.opts.constLabels
+	return register(f, prometheus.NewHistogram(opts))
+}
+
+// NewHistogramVec creates and registers a histogram vector
+func (f *collectorFactory) NewHistogramVec(opts prometheus.HistogramOpts, labelNames []string) *prometheus.HistogramVec {
+	opts.Name = f.name(opts.Name)
+	opts.ConstLabels = f.opts.constLabels
+	return register(f, prometheus.NewHistogramVec(opts, labelNames))
+}
+
+// NewTenantHistogramVec creates and registers a histogram vector whose
+// tenant labels follow the label policy; record to it with tenantPolicy.labels
+func (f *collectorFactory) NewTenantHistogramVec(opts prometheus.HistogramOpts, labelNames []string) *prometheus.HistogramVec {
+	return f.NewHistogramVec(opts, f.policy.labelNames(opts.Name, labelNames))
+}
+
+// Unregister removes the metrics InitMetrics registered with reg, so the
+// next InitMetrics call with reg starts every metric from zero. It is mainly
+// useful in tests sharing prometheus.DefaultRegisterer.
+func Unregister(reg prometheus.Registerer) {
+	initMutex.Lock()
+	defer initMutex.Unlock()
+
+	for _, c := range registered[reg] {
+		reg.Unregister(c)
+	}
+	delete(registered, reg)
+}
@@ -0,0 +1,169 @@
+// Package compress gzips responses for clients that accept it, for large
+// read-only endpoints such as /metrics, /stats and the admin listings.
+package compress
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MinSize is the smallest response worth compressing; smaller ones are sent
+// as they are
+const MinSize = 1024
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		zw, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return zw
+	},
+}
+
+// Gzip compresses responses of at least MinSize bytes when the request's
+// Accept-Encoding allows gzip. Responses that already set a Content-Encoding,
+// such as from promhttp, are left alone.
+func Gzip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !AcceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// AcceptsGzip reports whether an Accept-Encoding header value allows gzip,
+// explicitly or through *, without a zero q-value
+func AcceptsGzip(header string) bool {
+	accepted := false
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "x-gzip" && coding != "*" {
+			continue
+		}
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		// An explicit gzip entry overrides the wildcard
+		if coding != "*" {
+			return q > 0
+		}
+		accepted = q > 0
+	}
+	return accepted
+}
+
+// responseWriter buffers the first MinSize bytes of a response to decide
+// whether to compress it
+type responseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	// decided is set once the response is known to be compressed or not
+	decided bool
+	buf     []byte
+	zw      *gzip.Writer
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.status, w.wroteHeader = status, true
+	// Bodiless and already encoded responses pass straight through
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified ||
+		w.Header().Get("Content-Encoding") != "" {
+		w.decide(false)
+	}
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < MinSize {
+			return len(b), nil
+		}
+		buffered := w.buf
+		w.buf = nil
+		if err := w.start(buffered); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.zw != nil {
+		return w.zw.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// start begins a response large enough to compress with buffered
+func (w *responseWriter) start(buffered []byte) error {
+	w.decide(true)
+	_, err := w.zw.Write(buffered)
+	return err
+}
+
+// decide sends the headers, compressing the rest of the response if
+// compress is set
+func (w *responseWriter) decide(compress bool) {
+	w.decided = true
+	if compress {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Del("Content-Length")
+		w.zw = gzipWriters.Get().(*gzip.Writer)
+		w.zw.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+// close sends a buffered response too small to compress, or finishes the
+// compressed stream
+func (w *responseWriter) close() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.decide(false)
+		_, _ = w.ResponseWriter.Write(w.buf)
+		return
+	}
+	if w.zw != nil {
+		_ = w.zw.Close()
+		gzipWriters.Put(w.zw)
+		w.zw = nil
+	}
+}
+
+// Flush sends what has been written so far, committing to compression if
+// the response is not decided yet
+func (w *responseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		buffered := w.buf
+		w.buf = nil
+		_ = w.start(buffered)
+	}
+	if w.zw != nil {
+		_ = w.zw.Flush()
+	}
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,169 @@
+package compress
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGzip(t *testing.T) {
+	large := strings.Repeat("buildkite_webhook_requests_total 1\n", 100)
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		method         string
+		handler        http.HandlerFunc
+		wantGzip       bool
+		wantStatus     int
+		wantBody       string
+	}{
+		{
+			name:           "large response is compressed",
+			acceptEncoding: "gzip, deflate, br",
+			handler:        func(w http.ResponseWriter, r *http.Request) { _, _ = io.WriteString(w, large) },
+			wantGzip:       true,
+			wantStatus:     http.StatusOK,
+			wantBody:       large,
+		},
+		{
+			name:           "large response written in pieces is compressed",
+			acceptEncoding: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusCreated)
+				for _, line := range strings.SplitAfter(large, "\n") {
+					_, _ = io.WriteString(w, line)
+				}
+			},
+			wantGzip:   true,
+			wantStatus: http.StatusCreated,
+			wantBody:   large,
+		},
+		{
+			name:           "small response is sent plain",
+			acceptEncoding: "gzip",
+			handler:        func(w http.ResponseWriter, r *http.Request) { _, _ = io.WriteString(w, `{"status":"ok"}`) },
+			wantStatus:     http.StatusOK,
+			wantBody:       `{"status":"ok"}`,
+		},
+		{
+			name:       "no Accept-Encoding",
+			handler:    func(w http.ResponseWriter, r *http.Request) { _, _ = io.WriteString(w, large) },
+			wantStatus: http.StatusOK,
+			wantBody:   large,
+		},
+		{
+			name:           "gzip refused",
+			acceptEncoding: "gzip;q=0, *",
+			handler:        func(w http.ResponseWriter, r *http.Request) { _, _ = io.WriteString(w, large) },
+			wantStatus:     http.StatusOK,
+			wantBody:       large,
+		},
+		{
+			name:           "wildcard",
+			acceptEncoding: "*",
+			handler:        func(w http.ResponseWriter, r *http.Request) { _, _ = io.WriteString(w, large) },
+			wantGzip:       true,
+			wantStatus:     http.StatusOK,
+			wantBody:       large,
+		},
+		{
+			name:           "already encoded response passes through",
+			acceptEncoding: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", "zstd")
+				_, _ = io.WriteString(w, large)
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   large,
+		},
+		{
+			name:           "no content",
+			acceptEncoding: "gzip",
+			handler:        func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) },
+			wantStatus:     http.StatusNoContent,
+		},
+		{
+			name:           "HEAD request",
+			acceptEncoding: "gzip",
+			method:         http.MethodHead,
+			handler:        func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) },
+			wantStatus:     http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, "/metrics", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+			Gzip(tt.handler).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", got)
+			}
+			body := rec.Body.String()
+			if tt.wantGzip {
+				if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+					t.Fatalf("Content-Encoding = %q, want gzip", got)
+				}
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatalf("response is not gzip: %v", err)
+				}
+				decoded, err := io.ReadAll(zr)
+				if err != nil {
+					t.Fatalf("failed to decompress response: %v", err)
+				}
+				if len(decoded) <= rec.Body.Len() {
+					t.Errorf("compressed size %d is not smaller than %d", rec.Body.Len(), len(decoded))
+				}
+				body = string(decoded)
+			} else if got := rec.Header().Get("Content-Encoding"); got == "gzip" {
+				t.Errorf("Content-Encoding = gzip, want the response sent as written")
+			}
+			if body != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"GZIP", true},
+		{"x-gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"gzip;q=0.0", false},
+		{"*", true},
+		{"*;q=0", false},
+		{"*;q=0, gzip", true},
+		{"gzip;q=0, *", false},
+		{"br, zstd", false},
+		{"identity", false},
+	}
+
+	for _, tt := range tests {
+		if got := AcceptsGzip(tt.header); got != tt.want {
+			t.Errorf("AcceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
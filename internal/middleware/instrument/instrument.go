@@ -0,0 +1,78 @@
+// Package instrument records the same HTTP metrics for every route: requests
+// in flight, requests by status class, and request duration and sizes.
+package instrument
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+)
+
+// UnmatchedRoute labels requests that no route matched
+const UnmatchedRoute = "unmatched"
+
+// Middleware records HTTP metrics for each request. It wraps a ServeMux,
+// whose matched pattern labels the route, keeping the label's values to the
+// routes served.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		metrics.HTTPRequestsInFlight.Inc()
+		defer metrics.HTTPRequestsInFlight.Dec()
+
+		body := &countingBody{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+		rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r)
+
+		route := r.Pattern
+		if route == "" {
+			route = UnmatchedRoute
+		}
+		// A request rejected before its body is read counts its declared size
+		metrics.RecordHTTPRequest(route, rw.status, max(body.n, r.ContentLength, 0), rw.size, time.Since(start))
+	})
+}
+
+// countingBody counts the bytes read from a request body
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// responseWriter records the response status and size
+type responseWriter struct {
+	http.ResponseWriter
+	status      int
+	size        int64
+	wroteHeader bool
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
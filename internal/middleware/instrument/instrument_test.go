@@ -0,0 +1,83 @@
+package instrument
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestMiddleware(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webhook", func(w http.ResponseWriter, r *http.Request) {
+		if got := testutil.ToFloat64(metrics.HTTPRequestsInFlight); got != 1 {
+			t.Errorf("in flight while serving = %v, want 1", got)
+		}
+		body, _ := io.ReadAll(r.Body)
+		if string(body) == "reject" {
+			http.Error(w, "rejected", http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":"success"}`))
+	})
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handler := Middleware(mux)
+
+	serve := func(method, path, body string) {
+		t.Helper()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, path, strings.NewReader(body)))
+	}
+	serve(http.MethodPost, "/webhook", `{"event":"build.finished"}`)
+	serve(http.MethodPost, "/webhook", "reject")
+	serve(http.MethodGet, "/health", "")
+	serve(http.MethodGet, "/missing", "")
+
+	for _, tt := range []struct {
+		route, class string
+		want         float64
+	}{
+		{"/webhook", "2xx", 1},
+		{"/webhook", "4xx", 1},
+		{"/health", "2xx", 1},
+		{UnmatchedRoute, "4xx", 1},
+	} {
+		if got := testutil.ToFloat64(metrics.HTTPRequestsTotal.WithLabelValues(tt.route, tt.class)); got != tt.want {
+			t.Errorf("requests{%s, %s} = %v, want %v", tt.route, tt.class, got, tt.want)
+		}
+	}
+	if got := testutil.ToFloat64(metrics.HTTPRequestsInFlight); got != 0 {
+		t.Errorf("in flight after serving = %v, want 0", got)
+	}
+
+	// The two webhook requests sent 26 and 6 bytes and got 20 and 9 back
+	requestSize := histogram(t, metrics.HTTPRequestSize, "/webhook")
+	responseSize := histogram(t, metrics.HTTPResponseSize, "/webhook")
+	if requestSize.GetSampleCount() != 2 || requestSize.GetSampleSum() != 32 {
+		t.Errorf("request size = %d samples summing to %v, want 2 summing to 32", requestSize.GetSampleCount(), requestSize.GetSampleSum())
+	}
+	if responseSize.GetSampleCount() != 2 || responseSize.GetSampleSum() != 29 {
+		t.Errorf("response size = %d samples summing to %v, want 2 summing to 29", responseSize.GetSampleCount(), responseSize.GetSampleSum())
+	}
+}
+
+// histogram returns the histogram of a route
+func histogram(t *testing.T, vec *prometheus.HistogramVec, route string) *dto.Histogram {
+	t.Helper()
+	var m dto.Metric
+	if err := vec.WithLabelValues(route).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatalf("failed to read histogram: %v", err)
+	}
+	return m.GetHistogram()
+}
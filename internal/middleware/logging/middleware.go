@@ -1,12 +1,19 @@
 package logging
 
 import (
+	"encoding/binary"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/mcncl/buildkite-pubsub/internal/buildkite"
 	"github.com/mcncl/buildkite-pubsub/internal/logging"
 	"github.com/mcncl/buildkite-pubsub/internal/middleware/request"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // WithStructuredLogging adds structured logging to the request/response cycle
@@ -26,23 +33,85 @@ func WithStructuredLogging(logger *slog.Logger) func(http.Handler) http.Handler
 				}
 			}
 
-			logger.Info("Request started",
+			// Correlation fields shared by both log records
+			reqLogger := logger.With("request_id", requestID)
+			if deliveryID := r.Header.Get(buildkite.DeliveryIDHeader); deliveryID != "" {
+				reqLogger = reqLogger.With("delivery_id", deliveryID)
+			}
+			if sc := spanContext(r); sc.IsValid() {
+				reqLogger = reqLogger.With("trace_id", sc.TraceID().String(), "span_id", sc.SpanID().String(), "trace_sampled", sc.IsSampled())
+			}
+
+			reqLogger.Info("Request started",
 				"method", r.Method,
 				"path", r.URL.Path,
 				"remote_addr", r.RemoteAddr,
-				"request_id", requestID,
 			)
 
-			next.ServeHTTP(lrw, r.WithContext(r.Context()))
+			// The timeout middleware runs later in the chain and records
+			// the processing budget it applied
+			ctx, timeout := request.RecordTimeout(r.Context())
+			next.ServeHTTP(lrw, r.WithContext(ctx))
 
-			logger.Info("Request completed",
+			duration := time.Since(start)
+			attrs := []any{
 				"method", r.Method,
 				"path", r.URL.Path,
-				"request_id", requestID,
 				"status", lrw.StatusCode(),
-				"duration_ms", time.Since(start).Milliseconds(),
+				"duration_ms", duration.Milliseconds(),
 				"size", lrw.Size(),
-			)
+			}
+			if budget, source := timeout(); budget > 0 {
+				attrs = append(attrs, "timeout_ms", budget.Milliseconds(), "timeout_source", source)
+			}
+			// A publish that succeeded only after retries
+			if attempts, err := strconv.Atoi(lrw.Header().Get(webhook.PublishAttemptsHeader)); err == nil {
+				latency, _ := strconv.ParseInt(lrw.Header().Get(webhook.RetryLatencyHeader), 10, 64)
+				attrs = append(attrs, "publish_attempts", attempts, "retry_latency_ms", latency)
+			}
+			if publishTime := lrw.Header().Get(webhook.PublishTimeHeader); publishTime != "" {
+				attrs = append(attrs, "publish_time", publishTime)
+			}
+			attrs = append(attrs, logging.HTTPRequestKey, logging.NewHTTPRequest(r, lrw.StatusCode(), lrw.Size(), duration))
+			reqLogger.Info("Request completed", attrs...)
 		})
 	}
 }
+
+// cloudTraceHeader is the trace header Google Cloud load balancers and
+// Cloud Run add to requests: TRACE_ID/SPAN_ID;o=OPTIONS
+const cloudTraceHeader = "X-Cloud-Trace-Context"
+
+// spanContext returns the active span context, falling back to an inbound
+// W3C traceparent header and then X-Cloud-Trace-Context when tracing
+// middleware has not started a span
+func spanContext(r *http.Request) trace.SpanContext {
+	if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+		return sc
+	}
+	ctx := propagation.TraceContext{}.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		return sc
+	}
+	return parseCloudTraceContext(r.Header.Get(cloudTraceHeader))
+}
+
+// parseCloudTraceContext parses an X-Cloud-Trace-Context header, whose span
+// ID is decimal and whose o=1 option marks the trace as sampled
+func parseCloudTraceContext(header string) trace.SpanContext {
+	traceValue, options, _ := strings.Cut(header, ";")
+	traceHex, spanDec, _ := strings.Cut(traceValue, "/")
+
+	traceID, err := trace.TraceIDFromHex(traceHex)
+	if err != nil {
+		return trace.SpanContext{}
+	}
+	cfg := trace.SpanContextConfig{TraceID: traceID, Remote: true}
+	if span, err := strconv.ParseUint(spanDec, 10, 64); err == nil {
+		binary.BigEndian.PutUint64(cfg.SpanID[:], span)
+	}
+	if options == "o=1" {
+		cfg.TraceFlags = trace.FlagsSampled
+	}
+	return trace.NewSpanContext(cfg)
+}
@@ -0,0 +1,152 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/internal/logging"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook"
+)
+
+func TestParseCloudTraceContext(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      string
+		wantValid   bool
+		wantTrace   string
+		wantSpan    string
+		wantSampled bool
+	}{
+		{
+			name:        "sampled",
+			header:      "105445aa7843bc8bf206b12000100000/1;o=1",
+			wantValid:   true,
+			wantTrace:   "105445aa7843bc8bf206b12000100000",
+			wantSpan:    "0000000000000001",
+			wantSampled: true,
+		},
+		{
+			name:      "not sampled",
+			header:    "105445aa7843bc8bf206b12000100000/12345678901234567890;o=0",
+			wantValid: true,
+			wantTrace: "105445aa7843bc8bf206b12000100000",
+			wantSpan:  "ab54a98ceb1f0ad2",
+		},
+		{name: "missing", header: ""},
+		{name: "invalid trace", header: "not-a-trace/1;o=1"},
+		{name: "missing span", header: "105445aa7843bc8bf206b12000100000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := parseCloudTraceContext(tt.header)
+			if sc.IsValid() != tt.wantValid {
+				t.Fatalf("IsValid() = %v, want %v", sc.IsValid(), tt.wantValid)
+			}
+			if !tt.wantValid {
+				return
+			}
+			if sc.TraceID().String() != tt.wantTrace || sc.SpanID().String() != tt.wantSpan || sc.IsSampled() != tt.wantSampled {
+				t.Errorf("span context = %s/%s sampled=%v, want %s/%s sampled=%v",
+					sc.TraceID(), sc.SpanID(), sc.IsSampled(), tt.wantTrace, tt.wantSpan, tt.wantSampled)
+			}
+		})
+	}
+}
+
+func TestWithStructuredLoggingGCP(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(logging.NewGCPHandler(&buf, slog.LevelInfo, "my-project"))
+	handler := WithStructuredLogging(logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+	req.Header.Set(cloudTraceHeader, "105445aa7843bc8bf206b12000100000/1;o=1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("logged %d entries, want 2:\n%s", len(lines), buf.String())
+	}
+	var completed map[string]interface{}
+	if err := json.Unmarshal(lines[1], &completed); err != nil {
+		t.Fatalf("invalid JSON %q: %v", lines[1], err)
+	}
+
+	want := map[string]interface{}{
+		"severity":              "INFO",
+		"message":               "Request completed",
+		logging.TraceKey:        "projects/my-project/traces/105445aa7843bc8bf206b12000100000",
+		logging.SpanIDKey:       "0000000000000001",
+		logging.TraceSampledKey: true,
+	}
+	for key, value := range want {
+		if completed[key] != value {
+			t.Errorf("%s = %v, want %v", key, completed[key], value)
+		}
+	}
+	httpReq, ok := completed[logging.HTTPRequestKey].(map[string]interface{})
+	if !ok {
+		t.Fatalf("no %s block in %s", logging.HTTPRequestKey, lines[1])
+	}
+	if httpReq["requestMethod"] != "POST" || httpReq["status"] != float64(http.StatusAccepted) {
+		t.Errorf("%s = %v, want POST with status 202", logging.HTTPRequestKey, httpReq)
+	}
+}
+
+func TestWithStructuredLoggingPublishRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		headers      map[string]string
+		wantAttempts interface{}
+		wantLatency  interface{}
+		wantTime     interface{}
+	}{
+		{
+			name: "publish after retries",
+			headers: map[string]string{
+				webhook.PublishAttemptsHeader: "3",
+				webhook.RetryLatencyHeader:    "1500",
+				webhook.PublishTimeHeader:     "2026-01-02T03:04:05.5Z",
+			},
+			// JSON numbers decode as float64
+			wantAttempts: float64(3),
+			wantLatency:  float64(1500),
+			wantTime:     "2026-01-02T03:04:05.5Z",
+		},
+		{name: "first attempt", headers: map[string]string{webhook.PublishTimeHeader: "2026-01-02T03:04:05Z"}, wantTime: "2026-01-02T03:04:05Z"},
+		{name: "not published"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&buf, nil))
+			handler := WithStructuredLogging(logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for name, value := range tt.headers {
+					w.Header().Set(name, value)
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/webhook", nil))
+
+			lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+			var completed map[string]interface{}
+			if err := json.Unmarshal(lines[len(lines)-1], &completed); err != nil {
+				t.Fatalf("invalid JSON %q: %v", lines[len(lines)-1], err)
+			}
+			if completed["publish_attempts"] != tt.wantAttempts || completed["retry_latency_ms"] != tt.wantLatency {
+				t.Errorf("publish_attempts = %v, retry_latency_ms = %v, want %v and %v",
+					completed["publish_attempts"], completed["retry_latency_ms"], tt.wantAttempts, tt.wantLatency)
+			}
+			if completed["publish_time"] != tt.wantTime {
+				t.Errorf("publish_time = %v, want %v", completed["publish_time"], tt.wantTime)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+// Package middleware assembles the webhook middleware chain from named
+// middleware in a configurable, validated order. The middleware itself lives
+// in the logging, request and security subpackages.
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Middleware names, as used in configuration
+const (
+	ProxyHeaders = "proxy_headers"
+	Tracing      = "tracing"
+	RequestID    = "request_id"
+	Logging      = "logging"
+	CORS         = "cors"
+	Recorder     = "recorder"
+	Pause        = "pause"
+	AuthBan      = "auth_ban"
+	RateLimit    = "rate_limit"
+	Timeout      = "timeout"
+)
+
+// DefaultOrder is the chain used when no order is configured, outermost first
+var DefaultOrder = []string{ProxyHeaders, Tracing, RequestID, Logging, CORS, Recorder, Pause, AuthBan, RateLimit, Timeout}
+
+// mustPrecede lists middleware that must run before others because the later
+// one reads what the earlier one sets
+var mustPrecede = []struct {
+	before, after, reason string
+}{
+	{ProxyHeaders, Logging, "logs show the client address"},
+	{ProxyHeaders, RateLimit, "the per-IP limiter sees the client address"},
+	{RequestID, Logging, "logs include the request ID"},
+	{Tracing, Logging, "logs include the trace ID"},
+	{RequestID, Recorder, "recordings include the request ID"},
+	{ProxyHeaders, AuthBan, "bans apply to the client address"},
+	{CORS, Pause, "browsers can read its rejections"},
+	{CORS, AuthBan, "browsers can read its rejections"},
+	{CORS, RateLimit, "browsers can read its rejections"},
+}
+
+// Builder assembles a middleware chain from the middleware registered with it
+type Builder struct {
+	registered map[string]func(http.Handler) http.Handler
+}
+
+// NewBuilder creates a builder with no middleware registered
+func NewBuilder() *Builder {
+	return &Builder{registered: make(map[string]func(http.Handler) http.Handler)}
+}
+
+// Register makes mw available under name, which must be one of the names in
+// DefaultOrder. Middleware that is not registered, such as tracing when no
+// collector is configured, is skipped when the chain is built.
+func (b *Builder) Register(name string, mw func(http.Handler) http.Handler) {
+	b.registered[name] = mw
+}
+
+// Build returns the registered middleware in order, outermost first. An
+// empty order uses DefaultOrder; middleware left out of order is disabled.
+func (b *Builder) Build(order []string) ([]func(http.Handler) http.Handler, error) {
+	if len(order) == 0 {
+		order = DefaultOrder
+	}
+	if err := ValidateOrder(order); err != nil {
+		return nil, err
+	}
+	for name := range b.registered {
+		if !slices.Contains(DefaultOrder, name) {
+			return nil, fmt.Errorf("middleware %q is not a known middleware", name)
+		}
+	}
+
+	chain := make([]func(http.Handler) http.Handler, 0, len(order))
+	for _, name := range order {
+		if mw, ok := b.registered[name]; ok {
+			chain = append(chain, mw)
+		}
+	}
+	return chain, nil
+}
+
+// ValidateOrder checks that order names only known middleware, each at most
+// once, and that middleware depending on another comes after it
+func ValidateOrder(order []string) error {
+	for i, name := range order {
+		if !slices.Contains(DefaultOrder, name) {
+			return fmt.Errorf("unknown middleware %q: must be one of %s", name, strings.Join(DefaultOrder, ", "))
+		}
+		if slices.Contains(order[:i], name) {
+			return fmt.Errorf("middleware %q is listed more than once", name)
+		}
+	}
+	for _, rule := range mustPrecede {
+		before, after := slices.Index(order, rule.before), slices.Index(order, rule.after)
+		if before >= 0 && after >= 0 && before > after {
+			return fmt.Errorf("middleware %q must come before %q so %s", rule.before, rule.after, rule.reason)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// recorder returns middleware that appends name to calls when it runs
+func recorder(name string, calls *[]string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*calls = append(*calls, name)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	tests := []struct {
+		name       string
+		registered []string
+		order      []string
+		want       []string
+	}{
+		{
+			name:       "default order",
+			registered: []string{Timeout, RateLimit, Logging, RequestID, Pause},
+			want:       []string{RequestID, Logging, Pause, RateLimit, Timeout},
+		},
+		{
+			name:       "configured order",
+			registered: []string{RequestID, Logging, Pause, RateLimit, Timeout},
+			order:      []string{RateLimit, RequestID, Logging, Timeout},
+			want:       []string{RateLimit, RequestID, Logging, Timeout},
+		},
+		{
+			name:       "unregistered middleware is skipped",
+			registered: []string{RequestID, Logging},
+			order:      []string{ProxyHeaders, Tracing, RequestID, Logging},
+			want:       []string{RequestID, Logging},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []string
+			b := NewBuilder()
+			for _, name := range tt.registered {
+				b.Register(name, recorder(name, &calls))
+			}
+			chain, err := b.Build(tt.order)
+			if err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+
+			var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			for i := len(chain) - 1; i >= 0; i-- {
+				handler = chain[i](handler)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/webhook", nil))
+
+			if !reflect.DeepEqual(calls, tt.want) {
+				t.Errorf("middleware ran in order %v, want %v", calls, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		order   []string
+		wantErr string
+	}{
+		{name: "empty", order: nil},
+		{name: "default", order: DefaultOrder},
+		{name: "subset", order: []string{RequestID, Timeout}},
+		{name: "unknown", order: []string{RequestID, "csrf"}, wantErr: `unknown middleware "csrf"`},
+		{name: "duplicate", order: []string{RateLimit, RateLimit}, wantErr: "more than once"},
+		{name: "logging before request id", order: []string{Logging, RequestID}, wantErr: `"request_id" must come before "logging"`},
+		{name: "recorder before request id", order: []string{Recorder, RequestID}, wantErr: `"request_id" must come before "recorder"`},
+		{name: "pause before cors", order: []string{Pause, CORS}, wantErr: `"cors" must come before "pause"`},
+		{name: "rate limit before proxy headers", order: []string{RateLimit, ProxyHeaders}, wantErr: `"proxy_headers" must come before "rate_limit"`},
+		{name: "auth ban before proxy headers", order: []string{AuthBan, ProxyHeaders}, wantErr: `"proxy_headers" must come before "auth_ban"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateOrder(tt.order)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("ValidateOrder() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ValidateOrder() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := NewBuilder().Build([]string{"csrf"}); err == nil {
+		t.Error("Build() with an unknown middleware error = nil, want error")
+	}
+}
@@ -4,7 +4,8 @@ package request
 //
 // It includes middleware for:
 //   - Request ID generation and propagation
-//   - Request timeout management
+//   - Request timeout management, which trusted forwarders can shorten
+//     per request with X-Request-Timeout or grpc-timeout
 //
 // The middleware in this package is designed to be used with standard
 // http.Handler interfaces and can be easily chained together.
@@ -2,17 +2,145 @@ package request
 
 import (
 	"context"
+	"math"
+	"net"
 	"net/http"
+	"net/netip"
+	"strconv"
 	"time"
 )
 
+// Headers a trusted forwarder can send to shorten a request's timeout
+const (
+	// TimeoutHeader is a Go duration such as "2s", or a number of seconds
+	TimeoutHeader = "X-Request-Timeout"
+	// GRPCTimeoutHeader is up to eight digits and a unit: H, M, S, m, u or n
+	GRPCTimeoutHeader = "Grpc-Timeout"
+)
+
+// Sources of a request's timeout
+const (
+	TimeoutSourceConfig = "config"
+	TimeoutSourceHeader = "header"
+)
+
+// TimeoutConfig configures WithTimeouts
+type TimeoutConfig struct {
+	// Timeout is the longest a request may take
+	Timeout time.Duration
+	// HeaderCIDRs are the client networks whose TimeoutHeader or
+	// GRPCTimeoutHeader may shorten Timeout; other clients' headers are
+	// ignored
+	HeaderCIDRs []netip.Prefix
+}
+
 // WithTimeout adds a timeout to the request context
 func WithTimeout(timeout time.Duration) func(http.Handler) http.Handler {
+	return WithTimeouts(TimeoutConfig{Timeout: timeout})
+}
+
+// WithTimeouts adds a timeout to the request context, shortened by a
+// trusted client's timeout header but never lengthened
+func WithTimeouts(cfg TimeoutConfig) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timeout, source := cfg.Timeout, TimeoutSourceConfig
+			if requested, ok := headerTimeout(r); ok && requested < timeout && cfg.trusted(r) {
+				timeout, source = requested, TimeoutSourceHeader
+			}
+			if record, ok := r.Context().Value(timeoutRecordKey).(*timeoutRecord); ok {
+				record.timeout, record.source = timeout, source
+			}
+
 			ctx, cancel := context.WithTimeout(r.Context(), timeout)
 			defer cancel()
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
+
+// trusted reports whether r comes from one of the HeaderCIDRs
+func (c TimeoutConfig) trusted(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range c.HeaderCIDRs {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerTimeout returns the positive timeout r's headers ask for, preferring
+// TimeoutHeader to GRPCTimeoutHeader
+func headerTimeout(r *http.Request) (time.Duration, bool) {
+	if val := r.Header.Get(TimeoutHeader); val != "" {
+		timeout, err := time.ParseDuration(val)
+		if err != nil {
+			seconds, err := strconv.ParseFloat(val, 64)
+			if err != nil || !(seconds > 0 && seconds < math.MaxInt64/float64(time.Second)) {
+				return 0, false
+			}
+			timeout = time.Duration(seconds * float64(time.Second))
+		}
+		return timeout, timeout > 0
+	}
+	if val := r.Header.Get(GRPCTimeoutHeader); val != "" {
+		return parseGRPCTimeout(val)
+	}
+	return 0, false
+}
+
+// grpcTimeoutUnits are the units of a grpc-timeout header
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// parseGRPCTimeout parses a grpc-timeout header value such as "500m"
+func parseGRPCTimeout(val string) (time.Duration, bool) {
+	if len(val) < 2 || len(val) > 9 {
+		return 0, false
+	}
+	unit, ok := grpcTimeoutUnits[val[len(val)-1]]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(val[:len(val)-1], 10, 64)
+	// A timeout too long to represent never shortens the configured one
+	if err != nil || n == 0 || n > uint64(math.MaxInt64/unit) {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// timeoutRecord is where WithTimeouts records the timeout it applied
+type timeoutRecord struct {
+	timeout time.Duration
+	source  string
+}
+
+// timeoutRecordKey is the context key of a *timeoutRecord
+const timeoutRecordKey = contextKey("timeoutRecord")
+
+// RecordTimeout returns a context in which a WithTimeouts further down the
+// chain records the timeout it applies, and a function returning that
+// timeout and its source once the request has been served. The timeout is
+// zero if no WithTimeouts ran.
+func RecordTimeout(ctx context.Context) (context.Context, func() (time.Duration, string)) {
+	record := &timeoutRecord{}
+	return context.WithValue(ctx, timeoutRecordKey, record), func() (time.Duration, string) {
+		return record.timeout, record.source
+	}
+}
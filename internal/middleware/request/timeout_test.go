@@ -3,6 +3,7 @@ package request
 import (
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"testing"
 	"time"
 )
@@ -72,3 +73,52 @@ func TestWithTimeoutChain(t *testing.T) {
 		t.Errorf("got status %d, want %d", w.Code, http.StatusOK)
 	}
 }
+
+func TestWithTimeoutsHeader(t *testing.T) {
+	cfg := TimeoutConfig{
+		Timeout:     30 * time.Second,
+		HeaderCIDRs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		value      string
+		want       time.Duration
+		wantSource string
+	}{
+		{"no header", "10.0.0.1:1234", "", "", 30 * time.Second, TimeoutSourceConfig},
+		{"duration", "10.0.0.1:1234", TimeoutHeader, "2s", 2 * time.Second, TimeoutSourceHeader},
+		{"seconds", "10.0.0.1:1234", TimeoutHeader, "1.5", 1500 * time.Millisecond, TimeoutSourceHeader},
+		{"grpc-timeout", "10.0.0.1:1234", GRPCTimeoutHeader, "500m", 500 * time.Millisecond, TimeoutSourceHeader},
+		{"capped by config", "10.0.0.1:1234", TimeoutHeader, "5m", 30 * time.Second, TimeoutSourceConfig},
+		{"untrusted client", "192.0.2.1:1234", TimeoutHeader, "2s", 30 * time.Second, TimeoutSourceConfig},
+		{"invalid", "10.0.0.1:1234", TimeoutHeader, "soon", 30 * time.Second, TimeoutSourceConfig},
+		{"zero", "10.0.0.1:1234", GRPCTimeoutHeader, "0S", 30 * time.Second, TimeoutSourceConfig},
+		{"grpc-timeout too long", "10.0.0.1:1234", GRPCTimeoutHeader, "99999999H", 30 * time.Second, TimeoutSourceConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var remaining time.Duration
+			handler := WithTimeouts(cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				deadline, _ := r.Context().Deadline()
+				remaining = time.Until(deadline)
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			ctx, timeout := RecordTimeout(req.Context())
+			handler.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+
+			if got, source := timeout(); got != tt.want || source != tt.wantSource {
+				t.Errorf("timeout = %v from %s, want %v from %s", got, source, tt.want, tt.wantSource)
+			}
+			if remaining > tt.want || remaining < tt.want-time.Second {
+				t.Errorf("deadline in %v, want about %v", remaining, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package security
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+)
+
+// AuthBanConfig configures an AuthBan
+type AuthBanConfig struct {
+	// MaxFailures is the number of auth failures within Window that bans a
+	// client IP
+	MaxFailures int
+	// Window is the period failures are counted over
+	Window time.Duration
+	// Cooldown is how long a banned IP is rejected for
+	Cooldown time.Duration
+	// ExemptCIDRs are client networks, such as Buildkite's webhook IPs, that
+	// are never banned
+	ExemptCIDRs []netip.Prefix
+}
+
+// Ban describes a banned client IP
+type Ban struct {
+	IP       string    `json:"ip"`
+	Since    time.Time `json:"since"`
+	Until    time.Time `json:"until"`
+	Failures int       `json:"failures"`
+}
+
+// AuthBan rejects requests from client IPs that recently failed
+// authentication too often, fail2ban style. A failure is a 401 response from
+// the handler it wraps. It is safe for concurrent use.
+type AuthBan struct {
+	cfg AuthBanConfig
+	now func() time.Time
+
+	mu        sync.Mutex
+	clients   map[string]*authClient
+	lastSweep time.Time
+}
+
+// authClient is the failure history of one client IP
+type authClient struct {
+	// failures are the times of failures within the window, oldest first
+	failures    []time.Time
+	bannedSince time.Time
+	bannedUntil time.Time
+	// bannedFailures is the number of failures that led to the ban
+	bannedFailures int
+}
+
+// NewAuthBan creates an AuthBan; a config with no MaxFailures never bans
+func NewAuthBan(cfg AuthBanConfig) *AuthBan {
+	return &AuthBan{
+		cfg:       cfg,
+		now:       time.Now,
+		clients:   make(map[string]*authClient),
+		lastSweep: time.Now(),
+	}
+}
+
+// Middleware rejects banned client IPs with a 403 and counts the auth
+// failures of everyone else
+func (b *AuthBan) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := banKey(clientIP(r))
+		if b.exempt(ip) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if until, banned := b.banned(ip); banned {
+			metrics.RecordAuthBanRejection(r.URL.Path)
+			retryAfter := max(int(math.Ceil(until.Sub(b.now()).Seconds())), 1)
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			_ = json.NewEncoder(w).Encode(rateLimitResponse{
+				Status:     "error",
+				Message:    "Forbidden",
+				ErrorType:  "banned",
+				RetryAfter: retryAfter,
+				Details:    map[string]string{"reason": "too many authentication failures"},
+			})
+			return
+		}
+
+		rw := &banStatusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r)
+		if rw.status == http.StatusUnauthorized {
+			b.fail(ip)
+		}
+	})
+}
+
+// banKey normalizes an IP so its IPv4-mapped and plain forms share a ban
+func banKey(ip string) string {
+	if addr, err := netip.ParseAddr(ip); err == nil {
+		return addr.Unmap().String()
+	}
+	return ip
+}
+
+// exempt reports whether ip is never banned
+func (b *AuthBan) exempt(ip string) bool {
+	if b.cfg.MaxFailures <= 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range b.cfg.ExemptCIDRs {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// banned reports whether ip is banned and until when
+func (b *AuthBan) banned(ip string) (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.clients[ip]
+	if !ok || !b.now().Before(c.bannedUntil) {
+		return time.Time{}, false
+	}
+	return c.bannedUntil, true
+}
+
+// fail records an auth failure from ip, banning it once it reaches
+// MaxFailures within the window
+func (b *AuthBan) fail(ip string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	b.sweep(now)
+
+	c, ok := b.clients[ip]
+	if !ok {
+		c = &authClient{}
+		b.clients[ip] = c
+	}
+	c.failures = append(c.prune(now, b.cfg.Window), now)
+	if len(c.failures) < b.cfg.MaxFailures || now.Before(c.bannedUntil) {
+		return
+	}
+	// Failures start over so the ban's end gives the client a fresh window
+	c.bannedSince, c.bannedUntil = now, now.Add(b.cfg.Cooldown)
+	c.bannedFailures, c.failures = len(c.failures), nil
+	metrics.RecordAuthBan()
+	metrics.AuthBannedIPs.Set(float64(b.countBanned(now)))
+}
+
+// prune returns the failures still within window of now
+func (c *authClient) prune(now time.Time, window time.Duration) []time.Time {
+	i := 0
+	for i < len(c.failures) && now.Sub(c.failures[i]) >= window {
+		i++
+	}
+	return c.failures[i:]
+}
+
+// sweep forgets clients that are neither banned nor have failures within
+// the window, at most once per window
+func (b *AuthBan) sweep(now time.Time) {
+	if now.Sub(b.lastSweep) < b.cfg.Window {
+		return
+	}
+	for ip, c := range b.clients {
+		if c.failures = c.prune(now, b.cfg.Window); len(c.failures) == 0 && !now.Before(c.bannedUntil) {
+			delete(b.clients, ip)
+		}
+	}
+	b.lastSweep = now
+	metrics.AuthBannedIPs.Set(float64(b.countBanned(now)))
+}
+
+// countBanned returns the number of IPs banned at now
+func (b *AuthBan) countBanned(now time.Time) int {
+	n := 0
+	for _, c := range b.clients {
+		if now.Before(c.bannedUntil) {
+			n++
+		}
+	}
+	return n
+}
+
+// Bans returns the IPs currently banned, soonest to expire first
+func (b *AuthBan) Bans() []Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	bans := []Ban{}
+	for ip, c := range b.clients {
+		if now.Before(c.bannedUntil) {
+			bans = append(bans, Ban{IP: ip, Since: c.bannedSince, Until: c.bannedUntil, Failures: c.bannedFailures})
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		if !bans[i].Until.Equal(bans[j].Until) {
+			return bans[i].Until.Before(bans[j].Until)
+		}
+		return bans[i].IP < bans[j].IP
+	})
+	return bans
+}
+
+// Unban lifts the ban on ip and forgets its failures, reporting whether it
+// was banned
+func (b *AuthBan) Unban(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	ip = banKey(ip)
+	c, ok := b.clients[ip]
+	if !ok {
+		return false
+	}
+	delete(b.clients, ip)
+	metrics.AuthBannedIPs.Set(float64(b.countBanned(now)))
+	return now.Before(c.bannedUntil)
+}
+
+// banStatusWriter records the response status
+type banStatusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *banStatusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *banStatusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,139 @@
+package security
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestAuthBan(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	now := time.Now()
+	ban := NewAuthBan(AuthBanConfig{
+		MaxFailures: 3,
+		Window:      time.Minute,
+		Cooldown:    10 * time.Minute,
+		ExemptCIDRs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	})
+	ban.now = func() time.Time { return now }
+	handler := ban.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Buildkite-Token") != "valid" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	send := func(remoteAddr, token string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Buildkite-Token", token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Failures that fall out of the window do not count
+	send("192.0.2.1:1000", "wrong")
+	send("192.0.2.1:1000", "wrong")
+	now = now.Add(time.Minute)
+	if w := send("192.0.2.1:1000", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d after failures outside the window, want 401", w.Code)
+	}
+	send("192.0.2.1:1000", "wrong")
+	send("192.0.2.1:1000", "wrong")
+
+	// Banned, even with a valid token
+	w := send("192.0.2.1:2000", "valid")
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status = %d for a banned IP, want 403", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "600" {
+		t.Errorf("Retry-After = %q, want 600", got)
+	}
+	var body rateLimitResponse
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	if body.ErrorType != "banned" || body.RetryAfter != 600 {
+		t.Errorf("body = %+v, want error_type banned and retry_after 600", body)
+	}
+
+	// Other clients, and exempt ones however often they fail, are served
+	if w := send("192.0.2.2:1000", "valid"); w.Code != http.StatusOK {
+		t.Errorf("status = %d for another IP, want 200", w.Code)
+	}
+	for i := 0; i < 5; i++ {
+		send("10.1.2.3:1000", "wrong")
+	}
+	if w := send("10.1.2.3:1000", "valid"); w.Code != http.StatusOK {
+		t.Errorf("status = %d for an exempt IP, want 200", w.Code)
+	}
+
+	bans := ban.Bans()
+	if len(bans) != 1 || bans[0].IP != "192.0.2.1" || bans[0].Failures != 3 || !bans[0].Until.Equal(now.Add(10*time.Minute)) {
+		t.Fatalf("Bans() = %+v, want 192.0.2.1 banned for 10m after 3 failures", bans)
+	}
+	if got := counterValue(t, metrics.AuthBansTotal); got != 1 {
+		t.Errorf("bans = %v, want 1", got)
+	}
+	if got := counterValue(t, metrics.AuthBanRejections.WithLabelValues("/webhook")); got != 1 {
+		t.Errorf("rejections = %v, want 1", got)
+	}
+	var m dto.Metric
+	if err := metrics.AuthBannedIPs.Write(&m); err != nil {
+		t.Fatalf("failed to read gauge: %v", err)
+	}
+	if got := m.GetGauge().GetValue(); got != 1 {
+		t.Errorf("banned IPs = %v, want 1", got)
+	}
+
+	// The ban expires after the cooldown, with a fresh failure count
+	now = now.Add(10 * time.Minute)
+	if w := send("192.0.2.1:1000", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d after the cooldown, want 401", w.Code)
+	}
+	if w := send("192.0.2.1:1000", "valid"); w.Code != http.StatusOK {
+		t.Errorf("status = %d after one failure past the cooldown, want 200", w.Code)
+	}
+	if bans := ban.Bans(); len(bans) != 0 {
+		t.Errorf("Bans() = %+v after the cooldown, want none", bans)
+	}
+}
+
+func TestAuthBanUnban(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	ban := NewAuthBan(AuthBanConfig{MaxFailures: 1, Window: time.Minute, Cooldown: time.Hour})
+	handler := ban.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+	req.RemoteAddr = "[::ffff:192.0.2.1]:1000"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if bans := ban.Bans(); len(bans) != 1 || bans[0].IP != "192.0.2.1" {
+		t.Fatalf("Bans() = %+v, want 192.0.2.1", bans)
+	}
+	if ban.Unban("192.0.2.2") {
+		t.Error("Unban() of an IP that is not banned = true")
+	}
+	if !ban.Unban("::ffff:192.0.2.1") {
+		t.Error("Unban() of a banned IP = false")
+	}
+	if bans := ban.Bans(); len(bans) != 0 {
+		t.Errorf("Bans() after Unban = %+v, want none", bans)
+	}
+}
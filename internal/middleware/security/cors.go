@@ -0,0 +1,100 @@
+package security
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/buildkite"
+)
+
+// corsMaxAge is how long browsers may cache a preflight response
+const corsMaxAge = 10 * time.Minute
+
+// corsAllowedHeaders are the request headers the webhook handler reads
+var corsAllowedHeaders = strings.Join([]string{
+	"Content-Type",
+	buildkite.TokenHeader,
+	buildkite.SignatureHeader,
+	buildkite.EventHeader,
+	buildkite.DeliveryIDHeader,
+	"X-Request-ID",
+	"Traceparent",
+	"Tracestate",
+}, ", ")
+
+// corsExposedHeaders are the response headers browser clients may read
+const corsExposedHeaders = "X-Request-ID, Retry-After"
+
+// CORSConfig configures cross-origin requests to the webhook endpoint, such
+// as from a browser-based test console
+type CORSConfig struct {
+	// AllowedOrigins are origins such as https://console.example.com; "*"
+	// allows any origin
+	AllowedOrigins []string
+}
+
+// ValidateOrigin checks that origin is "*" or a scheme and host with no path
+func ValidateOrigin(origin string) error {
+	if origin == "*" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		u.Path != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return fmt.Errorf("invalid origin %q: must be \"*\" or a scheme and host such as https://console.example.com", origin)
+	}
+	return nil
+}
+
+// WithCORS answers CORS preflight requests from allowed origins and adds
+// CORS headers to their other requests. Preflight requests from other
+// origins get 403; their other requests pass through without CORS headers,
+// so browsers do not expose the response.
+func WithCORS(cfg CORSConfig) func(http.Handler) http.Handler {
+	anyOrigin := slices.Contains(cfg.AllowedOrigins, "*")
+	maxAge := strconv.Itoa(int(corsMaxAge.Seconds()))
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+			w.Header().Add("Vary", "Origin")
+			if !anyOrigin && !slices.Contains(cfg.AllowedOrigins, origin) {
+				if preflight {
+					http.Error(w, "Origin not allowed", http.StatusForbidden)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if anyOrigin {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+			if !preflight {
+				w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", "POST, HEAD")
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+			w.Header().Set("Access-Control-Max-Age", maxAge)
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package security
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithCORS(t *testing.T) {
+	tests := []struct {
+		name        string
+		origins     []string
+		method      string
+		origin      string
+		preflight   bool
+		wantStatus  int
+		wantOrigin  string
+		wantHandled bool
+	}{
+		{
+			name:        "no origin passes through",
+			origins:     []string{"https://console.example.com"},
+			method:      http.MethodPost,
+			wantStatus:  http.StatusOK,
+			wantHandled: true,
+		},
+		{
+			name:       "preflight from allowed origin",
+			origins:    []string{"https://console.example.com"},
+			method:     http.MethodOptions,
+			origin:     "https://console.example.com",
+			preflight:  true,
+			wantStatus: http.StatusNoContent,
+			wantOrigin: "https://console.example.com",
+		},
+		{
+			name:       "preflight from other origin",
+			origins:    []string{"https://console.example.com"},
+			method:     http.MethodOptions,
+			origin:     "https://evil.example.com",
+			preflight:  true,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "preflight with any origin allowed",
+			origins:    []string{"*"},
+			method:     http.MethodOptions,
+			origin:     "https://console.example.com",
+			preflight:  true,
+			wantStatus: http.StatusNoContent,
+			wantOrigin: "*",
+		},
+		{
+			name:        "request from allowed origin",
+			origins:     []string{"https://console.example.com"},
+			method:      http.MethodPost,
+			origin:      "https://console.example.com",
+			wantStatus:  http.StatusOK,
+			wantOrigin:  "https://console.example.com",
+			wantHandled: true,
+		},
+		{
+			name:        "request from other origin has no CORS headers",
+			origins:     []string{"https://console.example.com"},
+			method:      http.MethodPost,
+			origin:      "https://evil.example.com",
+			wantStatus:  http.StatusOK,
+			wantHandled: true,
+		},
+		{
+			name:        "options without preflight header passes through",
+			origins:     []string{"https://console.example.com"},
+			method:      http.MethodOptions,
+			origin:      "https://console.example.com",
+			wantStatus:  http.StatusOK,
+			wantOrigin:  "https://console.example.com",
+			wantHandled: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handled := false
+			handler := WithCORS(CORSConfig{AllowedOrigins: tt.origins})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handled = true
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequest(tt.method, "/webhook", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+				req.Header.Set("Access-Control-Request-Headers", "content-type, x-buildkite-token")
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if handled != tt.wantHandled {
+				t.Errorf("handler called = %v, want %v", handled, tt.wantHandled)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+			if tt.preflight && tt.wantOrigin != "" {
+				if got := w.Header().Get("Access-Control-Allow-Methods"); got != "POST, HEAD" {
+					t.Errorf("Access-Control-Allow-Methods = %q, want %q", got, "POST, HEAD")
+				}
+				if got := w.Header().Get("Access-Control-Allow-Headers"); got == "" {
+					t.Error("Access-Control-Allow-Headers is empty")
+				}
+			}
+		})
+	}
+}
+
+func TestValidateOrigin(t *testing.T) {
+	for origin, wantErr := range map[string]bool{
+		"*":                              false,
+		"https://console.example.com":    false,
+		"http://localhost:3000":          false,
+		"console.example.com":            true,
+		"https://console.example.com/":   true,
+		"ftp://console.example.com":      true,
+		"https://console.example.com?x=": true,
+	} {
+		if err := ValidateOrigin(origin); (err != nil) != wantErr {
+			t.Errorf("ValidateOrigin(%q) error = %v, wantErr %v", origin, err, wantErr)
+		}
+	}
+}
@@ -1,47 +1,411 @@
 package security
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"net/netip"
+	"path"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/mcncl/buildkite-pubsub/internal/buildkite"
+	"github.com/mcncl/buildkite-pubsub/internal/clock"
 	"github.com/mcncl/buildkite-pubsub/internal/metrics"
 	"golang.org/x/time/rate"
 )
 
+// Limiter types, used as metric labels
+const (
+	LimiterGlobal = "global"
+	LimiterIP     = "ip"
+	LimiterToken  = "token"
+)
+
+// idleLimiterTTL is how long a per-key limiter is kept after its last request
+const idleLimiterTTL = 10 * time.Minute
+
+// LimitConfig configures a token bucket allowing Requests per Window with
+// bursts of up to Burst requests
+type LimitConfig struct {
+	Requests int
+	// Burst defaults to Requests when zero
+	Burst int
+	// Window defaults to one minute when zero
+	Window time.Duration
+	// Clock refills the bucket; nil uses the system clock
+	Clock clock.Clock
+}
+
+// now returns the time on the config's clock
+func (c LimitConfig) now() time.Time {
+	return clock.OrReal(c.Clock).Now()
+}
+
+// window returns the period the limit applies to
+func (c LimitConfig) window() time.Duration {
+	if c.Window <= 0 {
+		return time.Minute
+	}
+	return c.Window
+}
+
+// burst returns the size of the token bucket
+func (c LimitConfig) burst() int {
+	if c.Burst <= 0 {
+		return c.Requests
+	}
+	return c.Burst
+}
+
+// interval returns the time to refill one token
+func (c LimitConfig) interval() time.Duration {
+	return c.window() / time.Duration(c.Requests)
+}
+
+// limiter creates the token bucket for the config
+func (c LimitConfig) limiter() *rate.Limiter {
+	return rate.NewLimiter(rate.Every(c.interval()), c.burst())
+}
+
+// retryAfter returns the seconds a client should wait, a whole window
+func (c LimitConfig) retryAfter() int {
+	return int(math.Ceil(c.window().Seconds()))
+}
+
+// quota describes a bucket holding tokens
+func (c LimitConfig) quota(tokens float64) quota {
+	burst := c.burst()
+	tokens = max(tokens, 0)
+	return quota{
+		limit:     burst,
+		remaining: int(math.Floor(tokens)),
+		reset:     int(math.Ceil((float64(burst) - tokens) * c.interval().Seconds())),
+	}
+}
+
+// quota is what a limiter allows a client, reported in the RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers
+type quota struct {
+	// limit is the requests allowed at once; zero means no limiter applied
+	limit     int
+	remaining int
+	// reset is the seconds until the bucket refills
+	reset int
+}
+
+// tighter returns whichever of q and o leaves the fewest requests, or on a
+// tie the one taking longer to refill
+func (q quota) tighter(o quota) quota {
+	if q.limit == 0 || o.remaining < q.remaining || (o.remaining == q.remaining && o.reset > q.reset) {
+		return o
+	}
+	return q
+}
+
+// setHeaders writes the quota's headers, if a limiter applied
+func (q quota) setHeaders(w http.ResponseWriter) {
+	if q.limit == 0 {
+		return
+	}
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(q.limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(q.remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(max(q.reset, 0)))
+}
+
+// RateLimitConfig configures the global, per-IP and per-token limiters.
+// Limiters with zero Requests are disabled, except the global limiter which
+// defaults to 60 requests per minute.
+type RateLimitConfig struct {
+	Global LimitConfig
+	IP     LimitConfig
+	Token  LimitConfig
+	// TokenKey identifies the client for the token limiter; requests for
+	// which it returns "" skip that limiter. Defaults to BuildkiteTokenKey.
+	TokenKey func(r *http.Request) string
+	// BypassPaths are path.Match patterns, such as health check paths,
+	// whose requests skip every limiter
+	BypassPaths []string
+	// BypassCIDRs are client networks, such as Buildkite's webhook IPs,
+	// that skip the per-IP limiter; the token and global limiters still apply
+	BypassCIDRs []netip.Prefix
+	// Clock is used by limiters whose config has no Clock; nil uses the
+	// system clock
+	Clock clock.Clock
+}
+
+// withClock sets the clock of a limiter config that has none
+func (c RateLimitConfig) withClock(limit LimitConfig) LimitConfig {
+	if limit.Clock == nil {
+		limit.Clock = c.Clock
+	}
+	return limit
+}
+
+// bypassPath reports whether requests for p skip every limiter
+func (c RateLimitConfig) bypassPath(p string) bool {
+	for _, pattern := range c.BypassPaths {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// bypassIP reports whether ip skips the per-IP limiter
+func (c RateLimitConfig) bypassIP(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range c.BypassCIDRs {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCIDRs parses networks in CIDR notation; a bare address is a network
+// of that one address
+func ParseCIDRs(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(cidr)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// BuildkiteTokenKey keys requests by a hash of the X-Buildkite-Token header,
+// so webhook tokens are not held in memory. Requests signed with HMAC carry
+// no token and are not keyed.
+func BuildkiteTokenKey(r *http.Request) string {
+	token := r.Header.Get(buildkite.TokenHeader)
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// HeaderKey keys requests by the value of a header, such as a tenant ID set
+// by a proxy in front of the webhook. The header is only believed from the
+// trusted networks; other clients could set it to spread requests over
+// buckets, so they are keyed by BuildkiteTokenKey instead.
+func HeaderKey(name string, trusted []netip.Prefix) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		addr, err := netip.ParseAddr(clientIP(r))
+		if err != nil {
+			return BuildkiteTokenKey(r)
+		}
+		addr = addr.Unmap()
+		for _, prefix := range trusted {
+			if prefix.Contains(addr) {
+				return r.Header.Get(name)
+			}
+		}
+		return BuildkiteTokenKey(r)
+	}
+}
+
 // RateLimiter provides global rate limiting
 type RateLimiter struct {
+	cfg     LimitConfig
 	limiter *rate.Limiter
 }
 
 // NewRateLimiter creates a new rate limiter with the given requests per minute
 func NewRateLimiter(requestsPerMinute int) *RateLimiter {
-	if requestsPerMinute <= 0 {
-		requestsPerMinute = 60 // default
+	return NewRateLimiterWithConfig(LimitConfig{Requests: requestsPerMinute})
+}
+
+// NewRateLimiterWithConfig creates a rate limiter with an explicit burst and window
+func NewRateLimiterWithConfig(cfg LimitConfig) *RateLimiter {
+	if cfg.Requests <= 0 {
+		cfg.Requests = 60 // default
 	}
-	r := rate.Every(time.Minute / time.Duration(requestsPerMinute))
 	return &RateLimiter{
-		limiter: rate.NewLimiter(r, requestsPerMinute),
+		cfg:     cfg,
+		limiter: cfg.limiter(),
 	}
 }
 
 // Allow checks if a request is allowed
 func (rl *RateLimiter) Allow() bool {
-	return rl.limiter.Allow()
+	return rl.limiter.AllowN(rl.cfg.now(), 1)
+}
+
+// Tokens returns the number of requests that could be allowed right now
+func (rl *RateLimiter) Tokens() float64 {
+	return rl.limiter.TokensAt(rl.cfg.now())
+}
+
+// KeyedRateLimiter keeps a separate token bucket per key, e.g. per client IP
+type KeyedRateLimiter struct {
+	cfg LimitConfig
+
+	mu        sync.Mutex
+	limiters  map[string]*keyedLimiter
+	lastSweep time.Time
+}
+
+type keyedLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// NewKeyedRateLimiter creates a limiter applying cfg to each key independently
+func NewKeyedRateLimiter(cfg LimitConfig) *KeyedRateLimiter {
+	return &KeyedRateLimiter{
+		cfg:       cfg,
+		limiters:  make(map[string]*keyedLimiter),
+		lastSweep: cfg.now(),
+	}
+}
+
+// Allow checks if a request for key is allowed and returns the tokens left
+func (kl *KeyedRateLimiter) Allow(key string) (bool, float64) {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+
+	now := kl.cfg.now()
+	if now.Sub(kl.lastSweep) > idleLimiterTTL {
+		for k, l := range kl.limiters {
+			if now.Sub(l.lastSeen) > idleLimiterTTL {
+				delete(kl.limiters, k)
+			}
+		}
+		kl.lastSweep = now
+	}
+
+	l, ok := kl.limiters[key]
+	if !ok {
+		l = &keyedLimiter{limiter: kl.cfg.limiter()}
+		kl.limiters[key] = l
+	}
+	l.lastSeen = now
+	return l.limiter.AllowN(now, 1), l.limiter.TokensAt(now)
 }
 
 // WithRateLimit returns middleware that applies rate limiting
 func WithRateLimit(requestsPerMinute int) func(http.Handler) http.Handler {
-	limiter := NewRateLimiter(requestsPerMinute)
+	return WithRateLimits(RateLimitConfig{Global: LimitConfig{Requests: requestsPerMinute}})
+}
+
+// WithRateLimits returns middleware applying the global limiter and, when
+// configured, per-client-IP and per-token limiters. Responses report the
+// quota of whichever limiter leaves the client the fewest requests in
+// RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers.
+func WithRateLimits(cfg RateLimitConfig) func(http.Handler) http.Handler {
+	global := NewRateLimiterWithConfig(cfg.withClock(cfg.Global))
+	tokenKey := cfg.TokenKey
+	if tokenKey == nil {
+		tokenKey = BuildkiteTokenKey
+	}
+
+	var ipLimiter, tokenLimiter *KeyedRateLimiter
+	if cfg.IP.Requests > 0 {
+		ipLimiter = NewKeyedRateLimiter(cfg.withClock(cfg.IP))
+	}
+	if cfg.Token.Requests > 0 {
+		tokenLimiter = NewKeyedRateLimiter(cfg.withClock(cfg.Token))
+	}
 
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if !limiter.Allow() {
-				metrics.RateLimitExceeded.WithLabelValues("http").Inc()
-				w.Header().Set("Retry-After", "60")
-				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			if cfg.bypassPath(r.URL.Path) {
+				next.ServeHTTP(w, r)
 				return
 			}
+
+			var q quota
+			if ipLimiter != nil {
+				if ip := clientIP(r); cfg.bypassIP(ip) {
+					metrics.RecordRateLimitBypass(LimiterIP)
+				} else {
+					allowed, tokens := ipLimiter.Allow(ip)
+					q = q.tighter(cfg.IP.quota(tokens))
+					if !checkLimit(w, r, LimiterIP, allowed, tokens, cfg.IP, q) {
+						return
+					}
+				}
+			}
+
+			if tokenLimiter != nil {
+				if key := tokenKey(r); key != "" {
+					allowed, tokens := tokenLimiter.Allow(key)
+					q = q.tighter(cfg.Token.quota(tokens))
+					if !checkLimit(w, r, LimiterToken, allowed, tokens, cfg.Token, q) {
+						return
+					}
+				}
+			}
+
+			allowed, tokens := global.Allow(), global.Tokens()
+			q = q.tighter(global.cfg.quota(tokens))
+			if !checkLimit(w, r, LimiterGlobal, allowed, tokens, cfg.Global, q) {
+				return
+			}
+
+			q.setHeaders(w)
 			next.ServeHTTP(w, r)
 		})
 	}
 }
+
+// checkLimit records a limiter decision and writes a 429, reporting q, when
+// denied
+func checkLimit(w http.ResponseWriter, r *http.Request, limiterType string, allowed bool, tokens float64, cfg LimitConfig, q quota) bool {
+	metrics.RecordRateLimitDecision(limiterType, allowed, tokens)
+	if allowed {
+		return true
+	}
+
+	metrics.RecordRateLimit(limiterType, r.URL.Path)
+	q.setHeaders(w)
+	retryAfter := cfg.retryAfter()
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	_ = json.NewEncoder(w).Encode(rateLimitResponse{
+		Status:     "error",
+		Message:    "Too Many Requests",
+		ErrorType:  "rate_limit",
+		RetryAfter: retryAfter,
+		Details:    map[string]string{"limiter": limiterType},
+	})
+	return false
+}
+
+// rateLimitResponse is the body of a 429, in the shape of the webhook
+// handler's ErrorResponse so clients parse every error the same way
+type rateLimitResponse struct {
+	Status     string            `json:"status"`
+	Message    string            `json:"message"`
+	ErrorType  string            `json:"error_type"`
+	RetryAfter int               `json:"retry_after"`
+	Details    map[string]string `json:"details"`
+}
+
+// clientIP returns the host part of the request's remote address
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,377 @@
+package security
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/buildkite"
+	"github.com/mcncl/buildkite-pubsub/internal/clock"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestWithRateLimitMetrics(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	handler := WithRateLimit(2)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	var codes []int
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/webhook", nil))
+		codes = append(codes, w.Code)
+	}
+
+	want := []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}
+	for i := range want {
+		if codes[i] != want[i] {
+			t.Errorf("request %d status = %d, want %d", i, codes[i], want[i])
+		}
+	}
+
+	if got := counterValue(t, metrics.RateLimitRequestsTotal.WithLabelValues(LimiterGlobal, "allowed")); got != 2 {
+		t.Errorf("allowed = %v, want 2", got)
+	}
+	if got := counterValue(t, metrics.RateLimitRequestsTotal.WithLabelValues(LimiterGlobal, "denied")); got != 1 {
+		t.Errorf("denied = %v, want 1", got)
+	}
+	if got := counterValue(t, metrics.RateLimitExceeded.WithLabelValues(LimiterGlobal, "/webhook")); got != 1 {
+		t.Errorf("exceeded{/webhook} = %v, want 1", got)
+	}
+
+	var m dto.Metric
+	if err := metrics.RateLimitTokens.WithLabelValues(LimiterGlobal).Write(&m); err != nil {
+		t.Fatalf("failed to read gauge: %v", err)
+	}
+	if tokens := m.GetGauge().GetValue(); tokens >= 1 {
+		t.Errorf("tokens available = %v, want < 1 after exhausting the limiter", tokens)
+	}
+}
+
+func TestWithRateLimitsBurstAndKeys(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		cfg        RateLimitConfig
+		requests   []*http.Request
+		want       []int
+		deniedBy   string
+		retryAfter string
+	}{
+		{
+			name: "burst smaller than sustained rate",
+			cfg:  RateLimitConfig{Global: LimitConfig{Requests: 100, Burst: 2}},
+			requests: []*http.Request{
+				newRequest("10.0.0.1:1234", ""),
+				newRequest("10.0.0.1:1234", ""),
+				newRequest("10.0.0.1:1234", ""),
+			},
+			want:       []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+			deniedBy:   LimiterGlobal,
+			retryAfter: "60",
+		},
+		{
+			name: "per second window",
+			cfg:  RateLimitConfig{Global: LimitConfig{Requests: 1, Window: time.Second}},
+			requests: []*http.Request{
+				newRequest("10.0.0.1:1234", ""),
+				newRequest("10.0.0.1:1234", ""),
+			},
+			want:       []int{http.StatusOK, http.StatusTooManyRequests},
+			deniedBy:   LimiterGlobal,
+			retryAfter: "1",
+		},
+		{
+			name: "per IP limit is independent per client",
+			cfg: RateLimitConfig{
+				Global: LimitConfig{Requests: 100},
+				IP:     LimitConfig{Requests: 1},
+			},
+			requests: []*http.Request{
+				newRequest("10.0.0.1:1234", ""),
+				newRequest("10.0.0.2:1234", ""),
+				newRequest("10.0.0.1:5678", ""),
+			},
+			want:       []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+			deniedBy:   LimiterIP,
+			retryAfter: "60",
+		},
+		{
+			name: "per token limit skips requests without a token",
+			cfg: RateLimitConfig{
+				Global: LimitConfig{Requests: 100},
+				Token:  LimitConfig{Requests: 1},
+			},
+			requests: []*http.Request{
+				newRequest("10.0.0.1:1234", "token-a"),
+				newRequest("10.0.0.1:1234", ""),
+				newRequest("10.0.0.1:1234", "token-b"),
+				newRequest("10.0.0.1:1234", "token-a"),
+			},
+			want:       []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+			deniedBy:   LimiterToken,
+			retryAfter: "60",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := counterValue(t, metrics.RateLimitRequestsTotal.WithLabelValues(tt.deniedBy, "denied"))
+
+			handler := WithRateLimits(tt.cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			var last *httptest.ResponseRecorder
+			for i, req := range tt.requests {
+				last = httptest.NewRecorder()
+				handler.ServeHTTP(last, req)
+				if last.Code != tt.want[i] {
+					t.Errorf("request %d status = %d, want %d", i, last.Code, tt.want[i])
+				}
+			}
+
+			if got := last.Header().Get("Retry-After"); got != tt.retryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.retryAfter)
+			}
+			if got := counterValue(t, metrics.RateLimitRequestsTotal.WithLabelValues(tt.deniedBy, "denied")) - before; got != 1 {
+				t.Errorf("denied{%s} = %v, want 1", tt.deniedBy, got)
+			}
+		})
+	}
+}
+
+func TestTokenRateLimitKeys(t *testing.T) {
+	req := newRequest("10.0.0.1:1234", "secret-token")
+	key := BuildkiteTokenKey(req)
+	if key == "" || key == "secret-token" {
+		t.Errorf("BuildkiteTokenKey = %q, want a hash of the token", key)
+	}
+	if other := BuildkiteTokenKey(newRequest("10.0.0.1:1234", "other-token")); other == key {
+		t.Error("different tokens produced the same key")
+	}
+	if got := BuildkiteTokenKey(newRequest("10.0.0.1:1234", "")); got != "" {
+		t.Errorf("BuildkiteTokenKey without token = %q, want empty", got)
+	}
+
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+	handler := WithRateLimits(RateLimitConfig{
+		Global:   LimitConfig{Requests: 100},
+		Token:    LimitConfig{Requests: 1},
+		TokenKey: HeaderKey("X-Tenant-ID", []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}),
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// Different tokens for the same tenant share one bucket
+	want := []int{http.StatusOK, http.StatusTooManyRequests}
+	for i, token := range []string{"token-a", "token-b"} {
+		req := newRequest("10.0.0.1:1234", token)
+		req.Header.Set("X-Tenant-ID", "tenant-1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != want[i] {
+			t.Errorf("request %d status = %d, want %d", i, w.Code, want[i])
+		}
+	}
+
+	// Untrusted clients can't escape their token's bucket by rotating the
+	// header
+	for i, tenant := range []string{"tenant-2", "tenant-3"} {
+		req := newRequest("192.0.2.1:1234", "token-c")
+		req.Header.Set("X-Tenant-ID", tenant)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != want[i] {
+			t.Errorf("untrusted request %d status = %d, want %d", i, w.Code, want[i])
+		}
+	}
+}
+
+func TestRateLimitBypass(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+	cidrs, err := ParseCIDRs([]string{"100.24.182.0/24", "2600:1f18::1"})
+	if err != nil {
+		t.Fatalf("ParseCIDRs() error = %v", err)
+	}
+	handler := WithRateLimits(RateLimitConfig{
+		Global:      LimitConfig{Requests: 4},
+		IP:          LimitConfig{Requests: 1},
+		BypassPaths: []string{"/health", "/ready"},
+		BypassCIDRs: cidrs,
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(req *http.Request) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Probes skip every limiter, so they neither use nor exhaust its budget
+	for i := 0; i < 10; i++ {
+		probe := httptest.NewRequest(http.MethodGet, "/health", nil)
+		probe.RemoteAddr = "10.0.0.1:1234"
+		if code := serve(probe); code != http.StatusOK {
+			t.Fatalf("probe %d status = %d, want %d", i, code, http.StatusOK)
+		}
+	}
+	if code := serve(newRequest("10.0.0.1:1234", "")); code != http.StatusOK {
+		t.Errorf("first request after probes status = %d, want %d", code, http.StatusOK)
+	}
+	if code := serve(newRequest("10.0.0.1:1234", "")); code != http.StatusTooManyRequests {
+		t.Errorf("second request from 10.0.0.1 status = %d, want %d", code, http.StatusTooManyRequests)
+	}
+
+	// Bypassed networks skip the per-IP limiter but not the global one
+	before := counterValue(t, metrics.RateLimitRequestsTotal.WithLabelValues(LimiterIP, "bypassed"))
+	want := []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusTooManyRequests}
+	for i, addr := range []string{"100.24.182.10:1234", "100.24.182.10:5678", "[2600:1f18::1]:1234", "100.24.182.11:1234"} {
+		if code := serve(newRequest(addr, "")); code != want[i] {
+			t.Errorf("request %d from %s status = %d, want %d", i, addr, code, want[i])
+		}
+	}
+	if got := counterValue(t, metrics.RateLimitRequestsTotal.WithLabelValues(LimiterIP, "bypassed")) - before; got != 4 {
+		t.Errorf("bypassed{ip} = %v, want 4", got)
+	}
+
+	if _, err := ParseCIDRs([]string{"buildkite"}); err == nil {
+		t.Error("ParseCIDRs() with an invalid network error = nil, want error")
+	}
+}
+
+func TestRateLimitResponse(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	// Every error the service returns is JSON, whatever the client accepts
+	for _, accept := range []string{"", "application/json", "text/plain", "*/*"} {
+		t.Run("accept "+accept, func(t *testing.T) {
+			handler := WithRateLimits(RateLimitConfig{Global: LimitConfig{Requests: 1, Window: 30 * time.Second}})(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			var w *httptest.ResponseRecorder
+			for range 2 {
+				req := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+				if accept != "" {
+					req.Header.Set("Accept", accept)
+				}
+				w = httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+			}
+
+			if w.Code != http.StatusTooManyRequests {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusTooManyRequests)
+			}
+			if got := w.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+			if got := w.Header().Get("Retry-After"); got != "30" {
+				t.Errorf("Retry-After = %q, want 30", got)
+			}
+
+			var body rateLimitResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("failed to decode %q: %v", w.Body, err)
+			}
+			want := rateLimitResponse{
+				Status:     "error",
+				Message:    "Too Many Requests",
+				ErrorType:  "rate_limit",
+				RetryAfter: 30,
+				Details:    map[string]string{"limiter": LimiterGlobal},
+			}
+			if !reflect.DeepEqual(body, want) {
+				t.Errorf("body = %+v, want %+v", body, want)
+			}
+		})
+	}
+}
+
+func newRequest(remoteAddr, token string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+	req.RemoteAddr = remoteAddr
+	if token != "" {
+		req.Header.Set(buildkite.TokenHeader, token)
+	}
+	return req
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatalf("failed to read counter: %v", err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	clk := clock.NewFake(time.Now())
+	handler := WithRateLimits(RateLimitConfig{
+		Global:      LimitConfig{Requests: 100, Window: time.Minute},
+		IP:          LimitConfig{Requests: 2, Window: time.Minute},
+		BypassPaths: []string{"/health"},
+		Clock:       clk,
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(path string) *httptest.ResponseRecorder {
+		req := newRequest("192.0.2.1:1234", "")
+		req.URL.Path = path
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// The per-IP limiter leaves fewer requests than the global one, so its
+	// quota is reported; the first token refills in 30s and the second in
+	// 60s. Once 30s pass one more request is allowed.
+	tests := []struct {
+		advance                          time.Duration
+		wantStatus                       int
+		wantLimit, wantRemain, wantReset string
+	}{
+		{0, http.StatusOK, "2", "1", "30"},
+		{0, http.StatusOK, "2", "0", "60"},
+		{0, http.StatusTooManyRequests, "2", "0", "60"},
+		{30 * time.Second, http.StatusOK, "2", "0", "60"},
+		{0, http.StatusTooManyRequests, "2", "0", "60"},
+	}
+	for i, tt := range tests {
+		clk.Advance(tt.advance)
+		w := serve("/webhook")
+		if w.Code != tt.wantStatus {
+			t.Fatalf("request %d status = %d, want %d", i, w.Code, tt.wantStatus)
+		}
+		got := [3]string{w.Header().Get("RateLimit-Limit"), w.Header().Get("RateLimit-Remaining"), w.Header().Get("RateLimit-Reset")}
+		if want := [3]string{tt.wantLimit, tt.wantRemain, tt.wantReset}; got != want {
+			t.Errorf("request %d RateLimit limit, remaining, reset = %v, want %v", i, got, want)
+		}
+	}
+
+	if got := serve("/health").Header().Get("RateLimit-Limit"); got != "" {
+		t.Errorf("bypassed path RateLimit-Limit = %q, want none", got)
+	}
+}
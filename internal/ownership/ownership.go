@@ -0,0 +1,159 @@
+// Package ownership maps pipelines to the teams that own them, so alerts on
+// published events and build metrics can reach the right people. The
+// mapping is read from a file that is reloaded while the service runs.
+package ownership
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultReloadInterval is how often the mapping file is checked for
+// changes unless configured
+const DefaultReloadInterval = 30 * time.Second
+
+// Reload results, used as metric labels
+const (
+	ReloadSuccess = "success"
+	ReloadError   = "error"
+)
+
+// Rule assigns pipelines matching any of Pipelines, path.Match patterns
+// such as "payments-*", to Team
+type Rule struct {
+	Team      string   `json:"team" yaml:"team"`
+	Pipelines []string `json:"pipelines" yaml:"pipelines"`
+}
+
+// Mapping resolves pipeline slugs to teams; the first matching rule wins
+type Mapping struct {
+	rules []Rule
+}
+
+// Parse reads a mapping from a YAML or JSON list of rules, such as
+// [{"team": "payments", "pipelines": ["payments-*", "billing-api"]}]
+func Parse(data []byte) (*Mapping, error) {
+	var rules []Rule
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse ownership mapping: %w", err)
+	}
+	for i, rule := range rules {
+		if rule.Team == "" || len(rule.Pipelines) == 0 {
+			return nil, fmt.Errorf("ownership rule %d requires a team and pipelines", i)
+		}
+		for _, pattern := range rule.Pipelines {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("ownership rule for %s has an invalid pattern %q: %w", rule.Team, pattern, err)
+			}
+		}
+	}
+	return &Mapping{rules: rules}, nil
+}
+
+// Team returns the team owning pipeline, or "" when no rule matches
+func (m *Mapping) Team(pipeline string) string {
+	if pipeline == "" {
+		return ""
+	}
+	for _, rule := range m.rules {
+		for _, pattern := range rule.Pipelines {
+			if ok, _ := path.Match(pattern, pipeline); ok {
+				return rule.Team
+			}
+		}
+	}
+	return ""
+}
+
+// Watcher serves the mapping in a file, picking up changes to it
+type Watcher struct {
+	file   string
+	logger *slog.Logger
+
+	mu      sync.RWMutex
+	mapping *Mapping
+	data    []byte
+}
+
+// NewWatcher loads the mapping in file. It fails if the file cannot be read
+// or parsed, so a broken mapping is caught at startup.
+func NewWatcher(file string, logger *slog.Logger) (*Watcher, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	w := &Watcher{file: filepath.Clean(file), logger: logger}
+	if _, err := w.Reload(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Team returns the team owning pipeline, or "" when no rule matches
+func (w *Watcher) Team(pipeline string) string {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.mapping.Team(pipeline)
+}
+
+// Reload reads the file again and reports whether the mapping changed. A
+// file that cannot be read or parsed leaves the current mapping in place.
+func (w *Watcher) Reload() (bool, error) {
+	data, err := os.ReadFile(w.file)
+	if err != nil {
+		metrics.OwnershipReloadsTotal.WithLabelValues(ReloadError).Inc()
+		return false, fmt.Errorf("failed to read ownership mapping: %w", err)
+	}
+
+	w.mu.RLock()
+	unchanged := w.mapping != nil && bytes.Equal(data, w.data)
+	w.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	mapping, err := Parse(data)
+	if err != nil {
+		metrics.OwnershipReloadsTotal.WithLabelValues(ReloadError).Inc()
+		return false, err
+	}
+	w.mu.Lock()
+	w.mapping, w.data = mapping, data
+	w.mu.Unlock()
+	metrics.OwnershipReloadsTotal.WithLabelValues(ReloadSuccess).Inc()
+	metrics.OwnershipRules.Set(float64(len(mapping.rules)))
+	return true, nil
+}
+
+// Run reloads the file every interval until ctx is done; a zero interval
+// uses DefaultReloadInterval
+func (w *Watcher) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultReloadInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := w.Reload()
+			switch {
+			case err != nil:
+				w.logger.Error("Failed to reload ownership mapping, keeping the previous one", "file", w.file, "error", err)
+			case changed:
+				w.logger.Info("Ownership mapping reloaded", "file", w.file)
+			}
+		}
+	}
+}
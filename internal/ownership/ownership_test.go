@@ -0,0 +1,150 @@
+package ownership
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const mapping = `
+- team: payments
+  pipelines: ["payments-*", "billing-api"]
+- team: platform
+  pipelines: ["*"]
+`
+
+func TestParse(t *testing.T) {
+	m, err := Parse([]byte(mapping))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	for pipeline, want := range map[string]string{
+		"payments-api": "payments",
+		"billing-api":  "payments",
+		"docs":         "platform",
+		"":             "",
+	} {
+		if got := m.Team(pipeline); got != want {
+			t.Errorf("Team(%q) = %q, want %q", pipeline, got, want)
+		}
+	}
+
+	// JSON is YAML too
+	if _, err := Parse([]byte(`[{"team":"payments","pipelines":["payments-*"]}]`)); err != nil {
+		t.Errorf("Parse(JSON) error = %v", err)
+	}
+
+	for name, data := range map[string]string{
+		"not a list":      "team: payments",
+		"missing team":    `[{"pipelines":["payments-*"]}]`,
+		"no pipelines":    `[{"team":"payments"}]`,
+		"invalid pattern": `[{"team":"payments","pipelines":["[payments"]}]`,
+	} {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("Parse() with %s error = nil, want error", name)
+		}
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	file := filepath.Join(t.TempDir(), "owners.yaml")
+	write := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+			t.Fatalf("failed to write mapping: %v", err)
+		}
+	}
+
+	if _, err := NewWatcher(file, nil); err == nil {
+		t.Error("NewWatcher() with a missing file error = nil, want error")
+	}
+
+	write(mapping)
+	w, err := NewWatcher(file, nil)
+	if err != nil {
+		t.Fatalf("NewWatcher() error = %v", err)
+	}
+	if got := w.Team("payments-api"); got != "payments" {
+		t.Errorf("Team() = %q, want payments", got)
+	}
+	if changed, err := w.Reload(); changed || err != nil {
+		t.Errorf("Reload() of an unchanged file = %v, %v, want false, nil", changed, err)
+	}
+
+	write(`[{"team":"checkout","pipelines":["payments-*"]}]`)
+	if changed, err := w.Reload(); !changed || err != nil {
+		t.Errorf("Reload() = %v, %v, want true, nil", changed, err)
+	}
+	if got := w.Team("payments-api"); got != "checkout" {
+		t.Errorf("Team() after reload = %q, want checkout", got)
+	}
+
+	// A broken edit keeps the last good mapping
+	write("- team: [")
+	if _, err := w.Reload(); err == nil {
+		t.Error("Reload() of a broken file error = nil, want error")
+	}
+	if got := w.Team("payments-api"); got != "checkout" {
+		t.Errorf("Team() after a failed reload = %q, want checkout", got)
+	}
+
+	if got := testutil.ToFloat64(metrics.OwnershipReloadsTotal.WithLabelValues(ReloadSuccess)); got != 2 {
+		t.Errorf("successful reloads = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(metrics.OwnershipReloadsTotal.WithLabelValues(ReloadError)); got != 2 {
+		t.Errorf("failed reloads = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(metrics.OwnershipRules); got != 1 {
+		t.Errorf("rules = %v, want 1", got)
+	}
+}
+
+func TestWatcherRun(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	file := filepath.Join(t.TempDir(), "owners.json")
+	if err := os.WriteFile(file, []byte(`[{"team":"payments","pipelines":["*"]}]`), 0o600); err != nil {
+		t.Fatalf("failed to write mapping: %v", err)
+	}
+	w, err := NewWatcher(file, nil)
+	if err != nil {
+		t.Fatalf("NewWatcher() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+
+	if err := os.WriteFile(file, []byte(`[{"team":"platform","pipelines":["*"]}]`), 0o600); err != nil {
+		t.Fatalf("failed to write mapping: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for w.Team("docs") != "platform" {
+		if time.Now().After(deadline) {
+			t.Fatal("Run() did not pick up the edited mapping")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run() did not stop when ctx was cancelled")
+	}
+}
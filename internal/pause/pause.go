@@ -0,0 +1,211 @@
+// Package pause lets operators stop the service accepting webhooks, for
+// example during planned Pub/Sub maintenance. Paused requests get a 503 with
+// Retry-After so Buildkite delivers them again later.
+package pause
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+)
+
+// defaultRetryAfter is sent to paused clients unless configured
+const defaultRetryAfter = time.Minute
+
+// State describes whether webhooks are accepted
+type State struct {
+	Paused bool      `json:"paused"`
+	Since  time.Time `json:"since,omitzero"`
+	Reason string    `json:"reason,omitempty"`
+	// InFlight is the number of webhooks still being handled
+	InFlight int `json:"in_flight"`
+}
+
+// Switch pauses and resumes webhook intake. When created with a state file,
+// the paused state survives restarts.
+type Switch struct {
+	stateFile  string
+	retryAfter time.Duration
+
+	mu       sync.Mutex
+	state    State
+	inFlight int
+	// idle is closed when the last in-flight webhook finishes
+	idle chan struct{}
+}
+
+// New creates a switch that accepts webhooks unless stateFile records a
+// pause. An empty stateFile keeps the state in memory only; a zero
+// retryAfter uses one minute.
+func New(stateFile string, retryAfter time.Duration) (*Switch, error) {
+	if retryAfter <= 0 {
+		retryAfter = defaultRetryAfter
+	}
+	s := &Switch{stateFile: stateFile, retryAfter: retryAfter}
+	if stateFile != "" {
+		data, err := os.ReadFile(filepath.Clean(stateFile))
+		switch {
+		case err == nil:
+			if err := json.Unmarshal(data, &s.state); err != nil {
+				return nil, fmt.Errorf("failed to parse pause state %s: %w", stateFile, err)
+			}
+		case !os.IsNotExist(err):
+			return nil, fmt.Errorf("failed to read pause state: %w", err)
+		}
+	}
+	s.recordState()
+	return s, nil
+}
+
+// Pause stops accepting webhooks. Webhooks already being handled finish.
+func (s *Switch) Pause(reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state.Paused {
+		return nil
+	}
+	state := State{Paused: true, Since: time.Now().UTC(), Reason: reason}
+	if err := s.save(state); err != nil {
+		return err
+	}
+	s.state = state
+	s.recordState()
+	return nil
+}
+
+// Resume accepts webhooks again
+func (s *Switch) Resume() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.state.Paused {
+		return nil
+	}
+	if err := s.save(State{}); err != nil {
+		return err
+	}
+	s.state = State{}
+	s.recordState()
+	return nil
+}
+
+// Drain pauses intake and waits until every in-flight webhook has been
+// handled or ctx is done
+func (s *Switch) Drain(ctx context.Context, reason string) error {
+	if err := s.Pause(reason); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	idle := s.idle
+	s.mu.Unlock()
+	if idle == nil {
+		return nil
+	}
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Paused reports whether webhooks are being rejected
+func (s *Switch) Paused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state.Paused
+}
+
+// State returns the current state
+func (s *Switch) State() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.state
+	state.InFlight = s.inFlight
+	return state
+}
+
+// Middleware rejects webhooks with 503 and Retry-After while paused and
+// tracks the webhooks in flight so Drain can wait for them
+func (s *Switch) Middleware(next http.Handler) http.Handler {
+	retryAfter := strconv.Itoa(int(math.Ceil(s.retryAfter.Seconds())))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.begin() {
+			metrics.PausedRejectionsTotal.Inc()
+			w.Header().Set("Retry-After", retryAfter)
+			http.Error(w, "Webhook intake is paused", http.StatusServiceUnavailable)
+			return
+		}
+		defer s.end()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// begin counts a webhook as in flight unless intake is paused
+func (s *Switch) begin() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state.Paused {
+		return false
+	}
+	if s.inFlight == 0 {
+		s.idle = make(chan struct{})
+	}
+	s.inFlight++
+	return true
+}
+
+// end finishes an in-flight webhook
+func (s *Switch) end() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inFlight--
+	if s.inFlight == 0 {
+		close(s.idle)
+		s.idle = nil
+	}
+}
+
+// save persists state to the state file; resuming removes the file
+func (s *Switch) save(state State) error {
+	if s.stateFile == "" {
+		return nil
+	}
+	if !state.Paused {
+		if err := os.Remove(s.stateFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove pause state: %w", err)
+		}
+		return nil
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	// Write a temporary file and rename it so a crash never leaves a
+	// truncated state file
+	tmp := s.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write pause state: %w", err)
+	}
+	if err := os.Rename(tmp, s.stateFile); err != nil {
+		return fmt.Errorf("failed to write pause state: %w", err)
+	}
+	return nil
+}
+
+// recordState updates the paused gauge; callers hold mu or own s
+func (s *Switch) recordState() {
+	paused := 0.0
+	if s.state.Paused {
+		paused = 1
+	}
+	metrics.WebhookPaused.Set(paused)
+}
@@ -0,0 +1,143 @@
+package pause
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMain(m *testing.M) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func TestMiddleware(t *testing.T) {
+	s, err := New("", 90*time.Second)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	handler := s.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/webhook", nil))
+		return w
+	}
+
+	if w := serve(); w.Code != http.StatusOK {
+		t.Fatalf("status before pause = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	before := testutil.ToFloat64(metrics.PausedRejectionsTotal)
+	if err := s.Pause("pubsub maintenance"); err != nil {
+		t.Fatalf("Pause() error = %v", err)
+	}
+	if got := testutil.ToFloat64(metrics.WebhookPaused); got != 1 {
+		t.Errorf("buildkite_webhook_paused = %v, want 1", got)
+	}
+	w := serve()
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "90" {
+		t.Errorf("paused response = %d with Retry-After %q, want 503 with 90", w.Code, w.Header().Get("Retry-After"))
+	}
+	if got := testutil.ToFloat64(metrics.PausedRejectionsTotal) - before; got != 1 {
+		t.Errorf("paused rejections = %v, want 1", got)
+	}
+	if state := s.State(); !state.Paused || state.Reason != "pubsub maintenance" || state.Since.IsZero() {
+		t.Errorf("State() = %+v, want paused with reason and time", state)
+	}
+
+	if err := s.Resume(); err != nil {
+		t.Fatalf("Resume() error = %v", err)
+	}
+	if w := serve(); w.Code != http.StatusOK {
+		t.Errorf("status after resume = %d, want %d", w.Code, http.StatusOK)
+	}
+	if got := testutil.ToFloat64(metrics.WebhookPaused); got != 0 {
+		t.Errorf("buildkite_webhook_paused = %v, want 0", got)
+	}
+}
+
+func TestDrainWaitsForInFlightWebhooks(t *testing.T) {
+	s, err := New("", 0)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := s.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/webhook", nil))
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Drain(ctx, "maintenance"); err != context.DeadlineExceeded {
+		t.Fatalf("Drain() with a webhook in flight error = %v, want deadline exceeded", err)
+	}
+	if state := s.State(); !state.Paused || state.InFlight != 1 {
+		t.Errorf("State() = %+v, want paused with one in flight", state)
+	}
+
+	close(release)
+	if err := s.Drain(context.Background(), "maintenance"); err != nil {
+		t.Fatalf("Drain() error = %v", err)
+	}
+	<-done
+	if state := s.State(); state.InFlight != 0 {
+		t.Errorf("InFlight after drain = %d, want 0", state.InFlight)
+	}
+}
+
+func TestStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pause.json")
+	s, err := New(path, 0)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := s.Pause("planned"); err != nil {
+		t.Fatalf("Pause() error = %v", err)
+	}
+
+	// A restart keeps the pause
+	restarted, err := New(path, 0)
+	if err != nil {
+		t.Fatalf("New() after restart error = %v", err)
+	}
+	if state := restarted.State(); !state.Paused || state.Reason != "planned" {
+		t.Errorf("State() after restart = %+v, want paused", state)
+	}
+
+	if err := restarted.Resume(); err != nil {
+		t.Fatalf("Resume() error = %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("state file after resume: %v, want removed", err)
+	}
+	if s, err := New(path, 0); err != nil || s.Paused() {
+		t.Errorf("New() after resume = paused %v, error %v; want accepting", s != nil && s.Paused(), err)
+	}
+
+	if err := os.WriteFile(path, []byte("paused"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(path, 0); err == nil {
+		t.Error("New() with a corrupt state file error = nil, want error")
+	}
+}
@@ -0,0 +1,150 @@
+package publisher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+)
+
+// Pub/Sub attribute limits
+const (
+	MaxAttributes          = 100
+	MaxAttributeKeyBytes   = 256
+	MaxAttributeValueBytes = 1024
+)
+
+// Attribute sanitization actions, used as metric labels
+const (
+	AttributeTruncated = "truncated"
+	AttributeRenamed   = "renamed"
+	AttributeDropped   = "dropped"
+)
+
+// truncatedHashLen is the number of hex characters of the value's hash kept
+// after a truncated value, so distinct long values stay distinguishable
+const truncatedHashLen = 8
+
+// SanitizeAttributes returns attributes that Pub/Sub will accept. Values over
+// the size limit are truncated with a hash suffix, invalid characters in keys
+// are replaced with underscores, and attributes that cannot be kept, are not
+// in a non-empty allow-list, or exceed the attribute count are dropped. Every
+// change is counted in metrics.
+func SanitizeAttributes(attributes map[string]string, allow map[string]bool) map[string]string {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	// Sort so the same attributes are kept when the count limit is hit
+	sort.Strings(keys)
+
+	result := make(map[string]string, len(attributes))
+	for _, key := range keys {
+		value := attributes[key]
+
+		if len(allow) > 0 && !allow[key] {
+			recordAttributeChange(key, AttributeDropped)
+			continue
+		}
+
+		name := sanitizeAttributeKey(key)
+		if name == "" || len(name) > MaxAttributeKeyBytes || len(result) >= MaxAttributes {
+			recordAttributeChange(key, AttributeDropped)
+			continue
+		}
+		if _, exists := result[name]; exists {
+			recordAttributeChange(key, AttributeDropped)
+			continue
+		}
+		if name != key {
+			recordAttributeChange(key, AttributeRenamed)
+		}
+
+		if len(value) > MaxAttributeValueBytes || !utf8.ValidString(value) {
+			value = truncateAttributeValue(value)
+			recordAttributeChange(key, AttributeTruncated)
+		}
+		result[name] = value
+	}
+	return result
+}
+
+// sanitizeAttributeKey replaces characters Pub/Sub filters cannot reference
+// and avoids the reserved "goog" prefix
+func sanitizeAttributeKey(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+	if strings.HasPrefix(strings.ToLower(name), "goog") {
+		name = "x_" + name
+	}
+	return name
+}
+
+// truncateAttributeValue cuts value to the size limit on a UTF-8 boundary and
+// appends a short hash of the full value
+func truncateAttributeValue(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	suffix := "~" + hex.EncodeToString(sum[:])[:truncatedHashLen]
+
+	value = strings.ToValidUTF8(value, "")
+	if len(value) <= MaxAttributeValueBytes {
+		return value
+	}
+	cut := MaxAttributeValueBytes - len(suffix)
+	for cut > 0 && !utf8.RuneStart(value[cut]) {
+		cut--
+	}
+	return value[:cut] + suffix
+}
+
+func recordAttributeChange(key, action string) {
+	metrics.PubsubAttributesSanitizedTotal.WithLabelValues(key, action).Inc()
+}
+
+// AttributeGuardPublisher sanitizes attributes before publishing, so an
+// oversized branch name or an unexpected key does not fail the publish
+type AttributeGuardPublisher struct {
+	publisher Publisher
+	allow     map[string]bool
+}
+
+// NewAttributeGuardPublisher wraps pub. When allowList is non-empty only
+// those attribute keys are published.
+func NewAttributeGuardPublisher(pub Publisher, allowList []string) *AttributeGuardPublisher {
+	var allow map[string]bool
+	if len(allowList) > 0 {
+		allow = make(map[string]bool, len(allowList))
+		for _, key := range allowList {
+			allow[key] = true
+		}
+	}
+	return &AttributeGuardPublisher{
+		publisher: pub,
+		allow:     allow,
+	}
+}
+
+// Publish publishes with sanitized attributes
+func (g *AttributeGuardPublisher) Publish(ctx context.Context, data interface{}, attributes map[string]string) (string, error) {
+	return g.publisher.Publish(ctx, data, SanitizeAttributes(attributes, g.allow))
+}
+
+// PublishWithResult is Publish, returning the wrapped publisher's result
+func (g *AttributeGuardPublisher) PublishWithResult(ctx context.Context, data interface{}, attributes map[string]string) (PublishResult, error) {
+	return PublishWithResult(ctx, g.publisher, data, SanitizeAttributes(attributes, g.allow))
+}
+
+// Close closes the wrapped publisher
+func (g *AttributeGuardPublisher) Close() error {
+	return g.publisher.Close()
+}
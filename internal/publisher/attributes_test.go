@@ -0,0 +1,108 @@
+package publisher
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSanitizeAttributes(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	longBranch := "feature/" + strings.Repeat("é", 600)
+	got := SanitizeAttributes(map[string]string{
+		"event_type":    "build.finished",
+		"branch":        longBranch,
+		"pipeline name": "deploy",
+		"goog-internal": "x",
+		"":              "empty key",
+	}, nil)
+
+	if got["event_type"] != "build.finished" {
+		t.Errorf("event_type = %q, want unchanged", got["event_type"])
+	}
+
+	branch := got["branch"]
+	if len(branch) > MaxAttributeValueBytes || !utf8.ValidString(branch) {
+		t.Errorf("branch is %d bytes (valid UTF-8: %v), want at most %d", len(branch), utf8.ValidString(branch), MaxAttributeValueBytes)
+	}
+	if !strings.HasPrefix(branch, "feature/é") || !strings.Contains(branch, "~") {
+		t.Errorf("branch = %q, want a truncated prefix with a hash suffix", branch[:20])
+	}
+	other := SanitizeAttributes(map[string]string{"branch": longBranch + "x"}, nil)["branch"]
+	if other == branch {
+		t.Error("different long values truncated to the same attribute")
+	}
+
+	if got["pipeline_name"] != "deploy" {
+		t.Errorf("pipeline_name = %q, want renamed attribute", got["pipeline_name"])
+	}
+	if got["x_goog-internal"] != "x" {
+		t.Errorf("attributes = %v, want reserved goog prefix renamed", got)
+	}
+	if _, ok := got[""]; ok {
+		t.Error("empty key was kept")
+	}
+	if len(got) != 4 {
+		t.Errorf("got %d attributes, want 4: %v", len(got), got)
+	}
+
+	if v := counterValue(t, metrics.PubsubAttributesSanitizedTotal.WithLabelValues("branch", AttributeTruncated)); v != 2 {
+		t.Errorf("truncated{branch} = %v, want 2", v)
+	}
+	if v := counterValue(t, metrics.PubsubAttributesSanitizedTotal.WithLabelValues("pipeline name", AttributeRenamed)); v != 1 {
+		t.Errorf("renamed{pipeline name} = %v, want 1", v)
+	}
+}
+
+func TestSanitizeAttributesLimits(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	attrs := make(map[string]string)
+	for i := 0; i < MaxAttributes+10; i++ {
+		attrs[strings.Repeat("k", 3)+string(rune('a'+i%26))+strings.Repeat("z", i/26)] = "v"
+	}
+	attrs[strings.Repeat("k", MaxAttributeKeyBytes+1)] = "v"
+
+	if got := SanitizeAttributes(attrs, nil); len(got) != MaxAttributes {
+		t.Errorf("got %d attributes, want %d", len(got), MaxAttributes)
+	}
+
+	allowed := SanitizeAttributes(map[string]string{"event_type": "build.finished", "branch": "main"}, map[string]bool{"event_type": true})
+	if len(allowed) != 1 || allowed["event_type"] != "build.finished" {
+		t.Errorf("allow-listed attributes = %v, want only event_type", allowed)
+	}
+}
+
+func TestAttributeGuardPublisher(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	mock := NewMockPublisher().(*MockPublisher)
+	pub := NewAttributeGuardPublisher(mock, []string{"event_type", "branch"})
+
+	if _, err := pub.Publish(context.Background(), "data", map[string]string{
+		"event_type": "build.finished",
+		"branch":     strings.Repeat("b", 2000),
+		"pipeline":   "deploy",
+	}); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	attrs := mock.LastPublished().Attributes
+	if _, ok := attrs["pipeline"]; ok {
+		t.Error("attribute outside the allow-list was published")
+	}
+	if len(attrs["branch"]) != MaxAttributeValueBytes {
+		t.Errorf("branch is %d bytes, want %d", len(attrs["branch"]), MaxAttributeValueBytes)
+	}
+}
@@ -0,0 +1,195 @@
+package publisher
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/errors"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+)
+
+// ErrQueueFull is returned when too many publishes are already pending
+var ErrQueueFull = fmt.Errorf("%w: publish queue full", errors.ErrRateLimit)
+
+const (
+	// saturationRatio is the share of capacity at which the queue reports
+	// itself saturated, so load balancers back off before requests are rejected
+	saturationRatio = 0.9
+	// minRetryAfter and maxRetryAfter bound the suggested retry delay
+	minRetryAfter = time.Second
+	maxRetryAfter = time.Minute
+	// drainSmoothing weights the latest completion interval in the drain rate
+	drainSmoothing = 0.2
+)
+
+// BackpressurePublisher bounds the number of pending publishes. When the
+// bound is reached it rejects publishes with ErrQueueFull and a retry delay
+// estimated from the current depth and how fast publishes complete.
+//
+// With a priority classifier, only low-priority publishes are rejected.
+// High-priority publishes wait in order for a free slot, and a freed slot
+// always goes to a waiting high-priority publish first.
+type BackpressurePublisher struct {
+	publisher Publisher
+	capacity  int
+	classify  *PriorityClassifier
+
+	mu             sync.Mutex
+	pending        int
+	waiting        []chan struct{} // high-priority publishes waiting for a slot
+	drainInterval  time.Duration   // smoothed time between completions
+	lastCompletion time.Time
+}
+
+// NewBackpressurePublisher wraps pub, allowing at most capacity pending publishes
+func NewBackpressurePublisher(pub Publisher, capacity int) *BackpressurePublisher {
+	return &BackpressurePublisher{
+		publisher: pub,
+		capacity:  capacity,
+	}
+}
+
+// NewPriorityBackpressurePublisher wraps pub like NewBackpressurePublisher,
+// but sheds only publishes that classify reports as low priority. A nil
+// classify treats every publish as low priority.
+func NewPriorityBackpressurePublisher(pub Publisher, capacity int, classify *PriorityClassifier) *BackpressurePublisher {
+	b := NewBackpressurePublisher(pub, capacity)
+	b.classify = classify
+	return b
+}
+
+// Publish publishes unless the queue is full. A high-priority publish waits
+// for a slot until ctx is done instead.
+func (b *BackpressurePublisher) Publish(ctx context.Context, data interface{}, attributes map[string]string) (string, error) {
+	result, err := b.PublishWithResult(ctx, data, attributes)
+	return result.MessageID, err
+}
+
+// PublishWithResult is Publish, returning the wrapped publisher's result
+func (b *BackpressurePublisher) PublishWithResult(ctx context.Context, data interface{}, attributes map[string]string) (PublishResult, error) {
+	if err := b.acquire(ctx, attributes); err != nil {
+		return PublishResult{}, err
+	}
+	defer b.complete()
+	return PublishWithResult(ctx, b.publisher, data, attributes)
+}
+
+// acquire takes a slot in the queue, waiting for one if the publish is high priority
+func (b *BackpressurePublisher) acquire(ctx context.Context, attributes map[string]string) error {
+	priority := PriorityLow
+	if b.classify != nil {
+		priority = b.classify.ClassifyAttributes(attributes)
+	}
+
+	b.mu.Lock()
+	// Low-priority publishes never overtake waiting high-priority ones
+	if b.pending < b.capacity && len(b.waiting) == 0 {
+		b.pending++
+		metrics.PublishQueueDepth.Set(float64(b.pending))
+		b.mu.Unlock()
+		return nil
+	}
+	if priority == PriorityLow {
+		retryAfter := b.retryAfterLocked()
+		b.mu.Unlock()
+		metrics.PublishQueueRejectionsTotal.Inc()
+		return errors.WithRetryAfter(ErrQueueFull, retryAfter)
+	}
+
+	ready := make(chan struct{})
+	b.waiting = append(b.waiting, ready)
+	metrics.PublishQueueWaiting.Set(float64(len(b.waiting)))
+	b.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		select {
+		case <-ready:
+			// The slot was handed over as ctx ended; give it back
+			b.releaseLocked()
+		default:
+			b.waiting = slices.DeleteFunc(b.waiting, func(c chan struct{}) bool { return c == ready })
+			metrics.PublishQueueWaiting.Set(float64(len(b.waiting)))
+		}
+		return ctx.Err()
+	}
+}
+
+// complete records a finished publish and updates the drain rate
+func (b *BackpressurePublisher) complete() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if !b.lastCompletion.IsZero() {
+		interval := now.Sub(b.lastCompletion)
+		if b.drainInterval == 0 {
+			b.drainInterval = interval
+		} else {
+			b.drainInterval = time.Duration(drainSmoothing*float64(interval) + (1-drainSmoothing)*float64(b.drainInterval))
+		}
+	}
+	b.lastCompletion = now
+	b.releaseLocked()
+}
+
+// releaseLocked hands a freed slot to the first waiting high-priority
+// publish, or frees it; callers hold b.mu
+func (b *BackpressurePublisher) releaseLocked() {
+	if len(b.waiting) > 0 {
+		close(b.waiting[0])
+		b.waiting = b.waiting[1:]
+		metrics.PublishQueueWaiting.Set(float64(len(b.waiting)))
+		return
+	}
+	b.pending--
+	metrics.PublishQueueDepth.Set(float64(b.pending))
+}
+
+// Depth returns the number of pending publishes
+func (b *BackpressurePublisher) Depth() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.pending
+}
+
+// Saturated reports whether the queue is close enough to capacity that new
+// traffic should be sent elsewhere
+func (b *BackpressurePublisher) Saturated() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return float64(b.pending) >= saturationRatio*float64(b.capacity)
+}
+
+// RetryAfter estimates how long the current queue takes to drain
+func (b *BackpressurePublisher) RetryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.retryAfterLocked()
+}
+
+// retryAfterLocked estimates the drain time from the depth and the smoothed
+// completion interval; callers hold b.mu
+func (b *BackpressurePublisher) retryAfterLocked() time.Duration {
+	if b.lastCompletion.IsZero() {
+		return maxRetryAfter
+	}
+	// Stalled publishes slow the drain rate even before they complete
+	interval := max(b.drainInterval, time.Since(b.lastCompletion)/time.Duration(max(b.pending, 1)))
+	estimate := time.Duration(b.pending) * interval
+	seconds := math.Ceil(estimate.Seconds())
+	return min(max(time.Duration(seconds)*time.Second, minRetryAfter), maxRetryAfter)
+}
+
+// Close closes the wrapped publisher
+func (b *BackpressurePublisher) Close() error {
+	return b.publisher.Close()
+}
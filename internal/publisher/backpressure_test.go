@@ -0,0 +1,100 @@
+package publisher
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/errors"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// blockingPublisher holds every publish until release is closed
+type blockingPublisher struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingPublisher) Publish(ctx context.Context, data interface{}, attributes map[string]string) (string, error) {
+	b.started <- struct{}{}
+	<-b.release
+	return "msg-id", nil
+}
+
+func (b *blockingPublisher) Close() error {
+	return nil
+}
+
+func TestBackpressurePublisher(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	inner := &blockingPublisher{started: make(chan struct{}, 10), release: make(chan struct{})}
+	bp := NewBackpressurePublisher(inner, 2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := bp.Publish(context.Background(), "data", nil); err != nil {
+				t.Errorf("Publish() error = %v", err)
+			}
+		}()
+		<-inner.started
+	}
+
+	if got := bp.Depth(); got != 2 {
+		t.Errorf("Depth() = %d, want 2", got)
+	}
+	if !bp.Saturated() {
+		t.Error("Saturated() = false at capacity, want true")
+	}
+
+	_, err := bp.Publish(context.Background(), "data", nil)
+	if !errors.Is(err, ErrQueueFull) || !errors.IsRateLimitError(err) {
+		t.Fatalf("Publish() error = %v, want ErrQueueFull", err)
+	}
+	// Nothing has completed yet, so the drain rate is unknown
+	if delay, ok := errors.RetryAfter(err); !ok || delay != maxRetryAfter {
+		t.Errorf("RetryAfter = %v, %v, want %v", delay, ok, maxRetryAfter)
+	}
+
+	close(inner.release)
+	wg.Wait()
+
+	if got := bp.Depth(); got != 0 {
+		t.Errorf("Depth() after drain = %d, want 0", got)
+	}
+	if bp.Saturated() {
+		t.Error("Saturated() = true after drain, want false")
+	}
+}
+
+func TestBackpressureRetryAfterFromDrainRate(t *testing.T) {
+	bp := NewBackpressurePublisher(NewMockPublisher(), 100)
+
+	bp.pending = 20
+	bp.drainInterval = 500 * time.Millisecond
+	bp.lastCompletion = time.Now()
+
+	// 20 pending publishes completing every 500ms drain in 10 seconds
+	if got := bp.RetryAfter(); got != 10*time.Second {
+		t.Errorf("RetryAfter() = %v, want 10s", got)
+	}
+
+	bp.pending = 1
+	bp.drainInterval = time.Millisecond
+	if got := bp.RetryAfter(); got != minRetryAfter {
+		t.Errorf("RetryAfter() = %v, want %v", got, minRetryAfter)
+	}
+
+	bp.pending = 1000
+	bp.drainInterval = time.Second
+	if got := bp.RetryAfter(); got != maxRetryAfter {
+		t.Errorf("RetryAfter() = %v, want %v", got, maxRetryAfter)
+	}
+}
@@ -0,0 +1,301 @@
+package publisher
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/clock"
+	"github.com/mcncl/buildkite-pubsub/internal/errors"
+)
+
+// ErrCircuitOpen is returned when the circuit breaker rejects a publish
+var ErrCircuitOpen = fmt.Errorf("%w: circuit breaker open", errors.ErrConnection)
+
+// ErrCircuitTripped is joined to a publish failure after which the circuit
+// breaker is open, so a retry before its open timeout would only be
+// rejected with ErrCircuitOpen. The failure keeps its own classification.
+var ErrCircuitTripped = fmt.Errorf("circuit breaker opened")
+
+// CircuitState is the state of a CircuitBreaker
+type CircuitState int
+
+const (
+	// CircuitClosed lets all requests through
+	CircuitClosed CircuitState = iota
+	// CircuitOpen rejects requests until the open timeout elapses
+	CircuitOpen
+	// CircuitHalfOpen lets a single probe request through
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitBreakerConfig configures a CircuitBreaker
+type CircuitBreakerConfig struct {
+	// FailureThreshold is the number of consecutive failures that opens the circuit
+	FailureThreshold int
+	// OpenTimeout is how long the circuit stays open before allowing a probe
+	OpenTimeout time.Duration
+	// OnStateChange is called after every state transition
+	OnStateChange func(from, to CircuitState)
+	// Clock times the open timeout; nil uses the system clock
+	Clock clock.Clock
+	// Store optionally saves the state on every transition and restores
+	// it when the breaker is created, so a restart during an outage
+	// resumes an open or half-open circuit
+	Store CircuitStateStore
+	// StoreTTL is how long a saved state applies; zero uses ten times
+	// OpenTimeout
+	StoreTTL time.Duration
+	// OnStoreError is called when the state cannot be loaded or saved; the
+	// breaker carries on with its state in memory
+	OnStoreError func(error)
+}
+
+// circuitStoreTimeout bounds each load and save of the circuit state
+const circuitStoreTimeout = 2 * time.Second
+
+// CircuitBreaker stops calls to a failing dependency after sustained errors
+// and periodically probes it to detect recovery
+type CircuitBreaker struct {
+	mu            sync.Mutex
+	cfg           CircuitBreakerConfig
+	state         CircuitState
+	failures      int
+	openedAt      time.Time
+	probeInFlight bool
+	// unsaved is set when the state changed since it was last saved
+	unsaved bool
+	// saveMu serializes saves so the last one holds the latest state
+	saveMu sync.Mutex
+}
+
+// NewCircuitBreaker creates a circuit breaker, closed unless cfg.Store holds
+// an unexpired open or half-open state. Zero values in cfg use defaults of 5
+// failures and a 30 second open timeout.
+func NewCircuitBreaker(cfg CircuitBreakerConfig) *CircuitBreaker {
+	if cfg.FailureThreshold <= 0 {
+		cfg.FailureThreshold = 5
+	}
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = 30 * time.Second
+	}
+	if cfg.StoreTTL <= 0 {
+		cfg.StoreTTL = 10 * cfg.OpenTimeout
+	}
+	cfg.Clock = clock.OrReal(cfg.Clock)
+	cb := &CircuitBreaker{cfg: cfg}
+	cb.restore()
+	return cb
+}
+
+// restore resumes the saved state, if it has not expired
+func (cb *CircuitBreaker) restore() {
+	if cb.cfg.Store == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), circuitStoreTimeout)
+	defer cancel()
+	snapshot, ok, err := cb.cfg.Store.Load(ctx)
+	if err != nil {
+		cb.storeError(err)
+		return
+	}
+	if !ok || snapshot.State == CircuitClosed || !cb.cfg.Clock.Now().Before(snapshot.ExpiresAt) {
+		return
+	}
+	cb.openedAt = snapshot.OpenedAt
+	cb.transition(snapshot.State)
+	// The restored state is already saved
+	cb.unsaved = false
+}
+
+// persist saves the state if it changed; callers must not hold cb.mu
+func (cb *CircuitBreaker) persist() {
+	if cb.cfg.Store == nil {
+		return
+	}
+	cb.saveMu.Lock()
+	defer cb.saveMu.Unlock()
+
+	cb.mu.Lock()
+	if !cb.unsaved {
+		cb.mu.Unlock()
+		return
+	}
+	snapshot := CircuitSnapshot{
+		State:     cb.state,
+		OpenedAt:  cb.openedAt,
+		ExpiresAt: cb.cfg.Clock.Now().Add(cb.cfg.StoreTTL),
+	}
+	cb.unsaved = false
+	cb.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), circuitStoreTimeout)
+	defer cancel()
+	if err := cb.cfg.Store.Save(ctx, snapshot); err != nil {
+		cb.storeError(err)
+	}
+}
+
+// storeError reports a failure to load or save the state
+func (cb *CircuitBreaker) storeError(err error) {
+	if cb.cfg.OnStoreError != nil {
+		cb.cfg.OnStoreError(err)
+	}
+}
+
+// Allow reports whether a request may proceed. Once the open timeout has
+// elapsed it moves the circuit to half-open and admits a single probe.
+func (cb *CircuitBreaker) Allow() bool {
+	allowed := cb.allow()
+	cb.persist()
+	return allowed
+}
+
+// allow is Allow without saving the state
+func (cb *CircuitBreaker) allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case CircuitOpen:
+		if cb.cfg.Clock.Since(cb.openedAt) < cb.cfg.OpenTimeout {
+			return false
+		}
+		cb.transition(CircuitHalfOpen)
+		cb.probeInFlight = true
+		return true
+	case CircuitHalfOpen:
+		if cb.probeInFlight {
+			return false
+		}
+		cb.probeInFlight = true
+		return true
+	default:
+		return true
+	}
+}
+
+// RecordSuccess records a successful request, closing a half-open circuit
+func (cb *CircuitBreaker) RecordSuccess() {
+	defer cb.persist()
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures = 0
+	cb.probeInFlight = false
+	if cb.state != CircuitClosed {
+		cb.transition(CircuitClosed)
+	}
+}
+
+// RecordFailure records a failed request, opening the circuit when the
+// threshold is reached or when a half-open probe fails
+func (cb *CircuitBreaker) RecordFailure() {
+	defer cb.persist()
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures++
+	cb.probeInFlight = false
+	if cb.state == CircuitHalfOpen || (cb.state == CircuitClosed && cb.failures >= cb.cfg.FailureThreshold) {
+		cb.openedAt = cb.cfg.Clock.Now()
+		cb.transition(CircuitOpen)
+	}
+}
+
+// RecordResult records the outcome of a request that err ended: a success,
+// a failure when a retry could succeed, and otherwise neither. A rejected
+// message, such as an oversized one, says nothing about the target's
+// health, so it only frees a half-open probe.
+func (cb *CircuitBreaker) RecordResult(err error) {
+	switch {
+	case err == nil:
+		cb.RecordSuccess()
+	case errors.IsRetryable(err):
+		cb.RecordFailure()
+	default:
+		cb.mu.Lock()
+		cb.probeInFlight = false
+		cb.mu.Unlock()
+	}
+}
+
+// State returns the current circuit state
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// transition changes state and notifies the callback; callers hold cb.mu
+func (cb *CircuitBreaker) transition(to CircuitState) {
+	from := cb.state
+	cb.state = to
+	cb.unsaved = cb.unsaved || from != to
+	if cb.cfg.OnStateChange != nil && from != to {
+		cb.cfg.OnStateChange(from, to)
+	}
+}
+
+// CircuitBreakerPublisher wraps a Publisher with a CircuitBreaker
+type CircuitBreakerPublisher struct {
+	publisher Publisher
+	breaker   *CircuitBreaker
+}
+
+// NewCircuitBreakerPublisher creates a publisher that fails fast with
+// ErrCircuitOpen while the breaker is open
+func NewCircuitBreakerPublisher(pub Publisher, breaker *CircuitBreaker) *CircuitBreakerPublisher {
+	return &CircuitBreakerPublisher{
+		publisher: pub,
+		breaker:   breaker,
+	}
+}
+
+// Publish publishes through the wrapped publisher when the breaker allows it
+func (p *CircuitBreakerPublisher) Publish(ctx context.Context, data interface{}, attributes map[string]string) (string, error) {
+	result, err := p.PublishWithResult(ctx, data, attributes)
+	return result.MessageID, err
+}
+
+// PublishWithResult is Publish, returning the wrapped publisher's result
+func (p *CircuitBreakerPublisher) PublishWithResult(ctx context.Context, data interface{}, attributes map[string]string) (PublishResult, error) {
+	if !p.breaker.Allow() {
+		return PublishResult{}, ErrCircuitOpen
+	}
+
+	result, err := PublishWithResult(ctx, p.publisher, data, attributes)
+	p.breaker.RecordResult(err)
+	if err != nil {
+		if p.breaker.State() == CircuitOpen {
+			return PublishResult{}, fmt.Errorf("%w: %w", err, ErrCircuitTripped)
+		}
+		return PublishResult{}, err
+	}
+	return result, nil
+}
+
+// Close closes the wrapped publisher
+func (p *CircuitBreakerPublisher) Close() error {
+	return p.publisher.Close()
+}
+
+// Breaker returns the circuit breaker guarding the publisher
+func (p *CircuitBreakerPublisher) Breaker() *CircuitBreaker {
+	return p.breaker
+}
@@ -0,0 +1,156 @@
+package publisher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/clock"
+	"github.com/mcncl/buildkite-pubsub/internal/errors"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var transitions []string
+	clk := clock.NewFake(time.Now())
+	cb := NewCircuitBreaker(CircuitBreakerConfig{
+		FailureThreshold: 3,
+		OpenTimeout:      20 * time.Second,
+		Clock:            clk,
+		OnStateChange: func(from, to CircuitState) {
+			transitions = append(transitions, from.String()+"->"+to.String())
+		},
+	})
+
+	// Failures below the threshold keep the circuit closed
+	for i := 0; i < 2; i++ {
+		if !cb.Allow() {
+			t.Fatalf("Allow() = false before threshold reached")
+		}
+		cb.RecordFailure()
+	}
+	if cb.State() != CircuitClosed {
+		t.Fatalf("State() = %v, want closed", cb.State())
+	}
+
+	// A success resets the consecutive failure count
+	cb.RecordSuccess()
+	for i := 0; i < 3; i++ {
+		cb.RecordFailure()
+	}
+	if cb.State() != CircuitOpen {
+		t.Fatalf("State() = %v, want open", cb.State())
+	}
+	if cb.Allow() {
+		t.Error("Allow() = true while circuit is open")
+	}
+
+	// After the timeout a single probe is admitted
+	clk.Advance(19 * time.Second)
+	if cb.Allow() {
+		t.Error("Allow() = true before open timeout")
+	}
+	clk.Advance(time.Second)
+	if !cb.Allow() {
+		t.Fatal("Allow() = false after open timeout, want probe")
+	}
+	if cb.State() != CircuitHalfOpen {
+		t.Fatalf("State() = %v, want half-open", cb.State())
+	}
+	if cb.Allow() {
+		t.Error("Allow() = true for second request while probe in flight")
+	}
+
+	// A failed probe re-opens the circuit
+	cb.RecordFailure()
+	if cb.State() != CircuitOpen {
+		t.Fatalf("State() = %v after failed probe, want open", cb.State())
+	}
+
+	// A successful probe closes it
+	clk.Advance(20 * time.Second)
+	if !cb.Allow() {
+		t.Fatal("Allow() = false after second open timeout")
+	}
+	cb.RecordSuccess()
+	if cb.State() != CircuitClosed {
+		t.Fatalf("State() = %v after successful probe, want closed", cb.State())
+	}
+
+	want := []string{"closed->open", "open->half-open", "half-open->open", "open->half-open", "half-open->closed"}
+	if len(transitions) != len(want) {
+		t.Fatalf("transitions = %v, want %v", transitions, want)
+	}
+	for i := range want {
+		if transitions[i] != want[i] {
+			t.Errorf("transition %d = %s, want %s", i, transitions[i], want[i])
+		}
+	}
+}
+
+func TestCircuitBreakerPublisher(t *testing.T) {
+	mock := NewMockPublisher().(*MockPublisher)
+	mock.SetError(errors.NewConnectionError("unavailable"))
+
+	pub := NewCircuitBreakerPublisher(mock, NewCircuitBreaker(CircuitBreakerConfig{
+		FailureThreshold: 2,
+		OpenTimeout:      time.Minute,
+	}))
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		_, err := pub.Publish(ctx, "data", nil)
+		if err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("Publish() attempt %d error = %v, want publisher error", i, err)
+		}
+		// Only the failure that opens the circuit is marked as tripping it
+		if tripped := errors.Is(err, ErrCircuitTripped); tripped != (i == 1) {
+			t.Errorf("Publish() attempt %d tripped = %v, want %v", i, tripped, i == 1)
+		}
+	}
+
+	mock.SetError(nil)
+	if _, err := pub.Publish(ctx, "data", nil); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Publish() error = %v, want ErrCircuitOpen", err)
+	}
+	if len(mock.GetPublished()) != 0 {
+		t.Errorf("publisher called %d times while circuit open", len(mock.GetPublished()))
+	}
+}
+
+func TestCircuitBreakerPublisherIgnoresRejectedMessages(t *testing.T) {
+	mock := NewMockPublisher().(*MockPublisher)
+	clk := clock.NewFake(time.Now())
+	breaker := NewCircuitBreaker(CircuitBreakerConfig{
+		FailureThreshold: 2,
+		OpenTimeout:      time.Minute,
+		Clock:            clk,
+	})
+	pub := NewCircuitBreakerPublisher(mock, breaker)
+	ctx := context.Background()
+
+	// Messages the topic rejects leave a healthy topic's circuit closed
+	mock.SetError(errors.NewValidationError("message too large"))
+	for i := 0; i < 5; i++ {
+		if _, err := pub.Publish(ctx, "data", nil); !errors.IsValidationError(err) || errors.Is(err, ErrCircuitTripped) {
+			t.Fatalf("Publish() attempt %d error = %v, want the validation error alone", i, err)
+		}
+	}
+	if got := breaker.State(); got != CircuitClosed {
+		t.Fatalf("State() = %v after rejected messages, want closed", got)
+	}
+
+	// A rejected half-open probe frees the probe for the next publish
+	breaker.RecordFailure()
+	breaker.RecordFailure()
+	clk.Advance(time.Minute)
+	if _, err := pub.Publish(ctx, "data", nil); !errors.IsValidationError(err) {
+		t.Fatalf("probe error = %v, want the validation error", err)
+	}
+	mock.SetError(nil)
+	if _, err := pub.Publish(ctx, "data", nil); err != nil {
+		t.Fatalf("Publish() after a rejected probe error = %v", err)
+	}
+	if got := breaker.State(); got != CircuitClosed {
+		t.Errorf("State() = %v after a successful probe, want closed", got)
+	}
+}
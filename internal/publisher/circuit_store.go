@@ -0,0 +1,147 @@
+package publisher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// CircuitSnapshot is the saved state of a circuit breaker
+type CircuitSnapshot struct {
+	State CircuitState `json:"state"`
+	// OpenedAt is when the circuit last opened
+	OpenedAt time.Time `json:"opened_at"`
+	// ExpiresAt is when the snapshot stops applying, so a restart long
+	// after an outage starts closed
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// CircuitStateStore saves a circuit breaker's state so a restarted instance
+// resumes an open or half-open circuit instead of starting closed during an
+// outage
+type CircuitStateStore interface {
+	// Load returns the saved snapshot; ok is false when none was saved
+	Load(ctx context.Context) (snapshot CircuitSnapshot, ok bool, err error)
+	// Save replaces the saved snapshot
+	Save(ctx context.Context, snapshot CircuitSnapshot) error
+}
+
+// NewCircuitStateStore creates a store from a redis:// or rediss:// URL, kept
+// under key, or otherwise a file path
+func NewCircuitStateStore(location, key string) (CircuitStateStore, error) {
+	if strings.HasPrefix(location, "redis://") || strings.HasPrefix(location, "rediss://") {
+		return NewRedisCircuitStore(location, key)
+	}
+	return NewFileCircuitStore(location), nil
+}
+
+// FileCircuitStore keeps a snapshot in a JSON file, such as on a volume that
+// outlives the pod
+type FileCircuitStore struct {
+	path string
+}
+
+// NewFileCircuitStore creates a store writing the snapshot to path
+func NewFileCircuitStore(path string) *FileCircuitStore {
+	return &FileCircuitStore{path: path}
+}
+
+// Load implements CircuitStateStore
+func (f *FileCircuitStore) Load(ctx context.Context) (CircuitSnapshot, bool, error) {
+	data, err := os.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return CircuitSnapshot{}, false, nil
+	}
+	if err != nil {
+		return CircuitSnapshot{}, false, fmt.Errorf("failed to read circuit state: %w", err)
+	}
+	var snapshot CircuitSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return CircuitSnapshot{}, false, fmt.Errorf("failed to decode circuit state: %w", err)
+	}
+	return snapshot, true, nil
+}
+
+// Save implements CircuitStateStore, replacing the file atomically so a
+// crash mid-write leaves the previous snapshot
+func (f *FileCircuitStore) Save(ctx context.Context, snapshot CircuitSnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to encode circuit state: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to write circuit state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write circuit state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write circuit state: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("failed to write circuit state: %w", err)
+	}
+	return nil
+}
+
+// redisCircuitKeyPrefix namespaces circuit state keys in a shared Redis
+const redisCircuitKeyPrefix = "buildkite-pubsub:circuit:"
+
+// RedisCircuitStore keeps a snapshot in Redis, expiring with it
+type RedisCircuitStore struct {
+	client *redis.Client
+	key    string
+}
+
+// NewRedisCircuitStore creates a store from a redis:// or rediss:// URL,
+// keeping the snapshot under key
+func NewRedisCircuitStore(url, key string) (*RedisCircuitStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis URL: %w", err)
+	}
+	return &RedisCircuitStore{client: redis.NewClient(opts), key: redisCircuitKeyPrefix + key}, nil
+}
+
+// Load implements CircuitStateStore
+func (r *RedisCircuitStore) Load(ctx context.Context) (CircuitSnapshot, bool, error) {
+	data, err := r.client.Get(ctx, r.key).Bytes()
+	if err == redis.Nil {
+		return CircuitSnapshot{}, false, nil
+	}
+	if err != nil {
+		return CircuitSnapshot{}, false, fmt.Errorf("failed to read circuit state: %w", err)
+	}
+	var snapshot CircuitSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return CircuitSnapshot{}, false, fmt.Errorf("failed to decode circuit state: %w", err)
+	}
+	return snapshot, true, nil
+}
+
+// Save implements CircuitStateStore; the key expires with the snapshot
+func (r *RedisCircuitStore) Save(ctx context.Context, snapshot CircuitSnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to encode circuit state: %w", err)
+	}
+	ttl := max(time.Until(snapshot.ExpiresAt), time.Second)
+	if err := r.client.Set(ctx, r.key, data, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to save circuit state: %w", err)
+	}
+	return nil
+}
+
+// Close closes the Redis client
+func (r *RedisCircuitStore) Close() error {
+	return r.client.Close()
+}
@@ -0,0 +1,111 @@
+package publisher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/mcncl/buildkite-pubsub/internal/clock"
+)
+
+func TestCircuitBreakerStore(t *testing.T) {
+	stores := map[string]func(t *testing.T) CircuitStateStore{
+		"file": func(t *testing.T) CircuitStateStore {
+			return NewFileCircuitStore(filepath.Join(t.TempDir(), "circuit.json"))
+		},
+		"redis": func(t *testing.T) CircuitStateStore {
+			srv := miniredis.RunT(t)
+			store, err := NewCircuitStateStore("redis://"+srv.Addr(), "pubsub")
+			if err != nil {
+				t.Fatalf("NewCircuitStateStore() error = %v", err)
+			}
+			t.Cleanup(func() { _ = store.(*RedisCircuitStore).Close() })
+			return store
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			clk := clock.NewFake(time.Now())
+			newBreaker := func() *CircuitBreaker {
+				return NewCircuitBreaker(CircuitBreakerConfig{
+					FailureThreshold: 2,
+					OpenTimeout:      30 * time.Second,
+					StoreTTL:         5 * time.Minute,
+					Clock:            clk,
+					Store:            store,
+					OnStoreError:     func(err error) { t.Errorf("store error: %v", err) },
+				})
+			}
+
+			// Nothing saved starts closed
+			cb := newBreaker()
+			if cb.State() != CircuitClosed {
+				t.Fatalf("State() = %v with nothing saved, want closed", cb.State())
+			}
+
+			// A restart during the outage resumes the open circuit and its timeout
+			cb.RecordFailure()
+			cb.RecordFailure()
+			clk.Advance(10 * time.Second)
+			restarted := newBreaker()
+			if restarted.State() != CircuitOpen {
+				t.Fatalf("State() after restart = %v, want open", restarted.State())
+			}
+			if restarted.Allow() {
+				t.Error("Allow() = true before the restored open timeout elapsed")
+			}
+			clk.Advance(20 * time.Second)
+			if !restarted.Allow() {
+				t.Fatal("Allow() = false after the restored open timeout, want probe")
+			}
+
+			// A half-open circuit resumes half-open, admitting a new probe
+			if again := newBreaker(); again.State() != CircuitHalfOpen || !again.Allow() {
+				t.Errorf("State() after restart while half-open = %v, want half-open admitting a probe", again.State())
+			}
+
+			// Recovery is saved too
+			restarted.RecordSuccess()
+			if again := newBreaker(); again.State() != CircuitClosed {
+				t.Errorf("State() after restart once recovered = %v, want closed", again.State())
+			}
+
+			// A saved state expires
+			cb = newBreaker()
+			cb.RecordFailure()
+			cb.RecordFailure()
+			clk.Advance(5 * time.Minute)
+			if again := newBreaker(); again.State() != CircuitClosed {
+				t.Errorf("State() after restart past the TTL = %v, want closed", again.State())
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerStoreErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "circuit.json")
+	if err := os.WriteFile(path, []byte("not json"), 0o600); err != nil {
+		t.Fatalf("failed to write state: %v", err)
+	}
+
+	var storeErrs []error
+	cb := NewCircuitBreaker(CircuitBreakerConfig{
+		FailureThreshold: 1,
+		Store:            NewFileCircuitStore(path),
+		OnStoreError:     func(err error) { storeErrs = append(storeErrs, err) },
+	})
+	if cb.State() != CircuitClosed || len(storeErrs) != 1 {
+		t.Fatalf("corrupt state: State() = %v, store errors = %v; want closed and one error", cb.State(), storeErrs)
+	}
+
+	// A failed save leaves the breaker working in memory
+	cb.cfg.Store = NewFileCircuitStore(filepath.Join(path, "missing", "circuit.json"))
+	cb.RecordFailure()
+	if cb.State() != CircuitOpen || len(storeErrs) != 2 {
+		t.Errorf("failed save: State() = %v, store errors = %v; want open and a second error", cb.State(), storeErrs)
+	}
+}
@@ -0,0 +1,316 @@
+package publisher
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/errors"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/internal/ttlcache"
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrPublishInFlight is returned when another request is publishing the same
+// event; the caller should retry later rather than treat it as published
+var ErrPublishInFlight = fmt.Errorf("%w: event is already being published", errors.ErrConnection)
+
+// ErrReservationLost is returned by DedupeStore.Commit when the key's
+// reservation lapsed and another publish now holds it
+var ErrReservationLost = fmt.Errorf("dedupe reservation held by another publish")
+
+// pendingMessageID marks a reserved key whose publish has not completed. A
+// reservation stores it with the reserving publish's token appended, so
+// only that publish can commit or release it.
+const pendingMessageID = "pending"
+
+// pendingValue is the value a reservation under token stores
+func pendingValue(token string) string {
+	return pendingMessageID + ":" + token
+}
+
+// isPending reports whether a stored value is a reservation
+func isPending(value string) bool {
+	return value == "" || value == pendingMessageID || strings.HasPrefix(value, pendingMessageID+":")
+}
+
+// newReservationToken returns a token unique to one publish
+func newReservationToken() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// defaultPendingTTL is how long a reservation blocks redeliveries of the
+// same key before its publish completes, unless set with SetPendingTTL
+const defaultPendingTTL = time.Minute
+
+// DedupeStore records which event keys have been published. A reservation
+// can lapse while its publish is still running and be taken by another, so
+// Commit and Release only act on a key still reserved under their token.
+type DedupeStore interface {
+	// Reserve marks key as in flight under token unless it already exists.
+	// When it exists, reserved is false and existing holds the stored value.
+	Reserve(ctx context.Context, key, token string, ttl time.Duration) (existing string, reserved bool, err error)
+	// Commit stores the message ID for a key reserved under token, or
+	// returns ErrReservationLost when it no longer is
+	Commit(ctx context.Context, key, token, msgID string, ttl time.Duration) error
+	// Release removes a reservation under token after a failed publish so
+	// it can be retried, leaving any other publish's reservation in place
+	Release(ctx context.Context, key, token string) error
+}
+
+type dedupeKeyContextKey struct{}
+
+// WithDedupeKey returns a context carrying the key DedupePublisher uses to
+// detect duplicate publishes, typically the Buildkite event UUID
+func WithDedupeKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, dedupeKeyContextKey{}, key)
+}
+
+// dedupeKeyFromContext returns the dedupe key, or "" when none is set
+func dedupeKeyFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(dedupeKeyContextKey{}).(string)
+	return key
+}
+
+// DedupePublisher publishes each dedupe key at most once within the TTL, so
+// overlapping Buildkite redeliveries and retries produce a single message.
+// Store errors fail open: the message is published without deduplication.
+type DedupePublisher struct {
+	publisher  Publisher
+	store      DedupeStore
+	ttl        time.Duration
+	pendingTTL time.Duration
+}
+
+// NewDedupePublisher wraps pub with deduplication backed by store
+func NewDedupePublisher(pub Publisher, store DedupeStore, ttl time.Duration) *DedupePublisher {
+	return &DedupePublisher{
+		publisher:  pub,
+		store:      store,
+		ttl:        ttl,
+		pendingTTL: defaultPendingTTL,
+	}
+}
+
+// SetPendingTTL sets how long an unfinished publish holds its key. A
+// redelivery arriving while the key is held gets ErrPublishInFlight; once
+// the hold lapses, for example because the replica publishing it crashed,
+// the redelivery publishes instead. It should exceed the longest publish.
+func (d *DedupePublisher) SetPendingTTL(ttl time.Duration) {
+	if ttl > 0 {
+		d.pendingTTL = ttl
+	}
+}
+
+// Publish publishes unless the context's dedupe key was already published,
+// in which case the original message ID is returned
+func (d *DedupePublisher) Publish(ctx context.Context, data interface{}, attributes map[string]string) (string, error) {
+	result, err := d.PublishWithResult(ctx, data, attributes)
+	return result.MessageID, err
+}
+
+// PublishWithResult is Publish, returning the wrapped publisher's result.
+// A duplicate returns only the original message ID.
+func (d *DedupePublisher) PublishWithResult(ctx context.Context, data interface{}, attributes map[string]string) (PublishResult, error) {
+	key := dedupeKeyFromContext(ctx)
+	if key == "" {
+		return PublishWithResult(ctx, d.publisher, data, attributes)
+	}
+
+	token := newReservationToken()
+	existing, reserved, err := d.store.Reserve(ctx, key, token, min(d.pendingTTL, d.ttl))
+	if err != nil {
+		metrics.DedupeChecksTotal.WithLabelValues("error").Inc()
+		return PublishWithResult(ctx, d.publisher, data, attributes)
+	}
+	if !reserved {
+		if isPending(existing) {
+			metrics.DedupeChecksTotal.WithLabelValues("in_flight").Inc()
+			return PublishResult{}, ErrPublishInFlight
+		}
+		metrics.DedupeChecksTotal.WithLabelValues("hit").Inc()
+		return PublishResult{MessageID: existing, Duplicate: true}, nil
+	}
+	metrics.DedupeChecksTotal.WithLabelValues("miss").Inc()
+
+	result, err := PublishWithResult(ctx, d.publisher, data, attributes)
+
+	// Use a fresh context so a request cancelled after publishing still
+	// commits or releases its key
+	storeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	if err != nil {
+		_ = d.store.Release(storeCtx, key, token)
+		return PublishResult{}, err
+	}
+
+	if err := d.store.Commit(storeCtx, key, token, result.MessageID, d.ttl); errors.Is(err, ErrReservationLost) {
+		// The hold lapsed mid-publish; the publish now holding the key
+		// records its own message ID
+		metrics.DedupeChecksTotal.WithLabelValues("lost").Inc()
+	} else if err != nil {
+		metrics.DedupeChecksTotal.WithLabelValues("error").Inc()
+	}
+	return result, nil
+}
+
+// Close closes the wrapped publisher
+func (d *DedupePublisher) Close() error {
+	return d.publisher.Close()
+}
+
+// MemoryDedupeStore is an in-process DedupeStore, suitable for a single
+// replica or tests
+type MemoryDedupeStore struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries *ttlcache.Cache[string, string]
+}
+
+// NewMemoryDedupeStore creates an empty in-memory store
+func NewMemoryDedupeStore() *MemoryDedupeStore {
+	return &MemoryDedupeStore{
+		now:     time.Now,
+		entries: ttlcache.New[string, string](0),
+	}
+}
+
+// Reserve implements DedupeStore
+func (m *MemoryDedupeStore) Reserve(ctx context.Context, key, token string, ttl time.Duration) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.entries.Expire(now)
+	if existing, ok := m.entries.Get(key); ok {
+		return existing, false, nil
+	}
+	m.entries.Set(key, pendingValue(token), now.Add(ttl))
+	return "", true, nil
+}
+
+// Commit implements DedupeStore
+func (m *MemoryDedupeStore) Commit(ctx context.Context, key, token, msgID string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.entries.Expire(now)
+	if value, ok := m.entries.Get(key); !ok || value != pendingValue(token) {
+		return ErrReservationLost
+	}
+	m.entries.Set(key, msgID, now.Add(ttl))
+	return nil
+}
+
+// Release implements DedupeStore
+func (m *MemoryDedupeStore) Release(ctx context.Context, key, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if value, ok := m.entries.Get(key); ok && value == pendingValue(token) {
+		m.entries.Delete(key)
+	}
+	return nil
+}
+
+// Len returns the number of keys held
+func (m *MemoryDedupeStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.entries.Len()
+}
+
+// redisDedupeKeyPrefix namespaces dedupe keys in a shared Redis
+const redisDedupeKeyPrefix = "buildkite-pubsub:dedupe:"
+
+// Compare-and-set and compare-and-delete of a reservation, atomic in Redis
+var (
+	// redisCommitScript sets KEYS[1] to ARGV[2] for ARGV[3] milliseconds if
+	// it still holds ARGV[1], returning 1, or returns 0
+	redisCommitScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+	return 1
+end
+return 0`)
+	// redisReleaseScript deletes KEYS[1] if it still holds ARGV[1]
+	redisReleaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+)
+
+// RedisDedupeStore is a DedupeStore shared by all replicas through Redis
+type RedisDedupeStore struct {
+	client *redis.Client
+}
+
+// NewRedisDedupeStore creates a store from a redis:// or rediss:// URL
+func NewRedisDedupeStore(url string) (*RedisDedupeStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis URL: %w", err)
+	}
+	return &RedisDedupeStore{client: redis.NewClient(opts)}, nil
+}
+
+// Reserve implements DedupeStore using SET NX so only one caller wins
+func (r *RedisDedupeStore) Reserve(ctx context.Context, key, token string, ttl time.Duration) (string, bool, error) {
+	key = redisDedupeKeyPrefix + key
+	reserved, err := r.client.SetNX(ctx, key, pendingValue(token), ttl).Result()
+	if err != nil {
+		return "", false, fmt.Errorf("failed to reserve dedupe key: %w", err)
+	}
+	if reserved {
+		return "", true, nil
+	}
+
+	existing, err := r.client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		// Expired between SETNX and GET; report as in flight
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read dedupe key: %w", err)
+	}
+	return existing, false, nil
+}
+
+// Commit implements DedupeStore
+func (r *RedisDedupeStore) Commit(ctx context.Context, key, token, msgID string, ttl time.Duration) error {
+	committed, err := redisCommitScript.Run(ctx, r.client, []string{redisDedupeKeyPrefix + key}, pendingValue(token), msgID, ttl.Milliseconds()).Int()
+	if err != nil {
+		return fmt.Errorf("failed to commit dedupe key: %w", err)
+	}
+	if committed == 0 {
+		return ErrReservationLost
+	}
+	return nil
+}
+
+// Release implements DedupeStore
+func (r *RedisDedupeStore) Release(ctx context.Context, key, token string) error {
+	if err := redisReleaseScript.Run(ctx, r.client, []string{redisDedupeKeyPrefix + key}, pendingValue(token)).Err(); err != nil {
+		return fmt.Errorf("failed to release dedupe key: %w", err)
+	}
+	return nil
+}
+
+// Ping checks connectivity to Redis
+func (r *RedisDedupeStore) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
+
+// Close closes the Redis client
+func (r *RedisDedupeStore) Close() error {
+	return r.client.Close()
+}
@@ -0,0 +1,283 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// dedupeStores creates each DedupeStore implementation
+var dedupeStores = map[string]func(t *testing.T) DedupeStore{
+	"memory": func(t *testing.T) DedupeStore {
+		return NewMemoryDedupeStore()
+	},
+	"redis": func(t *testing.T) DedupeStore {
+		srv := miniredis.RunT(t)
+		store, err := NewRedisDedupeStore("redis://" + srv.Addr())
+		if err != nil {
+			t.Fatalf("NewRedisDedupeStore() error = %v", err)
+		}
+		t.Cleanup(func() { _ = store.Close() })
+		return store
+	},
+}
+
+func TestDedupePublisher(t *testing.T) {
+	for name, newStore := range dedupeStores {
+		t.Run(name, func(t *testing.T) {
+			if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+				t.Fatalf("failed to initialize metrics: %v", err)
+			}
+
+			store := newStore(t)
+			mock := NewMockPublisher().(*MockPublisher)
+			pub := NewDedupePublisher(mock, store, time.Hour)
+			ctx := WithDedupeKey(context.Background(), "event-1")
+
+			// A failed publish releases the key so a retry can publish
+			mock.SetError(errors.New("unavailable"))
+			if _, err := pub.Publish(ctx, "data", nil); err == nil {
+				t.Fatal("Publish() expected error")
+			}
+			mock.SetError(nil)
+
+			msgID, err := pub.Publish(ctx, "data", nil)
+			if err != nil {
+				t.Fatalf("Publish() error = %v", err)
+			}
+
+			// A redelivery returns the original message ID without publishing
+			dupID, err := pub.Publish(ctx, "data", nil)
+			if err != nil {
+				t.Fatalf("duplicate Publish() error = %v", err)
+			}
+			if dupID != msgID {
+				t.Errorf("duplicate message ID = %q, want %q", dupID, msgID)
+			}
+			if len(mock.GetPublished()) != 1 {
+				t.Errorf("published %d messages, want 1", len(mock.GetPublished()))
+			}
+			if got := counterValue(t, metrics.DedupeChecksTotal.WithLabelValues("hit")); got != 1 {
+				t.Errorf("dedupe hits = %v, want 1", got)
+			}
+
+			// A concurrent publish of the same key is reported as in flight
+			if _, _, err := store.Reserve(context.Background(), "event-2", "other", time.Hour); err != nil {
+				t.Fatalf("Reserve() error = %v", err)
+			}
+			_, err = pub.Publish(WithDedupeKey(context.Background(), "event-2"), "data", nil)
+			if !errors.Is(err, ErrPublishInFlight) {
+				t.Errorf("Publish() error = %v, want ErrPublishInFlight", err)
+			}
+
+			// Without a key every publish goes through
+			for i := 0; i < 2; i++ {
+				if _, err := pub.Publish(context.Background(), "data", nil); err != nil {
+					t.Fatalf("Publish() without key error = %v", err)
+				}
+			}
+			if len(mock.GetPublished()) != 3 {
+				t.Errorf("published %d messages, want 3", len(mock.GetPublished()))
+			}
+		})
+	}
+}
+
+func TestDedupePublisherPendingTTL(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	store := NewMemoryDedupeStore()
+	mock := NewMockPublisher().(*MockPublisher)
+	pub := NewDedupePublisher(mock, store, time.Hour)
+	pub.SetPendingTTL(20 * time.Millisecond)
+	ctx := WithDedupeKey(context.Background(), "event-1")
+
+	// An attempt that reserved the key and never finished, as when a
+	// replica crashes mid-publish, blocks redeliveries only until its hold lapses
+	if _, _, err := store.Reserve(ctx, "event-1", "crashed", 20*time.Millisecond); err != nil {
+		t.Fatalf("Reserve() error = %v", err)
+	}
+	if _, err := pub.Publish(ctx, "data", nil); !errors.Is(err, ErrPublishInFlight) {
+		t.Fatalf("Publish() during hold error = %v, want ErrPublishInFlight", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, err := pub.Publish(ctx, "data", nil); err != nil {
+		t.Fatalf("Publish() after hold error = %v", err)
+	}
+
+	// A completed publish is remembered for the full TTL
+	time.Sleep(30 * time.Millisecond)
+	if _, err := pub.Publish(ctx, "data", nil); err != nil {
+		t.Fatalf("duplicate Publish() error = %v", err)
+	}
+	if len(mock.GetPublished()) != 1 {
+		t.Errorf("published %d messages, want 1", len(mock.GetPublished()))
+	}
+}
+
+// cancellingPublisher cancels the request once its publish succeeds, as
+// when a request times out just after publishing
+type cancellingPublisher struct {
+	Publisher
+	cancel context.CancelFunc
+}
+
+func (c *cancellingPublisher) Publish(ctx context.Context, data interface{}, attributes map[string]string) (string, error) {
+	defer c.cancel()
+	return c.Publisher.Publish(ctx, data, attributes)
+}
+
+func TestDedupePublisherCommitsAfterCancel(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	for name, newStore := range dedupeStores {
+		t.Run(name, func(t *testing.T) {
+			mock := NewMockPublisher().(*MockPublisher)
+			ctx, cancel := context.WithCancel(WithDedupeKey(context.Background(), "event-1"))
+			pub := NewDedupePublisher(&cancellingPublisher{Publisher: mock, cancel: cancel}, newStore(t), time.Hour)
+
+			msgID, err := pub.Publish(ctx, "data", nil)
+			if err != nil {
+				t.Fatalf("Publish() error = %v", err)
+			}
+			if ctx.Err() == nil {
+				t.Fatal("request context was not cancelled")
+			}
+
+			// The redelivery finds the committed message rather than a
+			// reservation still pending
+			result, err := pub.PublishWithResult(WithDedupeKey(context.Background(), "event-1"), "data", nil)
+			if err != nil || !result.Duplicate || result.MessageID != msgID {
+				t.Errorf("redelivery = %+v, %v, want duplicate of %s", result, err, msgID)
+			}
+			if len(mock.GetPublished()) != 1 {
+				t.Errorf("published %d messages, want 1", len(mock.GetPublished()))
+			}
+		})
+	}
+}
+
+func TestDedupePublisherFailsOpen(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	srv := miniredis.RunT(t)
+	store, err := NewRedisDedupeStore("redis://" + srv.Addr())
+	if err != nil {
+		t.Fatalf("NewRedisDedupeStore() error = %v", err)
+	}
+	defer func() { _ = store.Close() }()
+	srv.Close()
+
+	mock := NewMockPublisher().(*MockPublisher)
+	pub := NewDedupePublisher(mock, store, time.Hour)
+	if _, err := pub.Publish(WithDedupeKey(context.Background(), "event-1"), "data", nil); err != nil {
+		t.Fatalf("Publish() error = %v, want publish despite store failure", err)
+	}
+	if len(mock.GetPublished()) != 1 {
+		t.Errorf("published %d messages, want 1", len(mock.GetPublished()))
+	}
+	if got := counterValue(t, metrics.DedupeChecksTotal.WithLabelValues("error")); got != 1 {
+		t.Errorf("dedupe errors = %v, want 1", got)
+	}
+}
+
+func TestMemoryDedupeStoreExpiry(t *testing.T) {
+	store := NewMemoryDedupeStore()
+	ctx := context.Background()
+
+	if _, reserved, _ := store.Reserve(ctx, "key", "a", 10*time.Millisecond); !reserved {
+		t.Fatal("Reserve() = false for new key")
+	}
+	if _, reserved, _ := store.Reserve(ctx, "key", "a", 10*time.Millisecond); reserved {
+		t.Fatal("Reserve() = true for existing key")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if _, reserved, _ := store.Reserve(ctx, "key", "b", time.Hour); !reserved {
+		t.Error("Reserve() = false after TTL expired")
+	}
+}
+
+func TestMemoryDedupeStoreExpiryOrder(t *testing.T) {
+	store := NewMemoryDedupeStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	// Committed keys outlive reservations made after them
+	for _, key := range []string{"a", "b", "c"} {
+		if _, reserved, _ := store.Reserve(ctx, key, key, time.Minute); !reserved {
+			t.Fatalf("Reserve(%q) = false for new key", key)
+		}
+	}
+	if err := store.Commit(ctx, "a", "a", "msg-a", time.Hour); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	now = now.Add(30 * time.Second)
+	if _, reserved, _ := store.Reserve(ctx, "d", "d", time.Minute); !reserved {
+		t.Fatal("Reserve(\"d\") = false for new key")
+	}
+
+	// b and c expire, leaving a and d
+	now = now.Add(45 * time.Second)
+	if _, reserved, _ := store.Reserve(ctx, "e", "e", time.Minute); !reserved {
+		t.Fatal("Reserve(\"e\") = false for new key")
+	}
+	if got := store.Len(); got != 3 {
+		t.Errorf("Len() = %d, want 3", got)
+	}
+	if existing, reserved, _ := store.Reserve(ctx, "a", "x", time.Minute); reserved || existing != "msg-a" {
+		t.Errorf("Reserve(\"a\") = %q, %v, want msg-a still held", existing, reserved)
+	}
+	if err := store.Commit(ctx, "b", "b", "msg-b", time.Hour); !errors.Is(err, ErrReservationLost) {
+		t.Errorf("Commit() of an expired reservation error = %v, want ErrReservationLost", err)
+	}
+}
+
+func TestDedupeStoreReservationTokens(t *testing.T) {
+	for name, newStore := range dedupeStores {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			ctx := context.Background()
+
+			// A slow publish whose hold lapsed must not touch the key the
+			// redelivery reserved since
+			if _, reserved, err := store.Reserve(ctx, "key", "slow", time.Hour); err != nil || !reserved {
+				t.Fatalf("Reserve() = %v, %v, want reserved", reserved, err)
+			}
+			if err := store.Release(ctx, "key", "slow"); err != nil {
+				t.Fatalf("Release() error = %v", err)
+			}
+			if _, reserved, _ := store.Reserve(ctx, "key", "redelivery", time.Hour); !reserved {
+				t.Fatal("Reserve() = false after the owner released the key")
+			}
+			if err := store.Release(ctx, "key", "slow"); err != nil {
+				t.Fatalf("Release() error = %v", err)
+			}
+			if err := store.Commit(ctx, "key", "slow", "msg-slow", time.Hour); !errors.Is(err, ErrReservationLost) {
+				t.Errorf("Commit() by a stale token error = %v, want ErrReservationLost", err)
+			}
+			if existing, reserved, _ := store.Reserve(ctx, "key", "third", time.Hour); reserved || !isPending(existing) {
+				t.Errorf("Reserve() = %q, %v; want the redelivery's reservation kept", existing, reserved)
+			}
+
+			if err := store.Commit(ctx, "key", "redelivery", "msg-1", time.Hour); err != nil {
+				t.Fatalf("Commit() by the owner error = %v", err)
+			}
+			if existing, reserved, _ := store.Reserve(ctx, "key", "third", time.Hour); reserved || existing != "msg-1" {
+				t.Errorf("Reserve() = %q, %v; want msg-1", existing, reserved)
+			}
+		})
+	}
+}
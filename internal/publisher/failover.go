@@ -0,0 +1,179 @@
+package publisher
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+)
+
+// FailoverMode controls how a FailoverPublisher picks its target
+type FailoverMode string
+
+const (
+	// FailoverAuto publishes to the primary and fails over while its circuit is open
+	FailoverAuto FailoverMode = "auto"
+	// FailoverPrimary always publishes to the primary
+	FailoverPrimary FailoverMode = "primary"
+	// FailoverSecondary always publishes to the secondary
+	FailoverSecondary FailoverMode = "secondary"
+)
+
+// ParseFailoverMode validates a failover mode string
+func ParseFailoverMode(s string) (FailoverMode, error) {
+	switch mode := FailoverMode(s); mode {
+	case FailoverAuto, FailoverPrimary, FailoverSecondary:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid failover mode %q: must be auto, primary or secondary", s)
+	}
+}
+
+// Failover targets
+const (
+	targetPrimary   = "primary"
+	targetSecondary = "secondary"
+)
+
+// FailoverPublisher publishes to a primary publisher and switches to a
+// secondary (e.g. another region or project) when the primary's circuit
+// breaker opens after sustained errors. Once the breaker's probe succeeds,
+// publishing returns to the primary.
+type FailoverPublisher struct {
+	primary   Publisher
+	secondary Publisher
+	breaker   *CircuitBreaker
+
+	mu     sync.RWMutex
+	mode   FailoverMode
+	active string
+}
+
+// NewFailoverPublisher creates a FailoverPublisher in auto mode
+func NewFailoverPublisher(primary, secondary Publisher, breaker *CircuitBreaker) *FailoverPublisher {
+	metrics.FailoverActive.Set(0)
+	return &FailoverPublisher{
+		primary:   primary,
+		secondary: secondary,
+		breaker:   breaker,
+		mode:      FailoverAuto,
+		active:    targetPrimary,
+	}
+}
+
+// Publish publishes to the target selected by the current mode
+func (f *FailoverPublisher) Publish(ctx context.Context, data interface{}, attributes map[string]string) (string, error) {
+	result, err := f.PublishWithResult(ctx, data, attributes)
+	return result.MessageID, err
+}
+
+// PublishWithResult is Publish, returning the result of the target
+// published to
+func (f *FailoverPublisher) PublishWithResult(ctx context.Context, data interface{}, attributes map[string]string) (PublishResult, error) {
+	switch f.Mode() {
+	case FailoverSecondary:
+		return f.publishTo(ctx, targetSecondary, data, attributes)
+	case FailoverPrimary:
+		return f.publishPrimary(ctx, data, attributes)
+	}
+
+	if !f.breaker.Allow() {
+		return f.publishTo(ctx, targetSecondary, data, attributes)
+	}
+
+	result, err := f.publishPrimary(ctx, data, attributes)
+	if err == nil {
+		return result, nil
+	}
+
+	// Only fail over when this failure tripped the circuit; transient errors
+	// are returned so the caller's retry policy applies
+	if f.breaker.State() == CircuitOpen && ctx.Err() == nil {
+		return f.publishTo(ctx, targetSecondary, data, attributes)
+	}
+	return PublishResult{}, err
+}
+
+// publishPrimary publishes to the primary and feeds the result to the breaker
+func (f *FailoverPublisher) publishPrimary(ctx context.Context, data interface{}, attributes map[string]string) (PublishResult, error) {
+	result, err := f.publishTo(ctx, targetPrimary, data, attributes)
+	f.breaker.RecordResult(err)
+	if err != nil {
+		return PublishResult{}, err
+	}
+	return result, nil
+}
+
+// publishTo publishes to the named target and records it as active
+func (f *FailoverPublisher) publishTo(ctx context.Context, target string, data interface{}, attributes map[string]string) (PublishResult, error) {
+	pub := f.primary
+	if target == targetSecondary {
+		pub = f.secondary
+	}
+
+	result, err := PublishWithResult(ctx, pub, data, attributes)
+	if err != nil {
+		return PublishResult{}, err
+	}
+	f.setActive(target)
+	return result, nil
+}
+
+// setActive records the target that last published successfully
+func (f *FailoverPublisher) setActive(target string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.active == target {
+		return
+	}
+	f.active = target
+
+	if target == targetSecondary {
+		reason := "automatic"
+		if f.mode == FailoverSecondary {
+			reason = "manual"
+		}
+		metrics.FailoverActivationsTotal.WithLabelValues(reason).Inc()
+		metrics.FailoverActive.Set(1)
+	} else {
+		metrics.FailoverActive.Set(0)
+	}
+}
+
+// Mode returns the current failover mode
+func (f *FailoverPublisher) Mode() FailoverMode {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.mode
+}
+
+// SetMode switches the failover mode, e.g. from the admin API
+func (f *FailoverPublisher) SetMode(mode FailoverMode) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.mode = mode
+}
+
+// Active returns the target that last published successfully
+func (f *FailoverPublisher) Active() string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.active
+}
+
+// CircuitState returns the state of the primary's circuit breaker
+func (f *FailoverPublisher) CircuitState() CircuitState {
+	return f.breaker.State()
+}
+
+// Close closes both publishers
+func (f *FailoverPublisher) Close() error {
+	primaryErr := f.primary.Close()
+	secondaryErr := f.secondary.Close()
+	if primaryErr != nil {
+		return primaryErr
+	}
+	return secondaryErr
+}
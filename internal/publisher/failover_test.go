@@ -0,0 +1,145 @@
+package publisher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/clock"
+	"github.com/mcncl/buildkite-pubsub/internal/errors"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestFailoverPublisher(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	primary := NewMockPublisher().(*MockPublisher)
+	secondary := NewMockPublisher().(*MockPublisher)
+	clk := clock.NewFake(time.Now())
+	breaker := NewCircuitBreaker(CircuitBreakerConfig{
+		FailureThreshold: 2,
+		OpenTimeout:      20 * time.Second,
+		Clock:            clk,
+	})
+	pub := NewFailoverPublisher(primary, secondary, breaker)
+	ctx := context.Background()
+
+	// Healthy primary
+	if _, err := pub.Publish(ctx, "one", nil); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if len(primary.GetPublished()) != 1 || pub.Active() != "primary" {
+		t.Fatalf("expected publish to primary, active = %s", pub.Active())
+	}
+
+	// A single failure is returned to the caller without failing over
+	// Rejected messages say nothing about the primary's health
+	primary.SetError(errors.NewValidationError("message too large"))
+	for i := 0; i < 3; i++ {
+		if _, err := pub.Publish(ctx, "rejected", nil); !errors.IsValidationError(err) {
+			t.Fatalf("Publish() error = %v, want the validation error", err)
+		}
+	}
+	if len(secondary.GetPublished()) != 0 || pub.Active() != "primary" {
+		t.Fatalf("rejected messages failed over, active = %s", pub.Active())
+	}
+
+	primary.SetError(errors.NewConnectionError("unavailable"))
+	if _, err := pub.Publish(ctx, "two", nil); err == nil {
+		t.Fatal("Publish() expected error for transient primary failure")
+	}
+	if len(secondary.GetPublished()) != 0 {
+		t.Fatal("transient failure should not fail over")
+	}
+
+	// The failure that opens the circuit fails over that message
+	if _, err := pub.Publish(ctx, "three", nil); err != nil {
+		t.Fatalf("Publish() error = %v, want failover success", err)
+	}
+	if len(secondary.GetPublished()) != 1 || pub.Active() != "secondary" {
+		t.Fatalf("expected failover to secondary, active = %s", pub.Active())
+	}
+
+	// While open, publishes go straight to the secondary
+	if _, err := pub.Publish(ctx, "four", nil); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if len(secondary.GetPublished()) != 2 {
+		t.Errorf("secondary published %d, want 2", len(secondary.GetPublished()))
+	}
+	if got := gaugeValue(t, metrics.FailoverActive); got != 1 {
+		t.Errorf("FailoverActive = %v, want 1", got)
+	}
+	if got := counterValue(t, metrics.FailoverActivationsTotal.WithLabelValues("automatic")); got != 1 {
+		t.Errorf("FailoverActivationsTotal{automatic} = %v, want 1", got)
+	}
+
+	// Once the primary recovers, the probe returns traffic to it
+	primary.SetError(nil)
+	clk.Advance(20 * time.Second)
+	if _, err := pub.Publish(ctx, "five", nil); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if pub.Active() != "primary" || pub.CircuitState() != CircuitClosed {
+		t.Errorf("expected recovery to primary, active = %s, circuit = %s", pub.Active(), pub.CircuitState())
+	}
+	if got := gaugeValue(t, metrics.FailoverActive); got != 0 {
+		t.Errorf("FailoverActive = %v, want 0", got)
+	}
+}
+
+func TestFailoverPublisherManualMode(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	primary := NewMockPublisher().(*MockPublisher)
+	secondary := NewMockPublisher().(*MockPublisher)
+	pub := NewFailoverPublisher(primary, secondary, NewCircuitBreaker(CircuitBreakerConfig{}))
+	ctx := context.Background()
+
+	pub.SetMode(FailoverSecondary)
+	if _, err := pub.Publish(ctx, "data", nil); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if len(secondary.GetPublished()) != 1 || len(primary.GetPublished()) != 0 {
+		t.Error("manual secondary mode should publish only to the secondary")
+	}
+	if got := counterValue(t, metrics.FailoverActivationsTotal.WithLabelValues("manual")); got != 1 {
+		t.Errorf("FailoverActivationsTotal{manual} = %v, want 1", got)
+	}
+
+	pub.SetMode(FailoverPrimary)
+	if _, err := pub.Publish(ctx, "data", nil); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if len(primary.GetPublished()) != 1 {
+		t.Error("manual primary mode should publish to the primary")
+	}
+
+	if _, err := ParseFailoverMode("sideways"); err == nil {
+		t.Error("ParseFailoverMode() expected error for invalid mode")
+	}
+}
+
+func gaugeValue(t *testing.T, g prometheus.Gauge) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := g.Write(&m); err != nil {
+		t.Fatalf("failed to read gauge: %v", err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatalf("failed to read counter: %v", err)
+	}
+	return m.GetCounter().GetValue()
+}
@@ -0,0 +1,94 @@
+package publisher
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/jsoncodec"
+)
+
+// FileMessage is a message written by a FilePublisher
+type FileMessage struct {
+	ID          string            `json:"id"`
+	PublishedAt time.Time         `json:"published_at"`
+	Attributes  map[string]string `json:"attributes"`
+	Data        json.RawMessage   `json:"data"`
+}
+
+// FilePublisher writes each message to a directory as a JSON file holding
+// its data and attributes. It is a last resort for messages that must not
+// be lost while Pub/Sub itself is unavailable, such as DLQ messages; a
+// mounted Cloud Storage bucket or persistent volume keeps them beyond the
+// life of an instance.
+type FilePublisher struct {
+	dir string
+	now func() time.Time
+}
+
+// NewFilePublisher creates a FilePublisher, creating the directory if
+// needed
+func NewFilePublisher(dir string) (*FilePublisher, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create message directory: %w", err)
+	}
+	return &FilePublisher{dir: dir, now: time.Now}, nil
+}
+
+// Dir returns the directory messages are written to
+func (p *FilePublisher) Dir() string {
+	return p.dir
+}
+
+// Publish writes the message to a new file, returning its ID. Files sort
+// in the order they were written.
+func (p *FilePublisher) Publish(ctx context.Context, data interface{}, attributes map[string]string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	jsonData, err := jsoncodec.Marshal(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal data: %w", err)
+	}
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	now := p.now().UTC()
+	msg := FileMessage{
+		ID:          fmt.Sprintf("%d-%s", now.UnixNano(), hex.EncodeToString(suffix)),
+		PublishedAt: now,
+		Attributes:  attributes,
+		Data:        jsonData,
+	}
+	content, err := json.MarshalIndent(msg, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	// Write then rename, so readers never see a partial message
+	tmp, err := os.CreateTemp(p.dir, ".tmp-*")
+	if err != nil {
+		return "", fmt.Errorf("write message: %w", err)
+	}
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(p.dir, msg.ID+".json"))
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", fmt.Errorf("write message: %w", err)
+	}
+	return msg.ID, nil
+}
+
+// Close implements Publisher; there is nothing to release
+func (p *FilePublisher) Close() error {
+	return nil
+}
@@ -0,0 +1,51 @@
+package publisher
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFilePublisher(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "dlq")
+	pub, err := NewFilePublisher(dir)
+	if err != nil {
+		t.Fatalf("NewFilePublisher() error = %v", err)
+	}
+
+	id, err := pub.Publish(context.Background(), map[string]string{"build": "123"}, map[string]string{"event_type": "build.finished"})
+	if err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	if len(files) != 1 || files[0].Name() != id+".json" {
+		t.Fatalf("files = %v, want only %s.json", files, id)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	var msg FileMessage
+	if err := json.Unmarshal(content, &msg); err != nil {
+		t.Fatalf("message file is not JSON: %v", err)
+	}
+	var data map[string]string
+	if err := json.Unmarshal(msg.Data, &data); err != nil {
+		t.Fatalf("message data is not JSON: %v", err)
+	}
+	if msg.ID != id || msg.Attributes["event_type"] != "build.finished" || data["build"] != "123" {
+		t.Errorf("message = %+v, want the published data and attributes", msg)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := pub.Publish(ctx, "data", nil); err == nil {
+		t.Error("Publish() with a canceled context succeeded")
+	}
+}
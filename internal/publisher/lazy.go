@@ -0,0 +1,68 @@
+package publisher
+
+import (
+	"context"
+	"sync"
+)
+
+// LazyPublisher creates the publisher it wraps on the first publish rather
+// than at startup, so serverless cold starts that only answer pings or
+// reject requests don't pay for creating a client. A failed creation is
+// returned to that publish and retried by the next.
+type LazyPublisher struct {
+	create  func(ctx context.Context) (Publisher, error)
+	topicID string
+
+	mu        sync.Mutex
+	publisher Publisher
+}
+
+// NewLazyPublisher returns a publisher that calls create on first use.
+// topicID is reported in publish results until the publisher exists.
+func NewLazyPublisher(topicID string, create func(ctx context.Context) (Publisher, error)) *LazyPublisher {
+	return &LazyPublisher{create: create, topicID: topicID}
+}
+
+// TopicID returns the topic the publisher was created for
+func (l *LazyPublisher) TopicID() string {
+	return l.topicID
+}
+
+// get returns the wrapped publisher, creating it when needed
+func (l *LazyPublisher) get(ctx context.Context) (Publisher, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.publisher == nil {
+		pub, err := l.create(ctx)
+		if err != nil {
+			return nil, err
+		}
+		l.publisher = pub
+	}
+	return l.publisher, nil
+}
+
+// Publish implements Publisher
+func (l *LazyPublisher) Publish(ctx context.Context, data interface{}, attributes map[string]string) (string, error) {
+	result, err := l.PublishWithResult(ctx, data, attributes)
+	return result.MessageID, err
+}
+
+// PublishWithResult implements ResultPublisher
+func (l *LazyPublisher) PublishWithResult(ctx context.Context, data interface{}, attributes map[string]string) (PublishResult, error) {
+	pub, err := l.get(ctx)
+	if err != nil {
+		return PublishResult{}, err
+	}
+	return PublishWithResult(ctx, pub, data, attributes)
+}
+
+// Close closes the wrapped publisher if it was created
+func (l *LazyPublisher) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.publisher == nil {
+		return nil
+	}
+	return l.publisher.Close()
+}
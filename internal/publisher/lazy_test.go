@@ -0,0 +1,55 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestLazyPublisher(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	var creates int
+	createErr := errors.New("no credentials")
+	mock := NewMockPublisher().(*MockPublisher)
+	lazy := NewLazyPublisher("events", func(context.Context) (Publisher, error) {
+		creates++
+		if createErr != nil {
+			return nil, createErr
+		}
+		return mock, nil
+	})
+	if err := lazy.Close(); err != nil || creates != 0 {
+		t.Errorf("Close() before use = %v after %d creates, want nil without creating", err, creates)
+	}
+
+	// A failed creation fails the publish and is retried by the next
+	if _, err := lazy.Publish(context.Background(), "data", nil); !errors.Is(err, createErr) {
+		t.Errorf("Publish() error = %v, want %v", err, createErr)
+	}
+	createErr = nil
+	for range 2 {
+		if _, err := lazy.Publish(context.Background(), "data", nil); err != nil {
+			t.Fatalf("Publish() error = %v", err)
+		}
+	}
+	if creates != 2 || len(mock.GetPublished()) != 2 {
+		t.Errorf("created %d times and published %d messages, want 2 and 2", creates, len(mock.GetPublished()))
+	}
+
+	result, err := PublishWithResult(context.Background(), lazy, "data", nil)
+	if err != nil || result.Topic != "mock-topic" {
+		t.Errorf("PublishWithResult() = %+v, %v, want the wrapped publisher's result", result, err)
+	}
+	if lazy.TopicID() != "events" {
+		t.Errorf("TopicID() = %q, want events", lazy.TopicID())
+	}
+	if err := lazy.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+}
@@ -2,11 +2,22 @@ package publisher
 
 import (
 	"context"
+	"sync"
+	"time"
 )
 
-// MockPublisher provides a mock implementation of the Publisher interface for testing
+// defaultMockMessageID is returned by MockPublisher unless a response is scripted
+const defaultMockMessageID = "mock-message-id"
+
+// MockPublisher provides a mock implementation of the Publisher interface for testing.
+// Responses can be scripted per call, so tests can fail specific publishes,
+// return custom message IDs or slow individual calls down.
 type MockPublisher struct {
+	mu        sync.Mutex
 	published []publishedMessage
+	calls     []MockCall
+	script    map[int]MockResponse
+	latency   time.Duration
 	Error     error
 	topicID   string
 }
@@ -16,10 +27,29 @@ type publishedMessage struct {
 	Attributes map[string]string
 }
 
+// MockResponse is the scripted outcome of one Publish call. A zero MessageID
+// returns the default mock message ID and a zero PublishTime the time of the
+// publish; a non-zero Latency overrides the latency set with SetLatency.
+type MockResponse struct {
+	MessageID   string
+	PublishTime time.Time
+	Err         error
+	Latency     time.Duration
+}
+
+// MockCall records one Publish call, whether or not it succeeded
+type MockCall struct {
+	Data       interface{}
+	Attributes map[string]string
+	MessageID  string
+	Err        error
+}
+
 // NewMockPublisher creates a new MockPublisher
 func NewMockPublisher() Publisher {
 	return &MockPublisher{
 		published: make([]publishedMessage, 0),
+		script:    make(map[int]MockResponse),
 		topicID:   "mock-topic",
 	}
 }
@@ -28,10 +58,53 @@ func (m *MockPublisher) TopicID() string {
 	return m.topicID
 }
 
-// Publish records the published message and returns a mock message ID
+// Publish records the call, waits for any configured latency and returns the
+// scripted outcome, the error set with SetError or a mock message ID
 func (m *MockPublisher) Publish(ctx context.Context, data interface{}, attributes map[string]string) (string, error) {
-	if m.Error != nil {
-		return "", m.Error
+	result, err := m.PublishWithResult(ctx, data, attributes)
+	return result.MessageID, err
+}
+
+// PublishWithResult is Publish, returning the scripted result
+func (m *MockPublisher) PublishWithResult(ctx context.Context, data interface{}, attributes map[string]string) (PublishResult, error) {
+	m.mu.Lock()
+	m.calls = append(m.calls, MockCall{Data: data, Attributes: attributes})
+	call := len(m.calls)
+	resp, scripted := m.script[call]
+	if !scripted && m.Error != nil {
+		resp.Err = m.Error
+	}
+	if resp.Latency == 0 {
+		resp.Latency = m.latency
+	}
+	if resp.MessageID == "" {
+		resp.MessageID = defaultMockMessageID
+	}
+	m.mu.Unlock()
+
+	if resp.Latency > 0 {
+		timer := time.NewTimer(resp.Latency)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			resp.Err = ctx.Err()
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Reset may have cleared the calls while we waited
+	if call <= len(m.calls) {
+		if resp.Err != nil {
+			m.calls[call-1].Err = resp.Err
+		} else {
+			m.calls[call-1].MessageID = resp.MessageID
+		}
+	}
+	if resp.Err != nil {
+		return PublishResult{}, resp.Err
 	}
 
 	m.published = append(m.published, publishedMessage{
@@ -39,7 +112,10 @@ func (m *MockPublisher) Publish(ctx context.Context, data interface{}, attribute
 		Attributes: attributes,
 	})
 
-	return "mock-message-id", nil
+	if resp.PublishTime.IsZero() {
+		resp.PublishTime = time.Now()
+	}
+	return PublishResult{MessageID: resp.MessageID, Topic: m.topicID, PublishTime: resp.PublishTime}, nil
 }
 
 // Close implements the Publisher interface
@@ -47,26 +123,94 @@ func (m *MockPublisher) Close() error {
 	return nil
 }
 
-// GetPublished returns all published messages
+// GetPublished returns all successfully published messages
 func (m *MockPublisher) GetPublished() []publishedMessage {
-	return m.published
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]publishedMessage(nil), m.published...)
 }
 
 // LastPublished returns the last published message or nil if none exists
 func (m *MockPublisher) LastPublished() *publishedMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if len(m.published) == 0 {
 		return nil
 	}
-	return &m.published[len(m.published)-1]
+	last := m.published[len(m.published)-1]
+	return &last
 }
 
-// Reset clears all published messages and errors
+// Reset clears all published messages, recorded calls, scripted responses,
+// latency and errors
 func (m *MockPublisher) Reset() {
-	m.published = m.published[:0]
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.published = nil
+	m.calls = nil
+	m.script = make(map[int]MockResponse)
+	m.latency = 0
 	m.Error = nil
 }
 
-// SetError sets an error to be returned by the next Publish call
+// SetError sets an error to be returned by every Publish call without a
+// scripted response
 func (m *MockPublisher) SetError(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.Error = err
 }
+
+// SetLatency delays every Publish call by d, or until its context is done
+func (m *MockPublisher) SetLatency(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.latency = d
+}
+
+// Script sets the response for the nth Publish call, counting from 1
+func (m *MockPublisher) Script(call int, resp MockResponse) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.script[call] = resp
+}
+
+// FailOn makes the given Publish calls, counting from 1, return err
+func (m *MockPublisher) FailOn(err error, calls ...int) {
+	for _, call := range calls {
+		m.Script(call, MockResponse{Err: err})
+	}
+}
+
+// FailFirst makes the first n Publish calls return err
+func (m *MockPublisher) FailFirst(n int, err error) {
+	for call := 1; call <= n; call++ {
+		m.Script(call, MockResponse{Err: err})
+	}
+}
+
+// CallCount returns the number of Publish calls, including failed ones
+func (m *MockPublisher) CallCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.calls)
+}
+
+// Calls returns every Publish call in the order it was made
+func (m *MockPublisher) Calls() []MockCall {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]MockCall(nil), m.calls...)
+}
+
+// CallOrder returns the value of the attribute key for every Publish call in
+// order, for asserting the sequence in which messages were published
+func (m *MockPublisher) CallOrder(key string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	order := make([]string, len(m.calls))
+	for i, call := range m.calls {
+		order[i] = call.Attributes[key]
+	}
+	return order
+}
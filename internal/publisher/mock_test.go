@@ -0,0 +1,114 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMockPublisherScript(t *testing.T) {
+	mock := NewMockPublisher().(*MockPublisher)
+	unavailable := errors.New("unavailable")
+	mock.FailOn(unavailable, 2, 5)
+	mock.Script(3, MockResponse{MessageID: "custom-id"})
+
+	ctx := context.Background()
+	want := []struct {
+		id  string
+		err error
+	}{
+		{id: "mock-message-id"},
+		{err: unavailable},
+		{id: "custom-id"},
+		{id: "mock-message-id"},
+		{err: unavailable},
+		{id: "mock-message-id"},
+	}
+	for i, w := range want {
+		id, err := mock.Publish(ctx, "data", map[string]string{"seq": string(rune('a' + i))})
+		if id != w.id || !errors.Is(err, w.err) {
+			t.Errorf("call %d = (%q, %v), want (%q, %v)", i+1, id, err, w.id, w.err)
+		}
+	}
+
+	if got := mock.CallCount(); got != 6 {
+		t.Errorf("CallCount() = %d, want 6", got)
+	}
+	if got := len(mock.GetPublished()); got != 4 {
+		t.Errorf("published %d messages, want 4", got)
+	}
+	if got, want := mock.CallOrder("seq"), []string{"a", "b", "c", "d", "e", "f"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("CallOrder() = %v, want %v", got, want)
+	}
+	if calls := mock.Calls(); calls[1].Err != unavailable || calls[2].MessageID != "custom-id" {
+		t.Errorf("Calls() = %+v, want call 2 failed and call 3 returned custom-id", calls)
+	}
+}
+
+func TestMockPublisherFailFirst(t *testing.T) {
+	mock := NewMockPublisher().(*MockPublisher)
+	mock.FailFirst(2, errors.New("unavailable"))
+
+	for call := 1; call <= 3; call++ {
+		_, err := mock.Publish(context.Background(), "data", nil)
+		if gotErr := err != nil; gotErr != (call <= 2) {
+			t.Errorf("call %d error = %v", call, err)
+		}
+	}
+}
+
+func TestMockPublisherScriptOverridesSetError(t *testing.T) {
+	mock := NewMockPublisher().(*MockPublisher)
+	mock.SetError(errors.New("unavailable"))
+	mock.Script(2, MockResponse{})
+
+	if _, err := mock.Publish(context.Background(), "data", nil); err == nil {
+		t.Error("call 1 expected the SetError error")
+	}
+	if _, err := mock.Publish(context.Background(), "data", nil); err != nil {
+		t.Errorf("call 2 error = %v, want the scripted success", err)
+	}
+}
+
+func TestMockPublisherLatency(t *testing.T) {
+	mock := NewMockPublisher().(*MockPublisher)
+	mock.SetLatency(20 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := mock.Publish(context.Background(), "data", nil); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("Publish() returned after %v, want at least 20ms", elapsed)
+	}
+
+	mock.Script(2, MockResponse{Latency: time.Hour})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := mock.Publish(ctx, "data", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Publish() error = %v, want context.DeadlineExceeded", err)
+	}
+	if got := len(mock.GetPublished()); got != 1 {
+		t.Errorf("published %d messages, want 1", got)
+	}
+}
+
+func TestMockPublisherReset(t *testing.T) {
+	mock := NewMockPublisher().(*MockPublisher)
+	mock.FailOn(errors.New("unavailable"), 1)
+	mock.SetLatency(time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	_, _ = mock.Publish(ctx, "data", nil)
+
+	mock.Reset()
+
+	if _, err := mock.Publish(context.Background(), "data", nil); err != nil {
+		t.Errorf("Publish() after Reset error = %v", err)
+	}
+	if got := mock.CallCount(); got != 1 {
+		t.Errorf("CallCount() after Reset = %d, want 1", got)
+	}
+}
@@ -0,0 +1,41 @@
+package publisher
+
+import "path"
+
+// Priority orders publishes when the publish queue is full
+type Priority int
+
+const (
+	// PriorityLow publishes are shed when the queue is full
+	PriorityLow Priority = iota
+	// PriorityHigh publishes wait for a free slot and are admitted before
+	// any low-priority publish
+	PriorityHigh
+)
+
+// PriorityClassifier assigns high priority to event types matching any of
+// its patterns, such as "build.*" for build lifecycle events
+type PriorityClassifier struct {
+	high []string
+}
+
+// NewPriorityClassifier classifies event types matching a path.Match
+// pattern in high as high priority and everything else as low priority
+func NewPriorityClassifier(high []string) *PriorityClassifier {
+	return &PriorityClassifier{high: high}
+}
+
+// Classify returns the priority of an event type
+func (c *PriorityClassifier) Classify(eventType string) Priority {
+	for _, pattern := range c.high {
+		if ok, _ := path.Match(pattern, eventType); ok {
+			return PriorityHigh
+		}
+	}
+	return PriorityLow
+}
+
+// ClassifyAttributes returns the priority of a message from its event_type attribute
+func (c *PriorityClassifier) ClassifyAttributes(attributes map[string]string) Priority {
+	return c.Classify(attributes["event_type"])
+}
@@ -0,0 +1,123 @@
+package publisher
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/errors"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPriorityClassifier(t *testing.T) {
+	c := NewPriorityClassifier([]string{"build.*", "job.finished"})
+	tests := map[string]Priority{
+		"build.finished":  PriorityHigh,
+		"build.scheduled": PriorityHigh,
+		"job.finished":    PriorityHigh,
+		"job.started":     PriorityLow,
+		"agent.connected": PriorityLow,
+		"":                PriorityLow,
+	}
+	for eventType, want := range tests {
+		if got := c.ClassifyAttributes(map[string]string{"event_type": eventType}); got != want {
+			t.Errorf("Classify(%q) = %d, want %d", eventType, got, want)
+		}
+	}
+}
+
+// startedPublisher reports the event type of every publish as it starts and
+// holds it until release receives a value
+type startedPublisher struct {
+	started chan string
+	release chan struct{}
+}
+
+func (p *startedPublisher) Publish(ctx context.Context, data interface{}, attributes map[string]string) (string, error) {
+	p.started <- attributes["event_type"]
+	<-p.release
+	return "msg-id", nil
+}
+
+func (p *startedPublisher) Close() error {
+	return nil
+}
+
+func TestPriorityBackpressurePublisher(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	inner := &startedPublisher{started: make(chan string, 10), release: make(chan struct{})}
+	bp := NewPriorityBackpressurePublisher(inner, 1, NewPriorityClassifier([]string{"build.*"}))
+
+	var wg sync.WaitGroup
+	publish := func(eventType string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := bp.Publish(context.Background(), "data", map[string]string{"event_type": eventType}); err != nil {
+				t.Errorf("Publish(%s) error = %v", eventType, err)
+			}
+		}()
+	}
+	waitForWaiting := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for {
+			bp.mu.Lock()
+			waiting := len(bp.waiting)
+			bp.mu.Unlock()
+			if waiting == n {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("waiting = %d, want %d", waiting, n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// A low-priority publish fills the queue
+	publish("job.started")
+	if got := <-inner.started; got != "job.started" {
+		t.Fatalf("started %s, want job.started", got)
+	}
+
+	// High-priority publishes wait instead of being rejected
+	publish("build.finished")
+	waitForWaiting(1)
+	publish("build.started")
+	waitForWaiting(2)
+
+	// Low-priority publishes are shed while high-priority ones wait
+	_, err := bp.Publish(context.Background(), "data", map[string]string{"event_type": "agent.connected"})
+	if !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("low-priority Publish() error = %v, want ErrQueueFull", err)
+	}
+
+	// A waiting publish whose context ends leaves the queue
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := bp.Publish(ctx, "data", map[string]string{"event_type": "build.running"}); err != context.DeadlineExceeded {
+		t.Fatalf("cancelled Publish() error = %v, want deadline exceeded", err)
+	}
+	waitForWaiting(2)
+
+	// Freed slots go to the waiting publishes in order
+	for _, want := range []string{"build.finished", "build.started"} {
+		inner.release <- struct{}{}
+		if got := <-inner.started; got != want {
+			t.Errorf("started %s, want %s", got, want)
+		}
+	}
+	inner.release <- struct{}{}
+	wg.Wait()
+
+	if got := bp.Depth(); got != 0 {
+		t.Errorf("Depth() after drain = %d, want 0", got)
+	}
+	waitForWaiting(0)
+}
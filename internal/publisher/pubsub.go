@@ -2,11 +2,16 @@ package publisher
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"time"
 
 	"cloud.google.com/go/pubsub/v2"
 	"cloud.google.com/go/pubsub/v2/apiv1/pubsubpb"
+	"github.com/mcncl/buildkite-pubsub/internal/errors"
+	"github.com/mcncl/buildkite-pubsub/internal/jsoncodec"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // Publisher defines the interface for publishing messages
@@ -28,12 +33,14 @@ func NewPubSubPublisher(ctx context.Context, projectID, topicID string) (*PubSub
 	return NewPubSubPublisherWithSettings(ctx, projectID, topicID, nil)
 }
 
-// NewPubSubPublisherWithSettings creates a new Google Cloud Pub/Sub publisher with custom settings
-func NewPubSubPublisherWithSettings(ctx context.Context, projectID, topicID string, settings *pubsub.PublishSettings) (*PubSubPublisher, error) {
+// NewPubSubPublisherWithSettings creates a new Google Cloud Pub/Sub publisher with custom settings.
+// opts configure the client, such as the credentials it authenticates with.
+func NewPubSubPublisherWithSettings(ctx context.Context, projectID, topicID string, settings *pubsub.PublishSettings, opts ...option.ClientOption) (*PubSubPublisher, error) {
 	// Create the client
-	client, err := pubsub.NewClient(ctx, projectID)
+	client, err := pubsub.NewClient(ctx, projectID, opts...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create pubsub client: %w", err)
+		return nil, errors.WithHint(fmt.Errorf("%w: failed to create pubsub client: %w", errors.ErrAuth, err),
+			"check GOOGLE_APPLICATION_CREDENTIALS, or run `gcloud auth application-default login` when running locally")
 	}
 
 	// Check if topic exists using admin client from the client
@@ -42,7 +49,8 @@ func NewPubSubPublisherWithSettings(ctx context.Context, projectID, topicID stri
 		Topic: topicPath,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("topic %s does not exist or cannot be accessed: %w", topicID, err)
+		_ = client.Close()
+		return nil, topicError(projectID, topicID, err)
 	}
 
 	// Create publisher with settings
@@ -82,15 +90,62 @@ func NewPubSubPublisherWithSettings(ctx context.Context, projectID, topicID stri
 	}, nil
 }
 
+// topicError classifies a failure to look up a topic at startup, with a
+// hint on how to fix it
+func topicError(projectID, topicID string, err error) error {
+	topicPath := fmt.Sprintf("projects/%s/topics/%s", projectID, topicID)
+	switch code := status.Code(err); {
+	case code == codes.NotFound:
+		return errors.WithHint(fmt.Errorf("%w: topic %s does not exist: %w", errors.ErrNotFound, topicPath, err),
+			fmt.Sprintf("create it with `webhook setup-gcp -project %s -topic %s`, or check PROJECT_ID and TOPIC_ID", projectID, topicID))
+	case code == codes.PermissionDenied:
+		return errors.WithHint(fmt.Errorf("%w: permission denied for topic %s: %w", errors.ErrAuth, topicPath, err),
+			"grant the service account roles/pubsub.viewer and roles/pubsub.publisher on the topic; new IAM bindings can take a few minutes to apply")
+	case code == codes.Unauthenticated:
+		return errors.WithHint(fmt.Errorf("%w: credentials rejected for topic %s: %w", errors.ErrAuth, topicPath, err),
+			"check GOOGLE_APPLICATION_CREDENTIALS, or run `gcloud auth application-default login` when running locally")
+	case code == codes.Unavailable || code == codes.DeadlineExceeded ||
+		errors.Is(err, context.DeadlineExceeded):
+		return errors.WithHint(fmt.Errorf("%w: could not reach Pub/Sub for topic %s: %w", errors.ErrConnection, topicPath, err),
+			"check network access to pubsub.googleapis.com, or PUBSUB_EMULATOR_HOST when using the emulator")
+	default:
+		return fmt.Errorf("topic %s cannot be accessed: %w", topicPath, err)
+	}
+}
+
+// publishError classifies a failure to publish, so that only failures a
+// retry can fix are retryable
+func publishError(err error) error {
+	switch code := status.Code(err); {
+	case errors.Is(err, pubsub.ErrOversizedMessage) || code == codes.InvalidArgument:
+		return fmt.Errorf("%w: Pub/Sub rejected the message: %w", errors.ErrValidation, err)
+	case code == codes.NotFound:
+		return fmt.Errorf("%w: topic does not exist: %w", errors.ErrNotFound, err)
+	case code == codes.PermissionDenied || code == codes.Unauthenticated:
+		return fmt.Errorf("%w: not allowed to publish: %w", errors.ErrAuth, err)
+	case code == codes.ResourceExhausted:
+		return fmt.Errorf("%w: failed to publish message: %w", errors.ErrRateLimit, err)
+	default:
+		return fmt.Errorf("%w: failed to publish message: %w", errors.ErrPublish, err)
+	}
+}
+
 func (p *PubSubPublisher) TopicID() string {
 	return p.topicID
 }
 
 // Publish publishes a message to Pub/Sub
 func (p *PubSubPublisher) Publish(ctx context.Context, data interface{}, attributes map[string]string) (string, error) {
-	jsonData, err := json.Marshal(data)
+	result, err := p.PublishWithResult(ctx, data, attributes)
+	return result.MessageID, err
+}
+
+// PublishWithResult publishes a message to Pub/Sub and waits for it to be
+// acknowledged
+func (p *PubSubPublisher) PublishWithResult(ctx context.Context, data interface{}, attributes map[string]string) (PublishResult, error) {
+	jsonData, err := jsoncodec.Marshal(data)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal data: %w", err)
+		return PublishResult{}, fmt.Errorf("%w: failed to marshal data: %w", errors.ErrValidation, err)
 	}
 
 	msg := &pubsub.Message{
@@ -104,15 +159,15 @@ func (p *PubSubPublisher) Publish(ctx context.Context, data interface{}, attribu
 	// Get will block until the message is sent or ctx is cancelled
 	msgID, err := result.Get(ctx)
 	if err != nil {
-		return "", fmt.Errorf("failed to publish message: %w", err)
+		return PublishResult{}, publishError(err)
 	}
 
-	return msgID, nil
+	return PublishResult{MessageID: msgID, Topic: p.topicID, PublishTime: time.Now()}, nil
 }
 
 // PublishAsync publishes a message asynchronously without waiting for confirmation
 func (p *PubSubPublisher) PublishAsync(ctx context.Context, data interface{}, attributes map[string]string) *pubsub.PublishResult {
-	jsonData, _ := json.Marshal(data)
+	jsonData, _ := jsoncodec.Marshal(data)
 
 	msg := &pubsub.Message{
 		Data:       jsonData,
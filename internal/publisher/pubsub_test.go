@@ -4,15 +4,19 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
 	"cloud.google.com/go/pubsub/pstest"
 	"cloud.google.com/go/pubsub/v2"
 	"cloud.google.com/go/pubsub/v2/apiv1/pubsubpb"
+	"github.com/mcncl/buildkite-pubsub/internal/errors"
 	"google.golang.org/api/option"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
 // testSetup creates a pstest server and client for testing
@@ -971,3 +975,65 @@ func containsSubstringHelper(s, substr string) bool {
 	}
 	return false
 }
+
+func TestPublishError(t *testing.T) {
+	tests := []struct {
+		err       error
+		is        func(error) bool
+		retryable bool
+	}{
+		{pubsub.ErrOversizedMessage, errors.IsValidationError, false},
+		{status.Error(codes.InvalidArgument, "bad attribute"), errors.IsValidationError, false},
+		{status.Error(codes.NotFound, "Resource not found"), errors.IsNotFoundError, false},
+		{status.Error(codes.PermissionDenied, "User not authorized"), errors.IsAuthError, false},
+		{status.Error(codes.ResourceExhausted, "quota exceeded"), errors.IsRateLimitError, true},
+		{status.Error(codes.Unavailable, "connection refused"), errors.IsPublishError, true},
+	}
+	for _, tt := range tests {
+		err := publishError(tt.err)
+		if !tt.is(err) || errors.IsRetryable(err) != tt.retryable {
+			t.Errorf("publishError(%v) = %v, want it classified with retryable %v", tt.err, err, tt.retryable)
+		}
+	}
+}
+
+func TestTopicError(t *testing.T) {
+	tests := []struct {
+		err  error
+		is   func(error) bool
+		hint string
+	}{
+		{status.Error(codes.NotFound, "Resource not found"), errors.IsNotFoundError, "webhook setup-gcp -project test-project -topic events"},
+		{status.Error(codes.PermissionDenied, "User not authorized"), errors.IsAuthError, "roles/pubsub.publisher"},
+		{status.Error(codes.Unauthenticated, "invalid credentials"), errors.IsAuthError, "GOOGLE_APPLICATION_CREDENTIALS"},
+		{status.Error(codes.Unavailable, "connection refused"), errors.IsConnectionError, "pubsub.googleapis.com"},
+		{fmt.Errorf("dial: %w", context.DeadlineExceeded), errors.IsConnectionError, "pubsub.googleapis.com"},
+	}
+	for _, tt := range tests {
+		err := topicError("test-project", "events", tt.err)
+		if !tt.is(err) || !strings.Contains(err.Error(), "projects/test-project/topics/events") {
+			t.Errorf("topicError(%v) = %v, want it classified and naming the topic", tt.err, err)
+		}
+		if hint := errors.Hint(err); !strings.Contains(hint, tt.hint) {
+			t.Errorf("topicError(%v) hint = %q, want it to mention %s", tt.err, hint, tt.hint)
+		}
+		if status.Code(err) != status.Code(tt.err) {
+			t.Errorf("topicError(%v) lost the gRPC status", tt.err)
+		}
+	}
+
+	if err := topicError("test-project", "events", status.Error(codes.Internal, "oops")); errors.Hint(err) != "" || errors.IsRetryable(err) {
+		t.Errorf("topicError(Internal) = %v with hint %q, want it unclassified", err, errors.Hint(err))
+	}
+}
+
+func TestNewPubSubPublisherMissingTopic(t *testing.T) {
+	srv := pstest.NewServer()
+	defer func() { _ = srv.Close() }()
+	t.Setenv("PUBSUB_EMULATOR_HOST", srv.Addr)
+
+	_, err := NewPubSubPublisher(context.Background(), "test-project", "missing")
+	if !errors.IsNotFoundError(err) || !strings.Contains(errors.Hint(err), "setup-gcp") {
+		t.Errorf("NewPubSubPublisher() error = %v, hint %q, want not found with a setup hint", err, errors.Hint(err))
+	}
+}
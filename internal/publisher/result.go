@@ -0,0 +1,55 @@
+package publisher
+
+import (
+	"context"
+	"time"
+)
+
+// PublishResult describes a message Pub/Sub accepted
+type PublishResult struct {
+	MessageID string
+	// Topic is the ID of the topic the message was published to, or empty
+	// when the publisher doesn't know it
+	Topic string
+	// PublishTime is the local time the publish call returned. The Pub/Sub
+	// v2 client doesn't expose the publish_time the server assigns and
+	// subscribers see, so this is slightly later than it and uses this
+	// host's clock. Zero for a deduplicated publish, whose original time
+	// is unknown.
+	PublishTime time.Time
+	// Duplicate is set when DedupePublisher found the message already
+	// published and returned the original message ID without publishing
+	Duplicate bool
+}
+
+// ResultPublisher is a Publisher that reports more than the message ID.
+// Publishers in this package implement it and pass on the result of the
+// publisher they wrap.
+type ResultPublisher interface {
+	Publisher
+	PublishWithResult(ctx context.Context, data interface{}, attributes map[string]string) (PublishResult, error)
+}
+
+// topicPublisher is implemented by publishers bound to a single topic
+type topicPublisher interface {
+	TopicID() string
+}
+
+// PublishWithResult publishes with pub and returns its full result. For a
+// publisher that only returns a message ID, the result is filled in with
+// its topic when known and the time Publish returned.
+func PublishWithResult(ctx context.Context, pub Publisher, data interface{}, attributes map[string]string) (PublishResult, error) {
+	if rp, ok := pub.(ResultPublisher); ok {
+		return rp.PublishWithResult(ctx, data, attributes)
+	}
+
+	msgID, err := pub.Publish(ctx, data, attributes)
+	if err != nil {
+		return PublishResult{}, err
+	}
+	result := PublishResult{MessageID: msgID, PublishTime: time.Now()}
+	if tp, ok := pub.(topicPublisher); ok {
+		result.Topic = tp.TopicID()
+	}
+	return result, nil
+}
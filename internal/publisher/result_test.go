@@ -0,0 +1,55 @@
+package publisher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPublishWithResult(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+	ctx := context.Background()
+	acked := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	// The result is passed up through wrapping publishers
+	mock := NewMockPublisher().(*MockPublisher)
+	mock.Script(1, MockResponse{MessageID: "msg-1", PublishTime: acked})
+	breaker := NewCircuitBreaker(CircuitBreakerConfig{FailureThreshold: 5, OpenTimeout: time.Minute})
+	var pub Publisher = NewAttributeGuardPublisher(NewCircuitBreakerPublisher(mock, breaker), nil)
+	result, err := PublishWithResult(ctx, pub, map[string]string{"a": "b"}, nil)
+	if err != nil {
+		t.Fatalf("PublishWithResult() error = %v", err)
+	}
+	if want := (PublishResult{MessageID: "msg-1", Topic: "mock-topic", PublishTime: acked}); result != want {
+		t.Errorf("PublishWithResult() = %+v, want %+v", result, want)
+	}
+
+	// A publisher returning only an ID gets the time Publish returned
+	before := time.Now()
+	result, err = PublishWithResult(ctx, NewTypedMockPublisher[map[string]string](), map[string]string{"a": "b"}, nil)
+	if err != nil {
+		t.Fatalf("PublishWithResult() error = %v", err)
+	}
+	if result.MessageID != "mock-message-1" || result.Topic != "" || result.PublishTime.Before(before) {
+		t.Errorf("PublishWithResult() of a plain publisher = %+v", result)
+	}
+
+	// A duplicate has only the original message ID
+	dedupe := NewDedupePublisher(NewMockPublisher(), NewMemoryDedupeStore(), time.Hour)
+	dedupeCtx := WithDedupeKey(ctx, "event-1")
+	if _, err := PublishWithResult(dedupeCtx, dedupe, "data", nil); err != nil {
+		t.Fatalf("PublishWithResult() error = %v", err)
+	}
+	result, err = PublishWithResult(dedupeCtx, dedupe, "data", nil)
+	if err != nil {
+		t.Fatalf("PublishWithResult() of a duplicate error = %v", err)
+	}
+	if result.MessageID != defaultMockMessageID || !result.PublishTime.IsZero() {
+		t.Errorf("PublishWithResult() of a duplicate = %+v, want only the message ID", result)
+	}
+}
@@ -0,0 +1,117 @@
+package publisher
+
+import (
+	"context"
+	"path"
+
+	"github.com/mcncl/buildkite-pubsub/internal/buildkite"
+	"github.com/mcncl/buildkite-pubsub/internal/expression"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+)
+
+// DefaultRouteName labels messages that match no routing rule
+const DefaultRouteName = "default"
+
+// RouteRule matches transformed payloads. Each non-empty field is a
+// path.Match pattern, so "release/*" matches "release/v2"; empty fields
+// match anything.
+type RouteRule struct {
+	Name       string
+	EventType  string
+	Pipeline   string // matched against the pipeline slug and name
+	Branch     string
+	BuildState string
+	// Expression, when set, is a CEL condition the payload must also satisfy
+	Expression *expression.Program
+}
+
+// Matches reports whether the payload satisfies every pattern in the rule
+// and its expression
+func (r RouteRule) Matches(payload buildkite.TransformedPayload) bool {
+	return matchPattern(r.EventType, payload.EventType) &&
+		(matchPattern(r.Pipeline, payload.Build.Pipeline) || matchPattern(r.Pipeline, payload.Pipeline.Name)) &&
+		matchPattern(r.Branch, payload.Build.Branch) &&
+		matchPattern(r.BuildState, payload.Build.State) &&
+		(r.Expression == nil || r.Expression.Matches(payload))
+}
+
+// matchPattern reports whether value matches pattern; empty patterns match
+// anything and malformed patterns match nothing
+func matchPattern(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, err := path.Match(pattern, value)
+	return err == nil && ok
+}
+
+// Route sends payloads matching its rule to a publisher
+type Route struct {
+	RouteRule
+	Publisher Publisher
+}
+
+// RoutingPublisher publishes each payload to the first route whose rule
+// matches, falling back to the default publisher
+type RoutingPublisher struct {
+	routes     []Route
+	defaultPub Publisher
+}
+
+// NewRoutingPublisher creates a publisher evaluating routes in order
+func NewRoutingPublisher(defaultPub Publisher, routes []Route) *RoutingPublisher {
+	return &RoutingPublisher{
+		routes:     routes,
+		defaultPub: defaultPub,
+	}
+}
+
+// Publish publishes to the matching route's publisher
+func (r *RoutingPublisher) Publish(ctx context.Context, data interface{}, attributes map[string]string) (string, error) {
+	result, err := r.PublishWithResult(ctx, data, attributes)
+	return result.MessageID, err
+}
+
+// PublishWithResult is Publish, returning the matching route's result
+func (r *RoutingPublisher) PublishWithResult(ctx context.Context, data interface{}, attributes map[string]string) (PublishResult, error) {
+	name, pub := r.route(data)
+
+	result, err := PublishWithResult(ctx, pub, data, attributes)
+	if err != nil {
+		metrics.RoutedMessagesTotal.WithLabelValues(name, "error").Inc()
+		return PublishResult{}, err
+	}
+	metrics.RoutedMessagesTotal.WithLabelValues(name, "success").Inc()
+	return result, nil
+}
+
+// route selects the route for data; only transformed payloads are matched
+func (r *RoutingPublisher) route(data interface{}) (string, Publisher) {
+	var payload buildkite.TransformedPayload
+	switch p := data.(type) {
+	case buildkite.TransformedPayload:
+		payload = p
+	case *buildkite.TransformedPayload:
+		payload = *p
+	default:
+		return DefaultRouteName, r.defaultPub
+	}
+
+	for _, route := range r.routes {
+		if route.Matches(payload) {
+			return route.Name, route.Publisher
+		}
+	}
+	return DefaultRouteName, r.defaultPub
+}
+
+// Close closes the default publisher and every route's publisher
+func (r *RoutingPublisher) Close() error {
+	firstErr := r.defaultPub.Close()
+	for _, route := range r.routes {
+		if err := route.Publisher.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,75 @@
+package publisher
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/internal/buildkite"
+	"github.com/mcncl/buildkite-pubsub/internal/expression"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRoutingPublisher(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	defaultPub := NewMockPublisher().(*MockPublisher)
+	prodPub := NewMockPublisher().(*MockPublisher)
+	deployPub := NewMockPublisher().(*MockPublisher)
+	agentPub := NewMockPublisher().(*MockPublisher)
+
+	lost, err := expression.CompileCondition("agents", "event_type in ['agent.lost', 'agent.stopped']")
+	if err != nil {
+		t.Fatalf("CompileCondition() error = %v", err)
+	}
+	pub := NewRoutingPublisher(defaultPub, []Route{
+		{RouteRule: RouteRule{Name: "prod", Branch: "release/*"}, Publisher: prodPub},
+		{RouteRule: RouteRule{Name: "deploys", Pipeline: "deploy-*", EventType: "build.finished"}, Publisher: deployPub},
+		{RouteRule: RouteRule{Name: "agents", EventType: "agent.*", Expression: lost}, Publisher: agentPub},
+	})
+
+	payload := func(eventType, pipeline, branch string) buildkite.TransformedPayload {
+		return buildkite.TransformedPayload{
+			EventType: eventType,
+			Build:     buildkite.BuildInfo{Pipeline: pipeline, Branch: branch},
+			Pipeline:  buildkite.PipelineInfo{Name: pipeline},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		data    interface{}
+		want    *MockPublisher
+		wantRte string
+	}{
+		{name: "release branch", data: payload("build.finished", "app", "release/v2"), want: prodPub, wantRte: "prod"},
+		{name: "first matching rule wins", data: payload("build.finished", "deploy-api", "release/v3"), want: prodPub, wantRte: "prod"},
+		{name: "pipeline and event match", data: payload("build.finished", "deploy-api", "main"), want: deployPub, wantRte: "deploys"},
+		{name: "partial match falls through", data: payload("build.started", "deploy-api", "main"), want: defaultPub, wantRte: DefaultRouteName},
+		{name: "expression matches", data: payload("agent.lost", "", ""), want: agentPub, wantRte: "agents"},
+		{name: "expression must also match", data: payload("agent.connected", "", ""), want: defaultPub, wantRte: DefaultRouteName},
+		{name: "pointer payload", data: &buildkite.TransformedPayload{Build: buildkite.BuildInfo{Branch: "release/x"}}, want: prodPub, wantRte: "prod"},
+		{name: "non-payload data uses default", data: map[string]string{"branch": "release/v2"}, want: defaultPub, wantRte: DefaultRouteName},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(tt.want.GetPublished())
+			if _, err := pub.Publish(context.Background(), tt.data, nil); err != nil {
+				t.Fatalf("Publish() error = %v", err)
+			}
+			if len(tt.want.GetPublished()) != before+1 {
+				t.Errorf("expected message on %s route", tt.wantRte)
+			}
+		})
+	}
+
+	if got := counterValue(t, metrics.RoutedMessagesTotal.WithLabelValues("prod", "success")); got != 3 {
+		t.Errorf("routed messages{prod} = %v, want 3", got)
+	}
+	if got := counterValue(t, metrics.RoutedMessagesTotal.WithLabelValues(DefaultRouteName, "success")); got != 3 {
+		t.Errorf("routed messages{default} = %v, want 3", got)
+	}
+}
@@ -0,0 +1,170 @@
+package publisher
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/mcncl/buildkite-pubsub/internal/errors"
+	"github.com/mcncl/buildkite-pubsub/internal/jsoncodec"
+)
+
+// MaxSNSAttributes is the number of message attributes SNS accepts
+const MaxSNSAttributes = 10
+
+// snsAttributePriority orders the attributes kept when a message has more
+// than SNS accepts, putting those subscription filter policies use first
+var snsAttributePriority = []string{
+	"event_type",
+	"pipeline",
+	"build_state",
+	"branch",
+	"team",
+	"delivery_id",
+	"queue_name",
+	"cluster_id",
+	"origin",
+	"published_at",
+}
+
+// SNSAPI is the part of the SNS client the publisher uses
+type SNSAPI interface {
+	Publish(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error)
+}
+
+// SNSPublisher implements the Publisher interface for Amazon SNS. Message
+// attributes become SNS string attributes, keeping the ten that filter
+// policies are most likely to use.
+type SNSPublisher struct {
+	client   SNSAPI
+	topicARN string
+	fifo     bool
+}
+
+// NewSNSPublisher creates a publisher for the SNS topic with the given ARN
+func NewSNSPublisher(client SNSAPI, topicARN string) *SNSPublisher {
+	return &SNSPublisher{
+		client:   client,
+		topicARN: topicARN,
+		fifo:     strings.HasSuffix(topicARN, ".fifo"),
+	}
+}
+
+// TopicID returns the topic ARN
+func (p *SNSPublisher) TopicID() string {
+	return p.topicARN
+}
+
+// Publish publishes a message to SNS
+func (p *SNSPublisher) Publish(ctx context.Context, data interface{}, attributes map[string]string) (string, error) {
+	result, err := p.PublishWithResult(ctx, data, attributes)
+	return result.MessageID, err
+}
+
+// PublishWithResult publishes a message to SNS and waits for it to be
+// accepted. Messages to FIFO topics are grouped by pipeline and
+// deduplicated by the dedupe key, when set.
+func (p *SNSPublisher) PublishWithResult(ctx context.Context, data interface{}, attributes map[string]string) (PublishResult, error) {
+	jsonData, err := jsoncodec.Marshal(data)
+	if err != nil {
+		return PublishResult{}, fmt.Errorf("%w: failed to marshal data: %w", errors.ErrValidation, err)
+	}
+
+	input := &sns.PublishInput{
+		TopicArn:          aws.String(p.topicARN),
+		Message:           aws.String(string(jsonData)),
+		MessageAttributes: snsAttributes(attributes),
+	}
+	if p.fifo {
+		group := attributes["pipeline"]
+		if group == "" {
+			group = "default"
+		}
+		input.MessageGroupId = aws.String(group)
+		if key := dedupeKeyFromContext(ctx); key != "" {
+			input.MessageDeduplicationId = aws.String(key)
+		}
+	}
+
+	out, err := p.client.Publish(ctx, input)
+	if err != nil {
+		return PublishResult{}, snsError(err)
+	}
+	return PublishResult{MessageID: aws.ToString(out.MessageId), Topic: p.topicARN, PublishTime: time.Now()}, nil
+}
+
+// snsError classifies a failure to publish, so that only failures a retry
+// can fix are retryable
+func snsError(err error) error {
+	var (
+		invalidParameter *types.InvalidParameterException
+		invalidValue     *types.InvalidParameterValueException
+		notFound         *types.NotFoundException
+		unauthorized     *types.AuthorizationErrorException
+		throttled        *types.ThrottledException
+	)
+	switch {
+	case errors.As(err, &invalidParameter) || errors.As(err, &invalidValue):
+		return fmt.Errorf("%w: SNS rejected the message: %w", errors.ErrValidation, err)
+	case errors.As(err, &notFound):
+		return fmt.Errorf("%w: topic does not exist: %w", errors.ErrNotFound, err)
+	case errors.As(err, &unauthorized):
+		return fmt.Errorf("%w: not allowed to publish: %w", errors.ErrAuth, err)
+	case errors.As(err, &throttled):
+		return fmt.Errorf("%w: failed to publish message: %w", errors.ErrRateLimit, err)
+	default:
+		return fmt.Errorf("%w: failed to publish message: %w", errors.ErrPublish, err)
+	}
+}
+
+// Close implements Publisher; the SNS client holds no resources to release
+func (p *SNSPublisher) Close() error {
+	return nil
+}
+
+// snsAttributes converts attributes to SNS string attributes. SNS rejects
+// empty values, which are left out; beyond MaxSNSAttributes, those in
+// snsAttributePriority are kept first and then the rest by key.
+func snsAttributes(attributes map[string]string) map[string]types.MessageAttributeValue {
+	keys := make([]string, 0, len(attributes))
+	for key, value := range attributes {
+		if value != "" {
+			keys = append(keys, key)
+		}
+	}
+	rank := func(key string) int {
+		for i, k := range snsAttributePriority {
+			if k == key {
+				return i
+			}
+		}
+		return len(snsAttributePriority)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if ri, rj := rank(keys[i]), rank(keys[j]); ri != rj {
+			return ri < rj
+		}
+		return keys[i] < keys[j]
+	})
+
+	if len(keys) > MaxSNSAttributes {
+		for _, key := range keys[MaxSNSAttributes:] {
+			recordAttributeChange(key, AttributeDropped)
+		}
+		keys = keys[:MaxSNSAttributes]
+	}
+
+	out := make(map[string]types.MessageAttributeValue, len(keys))
+	for _, key := range keys {
+		out[key] = types.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(attributes[key]),
+		}
+	}
+	return out
+}
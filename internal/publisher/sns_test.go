@@ -0,0 +1,119 @@
+package publisher
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/mcncl/buildkite-pubsub/internal/errors"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeSNS records the last publish and returns err when set
+type fakeSNS struct {
+	input *sns.PublishInput
+	err   error
+}
+
+func (f *fakeSNS) Publish(_ context.Context, params *sns.PublishInput, _ ...func(*sns.Options)) (*sns.PublishOutput, error) {
+	f.input = params
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &sns.PublishOutput{MessageId: aws.String("sns-1")}, nil
+}
+
+func TestSNSPublisher(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	client := &fakeSNS{}
+	topic := "arn:aws:sns:us-east-1:123456789012:buildkite-events"
+	pub := NewSNSPublisher(client, topic)
+	attributes := map[string]string{"event_type": "build.finished", "pipeline": "api", "branch": ""}
+	for i := range 10 {
+		attributes["extra_"+strconv.Itoa(i)] = "x"
+	}
+
+	result, err := pub.PublishWithResult(context.Background(), map[string]string{"build": "1"}, attributes)
+	if err != nil {
+		t.Fatalf("PublishWithResult() error = %v", err)
+	}
+	if result.MessageID != "sns-1" || result.Topic != topic || result.PublishTime.IsZero() {
+		t.Errorf("PublishWithResult() = %+v", result)
+	}
+	input := client.input
+	if aws.ToString(input.TopicArn) != topic || aws.ToString(input.Message) != `{"build":"1"}` {
+		t.Errorf("published %q to %q", aws.ToString(input.Message), aws.ToString(input.TopicArn))
+	}
+	if input.MessageGroupId != nil {
+		t.Errorf("message group = %q for a standard topic, want none", aws.ToString(input.MessageGroupId))
+	}
+
+	// Empty values are left out and filter attributes kept over the rest
+	if len(input.MessageAttributes) != MaxSNSAttributes {
+		t.Errorf("published %d attributes, want %d", len(input.MessageAttributes), MaxSNSAttributes)
+	}
+	for _, key := range []string{"event_type", "pipeline", "extra_0"} {
+		if got := input.MessageAttributes[key]; aws.ToString(got.DataType) != "String" || aws.ToString(got.StringValue) != attributes[key] {
+			t.Errorf("attribute %s = %+v, want the string %q", key, got, attributes[key])
+		}
+	}
+	if _, ok := input.MessageAttributes["branch"]; ok {
+		t.Error("empty branch attribute published")
+	}
+	if got := testutil.ToFloat64(metrics.PubsubAttributesSanitizedTotal.WithLabelValues("extra_9", AttributeDropped)); got != 1 {
+		t.Errorf("dropped extra_9 = %v, want 1", got)
+	}
+
+	// Only failures a retry can fix are retryable
+	for _, tt := range []struct {
+		err       error
+		is        func(error) bool
+		retryable bool
+	}{
+		{&types.AuthorizationErrorException{Message: aws.String("not authorized")}, errors.IsAuthError, false},
+		{&types.InvalidParameterException{Message: aws.String("message too long")}, errors.IsValidationError, false},
+		{&types.NotFoundException{Message: aws.String("topic not found")}, errors.IsNotFoundError, false},
+		{&types.ThrottledException{Message: aws.String("slow down")}, errors.IsRateLimitError, true},
+		{fmt.Errorf("connection reset"), errors.IsPublishError, true},
+	} {
+		client.err = tt.err
+		_, err := pub.Publish(context.Background(), "data", nil)
+		if !tt.is(err) || errors.IsRetryable(err) != tt.retryable {
+			t.Errorf("Publish() with client error %v = %v, want it classified with retryable %v", tt.err, err, tt.retryable)
+		}
+	}
+}
+
+func TestSNSPublisherFIFO(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	client := &fakeSNS{}
+	pub := NewSNSPublisher(client, "arn:aws:sns:us-east-1:123456789012:buildkite-events.fifo")
+	ctx := WithDedupeKey(context.Background(), "delivery-1")
+	if _, err := pub.Publish(ctx, "data", map[string]string{"pipeline": "api"}); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if aws.ToString(client.input.MessageGroupId) != "api" || aws.ToString(client.input.MessageDeduplicationId) != "delivery-1" {
+		t.Errorf("group = %q, deduplication ID = %q, want api, delivery-1",
+			aws.ToString(client.input.MessageGroupId), aws.ToString(client.input.MessageDeduplicationId))
+	}
+
+	if _, err := pub.Publish(context.Background(), "data", nil); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if aws.ToString(client.input.MessageGroupId) != "default" || client.input.MessageDeduplicationId != nil {
+		t.Errorf("without a pipeline or dedupe key group = %q, deduplication ID = %v",
+			aws.ToString(client.input.MessageGroupId), client.input.MessageDeduplicationId)
+	}
+}
@@ -0,0 +1,85 @@
+package publisher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Publish publishes a value of a known type, so callers get compile-time
+// checking of the payload instead of passing interface{}
+func Publish[T any](ctx context.Context, pub Publisher, value T, attributes map[string]string) (string, error) {
+	return pub.Publish(ctx, value, attributes)
+}
+
+// TypedMessage is a message recorded by TypedMockPublisher
+type TypedMessage[T any] struct {
+	Value      T
+	Attributes map[string]string
+}
+
+// TypedMockPublisher is a Publisher for tests that decodes each published
+// message into T, the way a consumer would, so tests can assert on struct
+// fields rather than map lookups
+type TypedMockPublisher[T any] struct {
+	mu        sync.Mutex
+	published []TypedMessage[T]
+	err       error
+}
+
+// NewTypedMockPublisher creates a mock decoding messages into T
+func NewTypedMockPublisher[T any]() *TypedMockPublisher[T] {
+	return &TypedMockPublisher[T]{}
+}
+
+// Publish round-trips data through JSON into T and records it
+func (m *TypedMockPublisher[T]) Publish(ctx context.Context, data interface{}, attributes map[string]string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return "", m.err
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal data: %w", err)
+	}
+	var value T
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return "", fmt.Errorf("failed to decode published data as %T: %w", value, err)
+	}
+
+	m.published = append(m.published, TypedMessage[T]{Value: value, Attributes: attributes})
+	return fmt.Sprintf("mock-message-%d", len(m.published)), nil
+}
+
+// Close implements the Publisher interface
+func (m *TypedMockPublisher[T]) Close() error {
+	return nil
+}
+
+// Published returns every recorded message
+func (m *TypedMockPublisher[T]) Published() []TypedMessage[T] {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]TypedMessage[T](nil), m.published...)
+}
+
+// Last returns the most recent message, if any
+func (m *TypedMockPublisher[T]) Last() (TypedMessage[T], bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.published) == 0 {
+		return TypedMessage[T]{}, false
+	}
+	return m.published[len(m.published)-1], true
+}
+
+// SetError makes subsequent publishes fail with err; nil restores success
+func (m *TypedMockPublisher[T]) SetError(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.err = err
+}
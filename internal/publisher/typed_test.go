@@ -0,0 +1,54 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/internal/buildkite"
+)
+
+func TestTypedMockPublisher(t *testing.T) {
+	ctx := context.Background()
+	mock := NewTypedMockPublisher[buildkite.TransformedPayload]()
+
+	payload := buildkite.TransformedPayload{
+		EventType: "build.finished",
+		Build:     buildkite.BuildInfo{ID: "build-1", State: "passed"},
+	}
+	msgID, err := Publish(ctx, Publisher(mock), payload, map[string]string{"event_type": "build.finished"})
+	if err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if msgID != "mock-message-1" {
+		t.Errorf("message ID = %q, want mock-message-1", msgID)
+	}
+
+	// Untyped publishers such as the handler's are decoded too
+	if _, err := mock.Publish(ctx, map[string]interface{}{"event_type": "agent.connected"}, nil); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	published := mock.Published()
+	if len(published) != 2 {
+		t.Fatalf("published %d messages, want 2", len(published))
+	}
+	if got := published[0].Value.Build.State; got != "passed" {
+		t.Errorf("build state = %q, want passed", got)
+	}
+	last, ok := mock.Last()
+	if !ok || last.Value.EventType != "agent.connected" {
+		t.Errorf("Last() = %+v, %v, want agent.connected", last, ok)
+	}
+
+	// Data that does not decode into T is an error
+	if _, err := mock.Publish(ctx, []string{"not", "a", "payload"}, nil); err == nil {
+		t.Error("Publish() expected error for data that does not decode into T")
+	}
+
+	publishErr := errors.New("unavailable")
+	mock.SetError(publishErr)
+	if _, err := mock.Publish(ctx, payload, nil); !errors.Is(err, publishErr) {
+		t.Errorf("Publish() error = %v, want %v", err, publishErr)
+	}
+}
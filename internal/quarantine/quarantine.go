@@ -0,0 +1,138 @@
+// Package quarantine keeps webhook payloads that failed to transform in a
+// directory, with the error, so a transform bug doesn't lose them and they
+// can be reprocessed once it is fixed. A Cloud Storage bucket mounted with
+// Cloud Storage FUSE keeps them beyond the life of an instance.
+package quarantine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ext is the extension of quarantined payload files
+const ext = ".json"
+
+// Entry is a quarantined payload
+type Entry struct {
+	// ID identifies the body, so redeliveries of a payload share an entry
+	ID            string    `json:"id"`
+	QuarantinedAt time.Time `json:"quarantined_at"`
+	EventType     string    `json:"event_type,omitempty"`
+	DeliveryID    string    `json:"delivery_id,omitempty"`
+	Error         string    `json:"error"`
+	// Body is the webhook body exactly as received
+	Body string `json:"body"`
+}
+
+// Dir keeps quarantined payloads as one JSON file per entry. It is safe for
+// concurrent use, including by several processes sharing the directory.
+type Dir struct {
+	path string
+	now  func() time.Time
+}
+
+// NewDir creates a Dir, creating the directory if needed
+func NewDir(path string) (*Dir, error) {
+	if err := os.MkdirAll(path, 0o700); err != nil {
+		return nil, fmt.Errorf("create quarantine directory: %w", err)
+	}
+	return &Dir{path: path, now: time.Now}, nil
+}
+
+// Path returns the directory
+func (d *Dir) Path() string {
+	return d.path
+}
+
+// Put quarantines a body, replacing any earlier entry for the same body,
+// and returns the entry's ID
+func (d *Dir) Put(body []byte, eventType, deliveryID string, cause error) (string, error) {
+	sum := sha256.Sum256(body)
+	entry := Entry{
+		ID:            hex.EncodeToString(sum[:16]),
+		QuarantinedAt: d.now().UTC(),
+		EventType:     eventType,
+		DeliveryID:    deliveryID,
+		Error:         cause.Error(),
+		Body:          string(body),
+	}
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	// Write then rename, so readers never see a partial entry
+	tmp, err := os.CreateTemp(d.path, ".tmp-*")
+	if err != nil {
+		return "", fmt.Errorf("quarantine payload: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), d.file(entry.ID))
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", fmt.Errorf("quarantine payload: %w", err)
+	}
+	return entry.ID, nil
+}
+
+// List returns the quarantined entries, oldest first
+func (d *Dir) List() ([]Entry, error) {
+	files, err := os.ReadDir(d.path)
+	if err != nil {
+		return nil, fmt.Errorf("list quarantine: %w", err)
+	}
+	entries := []Entry{}
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") || filepath.Ext(f.Name()) != ext {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(d.path, f.Name()))
+		if os.IsNotExist(err) {
+			// Reprocessed since the directory was read
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read quarantined payload %s: %w", f.Name(), err)
+		}
+		var entry Entry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil, fmt.Errorf("decode quarantined payload %s: %w", f.Name(), err)
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].QuarantinedAt.Equal(entries[j].QuarantinedAt) {
+			return entries[i].QuarantinedAt.Before(entries[j].QuarantinedAt)
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	return entries, nil
+}
+
+// Remove deletes an entry; removing one that doesn't exist is not an error
+func (d *Dir) Remove(id string) error {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return fmt.Errorf("invalid quarantine id %q", id)
+	}
+	if err := os.Remove(d.file(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove quarantined payload: %w", err)
+	}
+	return nil
+}
+
+// file returns the path of an entry
+func (d *Dir) file(id string) string {
+	return filepath.Join(d.path, id+ext)
+}
@@ -0,0 +1,66 @@
+package quarantine
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDir(t *testing.T) {
+	dir, err := NewDir(filepath.Join(t.TempDir(), "quarantine"))
+	if err != nil {
+		t.Fatalf("NewDir() error = %v", err)
+	}
+	now := time.Date(2025, 1, 7, 1, 0, 0, 0, time.UTC)
+	dir.now = func() time.Time { return now }
+
+	body := []byte(`{"event":"build.finished", "build":{"id":"b1"}}`)
+	id, err := dir.Put(body, "build.finished", "d1", errors.New("bad build"))
+	if err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	// A redelivery replaces the entry rather than adding another
+	now = now.Add(time.Minute)
+	if again, err := dir.Put(body, "build.finished", "d1", errors.New("bad build")); err != nil || again != id {
+		t.Fatalf("Put() of the same body = %q, %v, want %q", again, err, id)
+	}
+	now = now.Add(time.Minute)
+	other, err := dir.Put([]byte(`{"event":"job.finished"}`), "job.finished", "", errors.New("bad job"))
+	if err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	entries, err := dir.List()
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(entries) != 2 || entries[0].ID != id || entries[1].ID != other {
+		t.Fatalf("List() = %+v, want %s then %s", entries, id, other)
+	}
+	if e := entries[0]; e.Body != string(body) || e.Error != "bad build" || e.DeliveryID != "d1" || e.EventType != "build.finished" {
+		t.Errorf("entry = %+v, want the body exactly as received with its error", e)
+	}
+
+	if err := dir.Remove(id); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if err := dir.Remove(id); err != nil {
+		t.Errorf("Remove() of a removed entry error = %v", err)
+	}
+	if err := dir.Remove("../" + other); err == nil {
+		t.Error("Remove() of a path outside the directory error = nil")
+	}
+	if entries, _ := dir.List(); len(entries) != 1 {
+		t.Errorf("List() after Remove() = %d entries, want 1", len(entries))
+	}
+
+	// Leftover temporary files are not entries
+	if err := os.WriteFile(filepath.Join(dir.Path(), ".tmp-1"), []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dir.List(); err != nil {
+		t.Errorf("List() with a temporary file error = %v", err)
+	}
+}
@@ -0,0 +1,297 @@
+// Package recorder keeps the most recent webhook requests and their
+// responses in memory, with credentials and configured payload fields
+// redacted, so operators can compare behaviour across versions and debug
+// failed deliveries without turning on debug logging.
+package recorder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/buildkite"
+	"github.com/mcncl/buildkite-pubsub/internal/middleware/request"
+)
+
+const (
+	// defaultSize is the number of exchanges kept unless configured
+	defaultSize = 100
+	// maxBodyBytes caps how much of each redacted body is kept
+	maxBodyBytes = 64 << 10
+	// maxParseBytes caps how much of each body is buffered to be parsed and
+	// redacted; larger bodies are recorded by size and hash only
+	maxParseBytes = 16 << 20
+	// redacted replaces credential headers and redacted payload fields
+	redacted = "[REDACTED]"
+)
+
+// DefaultRedactFields are payload fields that identify people or may hold
+// secrets, redacted unless other fields are configured
+var DefaultRedactFields = []string{
+	"build.env",
+	"build.meta_data",
+	"build.creator.email",
+	"build.author.email",
+	"sender.email",
+}
+
+// redactHeaders carry credentials and are never kept
+var redactHeaders = []string{
+	buildkite.TokenHeader,
+	buildkite.SignatureHeader,
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+}
+
+// Message is a recorded request or response
+type Message struct {
+	Header http.Header `json:"header"`
+	// Body is the redacted JSON body, or a JSON string of its first 64 KiB
+	// when truncated. Bodies that are not JSON, such as gzip-encoded ones,
+	// are never kept; only their size and hash are.
+	Body      json.RawMessage `json:"body,omitempty"`
+	Truncated bool            `json:"truncated,omitempty"`
+	// Size is the length of the body as sent, and SHA256 its hex digest
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// Exchange is a recorded webhook request and the response it got
+type Exchange struct {
+	Time       time.Time `json:"time"`
+	DurationMS int64     `json:"duration_ms"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	RequestID  string    `json:"request_id,omitempty"`
+	DeliveryID string    `json:"delivery_id,omitempty"`
+	Request    Message   `json:"request"`
+	Response   Message   `json:"response"`
+}
+
+// Filter selects recorded exchanges; empty fields match every exchange
+type Filter struct {
+	RequestID  string
+	DeliveryID string
+	// Limit caps the number returned; 0 returns every match
+	Limit int
+}
+
+// Recorder keeps the last exchanges in a ring buffer
+type Recorder struct {
+	redactFields [][]string
+
+	mu        sync.Mutex
+	exchanges []Exchange
+	// next is the index the next exchange is written to
+	next  int
+	count int
+}
+
+// New creates a recorder keeping the last size exchanges, or 100 when size
+// is zero. redactFields are dotted JSON paths such as "sender.email", where
+// a "*" segment matches every key; nil uses DefaultRedactFields.
+func New(size int, redactFields []string) *Recorder {
+	if size <= 0 {
+		size = defaultSize
+	}
+	if redactFields == nil {
+		redactFields = DefaultRedactFields
+	}
+	r := &Recorder{exchanges: make([]Exchange, size)}
+	for _, field := range redactFields {
+		if field != "" {
+			r.redactFields = append(r.redactFields, strings.Split(field, "."))
+		}
+	}
+	return r
+}
+
+// Recent returns the exchanges matching filter, newest first
+func (r *Recorder) Recent(filter Filter) []Exchange {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	matched := []Exchange{}
+	for i := 1; i <= r.count; i++ {
+		exchange := r.exchanges[(r.next-i+len(r.exchanges))%len(r.exchanges)]
+		if filter.RequestID != "" && exchange.RequestID != filter.RequestID {
+			continue
+		}
+		if filter.DeliveryID != "" && exchange.DeliveryID != filter.DeliveryID {
+			continue
+		}
+		matched = append(matched, exchange)
+		if filter.Limit > 0 && len(matched) == filter.Limit {
+			break
+		}
+	}
+	return matched
+}
+
+// Reset discards every recorded exchange
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clear(r.exchanges)
+	r.next, r.count = 0, 0
+}
+
+// add stores an exchange, replacing the oldest when full
+func (r *Recorder) add(exchange Exchange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.exchanges[r.next] = exchange
+	r.next = (r.next + 1) % len(r.exchanges)
+	if r.count < len(r.exchanges) {
+		r.count++
+	}
+}
+
+// Middleware records each request and its response. Bodies are captured as
+// the handler reads and writes them, so requests rejected before their body
+// is read are recorded without one.
+func (r *Recorder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		requestHeader := req.Header.Clone()
+
+		var requestBody capture
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(req.Body, &requestBody), req.Body}
+		}
+		rw := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rw, req)
+
+		if rw.header == nil {
+			rw.header = w.Header().Clone()
+		}
+		requestID, _ := req.Context().Value(request.RequestIDKey).(string)
+		r.add(Exchange{
+			Time:       start.UTC(),
+			DurationMS: time.Since(start).Milliseconds(),
+			Method:     req.Method,
+			Path:       req.URL.Path,
+			Status:     rw.status,
+			RequestID:  requestID,
+			DeliveryID: req.Header.Get(buildkite.DeliveryIDHeader),
+			Request:    r.message(requestHeader, &requestBody),
+			Response:   r.message(rw.header, &rw.body),
+		})
+	})
+}
+
+// message sanitizes a recorded header and body
+func (r *Recorder) message(header http.Header, body *capture) Message {
+	for _, name := range redactHeaders {
+		if header.Get(name) != "" {
+			header.Set(name, redacted)
+		}
+	}
+	msg := Message{Header: header}
+	if body.size == 0 {
+		return msg
+	}
+	msg.Size, msg.SHA256 = body.size, hex.EncodeToString(body.hash.Sum(nil))
+
+	// Redact before truncating, so no part of a redacted field is kept
+	var value interface{}
+	if body.overflow || json.Unmarshal(body.data, &value) != nil {
+		return msg
+	}
+	if obj, ok := value.(map[string]interface{}); ok {
+		for _, field := range r.redactFields {
+			redact(obj, field)
+		}
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return msg
+	}
+	if len(data) > maxBodyBytes {
+		msg.Body, _ = json.Marshal(string(data[:maxBodyBytes]))
+		msg.Truncated = true
+		return msg
+	}
+	msg.Body = data
+	return msg
+}
+
+// redact replaces the value at path, where "*" matches every key
+func redact(obj map[string]interface{}, path []string) {
+	key, rest := path[0], path[1:]
+	for k, value := range obj {
+		if key != "*" && k != key {
+			continue
+		}
+		if len(rest) == 0 {
+			obj[k] = redacted
+			continue
+		}
+		if child, ok := value.(map[string]interface{}); ok {
+			redact(child, rest)
+		}
+	}
+}
+
+// capture buffers up to maxParseBytes written to it, and the size and
+// hash of everything written
+type capture struct {
+	data     []byte
+	overflow bool
+	size     int64
+	hash     hash.Hash
+}
+
+func (c *capture) Write(p []byte) (int, error) {
+	if c.hash == nil {
+		c.hash = sha256.New()
+	}
+	c.hash.Write(p)
+	c.size += int64(len(p))
+	if !c.overflow {
+		if len(c.data)+len(p) > maxParseBytes {
+			c.data, c.overflow = nil, true
+		} else {
+			c.data = append(c.data, p...)
+		}
+	}
+	return len(p), nil
+}
+
+// responseRecorder captures the status, headers and body of a response
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   capture
+}
+
+// WriteHeader captures the status and the headers sent with it
+func (w *responseRecorder) WriteHeader(statusCode int) {
+	if w.header == nil {
+		w.status = statusCode
+		w.header = w.ResponseWriter.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write captures the body
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	if w.header == nil {
+		w.WriteHeader(http.StatusOK)
+	}
+	_, _ = w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,137 @@
+package recorder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/internal/buildkite"
+	"github.com/mcncl/buildkite-pubsub/internal/middleware/request"
+)
+
+// echo reads the request body and answers with a JSON status
+var echo = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	_, _ = io.ReadAll(r.Body)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write([]byte(`{"status":"success"}`))
+})
+
+func serve(handler http.Handler, body, deliveryID string) {
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+	req.Header.Set(buildkite.TokenHeader, "secret-token")
+	req.Header.Set(buildkite.DeliveryIDHeader, deliveryID)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func TestMiddleware(t *testing.T) {
+	rec := New(10, nil)
+	handler := request.WithRequestID(rec.Middleware(echo))
+
+	serve(handler, `{"event":"build.finished","build":{"id":"b1","env":{"SECRET":"x"},"creator":{"name":"Ada","email":"ada@example.com"}}}`, "d1")
+
+	exchanges := rec.Recent(Filter{})
+	if len(exchanges) != 1 {
+		t.Fatalf("Recent() returned %d exchanges, want 1", len(exchanges))
+	}
+	got := exchanges[0]
+	if got.Method != http.MethodPost || got.Path != "/webhook" || got.Status != http.StatusAccepted {
+		t.Errorf("exchange = %s %s %d, want POST /webhook 202", got.Method, got.Path, got.Status)
+	}
+	if got.DeliveryID != "d1" || got.RequestID == "" {
+		t.Errorf("DeliveryID = %q, RequestID = %q", got.DeliveryID, got.RequestID)
+	}
+	if token := got.Request.Header.Get(buildkite.TokenHeader); token != redacted {
+		t.Errorf("recorded token header = %q, want %q", token, redacted)
+	}
+	if id := got.Response.Header.Get(request.RequestIDHeader); id != got.RequestID {
+		t.Errorf("recorded response X-Request-ID = %q, want %q", id, got.RequestID)
+	}
+
+	var body struct {
+		Build struct {
+			ID      string            `json:"id"`
+			Env     interface{}       `json:"env"`
+			Creator map[string]string `json:"creator"`
+		} `json:"build"`
+	}
+	if err := json.Unmarshal(got.Request.Body, &body); err != nil {
+		t.Fatalf("recorded request body is not JSON: %v", err)
+	}
+	if body.Build.ID != "b1" || body.Build.Env != redacted || body.Build.Creator["email"] != redacted || body.Build.Creator["name"] != "Ada" {
+		t.Errorf("recorded request body = %s", got.Request.Body)
+	}
+	if string(got.Response.Body) != `{"status":"success"}` {
+		t.Errorf("recorded response body = %s", got.Response.Body)
+	}
+}
+
+func TestMiddlewareBodies(t *testing.T) {
+	rec := New(10, nil)
+	handler := rec.Middleware(echo)
+
+	secret := `not json: {"build":{"env":{"SECRET":"hunter2"}}}`
+	serve(handler, secret, "d1")
+	got := rec.Recent(Filter{DeliveryID: "d1"})[0].Request
+	sum := sha256.Sum256([]byte(secret))
+	if got.Body != nil || got.Size != int64(len(secret)) || got.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("non-JSON body recorded as %s, size %d, hash %s; want only its size and hash", got.Body, got.Size, got.SHA256)
+	}
+
+	// Large payloads are redacted before being truncated, so secrets
+	// within the part kept are redacted too
+	large := `{"event":"build.finished","build":{"id":"b1","env":{"SECRET":"hunter2"},"creator":{"email":"ada@example.com"},"message":"` + strings.Repeat("x", maxBodyBytes) + `"}}`
+	serve(handler, large, "d2")
+	got = rec.Recent(Filter{DeliveryID: "d2"})[0].Request
+	var body string
+	if err := json.Unmarshal(got.Body, &body); err != nil || len(body) != maxBodyBytes || !got.Truncated || got.Size != int64(len(large)) {
+		t.Errorf("large body recorded %d bytes, truncated %v, size %d; want %d, true, %d", len(body), got.Truncated, got.Size, maxBodyBytes, len(large))
+	}
+	for _, exchange := range rec.Recent(Filter{}) {
+		recorded, _ := json.Marshal(exchange)
+		if strings.Contains(string(recorded), "hunter2") || strings.Contains(string(recorded), "ada@example.com") {
+			t.Errorf("exchange %s recorded a redacted value: %s", exchange.DeliveryID, recorded)
+		}
+	}
+
+	// Requests rejected before the body is read are recorded without it
+	reject := rec.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "paused", http.StatusServiceUnavailable)
+	}))
+	serve(reject, `{"event":"ping"}`, "d3")
+	if got := rec.Recent(Filter{DeliveryID: "d3"})[0]; got.Status != http.StatusServiceUnavailable || got.Request.Body != nil {
+		t.Errorf("rejected exchange status = %d, request body = %s", got.Status, got.Request.Body)
+	}
+}
+
+func TestRecent(t *testing.T) {
+	rec := New(3, nil)
+	handler := rec.Middleware(echo)
+	for _, id := range []string{"d1", "d2", "d3", "d4"} {
+		serve(handler, "{}", id)
+	}
+
+	var ids []string
+	for _, exchange := range rec.Recent(Filter{}) {
+		ids = append(ids, exchange.DeliveryID)
+	}
+	if strings.Join(ids, ",") != "d4,d3,d2" {
+		t.Errorf("Recent() delivery IDs = %v, want d4,d3,d2", ids)
+	}
+	if got := rec.Recent(Filter{Limit: 1}); len(got) != 1 || got[0].DeliveryID != "d4" {
+		t.Errorf("Recent(limit 1) = %v, want d4", got)
+	}
+	if got := rec.Recent(Filter{DeliveryID: "d1"}); len(got) != 0 {
+		t.Errorf("Recent(d1) returned %d exchanges, want the evicted d1 gone", len(got))
+	}
+
+	rec.Reset()
+	if got := rec.Recent(Filter{}); len(got) != 0 {
+		t.Errorf("Recent() after Reset returned %d exchanges", len(got))
+	}
+}
@@ -0,0 +1,162 @@
+// Package rejections samples sanitized records of rejected webhook requests
+// into a diagnostics topic or the log, so spikes of auth and validation
+// failures, such as a Buildkite organization sending the wrong token, can be
+// investigated without storing payloads or credentials.
+package rejections
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/buildkite"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/internal/middleware/request"
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+)
+
+// EventType is the event_type attribute of published records
+const EventType = "rejection"
+
+// publishTimeout bounds each publish, so a broken diagnostics topic adds
+// little to a rejected request
+const publishTimeout = time.Second
+
+// Record describes a rejected request. It never holds the body, the token
+// or the signature.
+type Record struct {
+	Reason     string `json:"reason"`
+	Status     int    `json:"status"`
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	ClientIP   string `json:"client_ip,omitempty"`
+	UserAgent  string `json:"user_agent,omitempty"`
+	RequestID  string `json:"request_id,omitempty"`
+	DeliveryID string `json:"delivery_id,omitempty"`
+	Event      string `json:"event,omitempty"`
+	// Auth is how the request authenticated: "token", "signature" or "none"
+	Auth string `json:"auth"`
+	// TokenFingerprint is the start of the token's SHA-256 hash, enough to
+	// tell organizations apart without revealing the token
+	TokenFingerprint string    `json:"token_fingerprint,omitempty"`
+	ContentLength    int64     `json:"content_length"`
+	RejectedAt       time.Time `json:"rejected_at"`
+}
+
+// Config holds the settings for a Sampler
+type Config struct {
+	// Publisher receives sampled records; nil logs them instead
+	Publisher publisher.Publisher
+	// SampleRate is the fraction of rejections recorded, from 0 to 1
+	SampleRate float64
+	Logger     *slog.Logger
+}
+
+// Sampler records a sample of rejected requests
+type Sampler struct {
+	publisher publisher.Publisher
+	rate      float64
+	logger    *slog.Logger
+	random    func() float64
+}
+
+// New creates a Sampler
+func New(cfg Config) *Sampler {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &Sampler{
+		publisher: cfg.Publisher,
+		rate:      cfg.SampleRate,
+		logger:    logger,
+		random:    rand.Float64,
+	}
+}
+
+// Record samples a request rejected for reason with the given status code.
+// Failures are counted but never affect the response.
+func (s *Sampler) Record(ctx context.Context, r *http.Request, reason string, status int) {
+	if s.random() >= s.rate {
+		return
+	}
+	record := newRecord(r, reason, status)
+
+	if s.publisher == nil {
+		s.logger.Info("Rejected webhook request",
+			"reason", record.Reason,
+			"status", record.Status,
+			"method", record.Method,
+			"path", record.Path,
+			"client_ip", record.ClientIP,
+			"user_agent", record.UserAgent,
+			"request_id", record.RequestID,
+			"delivery_id", record.DeliveryID,
+			"event", record.Event,
+			"auth", record.Auth,
+			"token_fingerprint", record.TokenFingerprint,
+			"content_length", record.ContentLength,
+		)
+		metrics.RejectionSamplesTotal.WithLabelValues(reason, "success").Inc()
+		return
+	}
+
+	// Publish even if the request has been cancelled
+	publishCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), publishTimeout)
+	defer cancel()
+	attributes := map[string]string{
+		"origin":     "buildkite-webhook",
+		"event_type": EventType,
+		"reason":     reason,
+		"status":     strconv.Itoa(status),
+	}
+	if _, err := s.publisher.Publish(publishCtx, record, attributes); err != nil {
+		metrics.RejectionSamplesTotal.WithLabelValues(reason, "error").Inc()
+		s.logger.Warn("Failed to publish rejection record", "reason", reason, "error", err)
+		return
+	}
+	metrics.RejectionSamplesTotal.WithLabelValues(reason, "success").Inc()
+}
+
+// newRecord describes r without its body or credentials
+func newRecord(r *http.Request, reason string, status int) Record {
+	record := Record{
+		Reason:        reason,
+		Status:        status,
+		Method:        r.Method,
+		Path:          r.URL.Path,
+		ClientIP:      clientIP(r),
+		UserAgent:     r.UserAgent(),
+		DeliveryID:    r.Header.Get(buildkite.DeliveryIDHeader),
+		Event:         r.Header.Get(buildkite.EventHeader),
+		Auth:          "none",
+		ContentLength: r.ContentLength,
+		RejectedAt:    time.Now().UTC(),
+	}
+	if id, ok := r.Context().Value(request.RequestIDKey).(string); ok {
+		record.RequestID = id
+	}
+	if token := r.Header.Get(buildkite.TokenHeader); token != "" {
+		sum := sha256.Sum256([]byte(token))
+		record.Auth = "token"
+		record.TokenFingerprint = hex.EncodeToString(sum[:6])
+	} else if r.Header.Get(buildkite.SignatureHeader) != "" {
+		record.Auth = "signature"
+	}
+	return record
+}
+
+// clientIP returns the host part of the request's remote address
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,116 @@
+package rejections
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/internal/buildkite"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/internal/middleware/request"
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newRequest(token string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(`{"event":"build.finished"}`))
+	req.RemoteAddr = "203.0.113.7:4242"
+	req.Header.Set("User-Agent", "Buildkite-Request")
+	req.Header.Set(buildkite.EventHeader, "build.finished")
+	req.Header.Set(buildkite.DeliveryIDHeader, "delivery-1")
+	if token != "" {
+		req.Header.Set(buildkite.TokenHeader, token)
+	}
+	return req.WithContext(context.WithValue(req.Context(), request.RequestIDKey, "request-1"))
+}
+
+func TestRecord(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	mock := publisher.NewTypedMockPublisher[Record]()
+	s := New(Config{Publisher: mock, SampleRate: 1})
+	s.Record(context.Background(), newRequest("secret-token"), "auth_failure", http.StatusUnauthorized)
+
+	last, ok := mock.Last()
+	if !ok {
+		t.Fatal("no record published")
+	}
+	record := last.Value
+	if record.Reason != "auth_failure" || record.Status != http.StatusUnauthorized || record.Method != http.MethodPost ||
+		record.Path != "/webhook" || record.ClientIP != "203.0.113.7" || record.UserAgent != "Buildkite-Request" ||
+		record.RequestID != "request-1" || record.DeliveryID != "delivery-1" || record.Event != "build.finished" ||
+		record.Auth != "token" || record.ContentLength != 26 || record.RejectedAt.IsZero() {
+		t.Errorf("record = %+v", record)
+	}
+	if len(record.TokenFingerprint) != 12 || strings.Contains(record.TokenFingerprint, "secret") {
+		t.Errorf("token fingerprint = %q, want 12 hex characters of the token's hash", record.TokenFingerprint)
+	}
+	if last.Attributes["event_type"] != EventType || last.Attributes["reason"] != "auth_failure" || last.Attributes["status"] != "401" {
+		t.Errorf("attributes = %v", last.Attributes)
+	}
+
+	// The same token always has the same fingerprint
+	s.Record(context.Background(), newRequest("secret-token"), "auth_failure", http.StatusUnauthorized)
+	if again, _ := mock.Last(); again.Value.TokenFingerprint != record.TokenFingerprint {
+		t.Errorf("fingerprint changed from %q to %q", record.TokenFingerprint, again.Value.TokenFingerprint)
+	}
+
+	mock.SetError(errors.New("topic not found"))
+	s.Record(context.Background(), newRequest(""), "json_decode_error", http.StatusBadRequest)
+	if got := testutil.ToFloat64(metrics.RejectionSamplesTotal.WithLabelValues("auth_failure", "success")); got != 2 {
+		t.Errorf("successful samples = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(metrics.RejectionSamplesTotal.WithLabelValues("json_decode_error", "error")); got != 1 {
+		t.Errorf("failed samples = %v, want 1", got)
+	}
+}
+
+func TestRecordSampling(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	mock := publisher.NewTypedMockPublisher[Record]()
+	s := New(Config{Publisher: mock, SampleRate: 0.25})
+	draws := []float64{0.1, 0.25, 0.9, 0.2}
+	s.random = func() float64 {
+		draw := draws[0]
+		draws = draws[1:]
+		return draw
+	}
+	for range 4 {
+		s.Record(context.Background(), newRequest(""), "auth_failure", http.StatusUnauthorized)
+	}
+	if got := len(mock.Published()); got != 2 {
+		t.Errorf("sampled %d of 4 rejections, want 2", got)
+	}
+}
+
+func TestRecordLog(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	var logs bytes.Buffer
+	s := New(Config{SampleRate: 1, Logger: slog.New(slog.NewJSONHandler(&logs, nil))})
+	req := newRequest("")
+	req.Header.Set(buildkite.SignatureHeader, "timestamp=1,signature=abc")
+	s.Record(context.Background(), req, "auth_failure", http.StatusUnauthorized)
+
+	for _, want := range []string{`"reason":"auth_failure"`, `"auth":"signature"`, `"client_ip":"203.0.113.7"`} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("log = %s, want %s", logs.String(), want)
+		}
+	}
+	if strings.Contains(logs.String(), "signature=abc") || strings.Contains(logs.String(), "build.finished\"}") {
+		t.Errorf("log = %s, leaks the signature or body", logs.String())
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/mcncl/buildkite-pubsub/internal/config"
+	"golang.org/x/net/netutil"
+)
+
+// listenFDsStart is the first file descriptor systemd passes to an
+// activated service
+var listenFDsStart uintptr = 3
+
+// Listen opens the configured listener: the socket passed by systemd, a unix
+// socket, or TCP on Port. With MaxConnections set, connections beyond the
+// limit wait in the kernel's accept queue until an open connection closes.
+//
+// Shutting down the server closes the listener. A unix socket is removed
+// then; a systemd socket stays open in systemd, which queues new connections
+// for the next instance.
+func Listen(cfg config.ServerConfig) (net.Listener, error) {
+	var ln net.Listener
+	var err error
+	switch {
+	case cfg.SystemdSocket:
+		ln, err = listenSystemd()
+	case cfg.UnixSocket != "":
+		ln, err = listenUnix(cfg.UnixSocket, cfg.UnixSocketMode)
+	default:
+		ln, err = net.Listen("tcp", fmt.Sprintf(":%d", cfg.Port))
+		if err != nil {
+			err = fmt.Errorf("failed to listen on port %d: %w", cfg.Port, err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.MaxConnections > 0 {
+		ln = netutil.LimitListener(ln, cfg.MaxConnections)
+	}
+	return ln, nil
+}
+
+// listenSystemd returns the single socket passed by systemd socket
+// activation, following sd_listen_fds(3)
+func listenSystemd() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, fmt.Errorf("no socket passed by systemd: LISTEN_PID is not this process")
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, fmt.Errorf("no socket passed by systemd: LISTEN_FDS is %q", os.Getenv("LISTEN_FDS"))
+	}
+	if fds > 1 {
+		return nil, fmt.Errorf("systemd passed %d sockets, expected one", fds)
+	}
+
+	// Child processes must not think the socket was passed to them
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	// FileListener duplicates the descriptor, so close the original
+	f := os.NewFile(listenFDsStart, "systemd-socket")
+	defer func() { _ = f.Close() }()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use socket passed by systemd: %w", err)
+	}
+	return ln, nil
+}
+
+// listenUnix listens on a unix socket at path with the given octal file mode
+func listenUnix(path, mode string) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on unix socket %s: %w", path, err)
+	}
+
+	if mode != "" {
+		perm, err := strconv.ParseUint(mode, 8, 32)
+		if err == nil {
+			err = os.Chmod(path, fs.FileMode(perm))
+		}
+		if err != nil {
+			_ = ln.Close()
+			return nil, fmt.Errorf("failed to set mode %s on unix socket %s: %w", mode, path, err)
+		}
+	}
+	return ln, nil
+}
+
+// removeStaleSocket removes a socket left behind by a process that exited
+// without closing its listener. A path that is not a socket, or a socket
+// another process still accepts connections on, is left alone.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check unix socket %s: %w", path, err)
+	}
+	if info.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("unix socket path %s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("unix socket %s is in use by another process", path)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove stale unix socket %s: %w", path, err)
+	}
+	return nil
+}
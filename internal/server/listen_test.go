@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/config"
+)
+
+// serveListener serves a handler that echoes the protocol on ln and returns
+// the server so tests can shut it down
+func serveListener(t *testing.T, ln net.Listener) *http.Server {
+	t.Helper()
+	srv := New(config.ServerConfig{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Proto)
+	}))
+	go func() { _ = srv.Serve(ln) }()
+	t.Cleanup(func() { _ = srv.Close() })
+	return srv
+}
+
+// unixClient returns an HTTP client that dials the unix socket at path
+func unixClient(path string) *http.Client {
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhook.sock")
+	ln, err := Listen(config.ServerConfig{UnixSocket: path, UnixSocketMode: "0660", MaxConnections: 10})
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	srv := serveListener(t, ln)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o660 {
+		t.Errorf("socket mode = %o, want 660", perm)
+	}
+
+	resp, err := unixClient(path).Get("http://webhook/")
+	if err != nil {
+		t.Fatalf("GET error = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(body) != "HTTP/1.1" {
+		t.Errorf("body = %q, want HTTP/1.1", body)
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket still exists after shutdown: %v", err)
+	}
+}
+
+func TestListenUnixExistingPath(t *testing.T) {
+	t.Run("stale socket is replaced", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "webhook.sock")
+		stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+		if err != nil {
+			t.Fatalf("ListenUnix() error = %v", err)
+		}
+		stale.SetUnlinkOnClose(false)
+		_ = stale.Close()
+
+		ln, err := Listen(config.ServerConfig{UnixSocket: path})
+		if err != nil {
+			t.Fatalf("Listen() error = %v", err)
+		}
+		_ = ln.Close()
+	})
+
+	t.Run("socket in use is an error", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "webhook.sock")
+		live, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatalf("Listen() error = %v", err)
+		}
+		defer func() { _ = live.Close() }()
+
+		if _, err := Listen(config.ServerConfig{UnixSocket: path}); err == nil || !strings.Contains(err.Error(), "in use") {
+			t.Errorf("Listen() error = %v, want in use error", err)
+		}
+	})
+
+	t.Run("regular file is left alone", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "webhook.sock")
+		if err := os.WriteFile(path, []byte("keep"), 0o600); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+
+		if _, err := Listen(config.ServerConfig{UnixSocket: path}); err == nil {
+			t.Error("Listen() expected error for a regular file")
+		}
+		if data, err := os.ReadFile(path); err != nil || string(data) != "keep" {
+			t.Errorf("file was changed: %q, %v", data, err)
+		}
+	})
+}
+
+func TestListenSystemdErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		pid  string
+		fds  string
+		want string
+	}{
+		{name: "not activated", want: "LISTEN_PID"},
+		{name: "other process", pid: strconv.Itoa(os.Getpid() + 1), fds: "1", want: "LISTEN_PID"},
+		{name: "no sockets", pid: strconv.Itoa(os.Getpid()), fds: "0", want: "LISTEN_FDS"},
+		{name: "several sockets", pid: strconv.Itoa(os.Getpid()), fds: "2", want: "expected one"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LISTEN_PID", tt.pid)
+			t.Setenv("LISTEN_FDS", tt.fds)
+
+			_, err := Listen(config.ServerConfig{SystemdSocket: true})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Listen() error = %v, want error mentioning %s", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+//go:build unix
+
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/config"
+)
+
+func TestListenSystemd(t *testing.T) {
+	// Stand in for systemd: open a socket and pass its descriptor the way
+	// systemd would, with LISTEN_PID and LISTEN_FDS
+	inherited, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer func() { _ = inherited.Close() }()
+	f, err := inherited.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("File() error = %v", err)
+	}
+	fd, err := syscall.Dup(int(f.Fd()))
+	_ = f.Close()
+	if err != nil {
+		t.Fatalf("Dup() error = %v", err)
+	}
+
+	orig := listenFDsStart
+	listenFDsStart = uintptr(fd)
+	defer func() { listenFDsStart = orig }()
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "webhook")
+
+	ln, err := Listen(config.ServerConfig{SystemdSocket: true})
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	srv := serveListener(t, ln)
+
+	for _, env := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if _, ok := os.LookupEnv(env); ok {
+			t.Errorf("%s is still set", env)
+		}
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + inherited.Addr().String())
+	if err != nil {
+		t.Fatalf("GET error = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(body) != "HTTP/1.1" {
+		t.Errorf("body = %q, want HTTP/1.1", body)
+	}
+
+	// After shutdown systemd's socket stays open and queues connections for
+	// the next instance
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	conn, err := net.DialTimeout("tcp", inherited.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("socket closed after shutdown: %v", err)
+	}
+	_ = conn.Close()
+}
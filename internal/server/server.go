@@ -0,0 +1,74 @@
+// Package server builds the webhook's HTTP server and listener from the
+// server configuration.
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/mcncl/buildkite-pubsub/internal/config"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+)
+
+// New returns an HTTP server for handler with the configured timeouts, header
+// limit, keep-alive behaviour and protocols. Open connections are reported in
+// the buildkite_http_connections metrics.
+func New(cfg config.ServerConfig, handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Addr:              fmt.Sprintf(":%d", cfg.Port),
+		Handler:           handler,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		ConnState:         newConnTracker().track,
+	}
+	srv.SetKeepAlivesEnabled(!cfg.DisableKeepAlives)
+
+	if cfg.EnableH2C {
+		var protocols http.Protocols
+		protocols.SetHTTP1(true)
+		protocols.SetUnencryptedHTTP2(true)
+		srv.Protocols = &protocols
+	}
+	if cfg.HTTP2MaxConcurrentStreams > 0 {
+		srv.HTTP2 = &http.HTTP2Config{MaxConcurrentStreams: cfg.HTTP2MaxConcurrentStreams}
+	}
+
+	return srv
+}
+
+// connTracker keeps the state of each open connection so the gauge can move
+// a connection between states as the server reports transitions
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]http.ConnState
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[net.Conn]http.ConnState)}
+}
+
+func (t *connTracker) track(conn net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if prev, ok := t.conns[conn]; ok {
+		metrics.HTTPConnections.WithLabelValues(prev.String()).Dec()
+	}
+
+	switch state {
+	case http.StateNew, http.StateActive, http.StateIdle:
+		if state == http.StateNew {
+			metrics.HTTPConnectionsTotal.Inc()
+		}
+		t.conns[conn] = state
+		metrics.HTTPConnections.WithLabelValues(state.String()).Inc()
+	default:
+		// Hijacked and closed connections are no longer the server's
+		delete(t.conns, conn)
+	}
+}
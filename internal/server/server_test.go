@@ -0,0 +1,208 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/config"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestMain initializes metrics once: servers from earlier tests may still be
+// reporting connection state changes when the next test starts
+func TestMain(m *testing.M) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to initialize metrics: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// serve starts a server for cfg on a random port and returns its address
+func serve(t *testing.T, cfg config.ServerConfig) string {
+	t.Helper()
+	srv := New(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, r.Proto)
+	}))
+	ln, err := Listen(cfg)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	go func() { _ = srv.Serve(ln) }()
+	t.Cleanup(func() { _ = srv.Close() })
+	return ln.Addr().String()
+}
+
+func TestNew(t *testing.T) {
+	cfg := config.DefaultConfig().Server
+	cfg.ReadHeaderTimeout = 2 * time.Second
+	cfg.MaxHeaderBytes = 64 << 10
+	cfg.HTTP2MaxConcurrentStreams = 500
+
+	srv := New(cfg, http.NotFoundHandler())
+	if srv.Addr != ":8888" {
+		t.Errorf("Addr = %q, want :8888", srv.Addr)
+	}
+	if srv.ReadTimeout != cfg.ReadTimeout || srv.ReadHeaderTimeout != 2*time.Second ||
+		srv.WriteTimeout != cfg.WriteTimeout || srv.IdleTimeout != cfg.IdleTimeout {
+		t.Errorf("timeouts = %v/%v/%v/%v, want configured timeouts", srv.ReadTimeout, srv.ReadHeaderTimeout, srv.WriteTimeout, srv.IdleTimeout)
+	}
+	if srv.MaxHeaderBytes != 64<<10 {
+		t.Errorf("MaxHeaderBytes = %d, want %d", srv.MaxHeaderBytes, 64<<10)
+	}
+	if srv.HTTP2 == nil || srv.HTTP2.MaxConcurrentStreams != 500 {
+		t.Errorf("HTTP2 = %+v, want MaxConcurrentStreams 500", srv.HTTP2)
+	}
+	if srv.Protocols != nil {
+		t.Errorf("Protocols = %v, want net/http defaults without h2c", srv.Protocols)
+	}
+}
+
+func TestH2C(t *testing.T) {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: &protocols}, Timeout: 5 * time.Second}
+
+	tests := []struct {
+		name    string
+		h2c     bool
+		wantErr bool
+	}{
+		{name: "enabled", h2c: true},
+		{name: "disabled", h2c: false, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := serve(t, config.ServerConfig{EnableH2C: tt.h2c})
+
+			resp, err := client.Get("http://" + addr)
+			if tt.wantErr {
+				if err == nil {
+					_ = resp.Body.Close()
+					t.Fatal("expected HTTP/2 prior knowledge request to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GET error = %v", err)
+			}
+			defer func() { _ = resp.Body.Close() }()
+			if resp.ProtoMajor != 2 {
+				t.Errorf("Proto = %s, want HTTP/2.0", resp.Proto)
+			}
+		})
+	}
+
+	t.Run("HTTP/1.1 still served", func(t *testing.T) {
+		addr := serve(t, config.ServerConfig{EnableH2C: true})
+		resp, err := http.Get("http://" + addr)
+		if err != nil {
+			t.Fatalf("GET error = %v", err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		if resp.ProtoMajor != 1 {
+			t.Errorf("Proto = %s, want HTTP/1.1", resp.Proto)
+		}
+	})
+}
+
+func TestDisableKeepAlives(t *testing.T) {
+	addr := serve(t, config.ServerConfig{DisableKeepAlives: true})
+
+	resp, err := http.Get("http://" + addr)
+	if err != nil {
+		t.Fatalf("GET error = %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if !resp.Close {
+		t.Error("expected the server to close the connection after the response")
+	}
+}
+
+// get sends a request on conn and returns a reader for the response
+func get(t *testing.T, conn net.Conn) *bufio.Reader {
+	t.Helper()
+	if _, err := fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: test\r\n\r\n"); err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	return bufio.NewReader(conn)
+}
+
+func TestMaxConnections(t *testing.T) {
+	addr := serve(t, config.ServerConfig{MaxConnections: 1})
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial error = %v", err)
+	}
+	if _, err := get(t, first).ReadString('\n'); err != nil {
+		t.Fatalf("first connection: %v", err)
+	}
+
+	// The second connection waits to be accepted while the first is open
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial error = %v", err)
+	}
+	defer func() { _ = second.Close() }()
+	resp := get(t, second)
+	_ = second.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := resp.ReadString('\n'); err == nil {
+		t.Fatal("second connection was served while the limit was reached")
+	}
+
+	_ = first.Close()
+	_ = second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := resp.ReadString('\n'); err != nil {
+		t.Fatalf("second connection after the first closed: %v", err)
+	}
+}
+
+func TestConnectionMetrics(t *testing.T) {
+	idle := metrics.HTTPConnections.WithLabelValues("idle")
+	active := metrics.HTTPConnections.WithLabelValues("active")
+
+	// Wait for connections from earlier tests to close
+	waitFor(t, func() bool { return testutil.ToFloat64(idle) == 0 && testutil.ToFloat64(active) == 0 })
+	total := testutil.ToFloat64(metrics.HTTPConnectionsTotal)
+
+	addr := serve(t, config.ServerConfig{})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial error = %v", err)
+	}
+	if _, err := get(t, conn).ReadString('\n'); err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+
+	waitFor(t, func() bool { return testutil.ToFloat64(idle) == 1 })
+	if got := testutil.ToFloat64(metrics.HTTPConnectionsTotal) - total; got != 1 {
+		t.Errorf("connections accepted = %v, want 1", got)
+	}
+
+	_ = conn.Close()
+	waitFor(t, func() bool { return testutil.ToFloat64(idle) == 0 && testutil.ToFloat64(active) == 0 })
+}
+
+// waitFor polls cond until it holds or the test times out; the server
+// reports connection state changes asynchronously
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for !cond() {
+		select {
+		case <-ctx.Done():
+			t.Fatal("condition not met before timeout")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
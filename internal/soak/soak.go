@@ -0,0 +1,90 @@
+// Package soak samples heap and goroutine counts during long-running tests
+// and detects the sustained growth that indicates a leak.
+package soak
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// noiseTolerance is the fraction by which a sample may dip below the previous
+// one while still counting as growth; GC timing makes heap sizes noisy
+const noiseTolerance = 0.01
+
+// Sample is one measurement of the process
+type Sample struct {
+	At          time.Time
+	HeapInuse   uint64
+	HeapObjects uint64
+	Goroutines  int
+}
+
+// TakeSample forces a garbage collection so only live memory is measured,
+// then records heap and goroutine counts
+func TakeSample() Sample {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return Sample{
+		At:          time.Now(),
+		HeapInuse:   m.HeapInuse,
+		HeapObjects: m.HeapObjects,
+		Goroutines:  runtime.NumGoroutine(),
+	}
+}
+
+// String formats the sample for test logs
+func (s Sample) String() string {
+	return fmt.Sprintf("heap_inuse=%dKiB heap_objects=%d goroutines=%d", s.HeapInuse/1024, s.HeapObjects, s.Goroutines)
+}
+
+// CheckGrowth returns an error naming every measurement that grew across all
+// samples by more than minGrowth, e.g. 0.1 for 10%. Measurements that level
+// off or fall at any point are not reported, so a cache filling up to its
+// bound does not fail once it stops growing. At least three samples are
+// needed to establish a trend.
+func CheckGrowth(samples []Sample, minGrowth float64) error {
+	if len(samples) < 3 {
+		return nil
+	}
+
+	series := []struct {
+		name   string
+		values []float64
+	}{
+		{name: "heap_inuse"},
+		{name: "heap_objects"},
+		{name: "goroutines"},
+	}
+	for _, s := range samples {
+		series[0].values = append(series[0].values, float64(s.HeapInuse))
+		series[1].values = append(series[1].values, float64(s.HeapObjects))
+		series[2].values = append(series[2].values, float64(s.Goroutines))
+	}
+
+	var growing []string
+	for _, s := range series {
+		if monotonicGrowth(s.values, minGrowth) {
+			first, last := s.values[0], s.values[len(s.values)-1]
+			growing = append(growing, fmt.Sprintf("%s %.0f -> %.0f", s.name, first, last))
+		}
+	}
+	if len(growing) > 0 {
+		return fmt.Errorf("monotonic growth over %d samples: %s", len(samples), strings.Join(growing, ", "))
+	}
+	return nil
+}
+
+// monotonicGrowth reports whether values never fall by more than the noise
+// tolerance and the last exceeds the first by more than minGrowth
+func monotonicGrowth(values []float64, minGrowth float64) bool {
+	for i := 1; i < len(values); i++ {
+		if values[i] < values[i-1]*(1-noiseTolerance) {
+			return false
+		}
+	}
+	first, last := values[0], values[len(values)-1]
+	return last > first*(1+minGrowth)
+}
@@ -0,0 +1,69 @@
+package soak
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckGrowth(t *testing.T) {
+	samplesOf := func(heap []uint64, goroutines []int) []Sample {
+		samples := make([]Sample, len(heap))
+		for i := range heap {
+			samples[i] = Sample{HeapInuse: heap[i], HeapObjects: 1000, Goroutines: goroutines[i]}
+		}
+		return samples
+	}
+
+	tests := []struct {
+		name    string
+		samples []Sample
+		wantErr string
+	}{
+		{
+			name:    "stable",
+			samples: samplesOf([]uint64{100, 102, 99, 101, 100}, []int{10, 10, 10, 10, 10}),
+		},
+		{
+			name:    "heap leak",
+			samples: samplesOf([]uint64{100, 110, 120, 130, 140}, []int{10, 10, 10, 10, 10}),
+			wantErr: "heap_inuse 100 -> 140",
+		},
+		{
+			name:    "goroutine leak",
+			samples: samplesOf([]uint64{100, 100, 100, 100, 100}, []int{10, 12, 14, 16, 18}),
+			wantErr: "goroutines 10 -> 18",
+		},
+		{
+			name:    "growth within noise tolerance",
+			samples: samplesOf([]uint64{1000, 1100, 1095, 1200, 1300}, []int{10, 10, 10, 10, 10}),
+			wantErr: "heap_inuse 1000 -> 1300",
+		},
+		{
+			name:    "growth that levels off and falls",
+			samples: samplesOf([]uint64{100, 150, 200, 180, 200}, []int{10, 10, 10, 10, 10}),
+		},
+		{
+			name:    "growth below threshold",
+			samples: samplesOf([]uint64{100, 101, 102, 103, 104}, []int{10, 10, 10, 10, 10}),
+		},
+		{
+			name:    "too few samples",
+			samples: samplesOf([]uint64{100, 200}, []int{10, 20}),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckGrowth(tt.samples, 0.1)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("CheckGrowth() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("CheckGrowth() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
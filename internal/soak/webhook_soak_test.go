@@ -0,0 +1,206 @@
+//go:build soak
+
+package soak_test
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime/pprof"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/buildkite"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	loggingMiddleware "github.com/mcncl/buildkite-pubsub/internal/middleware/logging"
+	"github.com/mcncl/buildkite-pubsub/internal/middleware/request"
+	"github.com/mcncl/buildkite-pubsub/internal/middleware/security"
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+	"github.com/mcncl/buildkite-pubsub/internal/soak"
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook/webhooktest"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+var (
+	duration  = flag.Duration("soak.duration", 2*time.Hour, "how long to drive traffic")
+	interval  = flag.Duration("soak.interval", time.Minute, "how often to sample heap and goroutines")
+	warmup    = flag.Duration("soak.warmup", 25*time.Minute, "samples taken before this are ignored; keyed rate limiters hold idle clients for up to 20 minutes")
+	workers   = flag.Int("soak.workers", 8, "concurrent clients")
+	rps       = flag.Float64("soak.rate", 1000, "requests per second across all clients")
+	minGrowth = flag.Float64("soak.min-growth", 0.1, "growth across all samples, as a fraction, that fails the run")
+	profile   = flag.String("soak.heap-profile", "", "file to write a heap profile to when growth is detected")
+)
+
+// clientHeader lets each request claim a different client IP, so the per-IP
+// rate limiter sees as many clients as production does
+const clientHeader = "X-Soak-Client"
+
+const (
+	token  = "soak-token"
+	secret = "soak-secret"
+)
+
+func TestSoak(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	// The validator logs every request with the standard logger
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	pub := publisher.NewMockPublisher().(*publisher.MockPublisher)
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	handler := webhook.NewHandler(webhook.Config{
+		BuildkiteToken: token,
+		HMACSecret:     secret,
+		Publisher:      pub,
+		SchemaDrift:    buildkite.NewSchemaDriftDetector(logger, time.Hour),
+	})
+
+	// The same middleware chain as cmd/webhook, with limits high enough that
+	// most requests reach the handler while every limiter keeps state
+	var h http.Handler = handler
+	for _, mw := range []func(http.Handler) http.Handler{
+		request.WithTimeout(30 * time.Second),
+		security.WithRateLimits(security.RateLimitConfig{
+			Global: security.LimitConfig{Requests: 1_000_000, Window: time.Second},
+			IP:     security.LimitConfig{Requests: 50, Window: time.Second},
+			Token:  security.LimitConfig{Requests: 1_000, Window: time.Second},
+		}),
+		loggingMiddleware.WithStructuredLogging(logger),
+		request.WithRequestID,
+		withClientAddr,
+	} {
+		h = mw(h)
+	}
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	warm := *warmup
+	if warm >= *duration {
+		warm = *duration / 4
+	}
+	t.Logf("driving traffic for %v with %d workers, sampling every %v after %v warmup", *duration, *workers, *interval, warm)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+
+	var sent atomic.Int64
+	var wg sync.WaitGroup
+	limiter := rate.NewLimiter(rate.Limit(*rps), *workers)
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			drive(ctx, server.URL, limiter, &sent)
+		}()
+	}
+
+	start := time.Now()
+	var samples []soak.Sample
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for done := false; !done; {
+		select {
+		case <-ctx.Done():
+			done = true
+		case <-ticker.C:
+			// The mock publisher keeps every message; drop them so only
+			// the service's own memory is measured
+			pub.Reset()
+			sample := soak.TakeSample()
+			t.Logf("%v: %s requests=%d", time.Since(start).Round(time.Second), sample, sent.Load())
+			if time.Since(start) >= warm {
+				samples = append(samples, sample)
+			}
+		}
+	}
+	wg.Wait()
+
+	if err := soak.CheckGrowth(samples, *minGrowth); err != nil {
+		if *profile != "" {
+			writeHeapProfile(t, *profile)
+		}
+		t.Fatal(err)
+	}
+}
+
+// writeHeapProfile saves a heap profile for inspection with go tool pprof
+func writeHeapProfile(t *testing.T, path string) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Errorf("failed to create heap profile: %v", err)
+		return
+	}
+	defer func() { _ = f.Close() }()
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		t.Errorf("failed to write heap profile: %v", err)
+		return
+	}
+	t.Logf("heap profile written to %s", path)
+}
+
+// withClientAddr sets the request's remote address from clientHeader
+func withClientAddr(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if client := r.Header.Get(clientHeader); client != "" {
+			r.RemoteAddr = client + ":1234"
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// drive sends a mix of requests until ctx is done: valid token and signed
+// deliveries from many clients and pipelines, unknown tokens, malformed and
+// unsupported payloads, and request IDs and delivery IDs that are never reused
+func drive(ctx context.Context, url string, limiter *rate.Limiter, sent *atomic.Int64) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	for limiter.Wait(ctx) == nil {
+		n := sent.Add(1)
+		eventType := webhooktest.EventTypes[rand.IntN(len(webhooktest.EventTypes))]
+		body := webhooktest.Payload(eventType,
+			webhooktest.WithBuildID(fmt.Sprintf("build-%d", n)),
+			webhooktest.WithPipeline(fmt.Sprintf("pipeline-%d", rand.IntN(50))),
+		)
+
+		var req *http.Request
+		switch n % 10 {
+		case 0:
+			req = webhooktest.NewTokenRequest(url, fmt.Sprintf("unknown-%d", n), body)
+		case 1:
+			req = webhooktest.NewTokenRequest(url, token, []byte(`{"event":"build.finished","build":`))
+		case 2:
+			req = webhooktest.NewTokenRequest(url, token, webhooktest.Payload(fmt.Sprintf("custom.event-%d", rand.IntN(20))))
+		case 3, 4:
+			req = webhooktest.NewSignedRequest(url, secret, body)
+		default:
+			req = webhooktest.NewTokenRequest(url, token, body)
+		}
+		req.Header.Set(clientHeader, fmt.Sprintf("10.%d.%d.%d", rand.IntN(256), rand.IntN(256), rand.IntN(256)))
+		req.Header.Set(buildkite.DeliveryIDHeader, fmt.Sprintf("delivery-%d", n))
+		req.Header.Set(webhook.DeliveryModeHeader, subscriber.DeliveryModeSynthetic)
+		// webhooktest builds server-side requests; clients must not set RequestURI
+		req.RequestURI = ""
+
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			continue
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+}
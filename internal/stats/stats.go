@@ -0,0 +1,233 @@
+// Package stats keeps rolling request and publish rates in memory and serves
+// them as JSON, so autoscalers such as KEDA's metrics-api scaler or an HPA
+// external metrics adapter can read them without querying Prometheus.
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/lag"
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+)
+
+// DefaultWindow is the rolling window rates are averaged over unless
+// configured
+const DefaultWindow = time.Minute
+
+// counter indexes the counts kept in each bucket
+type counter int
+
+const (
+	requests counter = iota
+	requestErrors
+	rateLimited
+	publishes
+	publishErrors
+	numCounters
+)
+
+// bucket holds the counts of one second
+type bucket struct {
+	second int64
+	counts [numCounters]int64
+}
+
+// Snapshot is the rolling statistics /stats returns. Rates are per second,
+// averaged over the window or the time since start if shorter.
+type Snapshot struct {
+	WindowSeconds float64 `json:"window_seconds"`
+	// RequestsPerSecond counts every webhook request, whatever its outcome
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	// RequestErrorRate is the fraction of requests answered with a 5xx
+	RequestErrorRate     float64 `json:"request_error_rate"`
+	RateLimitedPerSecond float64 `json:"rate_limited_per_second"`
+	// PublishesPerSecond counts publish attempts, including retries
+	PublishesPerSecond float64 `json:"publishes_per_second"`
+	// PublishErrorRate is the fraction of publish attempts that failed
+	PublishErrorRate float64 `json:"publish_error_rate"`
+	// QueueDepth and QueueCapacity describe pending publishes when
+	// back-pressure is enabled
+	QueueDepth    int `json:"queue_depth"`
+	QueueCapacity int `json:"queue_capacity,omitempty"`
+	// Subscriptions is the backlog of monitored subscriptions, when
+	// subscription lag monitoring is enabled
+	Subscriptions []lag.Sample `json:"subscriptions,omitempty"`
+}
+
+// Aggregator counts events in one-second buckets over a sliding window. It
+// is safe for concurrent use.
+type Aggregator struct {
+	window time.Duration
+	start  time.Time
+	now    func() time.Time
+
+	mu      sync.Mutex
+	buckets []bucket
+
+	queueDepth    func() int
+	queueCapacity int
+	subscriptions func() []lag.Sample
+}
+
+// New creates an aggregator averaging over window, or DefaultWindow when
+// window is under a second
+func New(window time.Duration) *Aggregator {
+	if window < time.Second {
+		window = DefaultWindow
+	}
+	return &Aggregator{
+		window:  window,
+		start:   time.Now(),
+		now:     time.Now,
+		buckets: make([]bucket, int(window/time.Second)),
+	}
+}
+
+// SetQueue reports pending publishes from depth, out of capacity
+func (a *Aggregator) SetQueue(depth func() int, capacity int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.queueDepth, a.queueCapacity = depth, capacity
+}
+
+// SetSubscriptions reports the backlog of monitored subscriptions from
+// samples
+func (a *Aggregator) SetSubscriptions(samples func() []lag.Sample) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.subscriptions = samples
+}
+
+// add counts one event
+func (a *Aggregator) add(c counter) {
+	second := a.now().Unix()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	b := &a.buckets[second%int64(len(a.buckets))]
+	if b.second != second {
+		*b = bucket{second: second}
+	}
+	b.counts[c]++
+}
+
+// Snapshot returns the current rolling statistics
+func (a *Aggregator) Snapshot() Snapshot {
+	now := a.now()
+	a.mu.Lock()
+	var totals [numCounters]int64
+	oldest := now.Unix() - int64(len(a.buckets))
+	for _, b := range a.buckets {
+		if b.second > oldest {
+			for i, n := range b.counts {
+				totals[i] += n
+			}
+		}
+	}
+	depth, capacity, subscriptions := a.queueDepth, a.queueCapacity, a.subscriptions
+	a.mu.Unlock()
+
+	elapsed := min(now.Sub(a.start), a.window).Seconds()
+	elapsed = max(elapsed, 1)
+	s := Snapshot{
+		WindowSeconds:        a.window.Seconds(),
+		RequestsPerSecond:    float64(totals[requests]) / elapsed,
+		RequestErrorRate:     ratio(totals[requestErrors], totals[requests]),
+		RateLimitedPerSecond: float64(totals[rateLimited]) / elapsed,
+		PublishesPerSecond:   float64(totals[publishes]) / elapsed,
+		PublishErrorRate:     ratio(totals[publishErrors], totals[publishes]),
+		QueueCapacity:        capacity,
+	}
+	if depth != nil {
+		s.QueueDepth = depth()
+	}
+	if subscriptions != nil {
+		s.Subscriptions = subscriptions()
+	}
+	return s
+}
+
+// ratio returns n/total, or 0 when there is no total
+func ratio(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+// Handler serves the snapshot as JSON
+func (a *Aggregator) Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(a.Snapshot())
+}
+
+// Middleware counts requests by their response status
+func (a *Aggregator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r)
+
+		a.add(requests)
+		switch {
+		case rw.status == http.StatusTooManyRequests:
+			a.add(rateLimited)
+		case rw.status >= 500:
+			a.add(requestErrors)
+		}
+	})
+}
+
+// statusWriter records the response status
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Publisher wraps pub, counting its publish attempts and failures
+func (a *Aggregator) Publisher(pub publisher.Publisher) publisher.Publisher {
+	return &countingPublisher{pub: pub, stats: a}
+}
+
+// countingPublisher counts publishes for an Aggregator
+type countingPublisher struct {
+	pub   publisher.Publisher
+	stats *Aggregator
+}
+
+// Publish implements publisher.Publisher
+func (p *countingPublisher) Publish(ctx context.Context, data interface{}, attributes map[string]string) (string, error) {
+	result, err := p.PublishWithResult(ctx, data, attributes)
+	return result.MessageID, err
+}
+
+// PublishWithResult is Publish, returning the wrapped publisher's result
+func (p *countingPublisher) PublishWithResult(ctx context.Context, data interface{}, attributes map[string]string) (publisher.PublishResult, error) {
+	result, err := publisher.PublishWithResult(ctx, p.pub, data, attributes)
+	p.stats.add(publishes)
+	if err != nil {
+		p.stats.add(publishErrors)
+	}
+	return result, err
+}
+
+// Close closes the wrapped publisher
+func (p *countingPublisher) Close() error {
+	return p.pub.Close()
+}
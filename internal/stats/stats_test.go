@@ -0,0 +1,104 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/lag"
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+)
+
+func TestAggregator(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	a := New(10 * time.Second)
+	a.start = now.Add(-time.Minute)
+	a.now = func() time.Time { return now }
+
+	handler := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/limited":
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "/broken":
+			http.Error(w, "broken", http.StatusBadGateway)
+		default:
+			_, _ = w.Write([]byte("ok"))
+		}
+	}))
+	for _, path := range []string{"/", "/", "/", "/limited", "/broken"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, path, nil))
+	}
+
+	mock := publisher.NewMockPublisher().(*publisher.MockPublisher)
+	pub := a.Publisher(mock)
+	for i := 0; i < 3; i++ {
+		if _, err := pub.Publish(context.Background(), "data", nil); err != nil {
+			t.Fatalf("Publish() error = %v", err)
+		}
+	}
+	mock.SetError(errors.New("unavailable"))
+	if _, err := pub.Publish(context.Background(), "data", nil); err == nil {
+		t.Fatal("Publish() error = nil, want the wrapped publisher's error")
+	}
+	a.SetQueue(func() int { return 7 }, 100)
+	a.SetSubscriptions(func() []lag.Sample { return []lag.Sample{{Subscription: "consumer", Undelivered: 12}} })
+
+	want := Snapshot{
+		WindowSeconds:        10,
+		RequestsPerSecond:    0.5,
+		RequestErrorRate:     0.2,
+		RateLimitedPerSecond: 0.1,
+		PublishesPerSecond:   0.4,
+		PublishErrorRate:     0.25,
+		QueueDepth:           7,
+		QueueCapacity:        100,
+		Subscriptions:        []lag.Sample{{Subscription: "consumer", Undelivered: 12}},
+	}
+	if got := a.Snapshot(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Snapshot() = %+v, want %+v", got, want)
+	}
+
+	// Counts slide out of the window
+	now = now.Add(10 * time.Second)
+	if got := a.Snapshot(); got.RequestsPerSecond != 0 || got.PublishesPerSecond != 0 || got.PublishErrorRate != 0 {
+		t.Errorf("Snapshot() after the window = %+v, want no traffic", got)
+	}
+}
+
+func TestAggregatorStartup(t *testing.T) {
+	now := time.Now()
+	a := New(time.Minute)
+	a.start = now.Add(-2 * time.Second)
+	a.now = func() time.Time { return now }
+
+	a.add(requests)
+	a.add(requests)
+	// Rates cover the time since start, not the whole window
+	if got := a.Snapshot().RequestsPerSecond; got != 1 {
+		t.Errorf("RequestsPerSecond = %v, want 1", got)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	a := New(0)
+	rr := httptest.NewRecorder()
+	a.Handler(rr, httptest.NewRequest(http.MethodGet, "/stats", nil))
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if got["window_seconds"] != DefaultWindow.Seconds() {
+		t.Errorf("window_seconds = %v, want %v", got["window_seconds"], DefaultWindow.Seconds())
+	}
+	for _, key := range []string{"requests_per_second", "publishes_per_second", "request_error_rate", "publish_error_rate", "queue_depth"} {
+		if _, ok := got[key]; !ok {
+			t.Errorf("response has no %s: %s", key, rr.Body)
+		}
+	}
+}
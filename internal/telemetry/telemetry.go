@@ -13,6 +13,7 @@ import (
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
@@ -40,6 +41,13 @@ type Config struct {
 	ExportTimeout  int // seconds
 	MaxExportBatch int
 	MaxQueueSize   int
+	// SampleRatio is the fraction of new traces sampled; traces continued
+	// from an inbound traceparent follow its decision. Zero or one samples
+	// every trace.
+	SampleRatio float64
+	// Insecure chooses whether spans are exported without TLS; nil uses TLS
+	// only for https:// endpoints and Honeycomb
+	Insecure *bool
 }
 
 // DefaultConfig returns a Config with reasonable defaults
@@ -72,6 +80,11 @@ func ConfigFromEnv() Config {
 		cfg.ServiceName = serviceName
 	}
 
+	// Environment label from OTEL_ENVIRONMENT
+	if environment := os.Getenv("OTEL_ENVIRONMENT"); environment != "" {
+		cfg.Environment = environment
+	}
+
 	// OTLP endpoint from OTEL_EXPORTER_OTLP_ENDPOINT
 	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint != "" {
 		cfg.OTLPEndpoint = endpoint
@@ -85,6 +98,14 @@ func ConfigFromEnv() Config {
 	return cfg
 }
 
+// sampler returns the sampler for SampleRatio
+func (c Config) sampler() sdktrace.Sampler {
+	if c.SampleRatio <= 0 || c.SampleRatio >= 1 {
+		return sdktrace.AlwaysSample()
+	}
+	return sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))
+}
+
 // parseHeaders parses header string like "key1=value1,key2=value2"
 func parseHeaders(headerStr string) map[string]string {
 	headers := make(map[string]string)
@@ -153,13 +174,16 @@ func (p *Provider) Start(ctx context.Context) error {
 		clientOptions = append(clientOptions, otlptracegrpc.WithHeaders(p.config.OTLPHeaders))
 	}
 
-	// Determine if we should use TLS
-	if strings.Contains(p.config.OTLPEndpoint, "api.honeycomb.io") || strings.HasPrefix(p.config.OTLPEndpoint, "https://") {
-		// Use TLS for Honeycomb and HTTPS endpoints
-		clientOptions = append(clientOptions, otlptracegrpc.WithTLSCredentials(credentials.NewClientTLSFromCert(nil, "")))
-	} else {
-		// Use insecure for localhost/development
+	// Determine if we should use TLS: by default for Honeycomb and HTTPS
+	// endpoints, and not for localhost/development
+	insecure := !strings.Contains(p.config.OTLPEndpoint, "api.honeycomb.io") && !strings.HasPrefix(p.config.OTLPEndpoint, "https://")
+	if p.config.Insecure != nil {
+		insecure = *p.config.Insecure
+	}
+	if insecure {
 		clientOptions = append(clientOptions, otlptracegrpc.WithInsecure())
+	} else {
+		clientOptions = append(clientOptions, otlptracegrpc.WithTLSCredentials(credentials.NewClientTLSFromCert(nil, "")))
 	}
 
 	client := otlptracegrpc.NewClient(clientOptions...)
@@ -189,11 +213,15 @@ func (p *Provider) Start(ctx context.Context) error {
 			sdktrace.WithMaxQueueSize(p.config.MaxQueueSize),
 		),
 		sdktrace.WithResource(res),
-		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithSampler(p.config.sampler()),
 	)
 
-	// Set global trace provider
+	// Set global trace provider and W3C propagation so inbound trace context is honoured
 	otel.SetTracerProvider(p.tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
 	p.isInit = true
 
 	return nil
@@ -234,8 +262,11 @@ func (p *Provider) TracingMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
+		// Continue the caller's trace if a traceparent header was sent
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
 		tracer := p.tp.Tracer(p.config.ServiceName)
-		ctx, span := tracer.Start(r.Context(),
+		ctx, span := tracer.Start(ctx,
 			fmt.Sprintf("%s %s", r.Method, r.URL.Path),
 			trace.WithAttributes(
 				semconv.HTTPMethodKey.String(r.Method),
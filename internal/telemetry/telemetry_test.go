@@ -4,6 +4,7 @@ import (
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -91,6 +92,18 @@ func TestConfigValidation(t *testing.T) {
 	}
 }
 
+func TestSampler(t *testing.T) {
+	for ratio, want := range map[float64]string{
+		0:    "AlwaysOnSampler",
+		1:    "AlwaysOnSampler",
+		0.25: "ParentBased{root:TraceIDRatioBased{0.25}",
+	} {
+		if got := (Config{SampleRatio: ratio}).sampler().Description(); !strings.HasPrefix(got, want) {
+			t.Errorf("sampler for %v = %s, want %s", ratio, got, want)
+		}
+	}
+}
+
 func TestTracingMiddleware(t *testing.T) {
 	// Setup a mock OTLP server
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,98 @@
+// Package ttlcache holds entries that expire, kept in expiry order so that
+// expiring them only looks at the entries due. It backs the bounded
+// in-memory trackers, which each guard a Cache with their own lock.
+package ttlcache
+
+import (
+	"container/list"
+	"time"
+)
+
+// Cache maps keys to values until they expire, optionally holding at most
+// a maximum number of entries. It is not safe for concurrent use.
+type Cache[K comparable, V any] struct {
+	maxLen  int
+	entries map[K]*list.Element
+	// order holds *entry, soonest to expire first
+	order *list.List
+}
+
+type entry[K comparable, V any] struct {
+	key       K
+	value     V
+	expiresAt time.Time
+}
+
+// New creates an empty cache holding up to maxLen entries, evicting the
+// entry that would expire soonest to make room; maxLen 0 is unbounded
+func New[K comparable, V any](maxLen int) *Cache[K, V] {
+	return &Cache[K, V]{
+		maxLen:  maxLen,
+		entries: make(map[K]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Get returns the value for key. Call Expire first to leave out expired
+// entries.
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	elem, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	return elem.Value.(*entry[K, V]).value, true
+}
+
+// Set stores value for key until expiresAt, replacing any entry for key.
+// Entries usually share a TTL, so they almost always go at or near the
+// back.
+func (c *Cache[K, V]) Set(key K, value V, expiresAt time.Time) {
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	for c.maxLen > 0 && c.order.Len() >= c.maxLen {
+		c.remove(c.order.Front())
+	}
+
+	e := &entry[K, V]{key: key, value: value, expiresAt: expiresAt}
+	elem := c.order.Back()
+	for elem != nil && elem.Value.(*entry[K, V]).expiresAt.After(expiresAt) {
+		elem = elem.Prev()
+	}
+	if elem == nil {
+		c.entries[key] = c.order.PushFront(e)
+		return
+	}
+	c.entries[key] = c.order.InsertAfter(e, elem)
+}
+
+// Delete removes the entry for key, returning its value
+func (c *Cache[K, V]) Delete(key K) (V, bool) {
+	elem, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.remove(elem)
+	return elem.Value.(*entry[K, V]).value, true
+}
+
+// Expire removes entries that have expired by now
+func (c *Cache[K, V]) Expire(now time.Time) {
+	for elem := c.order.Front(); elem != nil && !now.Before(elem.Value.(*entry[K, V]).expiresAt); elem = c.order.Front() {
+		c.remove(elem)
+	}
+}
+
+// Len returns the number of entries, including any expired since the last
+// Expire
+func (c *Cache[K, V]) Len() int {
+	return c.order.Len()
+}
+
+// remove deletes an entry
+func (c *Cache[K, V]) remove(elem *list.Element) {
+	delete(c.entries, elem.Value.(*entry[K, V]).key)
+	c.order.Remove(elem)
+}
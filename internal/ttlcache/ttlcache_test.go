@@ -0,0 +1,44 @@
+package ttlcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	now := time.Now()
+	c := New[string, int](3)
+
+	// Entries expire in order of expiry, not of insertion
+	c.Set("a", 1, now.Add(time.Hour))
+	c.Set("b", 2, now.Add(time.Minute))
+	c.Set("c", 3, now.Add(2*time.Minute))
+	c.Expire(now.Add(90 * time.Second))
+	if _, ok := c.Get("b"); ok || c.Len() != 2 {
+		t.Errorf("after expiring b: Len() = %d, b present = %v", c.Len(), ok)
+	}
+
+	// Setting a key replaces its entry and expiry
+	c.Set("a", 10, now.Add(3*time.Minute))
+	if v, ok := c.Get("a"); !ok || v != 10 || c.Len() != 2 {
+		t.Errorf("Get(a) = %d, %v with Len() %d, want 10 and 2 entries", v, ok, c.Len())
+	}
+
+	// A full cache evicts the entry expiring soonest
+	c.Set("d", 4, now.Add(4*time.Minute))
+	c.Set("e", 5, now.Add(5*time.Minute))
+	if _, ok := c.Get("c"); ok || c.Len() != 3 {
+		t.Errorf("after eviction: Len() = %d, c present = %v, want c evicted", c.Len(), ok)
+	}
+
+	if v, ok := c.Delete("d"); !ok || v != 4 {
+		t.Errorf("Delete(d) = %d, %v, want 4", v, ok)
+	}
+	if _, ok := c.Delete("d"); ok {
+		t.Error("Delete(d) found a deleted key")
+	}
+	c.Expire(now.Add(time.Hour))
+	if c.Len() != 0 {
+		t.Errorf("Len() = %d after everything expired, want 0", c.Len())
+	}
+}
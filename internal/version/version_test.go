@@ -0,0 +1,44 @@
+package version
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	defer func(v, c, d string) { Version, Commit, Date = v, c, d }(Version, Commit, Date)
+	Version, Commit, Date = "v1.2.3", "abc123", "2026-01-02T03:04:05Z"
+
+	info := Get()
+	want := Info{
+		Version:   "v1.2.3",
+		Commit:    "abc123",
+		Date:      "2026-01-02T03:04:05Z",
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if info != want {
+		t.Errorf("Get() = %+v, want %+v", info, want)
+	}
+	if got, want := info.String(), "v1.2.3 (commit abc123, built 2026-01-02T03:04:05Z, "+runtime.Version()+" "+info.Platform+")"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	Handler(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("response = %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var info Info
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if info.Version != Version || info.GoVersion != runtime.Version() {
+		t.Errorf("body = %+v", info)
+	}
+}
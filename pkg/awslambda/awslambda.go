@@ -0,0 +1,262 @@
+// Package awslambda runs an http.Handler, such as the webhook handler, on
+// AWS Lambda behind API Gateway (REST APIs or HTTP APIs) or an Application
+// Load Balancer. Each invocation is converted to an *http.Request and the
+// handler's response to the response the event source expects.
+//
+//	lambda.Start(awslambda.New(webhook.NewHandler(cfg)))
+package awslambda
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Handler adapts an http.Handler to lambda.Handler
+type Handler struct {
+	handler http.Handler
+}
+
+// New returns a Lambda handler serving every invocation with h
+func New(h http.Handler) *Handler {
+	return &Handler{handler: h}
+}
+
+// eventProbe holds the fields that tell the event sources apart
+type eventProbe struct {
+	Version        string `json:"version"`
+	RequestContext struct {
+		ELB json.RawMessage `json:"elb"`
+	} `json:"requestContext"`
+}
+
+// Invoke implements lambda.Handler for API Gateway REST API and HTTP API
+// (payload format 1.0 and 2.0) and Application Load Balancer events
+func (h *Handler) Invoke(ctx context.Context, payload []byte) ([]byte, error) {
+	var probe eventProbe
+	if err := json.Unmarshal(payload, &probe); err != nil {
+		return nil, fmt.Errorf("failed to decode event: %w", err)
+	}
+
+	switch {
+	case probe.RequestContext.ELB != nil:
+		var event events.ALBTargetGroupRequest
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, fmt.Errorf("failed to decode ALB event: %w", err)
+		}
+		return h.serveALB(ctx, event)
+	case probe.Version == "2.0":
+		var event events.APIGatewayV2HTTPRequest
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, fmt.Errorf("failed to decode API Gateway event: %w", err)
+		}
+		return h.serveV2(ctx, event)
+	default:
+		var event events.APIGatewayProxyRequest
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, fmt.Errorf("failed to decode API Gateway event: %w", err)
+		}
+		return h.serveV1(ctx, event)
+	}
+}
+
+// serveV1 serves a REST API or payload format 1.0 HTTP API event, whose
+// query parameters arrive decoded
+func (h *Handler) serveV1(ctx context.Context, event events.APIGatewayProxyRequest) ([]byte, error) {
+	query := url.Values(event.MultiValueQueryStringParameters)
+	if len(query) == 0 {
+		query = url.Values{}
+		for key, value := range event.QueryStringParameters {
+			query.Set(key, value)
+		}
+	}
+	r, err := newRequest(ctx, event.HTTPMethod, event.Path, query.Encode(), event.Body, event.IsBase64Encoded)
+	if err != nil {
+		return nil, err
+	}
+	setHeaders(r, event.Headers, event.MultiValueHeaders)
+	r.RemoteAddr = remoteAddr(event.RequestContext.Identity.SourceIP)
+
+	w := h.serve(r)
+	body, encoded := w.encodedBody()
+	return json.Marshal(events.APIGatewayProxyResponse{
+		StatusCode:        w.status,
+		MultiValueHeaders: w.header,
+		Body:              body,
+		IsBase64Encoded:   encoded,
+	})
+}
+
+// serveV2 serves a payload format 2.0 HTTP API event
+func (h *Handler) serveV2(ctx context.Context, event events.APIGatewayV2HTTPRequest) ([]byte, error) {
+	r, err := newRequest(ctx, event.RequestContext.HTTP.Method, event.RawPath, event.RawQueryString, event.Body, event.IsBase64Encoded)
+	if err != nil {
+		return nil, err
+	}
+	setHeaders(r, event.Headers, nil)
+	if len(event.Cookies) > 0 {
+		r.Header.Set("Cookie", strings.Join(event.Cookies, "; "))
+	}
+	r.RemoteAddr = remoteAddr(event.RequestContext.HTTP.SourceIP)
+
+	w := h.serve(r)
+	body, encoded := w.encodedBody()
+	response := events.APIGatewayV2HTTPResponse{
+		StatusCode:      w.status,
+		Headers:         make(map[string]string, len(w.header)),
+		Body:            body,
+		IsBase64Encoded: encoded,
+		Cookies:         w.header.Values("Set-Cookie"),
+	}
+	for key, values := range w.header {
+		if key != "Set-Cookie" {
+			response.Headers[key] = strings.Join(values, ",")
+		}
+	}
+	return json.Marshal(response)
+}
+
+// serveALB serves an Application Load Balancer event, whose query
+// parameters arrive as sent. The response uses multi-value headers when
+// the target group has them enabled, which the request shows.
+func (h *Handler) serveALB(ctx context.Context, event events.ALBTargetGroupRequest) ([]byte, error) {
+	var query []string
+	if len(event.MultiValueQueryStringParameters) > 0 {
+		for key, values := range event.MultiValueQueryStringParameters {
+			for _, value := range values {
+				query = append(query, key+"="+value)
+			}
+		}
+	} else {
+		for key, value := range event.QueryStringParameters {
+			query = append(query, key+"="+value)
+		}
+	}
+	r, err := newRequest(ctx, event.HTTPMethod, event.Path, strings.Join(query, "&"), event.Body, event.IsBase64Encoded)
+	if err != nil {
+		return nil, err
+	}
+	setHeaders(r, event.Headers, event.MultiValueHeaders)
+	// The load balancer appends the client to X-Forwarded-For
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(forwarded[len(forwarded)-1], ",")
+		r.RemoteAddr = remoteAddr(strings.TrimSpace(hops[len(hops)-1]))
+	}
+
+	w := h.serve(r)
+	body, encoded := w.encodedBody()
+	response := events.ALBTargetGroupResponse{
+		StatusCode:        w.status,
+		StatusDescription: fmt.Sprintf("%d %s", w.status, http.StatusText(w.status)),
+		Body:              body,
+		IsBase64Encoded:   encoded,
+	}
+	if event.MultiValueHeaders != nil {
+		response.MultiValueHeaders = w.header
+	} else {
+		response.Headers = make(map[string]string, len(w.header))
+		for key, values := range w.header {
+			response.Headers[key] = values[len(values)-1]
+		}
+	}
+	return json.Marshal(response)
+}
+
+// newRequest builds the request for an event
+func newRequest(ctx context.Context, method, path, rawQuery, body string, base64Encoded bool) (*http.Request, error) {
+	data := []byte(body)
+	if base64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode base64 body: %w", err)
+		}
+		data = decoded
+	}
+
+	target := path
+	if rawQuery != "" {
+		target += "?" + rawQuery
+	}
+	u, err := url.ParseRequestURI(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request path %q: %w", target, err)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	r.RequestURI = u.RequestURI()
+	return r, nil
+}
+
+// setHeaders copies event headers to r, preferring multi-value headers
+func setHeaders(r *http.Request, single map[string]string, multi map[string][]string) {
+	if len(multi) > 0 {
+		for key, values := range multi {
+			for _, value := range values {
+				r.Header.Add(key, value)
+			}
+		}
+	} else {
+		for key, value := range single {
+			r.Header.Set(key, value)
+		}
+	}
+	r.Host = r.Header.Get("Host")
+}
+
+// remoteAddr formats a source IP as a request's host:port remote address
+func remoteAddr(ip string) string {
+	if ip == "" {
+		return ""
+	}
+	return net.JoinHostPort(ip, "0")
+}
+
+// serve runs the handler and records its response
+func (h *Handler) serve(r *http.Request) *responseWriter {
+	w := &responseWriter{header: http.Header{}}
+	h.handler.ServeHTTP(w, r)
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w
+}
+
+// responseWriter buffers a response for returning to the event source
+type responseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *responseWriter) Header() http.Header { return w.header }
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+// encodedBody returns the body as text, or base64 when it isn't UTF-8
+func (w *responseWriter) encodedBody() (string, bool) {
+	if utf8.Valid(w.body.Bytes()) {
+		return w.body.String(), false
+	}
+	return base64.StdEncoding.EncodeToString(w.body.Bytes()), true
+}
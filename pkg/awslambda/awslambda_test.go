@@ -0,0 +1,168 @@
+package awslambda
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+var _ lambda.Handler = (*Handler)(nil)
+
+// echo reports what the handler received in headers and echoes the body
+var echo = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	w.Header().Set("X-Method", r.Method)
+	w.Header().Set("X-Path", r.URL.Path)
+	w.Header().Set("X-Query", r.URL.RawQuery)
+	w.Header().Set("X-Token", r.Header.Get("X-Buildkite-Token"))
+	w.Header().Set("X-Remote-Addr", r.RemoteAddr)
+	w.Header().Add("Set-Cookie", "a=1")
+	w.Header().Add("Set-Cookie", "b=2")
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write(body)
+})
+
+func invoke(t *testing.T, h http.Handler, event interface{}, response interface{}) {
+	t.Helper()
+	payload, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("failed to encode event: %v", err)
+	}
+	out, err := New(h).Invoke(context.Background(), payload)
+	if err != nil {
+		t.Fatalf("Invoke() error = %v", err)
+	}
+	if err := json.Unmarshal(out, response); err != nil {
+		t.Fatalf("failed to decode response %s: %v", out, err)
+	}
+}
+
+func TestInvokeAPIGatewayV1(t *testing.T) {
+	event := events.APIGatewayProxyRequest{
+		HTTPMethod:            http.MethodPost,
+		Path:                  "/webhook",
+		Headers:               map[string]string{"X-Buildkite-Token": "token"},
+		QueryStringParameters: map[string]string{"source": "a b"},
+		Body:                  base64.StdEncoding.EncodeToString([]byte(`{"event":"ping"}`)),
+		IsBase64Encoded:       true,
+	}
+	event.RequestContext.Identity.SourceIP = "203.0.113.7"
+
+	var response events.APIGatewayProxyResponse
+	invoke(t, echo, event, &response)
+	if response.StatusCode != http.StatusAccepted || response.Body != `{"event":"ping"}` || response.IsBase64Encoded {
+		t.Errorf("response = %d %q", response.StatusCode, response.Body)
+	}
+	want := map[string]string{
+		"X-Method":      http.MethodPost,
+		"X-Path":        "/webhook",
+		"X-Query":       "source=a+b",
+		"X-Token":       "token",
+		"X-Remote-Addr": "203.0.113.7:0",
+	}
+	for key, value := range want {
+		if got := response.MultiValueHeaders[key]; len(got) != 1 || got[0] != value {
+			t.Errorf("%s = %v, want %q", key, got, value)
+		}
+	}
+	if got := response.MultiValueHeaders["Set-Cookie"]; len(got) != 2 {
+		t.Errorf("Set-Cookie = %v, want both cookies", got)
+	}
+}
+
+func TestInvokeAPIGatewayV2(t *testing.T) {
+	event := events.APIGatewayV2HTTPRequest{
+		Version:        "2.0",
+		RawPath:        "/webhook",
+		RawQueryString: "source=a%20b",
+		Headers:        map[string]string{"x-buildkite-token": "token"},
+		Body:           `{"event":"ping"}`,
+	}
+	event.RequestContext.HTTP.Method = http.MethodPost
+	event.RequestContext.HTTP.SourceIP = "2001:db8::1"
+
+	var response events.APIGatewayV2HTTPResponse
+	invoke(t, echo, event, &response)
+	if response.StatusCode != http.StatusAccepted || response.Body != `{"event":"ping"}` {
+		t.Errorf("response = %d %q", response.StatusCode, response.Body)
+	}
+	want := map[string]string{
+		"X-Method":      http.MethodPost,
+		"X-Query":       "source=a%20b",
+		"X-Token":       "token",
+		"X-Remote-Addr": "[2001:db8::1]:0",
+	}
+	for key, value := range want {
+		if got := response.Headers[key]; got != value {
+			t.Errorf("%s = %q, want %q", key, got, value)
+		}
+	}
+	if len(response.Cookies) != 2 || response.Headers["Set-Cookie"] != "" {
+		t.Errorf("cookies = %v, Set-Cookie header = %q, want cookies only in Cookies", response.Cookies, response.Headers["Set-Cookie"])
+	}
+}
+
+func TestInvokeALB(t *testing.T) {
+	event := events.ALBTargetGroupRequest{
+		HTTPMethod: http.MethodPost,
+		Path:       "/webhook",
+		Headers: map[string]string{
+			"x-buildkite-token": "token",
+			"x-forwarded-for":   "198.51.100.1, 203.0.113.7",
+		},
+		Body: `{"event":"ping"}`,
+	}
+	event.RequestContext.ELB.TargetGroupArn = "arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup/webhook/abc"
+
+	var response events.ALBTargetGroupResponse
+	invoke(t, echo, event, &response)
+	if response.StatusCode != http.StatusAccepted || response.StatusDescription != "202 Accepted" || response.Body != `{"event":"ping"}` {
+		t.Errorf("response = %d %q %q", response.StatusCode, response.StatusDescription, response.Body)
+	}
+	if response.Headers["X-Remote-Addr"] != "203.0.113.7:0" || response.Headers["X-Token"] != "token" || response.MultiValueHeaders != nil {
+		t.Errorf("headers = %v, multi-value headers = %v", response.Headers, response.MultiValueHeaders)
+	}
+
+	// With multi-value headers enabled on the target group, the response
+	// uses them too
+	event.Headers = nil
+	event.MultiValueHeaders = map[string][]string{"x-buildkite-token": {"token"}}
+	event.MultiValueQueryStringParameters = map[string][]string{"source": {"a%20b"}}
+	response = events.ALBTargetGroupResponse{}
+	invoke(t, echo, event, &response)
+	if got := response.MultiValueHeaders["Set-Cookie"]; len(got) != 2 {
+		t.Errorf("Set-Cookie = %v, want both cookies", got)
+	}
+	if got := response.MultiValueHeaders["X-Query"]; len(got) != 1 || got[0] != "source=a%20b" {
+		t.Errorf("query = %v, want it as sent", got)
+	}
+}
+
+func TestInvokeBinaryResponse(t *testing.T) {
+	binary := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte{0xff, 0xfe})
+	})
+	var response events.APIGatewayProxyResponse
+	invoke(t, binary, events.APIGatewayProxyRequest{HTTPMethod: http.MethodGet, Path: "/"}, &response)
+	if response.StatusCode != http.StatusOK || !response.IsBase64Encoded || response.Body != "//4=" {
+		t.Errorf("response = %d %q, base64 %v", response.StatusCode, response.Body, response.IsBase64Encoded)
+	}
+}
+
+func TestInvokeInvalidEvent(t *testing.T) {
+	for name, payload := range map[string]string{
+		"not json":       `[`,
+		"invalid base64": `{"httpMethod":"POST","path":"/","body":"!","isBase64Encoded":true}`,
+		"invalid path":   `{"httpMethod":"POST","path":"webhook"}`,
+	} {
+		if _, err := New(echo).Invoke(context.Background(), []byte(payload)); err == nil {
+			t.Errorf("Invoke() with %s error = nil, want error", name)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Package buildkiteauth verifies Buildkite webhook deliveries, either by the
+// X-Buildkite-Token header or by the HMAC-SHA256 X-Buildkite-Signature header.
+// It has no dependencies outside the standard library so any Go service
+// receiving Buildkite webhooks can use it.
+package buildkiteauth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers Buildkite uses to authenticate webhook deliveries
+const (
+	// TokenHeader carries the webhook token when token auth is configured
+	TokenHeader = "X-Buildkite-Token"
+	// SignatureHeader carries "timestamp=...,signature=..." when HMAC signing is configured
+	SignatureHeader = "X-Buildkite-Signature"
+)
+
+// DefaultTolerance is how far a signature timestamp may be from the current
+// time before the delivery is rejected as a possible replay
+const DefaultTolerance = 5 * time.Minute
+
+// Verification errors
+var (
+	ErrMissingToken       = errors.New("buildkiteauth: no token provided")
+	ErrInvalidToken       = errors.New("buildkiteauth: invalid token")
+	ErrMalformedSignature = errors.New("buildkiteauth: malformed signature header")
+	ErrSignatureExpired   = errors.New("buildkiteauth: signature timestamp outside tolerance")
+	ErrInvalidSignature   = errors.New("buildkiteauth: invalid signature")
+	// ErrSignatureFuture is returned for timestamps too far in the future,
+	// usually because of clock skew. It wraps ErrSignatureExpired.
+	ErrSignatureFuture = fmt.Errorf("%w: timestamp is in the future", ErrSignatureExpired)
+)
+
+// VerifyOptions configures signature verification
+type VerifyOptions struct {
+	// Tolerance is the maximum age of the signature timestamp; zero uses
+	// DefaultTolerance
+	Tolerance time.Duration
+	// FutureTolerance is how far the signature timestamp may be ahead of
+	// the current time; zero uses Tolerance
+	FutureTolerance time.Duration
+	// Now returns the current time; nil uses time.Now
+	Now func() time.Time
+}
+
+// VerifyToken checks a provided token against the expected token in constant
+// time. Surrounding whitespace in the provided token is ignored.
+func VerifyToken(expected, provided string) error {
+	provided = strings.TrimSpace(provided)
+	if provided == "" {
+		return ErrMissingToken
+	}
+	if expected == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(expected)) != 1 {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// VerifySignature checks an X-Buildkite-Signature header value against the
+// body signed with secret, rejecting timestamps outside the tolerance
+func VerifySignature(secret, header string, body []byte, opts VerifyOptions) error {
+	timestamp, signature, err := ParseSignatureHeader(header)
+	if err != nil {
+		return err
+	}
+
+	tolerance := opts.Tolerance
+	if tolerance <= 0 {
+		tolerance = DefaultTolerance
+	}
+	futureTolerance := opts.FutureTolerance
+	if futureTolerance <= 0 {
+		futureTolerance = tolerance
+	}
+	now := time.Now
+	if opts.Now != nil {
+		now = opts.Now
+	}
+	// Sub saturates for distant timestamps, so compare both bounds rather
+	// than negating a skew that may be the minimum duration
+	skew := now().Sub(time.Unix(timestamp, 0))
+	if skew > tolerance {
+		return ErrSignatureExpired
+	}
+	if skew < -futureTolerance {
+		return ErrSignatureFuture
+	}
+
+	expected := Sign(secret, timestamp, body)
+	if subtle.ConstantTimeCompare([]byte(signature), []byte(expected)) != 1 {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// ParseSignatureHeader splits a "timestamp=...,signature=..." header value
+func ParseSignatureHeader(header string) (timestamp int64, signature string, err error) {
+	var rawTimestamp string
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "timestamp":
+			rawTimestamp = strings.TrimSpace(value)
+		case "signature":
+			signature = strings.TrimSpace(value)
+		}
+	}
+
+	if rawTimestamp == "" || signature == "" {
+		return 0, "", ErrMalformedSignature
+	}
+	timestamp, err = strconv.ParseInt(rawTimestamp, 10, 64)
+	if err != nil {
+		return 0, "", ErrMalformedSignature
+	}
+	return timestamp, signature, nil
+}
+
+// Sign returns the hex HMAC-SHA256 of "timestamp.body", as Buildkite computes it
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyRequest authenticates a webhook request. A signature is checked when
+// the request carries one and secret is set; otherwise the token is checked.
+// The request body is read and restored so handlers can still read it.
+func VerifyRequest(r *http.Request, token, secret string, opts VerifyOptions) error {
+	if header := r.Header.Get(SignatureHeader); header != "" && secret != "" {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		return VerifySignature(secret, header, body, opts)
+	}
+	return VerifyToken(token, r.Header.Get(TokenHeader))
+}
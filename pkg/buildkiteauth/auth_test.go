@@ -0,0 +1,190 @@
+package buildkiteauth
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+		provided string
+		wantErr  error
+	}{
+		{name: "valid", expected: "secret", provided: "secret"},
+		{name: "surrounding whitespace", expected: "secret", provided: " secret\n"},
+		{name: "wrong token", expected: "secret", provided: "other", wantErr: ErrInvalidToken},
+		{name: "missing token", expected: "secret", provided: "", wantErr: ErrMissingToken},
+		{name: "no expected token", expected: "", provided: "secret", wantErr: ErrInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := VerifyToken(tt.expected, tt.provided); !errors.Is(err, tt.wantErr) {
+				t.Errorf("VerifyToken() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	const secret = "hmac-secret"
+	body := []byte(`{"event":"build.finished"}`)
+	now := time.Unix(1700000000, 0)
+	opts := VerifyOptions{Now: func() time.Time { return now }}
+
+	header := func(ts int64, sig string) string {
+		return fmt.Sprintf("timestamp=%d,signature=%s", ts, sig)
+	}
+
+	tests := []struct {
+		name    string
+		header  string
+		body    []byte
+		opts    VerifyOptions
+		wantErr error
+	}{
+		{name: "valid", header: header(now.Unix(), Sign(secret, now.Unix(), body)), body: body, opts: opts},
+		{name: "spaces around parts", header: fmt.Sprintf("timestamp = %d , signature = %s", now.Unix(), Sign(secret, now.Unix(), body)), body: body, opts: opts},
+		{name: "tampered body", header: header(now.Unix(), Sign(secret, now.Unix(), body)), body: []byte(`{}`), opts: opts, wantErr: ErrInvalidSignature},
+		{name: "wrong secret", header: header(now.Unix(), Sign("other", now.Unix(), body)), body: body, opts: opts, wantErr: ErrInvalidSignature},
+		{name: "expired", header: header(now.Unix()-301, Sign(secret, now.Unix()-301, body)), body: body, opts: opts, wantErr: ErrSignatureExpired},
+		{name: "from the future", header: header(now.Unix()+301, Sign(secret, now.Unix()+301, body)), body: body, opts: opts, wantErr: ErrSignatureFuture},
+		{
+			name:    "future tolerance",
+			header:  header(now.Unix()+60, Sign(secret, now.Unix()+60, body)),
+			body:    body,
+			opts:    VerifyOptions{FutureTolerance: 30 * time.Second, Now: opts.Now},
+			wantErr: ErrSignatureFuture,
+		},
+		{
+			name:   "future tolerance defaults to tolerance",
+			header: header(now.Unix()+600, Sign(secret, now.Unix()+600, body)),
+			body:   body,
+			opts:   VerifyOptions{Tolerance: 15 * time.Minute, Now: opts.Now},
+		},
+		{
+			name:   "custom tolerance",
+			header: header(now.Unix()-600, Sign(secret, now.Unix()-600, body)),
+			body:   body,
+			opts:   VerifyOptions{Tolerance: 15 * time.Minute, Now: opts.Now},
+		},
+		{name: "missing signature", header: fmt.Sprintf("timestamp=%d", now.Unix()), body: body, opts: opts, wantErr: ErrMalformedSignature},
+		{name: "bad timestamp", header: "timestamp=abc,signature=def", body: body, opts: opts, wantErr: ErrMalformedSignature},
+		{name: "empty", header: "", body: body, opts: opts, wantErr: ErrMalformedSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := VerifySignature(secret, tt.header, tt.body, tt.opts); !errors.Is(err, tt.wantErr) {
+				t.Errorf("VerifySignature() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyRequest(t *testing.T) {
+	const body = `{"event":"ping"}`
+	ts := time.Now().Unix()
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		secret  string
+		wantErr error
+	}{
+		{name: "token", headers: map[string]string{TokenHeader: "token"}},
+		{
+			name:    "signature",
+			headers: map[string]string{SignatureHeader: fmt.Sprintf("timestamp=%d,signature=%s", ts, Sign("secret", ts, []byte(body)))},
+			secret:  "secret",
+		},
+		{
+			name:    "signature ignored without a secret",
+			headers: map[string]string{SignatureHeader: "timestamp=1,signature=abc"},
+			wantErr: ErrMissingToken,
+		},
+		{
+			name:    "invalid signature does not fall back to token",
+			headers: map[string]string{SignatureHeader: fmt.Sprintf("timestamp=%d,signature=abc", ts), TokenHeader: "token"},
+			secret:  "secret",
+			wantErr: ErrInvalidSignature,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+
+			if err := VerifyRequest(req, "token", tt.secret, VerifyOptions{}); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("VerifyRequest() = %v, want %v", err, tt.wantErr)
+			}
+
+			got, err := io.ReadAll(req.Body)
+			if err != nil {
+				t.Fatalf("failed to read body: %v", err)
+			}
+			if string(got) != body {
+				t.Errorf("body after verification = %q, want %q", got, body)
+			}
+		})
+	}
+}
+
+func FuzzParseSignatureHeader(f *testing.F) {
+	f.Add("timestamp=1736208000,signature=" + Sign("secret", 1736208000, []byte("{}")))
+	f.Add(" timestamp = 1 , signature = abc ")
+	f.Add("signature=abc,timestamp=1")
+	f.Add("timestamp=,signature=")
+	f.Add("timestamp=99999999999999999999,signature=abc")
+	f.Add("timestamp=-1,signature=abc,extra")
+	f.Add("=,=,,")
+
+	f.Fuzz(func(t *testing.T, header string) {
+		ts, signature, err := ParseSignatureHeader(header)
+		if err != nil {
+			if !errors.Is(err, ErrMalformedSignature) {
+				t.Fatalf("ParseSignatureHeader(%q) error = %v, want ErrMalformedSignature", header, err)
+			}
+			return
+		}
+		if signature == "" {
+			t.Fatalf("ParseSignatureHeader(%q) returned an empty signature without error", header)
+		}
+
+		// Timestamps outside the tolerance are rejected however far away they are
+		now := time.Unix(1736208000, 0)
+		err = VerifySignature("secret", header, []byte("{}"), VerifyOptions{Now: func() time.Time { return now }})
+		tolerance := int64(DefaultTolerance / time.Second)
+		if outside := ts < now.Unix()-tolerance || ts > now.Unix()+tolerance; outside && !errors.Is(err, ErrSignatureExpired) {
+			t.Fatalf("VerifySignature(%q) error = %v, want ErrSignatureExpired", header, err)
+		}
+	})
+}
+
+func FuzzSignRoundTrip(f *testing.F) {
+	f.Add("secret", int64(1736208000), []byte(`{"event":"ping"}`))
+	f.Add("", int64(0), []byte{})
+	f.Add("s3cr3t,with=separators", int64(-1), []byte("timestamp=1,signature=abc"))
+
+	f.Fuzz(func(t *testing.T, secret string, ts int64, body []byte) {
+		header := fmt.Sprintf("timestamp=%d,signature=%s", ts, Sign(secret, ts, body))
+		opts := VerifyOptions{Now: func() time.Time { return time.Unix(ts, 0) }}
+		if err := VerifySignature(secret, header, body, opts); err != nil {
+			t.Fatalf("VerifySignature() of a signed body = %v", err)
+		}
+		if err := VerifySignature(secret, header, append(body, 'x'), opts); !errors.Is(err, ErrInvalidSignature) {
+			t.Fatalf("VerifySignature() of a modified body = %v, want ErrInvalidSignature", err)
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package subscriber
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Attributes are the message attributes the webhook, its heartbeats and
+// backfills publish, and that dead-lettering adds. Attribute rules
+// configured on the webhook can publish others.
+var Attributes = []string{
+	"origin",
+	"event_type",
+	PipelineAttribute,
+	OrganizationAttribute,
+	"build_state",
+	"normalized_state",
+	"is_terminal",
+	"is_retry",
+	"is_blocked",
+	"job_index",
+	"job_count",
+	"branch",
+	"team",
+	"cluster_id",
+	"queue_name",
+	"agent_tags",
+	"payload_format",
+	"delivery_id",
+	"delivery_attempt",
+	ReceivedAtAttribute,
+	PublishedAtAttribute,
+	ExpiresAtAttribute,
+	ProducerVersionAttribute,
+	ChecksumAttribute,
+	ChecksumPayloadAttribute,
+	"traceparent",
+	"tracestate",
+	SelftestIDAttribute,
+	DeliveryModeAttribute,
+	TransformWarningsAttribute,
+	SchemaURLAttribute,
+	ConfirmAttribute,
+	"instance",
+	"sequence",
+	"backfill",
+	"dlq_reason",
+	"dlq_original_timestamp",
+	"dlq_error_message",
+}
+
+// IsKnownAttribute reports whether the webhook publishes the attribute name
+func IsKnownAttribute(name string) bool {
+	return slices.Contains(Attributes, name)
+}
+
+// Subscription filter operators
+const (
+	// FilterEquals matches an attribute equal to any of the values
+	FilterEquals = "="
+	// FilterNotEquals matches an attribute equal to none of the values
+	FilterNotEquals = "!="
+	// FilterPrefix matches an attribute starting with any of the values
+	FilterPrefix = "^="
+	// FilterExists matches messages with the attribute
+	FilterExists = "exists"
+	// FilterNotExists matches messages without the attribute
+	FilterNotExists = "!exists"
+)
+
+// MaxFilterLength is the longest subscription filter Pub/Sub accepts
+const MaxFilterLength = 256
+
+// FilterTerm is one condition of a subscription filter
+type FilterTerm struct {
+	Attribute string
+	// Op is one of the Filter* operators
+	Op string
+	// Values are alternatives, unused by FilterExists and FilterNotExists
+	Values []string
+}
+
+// filterAttributePattern matches the attribute names a filter can
+// reference without quoting
+var filterAttributePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// ParseFilterTerm parses a term written as attribute=value, attribute!=value
+// or attribute^=prefix, with comma-separated alternatives, attribute for
+// messages with the attribute, or !attribute for messages without it
+func ParseFilterTerm(s string) (FilterTerm, error) {
+	for _, op := range []string{FilterNotEquals, FilterPrefix, FilterEquals} {
+		if attribute, values, ok := strings.Cut(s, op); ok {
+			if values == "" {
+				return FilterTerm{}, fmt.Errorf("filter term %q has no value", s)
+			}
+			return FilterTerm{Attribute: attribute, Op: op, Values: strings.Split(values, ",")}, nil
+		}
+	}
+	if attribute, ok := strings.CutPrefix(s, "!"); ok {
+		return FilterTerm{Attribute: attribute, Op: FilterNotExists}, nil
+	}
+	return FilterTerm{Attribute: s, Op: FilterExists}, nil
+}
+
+// SubscriptionFilter returns the Pub/Sub subscription filter matching
+// messages that meet every term, e.g.
+//
+//	attributes.event_type = "build.finished" AND attributes.branch = "main"
+//
+// Terms may only reference attributes the webhook publishes, or the custom
+// attributes that attribute rules publish, so a typo cannot silently match
+// nothing.
+func SubscriptionFilter(terms []FilterTerm, custom ...string) (string, error) {
+	if len(terms) == 0 {
+		return "", fmt.Errorf("a filter needs at least one term")
+	}
+	conditions := make([]string, 0, len(terms))
+	for _, term := range terms {
+		if !filterAttributePattern.MatchString(term.Attribute) {
+			return "", fmt.Errorf("invalid attribute name %q", term.Attribute)
+		}
+		if !IsKnownAttribute(term.Attribute) && !slices.Contains(custom, term.Attribute) {
+			return "", fmt.Errorf("the webhook does not publish attribute %q", term.Attribute)
+		}
+		condition, err := filterCondition(term)
+		if err != nil {
+			return "", err
+		}
+		conditions = append(conditions, condition)
+	}
+
+	filter := strings.Join(conditions, " AND ")
+	if len(filter) > MaxFilterLength {
+		return "", fmt.Errorf("filter is %d bytes, longer than Pub/Sub's limit of %d", len(filter), MaxFilterLength)
+	}
+	return filter, nil
+}
+
+// filterCondition returns the filter expression for one term
+func filterCondition(term FilterTerm) (string, error) {
+	key := "attributes." + term.Attribute
+	switch term.Op {
+	case FilterExists:
+		return "attributes:" + term.Attribute, nil
+	case FilterNotExists:
+		return "NOT attributes:" + term.Attribute, nil
+	case FilterEquals, FilterNotEquals, FilterPrefix:
+	default:
+		return "", fmt.Errorf("unknown filter operator %q", term.Op)
+	}
+	if len(term.Values) == 0 {
+		return "", fmt.Errorf("attribute %q needs a value to compare", term.Attribute)
+	}
+
+	alternatives := make([]string, len(term.Values))
+	for i, value := range term.Values {
+		switch term.Op {
+		case FilterEquals:
+			alternatives[i] = key + " = " + strconv.Quote(value)
+		case FilterNotEquals:
+			alternatives[i] = key + " != " + strconv.Quote(value)
+		case FilterPrefix:
+			alternatives[i] = "hasPrefix(" + key + ", " + strconv.Quote(value) + ")"
+		}
+	}
+	if len(alternatives) == 1 {
+		return alternatives[0], nil
+	}
+	// A value must differ from every excluded value, but match any other
+	join := " OR "
+	if term.Op == FilterNotEquals {
+		join = " AND "
+	}
+	return "(" + strings.Join(alternatives, join) + ")", nil
+}
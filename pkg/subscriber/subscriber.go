@@ -0,0 +1,313 @@
+// Package subscriber provides helpers for consumers of messages published by
+// the webhook.
+package subscriber
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+)
+
+// Timestamp attributes stamped on every published message, in RFC 3339
+// format with nanoseconds
+const (
+	// ReceivedAtAttribute is when the webhook received the event
+	ReceivedAtAttribute = "received_at"
+	// PublishedAtAttribute is when the webhook handed the event to Pub/Sub
+	PublishedAtAttribute = "published_at"
+)
+
+// ExpiresAtAttribute is when an event stops being worth processing, in RFC
+// 3339 format, stamped on the event types configured with a TTL
+const ExpiresAtAttribute = "expires_at"
+
+// Pipeline and organization attributes. Both are slugs normalized by Slug,
+// so subscription filters can match them exactly; the pipeline's display
+// name is only in the message data.
+const (
+	// PipelineAttribute is the pipeline slug
+	PipelineAttribute = "pipeline"
+	// OrganizationAttribute is the organization slug
+	OrganizationAttribute = "organization"
+)
+
+// MaxSlugLength is the length of the longest slug Slug returns
+const MaxSlugLength = 100
+
+// ProducerVersionAttribute is the version of the webhook that published a
+// message, e.g. "v1.2.3"
+const ProducerVersionAttribute = "producer_version"
+
+// SchemaURLAttribute is the URL of the JSON Schema a message's data
+// matches, stamped when the webhook is configured with where it serves
+// its schemas
+const SchemaURLAttribute = "schema_url"
+
+// Checksum attributes stamped on published messages when checksums are
+// enabled
+const (
+	// ChecksumAttribute is "<algorithm>:<hex digest>", e.g. "sha256:9f86..."
+	ChecksumAttribute = "checksum"
+	// ChecksumPayloadAttribute says what the checksum covers: the message
+	// data (ChecksumPayloadData) or the webhook body as Buildkite sent it
+	// (ChecksumPayloadRaw)
+	ChecksumPayloadAttribute = "checksum_payload"
+)
+
+// Checksum payloads
+const (
+	ChecksumPayloadData = "data"
+	ChecksumPayloadRaw  = "raw"
+)
+
+// Checksum algorithms
+const (
+	ChecksumSHA256 = "sha256"
+	ChecksumSHA512 = "sha512"
+)
+
+var (
+	// ErrNoChecksum is returned by VerifyChecksum for messages published
+	// without a checksum
+	ErrNoChecksum = errors.New("message has no checksum")
+	// ErrChecksumMismatch is returned by VerifyChecksum when the data does
+	// not match the checksum
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// HeartbeatEventType is the event_type attribute of the synthetic heartbeat
+// events the webhook publishes when configured. Their absence for longer
+// than a few intervals means events are not reaching the topic, even when
+// no builds are running.
+const HeartbeatEventType = "heartbeat"
+
+// Heartbeat is the body of a heartbeat event
+type Heartbeat struct {
+	EventType string `json:"event_type"`
+	// Instance identifies the replica that sent the heartbeat
+	Instance string `json:"instance"`
+	// Sequence counts this instance's heartbeats from 1; a gap means
+	// heartbeats were lost and a reset, with a new StartedAt, a restart
+	Sequence  uint64    `json:"sequence"`
+	StartedAt time.Time `json:"started_at"`
+	SentAt    time.Time `json:"sent_at"`
+	// IntervalSeconds is how often the instance sends heartbeats
+	IntervalSeconds float64 `json:"interval_seconds"`
+	Version         string  `json:"version,omitempty"`
+}
+
+// SelftestEventType is the event_type attribute of the events published
+// by `webhook selftest` to check an environment end to end; consumers
+// should ignore them
+const SelftestEventType = "selftest"
+
+// SelftestIDAttribute identifies the self-test run that published an event
+const SelftestIDAttribute = "selftest_id"
+
+// PingEventType is the event_type attribute of the messages published for
+// Buildkite ping events when the webhook's ping check is enabled; consumers
+// should ignore them
+const PingEventType = "ping"
+
+// DeliveryModeAttribute says how an event reached the topic, as one of the
+// DeliveryMode values, so consumers and dashboards can tell live traffic
+// from replays, backfills and synthetic events
+const DeliveryModeAttribute = "delivery_mode"
+
+// Delivery modes
+const (
+	// DeliveryModeLive is a webhook Buildkite delivered as it happened
+	DeliveryModeLive = "live"
+	// DeliveryModeReplayed is a webhook delivered again by an operator, such
+	// as a quarantined payload resent by `webhook reprocess`
+	DeliveryModeReplayed = "replayed"
+	// DeliveryModeBackfilled is a build imported from the Buildkite API
+	DeliveryModeBackfilled = "backfilled"
+	// DeliveryModeSynthetic is traffic generated to test the service, such
+	// as heartbeats, self-tests, pings and load tests
+	DeliveryModeSynthetic = "synthetic"
+)
+
+// TransformWarningsAttribute lists, comma-separated, the optional sections
+// of a webhook payload that were malformed and left out of the published
+// event, such as "sender,job"
+const TransformWarningsAttribute = "transform_warnings"
+
+// Delivery confirmation attributes. Messages of the webhook's critical
+// pipelines carry ConfirmAttribute, and the webhook waits for the primary
+// consumer to publish a confirmation to the feedback topic once it has
+// processed one; see ConfirmationAttributes.
+const (
+	// ConfirmAttribute addresses the confirmation to the webhook replica
+	// waiting for it
+	ConfirmAttribute = "confirm"
+	// ConfirmsMessageIDAttribute is the ID of the message a confirmation
+	// confirms
+	ConfirmsMessageIDAttribute = "confirms_message_id"
+)
+
+// ConfirmationAttributes returns the attributes of the confirmation a
+// consumer publishes to the feedback topic once it has processed message
+// messageID, or false when the webhook is not waiting for one. The
+// confirmation's data is ignored.
+func ConfirmationAttributes(attributes map[string]string, messageID string) (map[string]string, bool) {
+	to, ok := attributes[ConfirmAttribute]
+	if !ok || to == "" || messageID == "" {
+		return nil, false
+	}
+	return map[string]string{
+		ConfirmAttribute:           to,
+		ConfirmsMessageIDAttribute: messageID,
+	}, true
+}
+
+// IsDeliveryMode reports whether mode is one of the delivery modes
+func IsDeliveryMode(mode string) bool {
+	switch mode {
+	case DeliveryModeLive, DeliveryModeReplayed, DeliveryModeBackfilled, DeliveryModeSynthetic:
+		return true
+	}
+	return false
+}
+
+// IsHeartbeat reports whether a message is a heartbeat event rather than a
+// Buildkite event
+func IsHeartbeat(attributes map[string]string) bool {
+	return attributes["event_type"] == HeartbeatEventType
+}
+
+// ReceivedAt returns when the webhook received the event
+func ReceivedAt(attributes map[string]string) (time.Time, bool) {
+	return parseTimestamp(attributes, ReceivedAtAttribute)
+}
+
+// PublishedAt returns when the webhook published the event
+func PublishedAt(attributes map[string]string) (time.Time, bool) {
+	return parseTimestamp(attributes, PublishedAtAttribute)
+}
+
+// ExpiresAt returns when the event stops being worth processing
+func ExpiresAt(attributes map[string]string) (time.Time, bool) {
+	return parseTimestamp(attributes, ExpiresAtAttribute)
+}
+
+// Expired reports whether the event's expires_at has passed by now.
+// Messages without one never expire.
+func Expired(attributes map[string]string, now time.Time) bool {
+	t, ok := ExpiresAt(attributes)
+	return ok && !now.Before(t)
+}
+
+// Lag returns the end-to-end lag from the webhook receiving the event until
+// now. It falls back to the publish time for messages without received_at
+// and reports false when neither timestamp is present.
+func Lag(attributes map[string]string, now time.Time) (time.Duration, bool) {
+	t, ok := ReceivedAt(attributes)
+	if !ok {
+		t, ok = PublishedAt(attributes)
+	}
+	if !ok {
+		return 0, false
+	}
+	return now.Sub(t), true
+}
+
+// Slug normalizes a pipeline or organization slug or name for use as an
+// attribute value or metric label: lower case ASCII letters and digits,
+// with every other run of characters replaced by a single "-". Buildkite
+// slugs are returned unchanged. Values longer than MaxSlugLength are cut
+// short and end in a hash of the whole value, so distinct values stay
+// distinct, as do values with no ASCII letters or digits at all.
+func Slug(value string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(value) {
+		if ('a' <= r && r <= 'z') || ('0' <= r && r <= '9') {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	slug := b.String()
+	if len(slug) <= MaxSlugLength && (slug != "" || value == "") {
+		return slug
+	}
+	sum := sha256.Sum256([]byte(value))
+	suffix := hex.EncodeToString(sum[:4])
+	if slug == "" {
+		return suffix
+	}
+	if len(slug) > MaxSlugLength {
+		slug = strings.TrimRight(slug[:MaxSlugLength-len(suffix)-1], "-")
+	}
+	return slug + "-" + suffix
+}
+
+// Checksum returns the checksum of data in the ChecksumAttribute format
+func Checksum(algorithm string, data []byte) (string, error) {
+	h, err := newHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	h.Write(data)
+	return algorithm + ":" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifyChecksum checks data against a message's checksum attribute. Pass
+// the message data, or the webhook body Buildkite sent when the
+// checksum_payload attribute is "raw". It returns ErrNoChecksum for
+// messages without a checksum and ErrChecksumMismatch when data has
+// changed.
+func VerifyChecksum(data []byte, attributes map[string]string) error {
+	value, ok := attributes[ChecksumAttribute]
+	if !ok {
+		return ErrNoChecksum
+	}
+	algorithm, _, ok := strings.Cut(value, ":")
+	if !ok {
+		return fmt.Errorf("malformed checksum %q", value)
+	}
+	want, err := Checksum(algorithm, data)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(want), []byte(value)) != 1 {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// newHash returns the hash for a checksum algorithm
+func newHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	case ChecksumSHA512:
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+}
+
+// parseTimestamp parses an RFC 3339 timestamp attribute
+func parseTimestamp(attributes map[string]string, key string) (time.Time, bool) {
+	value, ok := attributes[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
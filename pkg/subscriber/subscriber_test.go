@@ -0,0 +1,269 @@
+package subscriber
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLag(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 10, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		attributes map[string]string
+		wantLag    time.Duration
+		wantOK     bool
+	}{
+		{
+			name: "received_at preferred",
+			attributes: map[string]string{
+				ReceivedAtAttribute:  "2024-05-01T12:00:00Z",
+				PublishedAtAttribute: "2024-05-01T12:00:02.5Z",
+			},
+			wantLag: 10 * time.Second,
+			wantOK:  true,
+		},
+		{
+			name:       "falls back to published_at",
+			attributes: map[string]string{PublishedAtAttribute: "2024-05-01T12:00:02.5Z"},
+			wantLag:    7500 * time.Millisecond,
+			wantOK:     true,
+		},
+		{
+			name:       "malformed timestamp",
+			attributes: map[string]string{ReceivedAtAttribute: "yesterday"},
+		},
+		{
+			name:       "no timestamps",
+			attributes: map[string]string{"event_type": "build.finished"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lag, ok := Lag(tt.attributes, now)
+			if ok != tt.wantOK || lag != tt.wantLag {
+				t.Errorf("Lag() = %v, %v, want %v, %v", lag, ok, tt.wantLag, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestExpired(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		expiresAt string
+		want      bool
+	}{
+		{expiresAt: "2024-05-01T11:59:59Z", want: true},
+		{expiresAt: "2024-05-01T12:00:00Z", want: true},
+		{expiresAt: "2024-05-01T12:00:01Z", want: false},
+		{expiresAt: "", want: false},
+		{expiresAt: "tomorrow", want: false},
+	}
+	for _, tt := range tests {
+		attributes := map[string]string{}
+		if tt.expiresAt != "" {
+			attributes[ExpiresAtAttribute] = tt.expiresAt
+		}
+		if got := Expired(attributes, now); got != tt.want {
+			t.Errorf("Expired(expires_at=%q) = %v, want %v", tt.expiresAt, got, tt.want)
+		}
+	}
+}
+
+func TestConfirmationAttributes(t *testing.T) {
+	attributes, ok := ConfirmationAttributes(map[string]string{ConfirmAttribute: "replica-1", "event_type": "build.finished"}, "msg-1")
+	if !ok || len(attributes) != 2 || attributes[ConfirmAttribute] != "replica-1" || attributes[ConfirmsMessageIDAttribute] != "msg-1" {
+		t.Errorf("ConfirmationAttributes() = %v, %v, want the confirmation of msg-1 for replica-1", attributes, ok)
+	}
+	if _, ok := ConfirmationAttributes(map[string]string{"event_type": "build.finished"}, "msg-1"); ok {
+		t.Error("ConfirmationAttributes() = true for a message not waiting for confirmation")
+	}
+}
+
+func TestSlug(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "", want: ""},
+		{value: "my-pipeline", want: "my-pipeline"},
+		{value: "My Pipeline", want: "my-pipeline"},
+		{value: "  Deploy: Prod / EU  ", want: "deploy-prod-eu"},
+		{value: "Café Builds", want: "caf-builds"},
+		{value: "payments__api--v2", want: "payments-api-v2"},
+	}
+	for _, tt := range tests {
+		if got := Slug(tt.value); got != tt.want {
+			t.Errorf("Slug(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+
+	// Values without ASCII letters or digits are told apart by their hash
+	if a, b := Slug("ビルド"), Slug("デプロイ"); len(a) != 8 || a == b {
+		t.Errorf("Slug() = %q and %q, want distinct hashes", a, b)
+	}
+
+	long := strings.Repeat("a", MaxSlugLength+10)
+	got := Slug(long)
+	if len(got) > MaxSlugLength || !strings.HasPrefix(got, "aaaa") || got == Slug(long+"b") {
+		t.Errorf("Slug() of a long value = %q, want at most %d characters ending in its hash", got, MaxSlugLength)
+	}
+	if Slug(got) != got {
+		t.Errorf("Slug(%q) changed a slug it returned", got)
+	}
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	data := []byte(`{"event_type":"build.finished"}`)
+	checksum, err := Checksum(ChecksumSHA256, data)
+	if err != nil {
+		t.Fatalf("Checksum() error = %v", err)
+	}
+	if !strings.HasPrefix(checksum, "sha256:") || len(checksum) != len("sha256:")+64 {
+		t.Errorf("Checksum() = %q, want sha256: and 64 hex characters", checksum)
+	}
+
+	attributes := map[string]string{ChecksumAttribute: checksum}
+	if err := VerifyChecksum(data, attributes); err != nil {
+		t.Errorf("VerifyChecksum() error = %v", err)
+	}
+	if err := VerifyChecksum([]byte(`{"event_type":"build.failed"}`), attributes); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("VerifyChecksum() of changed data error = %v, want ErrChecksumMismatch", err)
+	}
+	if err := VerifyChecksum(data, nil); !errors.Is(err, ErrNoChecksum) {
+		t.Errorf("VerifyChecksum() without a checksum error = %v, want ErrNoChecksum", err)
+	}
+	for _, malformed := range []string{"9f86d081", "md5:9f86d081"} {
+		if err := VerifyChecksum(data, map[string]string{ChecksumAttribute: malformed}); err == nil || errors.Is(err, ErrChecksumMismatch) {
+			t.Errorf("VerifyChecksum() with checksum %q error = %v, want an invalid checksum error", malformed, err)
+		}
+	}
+
+	sha512, err := Checksum(ChecksumSHA512, data)
+	if err != nil {
+		t.Fatalf("Checksum() error = %v", err)
+	}
+	if err := VerifyChecksum(data, map[string]string{ChecksumAttribute: sha512}); err != nil {
+		t.Errorf("VerifyChecksum() with sha512 error = %v", err)
+	}
+}
+
+func TestParseFilterTerm(t *testing.T) {
+	tests := []struct {
+		in   string
+		want FilterTerm
+	}{
+		{"event_type=build.finished", FilterTerm{Attribute: "event_type", Op: FilterEquals, Values: []string{"build.finished"}}},
+		{"branch=main,release", FilterTerm{Attribute: "branch", Op: FilterEquals, Values: []string{"main", "release"}}},
+		{"build_state!=passed", FilterTerm{Attribute: "build_state", Op: FilterNotEquals, Values: []string{"passed"}}},
+		{"pipeline^=payments-", FilterTerm{Attribute: "pipeline", Op: FilterPrefix, Values: []string{"payments-"}}},
+		{"team", FilterTerm{Attribute: "team", Op: FilterExists}},
+		{"!backfill", FilterTerm{Attribute: "backfill", Op: FilterNotExists}},
+	}
+	for _, tt := range tests {
+		got, err := ParseFilterTerm(tt.in)
+		if err != nil {
+			t.Errorf("ParseFilterTerm(%q) error: %v", tt.in, err)
+			continue
+		}
+		if got.Attribute != tt.want.Attribute || got.Op != tt.want.Op || strings.Join(got.Values, ",") != strings.Join(tt.want.Values, ",") {
+			t.Errorf("ParseFilterTerm(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+
+	if _, err := ParseFilterTerm("branch="); err == nil {
+		t.Error("ParseFilterTerm accepted a term without a value")
+	}
+}
+
+func TestSubscriptionFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		terms   []string
+		custom  []string
+		want    string
+		wantErr string
+	}{
+		{
+			name:  "equals",
+			terms: []string{"event_type=build.finished", "branch=main"},
+			want:  `attributes.event_type = "build.finished" AND attributes.branch = "main"`,
+		},
+		{
+			name:  "alternatives",
+			terms: []string{"build_state=failed,canceled"},
+			want:  `(attributes.build_state = "failed" OR attributes.build_state = "canceled")`,
+		},
+		{
+			name:  "exclusions",
+			terms: []string{"build_state!=passed,skipped"},
+			want:  `(attributes.build_state != "passed" AND attributes.build_state != "skipped")`,
+		},
+		{
+			name:  "prefix and presence",
+			terms: []string{"pipeline^=payments-", "team", "!backfill"},
+			want:  `hasPrefix(attributes.pipeline, "payments-") AND attributes:team AND NOT attributes:backfill`,
+		},
+		{
+			name:  "values are quoted",
+			terms: []string{`branch=say "hi"`},
+			want:  `attributes.branch = "say \"hi\""`,
+		},
+		{
+			name:   "custom attribute",
+			terms:  []string{"severity=high"},
+			custom: []string{"severity"},
+			want:   `attributes.severity = "high"`,
+		},
+		{
+			name:    "unknown attribute",
+			terms:   []string{"event=build.finished"},
+			wantErr: `does not publish attribute "event"`,
+		},
+		{
+			name:    "invalid attribute name",
+			terms:   []string{"build-state=passed"},
+			custom:  []string{"build-state"},
+			wantErr: "invalid attribute name",
+		},
+		{
+			name:    "too long",
+			terms:   []string{"pipeline=" + strings.Repeat("p,", 20) + "p"},
+			wantErr: "longer than Pub/Sub's limit",
+		},
+		{
+			name:    "no terms",
+			wantErr: "at least one term",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			terms := make([]FilterTerm, len(tt.terms))
+			for i, s := range tt.terms {
+				term, err := ParseFilterTerm(s)
+				if err != nil {
+					t.Fatalf("ParseFilterTerm(%q): %v", s, err)
+				}
+				terms[i] = term
+			}
+			got, err := SubscriptionFilter(terms, tt.custom...)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("SubscriptionFilter() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SubscriptionFilter() error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("SubscriptionFilter() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package transform
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/mcncl/buildkite-pubsub/internal/jsoncodec"
+)
+
+// OptionalSections are the parts of a payload DecodePartial can drop when
+// they are malformed, named by their dotted JSON path. The rest of a payload
+// is required.
+var OptionalSections = []string{
+	"sender",
+	"agent",
+	"job",
+	"build.creator",
+	"build.meta_data",
+	"build.rebuilt_from",
+	"pipeline.provider",
+}
+
+// SectionWarning reports an optional section of a payload that could not be
+// decoded and was left out
+type SectionWarning struct {
+	Section string
+	Err     error
+}
+
+func (w SectionWarning) Error() string {
+	return fmt.Sprintf("%s: %v", w.Section, w.Err)
+}
+
+// DecodePartial decodes a webhook body into a payload, leaving out any of
+// the OptionalSections that are malformed and returning a warning for
+// each. It fails only when the body is not a JSON object or a required
+// part of it is malformed.
+func DecodePartial(body []byte) (Payload, []SectionWarning, error) {
+	var payload Payload
+	err := jsoncodec.Unmarshal(body, &payload)
+	if err == nil {
+		return payload, nil, nil
+	}
+
+	// Split off the optional sections and decode the rest on its own
+	var top map[string]json.RawMessage
+	if jsoncodec.Unmarshal(body, &top) != nil {
+		return Payload{}, nil, err
+	}
+	optional := map[string]json.RawMessage{}
+	for _, parent := range []string{"build", "pipeline"} {
+		var fields map[string]json.RawMessage
+		if raw, ok := top[parent]; !ok || jsoncodec.Unmarshal(raw, &fields) != nil {
+			continue
+		}
+		for _, section := range OptionalSections {
+			if name, ok := cutParent(section, parent); ok {
+				if raw, ok := fields[name]; ok {
+					optional[section] = raw
+					delete(fields, name)
+				}
+			}
+		}
+		top[parent], _ = jsoncodec.Marshal(fields)
+	}
+	for _, section := range OptionalSections {
+		if raw, ok := top[section]; ok {
+			optional[section] = raw
+			delete(top, section)
+		}
+	}
+	required, _ := jsoncodec.Marshal(top)
+	payload = Payload{}
+	if requiredErr := jsoncodec.Unmarshal(required, &payload); requiredErr != nil {
+		return Payload{}, nil, requiredErr
+	}
+
+	// Decode each optional section into its field, in a stable order
+	targets := map[string]interface{}{
+		"sender":             &payload.Sender,
+		"agent":              &payload.Agent,
+		"job":                &payload.Job,
+		"build.creator":      &payload.Build.Creator,
+		"build.meta_data":    &payload.Build.MetaData,
+		"build.rebuilt_from": &payload.Build.RebuiltFrom,
+		"pipeline.provider":  &payload.Pipeline.Provider,
+	}
+	var warnings []SectionWarning
+	for _, section := range OptionalSections {
+		raw, ok := optional[section]
+		if !ok {
+			continue
+		}
+		if err := decodeSection(raw, targets[section]); err != nil {
+			warnings = append(warnings, SectionWarning{Section: section, Err: err})
+		}
+	}
+	return payload, warnings, nil
+}
+
+// decodeSection decodes raw into target, a pointer, leaving it untouched on
+// error so a half-decoded section is not kept
+func decodeSection(raw json.RawMessage, target interface{}) error {
+	v := reflect.New(reflect.TypeOf(target).Elem())
+	if err := jsoncodec.Unmarshal(raw, v.Interface()); err != nil {
+		return err
+	}
+	reflect.ValueOf(target).Elem().Set(v.Elem())
+	return nil
+}
+
+// cutParent returns the field name of a section nested in parent
+func cutParent(section, parent string) (string, bool) {
+	return strings.CutPrefix(section, parent+".")
+}
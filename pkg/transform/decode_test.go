@@ -0,0 +1,54 @@
+package transform
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDecodePartial(t *testing.T) {
+	body, err := os.ReadFile(filepath.Join("testdata", "build.finished.json"))
+	if err != nil {
+		t.Fatalf("failed to read payload: %v", err)
+	}
+	want, warnings, err := DecodePartial(body)
+	if err != nil || len(warnings) > 0 {
+		t.Fatalf("DecodePartial() of a valid payload = %v, %v", warnings, err)
+	}
+
+	// Break sender and build.meta_data; the rest still decodes
+	broken := strings.Replace(string(body), `"sender": {`, `"sender": ["not", "a", "user"], "ignored": {`, 1)
+	broken = strings.Replace(broken, `"meta_data": {`, `"meta_data": "oops", "ignored": {`, 1)
+	if broken == string(body) {
+		t.Fatal("fixture changed; update the replacements")
+	}
+	got, warnings, err := DecodePartial([]byte(broken))
+	if err != nil {
+		t.Fatalf("DecodePartial() error = %v", err)
+	}
+	var sections []string
+	for _, w := range warnings {
+		sections = append(sections, w.Section)
+	}
+	if strings.Join(sections, ",") != "sender,build.meta_data" {
+		t.Errorf("warnings = %v, want sender and build.meta_data", warnings)
+	}
+	if got.Sender != (User{}) || got.Build.MetaData != nil {
+		t.Errorf("malformed sections were kept: sender %+v, meta_data %v", got.Sender, got.Build.MetaData)
+	}
+	if got.Event != want.Event || got.Build.ID != want.Build.ID || got.Pipeline.Slug != want.Pipeline.Slug || got.Build.Creator != want.Build.Creator {
+		t.Errorf("DecodePartial() = %+v, want the valid sections of %+v", got, want)
+	}
+
+	// Required sections still fail
+	for name, body := range map[string]string{
+		"not an object": `[1, 2]`,
+		"bad build":     `{"event": "build.finished", "build": {"number": "one"}}`,
+		"bad event":     `{"event": 3}`,
+	} {
+		if _, _, err := DecodePartial([]byte(body)); err == nil {
+			t.Errorf("DecodePartial() of %s error = nil, want error", name)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+// Package transform normalizes Buildkite webhook payloads into the message
+// format the webhook service publishes. Replayers and backfills can use it to
+// produce messages identical to those sent for live webhooks.
+package transform
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/jsoncodec"
+)
+
+// supportedEventPrefixes are the event families Transform understands; job
+// events carry the same build and pipeline objects as build events
+var supportedEventPrefixes = []string{"build.", "job.", "agent."}
+
+// IsSupportedEvent reports whether Transform produces a meaningful payload
+// for the event type
+func IsSupportedEvent(eventType string) bool {
+	for _, prefix := range supportedEventPrefixes {
+		if strings.HasPrefix(eventType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// LatestSchemaVersion is the newest schema version WithSchemaVersion
+// accepts. Version 2 adds the build's created_at_ms, started_at_ms and
+// finished_at_ms.
+const LatestSchemaVersion = "2"
+
+// epochMillisSchemaVersion is the first schema version with epoch
+// millisecond timestamps
+const epochMillisSchemaVersion = 2
+
+// options holds the settings applied by Option functions
+type options struct {
+	metaData      bool
+	schemaVersion string
+	redactFields  [][]string
+}
+
+// Option customizes Transform
+type Option func(*options)
+
+// WithMetaData copies the build's meta-data into BuildInfo.MetaData
+func WithMetaData() Option {
+	return func(o *options) {
+		o.metaData = true
+	}
+}
+
+// WithSchemaVersion stamps the transformed payload with a schema version so
+// consumers can tell message formats apart. Numeric versions from 2 also
+// add the fields introduced by that version.
+func WithSchemaVersion(version string) Option {
+	return func(o *options) {
+		o.schemaVersion = version
+	}
+}
+
+// WithRedactedFields removes fields from the payload before it is
+// transformed, so they appear in neither the summary nor raw_payload. Fields
+// are dotted JSON paths such as "sender.email"; a "*" segment matches every
+// key, so "build.meta_data.*" empties the meta-data.
+func WithRedactedFields(fields ...string) Option {
+	return func(o *options) {
+		for _, field := range fields {
+			if field != "" {
+				o.redactFields = append(o.redactFields, strings.Split(field, "."))
+			}
+		}
+	}
+}
+
+// Transform converts a webhook payload into the published message format
+func Transform(payload Payload, opts ...Option) (TransformedPayload, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// Convert payload to map for raw storage
+	raw, err := toMap(payload)
+	if err != nil {
+		return TransformedPayload{}, err
+	}
+
+	if len(o.redactFields) > 0 {
+		for _, field := range o.redactFields {
+			redact(raw, field)
+		}
+		// Decode the redacted map so the summary matches raw_payload
+		payload, err = fromMap(raw)
+		if err != nil {
+			return TransformedPayload{}, err
+		}
+	}
+
+	transformed := summarize(payload)
+	if o.metaData && len(payload.Build.MetaData) > 0 {
+		transformed.Build.MetaData = payload.Build.MetaData
+	}
+	if schemaAtLeast(o.schemaVersion, epochMillisSchemaVersion) {
+		transformed.Build.CreatedAtMs = epochMillis(transformed.Build.CreatedAt)
+		transformed.Build.StartedAtMs = epochMillis(transformed.Build.StartedAt)
+		transformed.Build.FinishedAtMs = epochMillis(transformed.Build.FinishedAt)
+	}
+	transformed.SchemaVersion = o.schemaVersion
+	transformed.Raw = raw
+	return transformed, nil
+}
+
+// schemaAtLeast reports whether version is a number no lower than min
+func schemaAtLeast(version string, min int) bool {
+	n, err := strconv.Atoi(version)
+	return err == nil && n >= min
+}
+
+// epochMillis returns t in milliseconds since the Unix epoch, or 0 for the
+// zero time so unset timestamps are omitted rather than far in the past
+func epochMillis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// summarize builds the typed summary of a payload
+func summarize(payload Payload) TransformedPayload {
+	// Extract organization from pipeline URL
+	// URL format: https://api.buildkite.com/v2/organizations/ORGNAME/pipelines/...
+	orgName := ""
+	urlParts := strings.Split(payload.Pipeline.URL, "/")
+	for i, part := range urlParts {
+		if part == "organizations" && i+1 < len(urlParts) {
+			orgName = urlParts[i+1]
+			break
+		}
+	}
+
+	// Handle nullable time fields
+	var startedAt, finishedAt time.Time
+	if payload.Build.StartedAt != nil {
+		startedAt = *payload.Build.StartedAt
+	}
+	if payload.Build.FinishedAt != nil {
+		finishedAt = *payload.Build.FinishedAt
+	}
+
+	transformed := TransformedPayload{
+		EventType: payload.Event,
+		Build: BuildInfo{
+			ID:           payload.Build.ID,
+			URL:          payload.Build.URL,
+			WebURL:       payload.Build.WebURL,
+			Number:       payload.Build.Number,
+			State:        payload.Build.State,
+			Branch:       payload.Build.Branch,
+			Commit:       payload.Build.Commit,
+			CreatedAt:    payload.Build.CreatedAt,
+			StartedAt:    startedAt,
+			FinishedAt:   finishedAt,
+			Pipeline:     payload.Pipeline.Slug,
+			Organization: orgName,
+			ClusterID:    payload.Build.ClusterID,
+			IsRetry:      payload.Build.RebuiltFrom != nil,
+		},
+		Pipeline: PipelineInfo{
+			ID:          payload.Pipeline.ID,
+			Name:        payload.Pipeline.Name,
+			Description: payload.Pipeline.Description,
+			Repository:  payload.Pipeline.Repository,
+		},
+		Sender: payload.Sender,
+	}
+
+	transformed.Build.NormalizedState, transformed.Build.IsTerminal = NormalizeState(payload.Build.State)
+	transformed.Build.IsBlocked = payload.Build.Blocked || payload.Build.State == "blocked"
+	if transformed.Build.IsBlocked {
+		transformed.Build.BlockedState = payload.Build.BlockedState
+	}
+
+	if payload.Job != nil {
+		transformed.Job = jobInfo(*payload.Job)
+	}
+
+	if agent := payload.Agent; agent != nil {
+		transformed.Agent = &AgentInfo{
+			ID:              agent.ID,
+			Name:            agent.Name,
+			Hostname:        agent.Hostname,
+			ConnectionState: agent.ConnectionState,
+			Version:         agent.Version,
+			ClusterID:       agent.ClusterID,
+			QueueName:       AgentQueue(agent.MetaData),
+			Tags:            agent.MetaData,
+			CreatedAt:       agent.CreatedAt,
+		}
+	}
+
+	return transformed
+}
+
+// jobInfo builds the summary of a job
+func jobInfo(job Job) *JobInfo {
+	name := job.Name
+	if name == "" {
+		name = job.Label
+	}
+	return &JobInfo{
+		ID:          job.ID,
+		Type:        job.Type,
+		Name:        name,
+		StepKey:     job.StepKey,
+		State:       job.State,
+		ExitStatus:  job.ExitStatus,
+		StartedAt:   job.StartedAt,
+		FinishedAt:  job.FinishedAt,
+		IsBlockStep: job.Type == JobTypeBlock,
+		Unblockable: job.Unblockable,
+		UnblockURL:  job.UnblockURL,
+		UnblockedBy: job.UnblockedBy,
+		UnblockedAt: job.UnblockedAt,
+	}
+}
+
+// BuildJobs decodes the jobs of a build.* webhook body. Payload leaves them
+// out, as a build can have hundreds; JobMessages turns them into messages.
+func BuildJobs(body []byte) ([]map[string]interface{}, error) {
+	var envelope struct {
+		Build struct {
+			Jobs []map[string]interface{} `json:"jobs"`
+		} `json:"build"`
+	}
+	if err := jsoncodec.Unmarshal(body, &envelope); err != nil {
+		return nil, err
+	}
+	return envelope.Build.Jobs, nil
+}
+
+// JobMessages returns one build.job message per job of a transformed build
+// event, each with the build's summary, the job's summary and the job as
+// received in raw_payload, so consumers needn't explode the jobs array
+func JobMessages(build TransformedPayload, jobs []map[string]interface{}) ([]TransformedPayload, error) {
+	messages := make([]TransformedPayload, 0, len(jobs))
+	for i, raw := range jobs {
+		rawJSON, err := jsoncodec.Marshal(raw)
+		if err != nil {
+			return nil, err
+		}
+		var job Job
+		if err := jsoncodec.Unmarshal(rawJSON, &job); err != nil {
+			return nil, err
+		}
+
+		message := build
+		message.EventType = EventBuildJob
+		message.Agent = nil
+		message.Unblock = nil
+		message.Job = jobInfo(job)
+		message.JobSeries = &JobSeriesInfo{Index: i + 1, Count: len(jobs)}
+		message.Raw = raw
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// toMap converts a payload to its generic JSON form
+func toMap(payload Payload) (map[string]interface{}, error) {
+	rawJSON, err := jsoncodec.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	if err := jsoncodec.Unmarshal(rawJSON, &raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// fromMap decodes a generic JSON form back into a payload
+func fromMap(raw map[string]interface{}) (Payload, error) {
+	rawJSON, err := jsoncodec.Marshal(raw)
+	if err != nil {
+		return Payload{}, err
+	}
+
+	var payload Payload
+	if err := jsoncodec.Unmarshal(rawJSON, &payload); err != nil {
+		return Payload{}, err
+	}
+	return payload, nil
+}
+
+// redact deletes the value at path from obj
+func redact(obj map[string]interface{}, path []string) {
+	key, rest := path[0], path[1:]
+	for k, value := range obj {
+		if key != "*" && k != key {
+			continue
+		}
+		if len(rest) == 0 {
+			delete(obj, k)
+			continue
+		}
+		if child, ok := value.(map[string]interface{}); ok {
+			redact(child, rest)
+		}
+	}
+}
+
+// JobTypeBlock is the job type of block steps
+const JobTypeBlock = "manual"
+
+// EventBuildJob is the event type of the messages the webhook publishes
+// for each job of a finished build
+const EventBuildJob = "build.job"
+
+// EventBuildUnblocked is the event type of the message the webhook derives
+// when a blocked build runs again; Buildkite sends no such event
+const EventBuildUnblocked = "build.unblocked"
+
+// Normalized build states
+const (
+	NormalizedStateSuccess  = "success"
+	NormalizedStateFailure  = "failure"
+	NormalizedStateCanceled = "canceled"
+	NormalizedStateRunning  = "running"
+	NormalizedStateBlocked  = "blocked"
+)
+
+// normalizedStates maps Buildkite build states to their normalized state
+// and whether they are terminal. A blocked build can still be unblocked, and
+// a canceling or failing build is still running, so none of them are.
+var normalizedStates = map[string]struct {
+	state    string
+	terminal bool
+}{
+	"passed":    {NormalizedStateSuccess, true},
+	"failed":    {NormalizedStateFailure, true},
+	"failing":   {NormalizedStateRunning, false},
+	"canceled":  {NormalizedStateCanceled, true},
+	"canceling": {NormalizedStateCanceled, false},
+	"skipped":   {NormalizedStateCanceled, true},
+	"not_run":   {NormalizedStateCanceled, true},
+	"blocked":   {NormalizedStateBlocked, false},
+	"creating":  {NormalizedStateRunning, false},
+	"scheduled": {NormalizedStateRunning, false},
+	"running":   {NormalizedStateRunning, false},
+}
+
+// NormalizeState returns the normalized state of a Buildkite build state and
+// whether it is terminal; unknown states normalize to "" and are not terminal
+func NormalizeState(state string) (normalized string, terminal bool) {
+	s := normalizedStates[state]
+	return s.state, s.terminal
+}
+
+// defaultQueue is the queue Buildkite assigns agents without a queue tag
+const defaultQueue = "default"
+
+// AgentQueue returns the queue from an agent's key=value tags
+func AgentQueue(tags []string) string {
+	for _, tag := range tags {
+		if key, value, ok := strings.Cut(tag, "="); ok && key == "queue" && value != "" {
+			return value
+		}
+	}
+	return defaultQueue
+}
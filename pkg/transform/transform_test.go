@@ -0,0 +1,255 @@
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files in testdata")
+
+func TestTransformGolden(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		golden string
+		opts   []Option
+	}{
+		{name: "build.scheduled", input: "build.scheduled.json", golden: "build.scheduled.golden"},
+		{name: "build.running", input: "build.running.json", golden: "build.running.golden"},
+		{name: "build.finished", input: "build.finished.json", golden: "build.finished.golden"},
+		{name: "build.blocked", input: "build.blocked.json", golden: "build.blocked.golden"},
+		{name: "job.finished", input: "job.finished.json", golden: "job.finished.golden"},
+		{name: "job.activated block step", input: "job.activated.json", golden: "job.activated.golden"},
+		{name: "agent.connected", input: "agent.connected.json", golden: "agent.connected.golden"},
+		{name: "agent.lost", input: "agent.lost.json", golden: "agent.lost.golden"},
+		{
+			name:   "build.finished with options",
+			input:  "build.finished.json",
+			golden: "build.finished.options.golden",
+			opts: []Option{
+				WithMetaData(),
+				WithSchemaVersion("2"),
+				WithRedactedFields("sender.name", "build.creator.email", "pipeline.provider.settings.*"),
+			},
+		},
+		{
+			name:   "build.scheduled schema 2",
+			input:  "build.scheduled.json",
+			golden: "build.scheduled.v2.golden",
+			opts:   []Option{WithSchemaVersion(LatestSchemaVersion)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := os.ReadFile(filepath.Join("testdata", tt.input))
+			if err != nil {
+				t.Fatalf("failed to read input: %v", err)
+			}
+			var payload Payload
+			if err := json.Unmarshal(body, &payload); err != nil {
+				t.Fatalf("failed to decode input: %v", err)
+			}
+
+			transformed, err := Transform(payload, tt.opts...)
+			if err != nil {
+				t.Fatalf("Transform() error = %v", err)
+			}
+			got, err := json.MarshalIndent(transformed, "", "  ")
+			if err != nil {
+				t.Fatalf("failed to encode output: %v", err)
+			}
+			got = append(got, '\n')
+
+			goldenPath := filepath.Join("testdata", tt.golden)
+			if *update {
+				if err := os.WriteFile(goldenPath, got, 0o644); err != nil {
+					t.Fatalf("failed to write golden file: %v", err)
+				}
+			}
+			want, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatalf("failed to read golden file (run with -update to create it): %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("Transform() output differs from %s:\ngot:\n%s\nwant:\n%s", goldenPath, got, want)
+			}
+		})
+	}
+}
+
+func TestEpochMillis(t *testing.T) {
+	created := time.Date(2025, 1, 7, 1, 2, 3, 456_000_000, time.FixedZone("AEDT", 11*60*60))
+	finished := created.Add(90 * time.Second)
+	payload := Payload{
+		Event: "build.finished",
+		Build: Build{CreatedAt: created, FinishedAt: &finished},
+	}
+
+	tests := []struct {
+		version string
+		want    [3]int64
+	}{
+		{version: "", want: [3]int64{}},
+		{version: "1", want: [3]int64{}},
+		{version: "beta", want: [3]int64{}},
+		// An unset started_at stays unset rather than year 1
+		{version: "2", want: [3]int64{1736172123456, 0, 1736172213456}},
+		{version: "10", want: [3]int64{1736172123456, 0, 1736172213456}},
+	}
+	for _, tt := range tests {
+		transformed, err := Transform(payload, WithSchemaVersion(tt.version))
+		if err != nil {
+			t.Fatalf("Transform() error = %v", err)
+		}
+		build := transformed.Build
+		if got := [3]int64{build.CreatedAtMs, build.StartedAtMs, build.FinishedAtMs}; got != tt.want {
+			t.Errorf("schema %q: created, started, finished ms = %v, want %v", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeState(t *testing.T) {
+	tests := []struct {
+		state    string
+		want     string
+		terminal bool
+	}{
+		{"passed", NormalizedStateSuccess, true},
+		{"failed", NormalizedStateFailure, true},
+		{"failing", NormalizedStateRunning, false},
+		{"canceled", NormalizedStateCanceled, true},
+		{"canceling", NormalizedStateCanceled, false},
+		{"skipped", NormalizedStateCanceled, true},
+		{"not_run", NormalizedStateCanceled, true},
+		{"blocked", NormalizedStateBlocked, false},
+		{"scheduled", NormalizedStateRunning, false},
+		{"running", NormalizedStateRunning, false},
+		{"", "", false},
+		{"exploded", "", false},
+	}
+	for _, tt := range tests {
+		if got, terminal := NormalizeState(tt.state); got != tt.want || terminal != tt.terminal {
+			t.Errorf("NormalizeState(%q) = %q, %v, want %q, %v", tt.state, got, terminal, tt.want, tt.terminal)
+		}
+	}
+}
+
+func TestTransformRetry(t *testing.T) {
+	var payload Payload
+	if err := json.Unmarshal([]byte(`{"event":"build.finished","build":{"state":"passed","rebuilt_from":{"id":"b1","number":696,"url":"https://api.buildkite.com/v2/builds/b1"}}}`), &payload); err != nil {
+		t.Fatalf("failed to decode payload: %v", err)
+	}
+	transformed, err := Transform(payload)
+	if err != nil {
+		t.Fatalf("Transform() error = %v", err)
+	}
+	if !transformed.Build.IsRetry {
+		t.Error("is_retry = false for a rebuild, want true")
+	}
+
+	payload.Build.RebuiltFrom = nil
+	if transformed, _ = Transform(payload); transformed.Build.IsRetry {
+		t.Error("is_retry = true for a first build, want false")
+	}
+}
+
+func TestJobMessages(t *testing.T) {
+	body := []byte(`{"event":"build.finished","build":{"id":"b1","state":"failed","jobs":[` +
+		`{"id":"j1","type":"script","name":"test","step_key":"test","state":"passed","exit_status":0},` +
+		`{"id":"j2","type":"script","name":"lint","state":"failed","exit_status":1,"agent_query_rules":["queue=lint"]}]}}`)
+	var payload Payload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatalf("failed to decode payload: %v", err)
+	}
+	build, err := Transform(payload)
+	if err != nil {
+		t.Fatalf("Transform() error = %v", err)
+	}
+	jobs, err := BuildJobs(body)
+	if err != nil {
+		t.Fatalf("BuildJobs() error = %v", err)
+	}
+	messages, err := JobMessages(build, jobs)
+	if err != nil {
+		t.Fatalf("JobMessages() error = %v", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("JobMessages() returned %d messages, want 2", len(messages))
+	}
+
+	m := messages[1]
+	if m.EventType != EventBuildJob || m.Build.ID != "b1" || m.Build.State != "failed" {
+		t.Errorf("message = %s for build %s (%s), want build.job for b1 (failed)", m.EventType, m.Build.ID, m.Build.State)
+	}
+	if m.Job == nil || m.Job.ID != "j2" || m.Job.ExitStatus == nil || *m.Job.ExitStatus != 1 {
+		t.Errorf("job = %+v, want j2 exiting 1", m.Job)
+	}
+	if m.JobSeries == nil || m.JobSeries.Index != 2 || m.JobSeries.Count != 2 {
+		t.Errorf("job_series = %+v, want 2 of 2", m.JobSeries)
+	}
+	// Fields the summary leaves out are kept in raw_payload
+	if m.Raw["agent_query_rules"] == nil {
+		t.Error("raw_payload is missing the job's agent_query_rules")
+	}
+	if build.Job != nil || build.JobSeries != nil {
+		t.Error("JobMessages() modified the build message")
+	}
+}
+
+func TestIsSupportedEvent(t *testing.T) {
+	for eventType, want := range map[string]bool{
+		"build.finished":                     true,
+		"job.started":                        true,
+		"agent.connected":                    true,
+		"ping":                               false,
+		"cluster_token.registration_blocked": false,
+	} {
+		if got := IsSupportedEvent(eventType); got != want {
+			t.Errorf("IsSupportedEvent(%q) = %v, want %v", eventType, got, want)
+		}
+	}
+}
+
+func FuzzTransform(f *testing.F) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "*.json"))
+	if err != nil {
+		f.Fatalf("failed to list testdata: %v", err)
+	}
+	for _, input := range inputs {
+		body, err := os.ReadFile(input)
+		if err != nil {
+			f.Fatalf("failed to read %s: %v", input, err)
+		}
+		f.Add(body)
+	}
+	f.Add([]byte(`{"event":"build.finished","build":null,"pipeline":{"url":"organizations"}}`))
+	f.Add([]byte(`{"event":"agent.connected","agent":{"meta_data":["queue","=","queue="]}}`))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		var payload Payload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return
+		}
+
+		transformed, err := Transform(payload,
+			WithMetaData(),
+			WithSchemaVersion("1"),
+			WithRedactedFields("build.creator.email", "pipeline.provider.*", "agent.ip_address"),
+		)
+		if err != nil {
+			return
+		}
+		if transformed.EventType != payload.Event {
+			t.Errorf("event_type = %q, want %q", transformed.EventType, payload.Event)
+		}
+		if _, err := json.Marshal(transformed); err != nil {
+			t.Errorf("failed to encode transformed payload: %v", err)
+		}
+	})
+}
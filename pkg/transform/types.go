@@ -0,0 +1,227 @@
+package transform
+
+import "time"
+
+// Payload represents the incoming webhook payload from Buildkite
+type Payload struct {
+	Event    string   `json:"event"`
+	Build    Build    `json:"build"`
+	Pipeline Pipeline `json:"pipeline"`
+	Sender   User     `json:"sender"`
+	// Agent is set for agent.* events
+	Agent *Agent `json:"agent,omitempty"`
+	// Job is set for job.* events
+	Job *Job `json:"job,omitempty"`
+}
+
+type Build struct {
+	ID          string                 `json:"id"`
+	GraphQLID   string                 `json:"graphql_id"`
+	URL         string                 `json:"url"`
+	WebURL      string                 `json:"web_url"`
+	Number      int                    `json:"number"`
+	State       string                 `json:"state"`
+	Message     string                 `json:"message"`
+	Commit      string                 `json:"commit"`
+	Branch      string                 `json:"branch"`
+	Tag         *string                `json:"tag"`
+	Source      string                 `json:"source"`
+	Creator     User                   `json:"creator"`
+	CreatedAt   time.Time              `json:"created_at"`
+	ScheduledAt *time.Time             `json:"scheduled_at"`
+	StartedAt   *time.Time             `json:"started_at"`
+	FinishedAt  *time.Time             `json:"finished_at"`
+	MetaData    map[string]interface{} `json:"meta_data"`
+	ClusterID   string                 `json:"cluster_id"`
+	// RebuiltFrom is set when the build is a rebuild of an earlier one
+	RebuiltFrom *BuildReference `json:"rebuilt_from,omitempty"`
+	// Blocked is set while a block step waits to be unblocked, and
+	// BlockedState is the state the build would otherwise be in
+	Blocked      bool   `json:"blocked,omitempty"`
+	BlockedState string `json:"blocked_state,omitempty"`
+}
+
+// BuildReference identifies another build
+type BuildReference struct {
+	ID     string `json:"id"`
+	Number int    `json:"number"`
+	URL    string `json:"url"`
+}
+
+type Pipeline struct {
+	ID          string    `json:"id"`
+	GraphQLID   string    `json:"graphql_id"`
+	URL         string    `json:"url"`
+	WebURL      string    `json:"web_url"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Slug        string    `json:"slug"`
+	Repository  string    `json:"repository"`
+	Provider    Provider  `json:"provider"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type Provider struct {
+	ID       string                 `json:"id"`
+	Settings map[string]interface{} `json:"settings"`
+}
+
+// Agent is the agent an agent.* event describes
+type Agent struct {
+	ID                string     `json:"id"`
+	GraphQLID         string     `json:"graphql_id"`
+	URL               string     `json:"url"`
+	WebURL            string     `json:"web_url"`
+	Name              string     `json:"name"`
+	ConnectionState   string     `json:"connection_state"`
+	Hostname          string     `json:"hostname"`
+	IPAddress         string     `json:"ip_address"`
+	UserAgent         string     `json:"user_agent"`
+	Version           string     `json:"version"`
+	Creator           *User      `json:"creator"`
+	CreatedAt         time.Time  `json:"created_at"`
+	LastJobFinishedAt *time.Time `json:"last_job_finished_at"`
+	Priority          int        `json:"priority"`
+	// MetaData holds the agent's tags as key=value strings
+	MetaData  []string `json:"meta_data"`
+	ClusterID string   `json:"cluster_id"`
+}
+
+// Job is the job a job.* event describes. Block steps are jobs of type
+// "manual"; the Unblock fields are set for them.
+type Job struct {
+	ID         string     `json:"id"`
+	GraphQLID  string     `json:"graphql_id,omitempty"`
+	Type       string     `json:"type"`
+	Name       string     `json:"name,omitempty"`
+	Label      string     `json:"label,omitempty"`
+	StepKey    string     `json:"step_key,omitempty"`
+	State      string     `json:"state"`
+	WebURL     string     `json:"web_url,omitempty"`
+	ExitStatus *int       `json:"exit_status"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// Unblockable reports whether the sender may unblock the step
+	Unblockable bool       `json:"unblockable,omitempty"`
+	UnblockURL  string     `json:"unblock_url,omitempty"`
+	UnblockedBy *User      `json:"unblocked_by,omitempty"`
+	UnblockedAt *time.Time `json:"unblocked_at,omitempty"`
+}
+
+type User struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Email     string `json:"email,omitempty"`
+	AvatarURL string `json:"avatar_url,omitempty"`
+}
+
+// TransformedPayload represents our standardized message format
+type TransformedPayload struct {
+	EventType string       `json:"event_type"`
+	Build     BuildInfo    `json:"build"`
+	Pipeline  PipelineInfo `json:"pipeline"`
+	Sender    User         `json:"sender"`
+	Agent     *AgentInfo   `json:"agent,omitempty"`
+	Job       *JobInfo     `json:"job,omitempty"`
+	// Unblock is set on the build.unblocked events the webhook derives when
+	// a blocked build runs again
+	Unblock *UnblockInfo `json:"unblock,omitempty"`
+	// JobSeries is set on the build.job messages published for each job of
+	// a finished build
+	JobSeries *JobSeriesInfo         `json:"job_series,omitempty"`
+	Raw       map[string]interface{} `json:"raw_payload"`
+	// SchemaVersion is set by WithSchemaVersion
+	SchemaVersion string `json:"schema_version,omitempty"`
+}
+
+type BuildInfo struct {
+	ID         string    `json:"id"`
+	URL        string    `json:"url"`
+	WebURL     string    `json:"web_url"`
+	Number     int       `json:"number"`
+	State      string    `json:"state"`
+	Branch     string    `json:"branch"`
+	Commit     string    `json:"commit"`
+	CreatedAt  time.Time `json:"created_at"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	// CreatedAtMs, StartedAtMs and FinishedAtMs are the timestamps in
+	// milliseconds since the Unix epoch, from schema version 2; they are
+	// omitted when the timestamp is unset
+	CreatedAtMs  int64  `json:"created_at_ms,omitempty"`
+	StartedAtMs  int64  `json:"started_at_ms,omitempty"`
+	FinishedAtMs int64  `json:"finished_at_ms,omitempty"`
+	Pipeline     string `json:"pipeline"`
+	Organization string `json:"organization"`
+	ClusterID    string `json:"cluster_id,omitempty"`
+	// NormalizedState is one of the NormalizedState* values, or empty for
+	// states Buildkite has not documented
+	NormalizedState string `json:"normalized_state,omitempty"`
+	// IsTerminal reports whether State is final
+	IsTerminal bool `json:"is_terminal,omitempty"`
+	// IsRetry reports whether the build is a rebuild of an earlier one
+	IsRetry bool `json:"is_retry,omitempty"`
+	// IsBlocked reports whether a block step is waiting to be unblocked,
+	// and BlockedState is the state the build would otherwise be in
+	IsBlocked    bool   `json:"is_blocked,omitempty"`
+	BlockedState string `json:"blocked_state,omitempty"`
+	// MetaData is set by WithMetaData
+	MetaData map[string]interface{} `json:"meta_data,omitempty"`
+}
+
+// AgentInfo is the agent summary published for agent.* events
+type AgentInfo struct {
+	ID              string    `json:"id"`
+	Name            string    `json:"name"`
+	Hostname        string    `json:"hostname"`
+	ConnectionState string    `json:"connection_state"`
+	Version         string    `json:"version"`
+	ClusterID       string    `json:"cluster_id,omitempty"`
+	QueueName       string    `json:"queue_name"`
+	Tags            []string  `json:"tags"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// JobInfo is the job summary published for job.* events
+type JobInfo struct {
+	ID         string     `json:"id"`
+	Type       string     `json:"type"`
+	Name       string     `json:"name"`
+	StepKey    string     `json:"step_key,omitempty"`
+	State      string     `json:"state"`
+	ExitStatus *int       `json:"exit_status,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// IsBlockStep reports whether the job is a block step
+	IsBlockStep bool `json:"is_block_step,omitempty"`
+	// Unblockable, UnblockURL, UnblockedBy and UnblockedAt describe a block
+	// step; a step waiting to be unblocked has no UnblockedAt
+	Unblockable bool       `json:"unblockable,omitempty"`
+	UnblockURL  string     `json:"unblock_url,omitempty"`
+	UnblockedBy *User      `json:"unblocked_by,omitempty"`
+	UnblockedAt *time.Time `json:"unblocked_at,omitempty"`
+}
+
+// JobSeriesInfo places a build.job message in the series published for a
+// build's jobs
+type JobSeriesInfo struct {
+	// Index counts from 1
+	Index int `json:"index"`
+	Count int `json:"count"`
+}
+
+// UnblockInfo describes a build that ran again after being blocked. The
+// times are when the webhook received the events, so BlockedSeconds is how
+// long the build waited for approval as seen by the webhook.
+type UnblockInfo struct {
+	BlockedAt      time.Time `json:"blocked_at"`
+	UnblockedAt    time.Time `json:"unblocked_at"`
+	BlockedSeconds float64   `json:"blocked_seconds"`
+}
+
+type PipelineInfo struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Repository  string `json:"repository"`
+}
@@ -0,0 +1,113 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/mcncl/buildkite-pubsub/internal/expression"
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+	"github.com/mcncl/buildkite-pubsub/pkg/transform"
+)
+
+// AttributeHook derives additional message attributes from a transformed
+// payload, such as a team from the pipeline slug. The payload's EventType
+// is set. Hooks run for supported events only, in order; they cannot
+// replace attributes the handler or an earlier hook has set.
+type AttributeHook func(payload transform.TransformedPayload) map[string]string
+
+// TeamResolver names the team owning a pipeline slug, or "" when unknown
+type TeamResolver interface {
+	Team(pipeline string) string
+}
+
+// AttributeRule sets Attribute to Value on events matching Match
+type AttributeRule struct {
+	Attribute string
+	Value     string
+	// ValueExpression, when set, computes the value instead of Value; the
+	// rule does not match when it fails to evaluate
+	ValueExpression *expression.Program
+	Match           publisher.RouteRule
+}
+
+// AttributeRules returns a hook applying rules in order; for each
+// attribute the first matching rule wins
+func AttributeRules(rules []AttributeRule) AttributeHook {
+	return func(payload transform.TransformedPayload) map[string]string {
+		var attributes map[string]string
+		for _, rule := range rules {
+			if _, set := attributes[rule.Attribute]; set || !rule.Match.Matches(payload) {
+				continue
+			}
+			value := rule.Value
+			if rule.ValueExpression != nil {
+				var ok bool
+				if value, ok = rule.ValueExpression.Value(payload); !ok {
+					continue
+				}
+			}
+			if attributes == nil {
+				attributes = make(map[string]string)
+			}
+			attributes[rule.Attribute] = value
+		}
+		return attributes
+	}
+}
+
+// addDerivedAttributes adds the attributes hooks derive from payload,
+// keeping any already set by the handler or an earlier hook
+func addDerivedAttributes(attributes map[string]string, hooks []AttributeHook, payload transform.TransformedPayload) {
+	for _, hook := range hooks {
+		for key, value := range hook(payload) {
+			if _, set := attributes[key]; !set {
+				attributes[key] = value
+			}
+		}
+	}
+}
+
+// AttributeHasher replaces the values of selected attributes with their
+// hex-encoded HMAC-SHA256, so attributes such as a creator email can still
+// be correlated across events without publishing the raw value. Consumers
+// holding the key can hash a known value to find its events.
+type AttributeHasher struct {
+	key        []byte
+	attributes map[string]bool
+}
+
+// NewAttributeHasher creates a hasher of attributes keyed by key
+func NewAttributeHasher(key []byte, attributes []string) *AttributeHasher {
+	selected := make(map[string]bool, len(attributes))
+	for _, attribute := range attributes {
+		selected[attribute] = true
+	}
+	return &AttributeHasher{key: key, attributes: selected}
+}
+
+// Hash returns the keyed hash of value
+func (a *AttributeHasher) Hash(value string) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Value returns value hashed when attribute is selected, and as it is
+// otherwise, when it is empty or when a is nil
+func (a *AttributeHasher) Value(attribute, value string) string {
+	if a == nil || value == "" || !a.attributes[attribute] {
+		return value
+	}
+	return a.Hash(value)
+}
+
+// apply hashes the selected attributes in place
+func (a *AttributeHasher) apply(attributes map[string]string) {
+	if a == nil {
+		return
+	}
+	for key, value := range attributes {
+		attributes[key] = a.Value(key, value)
+	}
+}
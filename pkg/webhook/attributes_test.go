@@ -0,0 +1,341 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/audit"
+	"github.com/mcncl/buildkite-pubsub/internal/config"
+	"github.com/mcncl/buildkite-pubsub/internal/expression"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"github.com/mcncl/buildkite-pubsub/pkg/transform"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook/webhooktest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAttributeRules(t *testing.T) {
+	hook := AttributeRules([]AttributeRule{
+		{Attribute: "team", Value: "payments", Match: publisher.RouteRule{Pipeline: "payments-*"}},
+		{Attribute: "team", Value: "platform"},
+		{Attribute: "severity", Value: "high", Match: publisher.RouteRule{BuildState: "failed", Branch: "main"}},
+	})
+
+	tests := []struct {
+		name     string
+		pipeline string
+		branch   string
+		state    string
+		want     map[string]string
+	}{
+		{name: "first matching rule wins", pipeline: "payments-api", branch: "main", state: "passed", want: map[string]string{"team": "payments"}},
+		{name: "falls through to catch-all", pipeline: "docs", branch: "main", state: "passed", want: map[string]string{"team": "platform"}},
+		{name: "every attribute is derived", pipeline: "payments-api", branch: "main", state: "failed", want: map[string]string{"team": "payments", "severity": "high"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var payload transform.TransformedPayload
+			payload.Build.Pipeline = tt.pipeline
+			payload.Build.Branch = tt.branch
+			payload.Build.State = tt.state
+			if got := hook(payload); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hook() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+	prefix, err := expression.CompileValue("team", "build.pipeline.split('-')[0]")
+	if err != nil {
+		t.Fatalf("CompileValue() error = %v", err)
+	}
+	computed := AttributeRules([]AttributeRule{{Attribute: "team", ValueExpression: prefix}})
+	var payload transform.TransformedPayload
+	payload.Build.Pipeline = "payments-api"
+	if got := computed(payload); got["team"] != "payments" {
+		t.Errorf("hook() with a value expression = %v, want team=payments", got)
+	}
+
+	if got := AttributeRules(nil)(transform.TransformedPayload{}); got != nil {
+		t.Errorf("hook() without rules = %v, want nil", got)
+	}
+}
+
+func TestHandlerAttributeHooks(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	var seen []string
+	mock := publisher.NewMockPublisher().(*publisher.MockPublisher)
+	handler := NewHandler(Config{
+		BuildkiteToken: "test-token",
+		Publisher:      mock,
+		AttributeHooks: []AttributeHook{
+			func(payload transform.TransformedPayload) map[string]string {
+				seen = append(seen, payload.EventType)
+				return map[string]string{"team": "payments", "pipeline": "overridden"}
+			},
+			func(transform.TransformedPayload) map[string]string {
+				return map[string]string{"team": "platform", "severity": "high"}
+			},
+		},
+	})
+
+	send := func(payload string) map[string]string {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewBufferString(payload))
+		req.Header.Set("X-Buildkite-Token", "test-token")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+		}
+		return mock.LastPublished().Attributes
+	}
+
+	attrs := send(`{"event":"build.finished","build":{"id":"123","state":"passed"},"pipeline":{"slug":"test","name":"Test Pipeline"}}`)
+	if attrs["team"] != "payments" || attrs["severity"] != "high" {
+		t.Errorf("derived attributes team = %q, severity = %q, want payments, high", attrs["team"], attrs["severity"])
+	}
+	if attrs["pipeline"] != "test" {
+		t.Errorf("pipeline attribute = %q, hooks must not replace built-in attributes", attrs["pipeline"])
+	}
+	if len(seen) != 1 || seen[0] != "build.finished" {
+		t.Errorf("hook saw event types %v, want [build.finished]", seen)
+	}
+
+	// Unsupported events are published raw, without derived attributes
+	attrs = send(`{"event":"cluster.updated"}`)
+	if _, ok := attrs["team"]; ok || len(seen) != 1 {
+		t.Errorf("hooks ran for an unsupported event: attributes %v", attrs)
+	}
+}
+
+// teams is a TeamResolver backed by a map
+type teams map[string]string
+
+func (t teams) Team(pipeline string) string { return t[pipeline] }
+
+func TestHandlerTeams(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	if err := metrics.InitMetrics(reg); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	mock := publisher.NewMockPublisher().(*publisher.MockPublisher)
+	handler := NewHandler(Config{
+		BuildkiteToken: "test-token",
+		Publisher:      mock,
+		Teams:          teams{"payments-api": "payments"},
+	})
+
+	for _, pipeline := range []string{"payments-api", "docs"} {
+		payload := `{"event":"build.finished","build":{"id":"123","state":"passed","branch":"main"},"pipeline":{"slug":"` + pipeline + `","name":"` + pipeline + `"}}`
+		req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewBufferString(payload))
+		req.Header.Set("X-Buildkite-Token", "test-token")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+		}
+	}
+
+	published := mock.GetPublished()
+	if got := published[0].Attributes["team"]; got != "payments" {
+		t.Errorf("team attribute = %q, want payments", got)
+	}
+	if got, ok := published[1].Attributes["team"]; ok {
+		t.Errorf("team attribute for an unowned pipeline = %q, want none", got)
+	}
+	if got := testutil.ToFloat64(metrics.BuildsTotal.WithLabelValues("passed", "payments-api", "main", "payments")); got != 1 {
+		t.Errorf("builds{team=payments} = %v, want 1", got)
+	}
+}
+
+func TestHandlerExpiresAt(t *testing.T) {
+	webhooktest.NewRegistry(t)
+	pub := webhooktest.NewPublisher()
+	handler := NewHandler(Config{
+		BuildkiteToken: "test-token",
+		Publisher:      pub,
+		EventPolicies:  map[string]config.EventPolicy{"build.started": {TTLSeconds: 3600}},
+	})
+
+	for _, eventType := range []string{"build.started", "build.finished"} {
+		rr := webhooktest.Serve(handler, webhooktest.NewTokenRequest("/webhook", "test-token", webhooktest.Payload(eventType)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", rr.Code, rr.Body)
+		}
+	}
+
+	published := pub.GetPublished()
+	receivedAt, _ := subscriber.ReceivedAt(published[0].Attributes)
+	expiresAt, ok := subscriber.ExpiresAt(published[0].Attributes)
+	if !ok || expiresAt.Sub(receivedAt) != time.Hour {
+		t.Errorf("expires_at = %v, want an hour after received_at %v", expiresAt, receivedAt)
+	}
+	if got, ok := published[1].Attributes[subscriber.ExpiresAtAttribute]; ok {
+		t.Errorf("expires_at = %q for an event type without a TTL", got)
+	}
+}
+
+func TestHandlerPipelineAttribute(t *testing.T) {
+	webhooktest.NewRegistry(t)
+	tests := []struct {
+		name      string
+		legacy    bool
+		slug      string
+		want      string
+		wantAudit string
+	}{
+		{name: "slug", slug: "Payments_API", want: "payments-api", wantAudit: "payments-api"},
+		{name: "normalized name without a slug", want: "payments-api-eu"},
+		{name: "legacy display name", legacy: true, slug: "Payments_API", want: "Payments API (EU)", wantAudit: "Payments_API"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pub := webhooktest.NewPublisher()
+			store := &memoryAuditStore{}
+			handler := NewHandler(Config{
+				BuildkiteToken:          "test-token",
+				Publisher:               pub,
+				Audit:                   store,
+				LegacyPipelineAttribute: tt.legacy,
+			})
+			body := webhooktest.Payload("build.finished",
+				webhooktest.WithField("pipeline.slug", tt.slug),
+				webhooktest.WithField("pipeline.name", "Payments API (EU)"),
+				webhooktest.WithField("pipeline.url", "https://api.buildkite.com/v2/organizations/Acme_Corp/pipelines/payments-api"))
+			rr := webhooktest.Serve(handler, webhooktest.NewTokenRequest("/webhook", "test-token", body))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rr.Code, rr.Body)
+			}
+
+			msg := pub.LastPublished()
+			if got := msg.Attributes[subscriber.PipelineAttribute]; got != tt.want {
+				t.Errorf("pipeline attribute = %q, want %q", got, tt.want)
+			}
+			if got := msg.Attributes[subscriber.OrganizationAttribute]; got != "acme-corp" {
+				t.Errorf("organization attribute = %q, want acme-corp", got)
+			}
+			if payload, ok := msg.Data.(transform.TransformedPayload); !ok || payload.Pipeline.Name != "Payments API (EU)" {
+				t.Errorf("payload pipeline = %+v, want the display name", payload.Pipeline)
+			}
+			// Audit records match the metric labels, not the raw slug
+			records, _ := store.Query(context.Background(), audit.Query{})
+			if len(records) != 1 || records[0].Pipeline != tt.wantAudit {
+				t.Errorf("audit records = %+v, want pipeline %q", records, tt.wantAudit)
+			}
+		})
+	}
+}
+
+func TestHandlerAttributeHasher(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	hasher := NewAttributeHasher([]byte("0123456789abcdef"), []string{"creator_email", "branch", "team"})
+	mock := publisher.NewMockPublisher().(*publisher.MockPublisher)
+	handler := NewHandler(Config{
+		BuildkiteToken:  "test-token",
+		Publisher:       mock,
+		Teams:           teams{"test": "payments"},
+		AttributeHasher: hasher,
+		AttributeHooks: []AttributeHook{
+			func(transform.TransformedPayload) map[string]string {
+				return map[string]string{"creator_email": "dev@example.com", "empty": ""}
+			},
+		},
+	})
+
+	payload := `{"event":"build.finished","build":{"id":"123","state":"passed","branch":"feature/jane-doe"},"pipeline":{"slug":"test","name":"Test"}}`
+	req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewBufferString(payload))
+	req.Header.Set("X-Buildkite-Token", "test-token")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	attrs := mock.LastPublished().Attributes
+	for attribute, raw := range map[string]string{"creator_email": "dev@example.com", "branch": "feature/jane-doe", "team": "payments"} {
+		if got, want := attrs[attribute], hasher.Hash(raw); got != want {
+			t.Errorf("%s attribute = %q, want hash %q", attribute, got, want)
+		}
+	}
+	if attrs["pipeline"] != "test" {
+		t.Errorf("pipeline attribute = %q, want it left as it is", attrs["pipeline"])
+	}
+	if got := testutil.ToFloat64(metrics.BuildsTotal.WithLabelValues("passed", "test", hasher.Hash("feature/jane-doe"), hasher.Hash("payments"))); got != 1 {
+		t.Errorf("builds with hashed branch and team labels = %v, want 1", got)
+	}
+
+	// The hash is stable for a key and differs between keys
+	if hasher.Hash("dev@example.com") != attrs["creator_email"] {
+		t.Error("Hash() is not stable")
+	}
+	if NewAttributeHasher([]byte("fedcba9876543210"), nil).Hash("dev@example.com") == attrs["creator_email"] {
+		t.Error("Hash() does not depend on the key")
+	}
+	var none *AttributeHasher
+	if got := none.Value("branch", "main"); got != "main" {
+		t.Errorf("nil hasher Value() = %q, want main", got)
+	}
+	if got := hasher.Value("branch", ""); got != "" {
+		t.Errorf("Value() of an empty value = %q, want empty", got)
+	}
+}
+
+// TestPublishedAttributesKnown keeps subscriber.Attributes, which subscription
+// filters are validated against, in step with what the handler publishes
+func TestPublishedAttributesKnown(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	mock := publisher.NewMockPublisher().(*publisher.MockPublisher)
+	handler := NewHandler(Config{
+		BuildkiteToken:        "test-token",
+		Publisher:             mock,
+		Version:               "v1.2.3",
+		Teams:                 teams{"test": "payments"},
+		ChecksumAlgorithm:     subscriber.ChecksumSHA256,
+		DeliveryAttemptHeader: "X-Delivery-Attempt",
+	})
+
+	for _, payload := range []string{
+		`{"event":"build.finished","build":{"id":"123","state":"passed","branch":"main"},"pipeline":{"slug":"test","name":"Test"}}`,
+		`{"event":"job.started","job":{"id":"456","agent_query_rules":["queue=linux"],"cluster_id":"c1"},"pipeline":{"slug":"test"},"build":{"id":"123"}}`,
+		`{"event":"cluster.updated"}`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewBufferString(payload))
+		req.Header.Set("X-Buildkite-Token", "test-token")
+		req.Header.Set("X-Buildkite-Delivery-Id", "b6ef1d7c-4b0a-4bd2-8d3e-6f4a0c6c2f10")
+		req.Header.Set("X-Delivery-Attempt", "2")
+		req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+		}
+	}
+
+	for _, published := range mock.GetPublished() {
+		for name := range published.Attributes {
+			if !subscriber.IsKnownAttribute(name) {
+				t.Errorf("handler publishes attribute %q missing from subscriber.Attributes", name)
+			}
+		}
+	}
+}
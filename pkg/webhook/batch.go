@@ -0,0 +1,199 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/errors"
+	"github.com/mcncl/buildkite-pubsub/internal/jsoncodec"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DefaultBatchMaxItems caps the events in a batch unless
+// Config.BatchMaxItems is set
+const DefaultBatchMaxItems = 100
+
+// BatchItemResult is the outcome of one event in a batch, with the status
+// and fields it would have been answered with on its own
+type BatchItemResult struct {
+	Index      int    `json:"index"`
+	Status     int    `json:"status"`
+	EventType  string `json:"event_type,omitempty"`
+	Message    string `json:"message,omitempty"`
+	MessageID  string `json:"message_id,omitempty"`
+	ErrorType  string `json:"error_type,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+}
+
+// BatchResponse answers a batch: success when every event was accepted,
+// partial when some were and error when none were
+type BatchResponse struct {
+	Status   string            `json:"status"`
+	Accepted int               `json:"accepted"`
+	Failed   int               `json:"failed"`
+	Items    []BatchItemResult `json:"items"`
+}
+
+// ServeBatch accepts a JSON array of Buildkite payloads in one request,
+// such as from an edge aggregator. The request is authenticated once, then
+// each payload is handled as if delivered on its own, and the response
+// reports every payload's outcome. It answers 200 when every payload was
+// accepted and 207 otherwise, so the sender can retry just the failures.
+func (h *Handler) ServeBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		metrics.ErrorsTotal.WithLabelValues("method_not_allowed").Inc()
+		w.Header().Set("Allow", http.MethodPost)
+		h.sendJSONResponse(w, http.StatusMethodNotAllowed, ErrorResponse{
+			Status:    "error",
+			Message:   "Method not allowed, only POST is supported",
+			ErrorType: "validation",
+		})
+		return
+	}
+
+	start := time.Now()
+	delivery := deliveryFromRequest(r, h.attemptHeader)
+	ctx := withInboundTraceContext(r.Context(), r)
+	trace.SpanFromContext(ctx).SetAttributes(delivery.spanAttributes()...)
+	timer := newPhaseTimer(start)
+	defer func() {
+		timer.mark(phaseRespond)
+		timer.observe()
+	}()
+
+	if decodeErr := h.decodeBody(r); decodeErr != nil {
+		h.rejectBody(ctx, w, r, decodeErr)
+		return
+	}
+	err := h.authenticate(r)
+	timer.mark(phaseAuth)
+	if err != nil {
+		h.rejectUnauthenticated(ctx, w, r, err, "batch")
+		return
+	}
+	if !subscriber.IsDeliveryMode(delivery.mode) {
+		h.rejectDeliveryMode(ctx, w, r, "batch")
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	timer.mark(phaseRead)
+	if err != nil {
+		metrics.ErrorsTotal.WithLabelValues("body_read_error").Inc()
+		h.handleError(w, r, errors.Wrap(err, "failed to read request body"), "batch")
+		return
+	}
+	var items []json.RawMessage
+	if err := jsoncodec.Unmarshal(body, &items); err != nil || len(items) == 0 {
+		metrics.ErrorsTotal.WithLabelValues("json_decode_error").Inc()
+		h.recordRejection(ctx, r, "json_decode_error", http.StatusBadRequest)
+		h.handleError(w, r, errors.NewValidationError("batch must be a non-empty JSON array of payloads"), "batch")
+		return
+	}
+	if len(items) > h.batchMaxItems {
+		metrics.ErrorsTotal.WithLabelValues("batch_too_large").Inc()
+		h.recordRejection(ctx, r, "batch_too_large", http.StatusRequestEntityTooLarge)
+		h.sendJSONResponse(w, http.StatusRequestEntityTooLarge, ErrorResponse{
+			Status:    "error",
+			Message:   "batch has " + strconv.Itoa(len(items)) + " payloads, more than the limit of " + strconv.Itoa(h.batchMaxItems),
+			ErrorType: "validation",
+		})
+		return
+	}
+	metrics.WebhookBatchSize.Observe(float64(len(items)))
+
+	response := BatchResponse{Items: make([]BatchItemResult, 0, len(items))}
+	for i, item := range items {
+		result := h.serveBatchItem(ctx, r, item, batchItemDelivery(delivery, item), timer)
+		result.Index = i
+		if result.Status < 300 {
+			response.Accepted++
+		} else {
+			response.Failed++
+		}
+		response.Items = append(response.Items, result)
+	}
+
+	switch {
+	case response.Failed == 0:
+		response.Status = "success"
+		h.sendJSONResponse(w, http.StatusOK, response)
+	case response.Accepted == 0:
+		response.Status = "error"
+		h.sendJSONResponse(w, http.StatusMultiStatus, response)
+	default:
+		response.Status = "partial"
+		h.sendJSONResponse(w, http.StatusMultiStatus, response)
+	}
+}
+
+// serveBatchItem handles one payload of a batch, counting it in the request
+// metrics like a webhook of its own
+func (h *Handler) serveBatchItem(ctx context.Context, r *http.Request, item []byte, d delivery, timer *phaseTimer) BatchItemResult {
+	start := time.Now()
+	iw := &itemWriter{header: make(http.Header), status: http.StatusOK}
+	eventType := h.serveEvent(ctx, iw, r, item, d, timer, start)
+	metrics.WebhookRequestsTotal.WithLabelValues(strconv.Itoa(iw.status), eventType, d.modeLabel()).Inc()
+	metrics.WebhookRequestDuration.WithLabelValues(eventType).Observe(time.Since(start).Seconds())
+
+	// Every response serveEvent writes is a JSON object
+	var answer struct {
+		Message    string `json:"message"`
+		MessageID  string `json:"message_id"`
+		ErrorType  string `json:"error_type"`
+		RetryAfter int    `json:"retry_after"`
+	}
+	_ = json.Unmarshal(iw.body.Bytes(), &answer)
+	return BatchItemResult{
+		Status:     iw.status,
+		EventType:  eventType,
+		Message:    answer.Message,
+		MessageID:  answer.MessageID,
+		ErrorType:  answer.ErrorType,
+		RetryAfter: answer.RetryAfter,
+	}
+}
+
+// batchItemDelivery returns the delivery of a payload of a batch, giving
+// each its own delivery ID from a hash of its bytes. Payloads are not
+// deduplicated against each other, but a payload is against its retries,
+// even when they come in a smaller batch of just the failed payloads.
+func batchItemDelivery(d delivery, item []byte) delivery {
+	if d.id != "" {
+		sum := sha256.Sum256(item)
+		d.id += "/" + hex.EncodeToString(sum[:8])
+	}
+	// The event header names the batch's events, not each payload's
+	d.eventType = ""
+	return d
+}
+
+// itemWriter records the response to one payload of a batch
+type itemWriter struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (w *itemWriter) Header() http.Header { return w.header }
+
+func (w *itemWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+}
+
+func (w *itemWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
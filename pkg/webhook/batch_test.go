@@ -0,0 +1,210 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/buildkite"
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook/webhooktest"
+)
+
+// batchBody joins payloads into a batch
+func batchBody(payloads ...[]byte) []byte {
+	return append(append([]byte("["), bytes.Join(payloads, []byte(","))...), ']')
+}
+
+func TestServeBatch(t *testing.T) {
+	finished := webhooktest.Payload("build.finished", webhooktest.WithBuildID("build-1"))
+	started := webhooktest.Payload("build.started", webhooktest.WithBuildID("build-2"))
+
+	tests := []struct {
+		name        string
+		body        []byte
+		failPublish bool
+		wantStatus  int
+		wantBatch   string
+		wantItems   []int
+	}{
+		{
+			name:       "every payload published",
+			body:       batchBody(finished, started),
+			wantStatus: http.StatusOK,
+			wantBatch:  "success",
+			wantItems:  []int{http.StatusOK, http.StatusOK},
+		},
+		{
+			name:       "one malformed payload",
+			body:       batchBody(finished, []byte(`{"event":42}`), started),
+			wantStatus: http.StatusMultiStatus,
+			wantBatch:  "partial",
+			wantItems:  []int{http.StatusOK, http.StatusBadRequest, http.StatusOK},
+		},
+		{
+			name:        "every publish failing",
+			body:        batchBody(finished, started),
+			failPublish: true,
+			wantStatus:  http.StatusMultiStatus,
+			wantBatch:   "error",
+			wantItems:   []int{http.StatusInternalServerError, http.StatusInternalServerError},
+		},
+		{
+			name:       "not an array",
+			body:       finished,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "empty",
+			body:       []byte(`[]`),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "over the item limit",
+			body:       batchBody(finished, finished, finished, finished),
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := webhooktest.NewRegistry(t)
+			pub := webhooktest.NewPublisher()
+			if tt.failPublish {
+				pub.SetError(errors.New("topic unavailable"))
+			}
+			handler := NewHandler(Config{BuildkiteToken: "test-token", Publisher: pub, BatchMaxItems: 3})
+
+			rr := webhooktest.Serve(http.HandlerFunc(handler.ServeBatch), webhooktest.NewTokenRequest("/webhook/batch", "test-token", tt.body))
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+			if tt.wantItems == nil {
+				webhooktest.AssertPublishedCount(t, pub, 0)
+				return
+			}
+
+			var response BatchResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if response.Status != tt.wantBatch || len(response.Items) != len(tt.wantItems) {
+				t.Fatalf("response = %+v, want %s with %d items", response, tt.wantBatch, len(tt.wantItems))
+			}
+			accepted := 0
+			for i, item := range response.Items {
+				if item.Index != i || item.Status != tt.wantItems[i] {
+					t.Errorf("items[%d] = %+v, want status %d", i, item, tt.wantItems[i])
+				}
+				if item.Status == http.StatusOK {
+					accepted++
+					if item.MessageID == "" {
+						t.Errorf("items[%d] has no message_id", i)
+					}
+					webhooktest.AssertCounter(t, reg, "buildkite_webhook_requests_total",
+						map[string]string{"status": "200", "event_type": item.EventType, "delivery_mode": "live"}, 1)
+				}
+			}
+			if response.Accepted != accepted || response.Failed != len(tt.wantItems)-accepted {
+				t.Errorf("accepted, failed = %d, %d, want %d, %d", response.Accepted, response.Failed, accepted, len(tt.wantItems)-accepted)
+			}
+			if !tt.failPublish {
+				webhooktest.AssertPublishedCount(t, pub, accepted)
+			}
+		})
+	}
+}
+
+func TestServeBatchAuthentication(t *testing.T) {
+	reg := webhooktest.NewRegistry(t)
+	pub := webhooktest.NewPublisher()
+	handler := NewHandler(Config{BuildkiteToken: "test-token", Publisher: pub})
+	body := batchBody(webhooktest.Payload("build.finished"))
+
+	rr := webhooktest.Serve(http.HandlerFunc(handler.ServeBatch), webhooktest.NewTokenRequest("/webhook/batch", "wrong-token", body))
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusUnauthorized)
+	}
+	webhooktest.AssertPublishedCount(t, pub, 0)
+	webhooktest.AssertCounter(t, reg, "buildkite_webhook_auth_failures_total", nil, 1)
+
+	req := webhooktest.NewRequest("/webhook/batch", body)
+	req.Method = http.MethodGet
+	if rr := webhooktest.Serve(http.HandlerFunc(handler.ServeBatch), req); rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET status = %d, want %d", rr.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestServeBatchDeliveryIDs(t *testing.T) {
+	webhooktest.NewRegistry(t)
+	pub := webhooktest.NewPublisher()
+	handler := NewHandler(Config{BuildkiteToken: "test-token", Publisher: pub})
+	payloads := [][]byte{
+		webhooktest.Payload("build.finished", webhooktest.WithBuildID("build-1")),
+		webhooktest.Payload("build.finished", webhooktest.WithBuildID("build-2")),
+	}
+	req := webhooktest.NewTokenRequest("/webhook/batch", "test-token", batchBody(payloads...))
+	req.Header.Set(buildkite.DeliveryIDHeader, "delivery-1")
+
+	if rr := webhooktest.Serve(http.HandlerFunc(handler.ServeBatch), req); rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	published := pub.GetPublished()
+	if len(published) != 2 {
+		t.Fatalf("published %d messages, want 2", len(published))
+	}
+	for i, payload := range payloads {
+		sum := sha256.Sum256(payload)
+		if got, want := published[i].Attributes["delivery_id"], "delivery-1/"+hex.EncodeToString(sum[:8]); got != want {
+			t.Errorf("message %d delivery_id = %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestServeBatchRetriesFailedItems(t *testing.T) {
+	webhooktest.NewRegistry(t)
+	mock := webhooktest.NewPublisher()
+	handler := NewHandler(Config{
+		BuildkiteToken: "test-token",
+		Publisher:      publisher.NewDedupePublisher(mock, publisher.NewMemoryDedupeStore(), time.Hour),
+	})
+	send := func(payloads ...[]byte) BatchResponse {
+		t.Helper()
+		req := webhooktest.NewTokenRequest("/webhook/batch", "test-token", batchBody(payloads...))
+		req.Header.Set(buildkite.DeliveryIDHeader, "delivery-1")
+		rr := webhooktest.Serve(http.HandlerFunc(handler.ServeBatch), req)
+		var response BatchResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		return response
+	}
+	first := webhooktest.Payload("build.finished", webhooktest.WithBuildID("build-1"))
+	second := webhooktest.Payload("build.finished", webhooktest.WithBuildID("build-2"))
+
+	// The second payload fails, and the sender retries it alone with the
+	// same delivery ID, putting it at the first payload's index
+	mock.FailOn(errors.New("topic unavailable"), 2)
+	if response := send(first, second); response.Status != "partial" || response.Items[1].Status < 300 {
+		t.Fatalf("first batch = %+v, want the second payload to fail", response)
+	}
+	if response := send(second); response.Status != "success" {
+		t.Fatalf("retried batch = %+v, want success", response)
+	}
+	published := mock.GetPublished()
+	sum := sha256.Sum256(second)
+	if want := "delivery-1/" + hex.EncodeToString(sum[:8]); len(published) != 2 || published[1].Attributes["delivery_id"] != want {
+		t.Errorf("published %d messages, want the first payload then the retried second as %s", len(published), want)
+	}
+
+	// Retrying the whole batch publishes neither again
+	if response := send(first, second); response.Status != "success" {
+		t.Fatalf("repeated batch = %+v, want success", response)
+	}
+	webhooktest.AssertPublishedCount(t, mock, 2)
+}
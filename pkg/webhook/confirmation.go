@@ -0,0 +1,58 @@
+package webhook
+
+import (
+	"context"
+	"path"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Confirmations waits for the primary consumer to confirm it processed a
+// message, as internal/confirmation.Tracker does
+type Confirmations interface {
+	// Wait blocks until messageID is confirmed, returning how long that
+	// took, or until its timeout passes or ctx is done, returning false
+	Wait(ctx context.Context, messageID string) (time.Duration, bool)
+}
+
+// confirmationFor reports whether messages of a pipeline slug wait for
+// the consumer's confirmation
+func (h *Handler) confirmationFor(pipeline string) bool {
+	if h.confirmations == nil {
+		return false
+	}
+	for _, pattern := range h.critical {
+		if ok, _ := path.Match(pattern, pipeline); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// awaitConfirmation waits for the consumer to confirm the message, adding
+// the outcome to the response. A message the consumer does not confirm in
+// time is still published, so the webhook succeeds either way; the miss is
+// counted as a delivery SLO violation and marked on the request's span. A
+// redelivery deduplicated to the original message reaches no consumer, so
+// it is counted without waiting.
+func (h *Handler) awaitConfirmation(ctx context.Context, response map[string]interface{}, pipeline string, result publisher.PublishResult) {
+	label := h.hasher.Value("pipeline", h.slugLabel(pipeline))
+	if result.Duplicate {
+		metrics.RecordDeliveryConfirmation(label, "duplicate")
+		return
+	}
+	elapsed, confirmed := h.confirmations.Wait(ctx, result.MessageID)
+	response["confirmed"] = confirmed
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("delivery_confirmed", confirmed))
+	if !confirmed {
+		metrics.RecordDeliveryConfirmation(label, "timeout")
+		return
+	}
+	metrics.RecordDeliveryConfirmation(label, "confirmed")
+	metrics.RecordDeliveryConfirmationTime(label, elapsed.Seconds())
+	response["confirm_ms"] = elapsed.Milliseconds()
+}
@@ -0,0 +1,113 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook/webhooktest"
+)
+
+// fakeConfirmations confirms every message while confirmed is set, and
+// times them out otherwise
+type fakeConfirmations struct {
+	mu        sync.Mutex
+	confirmed bool
+	waited    []string
+}
+
+func (f *fakeConfirmations) Wait(_ context.Context, messageID string) (time.Duration, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.waited = append(f.waited, messageID)
+	if f.confirmed {
+		return 250 * time.Millisecond, true
+	}
+	return 10 * time.Second, false
+}
+
+func TestHandlerConfirmation(t *testing.T) {
+	reg := webhooktest.NewRegistry(t)
+	pub := webhooktest.NewPublisher()
+	confirmations := &fakeConfirmations{confirmed: true}
+	handler := NewHandler(Config{
+		BuildkiteToken:        "test-token",
+		Publisher:             pub,
+		Confirmations:         confirmations,
+		ConfirmationID:        "replica-1",
+		ConfirmationPipelines: []string{"deploy-*"},
+	})
+
+	serve := func(pipeline string) map[string]interface{} {
+		t.Helper()
+		body := webhooktest.Payload("build.finished", webhooktest.WithPipeline(pipeline))
+		rr := webhooktest.Serve(handler, webhooktest.NewTokenRequest("/webhook", "test-token", body))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", rr.Code, rr.Body)
+		}
+		var response map[string]interface{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		return response
+	}
+
+	response := serve("deploy-production")
+	webhooktest.AssertAttributes(t, pub, map[string]string{subscriber.ConfirmAttribute: "replica-1"})
+	if response["confirmed"] != true || response["confirm_ms"] != float64(250) {
+		t.Errorf("response confirmed = %v, confirm_ms = %v, want true, 250", response["confirmed"], response["confirm_ms"])
+	}
+	if len(confirmations.waited) != 1 || confirmations.waited[0] != response["message_id"] {
+		t.Errorf("waited for %v, want the published message %v", confirmations.waited, response["message_id"])
+	}
+	webhooktest.AssertCounter(t, reg, "buildkite_webhook_delivery_confirmations_total", map[string]string{"pipeline": "deploy-production", "outcome": "confirmed"}, 1)
+
+	// A message the consumer does not confirm is still published
+	confirmations.confirmed = false
+	response = serve("deploy-production")
+	if response["confirmed"] != false || response["status"] != "success" {
+		t.Errorf("response confirmed = %v, status = %v, want false, success", response["confirmed"], response["status"])
+	}
+	webhooktest.AssertCounter(t, reg, "buildkite_webhook_delivery_confirmations_total", map[string]string{"pipeline": "deploy-production", "outcome": "timeout"}, 1)
+
+	// Other pipelines neither ask for nor wait for a confirmation
+	response = serve("docs")
+	if _, ok := response["confirmed"]; ok {
+		t.Errorf("response for a pipeline that is not critical has confirmed = %v", response["confirmed"])
+	}
+	if confirm, ok := pub.LastPublished().Attributes[subscriber.ConfirmAttribute]; ok {
+		t.Errorf("confirm attribute = %q for a pipeline that is not critical", confirm)
+	}
+	if len(confirmations.waited) != 2 {
+		t.Errorf("waited %d times, want 2", len(confirmations.waited))
+	}
+}
+
+func TestHandlerConfirmationSkipsDuplicates(t *testing.T) {
+	reg := webhooktest.NewRegistry(t)
+	confirmations := &fakeConfirmations{confirmed: true}
+	handler := NewHandler(Config{
+		BuildkiteToken:        "test-token",
+		Publisher:             publisher.NewDedupePublisher(webhooktest.NewPublisher(), publisher.NewMemoryDedupeStore(), time.Hour),
+		Confirmations:         confirmations,
+		ConfirmationID:        "replica-1",
+		ConfirmationPipelines: []string{"deploy-*"},
+	})
+
+	// A redelivery publishes nothing new, so there is nothing to confirm
+	body := webhooktest.Payload("build.finished", webhooktest.WithPipeline("deploy-production"))
+	for i := 0; i < 2; i++ {
+		if rr := webhooktest.Serve(handler, webhooktest.NewTokenRequest("/webhook", "test-token", body)); rr.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", rr.Code, rr.Body)
+		}
+	}
+	if len(confirmations.waited) != 1 {
+		t.Errorf("waited %d times, want once for the original delivery", len(confirmations.waited))
+	}
+	webhooktest.AssertCounter(t, reg, "buildkite_webhook_delivery_confirmations_total", map[string]string{"pipeline": "deploy-production", "outcome": "duplicate"}, 1)
+}
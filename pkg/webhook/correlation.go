@@ -0,0 +1,115 @@
+package webhook
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mcncl/buildkite-pubsub/internal/buildkite"
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceContext handles W3C traceparent/tracestate independently of the global
+// propagator, so correlation works even when tracing export is disabled
+var traceContext = propagation.TraceContext{}
+
+// DeliveryModeHeader marks an authenticated request as other than a live
+// Buildkite delivery, such as a replay or load test, with one of the
+// subscriber.DeliveryMode values. It is published as the delivery_mode
+// attribute.
+const DeliveryModeHeader = "X-Buildkite-Pubsub-Delivery-Mode"
+
+// delivery holds the correlation identifiers Buildkite sends with a webhook
+type delivery struct {
+	id        string
+	eventType string
+	// attempt is the delivery attempt, starting at 1, or 0 when unknown
+	attempt int
+	// mode is the delivery mode, which may be invalid until checked
+	mode string
+}
+
+// deliveryFromRequest extracts Buildkite correlation headers from the
+// request, reading the delivery attempt from attemptHeader when set
+func deliveryFromRequest(r *http.Request, attemptHeader string) delivery {
+	d := delivery{
+		id:        strings.TrimSpace(r.Header.Get(buildkite.DeliveryIDHeader)),
+		eventType: strings.TrimSpace(r.Header.Get(buildkite.EventHeader)),
+		mode:      subscriber.DeliveryModeLive,
+	}
+	if mode := strings.TrimSpace(r.Header.Get(DeliveryModeHeader)); mode != "" {
+		d.mode = strings.ToLower(mode)
+	}
+	if attemptHeader != "" {
+		if attempt, err := strconv.Atoi(strings.TrimSpace(r.Header.Get(attemptHeader))); err == nil && attempt > 0 {
+			d.attempt = attempt
+		}
+	}
+	return d
+}
+
+// modeLabel returns the delivery mode as a metric label, bounding the
+// values an unauthenticated request can claim
+func (d delivery) modeLabel() string {
+	if !subscriber.IsDeliveryMode(d.mode) {
+		return "invalid"
+	}
+	return d.mode
+}
+
+// live reports whether Buildkite delivered the webhook as it happened
+func (d delivery) live() bool {
+	return d.mode == subscriber.DeliveryModeLive
+}
+
+// redelivery reports whether Buildkite has delivered this webhook before
+func (d delivery) redelivery() bool {
+	return d.attempt > 1
+}
+
+// spanAttributes returns the delivery identifiers as span attributes
+func (d delivery) spanAttributes() []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+	if d.id != "" {
+		attrs = append(attrs, attribute.String("buildkite.delivery_id", d.id))
+	}
+	if d.eventType != "" {
+		attrs = append(attrs, attribute.String("buildkite.event", d.eventType))
+	}
+	if d.attempt > 0 {
+		attrs = append(attrs, attribute.Int("buildkite.delivery_attempt", d.attempt))
+	}
+	return attrs
+}
+
+// eventKey identifies the event for publish deduplication: the Buildkite
+// delivery UUID when sent, otherwise a hash of the raw payload, which is
+// identical across redeliveries
+func (d delivery) eventKey(body []byte) string {
+	if d.id != "" {
+		return d.id
+	}
+	sum := sha256.Sum256(body)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// withInboundTraceContext returns a context carrying the caller's W3C trace
+// context when no span is active yet, so our spans join the sender's trace
+func withInboundTraceContext(ctx context.Context, r *http.Request) context.Context {
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+	return traceContext.Extract(ctx, propagation.HeaderCarrier(r.Header))
+}
+
+// injectTraceContext adds traceparent (and tracestate) attributes for the span
+// in ctx so consumers can continue the trace. It is a no-op without a valid span.
+func injectTraceContext(ctx context.Context, attributes map[string]string) {
+	traceContext.Inject(ctx, propagation.MapCarrier(attributes))
+}
@@ -0,0 +1,239 @@
+package webhook
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook/webhooktest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHandlerCorrelation(t *testing.T) {
+	const (
+		traceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+		traceparent = "00-" + traceID + "-00f067aa0ba902b7-01"
+		deliveryID  = "0b6e3c4a-8b9e-4f47-9f5c-1d2e3f4a5b6c"
+	)
+
+	payload := `{
+		"event": "build.finished",
+		"build": {"id": "123", "state": "passed", "branch": "main", "created_at": "2024-01-09T10:00:00Z"},
+		"pipeline": {"slug": "test", "name": "Test Pipeline"}
+	}`
+
+	tests := []struct {
+		name            string
+		headers         map[string]string
+		wantDeliveryID  string
+		wantTraceParent bool
+	}{
+		{
+			name:    "no correlation headers",
+			headers: map[string]string{},
+		},
+		{
+			name: "delivery id only",
+			headers: map[string]string{
+				"X-Buildkite-Delivery-Id": deliveryID,
+				"X-Buildkite-Event":       "build.finished",
+			},
+			wantDeliveryID: deliveryID,
+		},
+		{
+			name: "inbound traceparent is propagated",
+			headers: map[string]string{
+				"X-Buildkite-Delivery-Id": deliveryID,
+				"traceparent":             traceparent,
+			},
+			wantDeliveryID:  deliveryID,
+			wantTraceParent: true,
+		},
+		{
+			name: "malformed traceparent is ignored",
+			headers: map[string]string{
+				"traceparent": "not-a-traceparent",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			if err := metrics.InitMetrics(reg); err != nil {
+				t.Fatalf("failed to initialize metrics: %v", err)
+			}
+
+			mockPub := publisher.NewMockPublisher()
+			handler := NewHandler(Config{
+				BuildkiteToken: "test-token",
+				Publisher:      mockPub,
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewBufferString(payload))
+			req.Header.Set("X-Buildkite-Token", "test-token")
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			lastPub := mockPub.(*publisher.MockPublisher).LastPublished()
+			if lastPub == nil {
+				t.Fatal("expected message to be published")
+			}
+
+			if got := lastPub.Attributes["delivery_id"]; got != tt.wantDeliveryID {
+				t.Errorf("delivery_id attribute = %q, want %q", got, tt.wantDeliveryID)
+			}
+
+			got, ok := lastPub.Attributes["traceparent"]
+			if ok != tt.wantTraceParent {
+				t.Fatalf("traceparent attribute present = %v, want %v", ok, tt.wantTraceParent)
+			}
+			if tt.wantTraceParent && !strings.Contains(got, traceID) {
+				t.Errorf("traceparent attribute %q does not continue trace %s", got, traceID)
+			}
+		})
+	}
+}
+
+func TestHandlerDedupesRedeliveries(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	mock := publisher.NewMockPublisher().(*publisher.MockPublisher)
+	handler := NewHandler(Config{
+		BuildkiteToken: "test-token",
+		Publisher:      publisher.NewDedupePublisher(mock, publisher.NewMemoryDedupeStore(), time.Hour),
+	})
+
+	send := func(deliveryID, payload string) int {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewBufferString(payload))
+		req.Header.Set("X-Buildkite-Token", "test-token")
+		if deliveryID != "" {
+			req.Header.Set("X-Buildkite-Delivery-Id", deliveryID)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	finished := `{"event":"build.finished","build":{"id":"123","state":"passed"},"pipeline":{"slug":"test"}}`
+	started := `{"event":"build.started","build":{"id":"123","state":"running"},"pipeline":{"slug":"test"}}`
+
+	// Redelivery with the same delivery UUID
+	for i := 0; i < 2; i++ {
+		if code := send("delivery-1", finished); code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", code)
+		}
+	}
+	// Identical payload without a delivery UUID falls back to a payload hash
+	for i := 0; i < 2; i++ {
+		if code := send("", started); code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", code)
+		}
+	}
+
+	if got := len(mock.GetPublished()); got != 2 {
+		t.Errorf("published %d messages, want 2", got)
+	}
+}
+
+func TestHandlerDeliveryAttempts(t *testing.T) {
+	payload := `{"event":"build.finished","build":{"id":"123","state":"passed"},"pipeline":{"slug":"test"}}`
+
+	tests := []struct {
+		name            string
+		header          string
+		attempt         string
+		wantAttempt     string
+		wantRedelivered float64
+	}{
+		{name: "header not configured", attempt: "2"},
+		{name: "first attempt", header: "X-Delivery-Attempt", attempt: "1", wantAttempt: "1"},
+		{name: "redelivery", header: "X-Delivery-Attempt", attempt: "3", wantAttempt: "3", wantRedelivered: 1},
+		{name: "malformed attempt", header: "X-Delivery-Attempt", attempt: "soon"},
+		{name: "zero attempt", header: "X-Delivery-Attempt", attempt: "0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+				t.Fatalf("failed to initialize metrics: %v", err)
+			}
+
+			mock := publisher.NewMockPublisher().(*publisher.MockPublisher)
+			handler := NewHandler(Config{
+				BuildkiteToken:        "test-token",
+				Publisher:             mock,
+				DeliveryAttemptHeader: tt.header,
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewBufferString(payload))
+			req.Header.Set("X-Buildkite-Token", "test-token")
+			req.Header.Set("X-Delivery-Attempt", tt.attempt)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+			if got := mock.LastPublished().Attributes["delivery_attempt"]; got != tt.wantAttempt {
+				t.Errorf("delivery_attempt attribute = %q, want %q", got, tt.wantAttempt)
+			}
+			if got := testutil.ToFloat64(metrics.RedeliveriesTotal.WithLabelValues("build.finished")); got != tt.wantRedelivered {
+				t.Errorf("redeliveries = %v, want %v", got, tt.wantRedelivered)
+			}
+		})
+	}
+}
+
+func TestHandlerDeliveryMode(t *testing.T) {
+	reg := webhooktest.NewRegistry(t)
+	if err := metrics.InitMetrics(reg); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	pub := webhooktest.NewPublisher()
+	handler := NewHandler(Config{BuildkiteToken: "test-token", Publisher: pub})
+	send := func(mode string) int {
+		req := webhooktest.NewTokenRequest("/webhook", "test-token", webhooktest.Payload("build.finished", webhooktest.WithPipeline("deploy")))
+		if mode != "" {
+			req.Header.Set(DeliveryModeHeader, mode)
+		}
+		return webhooktest.Serve(handler, req).Code
+	}
+
+	if code := send(""); code != http.StatusOK {
+		t.Fatalf("live status = %d", code)
+	}
+	webhooktest.AssertAttributes(t, pub, map[string]string{subscriber.DeliveryModeAttribute: subscriber.DeliveryModeLive})
+
+	// Synthetic traffic is published and labelled, but never counted as a build
+	if code := send("Synthetic"); code != http.StatusOK {
+		t.Fatalf("synthetic status = %d", code)
+	}
+	webhooktest.AssertAttributes(t, pub, map[string]string{subscriber.DeliveryModeAttribute: subscriber.DeliveryModeSynthetic})
+	webhooktest.AssertCounter(t, reg, "buildkite_builds_total", map[string]string{"pipeline": "deploy"}, 1)
+	webhooktest.AssertCounter(t, reg, "buildkite_webhook_requests_total", map[string]string{"delivery_mode": "synthetic"}, 1)
+
+	if code := send("chaos"); code != http.StatusBadRequest {
+		t.Errorf("invalid mode status = %d, want %d", code, http.StatusBadRequest)
+	}
+	webhooktest.AssertPublishedCount(t, pub, 2)
+	webhooktest.AssertCounter(t, reg, "buildkite_webhook_requests_total", map[string]string{"delivery_mode": "invalid"}, 1)
+}
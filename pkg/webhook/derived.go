@@ -0,0 +1,196 @@
+package webhook
+
+import (
+	"context"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/audit"
+	"github.com/mcncl/buildkite-pubsub/internal/buildkite"
+	"github.com/mcncl/buildkite-pubsub/internal/errors"
+	"github.com/mcncl/buildkite-pubsub/internal/jsoncodec"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"github.com/mcncl/buildkite-pubsub/pkg/transform"
+)
+
+// Derived messages are published by the webhook in addition to the message
+// for the webhook itself, such as build.unblocked and build.job. They are
+// best effort: the webhook has already been handled, so a failure to publish
+// one is counted but does not fail it.
+
+// maxJobMessagePublishes bounds how many build.job messages are published
+// at once
+const maxJobMessagePublishes = 16
+
+// trackUnblock remembers blocked builds and publishes a build.unblocked
+// event when a build remembered as blocked runs again. attributes are those
+// of the webhook's own message, or nil when it was filtered out.
+func (h *Handler) trackUnblock(ctx context.Context, eventType string, payload buildkite.TransformedPayload, attributes map[string]string, eventID string, at time.Time) {
+	build := payload.Build
+	if h.blocks == nil || !strings.HasPrefix(eventType, "build.") || build.ID == "" {
+		return
+	}
+	if build.IsBlocked {
+		h.blocks.Block(build.ID, at)
+		return
+	}
+	// A blocked build that is canceled instead is forgotten without an event
+	since, ok := h.blocks.Unblock(build.ID)
+	if !ok || build.NormalizedState != transform.NormalizedStateRunning {
+		return
+	}
+
+	unblocked := payload
+	unblocked.EventType = transform.EventBuildUnblocked
+	unblocked.Unblock = &transform.UnblockInfo{
+		BlockedAt:      since.UTC(),
+		UnblockedAt:    at.UTC(),
+		BlockedSeconds: at.Sub(since).Seconds(),
+	}
+	if !h.filter.Matches(unblocked) {
+		return
+	}
+
+	err := h.publishDerived(ctx, eventID+":"+transform.EventBuildUnblocked, unblocked, h.derivedAttributes(unblocked, attributes, at))
+	metrics.UnblockEventsTotal.WithLabelValues(derivedOutcome(err)).Inc()
+}
+
+// publishJobMessages publishes a build.job message for each job of a
+// build.finished event whose pipeline matches one of the jobMessages
+// patterns
+func (h *Handler) publishJobMessages(ctx context.Context, eventType string, payload buildkite.TransformedPayload, body []byte, attributes map[string]string, eventID string, at time.Time) {
+	if eventType != "build.finished" || !h.jobMessagesFor(payload.Build.Pipeline) {
+		return
+	}
+	jobs, err := transform.BuildJobs(body)
+	if err == nil && len(jobs) == 0 {
+		return
+	}
+	var messages []transform.TransformedPayload
+	if err == nil {
+		messages, err = transform.JobMessages(payload, jobs)
+	}
+	if err != nil {
+		metrics.ErrorsTotal.WithLabelValues("job_messages_error").Inc()
+		return
+	}
+
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, maxJobMessagePublishes)
+	for _, message := range messages {
+		if !h.filter.Matches(message) {
+			continue
+		}
+		messageAttributes := h.derivedAttributes(message, attributes, at)
+		messageAttributes["job_index"] = strconv.Itoa(message.JobSeries.Index)
+		messageAttributes["job_count"] = strconv.Itoa(message.JobSeries.Count)
+
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(message transform.TransformedPayload) {
+			defer func() { <-limit; wg.Done() }()
+			err := h.publishDerived(ctx, eventID+":job:"+strconv.Itoa(message.JobSeries.Index), message, messageAttributes)
+			metrics.JobMessagesTotal.WithLabelValues(derivedOutcome(err)).Inc()
+		}(message)
+	}
+	wg.Wait()
+}
+
+// jobMessagesFor reports whether build.job messages are published for a
+// pipeline slug
+func (h *Handler) jobMessagesFor(pipeline string) bool {
+	for _, pattern := range h.jobMessagePipelines {
+		if ok, _ := path.Match(pattern, pipeline); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// derivedAttributes returns the attributes of a derived message, based on
+// those of the webhook's own message when it was published. The delivery,
+// checksum, confirm and expiry attributes describe the webhook's own
+// message, so they are not copied.
+func (h *Handler) derivedAttributes(payload buildkite.TransformedPayload, attributes map[string]string, at time.Time) map[string]string {
+	build := payload.Build
+	derived := map[string]string{
+		"origin":      "buildkite-webhook",
+		"pipeline":    h.pipelineAttribute(payload),
+		"build_state": build.State,
+		"branch":      build.Branch,
+	}
+	if build.Organization != "" {
+		derived[subscriber.OrganizationAttribute] = subscriber.Slug(build.Organization)
+	}
+	if h.version != "" {
+		derived[subscriber.ProducerVersionAttribute] = h.version
+	}
+	if h.teams != nil {
+		if team := h.teams.Team(build.Pipeline); team != "" {
+			derived["team"] = team
+		}
+	}
+	addQueueAttributes(derived, payload)
+	// The webhook's own attributes were hashed already
+	h.hasher.apply(derived)
+	for key, value := range attributes {
+		switch key {
+		case "delivery_id", "delivery_attempt", subscriber.ChecksumAttribute, subscriber.ChecksumPayloadAttribute, subscriber.ConfirmAttribute, subscriber.ExpiresAtAttribute:
+		default:
+			derived[key] = value
+		}
+	}
+	own := map[string]string{
+		"event_type":                   payload.EventType,
+		subscriber.ReceivedAtAttribute: at.UTC().Format(time.RFC3339Nano),
+	}
+	if expiresAt, ok := h.expiresAt(payload.EventType, at); ok {
+		own[subscriber.ExpiresAtAttribute] = expiresAt
+	}
+	addStateAttributes(own, payload)
+	h.hasher.apply(own)
+	for key, value := range own {
+		derived[key] = value
+	}
+	if h.checksum != "" {
+		data, _ := jsoncodec.Marshal(payload)
+		if checksum, err := subscriber.Checksum(h.checksum, data); err == nil {
+			derived[subscriber.ChecksumAttribute] = checksum
+			derived[subscriber.ChecksumPayloadAttribute] = subscriber.ChecksumPayloadData
+		}
+	}
+	return derived
+}
+
+// publishDerived publishes a derived message under its own dedupe key and
+// records the outcome in the audit index
+func (h *Handler) publishDerived(ctx context.Context, eventID string, payload buildkite.TransformedPayload, attributes map[string]string) error {
+	ctx = publisher.WithDedupeKey(ctx, eventID)
+	record := audit.Record{
+		EventID:   eventID,
+		EventType: payload.EventType,
+		BuildID:   payload.Build.ID,
+		Pipeline:  h.hasher.Value("pipeline", h.slugLabel(payload.Build.Pipeline)),
+	}
+	result, _, err := h.publishWithRetry(ctx, payload, attributes, h.retryAttemptsFor(payload.EventType))
+	if err != nil {
+		record.Outcome, record.Error = audit.OutcomeFailed, errors.Format(err)
+	} else {
+		record.MessageID, record.Outcome = result.MessageID, audit.OutcomePublished
+	}
+	h.recordAudit(ctx, record)
+	return err
+}
+
+// derivedOutcome is the metric label for the outcome of a derived publish
+func derivedOutcome(err error) string {
+	if err != nil {
+		return "failed"
+	}
+	return "published"
+}
@@ -0,0 +1,90 @@
+package webhook
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+)
+
+// DefaultMaxDecompressedSize caps a gzip-encoded body once decompressed
+// unless Config.MaxDecompressedSize is set
+const DefaultMaxDecompressedSize = 10 << 20
+
+// Body decoding rejection reasons, used as metric labels
+const (
+	decodeTooLarge    = "too_large"
+	decodeMalformed   = "malformed"
+	decodeUnsupported = "unsupported"
+)
+
+// bodyDecodeError is why a request body could not be decoded, and the
+// status it is answered with
+type bodyDecodeError struct {
+	reason string
+	status int
+	msg    string
+}
+
+func (e *bodyDecodeError) Error() string { return e.msg }
+
+// decodeBody replaces a gzip-encoded request body with its decompressed
+// contents, so signature checks and parsing see the JSON the sender
+// encoded. It stops reading once the body exceeds the limit, so a small
+// decompression bomb cannot exhaust memory.
+func (h *Handler) decodeBody(r *http.Request) *bodyDecodeError {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+		metrics.RequestEncodingsTotal.WithLabelValues("identity").Inc()
+		return nil
+	case "gzip", "x-gzip":
+		metrics.RequestEncodingsTotal.WithLabelValues("gzip").Inc()
+	default:
+		return &bodyDecodeError{
+			reason: decodeUnsupported,
+			status: http.StatusUnsupportedMediaType,
+			msg:    fmt.Sprintf("unsupported Content-Encoding %q, only gzip is accepted", encoding),
+		}
+	}
+
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		return &bodyDecodeError{reason: decodeMalformed, status: http.StatusBadRequest, msg: "malformed gzip body"}
+	}
+	defer func() { _ = zr.Close() }()
+	body, err := io.ReadAll(io.LimitReader(zr, int64(h.maxDecompressed)+1))
+	if err != nil {
+		return &bodyDecodeError{reason: decodeMalformed, status: http.StatusBadRequest, msg: "malformed gzip body"}
+	}
+	if len(body) > h.maxDecompressed {
+		return &bodyDecodeError{
+			reason: decodeTooLarge,
+			status: http.StatusRequestEntityTooLarge,
+			msg:    "decompressed body exceeds " + strconv.Itoa(h.maxDecompressed) + " bytes",
+		}
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Del("Content-Encoding")
+	return nil
+}
+
+// rejectBody answers a request whose body could not be decoded
+func (h *Handler) rejectBody(ctx context.Context, w http.ResponseWriter, r *http.Request, decodeErr *bodyDecodeError) {
+	metrics.DecompressionRejected.WithLabelValues(decodeErr.reason).Inc()
+	metrics.ErrorsTotal.WithLabelValues("body_decode_" + decodeErr.reason).Inc()
+	h.recordRejection(ctx, r, "body_decode_"+decodeErr.reason, decodeErr.status)
+	h.sendJSONResponse(w, decodeErr.status, ErrorResponse{
+		Status:    "error",
+		Message:   decodeErr.Error(),
+		ErrorType: "validation",
+	})
+}
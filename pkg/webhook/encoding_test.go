@@ -0,0 +1,146 @@
+package webhook
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/pkg/buildkiteauth"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook/webhooktest"
+)
+
+func gzipBody(t *testing.T, body []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		t.Fatalf("failed to compress body: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to compress body: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestHandlerContentEncoding(t *testing.T) {
+	payload := webhooktest.Payload("build.finished", webhooktest.WithBuildID("build-1"))
+	// 1 MiB of zeros compresses to about 1 KiB
+	bomb := gzipBody(t, make([]byte, 1<<20))
+
+	tests := []struct {
+		name       string
+		encoding   string
+		body       []byte
+		wantStatus int
+		wantReason string
+		wantPlain  float64
+		wantGzip   float64
+	}{
+		{
+			name:       "plain",
+			body:       payload,
+			wantStatus: http.StatusOK,
+			wantPlain:  1,
+		},
+		{
+			name:       "gzip",
+			encoding:   "gzip",
+			body:       gzipBody(t, payload),
+			wantStatus: http.StatusOK,
+			wantGzip:   1,
+		},
+		{
+			name:       "x-gzip",
+			encoding:   "X-Gzip",
+			body:       gzipBody(t, payload),
+			wantStatus: http.StatusOK,
+			wantGzip:   1,
+		},
+		{
+			name:       "decompression bomb",
+			encoding:   "gzip",
+			body:       bomb,
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantReason: decodeTooLarge,
+			wantGzip:   1,
+		},
+		{
+			name:       "truncated gzip",
+			encoding:   "gzip",
+			body:       gzipBody(t, payload)[:20],
+			wantStatus: http.StatusBadRequest,
+			wantReason: decodeMalformed,
+			wantGzip:   1,
+		},
+		{
+			name:       "not gzip",
+			encoding:   "gzip",
+			body:       payload,
+			wantStatus: http.StatusBadRequest,
+			wantReason: decodeMalformed,
+			wantGzip:   1,
+		},
+		{
+			name:       "unsupported encoding",
+			encoding:   "br",
+			body:       payload,
+			wantStatus: http.StatusUnsupportedMediaType,
+			wantReason: decodeUnsupported,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := webhooktest.NewRegistry(t)
+			pub := webhooktest.NewPublisher()
+			handler := NewHandler(Config{BuildkiteToken: "test-token", Publisher: pub, MaxDecompressedSize: 64 << 10})
+
+			req := webhooktest.NewTokenRequest("/webhook", "test-token", tt.body)
+			if tt.encoding != "" {
+				req.Header.Set("Content-Encoding", tt.encoding)
+			}
+			rr := webhooktest.Serve(handler, req)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+			webhooktest.AssertCounter(t, reg, "buildkite_webhook_request_encodings_total", map[string]string{"encoding": "identity"}, tt.wantPlain)
+			webhooktest.AssertCounter(t, reg, "buildkite_webhook_request_encodings_total", map[string]string{"encoding": "gzip"}, tt.wantGzip)
+			if tt.wantReason == "" {
+				published := webhooktest.AssertPublished(t, pub, "build.finished")
+				if published.Build.ID != "build-1" {
+					t.Errorf("published build %q, want build-1", published.Build.ID)
+				}
+				return
+			}
+			webhooktest.AssertPublishedCount(t, pub, 0)
+			webhooktest.AssertCounter(t, reg, "buildkite_webhook_decompression_rejections_total", map[string]string{"reason": tt.wantReason}, 1)
+		})
+	}
+}
+
+func TestHandlerGzipSignature(t *testing.T) {
+	webhooktest.NewRegistry(t)
+	payload := webhooktest.Payload("build.finished")
+	pub := webhooktest.NewPublisher()
+	handler := NewHandler(Config{HMACSecret: "secret", Publisher: pub})
+
+	// Signatures cover the JSON the sender encoded, not the compressed bytes
+	req := webhooktest.NewRequest("/webhook", gzipBody(t, payload))
+	req.Header.Set(buildkiteauth.SignatureHeader, webhooktest.SignatureHeader("secret", time.Now(), payload))
+	req.Header.Set("Content-Encoding", "gzip")
+	if rr := webhooktest.Serve(handler, req); rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	webhooktest.AssertPublishedCount(t, pub, 1)
+
+	// The default limit applies when none is configured
+	big := gzipBody(t, []byte(`{"padding":"`+strings.Repeat("a", DefaultMaxDecompressedSize)+`"}`))
+	req = webhooktest.NewSignedRequest("/webhook", "secret", big)
+	req.Header.Set("Content-Encoding", "gzip")
+	if rr := webhooktest.Serve(handler, req); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusRequestEntityTooLarge)
+	}
+}
@@ -5,13 +5,27 @@ import (
 	"context"
 	"encoding/json"
 	"io"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/mcncl/buildkite-pubsub/contracts"
+	"github.com/mcncl/buildkite-pubsub/internal/audit"
 	"github.com/mcncl/buildkite-pubsub/internal/buildkite"
+	"github.com/mcncl/buildkite-pubsub/internal/clock"
+	"github.com/mcncl/buildkite-pubsub/internal/config"
 	"github.com/mcncl/buildkite-pubsub/internal/errors"
+	"github.com/mcncl/buildkite-pubsub/internal/jsoncodec"
+	"github.com/mcncl/buildkite-pubsub/internal/jwtauth"
 	"github.com/mcncl/buildkite-pubsub/internal/metrics"
 	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+	"github.com/mcncl/buildkite-pubsub/internal/quarantine"
+	"github.com/mcncl/buildkite-pubsub/internal/rejections"
+	"github.com/mcncl/buildkite-pubsub/pkg/buildkiteauth"
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"github.com/mcncl/buildkite-pubsub/pkg/transform"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
@@ -35,46 +49,344 @@ type Config struct {
 	// DLQ configuration
 	DLQPublisher publisher.Publisher // Optional: publisher for dead letter queue
 	EnableDLQ    bool                // Whether to enable dead letter queue
+	// DLQRetryMaxAttempts is how many times a DLQ publish is tried; 0 or 1
+	// disables retries
+	DLQRetryMaxAttempts int
+	// DLQFallback optionally keeps DLQ messages that could not be
+	// published, such as a publisher.FilePublisher
+	DLQFallback publisher.Publisher
+	// Retry configuration
+	RetryMaxAttempts int           // Publish attempts per event; 0 or 1 disables retries
+	RetryBackoff     time.Duration // Initial delay between attempts, doubled each retry
+	// EventPolicies override RetryMaxAttempts and EnableDLQ per event type
+	EventPolicies map[string]config.EventPolicy
+	// SchemaDrift optionally reports payload fields that differ from the known schema
+	SchemaDrift *buildkite.SchemaDriftDetector
+	// UnsupportedEvents is one of the config.UnsupportedEvents* actions;
+	// empty publishes the raw payload
+	UnsupportedEvents string
+	// Version is reported in ping responses and the producer_version
+	// attribute
+	Version string
+	// Filter limits which events are published; events not matching it are
+	// acknowledged without publishing. The zero value matches every event.
+	Filter publisher.RouteRule
+	// Audit optionally records the outcome of every publish
+	Audit audit.Store
+	// Rejections optionally samples requests rejected for failing
+	// authentication or validation
+	Rejections *rejections.Sampler
+	// AttributeHooks derive additional message attributes from the
+	// transformed payload
+	AttributeHooks []AttributeHook
+	// AttributeHasher optionally hashes selected attributes, after the
+	// hooks have run, along with the matching build metric labels
+	AttributeHasher *AttributeHasher
+	// Teams optionally names the team owning each pipeline, published as
+	// the team attribute and build metric label
+	Teams TeamResolver
+	// SignatureTolerance is the maximum age of an HMAC signature
+	// timestamp; zero uses buildkiteauth.DefaultTolerance
+	SignatureTolerance time.Duration
+	// SignatureFutureTolerance is how far ahead of the local clock a
+	// signature timestamp may be; zero uses SignatureTolerance
+	SignatureFutureTolerance time.Duration
+	// JWT optionally accepts requests bearing an "Authorization: Bearer"
+	// JWT it verifies, so internal forwarders need not share the Buildkite
+	// token; requests without one are still checked against BuildkiteToken
+	// and HMACSecret
+	JWT *jwtauth.Verifier
+	// DeliveryAttemptHeader names a request header carrying the delivery
+	// attempt number, starting at 1; empty ignores attempts
+	DeliveryAttemptHeader string
+	// ChecksumAlgorithm is the subscriber.Checksum algorithm of the
+	// checksum attribute; empty publishes no checksum
+	ChecksumAlgorithm string
+	// ChecksumRaw checksums the webhook body as received rather than the
+	// message data
+	ChecksumRaw bool
+	// Transitions optionally suppresses build.* events repeating a terminal
+	// state already published for the build
+	Transitions *TransitionTracker
+	// Blocks optionally remembers blocked builds so a build.unblocked event
+	// is published when one runs again
+	Blocks *BlockTracker
+	// JobMessagePipelines are path.Match patterns of the pipeline slugs
+	// whose build.finished events are followed by a build.job message per
+	// job of the build
+	JobMessagePipelines []string
+	// Quarantine optionally keeps payloads that fail to transform
+	Quarantine *quarantine.Dir
+	// QuarantineAcknowledge answers quarantined payloads with 202 so
+	// Buildkite does not retry them; otherwise they fail with 500
+	QuarantineAcknowledge bool
+	// SchemaVersion is passed to transform.WithSchemaVersion; empty
+	// publishes the original format
+	SchemaVersion string
+	// SchemaBaseURL is where the webhook's schemas are served from, such
+	// as https://webhook.example.com; when set, messages of supported
+	// events carry a schema_url attribute naming the JSON Schema of their
+	// version
+	SchemaBaseURL string
+	// StrictMethods rejects HEAD and OPTIONS with 405 like every method
+	// but POST; otherwise HEAD answers uptime checks and OPTIONS lists the
+	// allowed methods
+	StrictMethods bool
+	// ServerTiming adds a Server-Timing header with the duration of each
+	// request phase to responses
+	ServerTiming bool
+	// PingPublisher optionally publishes a message for each ping event,
+	// which is answered with the result so Buildkite's "Test webhook"
+	// exercises publishing; nil answers pings without publishing
+	PingPublisher publisher.Publisher
+	// ShadowPublisher optionally receives each supported event transformed
+	// with ShadowSchemaVersion, alongside the message published to
+	// Publisher, with metrics of the fields where the two diverge
+	ShadowPublisher publisher.Publisher
+	// ShadowSchemaVersion is the transform.WithSchemaVersion of shadow
+	// messages
+	ShadowSchemaVersion string
+	// Confirmations optionally waits, after publishing an event of one of
+	// ConfirmationPipelines, for the primary consumer to confirm it
+	// processed the message before answering Buildkite
+	Confirmations Confirmations
+	// ConfirmationID is the confirm attribute of messages waiting for
+	// confirmation, addressing the confirmation to this replica
+	ConfirmationID string
+	// ConfirmationPipelines are path.Match patterns of the slugs of the
+	// critical pipelines whose messages wait for confirmation
+	ConfirmationPipelines []string
+	// PartialPayloads publishes events whose optional sections are
+	// malformed without those sections instead of rejecting them; see
+	// transform.DecodePartial
+	PartialPayloads bool
+	// LegacyPipelineAttribute publishes the pipeline's display name as the
+	// pipeline attribute instead of its normalized slug
+	LegacyPipelineAttribute bool
+	// MaxDecompressedSize caps a gzip-encoded body once decompressed; zero
+	// uses DefaultMaxDecompressedSize
+	MaxDecompressedSize int
+	// BatchMaxItems caps the payloads ServeBatch accepts in one request;
+	// zero uses DefaultBatchMaxItems
+	BatchMaxItems int
+	// Clock checks signature timestamps and times retry backoff; nil uses
+	// the system clock
+	Clock clock.Clock
 }
 
 // Handler handles incoming Buildkite webhooks
 type Handler struct {
-	validator    *buildkite.Validator
-	publisher    publisher.Publisher
-	dlqPublisher publisher.Publisher
-	enableDLQ    bool
+	validator           *buildkite.Validator
+	jwt                 *jwtauth.Verifier
+	publisher           publisher.Publisher
+	dlqPublisher        publisher.Publisher
+	dlqAttempts         int
+	dlqFallback         publisher.Publisher
+	enableDLQ           bool
+	retryMaxAttempts    int
+	retryBackoff        time.Duration
+	eventPolicies       map[string]config.EventPolicy
+	schemaDrift         *buildkite.SchemaDriftDetector
+	unsupported         string
+	version             string
+	filter              publisher.RouteRule
+	audit               audit.Store
+	rejections          *rejections.Sampler
+	attributeHooks      []AttributeHook
+	hasher              *AttributeHasher
+	shadowPublisher     publisher.Publisher
+	shadowSchemaVersion string
+	confirmations       Confirmations
+	confirmationID      string
+	critical            []string
+	teams               TeamResolver
+	strictMethods       bool
+	attemptHeader       string
+	checksum            string
+	checksumRaw         bool
+	schemaVersion       string
+	schemaBaseURL       string
+	transitions         *TransitionTracker
+	blocks              *BlockTracker
+	// jobMessagePipelines are patterns of pipelines publishing build.job
+	jobMessagePipelines []string
+	quarantine          *quarantine.Dir
+	quarantineAck       bool
+	serverTiming        bool
+	pingPublisher       publisher.Publisher
+	partialPayloads     bool
+	legacyPipeline      bool
+	maxDecompressed     int
+	batchMaxItems       int
+	clock               clock.Clock
+	// transform is buildkite.Transform, replaced in tests
+	transform func(buildkite.Payload, ...transform.Option) (buildkite.TransformedPayload, error)
 }
 
+const (
+	defaultRetryBackoff = 100 * time.Millisecond
+	maxRetryBackoff     = 2 * time.Second
+	// dlqRetryBackoff is the first delay between DLQ publish attempts,
+	// doubled each retry
+	dlqRetryBackoff = 100 * time.Millisecond
+	// dlqTimeout bounds all DLQ publish attempts, so a dead Pub/Sub
+	// doesn't hold the response
+	dlqTimeout = 5 * time.Second
+)
+
+// Outcomes of sending a failed event to the DLQ, used as metric labels
+const (
+	dlqSuccess  = "dlq_success"
+	dlqFailed   = "dlq_failed"
+	dlqFallback = "dlq_fallback"
+)
+
+// Final outcomes of publishing an event, used as metric labels
+const (
+	outcomeSuccess           = "success"
+	outcomeSuccessAfterRetry = "success_after_retry"
+	outcomeExhausted         = "exhausted"
+	outcomeNonRetryable      = "non_retryable"
+	outcomeCancelled         = "cancelled"
+	outcomeCircuitOpen       = "circuit_open"
+)
+
+// Response headers set when a publish succeeded only after retries, with the
+// number of attempts and the milliseconds from the first failure to the
+// success
+const (
+	PublishAttemptsHeader = "X-Buildkite-Pubsub-Publish-Attempts"
+	RetryLatencyHeader    = "X-Buildkite-Pubsub-Retry-Latency-Ms"
+)
+
+// PublishTimeHeader is the response header carrying the publish time of a
+// published event, in RFC 3339 format
+const PublishTimeHeader = "X-Buildkite-Pubsub-Publish-Time"
+
 // NewHandler creates a new webhook handler
 func NewHandler(cfg Config) *Handler {
+	clk := clock.OrReal(cfg.Clock)
 	var validator *buildkite.Validator
 	if cfg.HMACSecret != "" {
-		validator = buildkite.NewValidatorWithHMAC(cfg.BuildkiteToken, cfg.HMACSecret)
+		validator = buildkite.NewValidatorWithOptions(cfg.BuildkiteToken, cfg.HMACSecret, buildkiteauth.VerifyOptions{
+			Tolerance:       cfg.SignatureTolerance,
+			FutureTolerance: cfg.SignatureFutureTolerance,
+			Now:             clk.Now,
+		})
 	} else {
 		validator = buildkite.NewValidator(cfg.BuildkiteToken)
 	}
 
+	maxDecompressed := cfg.MaxDecompressedSize
+	if maxDecompressed <= 0 {
+		maxDecompressed = DefaultMaxDecompressedSize
+	}
+
+	batchMaxItems := cfg.BatchMaxItems
+	if batchMaxItems <= 0 {
+		batchMaxItems = DefaultBatchMaxItems
+	}
+
+	retryBackoff := cfg.RetryBackoff
+	if retryBackoff <= 0 {
+		retryBackoff = defaultRetryBackoff
+	}
+
 	return &Handler{
-		validator:    validator,
-		publisher:    cfg.Publisher,
-		dlqPublisher: cfg.DLQPublisher,
-		enableDLQ:    cfg.EnableDLQ,
+		validator:           validator,
+		jwt:                 cfg.JWT,
+		publisher:           cfg.Publisher,
+		dlqPublisher:        cfg.DLQPublisher,
+		dlqAttempts:         cfg.DLQRetryMaxAttempts,
+		dlqFallback:         cfg.DLQFallback,
+		enableDLQ:           cfg.EnableDLQ,
+		retryMaxAttempts:    cfg.RetryMaxAttempts,
+		retryBackoff:        retryBackoff,
+		eventPolicies:       cfg.EventPolicies,
+		schemaDrift:         cfg.SchemaDrift,
+		unsupported:         cfg.UnsupportedEvents,
+		version:             cfg.Version,
+		filter:              cfg.Filter,
+		audit:               cfg.Audit,
+		rejections:          cfg.Rejections,
+		attributeHooks:      cfg.AttributeHooks,
+		hasher:              cfg.AttributeHasher,
+		shadowPublisher:     cfg.ShadowPublisher,
+		shadowSchemaVersion: cfg.ShadowSchemaVersion,
+		confirmations:       cfg.Confirmations,
+		confirmationID:      cfg.ConfirmationID,
+		critical:            cfg.ConfirmationPipelines,
+		teams:               cfg.Teams,
+		strictMethods:       cfg.StrictMethods,
+		attemptHeader:       cfg.DeliveryAttemptHeader,
+		checksum:            cfg.ChecksumAlgorithm,
+		checksumRaw:         cfg.ChecksumRaw,
+		schemaVersion:       cfg.SchemaVersion,
+		schemaBaseURL:       strings.TrimSuffix(cfg.SchemaBaseURL, "/"),
+		transitions:         cfg.Transitions,
+		blocks:              cfg.Blocks,
+		jobMessagePipelines: cfg.JobMessagePipelines,
+		quarantine:          cfg.Quarantine,
+		quarantineAck:       cfg.QuarantineAcknowledge,
+		serverTiming:        cfg.ServerTiming,
+		pingPublisher:       cfg.PingPublisher,
+		partialPayloads:     cfg.PartialPayloads,
+		legacyPipeline:      cfg.LegacyPipelineAttribute,
+		maxDecompressed:     maxDecompressed,
+		batchMaxItems:       batchMaxItems,
+		clock:               clk,
+		transform:           buildkite.Transform,
 	}
 }
 
+// allowedMethods is sent in the Allow header
+const (
+	allowedMethods       = "POST, HEAD, OPTIONS"
+	allowedMethodsStrict = "POST"
+)
+
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Answer uptime checks and method discovery without counting them as
+	// webhook requests
+	if !h.strictMethods {
+		switch r.Method {
+		case http.MethodHead:
+			w.Header().Set("Allow", allowedMethods)
+			w.WriteHeader(http.StatusOK)
+			return
+		case http.MethodOptions:
+			w.Header().Set("Allow", allowedMethods)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
 	start := time.Now()
 	eventType := "unknown"
 
-	// Track the request in metrics
+	// Correlate with Buildkite's delivery and any inbound W3C trace context
+	delivery := deliveryFromRequest(r, h.attemptHeader)
+	ctx := withInboundTraceContext(r.Context(), r)
+	trace.SpanFromContext(ctx).SetAttributes(delivery.spanAttributes()...)
+
+	// Track the request in metrics by the status it was answered with, and
+	// the time spent in each phase
+	timer := newPhaseTimer(start)
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	if h.serverTiming {
+		sw.timing = timer
+	}
+	w = sw
 	defer func() {
+		timer.mark(phaseRespond)
+		timer.observe()
+		metrics.WebhookRequestsTotal.WithLabelValues(strconv.Itoa(sw.status), eventType, delivery.modeLabel()).Inc()
 		metrics.WebhookRequestDuration.WithLabelValues(eventType).Observe(time.Since(start).Seconds())
 	}()
 
 	if r.Method != http.MethodPost {
 		// Special case for method not allowed - use specific HTTP status code
 		metrics.ErrorsTotal.WithLabelValues("method_not_allowed").Inc()
-		metrics.WebhookRequestsTotal.WithLabelValues("405", eventType).Inc()
 
 		response := ErrorResponse{
 			Status:    "error",
@@ -86,21 +398,37 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			},
 		}
 
+		if h.strictMethods {
+			w.Header().Set("Allow", allowedMethodsStrict)
+		} else {
+			w.Header().Set("Allow", allowedMethods)
+		}
+		h.recordRejection(ctx, r, "method_not_allowed", http.StatusMethodNotAllowed)
 		h.sendJSONResponse(w, http.StatusMethodNotAllowed, response)
 		return
 	}
 
+	// Decompress the body before anything reads it
+	if decodeErr := h.decodeBody(r); decodeErr != nil {
+		h.rejectBody(ctx, w, r, decodeErr)
+		return
+	}
+
 	// Validate token first
-	if !h.validator.ValidateToken(r) {
-		err := errors.NewAuthError("invalid token")
-		metrics.AuthFailures.Inc()
-		metrics.ErrorsTotal.WithLabelValues("auth_failure").Inc()
-		h.handleError(w, r, err, eventType)
+	err := h.authenticate(r)
+	timer.mark(phaseAuth)
+	if err != nil {
+		h.rejectUnauthenticated(ctx, w, r, err, eventType)
+		return
+	}
+	if !subscriber.IsDeliveryMode(delivery.mode) {
+		h.rejectDeliveryMode(ctx, w, r, eventType)
 		return
 	}
 
 	// Read and measure the body
 	body, err := io.ReadAll(r.Body)
+	timer.mark(phaseRead)
 	if err != nil {
 		err = errors.Wrap(err, "failed to read request body")
 		metrics.ErrorsTotal.WithLabelValues("body_read_error").Inc()
@@ -109,62 +437,200 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	r.Body = io.NopCloser(bytes.NewBuffer(body))
 
-	// Record initial message size
-	metrics.RecordMessageSize("raw", len(body))
+	eventType = h.serveEvent(ctx, w, r, body, delivery, timer, start)
+}
+
+// serveEvent parses, transforms and publishes an authenticated event body
+// received at start, answering on w, and returns its event type
+func (h *Handler) serveEvent(ctx context.Context, w http.ResponseWriter, r *http.Request, body []byte, delivery delivery, timer *phaseTimer, start time.Time) (eventType string) {
+	eventType = "unknown"
 
 	// Start payload processing timer
 	processStart := time.Now()
 
 	// Parse payload
 	var payload buildkite.Payload
-	if err := json.Unmarshal(body, &payload); err != nil {
+	var err error
+	var warnings []transform.SectionWarning
+	if h.partialPayloads {
+		payload, warnings, err = buildkite.DecodePartial(body)
+	} else {
+		err = jsoncodec.Unmarshal(body, &payload)
+	}
+	timer.mark(phaseParse)
+	if err != nil {
 		metrics.ErrorsTotal.WithLabelValues("json_decode_error").Inc()
+		h.recordRejection(ctx, r, "json_decode_error", http.StatusBadRequest)
 		h.handleError(w, r, errors.NewValidationError("failed to decode payload"), eventType)
 		return
 	}
+	// Sections left out of a partial payload, reported to consumers
+	var warnedSections []string
+	for _, warning := range warnings {
+		metrics.TransformWarningsTotal.WithLabelValues(warning.Section).Inc()
+		warnedSections = append(warnedSections, warning.Section)
+	}
 
 	eventType = payload.Event
+	if delivery.redelivery() {
+		metrics.RedeliveriesTotal.WithLabelValues(eventType).Inc()
+	}
 
 	// Record payload processing duration
 	metrics.PayloadProcessingDuration.WithLabelValues(eventType).Observe(time.Since(processStart).Seconds())
 
 	// Handle ping event specially
 	if eventType == "ping" {
-		metrics.WebhookRequestsTotal.WithLabelValues("200", eventType).Inc()
-		h.sendJSONResponse(w, http.StatusOK, map[string]string{
+		response := map[string]string{
 			"status":  "success",
 			"message": "Pong! Webhook received successfully",
-		})
+			"service": "buildkite-pubsub",
+			"version": h.version,
+		}
+		// A self-test ping is published so its sender can watch for it
+		if id := r.Header.Get(SelftestHeader); id != "" {
+			msgID, err := h.publishSelftest(ctx, id)
+			timer.mark(phasePublish)
+			if err != nil {
+				h.handleError(w, r, errors.NewPublishError("failed to publish selftest event", err), eventType)
+				return
+			}
+			response["message_id"] = msgID
+		} else if h.pingPublisher != nil {
+			msgID, elapsed, err := h.publishPing(ctx, delivery)
+			timer.mark(phasePublish)
+			if err != nil {
+				h.handleError(w, r, errors.NewPublishError("ping check failed to publish", err), eventType)
+				return
+			}
+			response["message"] = "Pong! Webhook received and published successfully"
+			response["message_id"] = msgID
+			response["publish_ms"] = strconv.FormatInt(elapsed.Milliseconds(), 10)
+		}
+		h.sendJSONResponse(w, http.StatusOK, response)
 		return
 	}
 
-	// Transform payload
+	supported := buildkite.IsSupportedEvent(eventType)
+	if !supported {
+		metrics.UnsupportedEventsTotal.WithLabelValues(eventType).Inc()
+
+		switch h.unsupported {
+		case config.UnsupportedEventsDrop:
+			h.sendJSONResponse(w, http.StatusOK, map[string]string{
+				"status":     "success",
+				"message":    "Event type not supported, dropped",
+				"event_type": eventType,
+			})
+			return
+		case config.UnsupportedEventsReject:
+			h.recordRejection(ctx, r, "unsupported_event", http.StatusUnprocessableEntity)
+			h.sendJSONResponse(w, http.StatusUnprocessableEntity, ErrorResponse{
+				Status:    "error",
+				Message:   "Event type not supported",
+				ErrorType: "unsupported_event",
+				Details:   map[string]string{"event_type": eventType},
+			})
+			return
+		}
+	}
+
+	// Warn about Buildkite schema changes before they break consumers
+	if h.schemaDrift != nil {
+		h.schemaDrift.Check(eventType, body)
+	}
+
+	// Transform payload; unsupported events are published as received
 	tracer := otel.Tracer("buildkite-webhook")
-	ctx, transformSpan := tracer.Start(r.Context(), "transform_payload",
-		trace.WithAttributes(
-			attribute.String("event_type", eventType),
-			attribute.String("build_id", payload.Build.ID),
-		))
-	transformed, err := buildkite.Transform(payload)
-	transformSpan.End()
+	var transformed buildkite.TransformedPayload
+	var data interface{} = json.RawMessage(body)
+	if supported {
+		var transformSpan trace.Span
+		ctx, transformSpan = tracer.Start(ctx, "transform_payload",
+			trace.WithAttributes(
+				attribute.String("event_type", eventType),
+				attribute.String("build_id", payload.Build.ID),
+			),
+			trace.WithAttributes(delivery.spanAttributes()...))
+		transformed, err = h.transform(payload, h.transformOptions()...)
+		transformSpan.End()
+		timer.mark(phaseTransform)
 
-	if err != nil {
-		transformSpan.RecordError(err)
-		err = errors.Wrap(err, "failed to transform payload")
-		metrics.ErrorsTotal.WithLabelValues("transform_error").Inc()
-		h.handleError(w, r, err, eventType)
+		if err != nil {
+			transformSpan.RecordError(err)
+			err = errors.Wrap(err, "failed to transform payload")
+			metrics.ErrorsTotal.WithLabelValues("transform_error").Inc()
+			if id, ok := h.quarantinePayload(body, eventType, delivery, err); ok && h.quarantineAck {
+				h.sendJSONResponse(w, http.StatusAccepted, map[string]string{
+					"status":        "quarantined",
+					"message":       "Payload failed to transform and was quarantined",
+					"event_type":    eventType,
+					"quarantine_id": id,
+				})
+				return
+			}
+			h.handleError(w, r, err, eventType)
+			return
+		}
+		data = transformed
+	}
+
+	// Acknowledge events this endpoint does not publish so Buildkite does not retry them
+	if !h.filter.Matches(withEventType(transformed, eventType)) {
+		if supported {
+			eventID := delivery.eventKey(body)
+			h.trackUnblock(ctx, eventType, transformed, nil, eventID, start)
+			h.publishJobMessages(ctx, eventType, transformed, body, nil, eventID, start)
+			timer.mark(phasePublish)
+		}
+		metrics.FilteredEventsTotal.WithLabelValues(eventType).Inc()
+		h.sendJSONResponse(w, http.StatusOK, map[string]string{
+			"status":     "success",
+			"message":    "Event filtered, not published",
+			"event_type": eventType,
+		})
 		return
 	}
 
-	// Record build metrics if this is a build event
-	if build := transformed.Build; build.ID != "" {
-		metrics.RecordBuildStatus(build.State, build.Pipeline)
-		metrics.RecordPipelineBuild(build.Pipeline, build.Organization)
+	// Acknowledge repeats of a terminal state without publishing them again
+	undoTransition := func() {}
+	if build := transformed.Build; h.transitions != nil && strings.HasPrefix(eventType, "build.") && build.ID != "" {
+		var duplicate bool
+		duplicate, undoTransition = h.transitions.Observe(build.ID, build.State, build.IsTerminal)
+		if duplicate {
+			metrics.DuplicateTransitions.WithLabelValues(eventType, build.State).Inc()
+			h.sendJSONResponse(w, http.StatusOK, map[string]string{
+				"status":     "success",
+				"message":    "Build already reached this state, not published",
+				"event_type": eventType,
+			})
+			return
+		}
+	}
+
+	var team string
+	if h.teams != nil {
+		team = h.teams.Team(transformed.Build.Pipeline)
+	}
 
-		// Calculate and record queue time for started builds
-		if !build.StartedAt.IsZero() && build.StartedAt.After(build.CreatedAt) {
-			queueTime := build.StartedAt.Sub(build.CreatedAt).Seconds()
-			metrics.RecordQueueTime(build.Pipeline, queueTime)
+	// Record build metrics if this is a build event, delivered live so
+	// replays and tests never count a build twice or one that didn't happen
+	if build := transformed.Build; build.ID != "" && delivery.live() {
+		pipeline, branch, team := h.hasher.Value("pipeline", h.slugLabel(build.Pipeline)), h.hasher.Value("branch", build.Branch), h.hasher.Value("team", team)
+		metrics.RecordBuildStatus(build.State, pipeline, branch, team)
+		metrics.RecordPipelineBuild(pipeline, h.slugLabel(build.Organization))
+
+		// Calculate and record queue time once, when the build starts
+		if eventType == "build.started" && payload.Build.StartedAt != nil {
+			source := payload.Build.Source
+			if source == "" {
+				source = "unknown"
+			}
+			if wait, outlier := queueTime(payload.Build); outlier != "" {
+				metrics.RecordQueueTimeOutlier(outlier, source)
+			} else {
+				metrics.RecordQueueTime(pipeline, branch, team, source, wait.Seconds())
+			}
 		}
 	}
 
@@ -172,28 +638,56 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	pubStart := time.Now()
 
 	// Prepare for publishing
-	transformedJSON, _ := json.Marshal(transformed)
+	transformedJSON, _ := jsoncodec.Marshal(data)
 	metrics.RecordPubsubMessageSize(eventType, len(transformedJSON))
 
 	// Publish to Pub/Sub with retry logic
 	ctx, publishSpan := tracer.Start(ctx, "pubsub_publish",
 		trace.WithAttributes(
 			attribute.String("event_type", eventType),
-			attribute.String("pipeline", transformed.Pipeline.Name),
-		))
+			attribute.String("pipeline", h.hasher.Value("pipeline", h.pipelineAttribute(transformed))),
+		),
+		trace.WithAttributes(delivery.spanAttributes()...))
 	defer publishSpan.End()
 
 	// Build comprehensive attributes for Pub/Sub filtering
-	pubsubAttributes := map[string]string{
-		"origin":      "buildkite-webhook",
-		"event_type":  eventType,
-		"pipeline":    transformed.Pipeline.Name,
-		"build_state": transformed.Build.State,
-		"branch":      transformed.Build.Branch,
+	pubsubAttributes := h.messageAttributes(messageInfo{
+		eventType:   eventType,
+		transformed: transformed,
+		supported:   supported,
+		delivery:    delivery,
+		team:        team,
+		warnings:    warnedSections,
+		data:        transformedJSON,
+		body:        body,
+		receivedAt:  start,
+	})
+	// Carry the trace context so consumers can continue the trace
+	injectTraceContext(ctx, pubsubAttributes)
+
+	// Let a dedupe layer drop redeliveries of an event that was already published
+	eventID := delivery.eventKey(body)
+	ctx = publisher.WithDedupeKey(ctx, eventID)
+	auditRecord := audit.Record{
+		EventID:   eventID,
+		EventType: eventType,
+		BuildID:   transformed.Build.ID,
+		Pipeline:  h.hasher.Value("pipeline", h.slugLabel(transformed.Build.Pipeline)),
 	}
 
-	// Publish to Pub/Sub (SDK handles retries internally)
-	msgID, err := h.publisher.Publish(ctx, transformed, pubsubAttributes)
+	// Publish to Pub/Sub within this event type's retry budget
+	attempts := h.retryAttemptsFor(eventType)
+	publishSpan.SetAttributes(attribute.Int("retry_max_attempts", attempts))
+	if deadline, ok := ctx.Deadline(); ok {
+		publishSpan.SetAttributes(attribute.Int64("deadline_remaining_ms", time.Until(deadline).Milliseconds()))
+	}
+	waitShadow := func() {}
+	if supported {
+		waitShadow = h.publishShadow(ctx, eventType, payload, transformedJSON, body, pubsubAttributes)
+	}
+	result, retries, err := h.publishWithRetry(ctx, data, pubsubAttributes, attempts)
+	waitShadow()
+	timer.mark(phasePublish)
 
 	pubDuration := time.Since(pubStart).Seconds()
 	metrics.PubsubPublishDuration.Observe(pubDuration)
@@ -201,9 +695,25 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		publishSpan.RecordError(err)
 		publishSpan.SetStatus(codes.Error, "publish failed")
+		// Let Buildkite's retry publish the state
+		undoTransition()
+
+		auditRecord.Outcome = audit.OutcomeFailed
+		auditRecord.Error = errors.Format(err)
+
+		// A full queue asks Buildkite to retry later rather than dead-lettering
+		if errors.Is(err, publisher.ErrQueueFull) {
+			metrics.ErrorsTotal.WithLabelValues("queue_full").Inc()
+			h.recordAudit(ctx, auditRecord)
+			h.handleError(w, r, err, eventType)
+			return
+		}
 
 		// Send to DLQ if enabled
-		h.sendToDLQ(ctx, transformed, pubsubAttributes, err)
+		if h.sendToDLQ(ctx, data, pubsubAttributes, err) {
+			auditRecord.Outcome = audit.OutcomeDeadLettered
+		}
+		h.recordAudit(ctx, auditRecord)
 
 		// Classify and handle the publish error
 		publishErr := errors.NewPublishError("failed to publish message", err)
@@ -214,26 +724,100 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Record successful publish
+	msgID := result.MessageID
 	publishSpan.SetAttributes(attribute.String("message_id", msgID))
 	publishSpan.SetStatus(codes.Ok, "published successfully")
-
-	metrics.WebhookRequestsTotal.WithLabelValues("200", eventType).Inc()
-	metrics.PubsubPublishRequestsTotal.WithLabelValues("success", eventType).Inc()
-
-	// Return success response
-	h.sendJSONResponse(w, http.StatusOK, map[string]interface{}{
+	response := map[string]interface{}{
 		"status":     "success",
 		"message":    "Event published successfully",
 		"message_id": msgID,
 		"event_type": eventType,
-	})
+	}
+	if result.Topic != "" {
+		publishSpan.SetAttributes(attribute.String("topic", result.Topic))
+		response["topic"] = result.Topic
+	}
+	if len(warnedSections) > 0 {
+		response["transform_warnings"] = warnedSections
+	}
+	// Tell a publish that limped through retries from a healthy one
+	if retries.attempts > 1 {
+		publishSpan.SetAttributes(
+			attribute.Int("publish_attempts", retries.attempts),
+			attribute.Int64("retry_latency_ms", retries.latency.Milliseconds()))
+		response["publish_attempts"] = retries.attempts
+		response["retry_latency_ms"] = retries.latency.Milliseconds()
+		w.Header().Set(PublishAttemptsHeader, strconv.Itoa(retries.attempts))
+		w.Header().Set(RetryLatencyHeader, strconv.FormatInt(retries.latency.Milliseconds(), 10))
+	}
+	// A deduplicated publish has no publish time
+	if !result.PublishTime.IsZero() {
+		publishTime := result.PublishTime.UTC().Format(time.RFC3339Nano)
+		publishSpan.SetAttributes(attribute.String("publish_time", publishTime))
+		response["publish_time"] = publishTime
+		w.Header().Set(PublishTimeHeader, publishTime)
+	}
+
+	metrics.PubsubPublishRequestsTotal.WithLabelValues("success", eventType).Inc()
+	metrics.ReceiveToPublishDuration.WithLabelValues(eventType).Observe(time.Since(start).Seconds())
+
+	auditRecord.MessageID = msgID
+	auditRecord.Outcome = audit.OutcomePublished
+	h.recordAudit(ctx, auditRecord)
+
+	if supported {
+		h.trackUnblock(ctx, eventType, transformed, pubsubAttributes, eventID, start)
+		h.publishJobMessages(ctx, eventType, transformed, body, pubsubAttributes, eventID, start)
+		timer.mark(phasePublish)
+	}
+
+	// Hold the response until the consumer confirms a critical message
+	if pubsubAttributes[subscriber.ConfirmAttribute] != "" && msgID != "" {
+		h.awaitConfirmation(ctx, response, transformed.Build.Pipeline, result)
+		timer.mark(phaseConfirm)
+	}
+
+	// Return success response
+	h.sendJSONResponse(w, http.StatusOK, response)
+	return
+}
+
+// authenticate checks a bearer JWT when JWT auth is enabled and the request
+// carries one, and the Buildkite token or HMAC signature otherwise
+func (h *Handler) authenticate(r *http.Request) error {
+	if h.jwt != nil {
+		if token, ok := jwtauth.BearerToken(r); ok {
+			subject, _, err := h.jwt.Verify(r.Context(), token)
+			if err != nil {
+				return err
+			}
+			trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("auth.subject", subject))
+			return nil
+		}
+	}
+	return h.validator.Validate(r)
+}
+
+// rejectUnauthenticated answers a request that failed authenticate
+func (h *Handler) rejectUnauthenticated(ctx context.Context, w http.ResponseWriter, r *http.Request, err error, eventType string) {
+	if reason := buildkite.SignatureFailureReason(err); reason != "" {
+		metrics.SignatureFailuresTotal.WithLabelValues(reason).Inc()
+	}
+	metrics.AuthFailures.Inc()
+	metrics.ErrorsTotal.WithLabelValues("auth_failure").Inc()
+	h.recordRejection(ctx, r, "auth_failure", http.StatusUnauthorized)
+	h.handleError(w, r, errors.NewAuthError("invalid token"), eventType)
+}
+
+// rejectDeliveryMode answers a request with an invalid delivery mode header
+func (h *Handler) rejectDeliveryMode(ctx context.Context, w http.ResponseWriter, r *http.Request, eventType string) {
+	metrics.ErrorsTotal.WithLabelValues("invalid_delivery_mode").Inc()
+	h.recordRejection(ctx, r, "invalid_delivery_mode", http.StatusBadRequest)
+	h.handleError(w, r, errors.NewValidationError("invalid "+DeliveryModeHeader+" header"), eventType)
 }
 
 // handleError processes errors and returns appropriate HTTP responses
 func (h *Handler) handleError(w http.ResponseWriter, r *http.Request, err error, eventType string) {
-	// Always record error in metrics
-	metrics.WebhookRequestsTotal.WithLabelValues(h.getStatusCodeForError(err), eventType).Inc()
-
 	var errorType string
 
 	// Create error response based on error type
@@ -257,13 +841,15 @@ func (h *Handler) handleError(w http.ResponseWriter, r *http.Request, err error,
 	case errors.IsRateLimitError(err):
 		errorType = "rate_limit"
 		response.ErrorType = errorType
-		response.RetryAfter = 60 // Suggest retry after 60 seconds
+		response.RetryAfter = retryAfterSeconds(err, 60)
+		w.Header().Set("Retry-After", strconv.Itoa(response.RetryAfter))
 		h.sendJSONResponse(w, http.StatusTooManyRequests, response)
 
 	case errors.IsConnectionError(err):
 		errorType = "connection"
 		response.ErrorType = errorType
-		response.RetryAfter = 30 // Suggest retry after 30 seconds
+		response.RetryAfter = retryAfterSeconds(err, 30)
+		w.Header().Set("Retry-After", strconv.Itoa(response.RetryAfter))
 		h.sendJSONResponse(w, http.StatusServiceUnavailable, response)
 
 	case errors.IsPublishError(err):
@@ -279,22 +865,80 @@ func (h *Handler) handleError(w http.ResponseWriter, r *http.Request, err error,
 	}
 }
 
-// getStatusCodeForError returns an appropriate HTTP status code for an error
-func (h *Handler) getStatusCodeForError(err error) string {
-	switch {
-	case errors.IsAuthError(err):
-		return "401"
-	case errors.IsValidationError(err):
-		return "400"
-	case errors.IsRateLimitError(err):
-		return "429"
-	case errors.IsConnectionError(err):
-		return "503"
-	case errors.IsPublishError(err):
-		return "500"
-	default:
-		return "500"
+// transformOptions returns the options every payload is transformed with
+func (h *Handler) transformOptions() []transform.Option {
+	if h.schemaVersion == "" {
+		return nil
+	}
+	return []transform.Option{transform.WithSchemaVersion(h.schemaVersion)}
+}
+
+// schemaURL returns the schema_url attribute of messages with a schema
+// version, empty when SchemaBaseURL is not configured
+func (h *Handler) schemaURL(version string) string {
+	if h.schemaBaseURL == "" {
+		return ""
+	}
+	return h.schemaBaseURL + contracts.SchemaPath(version)
+}
+
+// addChecksum adds the checksum attribute when configured, covering the
+// message data or, with ChecksumRaw, the webhook body
+func (h *Handler) addChecksum(attributes map[string]string, data, body []byte) {
+	if h.checksum == "" {
+		return
+	}
+	payload, covers := data, subscriber.ChecksumPayloadData
+	if h.checksumRaw {
+		payload, covers = body, subscriber.ChecksumPayloadRaw
+	}
+	checksum, err := subscriber.Checksum(h.checksum, payload)
+	if err != nil {
+		metrics.ErrorsTotal.WithLabelValues("checksum_error").Inc()
+		return
 	}
+	attributes[subscriber.ChecksumAttribute] = checksum
+	attributes[subscriber.ChecksumPayloadAttribute] = covers
+}
+
+// retryAfterSeconds returns the retry delay attached to err, rounded up to
+// whole seconds, or fallback when none is attached
+func retryAfterSeconds(err error, fallback int) int {
+	if delay, ok := errors.RetryAfter(err); ok && delay > 0 {
+		return int(math.Ceil(delay.Seconds()))
+	}
+	return fallback
+}
+
+// statusWriter records the response status for the request metrics and,
+// when timing is set, adds the Server-Timing header
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	timing      *phaseTimer
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+		if w.timing != nil {
+			w.Header().Set("Server-Timing", w.timing.header())
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
 
 // sendJSONResponse sends a JSON response with the given status code
@@ -308,15 +952,239 @@ func (h *Handler) sendJSONResponse(w http.ResponseWriter, statusCode int, data i
 	}
 }
 
-// sendToDLQ sends a failed message to the Dead Letter Queue.
-// This is a best-effort operation - errors are logged but don't affect the main flow.
-func (h *Handler) sendToDLQ(ctx context.Context, data interface{}, originalAttrs map[string]string, failureErr error) {
-	// Skip if DLQ is not enabled or publisher is not configured
-	if !h.enableDLQ || h.dlqPublisher == nil {
+// maxQueueTime is the longest a build can plausibly wait to start. Longer
+// waits come from rebuilds, which keep the created_at of the original build.
+const maxQueueTime = 24 * time.Hour
+
+// queueTime returns how long build waited between being due to run and
+// starting. Builds scheduled for later are due at scheduled_at rather than
+// created_at. outlier names why the wait is implausible, if it is.
+func queueTime(build buildkite.Build) (wait time.Duration, outlier string) {
+	due := build.CreatedAt
+	if build.ScheduledAt != nil && build.ScheduledAt.After(due) {
+		due = *build.ScheduledAt
+	}
+	wait = build.StartedAt.Sub(due)
+	switch {
+	case wait < 0:
+		return wait, "negative"
+	case wait > maxQueueTime:
+		return wait, "too_long"
+	}
+	return wait, ""
+}
+
+// withEventType returns payload with its event type set, so raw unsupported
+// events can still be matched by event type
+func withEventType(payload buildkite.TransformedPayload, eventType string) buildkite.TransformedPayload {
+	payload.EventType = eventType
+	return payload
+}
+
+// addQueueAttributes adds cluster_id, queue_name and agent_tags when known, so
+// autoscalers can filter on queue without parsing message bodies
+func addQueueAttributes(attributes map[string]string, payload buildkite.TransformedPayload) {
+	clusterID := payload.Build.ClusterID
+	if agent := payload.Agent; agent != nil {
+		if agent.ClusterID != "" {
+			clusterID = agent.ClusterID
+		}
+		attributes["queue_name"] = agent.QueueName
+
+		// Keep whole tags only, within the attribute size limit
+		var tags strings.Builder
+		for _, tag := range agent.Tags {
+			if tags.Len()+len(tag)+1 > publisher.MaxAttributeValueBytes {
+				break
+			}
+			if tags.Len() > 0 {
+				tags.WriteByte(',')
+			}
+			tags.WriteString(tag)
+		}
+		if tags.Len() > 0 {
+			attributes["agent_tags"] = tags.String()
+		}
+	}
+	if clusterID != "" {
+		attributes["cluster_id"] = clusterID
+	}
+}
+
+// addStateAttributes adds normalized_state, is_terminal, is_retry and
+// is_blocked for builds in a known state, so consumers needn't map
+// Buildkite's states
+func addStateAttributes(attributes map[string]string, payload buildkite.TransformedPayload) {
+	if payload.Build.NormalizedState == "" {
 		return
 	}
+	attributes["normalized_state"] = payload.Build.NormalizedState
+	attributes["is_terminal"] = strconv.FormatBool(payload.Build.IsTerminal)
+	attributes["is_retry"] = strconv.FormatBool(payload.Build.IsRetry)
+	attributes["is_blocked"] = strconv.FormatBool(payload.Build.IsBlocked)
+}
+
+// quarantinePayload keeps a body that failed to transform, reporting
+// whether it was kept
+func (h *Handler) quarantinePayload(body []byte, eventType string, d delivery, cause error) (string, bool) {
+	if h.quarantine == nil {
+		return "", false
+	}
+	id, err := h.quarantine.Put(body, eventType, d.id, cause)
+	if err != nil {
+		metrics.ErrorsTotal.WithLabelValues("quarantine_error").Inc()
+		return "", false
+	}
+	metrics.QuarantinedPayloadsTotal.WithLabelValues(eventType).Inc()
+	return id, true
+}
+
+// publishRetries describes the retries a successful publish needed
+type publishRetries struct {
+	// attempts is the number of publish attempts, including the first
+	attempts int
+	// latency is the time from the first failed attempt to the success
+	latency time.Duration
+}
+
+// publishWithRetry publishes, retrying failures with exponential backoff
+// until attempts are exhausted, the context ends or the circuit is open.
+//
+// The retries and the circuit breaker count the same failures, so left to
+// themselves each retry of a failure that opened the circuit would wait out
+// its backoff only to be rejected with ErrCircuitOpen. A failure marked
+// with ErrCircuitTripped therefore ends the retries at once, counting the
+// attempts left as avoided, and the event goes to the DLQ straight away.
+func (h *Handler) publishWithRetry(ctx context.Context, data interface{}, attributes map[string]string, attempts int) (publisher.PublishResult, publishRetries, error) {
+	eventType := attributes["event_type"]
+	backoff := h.retryBackoff
+	var waited time.Duration
+	var firstFailure time.Time
+	// Record how many attempts the event took, how it ended and, when it
+	// waited to retry, for how long
+	finish := func(attempt int, outcome string) {
+		metrics.PubsubPublishAttempts.WithLabelValues(eventType).Observe(float64(attempt))
+		metrics.PubsubPublishOutcomesTotal.WithLabelValues(eventType, outcome).Inc()
+		if waited > 0 {
+			metrics.PubsubRetryBackoffDuration.WithLabelValues(eventType).Observe(waited.Seconds())
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		attributes[subscriber.PublishedAtAttribute] = time.Now().UTC().Format(time.RFC3339Nano)
+		result, err := publisher.PublishWithResult(ctx, h.publisher, data, attributes)
+		switch {
+		case err == nil && attempt == 1:
+			finish(attempt, outcomeSuccess)
+			return result, publishRetries{attempts: attempt}, nil
+		case err == nil:
+			finish(attempt, outcomeSuccessAfterRetry)
+			return result, publishRetries{attempts: attempt, latency: h.clock.Since(firstFailure)}, nil
+		case errors.Is(err, publisher.ErrCircuitOpen) || errors.Is(err, publisher.ErrQueueFull):
+			finish(attempt, outcomeNonRetryable)
+			return publisher.PublishResult{}, publishRetries{}, err
+		case !errors.IsRetryable(err):
+			// Rejected messages, missing topics and denied permissions
+			// fail the same way however often they are retried
+			finish(attempt, outcomeNonRetryable)
+			return publisher.PublishResult{}, publishRetries{}, err
+		case attempt >= attempts:
+			finish(attempt, outcomeExhausted)
+			return publisher.PublishResult{}, publishRetries{}, err
+		case errors.Is(err, publisher.ErrCircuitTripped):
+			metrics.PubsubRetriesAvoidedTotal.WithLabelValues(eventType).Add(float64(attempts - attempt))
+			finish(attempt, outcomeCircuitOpen)
+			return publisher.PublishResult{}, publishRetries{}, err
+		}
+		if attempt == 1 {
+			firstFailure = h.clock.Now()
+		}
+
+		// Stop when the request's deadline, which a forwarder may have
+		// shortened, would pass during the backoff, leaving time for the DLQ
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff {
+			finish(attempt, outcomeCancelled)
+			return publisher.PublishResult{}, publishRetries{}, err
+		}
+
+		metrics.PubsubPublishRetriesTotal.WithLabelValues(eventType).Inc()
+		start := h.clock.Now()
+		select {
+		case <-ctx.Done():
+			waited += h.clock.Since(start)
+			finish(attempt, outcomeCancelled)
+			return publisher.PublishResult{}, publishRetries{}, err
+		case <-h.clock.After(backoff):
+		}
+		waited += h.clock.Since(start)
+		backoff = min(backoff*2, maxRetryBackoff)
+	}
+}
+
+// retryAttemptsFor returns the publish attempts allowed for an event type
+func (h *Handler) retryAttemptsFor(eventType string) int {
+	attempts := h.retryMaxAttempts
+	if policy, ok := h.eventPolicies[eventType]; ok && policy.RetryMaxAttempts > 0 {
+		attempts = policy.RetryMaxAttempts
+	}
+	return max(attempts, 1)
+}
+
+// expiresAt returns when an event of this type received at receivedAt
+// expires, or false when its type has no TTL
+func (h *Handler) expiresAt(eventType string, receivedAt time.Time) (string, bool) {
+	policy, ok := h.eventPolicies[eventType]
+	if !ok || policy.TTLSeconds <= 0 {
+		return "", false
+	}
+	expiresAt := receivedAt.Add(time.Duration(policy.TTLSeconds) * time.Second)
+	return expiresAt.UTC().Format(time.RFC3339Nano), true
+}
 
+// pipelineAttribute returns the pipeline attribute of a message: the
+// normalized pipeline slug, falling back to the normalized display name,
+// or the display name itself for consumers of the legacy attribute
+func (h *Handler) pipelineAttribute(payload buildkite.TransformedPayload) string {
+	if h.legacyPipeline {
+		return payload.Pipeline.Name
+	}
+	if payload.Build.Pipeline != "" {
+		return subscriber.Slug(payload.Build.Pipeline)
+	}
+	return subscriber.Slug(payload.Pipeline.Name)
+}
+
+// slugLabel normalizes a pipeline or organization slug for metric labels
+// and audit records, so they match the attributes; with the legacy pipeline
+// attribute it is kept as Buildkite sent it
+func (h *Handler) slugLabel(slug string) string {
+	if h.legacyPipeline {
+		return slug
+	}
+	return subscriber.Slug(slug)
+}
+
+// dlqEnabledFor reports whether failed events of this type go to the DLQ
+func (h *Handler) dlqEnabledFor(eventType string) bool {
+	if policy, ok := h.eventPolicies[eventType]; ok && policy.EnableDLQ != nil {
+		return *policy.EnableDLQ
+	}
+	return h.enableDLQ
+}
+
+// sendToDLQ sends a failed message to the Dead Letter Queue, retrying a
+// few times and then keeping it with the fallback, if there is one, since
+// an outage failing the event usually fails the DLQ too. This is a
+// best-effort operation - errors are counted but don't affect the main flow.
+// It reports whether the message was dead-lettered or kept.
+func (h *Handler) sendToDLQ(ctx context.Context, data interface{}, originalAttrs map[string]string, failureErr error) bool {
 	eventType := originalAttrs["event_type"]
+
+	// Skip if DLQ is not enabled for this event type or publisher is not configured
+	if !h.dlqEnabledFor(eventType) || h.dlqPublisher == nil {
+		return false
+	}
+
 	failureReason := classifyFailureReason(failureErr)
 
 	// Create DLQ message with enriched attributes
@@ -341,20 +1209,72 @@ func (h *Handler) sendToDLQ(ctx context.Context, data interface{}, originalAttrs
 		},
 	}
 
-	// Use a short timeout for DLQ publish to avoid blocking
-	dlqCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	if err := h.publishDLQ(ctx, dlqMessage, dlqAttributes); err == nil {
+		metrics.RecordDLQMessage(eventType, failureReason)
+		metrics.DLQPublishOutcomesTotal.WithLabelValues(eventType, dlqSuccess).Inc()
+		return true
+	}
+	metrics.ErrorsTotal.WithLabelValues("dlq_publish_error").Inc()
+
+	// Keep the message locally, even if the request has ended meanwhile
+	if h.dlqFallback != nil {
+		if _, err := h.dlqFallback.Publish(context.WithoutCancel(ctx), dlqMessage, dlqAttributes); err == nil {
+			metrics.DLQPublishOutcomesTotal.WithLabelValues(eventType, dlqFallback).Inc()
+			return true
+		}
+		metrics.ErrorsTotal.WithLabelValues("dlq_fallback_error").Inc()
+	}
+	metrics.DLQPublishOutcomesTotal.WithLabelValues(eventType, dlqFailed).Inc()
+	return false
+}
+
+// publishDLQ publishes to the DLQ, retrying failures with a short
+// exponential backoff until its attempts or dlqTimeout run out. Failures no
+// retry can fix are returned at once, leaving the fallback to keep the message.
+func (h *Handler) publishDLQ(ctx context.Context, data interface{}, attributes map[string]string) error {
+	ctx, cancel := context.WithTimeout(ctx, dlqTimeout)
 	defer cancel()
 
-	// Attempt to publish to DLQ (best effort)
-	_, err := h.dlqPublisher.Publish(dlqCtx, dlqMessage, dlqAttributes)
-	if err != nil {
-		// Log the DLQ failure but don't propagate - this is best effort
-		metrics.ErrorsTotal.WithLabelValues("dlq_publish_error").Inc()
+	attempts := max(h.dlqAttempts, 1)
+	backoff := dlqRetryBackoff
+	for attempt := 1; ; attempt++ {
+		_, err := h.dlqPublisher.Publish(ctx, data, attributes)
+		if err == nil || attempt >= attempts || !errors.IsRetryable(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-h.clock.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// recordAudit stores a publish outcome when an audit store is configured.
+// Failures are counted but never fail the webhook. A record dropped from a
+// full audit.Writer queue is already counted as dropped.
+func (h *Handler) recordAudit(ctx context.Context, record audit.Record) {
+	if h.audit == nil {
 		return
 	}
+	record.PublishedAt = time.Now()
 
-	// Record successful DLQ message
-	metrics.RecordDLQMessage(eventType, failureReason)
+	// Record the outcome even if the request has been cancelled
+	auditCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second)
+	defer cancel()
+	if err := h.audit.Record(auditCtx, record); err != nil && !errors.Is(err, audit.ErrQueueFull) {
+		metrics.ErrorsTotal.WithLabelValues("audit_write_error").Inc()
+	}
+}
+
+// recordRejection samples a request rejected for reason when rejection
+// sampling is configured
+func (h *Handler) recordRejection(ctx context.Context, r *http.Request, reason string, status int) {
+	if h.rejections == nil {
+		return
+	}
+	h.rejections.Record(ctx, r, reason, status)
 }
 
 // classifyFailureReason returns a short description of why the message failed
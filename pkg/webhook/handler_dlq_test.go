@@ -1,13 +1,20 @@
 package webhook
 
 import (
+	"bytes"
 	"context"
+	"net/http"
+	"net/http/httptest"
 	"sync"
 	"testing"
 
+	"github.com/mcncl/buildkite-pubsub/internal/audit"
+	"github.com/mcncl/buildkite-pubsub/internal/buildkite"
 	"github.com/mcncl/buildkite-pubsub/internal/errors"
 	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 // MockDLQPublisher tracks messages sent to the DLQ
@@ -214,3 +221,149 @@ func TestSendToDLQ_PublishError(t *testing.T) {
 	// Should not panic even when DLQ publish fails
 	handler.sendToDLQ(ctx, testData, attrs, testErr)
 }
+
+// flakyDLQPublisher fails its first publishes
+type flakyDLQPublisher struct {
+	MockDLQPublisher
+	failures int
+	// err is the failure returned; nil returns a connection error
+	err   error
+	calls int
+}
+
+func (f *flakyDLQPublisher) Publish(ctx context.Context, data interface{}, attributes map[string]string) (string, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		if f.err != nil {
+			return "", f.err
+		}
+		return "", errors.NewConnectionError("DLQ unavailable")
+	}
+	return f.MockDLQPublisher.Publish(ctx, data, attributes)
+}
+
+func TestSendToDLQResilience(t *testing.T) {
+	attrs := map[string]string{"event_type": "build.started"}
+	testErr := errors.NewConnectionError("original failure")
+
+	tests := []struct {
+		name        string
+		failures    int
+		err         error
+		fallback    bool
+		wantOutcome string
+		wantKept    bool
+		wantCalls   int
+	}{
+		{name: "succeeds after retries", failures: 2, wantOutcome: dlqSuccess, wantKept: true, wantCalls: 3},
+		{name: "falls back when retries run out", failures: 3, fallback: true, wantOutcome: dlqFallback, wantKept: true, wantCalls: 3},
+		{name: "fails without a fallback", failures: 3, wantOutcome: dlqFailed, wantCalls: 3},
+		{name: "falls back at once when retries cannot help", failures: 3, err: errors.NewAuthError("permission denied"), fallback: true, wantOutcome: dlqFallback, wantKept: true, wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+				t.Fatalf("failed to initialize metrics: %v", err)
+			}
+			dlqPub := &flakyDLQPublisher{failures: tt.failures, err: tt.err}
+			cfg := Config{
+				BuildkiteToken:      "test-token",
+				Publisher:           publisher.NewMockPublisher(),
+				DLQPublisher:        dlqPub,
+				EnableDLQ:           true,
+				DLQRetryMaxAttempts: 3,
+			}
+			fallback := NewMockDLQPublisher()
+			if tt.fallback {
+				cfg.DLQFallback = fallback
+			}
+			handler := NewHandler(cfg)
+
+			if kept := handler.sendToDLQ(context.Background(), map[string]string{"test": "data"}, attrs, testErr); kept != tt.wantKept {
+				t.Errorf("sendToDLQ() = %v, want %v", kept, tt.wantKept)
+			}
+			if dlqPub.calls != tt.wantCalls {
+				t.Errorf("DLQ publish calls = %d, want %d", dlqPub.calls, tt.wantCalls)
+			}
+			if tt.fallback && (fallback.MessageCount() != 1 || fallback.LastMessage().attributes["dlq_reason"] != "connection_error") {
+				t.Errorf("fallback kept %d messages, want the DLQ message", fallback.MessageCount())
+			}
+			if got := testutil.ToFloat64(metrics.DLQPublishOutcomesTotal.WithLabelValues("build.started", tt.wantOutcome)); got != 1 {
+				t.Errorf("%s outcomes = %v, want 1", tt.wantOutcome, got)
+			}
+		})
+	}
+}
+
+// memoryAuditStore collects audit records in memory
+type memoryAuditStore struct {
+	mu      sync.Mutex
+	records []audit.Record
+}
+
+func (m *memoryAuditStore) Record(ctx context.Context, record audit.Record) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.records = append(m.records, record)
+	return nil
+}
+
+func (m *memoryAuditStore) Query(ctx context.Context, query audit.Query) ([]audit.Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]audit.Record(nil), m.records...), nil
+}
+
+func TestHandlerRecordsAudit(t *testing.T) {
+	const payload = `{"event":"build.finished","build":{"id":"build-1","state":"passed"},"pipeline":{"slug":"deploy"}}`
+
+	tests := []struct {
+		name        string
+		response    publisher.MockResponse
+		wantOutcome string
+		wantMsgID   string
+	}{
+		{name: "published", response: publisher.MockResponse{MessageID: "msg-id"}, wantOutcome: audit.OutcomePublished, wantMsgID: "msg-id"},
+		{name: "dead lettered", response: publisher.MockResponse{Err: errors.NewPublishError("publish failed", nil)}, wantOutcome: audit.OutcomeDeadLettered},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+				t.Fatalf("failed to initialize metrics: %v", err)
+			}
+
+			pub := publisher.NewMockPublisher().(*publisher.MockPublisher)
+			pub.Script(1, tt.response)
+
+			store := &memoryAuditStore{}
+			handler := NewHandler(Config{
+				BuildkiteToken: "test-token",
+				Publisher:      pub,
+				DLQPublisher:   NewMockDLQPublisher(),
+				EnableDLQ:      true,
+				Audit:          store,
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewBufferString(payload))
+			req.Header.Set("X-Buildkite-Token", "test-token")
+			req.Header.Set(buildkite.DeliveryIDHeader, "delivery-1")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			records, _ := store.Query(context.Background(), audit.Query{})
+			if len(records) != 1 {
+				t.Fatalf("audit records = %d, want 1", len(records))
+			}
+			got := records[0]
+			if got.EventID != "delivery-1" || got.BuildID != "build-1" || got.Pipeline != "deploy" || got.EventType != "build.finished" {
+				t.Errorf("record = %+v, want delivery-1 for build-1 on deploy", got)
+			}
+			if got.Outcome != tt.wantOutcome || got.MessageID != tt.wantMsgID {
+				t.Errorf("outcome = %q message_id = %q, want %q %q", got.Outcome, got.MessageID, tt.wantOutcome, tt.wantMsgID)
+			}
+			if got.PublishedAt.IsZero() {
+				t.Error("published_at not set")
+			}
+		})
+	}
+}
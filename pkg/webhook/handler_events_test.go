@@ -0,0 +1,192 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/internal/buildkite"
+	"github.com/mcncl/buildkite-pubsub/internal/config"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook/webhooktest"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestHandlerUnsupportedEvents(t *testing.T) {
+	const payload = `{"event":"cluster_token.registration_blocked","cluster_token":{"id":"abc"}}`
+
+	tests := []struct {
+		name        string
+		action      string
+		wantStatus  int
+		wantPublish bool
+	}{
+		{name: "default publishes raw payload", action: "", wantStatus: http.StatusOK, wantPublish: true},
+		{name: "publish", action: config.UnsupportedEventsPublish, wantStatus: http.StatusOK, wantPublish: true},
+		{name: "drop", action: config.UnsupportedEventsDrop, wantStatus: http.StatusOK},
+		{name: "reject", action: config.UnsupportedEventsReject, wantStatus: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+				t.Fatalf("failed to initialize metrics: %v", err)
+			}
+
+			pub := publisher.NewMockPublisher().(*publisher.MockPublisher)
+			handler := NewHandler(Config{
+				BuildkiteToken:    "test-token",
+				Publisher:         pub,
+				UnsupportedEvents: tt.action,
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewBufferString(payload))
+			req.Header.Set("X-Buildkite-Token", "test-token")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+
+			var m dto.Metric
+			if err := metrics.UnsupportedEventsTotal.WithLabelValues("cluster_token.registration_blocked").Write(&m); err != nil {
+				t.Fatalf("failed to read counter: %v", err)
+			}
+			if got := m.GetCounter().GetValue(); got != 1 {
+				t.Errorf("unsupported events = %v, want 1", got)
+			}
+
+			published := pub.GetPublished()
+			if !tt.wantPublish {
+				if len(published) != 0 {
+					t.Errorf("published %d messages, want none", len(published))
+				}
+				return
+			}
+			if len(published) != 1 {
+				t.Fatalf("published %d messages, want 1", len(published))
+			}
+			raw, ok := published[0].Data.(json.RawMessage)
+			if !ok || string(raw) != payload {
+				t.Errorf("published data = %v, want the raw payload", published[0].Data)
+			}
+			if got := published[0].Attributes["payload_format"]; got != "raw" {
+				t.Errorf("payload_format = %q, want raw", got)
+			}
+		})
+	}
+}
+
+func TestHandlerPingReportsVersion(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	handler := NewHandler(Config{
+		BuildkiteToken: "test-token",
+		Publisher:      publisher.NewMockPublisher(),
+		Version:        "v1.2.3",
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewBufferString(`{"event":"ping"}`))
+	req.Header.Set("X-Buildkite-Token", "test-token")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var resp map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp["version"] != "v1.2.3" {
+		t.Errorf("version = %q, want v1.2.3", resp["version"])
+	}
+}
+
+func TestHandlerProducerVersion(t *testing.T) {
+	webhooktest.NewRegistry(t)
+	pub := webhooktest.NewPublisher()
+	handler := NewHandler(Config{BuildkiteToken: "test-token", Publisher: pub, Version: "v1.2.3"})
+
+	rr := webhooktest.Serve(handler, webhooktest.NewTokenRequest("/webhook", "test-token", webhooktest.Payload("build.finished")))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rr.Code, rr.Body)
+	}
+	webhooktest.AssertAttributes(t, pub, map[string]string{subscriber.ProducerVersionAttribute: "v1.2.3"})
+}
+
+func TestHandlerSchemaURL(t *testing.T) {
+	webhooktest.NewRegistry(t)
+	events, shadow := webhooktest.NewPublisher(), webhooktest.NewPublisher()
+	handler := NewHandler(Config{
+		BuildkiteToken:      "test-token",
+		Publisher:           events,
+		SchemaVersion:       "1",
+		SchemaBaseURL:       "https://webhook.example.com/",
+		ShadowPublisher:     shadow,
+		ShadowSchemaVersion: "2",
+	})
+
+	rr := webhooktest.Serve(handler, webhooktest.NewTokenRequest("/webhook", "test-token", webhooktest.Payload("build.finished")))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rr.Code, rr.Body)
+	}
+	webhooktest.AssertAttributes(t, events, map[string]string{subscriber.SchemaURLAttribute: "https://webhook.example.com/schemas/1.json"})
+	webhooktest.AssertAttributes(t, shadow, map[string]string{subscriber.SchemaURLAttribute: "https://webhook.example.com/schemas/2.json"})
+
+	// Unsupported events are published as received, so match no schema
+	rr = webhooktest.Serve(handler, webhooktest.NewTokenRequest("/webhook", "test-token", []byte(`{"event":"cluster.updated"}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unsupported event status = %d: %s", rr.Code, rr.Body)
+	}
+	if url, ok := events.LastPublished().Attributes[subscriber.SchemaURLAttribute]; ok {
+		t.Errorf("unsupported event schema_url = %q, want none", url)
+	}
+}
+
+func TestHandlerFilter(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	pub := publisher.NewTypedMockPublisher[buildkite.TransformedPayload]()
+	handler := NewHandler(Config{
+		BuildkiteToken: "test-token",
+		Publisher:      pub,
+		Filter:         publisher.RouteRule{EventType: "agent.*"},
+	})
+
+	for _, payload := range []string{
+		`{"event":"build.finished","build":{"id":"123","state":"passed"},"pipeline":{"slug":"test"}}`,
+		`{"event":"agent.connected","agent":{"id":"a1","connection_state":"connected"}}`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/webhook/agents", bytes.NewBufferString(payload))
+		req.Header.Set("X-Buildkite-Token", "test-token")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+		}
+	}
+
+	published := pub.Published()
+	if len(published) != 1 || published[0].Value.Agent == nil || published[0].Value.Agent.ID != "a1" {
+		t.Errorf("published = %+v, want only the agent event", published)
+	}
+
+	var m dto.Metric
+	if err := metrics.FilteredEventsTotal.WithLabelValues("build.finished").Write(&m); err != nil {
+		t.Fatalf("failed to read counter: %v", err)
+	}
+	if got := m.GetCounter().GetValue(); got != 1 {
+		t.Errorf("filtered events = %v, want 1", got)
+	}
+}
@@ -0,0 +1,343 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/clock"
+	"github.com/mcncl/buildkite-pubsub/internal/config"
+	"github.com/mcncl/buildkite-pubsub/internal/errors"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestHandlerRetryPolicies(t *testing.T) {
+	policies := map[string]config.EventPolicy{
+		"build.finished":  {RetryMaxAttempts: 4, EnableDLQ: boolPtr(true)},
+		"agent.connected": {RetryMaxAttempts: 1, EnableDLQ: boolPtr(false)},
+	}
+
+	tests := []struct {
+		name        string
+		eventType   string
+		failures    int
+		err         error
+		wantStatus  int
+		wantCalls   int
+		wantDLQ     int
+		wantOutcome string
+	}{
+		{
+			name:        "publishes first time",
+			eventType:   "build.finished",
+			wantStatus:  http.StatusOK,
+			wantCalls:   1,
+			wantOutcome: outcomeSuccess,
+		},
+		{
+			name:        "retries until publish succeeds",
+			eventType:   "build.finished",
+			failures:    2,
+			err:         errors.NewConnectionError("unavailable"),
+			wantStatus:  http.StatusOK,
+			wantCalls:   3,
+			wantOutcome: outcomeSuccessAfterRetry,
+		},
+		{
+			name:        "per-event budget exhausted goes to DLQ",
+			eventType:   "build.finished",
+			failures:    10,
+			err:         errors.NewConnectionError("unavailable"),
+			wantStatus:  http.StatusInternalServerError,
+			wantCalls:   4,
+			wantDLQ:     1,
+			wantOutcome: outcomeExhausted,
+		},
+		{
+			name:        "droppable event is not retried or dead-lettered",
+			eventType:   "agent.connected",
+			failures:    10,
+			err:         errors.NewConnectionError("unavailable"),
+			wantStatus:  http.StatusInternalServerError,
+			wantCalls:   1,
+			wantOutcome: outcomeExhausted,
+		},
+		{
+			name:        "event without policy uses global budget and DLQ setting",
+			eventType:   "build.started",
+			failures:    10,
+			err:         errors.NewConnectionError("unavailable"),
+			wantStatus:  http.StatusInternalServerError,
+			wantCalls:   2,
+			wantOutcome: outcomeExhausted,
+		},
+		{
+			name:        "open circuit is not retried",
+			eventType:   "build.finished",
+			failures:    10,
+			err:         publisher.ErrCircuitOpen,
+			wantStatus:  http.StatusInternalServerError,
+			wantCalls:   1,
+			wantDLQ:     1,
+			wantOutcome: outcomeNonRetryable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+				t.Fatalf("failed to initialize metrics: %v", err)
+			}
+
+			pub := publisher.NewMockPublisher().(*publisher.MockPublisher)
+			pub.FailFirst(tt.failures, tt.err)
+			dlqPub := NewMockDLQPublisher()
+			handler := NewHandler(Config{
+				BuildkiteToken:   "test-token",
+				Publisher:        pub,
+				DLQPublisher:     dlqPub,
+				RetryMaxAttempts: 2,
+				RetryBackoff:     time.Millisecond,
+				EventPolicies:    policies,
+			})
+
+			payload := fmt.Sprintf(`{"event":%q,"build":{"id":"123","state":"passed"},"pipeline":{"slug":"test"}}`, tt.eventType)
+			req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewBufferString(payload))
+			req.Header.Set("X-Buildkite-Token", "test-token")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if pub.CallCount() != tt.wantCalls {
+				t.Errorf("publish calls = %d, want %d", pub.CallCount(), tt.wantCalls)
+			}
+			if dlqPub.MessageCount() != tt.wantDLQ {
+				t.Errorf("DLQ messages = %d, want %d", dlqPub.MessageCount(), tt.wantDLQ)
+			}
+			if got := testutil.ToFloat64(metrics.PubsubPublishOutcomesTotal.WithLabelValues(tt.eventType, tt.wantOutcome)); got != 1 {
+				t.Errorf("%s outcomes = %v, want 1", tt.wantOutcome, got)
+			}
+			series := testutil.CollectAndCount(metrics.PubsubRetryBackoffDuration)
+			if retried := tt.wantCalls > 1; retried != (series == 1) {
+				t.Errorf("backoff series = %d after %d calls", series, tt.wantCalls)
+			}
+
+			// Only a publish that succeeded after retries reports them
+			var response struct {
+				PublishAttempts int    `json:"publish_attempts"`
+				RetryLatencyMs  *int64 `json:"retry_latency_ms"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			wantAttempts := 0
+			if tt.wantStatus == http.StatusOK && tt.wantCalls > 1 {
+				wantAttempts = tt.wantCalls
+			}
+			if response.PublishAttempts != wantAttempts {
+				t.Errorf("response publish_attempts = %d, want %d", response.PublishAttempts, wantAttempts)
+			}
+			if got := w.Header().Get(PublishAttemptsHeader); wantAttempts == 0 && got != "" || wantAttempts > 0 && got != strconv.Itoa(wantAttempts) {
+				t.Errorf("%s = %q, want %d", PublishAttemptsHeader, got, wantAttempts)
+			}
+			if wantAttempts > 0 {
+				// Two backoffs of at least a millisecond each
+				if response.RetryLatencyMs == nil || *response.RetryLatencyMs < 2 {
+					t.Errorf("response retry_latency_ms = %v, want at least 2", response.RetryLatencyMs)
+				}
+				if w.Header().Get(RetryLatencyHeader) != strconv.FormatInt(*response.RetryLatencyMs, 10) {
+					t.Errorf("%s = %q, want %d", RetryLatencyHeader, w.Header().Get(RetryLatencyHeader), *response.RetryLatencyMs)
+				}
+			} else if response.RetryLatencyMs != nil {
+				t.Errorf("response retry_latency_ms = %d, want none", *response.RetryLatencyMs)
+			}
+		})
+	}
+}
+
+func TestPublishWithRetryBackoff(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	pub := publisher.NewMockPublisher().(*publisher.MockPublisher)
+	pub.FailFirst(3, errors.NewConnectionError("unavailable"))
+	clk := clock.NewFake(time.Now())
+	handler := NewHandler(Config{
+		BuildkiteToken: "test-token",
+		Publisher:      pub,
+		RetryBackoff:   time.Second,
+		Clock:          clk,
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := handler.publishWithRetry(context.Background(), "data", map[string]string{"event_type": "build.finished"}, 4)
+		done <- err
+	}()
+
+	// Each backoff doubles up to the maximum, and the next attempt waits for
+	// all of it
+	for i, backoff := range []time.Duration{time.Second, 2 * time.Second, maxRetryBackoff} {
+		clk.BlockUntil(1)
+		if pub.CallCount() != i+1 {
+			t.Fatalf("publish calls during backoff %d = %d, want %d", i+1, pub.CallCount(), i+1)
+		}
+		clk.Advance(backoff - time.Millisecond)
+		if clk.Waiters() != 1 {
+			t.Fatalf("backoff %d ended before %v", i+1, backoff)
+		}
+		clk.Advance(time.Millisecond)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("publishWithRetry() error = %v", err)
+	}
+	if pub.CallCount() != 4 {
+		t.Errorf("publish calls = %d, want 4", pub.CallCount())
+	}
+
+	// The time spent backing off is recorded exactly
+	var m dto.Metric
+	if err := metrics.PubsubRetryBackoffDuration.WithLabelValues("build.finished").(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatalf("failed to read backoff histogram: %v", err)
+	}
+	if got := m.GetHistogram().GetSampleSum(); got != 5 {
+		t.Errorf("backoff recorded = %vs, want 5s", got)
+	}
+}
+
+func TestPublishWithRetryStopsOnContextDone(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	pub := publisher.NewMockPublisher().(*publisher.MockPublisher)
+	pub.SetError(errors.NewConnectionError("unavailable"))
+	handler := NewHandler(Config{
+		BuildkiteToken: "test-token",
+		Publisher:      pub,
+		RetryBackoff:   time.Hour,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, _, err := handler.publishWithRetry(ctx, "data", map[string]string{"event_type": "build.finished"}, 5); err == nil {
+		t.Fatal("publishWithRetry() expected error")
+	}
+	if pub.CallCount() != 1 {
+		t.Errorf("publish calls = %d, want 1", pub.CallCount())
+	}
+	if got := testutil.ToFloat64(metrics.PubsubPublishOutcomesTotal.WithLabelValues("build.finished", outcomeCancelled)); got != 1 {
+		t.Errorf("cancelled outcomes = %v, want 1", got)
+	}
+}
+
+func TestPublishWithRetryStopsWhenCircuitOpens(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	pub := publisher.NewMockPublisher().(*publisher.MockPublisher)
+	pub.SetError(errors.NewConnectionError("unavailable"))
+	breaker := publisher.NewCircuitBreaker(publisher.CircuitBreakerConfig{FailureThreshold: 2, OpenTimeout: time.Minute})
+	handler := NewHandler(Config{
+		BuildkiteToken: "test-token",
+		Publisher:      publisher.NewCircuitBreakerPublisher(pub, breaker),
+		RetryBackoff:   time.Millisecond,
+	})
+
+	// The second failure opens the circuit, leaving three retries unused
+	_, _, err := handler.publishWithRetry(context.Background(), "data", map[string]string{"event_type": "build.finished"}, 5)
+	if !errors.IsConnectionError(err) {
+		t.Fatalf("publishWithRetry() error = %v, want the publish failure", err)
+	}
+	if pub.CallCount() != 2 {
+		t.Errorf("publish calls = %d, want 2", pub.CallCount())
+	}
+	if got := testutil.ToFloat64(metrics.PubsubRetriesAvoidedTotal.WithLabelValues("build.finished")); got != 3 {
+		t.Errorf("retries avoided = %v, want 3", got)
+	}
+	if got := testutil.ToFloat64(metrics.PubsubPublishOutcomesTotal.WithLabelValues("build.finished", outcomeCircuitOpen)); got != 1 {
+		t.Errorf("circuit_open outcomes = %v, want 1", got)
+	}
+}
+
+func TestPublishWithRetryStopsOnNonRetryableError(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	pub := publisher.NewMockPublisher().(*publisher.MockPublisher)
+	pub.SetError(errors.NewValidationError("message too large"))
+	handler := NewHandler(Config{
+		BuildkiteToken: "test-token",
+		Publisher:      pub,
+		RetryBackoff:   time.Millisecond,
+	})
+
+	// A message Pub/Sub rejects is rejected again on every retry
+	_, _, err := handler.publishWithRetry(context.Background(), "data", map[string]string{"event_type": "build.finished"}, 5)
+	if !errors.IsValidationError(err) {
+		t.Fatalf("publishWithRetry() error = %v, want the validation error", err)
+	}
+	if pub.CallCount() != 1 {
+		t.Errorf("publish calls = %d, want 1", pub.CallCount())
+	}
+	if got := testutil.ToFloat64(metrics.PubsubPublishOutcomesTotal.WithLabelValues("build.finished", outcomeNonRetryable)); got != 1 {
+		t.Errorf("non_retryable outcomes = %v, want 1", got)
+	}
+}
+
+func TestHandlerQueueFullRetryAfter(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	pub := publisher.NewMockPublisher().(*publisher.MockPublisher)
+	pub.SetError(errors.WithRetryAfter(publisher.ErrQueueFull, 2500*time.Millisecond))
+	dlqPub := NewMockDLQPublisher()
+	handler := NewHandler(Config{
+		BuildkiteToken:   "test-token",
+		Publisher:        pub,
+		DLQPublisher:     dlqPub,
+		EnableDLQ:        true,
+		RetryMaxAttempts: 3,
+		RetryBackoff:     time.Millisecond,
+	})
+
+	payload := `{"event":"build.finished","build":{"id":"123","state":"passed"},"pipeline":{"slug":"test"}}`
+	req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewBufferString(payload))
+	req.Header.Set("X-Buildkite-Token", "test-token")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if got := w.Header().Get("Retry-After"); got != "3" {
+		t.Errorf("Retry-After = %q, want 3", got)
+	}
+	if pub.CallCount() != 1 {
+		t.Errorf("publish calls = %d, want 1 (a full queue is not retried)", pub.CallCount())
+	}
+	if dlqPub.MessageCount() != 0 {
+		t.Errorf("DLQ messages = %d, want 0", dlqPub.MessageCount())
+	}
+}
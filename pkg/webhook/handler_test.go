@@ -2,43 +2,31 @@ package webhook
 
 import (
 	"bytes"
-	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/mcncl/buildkite-pubsub/internal/buildkite"
+	"github.com/mcncl/buildkite-pubsub/internal/clock"
 	"github.com/mcncl/buildkite-pubsub/internal/errors"
 	"github.com/mcncl/buildkite-pubsub/internal/metrics"
 	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook/webhooktest"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
-// MockPublisherWithError is a publisher that returns an error
-type MockPublisherWithError struct {
-	publisher.MockPublisher
-	errorType string
-}
-
-func (m *MockPublisherWithError) Publish(ctx context.Context, data interface{}, attributes map[string]string) (string, error) {
-	switch m.errorType {
-	case "connection":
-		return "", errors.NewConnectionError("connection refused")
-	case "publish":
-		return "", errors.NewPublishError("failed to publish message", fmt.Errorf("publish error"))
-	case "rate_limit":
-		return "", errors.NewRateLimitError("too many requests")
-	default:
-		return "", fmt.Errorf("unknown error")
-	}
-}
-
 func TestHandler(t *testing.T) {
 	tests := []struct {
 		name          string
@@ -265,18 +253,14 @@ func TestHandler(t *testing.T) {
 			}
 
 			// Create the appropriate publisher
-			var pub publisher.Publisher
+			pub := publisher.NewMockPublisher().(*publisher.MockPublisher)
 			switch tt.publisherType {
-			case "normal":
-				pub = publisher.NewMockPublisher()
 			case "connection_error":
-				pub = &MockPublisherWithError{errorType: "connection"}
+				pub.SetError(errors.NewConnectionError("connection refused"))
 			case "publish_error":
-				pub = &MockPublisherWithError{errorType: "publish"}
+				pub.SetError(errors.NewPublishError("failed to publish message", fmt.Errorf("publish error")))
 			case "rate_limit":
-				pub = &MockPublisherWithError{errorType: "rate_limit"}
-			default:
-				pub = publisher.NewMockPublisher()
+				pub.SetError(errors.NewRateLimitError("too many requests"))
 			}
 
 			// Create handler with the expected token
@@ -316,8 +300,7 @@ func TestHandler(t *testing.T) {
 
 			// Check publication status
 			if tt.publisherType == "normal" {
-				mp := pub.(*publisher.MockPublisher)
-				lastPub := mp.LastPublished()
+				lastPub := pub.LastPublished()
 				hasPublished := lastPub != nil
 				if hasPublished != tt.wantPublished {
 					t.Errorf("Handler published = %v, want %v", hasPublished, tt.wantPublished)
@@ -343,8 +326,8 @@ func TestHandler(t *testing.T) {
 					// Check pipeline attribute
 					if pipeline, ok := lastPub.Attributes["pipeline"]; !ok {
 						t.Error("Missing pipeline attribute")
-					} else if pipeline != "Test Pipeline" {
-						t.Errorf("Handler published wrong pipeline: got %v want Test Pipeline", pipeline)
+					} else if pipeline != "test" {
+						t.Errorf("Handler published wrong pipeline: got %v want test", pipeline)
 					}
 
 					// Check build_state attribute
@@ -456,9 +439,15 @@ func TestHandlerPublishAttributes(t *testing.T) {
 	expectedAttrs := map[string]string{
 		"origin":      "buildkite-webhook",
 		"event_type":  "build.finished",
-		"pipeline":    "Production Deployment",
+		"pipeline":    "production-deploy",
 		"build_state": "failed",
 		"branch":      "release/v2.0",
+
+		"delivery_mode":    "live",
+		"normalized_state": "failure",
+		"is_terminal":      "true",
+		"is_retry":         "false",
+		"is_blocked":       "false",
 	}
 
 	for key, expectedValue := range expectedAttrs {
@@ -472,8 +461,24 @@ func TestHandlerPublishAttributes(t *testing.T) {
 		}
 	}
 
+	// Every message carries lag timestamps
+	receivedAt, ok := subscriber.ReceivedAt(lastPub.Attributes)
+	if !ok {
+		t.Errorf("Missing or malformed attribute: %s", subscriber.ReceivedAtAttribute)
+	}
+	publishedAt, ok := subscriber.PublishedAt(lastPub.Attributes)
+	if !ok {
+		t.Errorf("Missing or malformed attribute: %s", subscriber.PublishedAtAttribute)
+	}
+	if publishedAt.Before(receivedAt) {
+		t.Errorf("published_at %v is before received_at %v", publishedAt, receivedAt)
+	}
+
 	// Verify no unexpected attributes (optional, but good practice)
 	for key := range lastPub.Attributes {
+		if key == subscriber.ReceivedAtAttribute || key == subscriber.PublishedAtAttribute {
+			continue
+		}
 		if _, expected := expectedAttrs[key]; !expected {
 			t.Errorf("Unexpected attribute: %s", key)
 		}
@@ -481,6 +486,52 @@ func TestHandlerPublishAttributes(t *testing.T) {
 }
 
 // Helper function to check if a metric exists
+func TestHandlerMethods(t *testing.T) {
+	tests := []struct {
+		name       string
+		strict     bool
+		method     string
+		wantStatus int
+		wantAllow  string
+	}{
+		{name: "head answers uptime checks", method: http.MethodHead, wantStatus: http.StatusOK, wantAllow: "POST, HEAD, OPTIONS"},
+		{name: "options lists methods", method: http.MethodOptions, wantStatus: http.StatusNoContent, wantAllow: "POST, HEAD, OPTIONS"},
+		{name: "get is rejected", method: http.MethodGet, wantStatus: http.StatusMethodNotAllowed, wantAllow: "POST, HEAD, OPTIONS"},
+		{name: "strict rejects head", strict: true, method: http.MethodHead, wantStatus: http.StatusMethodNotAllowed, wantAllow: "POST"},
+		{name: "strict rejects options", strict: true, method: http.MethodOptions, wantStatus: http.StatusMethodNotAllowed, wantAllow: "POST"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+				t.Fatalf("failed to initialize metrics: %v", err)
+			}
+			mockPub := publisher.NewMockPublisher()
+			handler := NewHandler(Config{
+				BuildkiteToken: "test-token",
+				Publisher:      mockPub,
+				StrictMethods:  tt.strict,
+			})
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(tt.method, "/webhook", nil))
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if got := rr.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+			if len(mockPub.(*publisher.MockPublisher).GetPublished()) != 0 {
+				t.Error("expected nothing to be published")
+			}
+			if tt.wantStatus != http.StatusMethodNotAllowed && rr.Body.Len() != 0 {
+				t.Errorf("body = %q, want empty", rr.Body)
+			}
+		})
+	}
+}
+
 func metricExists(metricName string) bool {
 	metrics, err := prometheus.DefaultGatherer.Gather()
 	if err != nil {
@@ -513,6 +564,70 @@ func generateTestHMACSignature(secret, timestamp, body string) string {
 	return hex.EncodeToString(mac.Sum(nil))
 }
 
+func TestHandlerSignatureFailureReasons(t *testing.T) {
+	const secret = "test-hmac-secret"
+	body := `{"event":"ping"}`
+	clk := clock.NewFake(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+	now := clk.Now().Unix()
+	sign := func(ts int64, secret string) string {
+		timestamp := strconv.FormatInt(ts, 10)
+		return "timestamp=" + timestamp + ",signature=" + generateTestHMACSignature(secret, timestamp, body)
+	}
+
+	tests := []struct {
+		name       string
+		signature  string
+		wantReason string
+	}{
+		{name: "valid", signature: sign(now, secret)},
+		{name: "wrong secret", signature: sign(now, "other-secret"), wantReason: buildkite.SignatureInvalid},
+		{name: "expired", signature: sign(now-120, secret), wantReason: buildkite.SignatureExpired},
+		{name: "future", signature: sign(now+120, secret), wantReason: buildkite.SignatureFuture},
+		{name: "within past tolerance", signature: sign(now-30, secret)},
+		{name: "at past tolerance", signature: sign(now-60, secret)},
+		{name: "just past tolerance", signature: sign(now-61, secret), wantReason: buildkite.SignatureExpired},
+		{name: "at future tolerance", signature: sign(now+10, secret)},
+		{name: "malformed", signature: "signature=abc", wantReason: buildkite.SignatureMalformed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+				t.Fatalf("failed to initialize metrics: %v", err)
+			}
+			handler := NewHandler(Config{
+				HMACSecret:               secret,
+				Publisher:                publisher.NewMockPublisher(),
+				SignatureTolerance:       time.Minute,
+				SignatureFutureTolerance: 10 * time.Second,
+				Clock:                    clk,
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+			req.Header.Set(buildkite.SignatureHeader, tt.signature)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			wantStatus := http.StatusOK
+			if tt.wantReason != "" {
+				wantStatus = http.StatusUnauthorized
+			}
+			if rr.Code != wantStatus {
+				t.Errorf("status = %d, want %d", rr.Code, wantStatus)
+			}
+			for _, reason := range []string{buildkite.SignatureInvalid, buildkite.SignatureExpired, buildkite.SignatureFuture, buildkite.SignatureMalformed} {
+				want := 0.0
+				if reason == tt.wantReason {
+					want = 1
+				}
+				if got := testutil.ToFloat64(metrics.SignatureFailuresTotal.WithLabelValues(reason)); got != want {
+					t.Errorf("signature failures{reason=%q} = %v, want %v", reason, got, want)
+				}
+			}
+		})
+	}
+}
+
 func TestHandlerWithHMACSignature(t *testing.T) {
 	hmacSecret := "test-hmac-secret"
 	payload := `{
@@ -757,3 +872,288 @@ func TestHandlerHMACAndTokenFallback(t *testing.T) {
 		})
 	}
 }
+
+func TestHandlerQueueAttributes(t *testing.T) {
+	tests := []struct {
+		name      string
+		payload   string
+		wantAttrs map[string]string
+		absent    []string
+	}{
+		{
+			name: "agent event with cluster and tags",
+			payload: `{
+				"event": "agent.stopped",
+				"agent": {
+					"id": "agent-1",
+					"connection_state": "stopped",
+					"cluster_id": "cluster-1",
+					"meta_data": ["queue=linux-large", "os=linux"]
+				}
+			}`,
+			wantAttrs: map[string]string{
+				"event_type": "agent.stopped",
+				"cluster_id": "cluster-1",
+				"queue_name": "linux-large",
+				"agent_tags": "queue=linux-large,os=linux",
+			},
+		},
+		{
+			name:      "agent event without queue tag uses default queue",
+			payload:   `{"event": "agent.connected", "agent": {"id": "agent-1", "connection_state": "connected"}}`,
+			wantAttrs: map[string]string{"queue_name": "default"},
+			absent:    []string{"cluster_id", "agent_tags"},
+		},
+		{
+			name:      "build event in a cluster",
+			payload:   `{"event": "build.finished", "build": {"id": "b1", "state": "passed", "cluster_id": "cluster-2"}, "pipeline": {"slug": "p"}}`,
+			wantAttrs: map[string]string{"cluster_id": "cluster-2"},
+			absent:    []string{"queue_name", "agent_tags"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+				t.Fatalf("failed to initialize metrics: %v", err)
+			}
+
+			mockPub := publisher.NewMockPublisher().(*publisher.MockPublisher)
+			handler := NewHandler(Config{
+				BuildkiteToken: "test-token",
+				Publisher:      mockPub,
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewBufferString(tt.payload))
+			req.Header.Set("X-Buildkite-Token", "test-token")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", w.Code)
+			}
+			published := mockPub.LastPublished()
+			if published == nil {
+				t.Fatal("no message published")
+			}
+			for key, want := range tt.wantAttrs {
+				if got := published.Attributes[key]; got != want {
+					t.Errorf("attribute %s = %q, want %q", key, got, want)
+				}
+			}
+			for _, key := range tt.absent {
+				if _, ok := published.Attributes[key]; ok {
+					t.Errorf("unexpected attribute %s", key)
+				}
+			}
+		})
+	}
+}
+
+func FuzzHandler(f *testing.F) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		f.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	handler := NewHandler(Config{
+		BuildkiteToken: "test-token",
+		Publisher:      publisher.NewMockPublisher(),
+		SchemaDrift:    buildkite.NewSchemaDriftDetector(slog.New(slog.NewTextHandler(io.Discard, nil)), time.Hour),
+	})
+
+	for _, eventType := range webhooktest.EventTypes {
+		f.Add(webhooktest.Payload(eventType))
+	}
+	f.Add([]byte(`{"event":"build.finished","build":null,"pipeline":null,"agent":null}`))
+	f.Add([]byte(`{"event":"agent.connected","agent":{"meta_data":["queue"]}}`))
+	f.Add([]byte(`{"event":"build.running","build":{"created_at":"2025-01-07T01:02:03Z","started_at":"2025-01-07T01:02:02Z"}}`))
+	f.Add([]byte(`{"event":1}`))
+	f.Add([]byte(`[]`))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body))
+		req.Header.Set("X-Buildkite-Token", "test-token")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		// Malformed payloads are the sender's fault and must never be
+		// reported as server errors, which Buildkite would retry
+		switch w.Code {
+		case http.StatusOK, http.StatusBadRequest:
+		default:
+			t.Fatalf("status = %d for body %q, want 200 or 400", w.Code, body)
+		}
+	})
+}
+
+func TestHandlerPublishResult(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	acked := time.Now().Add(250 * time.Millisecond).UTC()
+	mock := publisher.NewMockPublisher().(*publisher.MockPublisher)
+	mock.Script(1, publisher.MockResponse{MessageID: "msg-1", PublishTime: acked})
+	handler := NewHandler(Config{BuildkiteToken: "test-token", Publisher: mock})
+
+	body := webhooktest.Payload("build.finished")
+	rr := webhooktest.Serve(handler, webhooktest.NewTokenRequest("/webhook", "test-token", body))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rr.Code, rr.Body)
+	}
+
+	var response map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if response["message_id"] != "msg-1" || response["topic"] != "mock-topic" || response["publish_time"] != acked.Format(time.RFC3339Nano) {
+		t.Errorf("response = %v, want msg-1 on mock-topic published at %s", response, acked.Format(time.RFC3339Nano))
+	}
+	if got := rr.Header().Get(PublishTimeHeader); got != acked.Format(time.RFC3339Nano) {
+		t.Errorf("%s = %q, want %s", PublishTimeHeader, got, acked.Format(time.RFC3339Nano))
+	}
+}
+
+func TestHandlerChecksum(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	// publish returns the published message data, encoded as the Pub/Sub
+	// publisher encodes it, and attributes
+	publish := func(cfg Config, body []byte) ([]byte, map[string]string) {
+		t.Helper()
+		mock := publisher.NewMockPublisher().(*publisher.MockPublisher)
+		cfg.BuildkiteToken = "test-token"
+		cfg.Publisher = mock
+		rr := webhooktest.Serve(NewHandler(cfg), webhooktest.NewTokenRequest("/webhook", "test-token", body))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", rr.Code, rr.Body)
+		}
+		published := mock.LastPublished()
+		data, err := json.Marshal(published.Data)
+		if err != nil {
+			t.Fatalf("failed to encode published data: %v", err)
+		}
+		return data, published.Attributes
+	}
+
+	body := webhooktest.Payload("build.finished")
+	data, attrs := publish(Config{ChecksumAlgorithm: subscriber.ChecksumSHA256}, body)
+	if !strings.HasPrefix(attrs[subscriber.ChecksumAttribute], "sha256:") || attrs[subscriber.ChecksumPayloadAttribute] != subscriber.ChecksumPayloadData {
+		t.Errorf("attributes = %v, want a sha256 checksum of the data", attrs)
+	}
+	if err := subscriber.VerifyChecksum(data, attrs); err != nil {
+		t.Errorf("VerifyChecksum() error = %v", err)
+	}
+
+	// Raw events are checksummed as published, after compaction
+	data, attrs = publish(Config{ChecksumAlgorithm: subscriber.ChecksumSHA512}, []byte("{\n  \"event\": \"cluster.updated\"\n}"))
+	if err := subscriber.VerifyChecksum(data, attrs); err != nil || !strings.HasPrefix(attrs[subscriber.ChecksumAttribute], "sha512:") {
+		t.Errorf("VerifyChecksum() for a raw event = %v, checksum %q", err, attrs[subscriber.ChecksumAttribute])
+	}
+
+	data, attrs = publish(Config{ChecksumAlgorithm: subscriber.ChecksumSHA256, ChecksumRaw: true}, body)
+	if attrs[subscriber.ChecksumPayloadAttribute] != subscriber.ChecksumPayloadRaw {
+		t.Errorf("checksum_payload = %q, want raw", attrs[subscriber.ChecksumPayloadAttribute])
+	}
+	if err := subscriber.VerifyChecksum(body, attrs); err != nil {
+		t.Errorf("VerifyChecksum() of the webhook body error = %v", err)
+	}
+	if err := subscriber.VerifyChecksum(data, attrs); err == nil {
+		t.Error("VerifyChecksum() of the transformed data against a raw checksum error = nil, want mismatch")
+	}
+
+	if _, attrs = publish(Config{}, body); attrs[subscriber.ChecksumAttribute] != "" {
+		t.Errorf("checksum without an algorithm = %q, want none", attrs[subscriber.ChecksumAttribute])
+	}
+}
+
+func TestHandlerSchemaVersion(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	for _, version := range []string{"", "2"} {
+		mock := publisher.NewMockPublisher().(*publisher.MockPublisher)
+		handler := NewHandler(Config{BuildkiteToken: "test-token", Publisher: mock, SchemaVersion: version})
+		rr := webhooktest.Serve(handler, webhooktest.NewTokenRequest("/webhook", "test-token", webhooktest.Payload("build.finished")))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", rr.Code, rr.Body)
+		}
+
+		published, ok := mock.LastPublished().Data.(buildkite.TransformedPayload)
+		if !ok {
+			t.Fatalf("published %T, want a transformed payload", mock.LastPublished().Data)
+		}
+		if published.SchemaVersion != version {
+			t.Errorf("schema_version = %q, want %q", published.SchemaVersion, version)
+		}
+		if hasMillis := published.Build.CreatedAtMs != 0; hasMillis != (version == "2") {
+			t.Errorf("schema %q: created_at_ms = %d", version, published.Build.CreatedAtMs)
+		}
+	}
+}
+
+func TestQueueTime(t *testing.T) {
+	created := time.Date(2025, 1, 7, 1, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time {
+		ts := created.Add(d)
+		return &ts
+	}
+	tests := []struct {
+		name        string
+		build       buildkite.Build
+		wantWait    time.Duration
+		wantOutlier string
+	}{
+		{
+			name:     "created and started",
+			build:    buildkite.Build{CreatedAt: created, ScheduledAt: at(0), StartedAt: at(30 * time.Second)},
+			wantWait: 30 * time.Second,
+		},
+		{
+			name:     "scheduled for later",
+			build:    buildkite.Build{CreatedAt: created, ScheduledAt: at(time.Hour), StartedAt: at(time.Hour + 10*time.Second)},
+			wantWait: 10 * time.Second,
+		},
+		{
+			name:     "no scheduled_at",
+			build:    buildkite.Build{CreatedAt: created, StartedAt: at(time.Minute)},
+			wantWait: time.Minute,
+		},
+		{
+			name:        "rebuild keeping created_at",
+			build:       buildkite.Build{CreatedAt: created, StartedAt: at(72 * time.Hour)},
+			wantWait:    72 * time.Hour,
+			wantOutlier: "too_long",
+		},
+		{
+			name:        "started before scheduled",
+			build:       buildkite.Build{CreatedAt: created, ScheduledAt: at(time.Hour), StartedAt: at(time.Minute)},
+			wantWait:    -59 * time.Minute,
+			wantOutlier: "negative",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wait, outlier := queueTime(tt.build)
+			if wait != tt.wantWait || outlier != tt.wantOutlier {
+				t.Errorf("queueTime() = %v, %q, want %v, %q", wait, outlier, tt.wantWait, tt.wantOutlier)
+			}
+		})
+	}
+
+	reg := webhooktest.NewRegistry(t)
+	h := NewHandler(Config{BuildkiteToken: "test-token", Publisher: webhooktest.NewPublisher()})
+	rebuild := webhooktest.Payload("build.started", webhooktest.WithField("build.source", "api"), webhooktest.WithField("build.started_at", "2025-01-10T01:02:03.000Z"))
+	for _, body := range [][]byte{webhooktest.Payload("build.started"), rebuild} {
+		if rec := webhooktest.Serve(h, webhooktest.NewTokenRequest("/webhook", "test-token", body)); rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", rec.Code)
+		}
+	}
+	webhooktest.AssertCounter(t, reg, "buildkite_build_queue_outliers_total", map[string]string{"reason": "too_long", "source": "api"}, 1)
+	if count := testutil.CollectAndCount(metrics.BuildQueueDuration); count != 1 {
+		t.Errorf("queue time series = %d, want 1", count)
+	}
+}
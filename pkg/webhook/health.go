@@ -7,7 +7,9 @@ import (
 )
 
 type HealthCheck struct {
-	isReady *atomic.Bool
+	isReady   *atomic.Bool
+	saturated atomic.Pointer[func() bool]
+	paused    atomic.Pointer[func() bool]
 }
 
 func NewHealthCheck() *HealthCheck {
@@ -36,6 +38,26 @@ func (h *HealthCheck) ReadyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Paused instances take no webhooks, so send them elsewhere
+	if paused := h.paused.Load(); paused != nil && (*paused)() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"status": "paused",
+		})
+		return
+	}
+
+	// Shed traffic before the publish queue starts rejecting events
+	if saturated := h.saturated.Load(); saturated != nil && (*saturated)() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"status": "saturated",
+		})
+		return
+	}
+
 	response := map[string]string{
 		"status": "ready",
 	}
@@ -47,6 +69,16 @@ func (h *HealthCheck) ReadyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// SetSaturationCheck makes the ready check fail while saturated returns true
+func (h *HealthCheck) SetSaturationCheck(saturated func() bool) {
+	h.saturated.Store(&saturated)
+}
+
+// SetPauseCheck makes the ready check fail while paused returns true
+func (h *HealthCheck) SetPauseCheck(paused func() bool) {
+	h.paused.Store(&paused)
+}
+
 // SetReady marks the service as ready to receive traffic
 func (h *HealthCheck) SetReady(ready bool) {
 	h.isReady.Store(ready)
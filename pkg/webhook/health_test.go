@@ -12,6 +12,8 @@ func TestHealthCheck(t *testing.T) {
 		name         string
 		path         string
 		setReady     bool
+		saturated    bool
+		paused       bool
 		wantStatus   int
 		wantResponse map[string]string
 	}{
@@ -33,6 +35,26 @@ func TestHealthCheck(t *testing.T) {
 				"status": "ready",
 			},
 		},
+		{
+			name:       "readiness check when saturated",
+			path:       "/ready",
+			setReady:   true,
+			saturated:  true,
+			wantStatus: http.StatusServiceUnavailable,
+			wantResponse: map[string]string{
+				"status": "saturated",
+			},
+		},
+		{
+			name:       "readiness check when paused",
+			path:       "/ready",
+			setReady:   true,
+			paused:     true,
+			wantStatus: http.StatusServiceUnavailable,
+			wantResponse: map[string]string{
+				"status": "paused",
+			},
+		},
 		{
 			name:         "readiness check when not ready",
 			path:         "/ready",
@@ -47,6 +69,8 @@ func TestHealthCheck(t *testing.T) {
 			// Create health check instance
 			hc := NewHealthCheck()
 			hc.SetReady(tt.setReady)
+			hc.SetSaturationCheck(func() bool { return tt.saturated })
+			hc.SetPauseCheck(func() bool { return tt.paused })
 
 			// Create request
 			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
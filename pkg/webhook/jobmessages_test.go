@@ -0,0 +1,72 @@
+package webhook
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+	"github.com/mcncl/buildkite-pubsub/pkg/transform"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook/webhooktest"
+)
+
+func TestHandlerJobMessages(t *testing.T) {
+	reg := webhooktest.NewRegistry(t)
+	if err := metrics.InitMetrics(reg); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	pub := webhooktest.NewPublisher()
+	handler := NewHandler(Config{
+		BuildkiteToken:      "test-token",
+		Publisher:           pub,
+		JobMessagePipelines: []string{"mono*"},
+	})
+	jobs := []map[string]interface{}{
+		{"id": "j1", "type": "script", "name": "test", "state": "passed", "exit_status": 0},
+		{"id": "j2", "type": "script", "name": "lint", "state": "failed", "exit_status": 1},
+		{"id": "j3", "type": "manual", "label": "Deploy?", "state": "unblocked"},
+	}
+	send := func(eventType, pipeline string) {
+		t.Helper()
+		body := webhooktest.Payload(eventType,
+			webhooktest.WithPipeline(pipeline),
+			webhooktest.WithField("build.jobs", jobs))
+		rr := webhooktest.Serve(handler, webhooktest.NewTokenRequest("/webhook", "test-token", body))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s for %s: status = %d: %s", eventType, pipeline, rr.Code, rr.Body)
+		}
+	}
+
+	send("build.finished", "monorepo")
+	webhooktest.AssertPublishedCount(t, pub, 4)
+	webhooktest.AssertCounter(t, reg, "buildkite_webhook_job_messages_total", map[string]string{"outcome": "published"}, 3)
+
+	seen := map[string]bool{}
+	for _, msg := range pub.GetPublished() {
+		payload, ok := msg.Data.(transform.TransformedPayload)
+		if !ok || payload.EventType != transform.EventBuildJob {
+			continue
+		}
+		seen[payload.Job.ID] = true
+		if msg.Attributes["event_type"] != transform.EventBuildJob || msg.Attributes["job_count"] != "3" || msg.Attributes["job_index"] == "" {
+			t.Errorf("job %s attributes = %v, want build.job of 3", payload.Job.ID, msg.Attributes)
+		}
+		if _, ok := msg.Attributes["delivery_id"]; ok {
+			t.Errorf("job %s carries the webhook's delivery_id", payload.Job.ID)
+		}
+	}
+	if len(seen) != 3 {
+		t.Errorf("published build.job for %v, want j1, j2 and j3", seen)
+	}
+
+	// Other events and pipelines publish no job messages
+	send("build.running", "monorepo")
+	send("build.finished", "other")
+	webhooktest.AssertPublishedCount(t, pub, 6)
+
+	// A failed job message does not fail the webhook
+	pub.FailOn(publisher.ErrQueueFull, pub.CallCount()+2)
+	send("build.finished", "monorepo")
+	webhooktest.AssertCounter(t, reg, "buildkite_webhook_job_messages_total", map[string]string{"outcome": "failed"}, 1)
+}
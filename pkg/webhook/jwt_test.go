@@ -0,0 +1,95 @@
+package webhook
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/jwtauth"
+	"github.com/mcncl/buildkite-pubsub/internal/jwtauth/jwtauthtest"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook/webhooktest"
+)
+
+func TestHandlerJWTAuth(t *testing.T) {
+	issuer := jwtauthtest.NewIssuer(t)
+	key := issuer.AddKey(t, "forwarder-key", false)
+	verifier := jwtauth.New(jwtauth.Config{
+		Issuer:   issuer.URL,
+		Audience: "buildkite-pubsub",
+		Subjects: []string{"forwarder@example.iam.gserviceaccount.com"},
+		Client:   issuer.Client(),
+	})
+	token := func(sub string) string {
+		return jwtauthtest.Sign(t, key, "forwarder-key", map[string]interface{}{
+			"iss": issuer.URL,
+			"sub": sub,
+			"aud": "buildkite-pubsub",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		})
+	}
+
+	tests := []struct {
+		name       string
+		jwt        *jwtauth.Verifier
+		bearer     string
+		token      string
+		wantStatus int
+	}{
+		{
+			name:       "allowed forwarder",
+			jwt:        verifier,
+			bearer:     token("forwarder@example.iam.gserviceaccount.com"),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "subject not allowed",
+			jwt:        verifier,
+			bearer:     token("someone@example.com"),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "invalid JWT is not retried as a Buildkite token",
+			jwt:        verifier,
+			bearer:     "not-a-jwt",
+			token:      "test-token",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "Buildkite token still accepted",
+			jwt:        verifier,
+			token:      "test-token",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "JWT ignored when not enabled",
+			bearer:     token("forwarder@example.iam.gserviceaccount.com"),
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := webhooktest.NewRegistry(t)
+			pub := webhooktest.NewPublisher()
+			handler := NewHandler(Config{BuildkiteToken: "test-token", Publisher: pub, JWT: tt.jwt})
+
+			req := webhooktest.NewRequest("/webhook", webhooktest.Payload("build.finished"))
+			if tt.token != "" {
+				req = webhooktest.NewTokenRequest("/webhook", tt.token, webhooktest.Payload("build.finished"))
+			}
+			if tt.bearer != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			rr := webhooktest.Serve(handler, req)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+			if tt.wantStatus == http.StatusOK {
+				webhooktest.AssertPublishedCount(t, pub, 1)
+				return
+			}
+			webhooktest.AssertPublishedCount(t, pub, 0)
+			webhooktest.AssertCounter(t, reg, "buildkite_webhook_auth_failures_total", nil, 1)
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook/webhooktest"
+)
+
+func TestHandlerPartialPayloads(t *testing.T) {
+	reg := webhooktest.NewRegistry(t)
+	if err := metrics.InitMetrics(reg); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+	body := webhooktest.Payload("build.finished",
+		webhooktest.WithBuildID("build-1"),
+		webhooktest.WithField("sender", "not a user"))
+
+	// Without partial payloads a malformed section rejects the event
+	pub := webhooktest.NewPublisher()
+	handler := NewHandler(Config{BuildkiteToken: "test-token", Publisher: pub})
+	rr := webhooktest.Serve(handler, webhooktest.NewTokenRequest("/webhook", "test-token", body))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+	webhooktest.AssertPublishedCount(t, pub, 0)
+
+	pub = webhooktest.NewPublisher()
+	handler = NewHandler(Config{BuildkiteToken: "test-token", Publisher: pub, PartialPayloads: true})
+	rr = webhooktest.Serve(handler, webhooktest.NewTokenRequest("/webhook", "test-token", body))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	var response struct {
+		TransformWarnings []string `json:"transform_warnings"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(response.TransformWarnings) != 1 || response.TransformWarnings[0] != "sender" {
+		t.Errorf("response transform_warnings = %v, want [sender]", response.TransformWarnings)
+	}
+	published := webhooktest.AssertPublished(t, pub, "build.finished")
+	if published.Build.ID != "build-1" || published.Sender.ID != "" {
+		t.Errorf("published build %q sender %+v, want build-1 without a sender", published.Build.ID, published.Sender)
+	}
+	webhooktest.AssertAttributes(t, pub, map[string]string{subscriber.TransformWarningsAttribute: "sender"})
+	webhooktest.AssertCounter(t, reg, "buildkite_transform_warnings_total", map[string]string{"section": "sender"}, 1)
+
+	// A well-formed payload has no warnings
+	rr = webhooktest.Serve(handler, webhooktest.NewTokenRequest("/webhook", "test-token", webhooktest.Payload("build.finished")))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	if _, ok := pub.LastPublished().Attributes[subscriber.TransformWarningsAttribute]; ok {
+		t.Error("well-formed payload has a transform_warnings attribute")
+	}
+}
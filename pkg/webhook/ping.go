@@ -0,0 +1,40 @@
+package webhook
+
+import (
+	"context"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+)
+
+// pingEvent is the body of a ping check message
+type pingEvent struct {
+	EventType  string `json:"event_type"`
+	DeliveryID string `json:"delivery_id,omitempty"`
+	Version    string `json:"version,omitempty"`
+}
+
+// publishPing publishes a ping check message, once and without the DLQ so
+// a failure is reported straight back to Buildkite, returning its message
+// ID and how long publishing took
+func (h *Handler) publishPing(ctx context.Context, d delivery) (string, time.Duration, error) {
+	attributes := map[string]string{
+		"origin":                         "buildkite-webhook",
+		"event_type":                     subscriber.PingEventType,
+		subscriber.DeliveryModeAttribute: subscriber.DeliveryModeSynthetic,
+		subscriber.PublishedAtAttribute:  time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if d.id != "" {
+		attributes["delivery_id"] = d.id
+	}
+	if h.version != "" {
+		attributes[subscriber.ProducerVersionAttribute] = h.version
+	}
+	start := time.Now()
+	msgID, err := h.pingPublisher.Publish(ctx, pingEvent{
+		EventType:  subscriber.PingEventType,
+		DeliveryID: d.id,
+		Version:    h.version,
+	}, attributes)
+	return msgID, time.Since(start), err
+}
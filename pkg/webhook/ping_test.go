@@ -0,0 +1,56 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook/webhooktest"
+)
+
+func TestHandlerPingCheck(t *testing.T) {
+	if err := metrics.InitMetrics(webhooktest.NewRegistry(t)); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	events, pings := webhooktest.NewPublisher(), webhooktest.NewPublisher()
+	handler := NewHandler(Config{
+		BuildkiteToken: "test-token",
+		Publisher:      events,
+		PingPublisher:  pings,
+		Version:        "v1.2.3",
+	})
+	ping := func() *http.Response {
+		req := webhooktest.NewTokenRequest("/webhook", "test-token", []byte(`{"event":"ping"}`))
+		req.Header.Set("X-Buildkite-Delivery-Id", "delivery-1")
+		return webhooktest.Serve(handler, req).Result()
+	}
+
+	resp := ping()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("ping status = %d", resp.StatusCode)
+	}
+	var response map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if response["message_id"] == "" || response["publish_ms"] == "" {
+		t.Errorf("response = %v, want the ping's message ID and publish time", response)
+	}
+	webhooktest.AssertPublishedCount(t, events, 0)
+	webhooktest.AssertPublishedCount(t, pings, 1)
+	webhooktest.AssertAttributes(t, pings, map[string]string{
+		"event_type":                        subscriber.PingEventType,
+		"delivery_id":                       "delivery-1",
+		subscriber.ProducerVersionAttribute: "v1.2.3",
+	})
+
+	// An unreachable topic fails the ping so Buildkite's test shows it
+	pings.SetError(errors.New("topic not found"))
+	if resp := ping(); resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("ping with a failing publisher status = %d, want %d", resp.StatusCode, http.StatusInternalServerError)
+	}
+}
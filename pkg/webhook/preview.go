@@ -0,0 +1,157 @@
+package webhook
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/buildkite"
+	"github.com/mcncl/buildkite-pubsub/internal/errors"
+	"github.com/mcncl/buildkite-pubsub/internal/jsoncodec"
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"github.com/mcncl/buildkite-pubsub/pkg/transform"
+)
+
+// messageInfo describes a message being published, for building its
+// attributes
+type messageInfo struct {
+	eventType   string
+	transformed buildkite.TransformedPayload
+	supported   bool
+	delivery    delivery
+	team        string
+	// warnings are the sections left out of a partial payload
+	warnings []string
+	// data is the published message and body the payload as received
+	data, body []byte
+	receivedAt time.Time
+}
+
+// messageAttributes returns the Pub/Sub attributes published with a message,
+// apart from the trace context
+func (h *Handler) messageAttributes(m messageInfo) map[string]string {
+	attributes := map[string]string{
+		"origin":      "buildkite-webhook",
+		"event_type":  m.eventType,
+		"pipeline":    h.pipelineAttribute(m.transformed),
+		"build_state": m.transformed.Build.State,
+		"branch":      m.transformed.Build.Branch,
+	}
+	if org := m.transformed.Build.Organization; org != "" {
+		attributes[subscriber.OrganizationAttribute] = subscriber.Slug(org)
+	}
+	if m.delivery.id != "" {
+		attributes["delivery_id"] = m.delivery.id
+	}
+	if m.delivery.attempt > 0 {
+		attributes["delivery_attempt"] = strconv.Itoa(m.delivery.attempt)
+	}
+	attributes[subscriber.DeliveryModeAttribute] = m.delivery.mode
+	if len(m.warnings) > 0 {
+		attributes[subscriber.TransformWarningsAttribute] = strings.Join(m.warnings, ",")
+	}
+	if m.team != "" {
+		attributes["team"] = m.team
+	}
+	if h.version != "" {
+		attributes[subscriber.ProducerVersionAttribute] = h.version
+	}
+	if !m.supported {
+		attributes["payload_format"] = "raw"
+	} else {
+		if url := h.schemaURL(h.schemaVersion); url != "" {
+			attributes[subscriber.SchemaURLAttribute] = url
+		}
+		if h.confirmationFor(m.transformed.Build.Pipeline) {
+			attributes[subscriber.ConfirmAttribute] = h.confirmationID
+		}
+	}
+	h.addChecksum(attributes, m.data, m.body)
+	// Let consumers compute end-to-end lag; published_at is stamped per attempt
+	attributes[subscriber.ReceivedAtAttribute] = m.receivedAt.UTC().Format(time.RFC3339Nano)
+	if expiresAt, ok := h.expiresAt(m.eventType, m.receivedAt); ok {
+		attributes[subscriber.ExpiresAtAttribute] = expiresAt
+	}
+	addQueueAttributes(attributes, m.transformed)
+	addStateAttributes(attributes, m.transformed)
+	if m.supported {
+		addDerivedAttributes(attributes, h.attributeHooks, withEventType(m.transformed, m.eventType))
+	}
+	h.hasher.apply(attributes)
+	return attributes
+}
+
+// Preview is what the handler would publish for a payload
+type Preview struct {
+	EventType string `json:"event_type"`
+	// Data is the message body, the payload as received for unsupported
+	// events
+	Data       json.RawMessage   `json:"data"`
+	Attributes map[string]string `json:"attributes"`
+	// Filtered is true when the handler's event filter would acknowledge
+	// the event without publishing it
+	Filtered          bool     `json:"filtered"`
+	TransformWarnings []string `json:"transform_warnings,omitempty"`
+}
+
+// Preview transforms body as a live delivery and returns the message and
+// attributes that would be published, without publishing it or recording
+// metrics. Attributes that depend on the request, such as delivery_id and
+// the trace context, are left out, and published_at is stamped at publish
+// time so never appears.
+func (h *Handler) Preview(body []byte) (Preview, error) {
+	var payload buildkite.Payload
+	var warnings []transform.SectionWarning
+	var err error
+	if h.partialPayloads {
+		payload, warnings, err = buildkite.DecodePartial(body)
+	} else {
+		err = jsoncodec.Unmarshal(body, &payload)
+	}
+	if err != nil {
+		return Preview{}, errors.NewValidationError("failed to decode payload")
+	}
+	var warnedSections []string
+	for _, warning := range warnings {
+		warnedSections = append(warnedSections, warning.Section)
+	}
+
+	eventType := payload.Event
+	supported := buildkite.IsSupportedEvent(eventType)
+	var transformed buildkite.TransformedPayload
+	var message interface{} = json.RawMessage(body)
+	if supported {
+		transformed, err = h.transform(payload, h.transformOptions()...)
+		if err != nil {
+			return Preview{}, errors.Wrap(err, "failed to transform payload")
+		}
+		message = transformed
+	}
+	data, err := jsoncodec.Marshal(message)
+	if err != nil {
+		return Preview{}, errors.Wrap(err, "failed to encode message")
+	}
+
+	var team string
+	if h.teams != nil {
+		team = h.teams.Team(transformed.Build.Pipeline)
+	}
+	return Preview{
+		EventType: eventType,
+		Data:      data,
+		Attributes: h.messageAttributes(messageInfo{
+			eventType:   eventType,
+			transformed: transformed,
+			supported:   supported,
+			delivery:    delivery{mode: subscriber.DeliveryModeLive},
+			team:        team,
+			warnings:    warnedSections,
+			data:        data,
+			body:        body,
+			receivedAt:  h.clock.Now(),
+		}),
+		Filtered:          !h.filter.Matches(withEventType(transformed, eventType)),
+		TransformWarnings: warnedSections,
+	}, nil
+}
@@ -0,0 +1,91 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/internal/errors"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook/webhooktest"
+)
+
+func TestHandlerPreview(t *testing.T) {
+	reg := webhooktest.NewRegistry(t)
+	if err := metrics.InitMetrics(reg); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+	pub := webhooktest.NewPublisher()
+	handler := NewHandler(Config{
+		BuildkiteToken:    "test-token",
+		Publisher:         pub,
+		Version:           "v1.2.3",
+		ChecksumAlgorithm: subscriber.ChecksumSHA256,
+		Filter:            publisher.RouteRule{EventType: "build.*"},
+	})
+	body := webhooktest.Payload("build.finished", webhooktest.WithBuildID("build-1"), webhooktest.WithBranch("main"))
+
+	preview, err := handler.Preview(body)
+	if err != nil {
+		t.Fatalf("Preview() error = %v", err)
+	}
+	webhooktest.AssertPublishedCount(t, pub, 0)
+	if preview.EventType != "build.finished" || preview.Filtered {
+		t.Errorf("preview event %q filtered %v, want build.finished unfiltered", preview.EventType, preview.Filtered)
+	}
+
+	// The preview matches what a live delivery publishes, apart from the
+	// attributes stamped per request
+	rr := webhooktest.Serve(handler, webhooktest.NewTokenRequest("/webhook", "test-token", body))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	published := pub.LastPublished()
+	data, err := json.Marshal(published.Data)
+	if err != nil {
+		t.Fatalf("failed to encode published data: %v", err)
+	}
+	if string(data) != string(preview.Data) {
+		t.Errorf("preview data = %s, want %s", preview.Data, data)
+	}
+	for name, want := range published.Attributes {
+		switch name {
+		case subscriber.ReceivedAtAttribute, subscriber.PublishedAtAttribute, "traceparent", "tracestate":
+			continue
+		}
+		if got := preview.Attributes[name]; got != want {
+			t.Errorf("preview attribute %s = %q, want %q", name, got, want)
+		}
+	}
+	if _, ok := preview.Attributes[subscriber.ReceivedAtAttribute]; !ok {
+		t.Error("preview has no received_at attribute")
+	}
+	if _, ok := preview.Attributes[subscriber.PublishedAtAttribute]; ok {
+		t.Error("preview has a published_at attribute")
+	}
+
+	// Events the filter drops are still previewed
+	preview, err = handler.Preview(webhooktest.Payload("job.finished"))
+	if err != nil {
+		t.Fatalf("Preview() error = %v", err)
+	}
+	if !preview.Filtered {
+		t.Error("job.finished preview is not filtered")
+	}
+
+	// Unsupported events are previewed as received
+	preview, err = handler.Preview([]byte(`{"event":"cluster.created","cluster":{"id":"c1"}}`))
+	if err != nil {
+		t.Fatalf("Preview() error = %v", err)
+	}
+	if preview.Attributes["payload_format"] != "raw" || string(preview.Data) != `{"event":"cluster.created","cluster":{"id":"c1"}}` {
+		t.Errorf("unsupported preview = %s %v, want the raw payload", preview.Data, preview.Attributes)
+	}
+
+	if _, err := handler.Preview([]byte("not json")); !errors.IsValidationError(err) {
+		t.Errorf("Preview(invalid) error = %v, want a validation error", err)
+	}
+	webhooktest.AssertPublishedCount(t, pub, 1)
+}
@@ -0,0 +1,76 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/internal/buildkite"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/internal/quarantine"
+	"github.com/mcncl/buildkite-pubsub/pkg/transform"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook/webhooktest"
+)
+
+func TestHandlerQuarantine(t *testing.T) {
+	failTransform := func(buildkite.Payload, ...transform.Option) (buildkite.TransformedPayload, error) {
+		return buildkite.TransformedPayload{}, fmt.Errorf("unexpected field")
+	}
+
+	tests := []struct {
+		name        string
+		acknowledge bool
+		wantStatus  int
+	}{
+		{name: "acknowledged", acknowledge: true, wantStatus: http.StatusAccepted},
+		{name: "retried", acknowledge: false, wantStatus: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := webhooktest.NewRegistry(t)
+			if err := metrics.InitMetrics(reg); err != nil {
+				t.Fatalf("failed to initialize metrics: %v", err)
+			}
+			dir, err := quarantine.NewDir(filepath.Join(t.TempDir(), "quarantine"))
+			if err != nil {
+				t.Fatalf("NewDir() error = %v", err)
+			}
+
+			pub := webhooktest.NewPublisher()
+			handler := NewHandler(Config{
+				BuildkiteToken:        "test-token",
+				Publisher:             pub,
+				Quarantine:            dir,
+				QuarantineAcknowledge: tt.acknowledge,
+			})
+			handler.transform = failTransform
+
+			body := webhooktest.Payload("build.finished")
+			req := webhooktest.NewTokenRequest("/webhook", "test-token", body)
+			req.Header.Set(buildkite.DeliveryIDHeader, "d1")
+			rr := webhooktest.Serve(handler, req)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+			webhooktest.AssertPublishedCount(t, pub, 0)
+
+			entries, err := dir.List()
+			if err != nil || len(entries) != 1 {
+				t.Fatalf("List() = %d entries, %v, want 1", len(entries), err)
+			}
+			if e := entries[0]; e.Body != string(body) || e.DeliveryID != "d1" || e.EventType != "build.finished" || e.Error == "" {
+				t.Errorf("entry = %+v, want the body, delivery and error", e)
+			}
+			if tt.acknowledge {
+				var resp map[string]string
+				if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp["quarantine_id"] != entries[0].ID {
+					t.Errorf("response = %s, want quarantine_id %s", rr.Body, entries[0].ID)
+				}
+			}
+			webhooktest.AssertCounter(t, reg, "buildkite_webhook_quarantined_payloads_total", map[string]string{"event_type": "build.finished"}, 1)
+		})
+	}
+}
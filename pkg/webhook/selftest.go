@@ -0,0 +1,40 @@
+package webhook
+
+import (
+	"context"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+)
+
+// SelftestHeader asks the handler to publish an authenticated ping as a
+// selftest event carrying the header's value, so `webhook selftest` can
+// check that deliveries reach Pub/Sub. Other pings are never published.
+const SelftestHeader = "X-Buildkite-Pubsub-Selftest"
+
+// selftestEvent is the body of a selftest event
+type selftestEvent struct {
+	EventType string `json:"event_type"`
+	ID        string `json:"selftest_id"`
+	Version   string `json:"version,omitempty"`
+}
+
+// publishSelftest publishes a selftest event for the run id, once and
+// without the DLQ, so a failure is reported straight back to the sender
+func (h *Handler) publishSelftest(ctx context.Context, id string) (string, error) {
+	attributes := map[string]string{
+		"origin":                         "buildkite-webhook",
+		"event_type":                     subscriber.SelftestEventType,
+		subscriber.SelftestIDAttribute:   id,
+		subscriber.DeliveryModeAttribute: subscriber.DeliveryModeSynthetic,
+		subscriber.PublishedAtAttribute:  time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if h.version != "" {
+		attributes[subscriber.ProducerVersionAttribute] = h.version
+	}
+	return h.publisher.Publish(ctx, selftestEvent{
+		EventType: subscriber.SelftestEventType,
+		ID:        id,
+		Version:   h.version,
+	}, attributes)
+}
@@ -0,0 +1,66 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHandlerSelftest(t *testing.T) {
+	if err := metrics.InitMetrics(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	mock := publisher.NewMockPublisher().(*publisher.MockPublisher)
+	handler := NewHandler(Config{BuildkiteToken: "test-token", Publisher: mock, Version: "v1.2.3"})
+	ping := func(token, selftestID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewBufferString(`{"event":"ping"}`))
+		req.Header.Set("X-Buildkite-Token", token)
+		if selftestID != "" {
+			req.Header.Set(SelftestHeader, selftestID)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Plain pings are never published
+	if w := ping("test-token", ""); w.Code != http.StatusOK || len(mock.GetPublished()) != 0 {
+		t.Fatalf("ping status = %d with %d published, want 200 with none", w.Code, len(mock.GetPublished()))
+	}
+
+	// Nor are unauthenticated self-test pings
+	if w := ping("wrong-token", "run-1"); w.Code != http.StatusUnauthorized || len(mock.GetPublished()) != 0 {
+		t.Fatalf("unauthenticated selftest status = %d with %d published, want 401 with none", w.Code, len(mock.GetPublished()))
+	}
+
+	w := ping("test-token", "run-1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("selftest status = %d: %s", w.Code, w.Body)
+	}
+	var response map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	msg := mock.LastPublished()
+	if response["message_id"] == "" || msg.Attributes["event_type"] != subscriber.SelftestEventType ||
+		msg.Attributes[subscriber.SelftestIDAttribute] != "run-1" || msg.Attributes[subscriber.ProducerVersionAttribute] != "v1.2.3" {
+		t.Errorf("response %v published %v, want a selftest event for run-1", response, msg.Attributes)
+	}
+	if event, ok := msg.Data.(selftestEvent); !ok || event.ID != "run-1" || event.Version != "v1.2.3" {
+		t.Errorf("published data = %#v", msg.Data)
+	}
+
+	mock.SetError(errors.New("topic not found"))
+	if w := ping("test-token", "run-2"); w.Code != http.StatusInternalServerError {
+		t.Errorf("selftest with a failing publisher status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
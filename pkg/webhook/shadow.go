@@ -0,0 +1,163 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/mcncl/buildkite-pubsub/internal/buildkite"
+	"github.com/mcncl/buildkite-pubsub/internal/jsoncodec"
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"github.com/mcncl/buildkite-pubsub/pkg/transform"
+)
+
+// Shadow publishing sends each supported event, transformed with a new
+// schema version, to a shadow topic alongside the message published with
+// the current one. Consumers of the new format can be tried on live traffic,
+// and the divergence metrics show which fields the change touches, before
+// the events topic switches over. Shadow publishes are best effort: they
+// never delay the response beyond the main publish or fail the webhook.
+
+// maxDivergenceDepth is how deep divergent fields are named, so
+// "build.created_at_ms" is a label but the keys of raw_payload or
+// build.meta_data are not
+const maxDivergenceDepth = 2
+
+// Divergence kinds
+const (
+	DivergenceAdded   = "added"
+	DivergenceRemoved = "removed"
+	DivergenceChanged = "changed"
+)
+
+// Divergence is a field of the shadow message that differs from the
+// published one. Field is a dotted path such as "build.created_at_ms".
+type Divergence struct {
+	Field string
+	Kind  string
+}
+
+// publishShadow starts publishing payload transformed with the shadow
+// schema version, comparing it with data, the message published to the
+// events topic. It returns a function waiting for the shadow publish.
+func (h *Handler) publishShadow(ctx context.Context, eventType string, payload buildkite.Payload, data, body []byte, attributes map[string]string) (wait func()) {
+	if h.shadowPublisher == nil {
+		return func() {}
+	}
+
+	shadow, err := h.transform(payload, transform.WithSchemaVersion(h.shadowSchemaVersion))
+	var shadowData []byte
+	if err == nil {
+		shadowData, err = jsoncodec.Marshal(shadow)
+	}
+	if err != nil {
+		metrics.ShadowPublishesTotal.WithLabelValues("transform_error").Inc()
+		return func() {}
+	}
+	recordDivergences(eventType, data, shadowData)
+
+	// The main publish stamps its attributes, so the shadow gets its own.
+	// Only the events topic's consumer confirms messages.
+	shadowAttributes := make(map[string]string, len(attributes))
+	for key, value := range attributes {
+		shadowAttributes[key] = value
+	}
+	delete(shadowAttributes, subscriber.ConfirmAttribute)
+	if url := h.schemaURL(h.shadowSchemaVersion); url != "" {
+		shadowAttributes[subscriber.SchemaURLAttribute] = url
+	}
+	h.addChecksum(shadowAttributes, shadowData, body)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		outcome := "published"
+		if _, err := h.shadowPublisher.Publish(ctx, json.RawMessage(shadowData), shadowAttributes); err != nil {
+			outcome = "failed"
+		}
+		metrics.ShadowPublishesTotal.WithLabelValues(outcome).Inc()
+	}()
+	return wg.Wait
+}
+
+// recordDivergences counts whether the shadow message differs from the
+// published one, and each field that does
+func recordDivergences(eventType string, published, shadow []byte) {
+	found, err := Divergences(published, shadow)
+	if err != nil {
+		return
+	}
+	result := "identical"
+	if len(found) > 0 {
+		result = "diverged"
+	}
+	metrics.ShadowComparisonsTotal.WithLabelValues(eventType, result).Inc()
+	for _, d := range found {
+		metrics.ShadowDivergencesTotal.WithLabelValues(d.Field, d.Kind).Inc()
+	}
+}
+
+// Divergences lists the fields where the shadow message differs from the
+// published one, up to two levels deep. Deeper differences are reported
+// against their parent, such as build.meta_data, and arrays are compared
+// whole.
+func Divergences(published, shadow []byte) ([]Divergence, error) {
+	var a, b interface{}
+	if err := json.Unmarshal(published, &a); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(shadow, &b); err != nil {
+		return nil, err
+	}
+	var found []Divergence
+	diverge(a, b, "", 0, &found)
+	return found, nil
+}
+
+func diverge(a, b interface{}, field string, depth int, found *[]Divergence) {
+	objA, okA := a.(map[string]interface{})
+	objB, okB := b.(map[string]interface{})
+	if !okA || !okB || depth == maxDivergenceDepth {
+		if !reflect.DeepEqual(a, b) {
+			*found = append(*found, Divergence{Field: field, Kind: DivergenceChanged})
+		}
+		return
+	}
+
+	for _, key := range sortedKeys(objA, objB) {
+		child := key
+		if field != "" {
+			child = field + "." + key
+		}
+		valueA, inA := objA[key]
+		valueB, inB := objB[key]
+		switch {
+		case !inA:
+			*found = append(*found, Divergence{Field: child, Kind: DivergenceAdded})
+		case !inB:
+			*found = append(*found, Divergence{Field: child, Kind: DivergenceRemoved})
+		default:
+			diverge(valueA, valueB, child, depth+1, found)
+		}
+	}
+}
+
+// sortedKeys returns the keys of both objects in order, so divergences are
+// reported in a stable order
+func sortedKeys(a, b map[string]interface{}) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,120 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook/webhooktest"
+)
+
+func TestHandlerShadowPublish(t *testing.T) {
+	reg := webhooktest.NewRegistry(t)
+
+	events, shadow := webhooktest.NewPublisher(), webhooktest.NewPublisher()
+	handler := NewHandler(Config{
+		BuildkiteToken:      "test-token",
+		Publisher:           events,
+		ShadowPublisher:     shadow,
+		ShadowSchemaVersion: "2",
+		ChecksumAlgorithm:   subscriber.ChecksumSHA256,
+	})
+
+	rr := webhooktest.Serve(handler, webhooktest.NewTokenRequest("/webhook", "test-token", webhooktest.Payload("build.finished")))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rr.Code, rr.Body)
+	}
+
+	published := webhooktest.AssertPublished(t, events, "build.finished")
+	if published.SchemaVersion != "" {
+		t.Errorf("published schema_version = %q, want the original format", published.SchemaVersion)
+	}
+	shadowed := webhooktest.AssertPublished(t, shadow, "build.finished")
+	if shadowed.SchemaVersion != "2" || shadowed.Build.FinishedAtMs == 0 {
+		t.Errorf("shadow schema_version = %q, finished_at_ms = %d, want version 2 fields", shadowed.SchemaVersion, shadowed.Build.FinishedAtMs)
+	}
+	// The shadow's checksum covers its own data
+	last := shadow.LastPublished()
+	data, _ := json.Marshal(last.Data)
+	if err := subscriber.VerifyChecksum(data, last.Attributes); err != nil {
+		t.Errorf("shadow checksum: %v", err)
+	}
+
+	webhooktest.AssertCounter(t, reg, "buildkite_webhook_shadow_publishes_total", map[string]string{"outcome": "published"}, 1)
+	webhooktest.AssertCounter(t, reg, "buildkite_webhook_shadow_comparisons_total", map[string]string{"event_type": "build.finished", "result": "diverged"}, 1)
+	webhooktest.AssertCounter(t, reg, "buildkite_webhook_shadow_divergences_total", map[string]string{"field": "schema_version", "kind": "added"}, 1)
+	webhooktest.AssertCounter(t, reg, "buildkite_webhook_shadow_divergences_total", map[string]string{"field": "build.finished_at_ms", "kind": "added"}, 1)
+
+	// A failed shadow publish does not fail the webhook
+	shadow.SetError(errors.New("shadow topic not found"))
+	rr = webhooktest.Serve(handler, webhooktest.NewTokenRequest("/webhook", "test-token", webhooktest.Payload("build.finished")))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status with a failing shadow = %d: %s", rr.Code, rr.Body)
+	}
+	webhooktest.AssertPublishedCount(t, events, 2)
+	webhooktest.AssertCounter(t, reg, "buildkite_webhook_shadow_publishes_total", map[string]string{"outcome": "failed"}, 1)
+
+	// Unsupported events are published as received, so have no shadow
+	rr = webhooktest.Serve(handler, webhooktest.NewTokenRequest("/webhook", "test-token", []byte(`{"event":"cluster.updated"}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unsupported event status = %d: %s", rr.Code, rr.Body)
+	}
+	if got := shadow.CallCount(); got != 2 {
+		t.Errorf("shadow publishes = %d, want 2", got)
+	}
+}
+
+func TestDivergences(t *testing.T) {
+	tests := []struct {
+		name              string
+		published, shadow string
+		want              []Divergence
+	}{
+		{
+			name:      "identical",
+			published: `{"event_type":"build.finished","build":{"id":"1"}}`,
+			shadow:    `{"build":{"id":"1"},"event_type":"build.finished"}`,
+		},
+		{
+			name:      "added, removed and changed",
+			published: `{"build":{"id":"1","state":"passed","url":"u"}}`,
+			shadow:    `{"build":{"id":"1","state":"failed","number":2},"schema_version":"2"}`,
+			want: []Divergence{
+				{Field: "build.number", Kind: DivergenceAdded},
+				{Field: "build.state", Kind: DivergenceChanged},
+				{Field: "build.url", Kind: DivergenceRemoved},
+				{Field: "schema_version", Kind: DivergenceAdded},
+			},
+		},
+		{
+			name:      "deep fields are reported against their parent",
+			published: `{"build":{"meta_data":{"release":"v1"}}}`,
+			shadow:    `{"build":{"meta_data":{"release":"v2","team":"x"}}}`,
+			want:      []Divergence{{Field: "build.meta_data", Kind: DivergenceChanged}},
+		},
+		{
+			name:      "arrays are compared whole",
+			published: `{"agent":{"tags":["a","b"]}}`,
+			shadow:    `{"agent":{"tags":["a"]}}`,
+			want:      []Divergence{{Field: "agent.tags", Kind: DivergenceChanged}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Divergences([]byte(tt.published), []byte(tt.shadow))
+			if err != nil {
+				t.Fatalf("Divergences() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Divergences() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := Divergences([]byte(`{}`), []byte(`not json`)); err == nil {
+		t.Error("Divergences() of invalid JSON error = nil, want error")
+	}
+}
@@ -0,0 +1,64 @@
+package webhook
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+)
+
+// Phases of a webhook request, timed in the phase duration histogram and the
+// Server-Timing header. Each phase runs from the end of the one before it,
+// so together they cover the whole request.
+const (
+	phaseAuth      = "auth"
+	phaseRead      = "read"
+	phaseParse     = "parse"
+	phaseTransform = "transform"
+	phasePublish   = "publish"
+	phaseConfirm   = "confirm"
+	phaseRespond   = "respond"
+)
+
+// phaseTimer times the phases of a webhook request
+type phaseTimer struct {
+	last time.Time
+	// order lists the phases in the order they were first marked
+	order  []string
+	totals map[string]time.Duration
+}
+
+// newPhaseTimer starts timing a request that started at start
+func newPhaseTimer(start time.Time) *phaseTimer {
+	return &phaseTimer{last: start, totals: make(map[string]time.Duration)}
+}
+
+// mark ends phase, adding the time since the previous mark to it; a phase
+// marked again, such as publish after derived messages, accumulates
+func (t *phaseTimer) mark(phase string) {
+	now := time.Now()
+	if _, ok := t.totals[phase]; !ok {
+		t.order = append(t.order, phase)
+	}
+	t.totals[phase] += now.Sub(t.last)
+	t.last = now
+}
+
+// header returns the phases marked so far as a Server-Timing header value,
+// with durations in milliseconds
+func (t *phaseTimer) header() string {
+	entries := make([]string, len(t.order))
+	for i, phase := range t.order {
+		ms := float64(t.totals[phase]) / float64(time.Millisecond)
+		entries[i] = phase + ";dur=" + strconv.FormatFloat(ms, 'f', 3, 64)
+	}
+	return strings.Join(entries, ", ")
+}
+
+// observe records the duration of each phase marked
+func (t *phaseTimer) observe() {
+	for _, phase := range t.order {
+		metrics.WebhookPhaseDuration.WithLabelValues(phase).Observe(t.totals[phase].Seconds())
+	}
+}
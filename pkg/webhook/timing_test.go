@@ -0,0 +1,61 @@
+package webhook
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook/webhooktest"
+)
+
+func TestHandlerPhaseTimings(t *testing.T) {
+	reg := webhooktest.NewRegistry(t)
+	if err := metrics.InitMetrics(reg); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	pub := webhooktest.NewPublisher()
+	handler := NewHandler(Config{
+		BuildkiteToken: "test-token",
+		Publisher:      pub,
+		ServerTiming:   true,
+	})
+
+	rr := webhooktest.Serve(handler, webhooktest.NewTokenRequest("/webhook", "test-token", webhooktest.Payload("build.finished")))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rr.Code, rr.Body)
+	}
+	// respond ends after the header is written, so only the histogram has it
+	header := rr.Header().Get("Server-Timing")
+	var phases []string
+	for _, entry := range strings.Split(header, ", ") {
+		name, dur, ok := strings.Cut(entry, ";dur=")
+		if !ok || dur == "" {
+			t.Fatalf("Server-Timing entry %q has no duration", entry)
+		}
+		phases = append(phases, name)
+	}
+	if got, want := strings.Join(phases, ","), "auth,read,parse,transform,publish"; got != want {
+		t.Errorf("Server-Timing phases = %s, want %s", got, want)
+	}
+	for _, phase := range []string{phaseAuth, phaseRead, phaseParse, phaseTransform, phasePublish, phaseRespond} {
+		if n := webhooktest.HistogramCount(t, reg, "buildkite_webhook_phase_duration_seconds", map[string]string{"phase": phase}); n != 1 {
+			t.Errorf("phase %s observed %d times, want 1", phase, n)
+		}
+	}
+
+	// A rejected request times the phases it reached, and the header is off
+	// unless configured
+	handler = NewHandler(Config{BuildkiteToken: "test-token", Publisher: pub})
+	rr = webhooktest.Serve(handler, webhooktest.NewTokenRequest("/webhook", "wrong-token", webhooktest.Payload("build.finished")))
+	if rr.Header().Get("Server-Timing") != "" {
+		t.Errorf("Server-Timing = %q without ServerTiming, want none", rr.Header().Get("Server-Timing"))
+	}
+	if n := webhooktest.HistogramCount(t, reg, "buildkite_webhook_phase_duration_seconds", map[string]string{"phase": phaseAuth}); n != 2 {
+		t.Errorf("auth phase observed %d times, want 2", n)
+	}
+	if n := webhooktest.HistogramCount(t, reg, "buildkite_webhook_phase_duration_seconds", map[string]string{"phase": phaseRead}); n != 1 {
+		t.Errorf("read phase observed %d times after a rejection, want 1", n)
+	}
+}
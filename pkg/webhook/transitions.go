@@ -0,0 +1,81 @@
+package webhook
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/ttlcache"
+)
+
+// TransitionTracker remembers the last state of recently seen builds, so a
+// build.* event repeating a terminal state the build already reached is
+// published once. It is bounded by a TTL and a maximum number of builds, and
+// safe for concurrent use.
+type TransitionTracker struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu     sync.Mutex
+	builds *ttlcache.Cache[string, buildState]
+}
+
+// buildState is a build's last observed state
+type buildState struct {
+	state     string
+	terminal  bool
+	expiresAt time.Time
+}
+
+// NewTransitionTracker creates a tracker remembering up to maxBuilds builds
+// for ttl after their last event
+func NewTransitionTracker(ttl time.Duration, maxBuilds int) *TransitionTracker {
+	return &TransitionTracker{
+		ttl:    ttl,
+		now:    time.Now,
+		builds: ttlcache.New[string, buildState](max(maxBuilds, 1)),
+	}
+}
+
+// Observe records a build's state and reports whether it repeats the
+// terminal state last recorded for the build. Unless it is a duplicate, the
+// returned undo restores the previous record, for when the event could not
+// be published.
+func (t *TransitionTracker) Observe(buildID, state string, terminal bool) (duplicate bool, undo func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	t.builds.Expire(now)
+
+	var previous *buildState
+	if prev, ok := t.builds.Get(buildID); ok {
+		if terminal && prev.terminal && prev.state == state {
+			return true, func() {}
+		}
+		previous = &prev
+	}
+	expiresAt := now.Add(t.ttl)
+	t.builds.Set(buildID, buildState{state: state, terminal: terminal, expiresAt: expiresAt}, expiresAt)
+
+	return false, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		// Leave the record alone if a later event has replaced it
+		current, ok := t.builds.Get(buildID)
+		if !ok || current.state != state {
+			return
+		}
+		t.builds.Delete(buildID)
+		if previous != nil && t.now().Before(previous.expiresAt) {
+			t.builds.Set(buildID, *previous, previous.expiresAt)
+		}
+	}
+}
+
+// Len returns the number of builds remembered
+func (t *TransitionTracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.builds.Len()
+}
@@ -0,0 +1,120 @@
+package webhook
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook/webhooktest"
+)
+
+func TestTransitionTracker(t *testing.T) {
+	now := time.Now()
+	tracker := NewTransitionTracker(time.Hour, 2)
+	tracker.now = func() time.Time { return now }
+
+	if dup, _ := tracker.Observe("b1", "failed", true); dup {
+		t.Fatal("first terminal state reported as a duplicate")
+	}
+	if dup, _ := tracker.Observe("b1", "failed", true); !dup {
+		t.Error("repeated terminal state not reported as a duplicate")
+	}
+	if dup, _ := tracker.Observe("b1", "passed", true); dup {
+		t.Error("a different terminal state reported as a duplicate")
+	}
+
+	// A retried job takes the build back through running
+	tracker.Observe("b1", "running", false)
+	if dup, _ := tracker.Observe("b1", "passed", true); dup {
+		t.Error("terminal state after running again reported as a duplicate")
+	}
+	if dup, _ := tracker.Observe("b2", "running", false); dup {
+		t.Error("non-terminal state reported as a duplicate")
+	}
+	if dup, _ := tracker.Observe("b2", "running", false); dup {
+		t.Error("repeated non-terminal state reported as a duplicate")
+	}
+
+	// b1 is the oldest, so a third build evicts it
+	tracker.Observe("b3", "passed", true)
+	if tracker.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", tracker.Len())
+	}
+	if dup, _ := tracker.Observe("b1", "passed", true); dup {
+		t.Error("evicted build reported as a duplicate")
+	}
+
+	now = now.Add(time.Hour)
+	if dup, _ := tracker.Observe("b1", "passed", true); dup {
+		t.Error("expired build reported as a duplicate")
+	}
+	if tracker.Len() != 1 {
+		t.Errorf("Len() after expiry = %d, want 1", tracker.Len())
+	}
+}
+
+func TestTransitionTrackerUndo(t *testing.T) {
+	tracker := NewTransitionTracker(time.Hour, 10)
+
+	tracker.Observe("b1", "running", false)
+	_, undo := tracker.Observe("b1", "failed", true)
+	undo()
+	if dup, _ := tracker.Observe("b1", "failed", true); dup {
+		t.Error("undone terminal state reported as a duplicate")
+	}
+
+	// Undo leaves a later state alone
+	_, undo = tracker.Observe("b2", "failed", true)
+	tracker.Observe("b2", "running", false)
+	tracker.Observe("b2", "passed", true)
+	undo()
+	if dup, _ := tracker.Observe("b2", "passed", true); !dup {
+		t.Error("undo of an earlier event removed a later state")
+	}
+}
+
+func TestHandlerTransitions(t *testing.T) {
+	reg := webhooktest.NewRegistry(t)
+	if err := metrics.InitMetrics(reg); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	pub := webhooktest.NewPublisher()
+	handler := NewHandler(Config{
+		BuildkiteToken: "test-token",
+		Publisher:      pub,
+		Transitions:    NewTransitionTracker(time.Hour, 100),
+	})
+	send := func(eventType, state string) {
+		t.Helper()
+		body := webhooktest.Payload(eventType, webhooktest.WithBuildID("b1"), webhooktest.WithBuildState(state))
+		rr := webhooktest.Serve(handler, webhooktest.NewTokenRequest("/webhook", "test-token", body))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s %s: status = %d: %s", eventType, state, rr.Code, rr.Body)
+		}
+	}
+
+	send("build.finished", "failed")
+	send("build.finished", "failed")
+	// Job events carry the build's state but are never suppressed
+	send("job.finished", "failed")
+	send("job.finished", "failed")
+	webhooktest.AssertPublishedCount(t, pub, 3)
+	webhooktest.AssertCounter(t, reg, "buildkite_webhook_duplicate_transitions_total",
+		map[string]string{"event_type": "build.finished", "state": "failed"}, 1)
+
+	// A failed publish leaves the state for Buildkite's retry to publish
+	pub.SetError(fmt.Errorf("%w", publisher.ErrQueueFull))
+	body := webhooktest.Payload("build.finished", webhooktest.WithBuildID("b2"), webhooktest.WithBuildState("passed"))
+	if rr := webhooktest.Serve(handler, webhooktest.NewTokenRequest("/webhook", "test-token", body)); rr.Code == http.StatusOK {
+		t.Fatalf("status = %d with a failing publisher, want an error", rr.Code)
+	}
+	pub.SetError(nil)
+	if rr := webhooktest.Serve(handler, webhooktest.NewTokenRequest("/webhook", "test-token", body)); rr.Code != http.StatusOK {
+		t.Fatalf("retry status = %d: %s", rr.Code, rr.Body)
+	}
+	webhooktest.AssertPublishedCount(t, pub, 4)
+}
@@ -0,0 +1,62 @@
+package webhook
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/ttlcache"
+)
+
+// BlockTracker remembers when recently seen builds became blocked, so the
+// handler can publish a build.unblocked event when a blocked build runs
+// again. It is bounded by a TTL and a maximum number of builds, and safe for
+// concurrent use.
+type BlockTracker struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu sync.Mutex
+	// builds holds when each build became blocked
+	builds *ttlcache.Cache[string, time.Time]
+}
+
+// NewBlockTracker creates a tracker remembering up to maxBuilds blocked
+// builds for ttl after they became blocked
+func NewBlockTracker(ttl time.Duration, maxBuilds int) *BlockTracker {
+	return &BlockTracker{
+		ttl:    ttl,
+		now:    time.Now,
+		builds: ttlcache.New[string, time.Time](max(maxBuilds, 1)),
+	}
+}
+
+// Block records that a build was blocked at since. A build already blocked
+// keeps the time it first became blocked.
+func (t *BlockTracker) Block(buildID string, since time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	t.builds.Expire(now)
+	if _, ok := t.builds.Get(buildID); ok {
+		return
+	}
+	t.builds.Set(buildID, since, now.Add(t.ttl))
+}
+
+// Unblock forgets a blocked build, returning when it became blocked; ok is
+// false when the build was not remembered as blocked
+func (t *BlockTracker) Unblock(buildID string) (since time.Time, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.builds.Expire(t.now())
+	return t.builds.Delete(buildID)
+}
+
+// Len returns the number of blocked builds remembered
+func (t *BlockTracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.builds.Len()
+}
@@ -0,0 +1,116 @@
+package webhook
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+	"github.com/mcncl/buildkite-pubsub/pkg/subscriber"
+	"github.com/mcncl/buildkite-pubsub/pkg/transform"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook/webhooktest"
+)
+
+func TestBlockTracker(t *testing.T) {
+	now := time.Now()
+	tracker := NewBlockTracker(time.Hour, 2)
+	tracker.now = func() time.Time { return now }
+
+	blockedAt := now.Add(-time.Minute)
+	tracker.Block("b1", blockedAt)
+	// A build blocked again keeps the time it first became blocked
+	tracker.Block("b1", now)
+	if since, ok := tracker.Unblock("b1"); !ok || !since.Equal(blockedAt) {
+		t.Errorf("Unblock() = %v, %v, want %v, true", since, ok, blockedAt)
+	}
+	if _, ok := tracker.Unblock("b1"); ok {
+		t.Error("Unblock() of an unblocked build = true")
+	}
+
+	// b2 is the oldest, so a third build evicts it
+	tracker.Block("b2", now)
+	tracker.Block("b3", now)
+	tracker.Block("b4", now)
+	if tracker.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", tracker.Len())
+	}
+	if _, ok := tracker.Unblock("b2"); ok {
+		t.Error("Unblock() of an evicted build = true")
+	}
+
+	now = now.Add(time.Hour)
+	if _, ok := tracker.Unblock("b3"); ok {
+		t.Error("Unblock() of an expired build = true")
+	}
+	if tracker.Len() != 0 {
+		t.Errorf("Len() after expiry = %d, want 0", tracker.Len())
+	}
+}
+
+func TestHandlerUnblockEvents(t *testing.T) {
+	reg := webhooktest.NewRegistry(t)
+	if err := metrics.InitMetrics(reg); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+
+	pub := webhooktest.NewPublisher()
+	handler := NewHandler(Config{
+		BuildkiteToken: "test-token",
+		Publisher:      pub,
+		Blocks:         NewBlockTracker(time.Hour, 100),
+		// Checksum the webhook body, which the derived event cannot share
+		ChecksumAlgorithm: subscriber.ChecksumSHA256,
+		ChecksumRaw:       true,
+	})
+	send := func(eventType, buildID, state string, blocked bool) {
+		t.Helper()
+		body := webhooktest.Payload(eventType,
+			webhooktest.WithBuildID(buildID),
+			webhooktest.WithBuildState(state),
+			webhooktest.WithField("build.blocked", blocked))
+		rr := webhooktest.Serve(handler, webhooktest.NewTokenRequest("/webhook", "test-token", body))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s %s: status = %d: %s", eventType, state, rr.Code, rr.Body)
+		}
+	}
+
+	send("build.finished", "b1", "blocked", true)
+	webhooktest.AssertAttributes(t, pub, map[string]string{"normalized_state": "blocked", "is_blocked": "true"})
+	send("build.running", "b1", "running", false)
+	webhooktest.AssertPublishedCount(t, pub, 3)
+
+	unblocked := webhooktest.AssertPublished(t, pub, transform.EventBuildUnblocked)
+	if unblocked.EventType != transform.EventBuildUnblocked || unblocked.Build.ID != "b1" {
+		t.Errorf("unblocked event = %s for %s, want build.unblocked for b1", unblocked.EventType, unblocked.Build.ID)
+	}
+	if u := unblocked.Unblock; u == nil || u.UnblockedAt.Before(u.BlockedAt) || u.BlockedSeconds < 0 {
+		t.Errorf("unblock = %+v, want blocked_at before unblocked_at", u)
+	}
+	last := pub.LastPublished()
+	if _, ok := last.Attributes["delivery_id"]; ok {
+		t.Error("build.unblocked carries the webhook's delivery_id")
+	}
+	if last.Attributes[subscriber.ChecksumPayloadAttribute] != subscriber.ChecksumPayloadData {
+		t.Errorf("checksum_payload = %q, want the derived message's data", last.Attributes[subscriber.ChecksumPayloadAttribute])
+	}
+	webhooktest.AssertCounter(t, reg, "buildkite_webhook_unblock_events_total", map[string]string{"outcome": "published"}, 1)
+
+	// Running again, or a build never seen blocked, derives nothing
+	send("build.running", "b1", "running", false)
+	send("build.running", "b2", "running", false)
+	webhooktest.AssertPublishedCount(t, pub, 5)
+
+	// A blocked build that is canceled is forgotten
+	send("build.finished", "b3", "blocked", true)
+	send("build.finished", "b3", "canceled", false)
+	send("build.running", "b3", "running", false)
+	webhooktest.AssertPublishedCount(t, pub, 8)
+
+	// A failed publish of the derived event does not fail the webhook
+	send("build.finished", "b4", "blocked", true)
+	// The build.running message is the next call, and build.unblocked the one after
+	pub.FailOn(publisher.ErrQueueFull, pub.CallCount()+2)
+	send("build.running", "b4", "running", false)
+	webhooktest.AssertCounter(t, reg, "buildkite_webhook_unblock_events_total", map[string]string{"outcome": "failed"}, 1)
+}
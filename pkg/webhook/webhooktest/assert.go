@@ -0,0 +1,134 @@
+package webhooktest
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mcncl/buildkite-pubsub/internal/metrics"
+	"github.com/mcncl/buildkite-pubsub/internal/publisher"
+	"github.com/mcncl/buildkite-pubsub/pkg/transform"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// NewPublisher returns a mock publisher recording every message, to pass as
+// the handler's Publisher. Its responses can be scripted to simulate failures.
+func NewPublisher() *publisher.MockPublisher {
+	return publisher.NewMockPublisher().(*publisher.MockPublisher)
+}
+
+// NewRegistry returns a fresh registry with the service's metrics registered
+// on it, so counters start from zero in every test
+func NewRegistry(t testing.TB) *prometheus.Registry {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	if err := metrics.InitMetrics(reg); err != nil {
+		t.Fatalf("failed to initialize metrics: %v", err)
+	}
+	return reg
+}
+
+// AssertPublished fails the test unless pub published a message with the
+// event_type attribute eventType, and returns the latest such payload
+func AssertPublished(t testing.TB, pub *publisher.MockPublisher, eventType string) transform.TransformedPayload {
+	t.Helper()
+	published := pub.GetPublished()
+	for i := len(published) - 1; i >= 0; i-- {
+		if published[i].Attributes["event_type"] != eventType {
+			continue
+		}
+		data, err := json.Marshal(published[i].Data)
+		if err != nil {
+			t.Fatalf("failed to encode published %s message: %v", eventType, err)
+		}
+		var payload transform.TransformedPayload
+		if err := json.Unmarshal(data, &payload); err != nil {
+			t.Fatalf("failed to decode published %s message: %v", eventType, err)
+		}
+		return payload
+	}
+	t.Fatalf("no %s message published (%d messages published)", eventType, len(published))
+	return transform.TransformedPayload{}
+}
+
+// AssertPublishedCount fails the test unless pub published exactly want messages
+func AssertPublishedCount(t testing.TB, pub *publisher.MockPublisher, want int) {
+	t.Helper()
+	if got := len(pub.GetPublished()); got != want {
+		t.Errorf("published %d messages, want %d", got, want)
+	}
+}
+
+// AssertAttributes fails the test unless the last published message carries
+// every attribute in want
+func AssertAttributes(t testing.TB, pub *publisher.MockPublisher, want map[string]string) {
+	t.Helper()
+	last := pub.LastPublished()
+	if last == nil {
+		t.Fatal("no message published")
+	}
+	for key, value := range want {
+		if got, ok := last.Attributes[key]; !ok || got != value {
+			t.Errorf("attribute %s = %q, want %q", key, got, value)
+		}
+	}
+}
+
+// CounterValue returns the sum of the counter series named name whose labels
+// include every label in labels, or 0 when there are none
+func CounterValue(t testing.TB, g prometheus.Gatherer, name string, labels map[string]string) float64 {
+	t.Helper()
+	var total float64
+	for _, m := range series(t, g, name, labels) {
+		total += m.GetCounter().GetValue()
+	}
+	return total
+}
+
+// HistogramCount returns the number of observations in the histogram series
+// named name whose labels include every label in labels
+func HistogramCount(t testing.TB, g prometheus.Gatherer, name string, labels map[string]string) uint64 {
+	t.Helper()
+	var total uint64
+	for _, m := range series(t, g, name, labels) {
+		total += m.GetHistogram().GetSampleCount()
+	}
+	return total
+}
+
+// series returns the series named name whose labels include every label in
+// labels
+func series(t testing.TB, g prometheus.Gatherer, name string, labels map[string]string) []*dto.Metric {
+	t.Helper()
+	families, err := g.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+
+	var matches []*dto.Metric
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			matched := 0
+			for _, pair := range m.GetLabel() {
+				if value, ok := labels[pair.GetName()]; ok && value == pair.GetValue() {
+					matched++
+				}
+			}
+			if matched == len(labels) {
+				matches = append(matches, m)
+			}
+		}
+	}
+	return matches
+}
+
+// AssertCounter fails the test unless CounterValue returns want
+func AssertCounter(t testing.TB, g prometheus.Gatherer, name string, labels map[string]string, want float64) {
+	t.Helper()
+	if got := CounterValue(t, g, name, labels); got != want {
+		t.Errorf("%s%v = %v, want %v", name, labels, got, want)
+	}
+}
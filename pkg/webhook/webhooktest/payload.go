@@ -0,0 +1,250 @@
+package webhooktest
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// EventTypes lists the events Payload generates fixtures for
+var EventTypes = []string{
+	"ping",
+	"build.scheduled",
+	"build.running",
+	"build.failing",
+	"build.finished",
+	"job.scheduled",
+	"job.started",
+	"job.finished",
+	"job.activated",
+	"agent.connected",
+	"agent.disconnected",
+	"agent.lost",
+	"agent.stopping",
+	"agent.stopped",
+}
+
+// Default identifiers used in generated payloads
+const (
+	DefaultBuildID   = "0194a0c3-27e1-4a4b-9c1e-000000000697"
+	DefaultJobID     = "0194a0c4-0000-4000-8000-000000000001"
+	DefaultAgentID   = "0194a0c3-27e1-4a4b-9c1e-5b2d3f4a6c7d"
+	DefaultPipeline  = "basic-pipeline"
+	DefaultBranch    = "main"
+	DefaultClusterID = "c5b6e1a2-0d7f-4b8e-9a63-2f1d0c9e8b7a"
+)
+
+// states maps event types to the build, job or agent state Buildkite sends
+// with them; events not listed use the state of the .finished or .connected event
+var states = map[string]string{
+	"build.scheduled":    "scheduled",
+	"build.running":      "running",
+	"build.failing":      "failing",
+	"job.scheduled":      "scheduled",
+	"job.started":        "running",
+	"job.activated":      "assigned",
+	"agent.disconnected": "disconnected",
+	"agent.lost":         "lost",
+	"agent.stopping":     "stopping",
+	"agent.stopped":      "stopped",
+}
+
+// PayloadOption customizes a generated payload
+type PayloadOption func(map[string]interface{})
+
+// WithBuildID sets build.id
+func WithBuildID(id string) PayloadOption {
+	return WithField("build.id", id)
+}
+
+// WithBuildState sets build.state
+func WithBuildState(state string) PayloadOption {
+	return WithField("build.state", state)
+}
+
+// WithPipeline sets the pipeline slug and name
+func WithPipeline(slug string) PayloadOption {
+	return func(p map[string]interface{}) {
+		setField(p, "pipeline.slug", slug)
+		setField(p, "pipeline.name", slug)
+	}
+}
+
+// WithBranch sets build.branch
+func WithBranch(branch string) PayloadOption {
+	return WithField("build.branch", branch)
+}
+
+// WithAgentQueue sets the agent's queue tag
+func WithAgentQueue(queue string) PayloadOption {
+	return WithField("agent.meta_data", []string{"queue=" + queue, "os=linux"})
+}
+
+// WithField sets the field at a dotted path such as "build.meta_data.release",
+// creating intermediate objects as needed. A nil value removes the field.
+func WithField(path string, value interface{}) PayloadOption {
+	return func(p map[string]interface{}) {
+		setField(p, path, value)
+	}
+}
+
+// Payload returns a realistic Buildkite webhook payload for eventType, based
+// on the payloads Buildkite documents. Event types not in EventTypes get a
+// build payload with the given event name.
+func Payload(eventType string, opts ...PayloadOption) []byte {
+	p := payloadFor(eventType)
+	for _, opt := range opts {
+		opt(p)
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		panic("webhooktest: marshal payload: " + err.Error())
+	}
+	return body
+}
+
+// payloadFor builds the fixture for eventType
+func payloadFor(eventType string) map[string]interface{} {
+	p := map[string]interface{}{
+		"event":  eventType,
+		"sender": user(),
+	}
+
+	switch {
+	case eventType == "ping":
+		p["service"] = map[string]interface{}{
+			"id":       "0194a0c3-0000-4000-8000-00000000beef",
+			"provider": "webhook",
+			"settings": map[string]interface{}{"url": "https://example.com/webhook"},
+		}
+	case strings.HasPrefix(eventType, "agent."):
+		p["agent"] = agent(stateFor(eventType, "connected"))
+	case strings.HasPrefix(eventType, "job."):
+		p["job"] = job(stateFor(eventType, "passed"))
+		p["build"] = build("running")
+		p["pipeline"] = pipeline()
+	default:
+		p["build"] = build(stateFor(eventType, "passed"))
+		p["pipeline"] = pipeline()
+	}
+	return p
+}
+
+func stateFor(eventType, fallback string) string {
+	if state, ok := states[eventType]; ok {
+		return state
+	}
+	return fallback
+}
+
+func user() map[string]interface{} {
+	return map[string]interface{}{
+		"id":    "01831b25-7d66-431e-8dcf-6d7ff40c5255",
+		"name":  "Test User",
+		"email": "test@example.com",
+	}
+}
+
+func build(state string) map[string]interface{} {
+	b := map[string]interface{}{
+		"id":           DefaultBuildID,
+		"graphql_id":   "QnVpbGQtLS0wMTk0YTBjMw==",
+		"url":          "https://api.buildkite.com/v2/organizations/testkite/pipelines/" + DefaultPipeline + "/builds/697",
+		"web_url":      "https://buildkite.com/testkite/" + DefaultPipeline + "/builds/697",
+		"number":       697,
+		"state":        state,
+		"message":      "Update README",
+		"commit":       "b2a9e3f8c1d4",
+		"branch":       DefaultBranch,
+		"tag":          nil,
+		"source":       "ui",
+		"creator":      user(),
+		"created_at":   "2025-01-07T01:02:03.000Z",
+		"scheduled_at": "2025-01-07T01:02:03.000Z",
+		"started_at":   nil,
+		"finished_at":  nil,
+		"meta_data":    map[string]interface{}{},
+		"cluster_id":   DefaultClusterID,
+	}
+	if state != "scheduled" {
+		b["started_at"] = "2025-01-07T01:02:10.000Z"
+	}
+	switch state {
+	case "passed", "failed", "canceled":
+		b["finished_at"] = "2025-01-07T01:04:40.000Z"
+	}
+	return b
+}
+
+func pipeline() map[string]interface{} {
+	return map[string]interface{}{
+		"id":          "0189b873-e493-4675-b964-a085ddc4b927",
+		"graphql_id":  "UGlwZWxpbmUtLS0wMTg5Yjg3Mw==",
+		"url":         "https://api.buildkite.com/v2/organizations/testkite/pipelines/" + DefaultPipeline,
+		"web_url":     "https://buildkite.com/testkite/" + DefaultPipeline,
+		"name":        DefaultPipeline,
+		"description": "Has no special config just standard steps.",
+		"slug":        DefaultPipeline,
+		"repository":  "git@github.com:testkite/basic-pipeline.git",
+		"provider": map[string]interface{}{
+			"id":       "github",
+			"settings": map[string]interface{}{"trigger_mode": "code"},
+		},
+		"created_at": "2023-08-07T04:12:03.000Z",
+	}
+}
+
+func job(state string) map[string]interface{} {
+	j := map[string]interface{}{
+		"id":                DefaultJobID,
+		"type":              "script",
+		"name":              "Test",
+		"state":             state,
+		"agent_query_rules": []string{"queue=linux"},
+		"exit_status":       nil,
+	}
+	if state == "passed" {
+		j["exit_status"] = 0
+	}
+	return j
+}
+
+func agent(state string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":                   DefaultAgentID,
+		"graphql_id":           "QWdlbnQtLS0wMTk0YTBjMw==",
+		"url":                  "https://api.buildkite.com/v2/organizations/testkite/agents/0194a0c3",
+		"web_url":              "https://buildkite.com/organizations/testkite/agents/0194a0c3",
+		"name":                 "builder-1",
+		"connection_state":     state,
+		"hostname":             "builder-1.internal",
+		"ip_address":           "10.0.0.12",
+		"user_agent":           "buildkite-agent/3.87.0.10000 (linux; amd64)",
+		"version":              "3.87.0",
+		"creator":              nil,
+		"created_at":           "2025-01-07T00:00:00.000Z",
+		"last_job_finished_at": nil,
+		"priority":             0,
+		"meta_data":            []string{"queue=linux", "os=linux"},
+		"cluster_id":           DefaultClusterID,
+	}
+}
+
+// setField sets or, when value is nil, deletes the field at a dotted path
+func setField(p map[string]interface{}, path string, value interface{}) {
+	parts := strings.Split(path, ".")
+	obj := p
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := obj[part].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			obj[part] = child
+		}
+		obj = child
+	}
+	last := parts[len(parts)-1]
+	if value == nil {
+		delete(obj, last)
+		return
+	}
+	obj[last] = value
+}
@@ -0,0 +1,59 @@
+// Package webhooktest provides utilities for testing code built on the
+// webhook handler: authenticated Buildkite requests, realistic payload
+// fixtures and assertions on published messages and metrics.
+package webhooktest
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/pkg/buildkiteauth"
+)
+
+// DefaultTarget is the path requests are sent to when target is empty
+const DefaultTarget = "/webhook"
+
+// NewRequest returns an unauthenticated Buildkite webhook delivery of body
+func NewRequest(target string, body []byte) *http.Request {
+	if target == "" {
+		target = DefaultTarget
+	}
+	req := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+// NewTokenRequest returns a delivery authenticated with the X-Buildkite-Token header
+func NewTokenRequest(target, token string, body []byte) *http.Request {
+	req := NewRequest(target, body)
+	req.Header.Set(buildkiteauth.TokenHeader, token)
+	return req
+}
+
+// NewSignedRequest returns a delivery signed with secret at the current time
+func NewSignedRequest(target, secret string, body []byte) *http.Request {
+	return NewSignedRequestAt(target, secret, body, time.Now())
+}
+
+// NewSignedRequestAt returns a delivery signed with secret at ts, for testing
+// expired or future signatures
+func NewSignedRequestAt(target, secret string, body []byte, ts time.Time) *http.Request {
+	req := NewRequest(target, body)
+	req.Header.Set(buildkiteauth.SignatureHeader, SignatureHeader(secret, ts, body))
+	return req
+}
+
+// SignatureHeader returns the X-Buildkite-Signature value for body signed at ts
+func SignatureHeader(secret string, ts time.Time, body []byte) string {
+	return fmt.Sprintf("timestamp=%d,signature=%s", ts.Unix(), buildkiteauth.Sign(secret, ts.Unix(), body))
+}
+
+// Serve sends req to h and returns the recorded response
+func Serve(h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
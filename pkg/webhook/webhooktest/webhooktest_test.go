@@ -0,0 +1,99 @@
+package webhooktest_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mcncl/buildkite-pubsub/pkg/transform"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook"
+	"github.com/mcncl/buildkite-pubsub/pkg/webhook/webhooktest"
+)
+
+func TestPayloadFixtures(t *testing.T) {
+	for _, eventType := range webhooktest.EventTypes {
+		t.Run(eventType, func(t *testing.T) {
+			var payload transform.Payload
+			if err := json.Unmarshal(webhooktest.Payload(eventType), &payload); err != nil {
+				t.Fatalf("failed to decode payload: %v", err)
+			}
+			if payload.Event != eventType {
+				t.Errorf("event = %q, want %q", payload.Event, eventType)
+			}
+		})
+	}
+}
+
+func TestPayloadOptions(t *testing.T) {
+	body := webhooktest.Payload("build.finished",
+		webhooktest.WithBuildID("build-1"),
+		webhooktest.WithBuildState("failed"),
+		webhooktest.WithPipeline("deploy"),
+		webhooktest.WithBranch("release/v2"),
+		webhooktest.WithField("build.meta_data.release", "v2.0.0"),
+		webhooktest.WithField("build.cluster_id", nil),
+	)
+
+	var payload transform.Payload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatalf("failed to decode payload: %v", err)
+	}
+	b := payload.Build
+	if b.ID != "build-1" || b.State != "failed" || b.Branch != "release/v2" || payload.Pipeline.Slug != "deploy" {
+		t.Errorf("build = %+v pipeline = %q, want the overridden fields", b, payload.Pipeline.Slug)
+	}
+	if b.MetaData["release"] != "v2.0.0" || b.ClusterID != "" {
+		t.Errorf("meta_data = %v cluster_id = %q, want release set and cluster_id removed", b.MetaData, b.ClusterID)
+	}
+}
+
+func TestTokenRequest(t *testing.T) {
+	reg := webhooktest.NewRegistry(t)
+	pub := webhooktest.NewPublisher()
+	handler := webhook.NewHandler(webhook.Config{
+		BuildkiteToken: "test-token",
+		Publisher:      pub,
+	})
+
+	body := webhooktest.Payload("build.finished", webhooktest.WithPipeline("deploy"))
+	if w := webhooktest.Serve(handler, webhooktest.NewTokenRequest("", "test-token", body)); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := webhooktest.Serve(handler, webhooktest.NewTokenRequest("", "wrong-token", body)); w.Code != http.StatusUnauthorized {
+		t.Errorf("status with wrong token = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	payload := webhooktest.AssertPublished(t, pub, "build.finished")
+	if payload.Build.ID != webhooktest.DefaultBuildID || payload.Build.Pipeline != "deploy" {
+		t.Errorf("published build = %+v, want %s on deploy", payload.Build, webhooktest.DefaultBuildID)
+	}
+	webhooktest.AssertPublishedCount(t, pub, 1)
+	webhooktest.AssertAttributes(t, pub, map[string]string{"pipeline": "deploy", "build_state": "passed"})
+	webhooktest.AssertCounter(t, reg, "buildkite_webhook_requests_total", map[string]string{"status": "200", "event_type": "build.finished"}, 1)
+	webhooktest.AssertCounter(t, reg, "buildkite_webhook_auth_failures_total", nil, 1)
+}
+
+func TestSignedRequest(t *testing.T) {
+	webhooktest.NewRegistry(t)
+	pub := webhooktest.NewPublisher()
+	handler := webhook.NewHandler(webhook.Config{
+		HMACSecret: "secret",
+		Publisher:  pub,
+	})
+
+	body := webhooktest.Payload("agent.connected", webhooktest.WithAgentQueue("gpu"))
+	if w := webhooktest.Serve(handler, webhooktest.NewSignedRequest("", "secret", body)); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	expired := webhooktest.NewSignedRequestAt("", "secret", body, time.Now().Add(-time.Hour))
+	if w := webhooktest.Serve(handler, expired); w.Code != http.StatusUnauthorized {
+		t.Errorf("status with expired signature = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	payload := webhooktest.AssertPublished(t, pub, "agent.connected")
+	if payload.Agent == nil || payload.Agent.QueueName != "gpu" {
+		t.Errorf("published agent = %+v, want queue gpu", payload.Agent)
+	}
+	webhooktest.AssertPublishedCount(t, pub, 1)
+}